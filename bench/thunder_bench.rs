@@ -5,7 +5,8 @@
 
 use std::fs;
 use std::time::Instant;
-use thunder::{Database, DatabaseOptions};
+use thunder::overflow::OverflowManager;
+use thunder::{Database, DatabaseOptions, FreelistType, PageSizeConfig, TruncateSequence};
 
 const NUM_KEYS: usize = 100_000;
 const VALUE_SIZE: usize = 100;
@@ -46,6 +47,23 @@ fn run_benchmarks(db_path: &str) {
 
     // Large value benchmarks
     bench_large_values(db_path);
+    bench_page_size_large_values(db_path);
+
+    // Multi-get probes that mostly miss
+    bench_multi_get_misses(db_path);
+    bench_bucket_get_many(db_path);
+    bench_keys_only_scan(db_path);
+    bench_keys_only_large_values(db_path);
+    bench_put_vs_set(db_path);
+
+    // Absent-key lookups with and without a bucket Bloom filter
+    bench_bucket_bloom_misses(db_path);
+    bench_truncate_bucket(db_path);
+    bench_bucket_bulk_load(db_path);
+    bench_freelist_allocation();
+    bench_in_memory_vs_file(db_path);
+    bench_committed_only_reads(db_path);
+    bench_iter_skip_vs_next(db_path);
 }
 
 fn bench_sequential_writes(db_path: &str) {
@@ -272,3 +290,669 @@ fn bench_large_values(db_path: &str) {
         );
     }
 }
+
+fn bench_page_size_large_values(db_path: &str) {
+    const NUM_LARGE: usize = 100;
+    let value = vec![b'x'; 1024 * 1024];
+
+    for page_size in [PageSizeConfig::Size4K, PageSizeConfig::Size64K] {
+        let _ = fs::remove_file(db_path);
+
+        let options = DatabaseOptions {
+            page_size,
+            ..Default::default()
+        };
+        let mut db = Database::open_with_options(db_path, options).expect("open should succeed");
+
+        let start = Instant::now();
+        {
+            let mut wtx = db.write_tx();
+            for i in 0..NUM_LARGE {
+                let key = format!("large_{i:04}");
+                wtx.put(key.as_bytes(), &value);
+            }
+            wtx.commit().expect("commit should succeed");
+        }
+        let elapsed = start.elapsed();
+
+        let mb_per_sec = NUM_LARGE as f64 / elapsed.as_secs_f64();
+        println!(
+            "Large values ({} × 1MB, {}KB pages): {:?} ({:.1} MB/sec)",
+            NUM_LARGE,
+            page_size.as_usize() / 1024,
+            elapsed,
+            mb_per_sec
+        );
+    }
+}
+
+fn bench_multi_get_misses(db_path: &str) {
+    let _ = fs::remove_file(db_path);
+
+    let mut db = Database::open(db_path).expect("open should succeed");
+    let value = vec![b'v'; VALUE_SIZE];
+
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"probe")
+            .expect("create bucket should succeed");
+        for i in 0..NUM_KEYS {
+            let key = format!("key_{i:08}");
+            wtx.bucket_put(b"probe", key.as_bytes(), &value)
+                .expect("put should succeed");
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+
+    // 90% of the probes miss: one in ten lands on a stored key.
+    let keys: Vec<String> = (0..NUM_KEYS)
+        .map(|i| {
+            let n = (i * 7919 + 104729) % NUM_KEYS;
+            if i % 10 == 0 {
+                format!("key_{n:08}")
+            } else {
+                format!("miss_{n:08}")
+            }
+        })
+        .collect();
+    let requests: Vec<(&[u8], &[u8])> =
+        keys.iter().map(|k| (&b"probe"[..], k.as_bytes())).collect();
+
+    let rtx = db.read_tx();
+
+    let start = Instant::now();
+    let bucket = rtx.bucket(b"probe").expect("bucket should exist");
+    let unfiltered = requests
+        .iter()
+        .filter(|(_, key)| bucket.get(key).is_some())
+        .count();
+    let unfiltered_elapsed = start.elapsed();
+
+    let start = Instant::now();
+    let filtered = rtx
+        .multi_bucket_get(&requests)
+        .expect("multi get should succeed")
+        .iter()
+        .filter(|v| v.is_some())
+        .count();
+    let filtered_elapsed = start.elapsed();
+    assert_eq!(filtered, unfiltered);
+
+    println!(
+        "Multi-get, 90% misses ({}K lookups): unfiltered {:?} ({:.0} ops/sec), bloom-filtered {:?} ({:.0} ops/sec)",
+        NUM_KEYS / 1000,
+        unfiltered_elapsed,
+        NUM_KEYS as f64 / unfiltered_elapsed.as_secs_f64(),
+        filtered_elapsed,
+        NUM_KEYS as f64 / filtered_elapsed.as_secs_f64()
+    );
+}
+
+fn bench_bucket_get_many(db_path: &str) {
+    const LOOKUPS: usize = 10_000;
+
+    let _ = fs::remove_file(db_path);
+
+    let mut db = Database::open(db_path).expect("open should succeed");
+    let value = vec![b'v'; VALUE_SIZE];
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"probe")
+            .expect("create bucket should succeed");
+        for i in 0..NUM_KEYS {
+            let key = format!("key_{i:08}");
+            wtx.bucket_put(b"probe", key.as_bytes(), &value)
+                .expect("put should succeed");
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let mut state = 0x9E37_79B9_7F4A_7C15u64;
+    let keys: Vec<Vec<u8>> = (0..LOOKUPS)
+        .map(|_| {
+            state ^= state << 13;
+            state ^= state >> 7;
+            state ^= state << 17;
+            format!("key_{:08}", state % NUM_KEYS as u64).into_bytes()
+        })
+        .collect();
+
+    let rtx = db.read_tx();
+    let bucket = rtx.bucket(b"probe").expect("bucket should exist");
+
+    let start = Instant::now();
+    let looped: Vec<_> = keys.iter().map(|key| bucket.get(key)).collect();
+    let looped_elapsed = start.elapsed();
+
+    let start = Instant::now();
+    let batched = bucket.get_many(&keys);
+    let batched_elapsed = start.elapsed();
+    assert_eq!(batched, looped);
+
+    println!(
+        "Bucket get_many ({}K random keys): get loop {:?} ({:.0} ops/sec), get_many {:?} ({:.0} ops/sec)",
+        LOOKUPS / 1000,
+        looped_elapsed,
+        LOOKUPS as f64 / looped_elapsed.as_secs_f64(),
+        batched_elapsed,
+        LOOKUPS as f64 / batched_elapsed.as_secs_f64()
+    );
+}
+
+fn bench_keys_only_scan(db_path: &str) {
+    let _ = fs::remove_file(db_path);
+
+    let mut db = Database::open(db_path).expect("open should succeed");
+    let value = vec![b'v'; VALUE_SIZE];
+
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"scan")
+            .expect("create bucket should succeed");
+        for i in 0..NUM_KEYS {
+            let key = format!("key_{i:08}");
+            wtx.bucket_put(b"scan", key.as_bytes(), &value)
+                .expect("put should succeed");
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let rtx = db.read_tx();
+    let bucket = rtx.bucket(b"scan").expect("bucket should exist");
+
+    // Entries scan: touches each key and value.
+    let start = Instant::now();
+    let mut entry_bytes = 0usize;
+    for (key, value) in bucket.iter() {
+        entry_bytes += key.len() + value.len();
+        std::hint::black_box(value.last());
+    }
+    let entries_elapsed = start.elapsed();
+
+    // Keys-only scan: values are never read.
+    let start = Instant::now();
+    let mut key_bytes = 0usize;
+    for key in bucket.keys() {
+        key_bytes += key.len();
+        std::hint::black_box(key.last());
+    }
+    let keys_elapsed = start.elapsed();
+
+    println!(
+        "Keys-only scan ({}K keys): entries {:?} ({} KB touched), keys only {:?} ({} KB touched)",
+        NUM_KEYS / 1000,
+        entries_elapsed,
+        entry_bytes / 1024,
+        keys_elapsed,
+        key_bytes / 1024
+    );
+}
+
+fn bench_keys_only_large_values(db_path: &str) {
+    const LARGE_KEYS: usize = 200;
+    const LARGE_VALUE_SIZE: usize = 1024 * 1024;
+    let _ = fs::remove_file(db_path);
+
+    {
+        let mut db = Database::open(db_path).expect("open should succeed");
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"blobs")
+            .expect("create bucket should succeed");
+        for i in 0..LARGE_KEYS {
+            let key = format!("blob_{i:06}");
+            let value = vec![i as u8; LARGE_VALUE_SIZE];
+            wtx.bucket_put(b"blobs", key.as_bytes(), &value)
+                .expect("put should succeed");
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let db = Database::open(db_path).expect("reopen should succeed");
+    let rtx = db.read_tx();
+    let bucket = rtx.bucket(b"blobs").expect("bucket should exist");
+
+    // Full iteration: each value is read, as a consumer of it would.
+    let start = Instant::now();
+    let mut checksum = 0u64;
+    bucket
+        .for_each(|key, value| {
+            checksum = checksum.wrapping_add(key.len() as u64);
+            checksum = value
+                .iter()
+                .fold(checksum, |sum, &b| sum.wrapping_add(b as u64));
+            Ok(())
+        })
+        .expect("scan should succeed");
+    std::hint::black_box(checksum);
+    let full = start.elapsed();
+
+    // Keys only: values are never touched.
+    let start = Instant::now();
+    let mut count = 0usize;
+    bucket
+        .for_each_key(|key| {
+            count += 1;
+            std::hint::black_box(key.last());
+            Ok(())
+        })
+        .expect("scan should succeed");
+    let keys_only = start.elapsed();
+    assert_eq!(count, LARGE_KEYS);
+
+    println!(
+        "Keys-only scan ({LARGE_KEYS} x 1MB values): for_each {:?}, for_each_key {:?} ({:.0}x)",
+        full,
+        keys_only,
+        full.as_secs_f64() / keys_only.as_secs_f64()
+    );
+}
+
+fn bench_put_vs_set(db_path: &str) {
+    let _ = fs::remove_file(db_path);
+
+    const HOT_KEYS: usize = 1_000;
+    let rounds = NUM_KEYS / HOT_KEYS;
+    let mut db = Database::open(db_path).expect("open should succeed");
+    let value = vec![b'v'; VALUE_SIZE];
+    let keys: Vec<String> = (0..HOT_KEYS).map(|i| format!("key_{i:08}")).collect();
+
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"hot")
+            .expect("create bucket should succeed");
+        for key in &keys {
+            wtx.bucket_put(b"hot", key.as_bytes(), &value)
+                .expect("put should succeed");
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+
+    // Overwrite the same keys repeatedly, first with put, then with set.
+    let start = Instant::now();
+    {
+        let mut wtx = db.write_tx();
+        for _ in 0..rounds {
+            for key in &keys {
+                wtx.bucket_put(b"hot", key.as_bytes(), &value)
+                    .expect("put should succeed");
+            }
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+    let put_elapsed = start.elapsed();
+
+    let start = Instant::now();
+    {
+        let mut wtx = db.write_tx();
+        for _ in 0..rounds {
+            for key in &keys {
+                wtx.bucket_set(b"hot", key.as_bytes(), &value)
+                    .expect("set should succeed");
+            }
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+    let set_elapsed = start.elapsed();
+
+    let ops = (rounds * HOT_KEYS) as f64;
+    println!(
+        "Overwrites ({}K keys x {} rounds): put {:?} ({:.0} ops/sec), set {:?} ({:.0} ops/sec)",
+        HOT_KEYS / 1000,
+        rounds,
+        put_elapsed,
+        ops / put_elapsed.as_secs_f64(),
+        set_elapsed,
+        ops / set_elapsed.as_secs_f64()
+    );
+}
+
+fn bench_bucket_bloom_misses(db_path: &str) {
+    let _ = fs::remove_file(db_path);
+
+    const BLOOM_KEYS: usize = 1_000_000;
+    let mut db = Database::open(db_path).expect("open should succeed");
+    let value = vec![b'v'; VALUE_SIZE];
+
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"plain")
+            .expect("create bucket should succeed");
+        wtx.create_bucket(b"bloom")
+            .expect("create bucket should succeed");
+        wtx.set_bucket_bloom(b"bloom", 10)
+            .expect("set bloom should succeed");
+        for i in 0..BLOOM_KEYS {
+            let key = format!("key_{i:08}");
+            wtx.bucket_put(b"plain", key.as_bytes(), &value)
+                .expect("put should succeed");
+            wtx.bucket_put(b"bloom", key.as_bytes(), &value)
+                .expect("put should succeed");
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+
+    // Every probe misses.
+    let probes: Vec<String> = (0..NUM_KEYS)
+        .map(|i| format!("miss_{:08}", (i * 7919 + 104729) % BLOOM_KEYS))
+        .collect();
+    let rtx = db.read_tx();
+
+    let mut results = Vec::new();
+    for name in [&b"plain"[..], &b"bloom"[..]] {
+        let bucket = rtx.bucket(name).expect("bucket should exist");
+        let start = Instant::now();
+        let found = probes
+            .iter()
+            .filter(|key| bucket.get(key.as_bytes()).is_some())
+            .count();
+        assert_eq!(found, 0);
+        results.push(start.elapsed());
+    }
+
+    println!(
+        "Negative lookups ({}K probes, {}M-key bucket): no filter {:?} ({:.0} ops/sec), bloom filter {:?} ({:.0} ops/sec)",
+        NUM_KEYS / 1000,
+        BLOOM_KEYS / 1_000_000,
+        results[0],
+        NUM_KEYS as f64 / results[0].as_secs_f64(),
+        results[1],
+        NUM_KEYS as f64 / results[1].as_secs_f64()
+    );
+}
+
+fn bench_truncate_bucket(db_path: &str) {
+    let _ = fs::remove_file(db_path);
+
+    const TRUNCATE_KEYS: usize = 1_000_000;
+    // Staging a delete checks the deletes already staged, so deleting
+    // the whole bucket key by key would take hours; time a slice instead.
+    const PER_KEY_DELETES: usize = 50_000;
+    let mut db = Database::open(db_path).expect("open should succeed");
+    let value = vec![b'v'; VALUE_SIZE];
+    let keys: Vec<String> = (0..TRUNCATE_KEYS).map(|i| format!("key_{i:08}")).collect();
+
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"big")
+            .expect("create bucket should succeed");
+        for key in &keys {
+            wtx.bucket_put(b"big", key.as_bytes(), &value)
+                .expect("put should succeed");
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+    let before = db.stats();
+
+    let start = Instant::now();
+    {
+        let mut wtx = db.write_tx();
+        for key in &keys[..PER_KEY_DELETES] {
+            wtx.bucket_delete(b"big", key.as_bytes())
+                .expect("delete should succeed");
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+    let per_key = start.elapsed();
+
+    let start = Instant::now();
+    {
+        let mut wtx = db.write_tx();
+        wtx.truncate_bucket(b"big", TruncateSequence::Keep)
+            .expect("truncate should succeed");
+        wtx.commit().expect("commit should succeed");
+    }
+    let truncate = start.elapsed();
+    let after = db.stats();
+
+    println!(
+        "Emptying a {}M-key bucket: per-key deletes of {}K keys {:?}, truncate {:?}; data size {} MB -> {} MB",
+        TRUNCATE_KEYS / 1_000_000,
+        PER_KEY_DELETES / 1000,
+        per_key,
+        truncate,
+        before.data_size / 1_000_000,
+        after.data_size / 1_000_000
+    );
+}
+
+fn bench_bucket_bulk_load(db_path: &str) {
+    const LOAD_KEYS: usize = 1_000_000;
+    let value = vec![b'v'; VALUE_SIZE];
+    let keys: Vec<String> = (0..LOAD_KEYS).map(|i| format!("key_{i:08}")).collect();
+
+    let _ = fs::remove_file(db_path);
+    let mut db = Database::open(db_path).expect("open should succeed");
+    let start = Instant::now();
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"import")
+            .expect("create bucket should succeed");
+        for key in &keys {
+            wtx.bucket_put(b"import", key.as_bytes(), &value)
+                .expect("put should succeed");
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+    let per_key = start.elapsed();
+    drop(db);
+
+    let _ = fs::remove_file(db_path);
+    let mut db = Database::open(db_path).expect("open should succeed");
+    let start = Instant::now();
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"import")
+            .expect("create bucket should succeed");
+        wtx.bucket_bulk_load(b"import", keys.iter().map(|key| (key, &value)))
+            .expect("bulk load should succeed");
+        wtx.commit().expect("commit should succeed");
+    }
+    let bulk = start.elapsed();
+
+    println!(
+        "Importing {}M sorted keys: per-key puts {:?}, bulk load {:?} ({:.2}x)",
+        LOAD_KEYS / 1_000_000,
+        per_key,
+        bulk,
+        per_key.as_secs_f64() / bulk.as_secs_f64()
+    );
+}
+
+fn bench_freelist_allocation() {
+    const SCATTERED_PAGES: u64 = 200_000;
+    const RUNS: u64 = 2_000;
+    const RUN_LEN: usize = 4;
+
+    // Isolated free pages in release order, with the only runs long
+    // enough for a 4-page value at the end of the file.
+    let mut freed: Vec<u64> = (0..SCATTERED_PAGES).map(|i| i * 2).collect();
+    freed.extend((0..RUNS).flat_map(|run| {
+        let start = 1_000_000 + run * (RUN_LEN as u64 + 1);
+        start..start + RUN_LEN as u64
+    }));
+    let mut state = 0x9E37_79B9_7F4A_7C15u64;
+    for i in (1..freed.len()).rev() {
+        state ^= state << 13;
+        state ^= state >> 7;
+        state ^= state << 17;
+        freed.swap(i, (state % (i as u64 + 1)) as usize);
+    }
+
+    for kind in [FreelistType::Array, FreelistType::HashMap] {
+        let mut mgr = OverflowManager::new(4096, 2_000_000).with_freelist(kind);
+        let start = Instant::now();
+        for &page in &freed {
+            mgr.free_page(page);
+        }
+        mgr.coalesce_free_pages();
+        let mut reused = 0;
+        for _ in 0..RUNS {
+            if mgr.alloc_contiguous_pages(RUN_LEN) < 2_000_000 {
+                reused += 1;
+            }
+        }
+        let elapsed = start.elapsed();
+
+        println!(
+            "Freelist {:?}: {} pages freed, {} {}-page runs allocated ({} reused) in {:?} ({:.0} runs/sec)",
+            kind,
+            freed.len(),
+            RUNS,
+            RUN_LEN,
+            reused,
+            elapsed,
+            RUNS as f64 / elapsed.as_secs_f64()
+        );
+    }
+}
+
+fn bench_in_memory_vs_file(db_path: &str) {
+    let _ = fs::remove_file(db_path);
+
+    let value = vec![b'v'; VALUE_SIZE];
+    let run = |db: &mut Database| {
+        let start = Instant::now();
+        for batch in 0..BATCH_TXS {
+            let mut wtx = db.write_tx();
+            for i in 0..BATCH_SIZE {
+                let key = format!("key_{:08}", batch * BATCH_SIZE + i);
+                wtx.put(key.as_bytes(), &value);
+            }
+            wtx.commit().expect("commit should succeed");
+        }
+        let writes = start.elapsed();
+
+        let start = Instant::now();
+        let rtx = db.read_tx();
+        for i in 0..BATCH_TXS * BATCH_SIZE {
+            let key = format!("key_{i:08}");
+            assert!(rtx.get(key.as_bytes()).is_some());
+        }
+        (writes, start.elapsed())
+    };
+
+    let mut file_db = Database::open(db_path).expect("open should succeed");
+    let (file_writes, file_reads) = run(&mut file_db);
+    drop(file_db);
+    let _ = fs::remove_file(db_path);
+
+    let mut memory_db = Database::open_in_memory().expect("open should succeed");
+    let (memory_writes, memory_reads) = run(&mut memory_db);
+
+    let ops = (BATCH_TXS * BATCH_SIZE) as f64;
+    println!(
+        "In-memory vs file ({} txs x {} keys): writes file {:?} ({:.0} ops/sec), memory {:?} ({:.0} ops/sec); reads file {:?}, memory {:?}",
+        BATCH_TXS,
+        BATCH_SIZE,
+        file_writes,
+        ops / file_writes.as_secs_f64(),
+        memory_writes,
+        ops / memory_writes.as_secs_f64(),
+        file_reads,
+        memory_reads
+    );
+}
+
+fn bench_committed_only_reads(db_path: &str) {
+    let _ = fs::remove_file(db_path);
+
+    const PENDING_DELETES: usize = NUM_KEYS / 10;
+    let mut db = Database::open(db_path).expect("open should succeed");
+    let value = vec![b'v'; VALUE_SIZE];
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"data")
+            .expect("create bucket should succeed");
+        for i in 0..NUM_KEYS {
+            wtx.bucket_put(b"data", format!("key_{i:08}").as_bytes(), &value)
+                .expect("put should succeed");
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+
+    // Reads of an untouched range while many deletions are pending.
+    let run = |db: &mut Database, read_your_writes: bool| {
+        let mut wtx = db.write_tx();
+        if !read_your_writes {
+            wtx.disable_read_your_writes();
+        }
+        for i in 0..PENDING_DELETES {
+            wtx.bucket_delete(b"data", format!("key_{i:08}").as_bytes())
+                .expect("delete should succeed");
+        }
+        let start = Instant::now();
+        for i in PENDING_DELETES..NUM_KEYS {
+            assert!(wtx
+                .bucket_get(b"data", format!("key_{i:08}").as_bytes())
+                .expect("get should succeed")
+                .is_some());
+        }
+        let elapsed = start.elapsed();
+        wtx.rollback();
+        elapsed
+    };
+    let merged = run(&mut db, true);
+    let committed = run(&mut db, false);
+
+    let ops = (NUM_KEYS - PENDING_DELETES) as f64;
+    println!(
+        "Reads with {}K pending deletes: read-your-writes {:?} ({:.0} ops/sec), committed-only {:?} ({:.0} ops/sec)",
+        PENDING_DELETES / 1000,
+        merged,
+        ops / merged.as_secs_f64(),
+        committed,
+        ops / committed.as_secs_f64()
+    );
+}
+
+fn bench_iter_skip_vs_next(db_path: &str) {
+    let _ = fs::remove_file(db_path);
+
+    const SKIP: usize = 1000;
+    let mut db = Database::open(db_path).expect("open should succeed");
+    let value = vec![b'v'; VALUE_SIZE];
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"data")
+            .expect("create bucket should succeed");
+        for i in 0..NUM_KEYS {
+            wtx.bucket_put(b"data", format!("key_{i:08}").as_bytes(), &value)
+                .expect("put should succeed");
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let rtx = db.read_tx();
+    let bucket = rtx.bucket(b"data").expect("bucket should exist");
+
+    let start = Instant::now();
+    let mut iter = bucket.iter();
+    let mut skipped = 0;
+    while iter.nth(SKIP - 1).is_some() {
+        skipped += 1;
+    }
+    let skip_elapsed = start.elapsed();
+
+    let start = Instant::now();
+    let mut iter = bucket.iter();
+    let mut stepped = 0;
+    'outer: loop {
+        for _ in 0..SKIP {
+            if iter.next().is_none() {
+                break 'outer;
+            }
+        }
+        stepped += 1;
+    }
+    let next_elapsed = start.elapsed();
+    assert_eq!(skipped, stepped);
+
+    println!(
+        "Skipping {} hops of {} keys: nth {:?}, next loop {:?} ({:.2}x)",
+        skipped,
+        SKIP,
+        skip_elapsed,
+        next_elapsed,
+        next_elapsed.as_secs_f64() / skip_elapsed.as_secs_f64()
+    );
+}
@@ -0,0 +1,391 @@
+//! Summary: Audit log of committed mutations written to an external sink.
+//! Copyright (c) YOAB. All rights reserved.
+//!
+//! When `DatabaseOptions::audit_writer` is set, every write transaction
+//! writes one [`AuditRecord`] describing its mutations to the writer
+//! before any of them is applied, and flushes it before `commit()`
+//! returns. The audit log is for external auditing only; it is not read
+//! back by the database and plays no part in recovery.
+//!
+//! # Ordering
+//!
+//! A record lists operations in the order the commit applies them:
+//! deletions in the order they were issued, then puts in the order of
+//! their stored keys, which groups bucket entries by bucket ahead of
+//! top-level keys. A transaction buffers its net effect, so a key written several times
+//! appears once with its final value, and a put followed by a delete of
+//! the same key appears as the delete alone.
+//!
+//! Internal bookkeeping entries (bucket headers, checksums, original keys
+//! and insertion order) are not reported. Deleting a bucket reports a delete for each
+//! key it held.
+//!
+//! # Failure Semantics
+//!
+//! If writing or flushing the record fails, the commit fails with
+//! `AuditWrite` and nothing is applied. Because the record is written
+//! ahead, a commit that fails afterwards, while persisting, leaves a record
+//! for a version that was never committed. Transactions that are rolled
+//! back or dropped write nothing.
+//!
+//! # Format
+//!
+//! Records are framed as `[len:u32][crc32:u32][payload]`, where `len` is
+//! the payload length and the CRC covers the payload:
+//!
+//! ```text
+//! payload = [version:u64][timestamp_micros:u64][op_count:u32][op...]
+//! op      = [kind:u8][depth:u8]([name_len:u8][name])*[key_len:u32][key]
+//!           [value_len:u32][value]    (puts only)
+//! ```
+//!
+//! `kind` is 1 for a put and 2 for a delete; `depth` is the number of
+//! bucket path components, 0 for top-level keys. All integers are little
+//! endian.
+
+use std::fmt;
+use std::io::{self, Write};
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+use crate::bucket;
+use crate::checksum;
+use crate::error::{Error, Result};
+use crate::expiry;
+use crate::normalize;
+
+/// Size of the record frame header.
+const FRAME_HEADER_SIZE: usize = 8;
+
+/// Operation kind byte for a put.
+const OP_PUT: u8 = 1;
+
+/// Operation kind byte for a delete.
+const OP_DELETE: u8 = 2;
+
+/// A shared sink receiving audit records.
+///
+/// Cloning is cheap (reference counted); clones write to the same sink,
+/// so one writer can be shared by several databases.
+///
+/// # Example
+///
+/// ```ignore
+/// let log = OpenOptions::new().append(true).create(true).open("audit.log")?;
+/// let options = DatabaseOptions {
+///     audit_writer: Some(AuditWriter::new(log)),
+///     ..DatabaseOptions::default()
+/// };
+/// ```
+#[derive(Clone)]
+pub struct AuditWriter(Arc<Mutex<dyn Write + Send>>);
+
+impl AuditWriter {
+    /// Creates an audit writer forwarding records to `writer`.
+    pub fn new<W>(writer: W) -> Self
+    where
+        W: Write + Send + 'static,
+    {
+        Self(Arc::new(Mutex::new(writer)))
+    }
+
+    /// Writes `record` and flushes the sink.
+    ///
+    /// # Errors
+    ///
+    /// Returns the I/O error reported by the sink.
+    pub fn write_record(&self, record: &AuditRecord) -> io::Result<()> {
+        let frame = record.encode();
+        let mut writer = self.0.lock().unwrap_or_else(|e| e.into_inner());
+        writer.write_all(&frame)?;
+        writer.flush()
+    }
+}
+
+impl fmt::Debug for AuditWriter {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str("AuditWriter")
+    }
+}
+
+/// A single mutation reported in an audit record.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum AuditOp {
+    /// A key was inserted or updated.
+    Put {
+        /// Bucket path, empty for top-level keys.
+        bucket: Vec<Vec<u8>>,
+        key: Vec<u8>,
+        value: Vec<u8>,
+    },
+    /// A key was deleted.
+    Delete {
+        /// Bucket path, empty for top-level keys.
+        bucket: Vec<Vec<u8>>,
+        key: Vec<u8>,
+    },
+}
+
+impl AuditOp {
+    /// Describes a write of the internal key `key`.
+    ///
+    /// Returns `None` for internal bookkeeping entries.
+    pub(crate) fn from_internal(key: &[u8], value: Option<&[u8]>) -> Option<Self> {
+        let (path, key) = user_key_of(key)?;
+        let bucket = path.into_iter().map(<[u8]>::to_vec).collect();
+        let key = key.to_vec();
+        Some(match value {
+            Some(value) => AuditOp::Put {
+                bucket,
+                key,
+                value: value.to_vec(),
+            },
+            None => AuditOp::Delete { bucket, key },
+        })
+    }
+}
+
+/// Splits the internal key `key` into its bucket path, empty for
+/// top-level keys, and the key the user wrote.
+///
+/// Returns `None` for internal bookkeeping entries.
+pub(crate) fn user_key_of(key: &[u8]) -> Option<(Vec<&[u8]>, &[u8])> {
+    match bucket::split_data_key(key) {
+        Some(split) => Some(split),
+        None if bucket::is_bucket_meta_key(key)
+            || bucket::is_nested_bucket_meta_key(key)
+            || bucket::is_bucket_order_key(key)
+            || checksum::is_checksum_key(key)
+            || expiry::is_expiry_key(key)
+            || normalize::is_original_key_entry(key) =>
+        {
+            None
+        }
+        None => Some((Vec::new(), key)),
+    }
+}
+
+/// The mutations committed by one write transaction.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct AuditRecord {
+    /// The version the transaction commits as.
+    pub version: u64,
+    /// When the transaction committed, at microsecond precision.
+    pub timestamp: SystemTime,
+    /// The operations, in the order they are applied.
+    pub ops: Vec<AuditOp>,
+}
+
+impl AuditRecord {
+    /// Encodes the record as a framed byte string.
+    pub fn encode(&self) -> Vec<u8> {
+        let micros = self
+            .timestamp
+            .duration_since(UNIX_EPOCH)
+            .map_or(0, |d| d.as_micros() as u64);
+
+        let mut payload = Vec::new();
+        payload.extend_from_slice(&self.version.to_le_bytes());
+        payload.extend_from_slice(&micros.to_le_bytes());
+        payload.extend_from_slice(&(self.ops.len() as u32).to_le_bytes());
+        for op in &self.ops {
+            let (kind, bucket, key, value) = match op {
+                AuditOp::Put { bucket, key, value } => (OP_PUT, bucket, key, Some(value)),
+                AuditOp::Delete { bucket, key } => (OP_DELETE, bucket, key, None),
+            };
+            payload.push(kind);
+            payload.push(bucket.len() as u8);
+            for name in bucket {
+                payload.push(name.len() as u8);
+                payload.extend_from_slice(name);
+            }
+            payload.extend_from_slice(&(key.len() as u32).to_le_bytes());
+            payload.extend_from_slice(key);
+            if let Some(value) = value {
+                payload.extend_from_slice(&(value.len() as u32).to_le_bytes());
+                payload.extend_from_slice(value);
+            }
+        }
+
+        let mut frame = Vec::with_capacity(FRAME_HEADER_SIZE + payload.len());
+        frame.extend_from_slice(&(payload.len() as u32).to_le_bytes());
+        frame.extend_from_slice(&crc32fast::hash(&payload).to_le_bytes());
+        frame.extend_from_slice(&payload);
+        frame
+    }
+
+    /// Decodes one framed record from the start of `data`.
+    ///
+    /// Returns the record and the number of bytes consumed.
+    ///
+    /// # Errors
+    ///
+    /// Returns `Corrupted` if the frame is truncated, fails its checksum,
+    /// or holds a malformed payload.
+    pub fn decode(data: &[u8]) -> Result<(Self, usize)> {
+        let mut frame = Reader { data, pos: 0 };
+        let len = frame.u32()? as usize;
+        let crc = frame.u32()?;
+        let payload = frame.bytes(len)?;
+        if crc32fast::hash(payload) != crc {
+            return Err(corrupted("audit record checksum mismatch"));
+        }
+
+        let mut reader = Reader {
+            data: payload,
+            pos: 0,
+        };
+        let version = reader.u64()?;
+        let timestamp = UNIX_EPOCH + Duration::from_micros(reader.u64()?);
+        let op_count = reader.u32()?;
+        let mut ops = Vec::new();
+        for _ in 0..op_count {
+            let kind = reader.u8()?;
+            let depth = reader.u8()?;
+            let mut bucket = Vec::with_capacity(depth as usize);
+            for _ in 0..depth {
+                let name_len = reader.u8()? as usize;
+                bucket.push(reader.bytes(name_len)?.to_vec());
+            }
+            let key_len = reader.u32()? as usize;
+            let key = reader.bytes(key_len)?.to_vec();
+            ops.push(match kind {
+                OP_PUT => {
+                    let value_len = reader.u32()? as usize;
+                    let value = reader.bytes(value_len)?.to_vec();
+                    AuditOp::Put { bucket, key, value }
+                }
+                OP_DELETE => AuditOp::Delete { bucket, key },
+                _ => return Err(corrupted("unknown audit operation kind")),
+            });
+        }
+        if reader.pos != payload.len() {
+            return Err(corrupted("trailing bytes in audit record"));
+        }
+
+        Ok((
+            Self {
+                version,
+                timestamp,
+                ops,
+            },
+            frame.pos,
+        ))
+    }
+
+    /// Decodes every record in a captured audit stream.
+    ///
+    /// # Errors
+    ///
+    /// Returns `Corrupted` if any record is truncated or malformed.
+    pub fn decode_all(mut data: &[u8]) -> Result<Vec<Self>> {
+        let mut records = Vec::new();
+        while !data.is_empty() {
+            let (record, consumed) = Self::decode(data)?;
+            records.push(record);
+            data = &data[consumed..];
+        }
+        Ok(records)
+    }
+}
+
+fn corrupted(details: &str) -> Error {
+    Error::Corrupted {
+        context: "decoding audit record",
+        details: details.to_string(),
+    }
+}
+
+/// Bounds-checked cursor over an encoded record.
+struct Reader<'a> {
+    data: &'a [u8],
+    pos: usize,
+}
+
+impl<'a> Reader<'a> {
+    fn bytes(&mut self, len: usize) -> Result<&'a [u8]> {
+        let bytes = self
+            .data
+            .get(self.pos..self.pos + len)
+            .ok_or_else(|| corrupted("audit record is truncated"))?;
+        self.pos += len;
+        Ok(bytes)
+    }
+
+    fn u8(&mut self) -> Result<u8> {
+        Ok(self.bytes(1)?[0])
+    }
+
+    fn u32(&mut self) -> Result<u32> {
+        Ok(u32::from_le_bytes(self.bytes(4)?.try_into().unwrap()))
+    }
+
+    fn u64(&mut self) -> Result<u64> {
+        Ok(u64::from_le_bytes(self.bytes(8)?.try_into().unwrap()))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_record_roundtrip_and_corruption() {
+        let record = AuditRecord {
+            version: 7,
+            timestamp: UNIX_EPOCH + Duration::from_micros(1_234_567),
+            ops: vec![
+                AuditOp::Delete {
+                    bucket: Vec::new(),
+                    key: b"old".to_vec(),
+                },
+                AuditOp::Put {
+                    bucket: vec![b"parent".to_vec(), b"child".to_vec()],
+                    key: b"k".to_vec(),
+                    value: b"v".to_vec(),
+                },
+            ],
+        };
+        let mut stream = record.encode();
+        stream.extend_from_slice(&record.encode());
+
+        let decoded = AuditRecord::decode_all(&stream).unwrap();
+        assert_eq!(decoded, vec![record.clone(), record]);
+
+        let last = stream.len() - 1;
+        stream[last] ^= 0xFF;
+        assert!(matches!(
+            AuditRecord::decode_all(&stream),
+            Err(Error::Corrupted { .. })
+        ));
+        assert!(AuditRecord::decode(&stream[..5]).is_err());
+    }
+
+    #[test]
+    fn test_op_from_internal_key() {
+        let data_key = bucket::bucket_data_key(b"users", b"alice");
+        assert_eq!(
+            AuditOp::from_internal(&data_key, None),
+            Some(AuditOp::Delete {
+                bucket: vec![b"users".to_vec()],
+                key: b"alice".to_vec(),
+            })
+        );
+        assert_eq!(
+            AuditOp::from_internal(b"plain", Some(b"1")),
+            Some(AuditOp::Put {
+                bucket: Vec::new(),
+                key: b"plain".to_vec(),
+                value: b"1".to_vec(),
+            })
+        );
+        assert_eq!(
+            AuditOp::from_internal(&bucket::bucket_meta_key(b"users"), Some(b"")),
+            None
+        );
+        assert_eq!(
+            AuditOp::from_internal(&checksum::checksum_key(&data_key), Some(b"")),
+            None
+        );
+    }
+}
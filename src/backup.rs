@@ -0,0 +1,170 @@
+//! Summary: Hot backups streamed to any writer.
+//! Copyright (c) YOAB. All rights reserved.
+//!
+//! A backup writes a consistent copy of the database, as a complete
+//! database file, to an `io::Write` such as a file, socket or compressor.
+//! Like compaction it runs in two steps so writers are never held up:
+//!
+//! 1. `Database::begin_backup()` captures the committed tree. It only needs
+//!    a shared borrow and is O(1).
+//! 2. [`Backup::write_to()`] writes the captured version. It does not
+//!    borrow the database, so transactions, commits included, continue on
+//!    other threads while it runs.
+//!
+//! `Database::write_to()` performs both steps in one call, and
+//! `Database::compact_to()` does the same for a new file.
+//!
+//! # Format
+//!
+//! The stream is a database file holding the captured version, written
+//! the way compaction writes, so it contains no superseded entries and is
+//! usually smaller than the live file. Writing it to a file yields a
+//! database `Database::open()` accepts. The file is first written to a
+//! temporary file next to the database (`<path>.backup-*`), then copied
+//! to the writer; the temporary file is removed afterwards.
+//! [`Backup::write_to_path()`] writes the new file directly instead.
+
+use std::fs::{self, File};
+use std::io::{self, Write};
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
+use std::sync::atomic::{AtomicU64, Ordering};
+
+use crate::btree::BTree;
+use crate::db::{Database, DatabaseOptions};
+use crate::error::{Error, Result};
+
+/// Distinguishes the temporary files of concurrent backups.
+static NEXT_BACKUP_ID: AtomicU64 = AtomicU64::new(1);
+
+/// A consistent copy of a database, ready to be written out.
+///
+/// Created by `Database::begin_backup()`. Holding it pins the captured
+/// version in memory, like a snapshot.
+///
+/// # Example
+///
+/// ```ignore
+/// let backup = db.begin_backup();
+/// let copier = std::thread::spawn(move || {
+///     let mut file = File::create("nightly.thunder")?;
+///     backup.write_to(&mut file)
+/// });
+/// // Commits continue while the copy is written.
+/// let bytes = copier.join().unwrap()?;
+/// ```
+#[derive(Debug)]
+pub struct Backup {
+    /// The committed tree being backed up.
+    tree: Arc<BTree>,
+    /// The version the tree was committed as.
+    version: u64,
+    /// Options for writing the temporary file.
+    options: DatabaseOptions,
+    /// Path of the database being backed up.
+    path: PathBuf,
+}
+
+impl Backup {
+    /// Creates a backup of `tree`, committed as `version`, for the database
+    /// at `path`.
+    pub(crate) fn new(
+        tree: Arc<BTree>,
+        version: u64,
+        path: &Path,
+        options: DatabaseOptions,
+    ) -> Self {
+        Self {
+            tree,
+            version,
+            options,
+            path: path.to_path_buf(),
+        }
+    }
+
+    /// Returns the version being backed up.
+    #[inline]
+    pub fn version(&self) -> u64 {
+        self.version
+    }
+
+    /// Writes the backup to `w` as a complete database file.
+    ///
+    /// Returns the number of bytes written, which is the size of the
+    /// resulting file. Can be called more than once, for several copies.
+    ///
+    /// # Errors
+    ///
+    /// Returns an error if the temporary file cannot be written or read
+    /// back, or if writing to `w` fails.
+    pub fn write_to<W: Write>(&self, w: &mut W) -> Result<u64> {
+        let mut temp_path = self.path.as_os_str().to_owned();
+        temp_path.push(format!(
+            ".backup-{}-{}",
+            std::process::id(),
+            NEXT_BACKUP_ID.fetch_add(1, Ordering::Relaxed)
+        ));
+        let temp_path = PathBuf::from(temp_path);
+
+        let copied = self.copy_through(&temp_path, w);
+        let _ = fs::remove_file(&temp_path);
+        copied
+    }
+
+    /// Writes the backup as a new database file at `path`.
+    ///
+    /// Returns the size of the file. The file is packed like a compacted
+    /// database: it holds only live entries and has no free pages, so
+    /// this is the way to shrink a file after heavy churn without
+    /// replacing it in place.
+    ///
+    /// # Errors
+    ///
+    /// Returns `FileOpen` if `path` already exists or cannot be created,
+    /// or an error if the file cannot be written. A partially written file
+    /// is removed.
+    pub fn write_to_path<P: AsRef<Path>>(&self, path: P) -> Result<u64> {
+        let path = path.as_ref();
+        // Claim the path first so an existing file is never overwritten.
+        fs::OpenOptions::new()
+            .write(true)
+            .create_new(true)
+            .open(path)
+            .map_err(|e| Error::FileOpen {
+                path: path.to_path_buf(),
+                source: e,
+            })?;
+
+        let written = self.persist_to(path);
+        if written.is_err() {
+            let _ = fs::remove_file(path);
+        }
+        written
+    }
+
+    /// Writes the backup as a database file at `path`, returning its size.
+    fn persist_to(&self, path: &Path) -> Result<u64> {
+        Database::open_with_options(path, self.options.clone())?
+            .persist_as(Arc::clone(&self.tree), self.version)?;
+        fs::metadata(path)
+            .map(|metadata| metadata.len())
+            .map_err(|e| Error::FileMetadata {
+                path: path.to_path_buf(),
+                source: e,
+            })
+    }
+
+    /// Writes the backup to `temp_path`, then copies that file to `w`.
+    fn copy_through<W: Write>(&self, temp_path: &Path, w: &mut W) -> Result<u64> {
+        let _ = fs::remove_file(temp_path);
+        self.persist_to(temp_path)?;
+
+        let mut file = File::open(temp_path).map_err(|e| Error::FileOpen {
+            path: temp_path.to_path_buf(),
+            source: e,
+        })?;
+        let written = io::copy(&mut file, w)?;
+        w.flush()?;
+        Ok(written)
+    }
+}
@@ -5,6 +5,26 @@
 //! negative lookups. When the filter says a key is not present, it
 //! is definitely not present. When it says a key might be present,
 //! there is a small probability of a false positive.
+//!
+//! # Bucket Filters
+//!
+//! Besides the database-wide filter, a bucket may keep a filter of its own
+//! over its user keys, enabled with `WriteTx::set_bucket_bloom()`. Sized
+//! from the bucket alone and hashed without the bucket prefix, it answers
+//! an absent-key `BucketRef::get()` with a lower false positive rate than
+//! the shared filter.
+//!
+//! Bucket filters are held by [`BucketBlooms`]. Their bits are never
+//! persisted: they are built from the bucket's keys when the database
+//! opens and extended as commits add keys.
+//! Removed keys stay in a filter, which only costs false positives, until
+//! the filter is rebuilt: when its keys outgrow the capacity it was sized
+//! for, or when the bucket's bits per key change.
+
+use std::collections::HashMap;
+
+use crate::btree::{BTree, Bound};
+use crate::bucket;
 
 /// A space-efficient probabilistic data structure for set membership.
 ///
@@ -84,6 +104,34 @@ impl BloomFilter {
         Self::new(expected_items, 0.01)
     }
 
+    /// Creates a Bloom filter sized for `expected_items` at `bits_per_key`
+    /// bits each.
+    ///
+    /// Uses the number of hash functions that minimizes false positives
+    /// at that density: about 1% at 10 bits per key.
+    ///
+    /// # Panics
+    ///
+    /// Panics if `expected_items` or `bits_per_key` is 0.
+    pub fn with_bits_per_key(expected_items: usize, bits_per_key: u8) -> Self {
+        assert!(expected_items > 0, "expected_items must be positive");
+        assert!(bits_per_key > 0, "bits_per_key must be positive");
+
+        let num_words = (expected_items * bits_per_key as usize)
+            .max(64)
+            .div_ceil(64);
+        let num_hashes = (bits_per_key as f64 * std::f64::consts::LN_2)
+            .round()
+            .clamp(1.0, 16.0) as u8;
+
+        Self {
+            bits: vec![0u64; num_words],
+            num_hashes,
+            num_bits: num_words * 64,
+            item_count: 0,
+        }
+    }
+
     /// Adds a key to the filter.
     ///
     /// After this call, `may_contain(key)` will always return `true`.
@@ -249,6 +297,124 @@ impl BloomFilter {
     }
 }
 
+/// Smallest number of keys a bucket filter is sized for.
+const MIN_BUCKET_CAPACITY: usize = 1024;
+
+/// A bucket's filter and the parameters it was built with.
+#[derive(Debug, Clone)]
+struct BucketBloom {
+    filter: BloomFilter,
+    bits_per_key: u8,
+    /// Number of insertions the filter was sized for.
+    capacity: usize,
+}
+
+impl BucketBloom {
+    /// Builds the filter of bucket `name` from its keys in `tree`.
+    fn build(tree: &BTree, name: &[u8], bits_per_key: u8) -> Self {
+        let prefix = bucket::bucket_data_prefix(name);
+        let keys: Vec<&[u8]> = tree
+            .range(Bound::Included(&prefix), Bound::Unbounded)
+            .map(|(key, _)| key)
+            .take_while(|key| key.starts_with(&prefix))
+            .map(|key| &key[prefix.len()..])
+            .collect();
+
+        // Leave room to grow before the next rebuild.
+        let capacity = (keys.len() * 2).max(MIN_BUCKET_CAPACITY);
+        let mut filter = BloomFilter::with_bits_per_key(capacity, bits_per_key);
+        for key in keys {
+            filter.insert(key);
+        }
+        Self {
+            filter,
+            bits_per_key,
+            capacity,
+        }
+    }
+}
+
+/// The Bloom filters of the buckets that have one, keyed by bucket name.
+///
+/// Each filter covers every key its bucket holds in the committed tree,
+/// so it can only rule keys out.
+#[derive(Debug, Clone, Default)]
+pub(crate) struct BucketBlooms {
+    filters: HashMap<Vec<u8>, BucketBloom>,
+}
+
+impl BucketBlooms {
+    /// Builds the filters of all buckets in `tree` that have one.
+    pub(crate) fn build(tree: &BTree) -> Self {
+        // Bucket metadata keys sort before all other keys.
+        let filters = tree
+            .iter()
+            .take_while(|(key, _)| bucket::is_bucket_meta_key(key))
+            .filter_map(|(key, header)| {
+                let name = bucket::bucket_name_of_key(key)?;
+                let bits_per_key = bucket::decode_bloom_bits(header)?;
+                Some((name.to_vec(), BucketBloom::build(tree, name, bits_per_key)))
+            })
+            .collect();
+        Self { filters }
+    }
+
+    /// Returns the filter of bucket `name`, if it has one.
+    #[inline]
+    pub(crate) fn get(&self, name: &[u8]) -> Option<&BloomFilter> {
+        self.filters.get(name).map(|bloom| &bloom.filter)
+    }
+
+    /// Brings the filters up to date with a commit that wrote or deleted
+    /// `changed` keys, after the commit was applied to `tree`.
+    ///
+    /// New bucket keys are added to their bucket's filter. Filters of
+    /// buckets whose bits per key changed, and filters that outgrew their
+    /// capacity, are rebuilt from `tree`; filters of deleted buckets are
+    /// dropped.
+    pub(crate) fn apply<'k>(&mut self, tree: &BTree, changed: impl IntoIterator<Item = &'k [u8]>) {
+        let mut rebuild: HashMap<Vec<u8>, Option<u8>> = HashMap::new();
+        for key in changed {
+            if bucket::is_bucket_meta_key(key) {
+                let Some(name) = bucket::bucket_name_of_key(key) else {
+                    continue;
+                };
+                let bits_per_key = tree.get(key).and_then(bucket::decode_bloom_bits);
+                let current = self.filters.get(name).map(|bloom| bloom.bits_per_key);
+                if bits_per_key != current {
+                    rebuild.insert(name.to_vec(), bits_per_key);
+                }
+            } else if let Some(name) = bucket::bucket_name_of_data_key(key) {
+                let Some(bloom) = self.filters.get_mut(name) else {
+                    continue;
+                };
+                // Deleted keys stay in the filter until it is rebuilt.
+                if tree.get(key).is_none() {
+                    continue;
+                }
+                bloom.filter.insert(&key[2 + name.len()..]);
+                if bloom.filter.item_count() > bloom.capacity {
+                    rebuild
+                        .entry(name.to_vec())
+                        .or_insert(Some(bloom.bits_per_key));
+                }
+            }
+        }
+
+        for (name, bits_per_key) in rebuild {
+            match bits_per_key {
+                Some(bits_per_key) => {
+                    let bloom = BucketBloom::build(tree, &name, bits_per_key);
+                    self.filters.insert(name, bloom);
+                }
+                None => {
+                    self.filters.remove(&name);
+                }
+            }
+        }
+    }
+}
+
 /// FNV-1a hash function.
 ///
 /// A fast, non-cryptographic hash function suitable for hash tables
@@ -383,6 +549,39 @@ mod tests {
         assert_eq!(filter.item_count(), 0);
     }
 
+    #[test]
+    fn test_bucket_blooms() {
+        let mut tree = BTree::new();
+        let meta_key = bucket::bucket_meta_key(b"b");
+        tree.insert(meta_key.clone(), bucket::with_bloom_bits(None, Some(10)));
+        tree.insert(bucket::bucket_data_key(b"b", b"k0"), b"v".to_vec());
+        let mut blooms = BucketBlooms::build(&tree);
+        assert!(blooms.get(b"b").unwrap().may_contain(b"k0"));
+
+        // Inserts past the filter's capacity rebuild it without losing keys.
+        let keys: Vec<Vec<u8>> = (1..5000u32)
+            .map(|i| bucket::bucket_data_key(b"b", format!("k{i}").as_bytes()))
+            .collect();
+        for key in &keys {
+            tree.insert(key.clone(), b"v".to_vec());
+        }
+        blooms.apply(&tree, keys.iter().map(Vec::as_slice));
+        let filter = blooms.get(b"b").unwrap();
+        assert!(filter.size_bits() >= 5000 * 10);
+        for i in 0..5000u32 {
+            assert!(filter.may_contain(format!("k{i}").as_bytes()));
+        }
+        let false_positives = (0..10000u32)
+            .filter(|i| filter.may_contain(format!("absent{i}").as_bytes()))
+            .count();
+        assert!(false_positives < 300, "{false_positives} false positives");
+
+        // Clearing the setting drops the filter.
+        tree.insert(meta_key.clone(), bucket::with_bloom_bits(None, None));
+        blooms.apply(&tree, [meta_key.as_slice()]);
+        assert!(blooms.get(b"b").is_none());
+    }
+
     #[test]
     fn test_bloom_filter_deserialization_invalid() {
         // Too short
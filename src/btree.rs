@@ -10,12 +10,20 @@
 //! - Leaf nodes store key-value pairs.
 //! - Branch nodes store keys and child pointers.
 //! - All values are stored in leaf nodes only.
-//! - Keys are ordered lexicographically.
+//! - Keys are ordered lexicographically, or by a
+//!   [`KeyComparator`](crate::comparator::KeyComparator) within buckets.
+//! - Leaves keep keys and values in separate arrays, so key-only scans
+//!   ([`BTree::keys()`]) never read value bytes.
+//! - Every node caches the number of entries below it and their total key
+//!   and value bytes, so [`BTree::range_size()`] sums whole subtrees
+//!   without visiting them.
 
 // Note: rayon is available for future bulk operation optimizations
 #[allow(unused_imports)]
 use rayon::prelude::*;
 
+use crate::comparator::{KeyComparator, KeyOrder};
+
 /// Maximum number of keys in a leaf node before splitting.
 /// Chosen to fit well within a 4KB page with reasonable key/value sizes.
 pub const LEAF_MAX_KEYS: usize = 32;
@@ -29,11 +37,12 @@ pub const MIN_KEYS: usize = LEAF_MAX_KEYS / 2;
 /// A B+ tree for in-memory key-value storage.
 ///
 /// Keys and values are arbitrary byte slices. Keys are ordered
-/// lexicographically.
+/// lexicographically unless the tree was created with a comparator.
 #[derive(Debug)]
 pub struct BTree {
     root: Option<Box<Node>>,
     len: usize,
+    comparator: Option<KeyComparator>,
 }
 
 /// A node in the B+ tree.
@@ -52,6 +61,8 @@ struct LeafNode {
     keys: Vec<Vec<u8>>,
     /// Values corresponding to each key.
     values: Vec<Vec<u8>>,
+    /// Total bytes of the keys and values.
+    bytes: u64,
 }
 
 /// A branch node storing keys and child pointers.
@@ -63,12 +74,89 @@ struct BranchNode {
     /// Note: Box is needed here to break the recursive type and allow Node to have a known size.
     #[allow(clippy::vec_box)]
     children: Vec<Box<Node>>,
+    /// Entries in the subtree.
+    len: usize,
+    /// Total bytes of the keys and values in the subtree.
+    bytes: u64,
+}
+
+impl Node {
+    /// Returns the entries below this node and their key and value bytes.
+    #[inline]
+    fn size(&self) -> (usize, u64) {
+        match self {
+            Node::Leaf(leaf) => (leaf.keys.len(), leaf.bytes),
+            Node::Branch(branch) => (branch.len, branch.bytes),
+        }
+    }
+}
+
+impl LeafNode {
+    /// Creates a leaf holding `keys` and their `values`.
+    fn new(keys: Vec<Vec<u8>>, values: Vec<Vec<u8>>) -> Self {
+        let bytes = keys
+            .iter()
+            .zip(&values)
+            .map(|(k, v)| (k.len() + v.len()) as u64)
+            .sum();
+        Self {
+            keys,
+            values,
+            bytes,
+        }
+    }
+}
+
+impl BranchNode {
+    /// Creates a branch over `children`, separated by `keys`.
+    #[allow(clippy::vec_box)]
+    fn new(keys: Vec<Vec<u8>>, children: Vec<Box<Node>>) -> Self {
+        let mut branch = Self {
+            keys,
+            children,
+            len: 0,
+            bytes: 0,
+        };
+        branch.recount();
+        branch
+    }
+
+    /// Recomputes the subtree totals from the children's.
+    fn recount(&mut self) {
+        (self.len, self.bytes) = self
+            .children
+            .iter()
+            .map(|child| child.size())
+            .fold((0, 0), |(len, bytes), (l, b)| (len + l, bytes + b));
+    }
 }
 
 impl BTree {
     /// Creates a new empty B+ tree.
     pub fn new() -> Self {
-        Self { root: None, len: 0 }
+        Self::with_comparator(None)
+    }
+
+    /// Creates a new empty B+ tree ordering bucket keys by `comparator`,
+    /// or byte-wise if it is `None`.
+    pub fn with_comparator(comparator: Option<KeyComparator>) -> Self {
+        Self {
+            root: None,
+            len: 0,
+            comparator,
+        }
+    }
+
+    /// Returns the comparator the tree orders bucket keys by.
+    #[inline]
+    pub fn comparator(&self) -> Option<&KeyComparator> {
+        self.comparator.as_ref()
+    }
+
+    /// Returns the order of the tree's keys.
+    #[inline]
+    pub(crate) fn order(&self) -> KeyOrder<'_> {
+        KeyOrder::new(self.comparator.as_ref())
     }
 
     /// Returns the number of key-value pairs in the tree.
@@ -83,12 +171,50 @@ impl BTree {
         self.len == 0
     }
 
+    /// Returns the number of levels in the tree, counting the leaves.
+    ///
+    /// Zero for an empty tree. Every leaf is at the same depth.
+    pub fn depth(&self) -> usize {
+        let mut depth = 0;
+        let mut node = self.root.as_deref();
+        while let Some(current) = node {
+            depth += 1;
+            node = match current {
+                Node::Leaf(_) => None,
+                Node::Branch(branch) => branch.children.first().map(|c| &**c),
+            };
+        }
+        depth
+    }
+
     /// Looks up a key in the tree.
     ///
     /// Returns the value associated with the key, or `None` if not found.
     pub fn get(&self, key: &[u8]) -> Option<&[u8]> {
         let root = self.root.as_ref()?;
-        Self::search_node(root, key)
+        Self::search_node(root, key, self.order())
+    }
+
+    /// Looks up several keys with one ordered walk of the tree.
+    ///
+    /// Returns the values in the order of `keys`, `None` for missing keys.
+    /// The keys are probed in sorted order, each probe continuing from the
+    /// last instead of descending from the root.
+    pub fn get_many<K: AsRef<[u8]>>(&self, keys: &[K]) -> Vec<Option<&[u8]>> {
+        let order = self.order();
+        let mut probes: Vec<usize> = (0..keys.len()).collect();
+        probes.sort_unstable_by(|&a, &b| order.cmp(keys[a].as_ref(), keys[b].as_ref()));
+
+        let mut values = vec![None; keys.len()];
+        let mut cursor = self.cursor();
+        for i in probes {
+            let key = keys[i].as_ref();
+            values[i] = cursor
+                .seek_forward(key)
+                .filter(|(found, _)| order.cmp(found, key).is_eq())
+                .map(|(_, value)| value);
+        }
+        values
     }
 
     /// Inserts a key-value pair into the tree.
@@ -97,23 +223,21 @@ impl BTree {
     pub fn insert(&mut self, key: Vec<u8>, value: Vec<u8>) -> Option<Vec<u8>> {
         if self.root.is_none() {
             // Create first leaf node.
-            self.root = Some(Box::new(Node::Leaf(LeafNode {
-                keys: vec![key],
-                values: vec![value],
-            })));
+            self.root = Some(Box::new(Node::Leaf(LeafNode::new(vec![key], vec![value]))));
             self.len = 1;
             return None;
         }
 
         let root = self.root.take().unwrap();
-        let (new_root, old_value, split) = Self::insert_into_node(root, key, value);
+        let order = KeyOrder::new(self.comparator.as_ref());
+        let (new_root, old_value, split) = Self::insert_into_node(root, key, value, order);
 
         self.root = Some(if let Some((median_key, right_child)) = split {
             // Root was split, create new root.
-            Box::new(Node::Branch(BranchNode {
-                keys: vec![median_key],
-                children: vec![new_root, right_child],
-            }))
+            Box::new(Node::Branch(BranchNode::new(
+                vec![median_key],
+                vec![new_root, right_child],
+            )))
         } else {
             new_root
         });
@@ -130,7 +254,8 @@ impl BTree {
     /// Returns the removed value, or `None` if the key was not found.
     pub fn remove(&mut self, key: &[u8]) -> Option<Vec<u8>> {
         let root = self.root.take()?;
-        let (new_root, removed_value) = Self::remove_from_node(root, key);
+        let order = KeyOrder::new(self.comparator.as_ref());
+        let (new_root, removed_value) = Self::remove_from_node(root, key, order);
 
         self.root = new_root;
 
@@ -175,7 +300,6 @@ impl BTree {
     /// Inserts multiple key-value pairs from a pre-sorted slice.
     ///
     /// This is the fastest bulk insert method when data is already sorted.
-    /// Uses parallel insertion for large batches.
     ///
     /// # Arguments
     ///
@@ -184,46 +308,145 @@ impl BTree {
     /// # Returns
     ///
     /// The number of new entries inserted.
+    pub fn insert_bulk_sorted(&mut self, entries: &[(Vec<u8>, Vec<u8>)]) -> usize {
+        self.extend_sorted(entries.to_vec())
+    }
+
+    /// Inserts an owned run of key-value pairs sorted by key.
     ///
-    /// # Performance
+    /// Keys must be strictly increasing. When the tree is empty, or the run
+    /// is large relative to it, the tree is rebuilt bottom-up from a merge
+    /// of its entries and the run instead of splitting its way through one
+    /// key at a time. Values in the run replace existing ones.
     ///
-    /// For sorted data, this achieves O(n) insertion instead of O(n log n)
-    /// by exploiting the sequential access pattern.
-    pub fn insert_bulk_sorted(&mut self, entries: &[(Vec<u8>, Vec<u8>)]) -> usize {
+    /// # Returns
+    ///
+    /// The number of new entries inserted.
+    pub fn extend_sorted(&mut self, entries: Vec<(Vec<u8>, Vec<u8>)>) -> usize {
+        debug_assert!(
+            entries
+                .windows(2)
+                .all(|w| self.order().lt(&w[0].0, &w[1].0))
+        );
         if entries.is_empty() {
             return 0;
         }
 
-        let mut inserted_count = 0;
+        if entries.len() * 4 < self.len {
+            let mut inserted_count = 0;
+            for (key, value) in entries {
+                if self.insert(key, value).is_none() {
+                    inserted_count += 1;
+                }
+            }
+            return inserted_count;
+        }
+
+        let before = self.len;
+        let mut existing = Vec::with_capacity(before);
+        if let Some(root) = self.root.take() {
+            Self::drain_node(*root, &mut existing);
+        }
+
+        let order = self.order();
+        let mut merged = Vec::with_capacity(existing.len() + entries.len());
+        let mut existing = existing.into_iter().peekable();
         for (key, value) in entries {
-            if self.insert(key.clone(), value.clone()).is_none() {
-                inserted_count += 1;
+            while let Some(entry) = existing.next_if(|(k, _)| order.lt(k, &key)) {
+                merged.push(entry);
+            }
+            existing.next_if(|(k, _)| *k == key);
+            merged.push((key, value));
+        }
+        merged.extend(existing);
+
+        let comparator = self.comparator.take();
+        *self = Self::from_sorted(merged);
+        self.comparator = comparator;
+        self.len - before
+    }
+
+    /// Builds a tree bottom-up from entries sorted by strictly increasing key.
+    ///
+    /// Nodes are filled close to capacity and spread evenly, so every node
+    /// but the root holds at least `MIN_KEYS` keys.
+    pub fn from_sorted(entries: Vec<(Vec<u8>, Vec<u8>)>) -> Self {
+        let len = entries.len();
+        if len == 0 {
+            return Self::new();
+        }
+
+        // Each level is a run of (first key in subtree, node).
+        let mut level: Vec<(Vec<u8>, Box<Node>)> = Vec::with_capacity(len / LEAF_MAX_KEYS + 1);
+        let mut entries = entries.into_iter();
+        for size in Self::even_chunks(len, LEAF_MAX_KEYS) {
+            let (keys, values): (Vec<_>, Vec<_>) = entries.by_ref().take(size).unzip();
+            let first = keys[0].clone();
+            level.push((first, Box::new(Node::Leaf(LeafNode::new(keys, values)))));
+        }
+
+        while level.len() > 1 {
+            let count = level.len();
+            let mut nodes = level.into_iter();
+            level = Vec::with_capacity(count / (BRANCH_MAX_KEYS + 1) + 1);
+            for size in Self::even_chunks(count, BRANCH_MAX_KEYS + 1) {
+                let mut children = nodes.by_ref().take(size);
+                let (first, child) = children.next().expect("chunks are non-empty");
+                let (keys, mut rest): (Vec<_>, Vec<_>) = children.unzip();
+                rest.insert(0, child);
+                level.push((first, Box::new(Node::Branch(BranchNode::new(keys, rest)))));
+            }
+        }
+
+        let root = level.pop().map(|(_, node)| node);
+        Self {
+            root,
+            len,
+            comparator: None,
+        }
+    }
+
+    /// Splits `len` items into the fewest chunks of at most `max`, with
+    /// sizes differing by at most one.
+    fn even_chunks(len: usize, max: usize) -> impl Iterator<Item = usize> {
+        let count = len.div_ceil(max);
+        let (base, extra) = (len / count, len % count);
+        (0..count).map(move |i| base + usize::from(i < extra))
+    }
+
+    /// Moves every entry below `node` into `out` in key order.
+    fn drain_node(node: Node, out: &mut Vec<(Vec<u8>, Vec<u8>)>) {
+        match node {
+            Node::Leaf(leaf) => out.extend(leaf.keys.into_iter().zip(leaf.values)),
+            Node::Branch(branch) => {
+                for child in branch.children {
+                    Self::drain_node(*child, out);
+                }
             }
         }
-        inserted_count
     }
 
     /// Searches for a key in a node recursively.
-    fn search_node<'a>(node: &'a Node, key: &[u8]) -> Option<&'a [u8]> {
+    fn search_node<'a>(node: &'a Node, key: &[u8], order: KeyOrder<'_>) -> Option<&'a [u8]> {
         match node {
             Node::Leaf(leaf) => {
                 // Binary search for the key.
-                match leaf.keys.binary_search_by(|k| k.as_slice().cmp(key)) {
+                match leaf.keys.binary_search_by(|k| order.cmp(k, key)) {
                     Ok(idx) => Some(&leaf.values[idx]),
                     Err(_) => None,
                 }
             }
             Node::Branch(branch) => {
                 // Find the child to descend into.
-                let child_idx = Self::find_child_index(&branch.keys, key);
-                Self::search_node(&branch.children[child_idx], key)
+                let child_idx = Self::find_child_index(&branch.keys, key, order);
+                Self::search_node(&branch.children[child_idx], key, order)
             }
         }
     }
 
     /// Finds the index of the child to descend into for a given key.
-    fn find_child_index(keys: &[Vec<u8>], key: &[u8]) -> usize {
-        match keys.binary_search_by(|k| k.as_slice().cmp(key)) {
+    fn find_child_index(keys: &[Vec<u8>], key: &[u8], order: KeyOrder<'_>) -> usize {
+        match keys.binary_search_by(|k| order.cmp(k, key)) {
             Ok(idx) => idx + 1, // Key found, go right.
             Err(idx) => idx,    // Key not found, go to appropriate child.
         }
@@ -238,18 +461,22 @@ impl BTree {
         mut node: Box<Node>,
         key: Vec<u8>,
         value: Vec<u8>,
+        order: KeyOrder<'_>,
     ) -> (Box<Node>, Option<Vec<u8>>, Option<(Vec<u8>, Box<Node>)>) {
         match node.as_mut() {
             Node::Leaf(leaf) => {
                 // Find insertion point.
-                match leaf.keys.binary_search_by(|k| k.as_slice().cmp(&key)) {
+                match leaf.keys.binary_search_by(|k| order.cmp(k, &key)) {
                     Ok(idx) => {
                         // Key exists, replace value.
+                        leaf.bytes += value.len() as u64;
                         let old_value = std::mem::replace(&mut leaf.values[idx], value);
+                        leaf.bytes -= old_value.len() as u64;
                         (node, Some(old_value), None)
                     }
                     Err(idx) => {
                         // Insert new key-value pair.
+                        leaf.bytes += (key.len() + value.len()) as u64;
                         leaf.keys.insert(idx, key);
                         leaf.values.insert(idx, value);
 
@@ -265,11 +492,12 @@ impl BTree {
             }
             Node::Branch(branch) => {
                 // Find the child to insert into.
-                let child_idx = Self::find_child_index(&branch.keys, &key);
+                let child_idx = Self::find_child_index(&branch.keys, &key, order);
                 let child = branch.children.remove(child_idx);
+                let (key_len, value_len) = (key.len() as u64, value.len() as u64);
 
                 let (updated_child, old_value, child_split) =
-                    Self::insert_into_node(child, key, value);
+                    Self::insert_into_node(child, key, value, order);
 
                 branch.children.insert(child_idx, updated_child);
 
@@ -277,14 +505,23 @@ impl BTree {
                     // Child was split, insert median key and right child.
                     branch.keys.insert(child_idx, median_key);
                     branch.children.insert(child_idx + 1, right_child);
+                }
 
-                    if branch.keys.len() > BRANCH_MAX_KEYS {
-                        // Split the branch.
-                        let split = Self::split_branch(branch);
-                        (node, old_value, Some(split))
-                    } else {
-                        (node, old_value, None)
+                // Splits below move entries between children, leaving only
+                // this entry's change to the subtree totals.
+                branch.bytes += value_len;
+                match &old_value {
+                    Some(old) => branch.bytes -= old.len() as u64,
+                    None => {
+                        branch.len += 1;
+                        branch.bytes += key_len;
                     }
+                }
+
+                if branch.keys.len() > BRANCH_MAX_KEYS {
+                    // Split the branch.
+                    let split = Self::split_branch(branch);
+                    (node, old_value, Some(split))
                 } else {
                     (node, old_value, None)
                 }
@@ -302,10 +539,9 @@ impl BTree {
         // The first key of the right node becomes the separator.
         let median_key = right_keys[0].clone();
 
-        let right_node = Box::new(Node::Leaf(LeafNode {
-            keys: right_keys,
-            values: right_values,
-        }));
+        let right = LeafNode::new(right_keys, right_values);
+        leaf.bytes -= right.bytes;
+        let right_node = Box::new(Node::Leaf(right));
 
         (median_key, right_node)
     }
@@ -319,10 +555,8 @@ impl BTree {
         let right_keys = branch.keys.split_off(mid);
         let right_children = branch.children.split_off(mid + 1);
 
-        let right_node = Box::new(Node::Branch(BranchNode {
-            keys: right_keys,
-            children: right_children,
-        }));
+        branch.recount();
+        let right_node = Box::new(Node::Branch(BranchNode::new(right_keys, right_children)));
 
         (median_key, right_node)
     }
@@ -330,12 +564,17 @@ impl BTree {
     /// Removes a key from a node.
     ///
     /// Returns (optional_updated_node, optional_removed_value).
-    fn remove_from_node(mut node: Box<Node>, key: &[u8]) -> (Option<Box<Node>>, Option<Vec<u8>>) {
+    fn remove_from_node(
+        mut node: Box<Node>,
+        key: &[u8],
+        order: KeyOrder<'_>,
+    ) -> (Option<Box<Node>>, Option<Vec<u8>>) {
         match node.as_mut() {
-            Node::Leaf(leaf) => match leaf.keys.binary_search_by(|k| k.as_slice().cmp(key)) {
+            Node::Leaf(leaf) => match leaf.keys.binary_search_by(|k| order.cmp(k, key)) {
                 Ok(idx) => {
-                    leaf.keys.remove(idx);
+                    let key = leaf.keys.remove(idx);
                     let value = leaf.values.remove(idx);
+                    leaf.bytes -= (key.len() + value.len()) as u64;
 
                     if leaf.keys.is_empty() {
                         (None, Some(value))
@@ -346,10 +585,10 @@ impl BTree {
                 Err(_) => (Some(node), None),
             },
             Node::Branch(branch) => {
-                let child_idx = Self::find_child_index(&branch.keys, key);
+                let child_idx = Self::find_child_index(&branch.keys, key, order);
                 let child = branch.children.remove(child_idx);
 
-                let (updated_child, removed_value) = Self::remove_from_node(child, key);
+                let (updated_child, removed_value) = Self::remove_from_node(child, key, order);
 
                 match updated_child {
                     Some(child) => {
@@ -370,6 +609,13 @@ impl BTree {
                     }
                 }
 
+                // Rebalancing moves entries between children, leaving only
+                // the removed entry's change to the subtree totals.
+                if let Some(value) = &removed_value {
+                    branch.len -= 1;
+                    branch.bytes -= (key.len() + value.len()) as u64;
+                }
+
                 // If branch has only one child left, promote it.
                 if branch.keys.is_empty() && branch.children.len() == 1 {
                     let only_child = branch.children.pop().unwrap();
@@ -432,6 +678,9 @@ impl BTree {
             (Node::Leaf(left), Node::Leaf(right)) => {
                 let key = left.keys.pop().unwrap();
                 let value = left.values.pop().unwrap();
+                let moved = (key.len() + value.len()) as u64;
+                left.bytes -= moved;
+                right.bytes += moved;
                 right.keys.insert(0, key.clone());
                 right.values.insert(0, value);
                 branch.keys[separator_idx] = key;
@@ -442,6 +691,8 @@ impl BTree {
                 let separator = std::mem::replace(&mut branch.keys[separator_idx], key);
                 right.keys.insert(0, separator);
                 right.children.insert(0, child);
+                left.recount();
+                right.recount();
             }
             _ => unreachable!("mismatched node types"),
         }
@@ -460,6 +711,9 @@ impl BTree {
             (Node::Leaf(left), Node::Leaf(right)) => {
                 let key = right.keys.remove(0);
                 let value = right.values.remove(0);
+                let moved = (key.len() + value.len()) as u64;
+                right.bytes -= moved;
+                left.bytes += moved;
                 left.keys.push(key);
                 left.values.push(value);
                 branch.keys[separator_idx] = right.keys[0].clone();
@@ -470,6 +724,8 @@ impl BTree {
                 let separator = std::mem::replace(&mut branch.keys[separator_idx], key);
                 left.keys.push(separator);
                 left.children.push(child);
+                left.recount();
+                right.recount();
             }
             _ => unreachable!("mismatched node types"),
         }
@@ -485,11 +741,14 @@ impl BTree {
             (Node::Leaf(left), Node::Leaf(right)) => {
                 left.keys.extend(right.keys);
                 left.values.extend(right.values);
+                left.bytes += right.bytes;
             }
             (Node::Branch(left), Node::Branch(right)) => {
                 left.keys.push(separator);
                 left.keys.extend(right.keys);
                 left.children.extend(right.children);
+                left.len += right.len;
+                left.bytes += right.bytes;
             }
             _ => unreachable!("mismatched node types"),
         }
@@ -504,11 +763,14 @@ impl BTree {
             (Node::Leaf(left), Node::Leaf(right)) => {
                 left.keys.extend(right.keys);
                 left.values.extend(right.values);
+                left.bytes += right.bytes;
             }
             (Node::Branch(left), Node::Branch(right)) => {
                 left.keys.push(separator);
                 left.keys.extend(right.keys);
                 left.children.extend(right.children);
+                left.len += right.len;
+                left.bytes += right.bytes;
             }
             _ => unreachable!("mismatched node types"),
         }
@@ -519,12 +781,235 @@ impl BTree {
         BTreeIter::new(self.root.as_deref())
     }
 
+    /// Returns an iterator over all keys in sorted order.
+    ///
+    /// Walks only the leaves' key arrays, leaving values untouched.
+    pub fn keys(&self) -> BTreeKeys<'_> {
+        BTreeKeys { inner: self.iter() }
+    }
+
     /// Returns an iterator over a range of key-value pairs in sorted order.
     ///
     /// The range is specified by start and end bounds.
     pub fn range<'a>(&'a self, start: Bound<'a>, end: Bound<'a>) -> BTreeRangeIter<'a> {
         BTreeRangeIter::new(self, start, end)
     }
+
+    /// Returns the number of entries in a key range and the total bytes of
+    /// their keys and values.
+    ///
+    /// Whole subtrees inside the range are counted from the totals their
+    /// nodes cache, so only the nodes along the two bounds are visited and
+    /// the cost grows with the depth of the tree, not the size of the
+    /// range.
+    pub fn range_size(&self, start: Bound<'_>, end: Bound<'_>) -> (usize, u64) {
+        match &self.root {
+            Some(root) => Self::range_size_in(root, Some(&start), Some(&end), self.order()),
+            None => (0, 0),
+        }
+    }
+
+    /// Sizes the part of the subtree at `node` within the bounds given;
+    /// `None` means the subtree lies entirely on the inner side of that
+    /// bound.
+    fn range_size_in(
+        node: &Node,
+        start: Option<&Bound<'_>>,
+        end: Option<&Bound<'_>>,
+        order: KeyOrder<'_>,
+    ) -> (usize, u64) {
+        let start = start.filter(|b| !matches!(b, Bound::Unbounded));
+        let end = end.filter(|b| !matches!(b, Bound::Unbounded));
+        if start.is_none() && end.is_none() {
+            return node.size();
+        }
+        match node {
+            Node::Leaf(leaf) => leaf
+                .keys
+                .iter()
+                .zip(&leaf.values)
+                .filter(|(k, _)| {
+                    start.is_none_or(|b| is_at_or_after(k, b, order))
+                        && end.is_none_or(|b| is_before(k, b, order))
+                })
+                .fold((0, 0), |(len, bytes), (k, v)| {
+                    (len + 1, bytes + (k.len() + v.len()) as u64)
+                }),
+            Node::Branch(branch) => {
+                let first = start.map_or(0, |b| match b {
+                    Bound::Included(key) | Bound::Excluded(key) => {
+                        Self::find_child_index(&branch.keys, key, order)
+                    }
+                    Bound::Unbounded => 0,
+                });
+                let last = end.map_or(branch.children.len() - 1, |b| match b {
+                    Bound::Included(key) | Bound::Excluded(key) => {
+                        Self::find_child_index(&branch.keys, key, order)
+                    }
+                    Bound::Unbounded => branch.children.len() - 1,
+                });
+                // A start bound after the end bound selects nothing.
+                if last < first {
+                    return (0, 0);
+                }
+                let mut total = (0, 0);
+                for i in first..=last {
+                    let (len, bytes) = Self::range_size_in(
+                        &branch.children[i],
+                        start.filter(|_| i == first),
+                        end.filter(|_| i == last),
+                        order,
+                    );
+                    total = (total.0 + len, total.1 + bytes);
+                }
+                total
+            }
+        }
+    }
+
+    /// Verifies the structure of the tree, returning every problem found.
+    ///
+    /// Checks that keys are strictly ascending within each node, that every
+    /// key lies within the bounds set by the separators above it, that each
+    /// branch has one more child than separators, that all leaves are at
+    /// the same depth, and that the stored length matches the entries.
+    /// Returns an empty vector for a well-formed tree.
+    pub(crate) fn check(&self) -> Vec<String> {
+        let mut problems = Vec::new();
+        let mut leaf_depth = None;
+        let mut entries = 0;
+        if let Some(root) = &self.root {
+            Self::check_node(
+                root,
+                &[],
+                (None, None),
+                self.order(),
+                &mut leaf_depth,
+                &mut entries,
+                &mut problems,
+            );
+        }
+        if entries != self.len {
+            problems.push(format!(
+                "tree records {} entries but holds {entries}",
+                self.len
+            ));
+        }
+        problems
+    }
+
+    /// Checks the subtree at `path` (child indices from the root), whose
+    /// keys must satisfy `lower <= key < upper`.
+    fn check_node(
+        node: &Node,
+        path: &[usize],
+        (lower, upper): (Option<&[u8]>, Option<&[u8]>),
+        order: KeyOrder<'_>,
+        leaf_depth: &mut Option<usize>,
+        entries: &mut usize,
+        problems: &mut Vec<String>,
+    ) {
+        let keys = match node {
+            Node::Leaf(leaf) => &leaf.keys,
+            Node::Branch(branch) => &branch.keys,
+        };
+        for pair in keys.windows(2) {
+            if !order.lt(&pair[0], &pair[1]) {
+                problems.push(format!(
+                    "node {path:?}: key {:?} is not below the next key {:?}",
+                    String::from_utf8_lossy(&pair[0]),
+                    String::from_utf8_lossy(&pair[1])
+                ));
+            }
+        }
+        for key in keys {
+            let below = lower.is_some_and(|lower| order.lt(key, lower));
+            let above = upper.is_some_and(|upper| !order.lt(key, upper));
+            if below || above {
+                problems.push(format!(
+                    "node {path:?}: key {:?} lies outside the range of its parent",
+                    String::from_utf8_lossy(key)
+                ));
+            }
+        }
+
+        match node {
+            Node::Leaf(leaf) => {
+                if leaf.values.len() != leaf.keys.len() {
+                    problems.push(format!(
+                        "leaf {path:?}: {} keys but {} values",
+                        leaf.keys.len(),
+                        leaf.values.len()
+                    ));
+                }
+                let bytes: u64 = leaf
+                    .keys
+                    .iter()
+                    .zip(&leaf.values)
+                    .map(|(k, v)| (k.len() + v.len()) as u64)
+                    .sum();
+                if bytes != leaf.bytes {
+                    problems.push(format!("leaf {path:?}: cached byte total is stale"));
+                }
+                *entries += leaf.keys.len();
+                match *leaf_depth {
+                    None => *leaf_depth = Some(path.len()),
+                    Some(depth) if depth != path.len() => problems.push(format!(
+                        "leaf {path:?} is at depth {} but other leaves are at {depth}",
+                        path.len()
+                    )),
+                    Some(_) => {}
+                }
+            }
+            Node::Branch(branch) => {
+                if branch.children.len() != branch.keys.len() + 1 {
+                    problems.push(format!(
+                        "branch {path:?}: {} separators but {} children",
+                        branch.keys.len(),
+                        branch.children.len()
+                    ));
+                }
+                let counted = branch
+                    .children
+                    .iter()
+                    .map(|child| child.size())
+                    .fold((0, 0), |(len, bytes), (l, b)| (len + l, bytes + b));
+                if counted != (branch.len, branch.bytes) {
+                    problems.push(format!("branch {path:?}: cached subtree totals are stale"));
+                }
+                let mut child_path = path.to_vec();
+                for (i, child) in branch.children.iter().enumerate() {
+                    let child_lower = if i == 0 {
+                        lower
+                    } else {
+                        branch.keys.get(i - 1).map(Vec::as_slice)
+                    };
+                    let child_upper = branch.keys.get(i).map(Vec::as_slice).or(upper);
+                    child_path.push(i);
+                    Self::check_node(
+                        child,
+                        &child_path,
+                        (child_lower, child_upper),
+                        order,
+                        leaf_depth,
+                        entries,
+                        problems,
+                    );
+                    child_path.pop();
+                }
+            }
+        }
+    }
+
+    /// Returns a cursor positioned before the first entry.
+    pub(crate) fn cursor(&self) -> BTreeCursor<'_> {
+        BTreeCursor {
+            root: self.root.as_deref(),
+            order: self.order(),
+            path: Vec::new(),
+            position: CursorPosition::BeforeFirst,
+        }
+    }
 }
 
 impl Default for BTree {
@@ -573,6 +1058,44 @@ impl<'a> BTreeIter<'a> {
         }
     }
 
+    /// Skips `n` entries using leaf key counts, hopping over whole leaves
+    /// instead of visiting each entry.
+    fn skip_entries(&mut self, mut n: usize) {
+        while n > 0 {
+            let Some((leaf, idx)) = self.current_leaf.as_mut() else {
+                return;
+            };
+            let remaining = leaf.keys.len() - *idx;
+            if n < remaining {
+                *idx += n;
+                return;
+            }
+            n -= remaining;
+            self.advance_to_next_leaf();
+        }
+    }
+
+    /// Returns the next key and its position, without reading its value.
+    #[inline]
+    fn next_position(&mut self) -> Option<(&'a LeafNode, usize)> {
+        let (leaf, idx) = self.current_leaf.as_mut()?;
+        let position = (*leaf, *idx);
+
+        *idx += 1;
+        if *idx >= leaf.keys.len() {
+            self.advance_to_next_leaf();
+        }
+
+        Some(position)
+    }
+
+    /// Returns the next key, without reading its value.
+    #[inline]
+    pub(crate) fn next_key(&mut self) -> Option<&'a [u8]> {
+        let (leaf, idx) = self.next_position()?;
+        Some(leaf.keys[idx].as_slice())
+    }
+
     /// Advances to the next leaf.
     fn advance_to_next_leaf(&mut self) {
         self.current_leaf = None;
@@ -594,17 +1117,269 @@ impl<'a> Iterator for BTreeIter<'a> {
     type Item = (&'a [u8], &'a [u8]);
 
     fn next(&mut self) -> Option<Self::Item> {
-        let (leaf, idx) = self.current_leaf.as_mut()?;
+        let (leaf, idx) = self.next_position()?;
+        Some((leaf.keys[idx].as_slice(), leaf.values[idx].as_slice()))
+    }
 
-        let key = &leaf.keys[*idx];
-        let value = &leaf.values[*idx];
+    /// Skips `n` entries a leaf at a time, then returns the next one.
+    ///
+    /// Also speeds up `skip(n)`, which is built on `nth`.
+    fn nth(&mut self, n: usize) -> Option<Self::Item> {
+        self.skip_entries(n);
+        self.next()
+    }
+}
 
-        *idx += 1;
-        if *idx >= leaf.keys.len() {
-            self.advance_to_next_leaf();
+/// Where a [`BTreeCursor`] stands.
+#[derive(Clone, Copy)]
+enum CursorPosition<'a> {
+    /// Before the first entry.
+    BeforeFirst,
+    /// On an entry of a leaf.
+    At(&'a LeafNode, usize),
+    /// After the last entry.
+    AfterLast,
+}
+
+/// A position in a B+ tree that can step in both directions.
+///
+/// Keeps the branches above the current leaf, so stepping across a leaf
+/// boundary climbs only as far as the nearest common ancestor.
+pub(crate) struct BTreeCursor<'a> {
+    root: Option<&'a Node>,
+    order: KeyOrder<'a>,
+    /// Branches above the current leaf, with the index of the child taken.
+    path: Vec<(&'a BranchNode, usize)>,
+    position: CursorPosition<'a>,
+}
+
+impl<'a> BTreeCursor<'a> {
+    /// Returns the entry at the cursor, if it is on one.
+    pub(crate) fn current(&self) -> Option<(&'a [u8], &'a [u8])> {
+        match self.position {
+            CursorPosition::At(leaf, idx) => {
+                Some((leaf.keys[idx].as_slice(), leaf.values[idx].as_slice()))
+            }
+            _ => None,
         }
+    }
+
+    /// Returns true if the cursor is before the first entry.
+    pub(crate) fn is_before_first(&self) -> bool {
+        matches!(self.position, CursorPosition::BeforeFirst)
+    }
 
-        Some((key.as_slice(), value.as_slice()))
+    /// Moves to the first entry.
+    pub(crate) fn first(&mut self) -> Option<(&'a [u8], &'a [u8])> {
+        self.path.clear();
+        let leaf = self.root.map(|root| self.descend(root, true));
+        self.enter_forward(leaf)
+    }
+
+    /// Moves to the last entry.
+    pub(crate) fn last(&mut self) -> Option<(&'a [u8], &'a [u8])> {
+        self.path.clear();
+        let leaf = self.root.map(|root| self.descend(root, false));
+        self.enter_backward(leaf)
+    }
+
+    /// Moves to the next entry.
+    ///
+    /// From before the first entry this is the first entry; past the last
+    /// one the cursor stays after it.
+    pub(crate) fn next(&mut self) -> Option<(&'a [u8], &'a [u8])> {
+        match self.position {
+            CursorPosition::BeforeFirst => self.first(),
+            CursorPosition::AfterLast => None,
+            CursorPosition::At(leaf, idx) if idx + 1 < leaf.keys.len() => {
+                self.position = CursorPosition::At(leaf, idx + 1);
+                self.current()
+            }
+            CursorPosition::At(..) => {
+                let leaf = self.next_leaf();
+                self.enter_forward(leaf)
+            }
+        }
+    }
+
+    /// Moves to the previous entry.
+    ///
+    /// From after the last entry this is the last entry; before the first
+    /// one the cursor stays before it.
+    pub(crate) fn prev(&mut self) -> Option<(&'a [u8], &'a [u8])> {
+        match self.position {
+            CursorPosition::AfterLast => self.last(),
+            CursorPosition::BeforeFirst => None,
+            CursorPosition::At(leaf, idx) if idx > 0 => {
+                self.position = CursorPosition::At(leaf, idx - 1);
+                self.current()
+            }
+            CursorPosition::At(..) => {
+                let leaf = self.prev_leaf();
+                self.enter_backward(leaf)
+            }
+        }
+    }
+
+    /// Moves to the first entry whose key is at least `key`.
+    pub(crate) fn seek(&mut self, key: &[u8]) -> Option<(&'a [u8], &'a [u8])> {
+        self.path.clear();
+        let Some(node) = self.root else {
+            self.position = CursorPosition::AfterLast;
+            return None;
+        };
+        self.seek_below(node, key)
+    }
+
+    /// Moves forward to the first entry whose key is at least `key`.
+    ///
+    /// Like [`seek()`](Self::seek), but climbs only to the nearest branch
+    /// whose subtree still covers `key`, so probing keys in ascending
+    /// order walks the tree once. `key` must not sort before the current
+    /// entry.
+    pub(crate) fn seek_forward(&mut self, key: &[u8]) -> Option<(&'a [u8], &'a [u8])> {
+        let CursorPosition::At(leaf, idx) = self.position else {
+            return match self.position {
+                CursorPosition::AfterLast => None,
+                _ => self.seek(key),
+            };
+        };
+        if leaf
+            .keys
+            .last()
+            .is_some_and(|last| !self.order.lt(last, key))
+        {
+            let skip = leaf.keys[idx..].partition_point(|k| self.order.lt(k, key));
+            self.position = CursorPosition::At(leaf, idx + skip);
+            return self.current();
+        }
+        while let Some((branch, idx)) = self.path.pop() {
+            if idx < branch.keys.len() && self.order.lt(key, &branch.keys[idx]) {
+                let child = BTree::find_child_index(&branch.keys, key, self.order);
+                self.path.push((branch, child));
+                return self.seek_below(&branch.children[child], key);
+            }
+        }
+        self.seek(key)
+    }
+
+    /// Descends from `node`, which the path leads to, to the first entry
+    /// whose key is at least `key`.
+    fn seek_below(&mut self, mut node: &'a Node, key: &[u8]) -> Option<(&'a [u8], &'a [u8])> {
+        loop {
+            match node {
+                Node::Branch(branch) => {
+                    let idx = BTree::find_child_index(&branch.keys, key, self.order);
+                    self.path.push((branch, idx));
+                    node = &branch.children[idx];
+                }
+                Node::Leaf(leaf) => {
+                    let idx = leaf.keys.partition_point(|k| self.order.lt(k, key));
+                    if idx < leaf.keys.len() {
+                        self.position = CursorPosition::At(leaf, idx);
+                        return self.current();
+                    }
+                    let next = self.next_leaf();
+                    return self.enter_forward(next);
+                }
+            }
+        }
+    }
+
+    /// Descends from `node` to its leftmost or rightmost leaf.
+    fn descend(&mut self, mut node: &'a Node, leftmost: bool) -> &'a LeafNode {
+        loop {
+            match node {
+                Node::Leaf(leaf) => return leaf,
+                Node::Branch(branch) => {
+                    let idx = if leftmost {
+                        0
+                    } else {
+                        branch.children.len() - 1
+                    };
+                    self.path.push((branch, idx));
+                    node = &branch.children[idx];
+                }
+            }
+        }
+    }
+
+    /// Climbs to the nearest branch with a child to the right of the path
+    /// and descends to that child's leftmost leaf.
+    fn next_leaf(&mut self) -> Option<&'a LeafNode> {
+        while let Some((branch, idx)) = self.path.pop() {
+            if idx + 1 < branch.children.len() {
+                self.path.push((branch, idx + 1));
+                return Some(self.descend(&branch.children[idx + 1], true));
+            }
+        }
+        None
+    }
+
+    /// Climbs to the nearest branch with a child to the left of the path
+    /// and descends to that child's rightmost leaf.
+    fn prev_leaf(&mut self) -> Option<&'a LeafNode> {
+        while let Some((branch, idx)) = self.path.pop() {
+            if idx > 0 {
+                self.path.push((branch, idx - 1));
+                return Some(self.descend(&branch.children[idx - 1], false));
+            }
+        }
+        None
+    }
+
+    /// Positions on the first entry of `leaf` or, if it is empty, of the
+    /// leaves after it.
+    fn enter_forward(&mut self, mut leaf: Option<&'a LeafNode>) -> Option<(&'a [u8], &'a [u8])> {
+        loop {
+            match leaf {
+                None => {
+                    self.position = CursorPosition::AfterLast;
+                    return None;
+                }
+                Some(l) if l.keys.is_empty() => leaf = self.next_leaf(),
+                Some(l) => {
+                    self.position = CursorPosition::At(l, 0);
+                    return self.current();
+                }
+            }
+        }
+    }
+
+    /// Positions on the last entry of `leaf` or, if it is empty, of the
+    /// leaves before it.
+    fn enter_backward(&mut self, mut leaf: Option<&'a LeafNode>) -> Option<(&'a [u8], &'a [u8])> {
+        loop {
+            match leaf {
+                None => {
+                    self.position = CursorPosition::BeforeFirst;
+                    return None;
+                }
+                Some(l) if l.keys.is_empty() => leaf = self.prev_leaf(),
+                Some(l) => {
+                    self.position = CursorPosition::At(l, l.keys.len() - 1);
+                    return self.current();
+                }
+            }
+        }
+    }
+}
+
+/// Iterator over B+ tree keys, created by [`BTree::keys()`].
+pub struct BTreeKeys<'a> {
+    inner: BTreeIter<'a>,
+}
+
+impl<'a> Iterator for BTreeKeys<'a> {
+    type Item = &'a [u8];
+
+    fn next(&mut self) -> Option<Self::Item> {
+        self.inner.next_key()
+    }
+
+    fn nth(&mut self, n: usize) -> Option<Self::Item> {
+        self.inner.skip_entries(n);
+        self.inner.next_key()
     }
 }
 
@@ -619,6 +1394,26 @@ pub enum Bound<'a> {
     Excluded(&'a [u8]),
 }
 
+/// Returns whether `key` lies at or after the start bound `bound`.
+#[inline]
+fn is_at_or_after(key: &[u8], bound: &Bound<'_>, order: KeyOrder<'_>) -> bool {
+    match bound {
+        Bound::Unbounded => true,
+        Bound::Included(start) => !order.lt(key, start),
+        Bound::Excluded(start) => order.lt(start, key),
+    }
+}
+
+/// Returns whether `key` lies before the end bound `bound`.
+#[inline]
+fn is_before(key: &[u8], bound: &Bound<'_>, order: KeyOrder<'_>) -> bool {
+    match bound {
+        Bound::Unbounded => true,
+        Bound::Included(end) => !order.lt(end, key),
+        Bound::Excluded(end) => order.lt(key, end),
+    }
+}
+
 /// Iterator over a range of B+ tree key-value pairs.
 pub struct BTreeRangeIter<'a> {
     /// The underlying full iterator.
@@ -627,6 +1422,8 @@ pub struct BTreeRangeIter<'a> {
     start_bound: Bound<'a>,
     /// End bound for filtering.
     end_bound: Bound<'a>,
+    /// Order the bounds are compared in.
+    order: KeyOrder<'a>,
     /// Whether we've started yielding (past start bound).
     started: bool,
     /// Whether we've finished (past end bound).
@@ -640,6 +1437,7 @@ impl<'a> BTreeRangeIter<'a> {
             inner: tree.iter(),
             start_bound: start,
             end_bound: end,
+            order: tree.order(),
             started: false,
             finished: false,
         }
@@ -648,21 +1446,13 @@ impl<'a> BTreeRangeIter<'a> {
     /// Checks if a key is past the start bound.
     #[inline]
     fn is_at_or_past_start(&self, key: &[u8]) -> bool {
-        match &self.start_bound {
-            Bound::Unbounded => true,
-            Bound::Included(start) => key >= *start,
-            Bound::Excluded(start) => key > *start,
-        }
+        is_at_or_after(key, &self.start_bound, self.order)
     }
 
     /// Checks if a key is past the end bound.
     #[inline]
     fn is_past_end(&self, key: &[u8]) -> bool {
-        match &self.end_bound {
-            Bound::Unbounded => false,
-            Bound::Included(end) => key > *end,
-            Bound::Excluded(end) => key >= *end,
-        }
+        !is_before(key, &self.end_bound, self.order)
     }
 }
 
@@ -764,6 +1554,157 @@ mod tests {
         }
     }
 
+    #[test]
+    fn test_btree_iter_nth_matches_next() {
+        let mut tree = BTree::new();
+        for i in 0..5000u32 {
+            tree.insert(i.to_be_bytes().to_vec(), vec![i as u8]);
+        }
+
+        for (start, n) in [(0, 0), (0, 1), (3, 31), (10, 1000), (100, 4899), (0, 5000)] {
+            let mut skipped = tree.iter();
+            let mut stepped = tree.iter();
+            skipped.nth(start);
+            stepped.nth(start);
+
+            let landed = skipped.nth(n);
+            let mut expected = None;
+            for _ in 0..=n {
+                expected = stepped.next();
+            }
+            assert_eq!(landed, expected, "start {start}, n {n}");
+            assert_eq!(skipped.next(), stepped.next());
+        }
+    }
+
+    #[test]
+    fn test_btree_keys_match_iter() {
+        let mut tree = BTree::new();
+        assert_eq!(tree.keys().next(), None);
+        for i in (0..2000u32).rev() {
+            tree.insert(i.to_be_bytes().to_vec(), vec![0; 100]);
+        }
+
+        let expected: Vec<&[u8]> = tree.iter().map(|(k, _)| k).collect();
+        assert_eq!(tree.keys().collect::<Vec<_>>(), expected);
+        assert_eq!(tree.keys().nth(1234), Some(expected[1234]));
+    }
+
+    #[test]
+    fn test_btree_depth() {
+        let mut tree = BTree::new();
+        assert_eq!(tree.depth(), 0);
+        tree.insert(b"a".to_vec(), b"1".to_vec());
+        assert_eq!(tree.depth(), 1);
+
+        let mut last = 1;
+        for i in 0..50_000u32 {
+            tree.insert(i.to_be_bytes().to_vec(), vec![0; 8]);
+            let depth = tree.depth();
+            assert!(depth == last || depth == last + 1);
+            last = depth;
+        }
+        assert!((2..=6).contains(&last), "depth {last}");
+    }
+
+    #[test]
+    fn test_btree_check() {
+        let mut tree = BTree::new();
+        assert!(tree.check().is_empty());
+        for i in 0..5000u32 {
+            tree.insert(i.to_be_bytes().to_vec(), vec![0; 8]);
+        }
+        for i in (0..5000u32).step_by(3) {
+            tree.remove(&i.to_be_bytes());
+        }
+        assert!(tree.check().is_empty(), "{:?}", tree.check());
+
+        // A leaf key above the separator of its parent, and keys out of order.
+        let bad = BTree {
+            root: Some(Box::new(Node::Branch(BranchNode::new(
+                vec![b"m".to_vec()],
+                vec![
+                    Box::new(Node::Leaf(LeafNode::new(
+                        vec![b"a".to_vec(), b"z".to_vec()],
+                        vec![vec![], vec![]],
+                    ))),
+                    Box::new(Node::Leaf(LeafNode::new(
+                        vec![b"q".to_vec(), b"n".to_vec()],
+                        vec![vec![], vec![]],
+                    ))),
+                ],
+            )))),
+            len: 4,
+            comparator: None,
+        };
+        let problems = bad.check();
+        assert_eq!(problems.len(), 2, "{problems:?}");
+        assert!(problems[0].contains("outside the range"));
+        assert!(problems[1].contains("is not below"));
+    }
+
+    #[test]
+    fn test_btree_cursor_steps_both_ways() {
+        let mut tree = BTree::new();
+        assert_eq!(tree.cursor().first(), None);
+        assert_eq!(tree.cursor().last(), None);
+        for i in 0..3000u32 {
+            tree.insert(i.to_be_bytes().to_vec(), vec![i as u8]);
+        }
+        for i in (0..3000u32).step_by(3) {
+            tree.remove(&i.to_be_bytes());
+        }
+        let expected: Vec<&[u8]> = tree.keys().collect();
+
+        let mut cursor = tree.cursor();
+        let mut forward = Vec::new();
+        let mut entry = cursor.next();
+        while let Some((key, _)) = entry {
+            forward.push(key);
+            entry = cursor.next();
+        }
+        assert_eq!(forward, expected);
+
+        let mut backward = Vec::new();
+        let mut entry = cursor.prev();
+        while let Some((key, _)) = entry {
+            backward.push(key);
+            entry = cursor.prev();
+        }
+        backward.reverse();
+        assert_eq!(backward, expected);
+        assert!(cursor.is_before_first());
+
+        // Seeking lands on the key or its successor, across leaf boundaries.
+        for i in [0u32, 1, 3, 1000, 2997, 2998] {
+            let successor = (i..3000).find(|j| j % 3 != 0).unwrap();
+            let (key, _) = cursor.seek(&i.to_be_bytes()).unwrap();
+            assert_eq!(key, successor.to_be_bytes());
+        }
+        assert_eq!(cursor.seek(&3000u32.to_be_bytes()), None);
+        assert_eq!(cursor.prev().unwrap().0, 2999u32.to_be_bytes());
+    }
+
+    #[test]
+    fn test_btree_get_many_matches_get() {
+        let mut tree = BTree::new();
+        assert_eq!(tree.get_many(&[b"missing"]), vec![None]);
+        for i in 0..3000u32 {
+            tree.insert(i.to_be_bytes().to_vec(), vec![i as u8]);
+        }
+        for i in (0..3000u32).step_by(3) {
+            tree.remove(&i.to_be_bytes());
+        }
+
+        // Unsorted, repeated, and absent keys, including past the last one.
+        let keys: Vec<[u8; 4]> = [2999u32, 4, 0, 1500, 4, 3001, 1, 2998, 1501]
+            .iter()
+            .map(|i| i.to_be_bytes())
+            .collect();
+        let expected: Vec<_> = keys.iter().map(|k| tree.get(k)).collect();
+        assert_eq!(tree.get_many(&keys), expected);
+    }
+
     #[test]
     fn test_btree_interleaved_insert_delete() {
         let mut tree = BTree::new();
@@ -784,4 +1725,127 @@ mod tests {
             assert!(tree.get(format!("key{i:03}").as_bytes()).is_some());
         }
     }
+
+    #[test]
+    fn test_btree_range_size() {
+        let mut tree = BTree::new();
+        assert_eq!(tree.range_size(Bound::Unbounded, Bound::Unbounded), (0, 0));
+        for i in 0..3000u32 {
+            tree.insert(
+                format!("key{i:05}").into_bytes(),
+                vec![0; (i % 50) as usize],
+            );
+        }
+        for i in (0..3000u32).step_by(7) {
+            tree.remove(format!("key{i:05}").as_bytes());
+        }
+        for i in (0..3000u32).step_by(5) {
+            tree.insert(format!("key{i:05}").into_bytes(), vec![1; 100]);
+        }
+        assert!(tree.check().is_empty(), "{:?}", tree.check());
+
+        let scan = |start: Bound<'_>, end: Bound<'_>| {
+            tree.range(start, end).fold((0, 0), |(len, bytes), (k, v)| {
+                (len + 1, bytes + (k.len() + v.len()) as u64)
+            })
+        };
+        let keys = [
+            &b"key00000"[..],
+            b"key00007",
+            b"key00499",
+            b"key01234",
+            b"key02999",
+            b"zzz",
+        ];
+        for start in keys {
+            for end in keys {
+                for (s, e) in [
+                    (Bound::Included(start), Bound::Excluded(end)),
+                    (Bound::Excluded(start), Bound::Included(end)),
+                    (Bound::Unbounded, Bound::Excluded(end)),
+                    (Bound::Included(start), Bound::Unbounded),
+                ] {
+                    assert_eq!(
+                        tree.range_size(s.clone(), e.clone()),
+                        scan(s.clone(), e.clone()),
+                        "{s:?}..{e:?}"
+                    );
+                }
+            }
+        }
+        let all = tree.range_size(Bound::Unbounded, Bound::Unbounded);
+        assert_eq!(all.0, tree.len());
+    }
+
+    #[test]
+    fn test_btree_from_sorted() {
+        let entry = |i: u32| (format!("key{i:06}").into_bytes(), i.to_le_bytes().to_vec());
+        for n in [0, 1, 16, 32, 33, 100, 1057, 40_000] {
+            let tree = BTree::from_sorted((0..n).map(entry).collect());
+            assert!(tree.check().is_empty(), "n={n}: {:?}", tree.check());
+            assert_eq!(tree.len(), n as usize);
+            assert!(
+                tree.iter()
+                    .map(|(k, v)| (k.to_vec(), v.to_vec()))
+                    .eq((0..n).map(entry))
+            );
+        }
+
+        // A large run merges with existing entries; run values win.
+        let mut tree = BTree::new();
+        for i in (0..2000).step_by(3) {
+            tree.insert(entry(i).0, b"old".to_vec());
+        }
+        let run: Vec<_> = (0..2000).step_by(2).map(entry).collect();
+        let before = tree.len();
+        let inserted = tree.extend_sorted(run);
+        assert!(tree.check().is_empty(), "{:?}", tree.check());
+        assert_eq!(tree.len(), before + inserted);
+        for i in 0..2000 {
+            let expected = match (i % 2, i % 3) {
+                (0, _) => Some(entry(i).1),
+                (_, 0) => Some(b"old".to_vec()),
+                _ => None,
+            };
+            assert_eq!(tree.get(&entry(i).0).map(<[u8]>::to_vec), expected);
+        }
+
+        // A small run goes through regular inserts.
+        let inserted = tree.extend_sorted(vec![entry(1), entry(5000)]);
+        assert_eq!(inserted, 2);
+        assert!(tree.check().is_empty(), "{:?}", tree.check());
+    }
+
+    #[test]
+    fn test_comparator_orders_bucket_keys() {
+        use crate::bucket::bucket_data_key;
+
+        let reversed = KeyComparator::new(|a, b| b.cmp(a));
+        let mut tree = BTree::with_comparator(Some(reversed));
+        let key = |i: u32| bucket_data_key(b"b", &i.to_be_bytes());
+        for i in 0..1000u32 {
+            tree.insert(key(i), vec![]);
+        }
+        for i in (0..1000u32).step_by(7) {
+            tree.remove(&key(i));
+        }
+        // A merge rebuild keeps the comparator.
+        let run: Vec<_> = (1000..3000u32).rev().map(|i| (key(i), vec![])).collect();
+        tree.extend_sorted(run);
+        assert!(tree.check().is_empty(), "{:?}", tree.check());
+
+        let keys: Vec<_> = tree.keys().map(<[u8]>::to_vec).collect();
+        let expected: Vec<_> = (0..3000u32)
+            .rev()
+            .filter(|i| *i >= 1000 || i % 7 != 0)
+            .map(key)
+            .collect();
+        assert_eq!(keys, expected);
+
+        let (count, _) = tree.range_size(Bound::Included(&key(20)), Bound::Excluded(&key(9)));
+        // 20 down to 10, less 14.
+        assert_eq!(count, 10);
+        let mut cursor = tree.cursor();
+        assert_eq!(cursor.seek(&key(7)).map(|(k, _)| k.to_vec()), Some(key(6)));
+    }
 }
@@ -14,6 +14,59 @@
 //! This allows efficient range scans within a bucket while keeping all
 //! data in a single B+ tree.
 //!
+//! # Space Usage
+//!
+//! Because buckets are only key prefixes, a bucket never owns dedicated
+//! pages: every bucket is effectively stored inline alongside the others.
+//! An empty bucket costs one metadata entry, and a bucket with a few keys
+//! costs only those entries, so workloads with many tiny buckets need no
+//! separate inline-bucket format or promotion step.
+//!
+//! # Timestamps
+//!
+//! The bucket metadata value is a small header holding the bucket's creation
+//! and last-modification times as microseconds since the Unix epoch:
+//! `[created_at:u64][modified_at:u64]`. The modification time is refreshed
+//! by every commit that writes to the bucket. Buckets created before this
+//! header existed have an empty metadata value and report no timestamps.
+//!
+//! # Key Limits
+//!
+//! A bucket may cap its number of keys with `WriteTx::set_bucket_max_keys()`.
+//! The limit follows the timestamps in the header:
+//! `[max_keys:u64][policy:u8][next_seq:u64]`. When a commit would leave
+//! the bucket over its limit, the commit also deletes entries chosen by the
+//! bucket's [`EvictionPolicy`] until it fits.
+//!
+//! To evict the oldest entries, each key is assigned an insertion sequence
+//! number from `next_seq` the first time it is written, kept in an order
+//! entry `[BUCKET_ORDER_PREFIX][name_len][name][user_key]`. Overwriting a
+//! key keeps its sequence number. Keys inserted by the same transaction are
+//! numbered in key order.
+//!
+//! # Compaction Priority
+//!
+//! A bucket's [`CompactionPriority`] is a single byte after the key limit
+//! fields; those are then present even without a limit, with policy
+//! `NO_LIMIT`. Buckets at the default priority omit it.
+//!
+//! # Sequences
+//!
+//! A bucket's sequence counter, advanced by `WriteTx::next_bucket_sequence()`,
+//! is a `u64` after the compaction priority; the fields before it are then
+//! present too. Buckets whose sequence is 0 omit it. Living in the header,
+//! the counter commits with the transaction that advances it.
+//!
+//! # Bloom Filters
+//!
+//! A bucket may keep a Bloom filter over its keys, set with
+//! `WriteTx::set_bucket_bloom()`. Its bits per key are a single byte after
+//! the sequence, which is then present even when 0. Buckets without a
+//! filter omit it. Only the setting is stored: the filter itself is built
+//! from the bucket's keys when the database opens, like the database-wide
+//! filter, and kept up to date by each commit. See the
+//! [`bloom`](crate::bloom) module.
+//!
 //! # Nested Buckets
 //!
 //! Nested buckets extend this model to support hierarchical bucket structures.
@@ -26,8 +79,18 @@
 //! The format for nested bucket data is:
 //! `[NESTED_BUCKET_DATA_PREFIX][path_component_count][path...][user_key]`
 
+use std::cmp::Ordering;
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+use crate::bloom::BloomFilter;
 use crate::btree::BTree;
+use crate::cancel::{CancelCheck, CancelToken};
+use crate::checksum;
+use crate::comparator::KeyOrder;
+use crate::cursor::Cursor;
 use crate::error::{Error, Result};
+use crate::expiry::{self, ExpiryCheck};
+use crate::normalize;
 
 /// Magic prefix byte for bucket metadata entries.
 const BUCKET_META_PREFIX: u8 = 0x00;
@@ -41,6 +104,18 @@ const NESTED_BUCKET_META_PREFIX: u8 = 0x02;
 /// Magic prefix byte for nested bucket data entries.
 const NESTED_BUCKET_DATA_PREFIX: u8 = 0x03;
 
+/// Magic prefix byte for insertion order entries of key-limited buckets.
+const BUCKET_ORDER_PREFIX: u8 = 0x06;
+
+/// Size of the bucket metadata header in bytes.
+const BUCKET_HEADER_SIZE: usize = 16;
+
+/// Size of the key limit fields following the header timestamps.
+const KEY_LIMIT_SIZE: usize = 17;
+
+/// Eviction policy byte of key limit fields that hold no limit.
+const NO_LIMIT: u8 = 0xFF;
+
 /// Maximum allowed bucket name length in bytes.
 pub const MAX_BUCKET_NAME_LEN: usize = 255;
 
@@ -78,6 +153,350 @@ pub fn bucket_meta_key(name: &[u8]) -> Vec<u8> {
     key
 }
 
+/// Returns true if `key` is a bucket metadata key.
+#[inline]
+pub fn is_bucket_meta_key(key: &[u8]) -> bool {
+    key.first() == Some(&BUCKET_META_PREFIX)
+}
+
+/// Converts a time to microseconds since the Unix epoch.
+#[inline]
+fn to_micros(time: SystemTime) -> u64 {
+    time.duration_since(UNIX_EPOCH)
+        .map_or(0, |d| d.as_micros() as u64)
+}
+
+/// Encodes a bucket metadata header.
+///
+/// Format: `[created_at:u64][modified_at:u64]`, microseconds since the epoch.
+pub fn encode_bucket_header(created_at: SystemTime, modified_at: SystemTime) -> Vec<u8> {
+    let mut header = Vec::with_capacity(BUCKET_HEADER_SIZE);
+    header.extend_from_slice(&to_micros(created_at).to_le_bytes());
+    header.extend_from_slice(&to_micros(modified_at).to_le_bytes());
+    header
+}
+
+/// Creates the header for a bucket created now.
+#[inline]
+pub fn new_bucket_header() -> Vec<u8> {
+    let now = SystemTime::now();
+    encode_bucket_header(now, now)
+}
+
+/// Decodes a bucket metadata header into `(created_at, modified_at)`.
+///
+/// Returns `None` for buckets created without a header.
+pub fn decode_bucket_header(header: &[u8]) -> Option<(SystemTime, SystemTime)> {
+    if header.len() < BUCKET_HEADER_SIZE {
+        return None;
+    }
+    let created = u64::from_le_bytes(header[0..8].try_into().ok()?);
+    let modified = u64::from_le_bytes(header[8..16].try_into().ok()?);
+    Some((
+        UNIX_EPOCH + Duration::from_micros(created),
+        UNIX_EPOCH + Duration::from_micros(modified),
+    ))
+}
+
+/// Returns `header` with its modification time set to `now`.
+///
+/// Fields following the timestamps are kept. Headers from buckets created
+/// before timestamps existed start tracking at `now`.
+pub fn touch_bucket_header(header: Option<&[u8]>, now: SystemTime) -> Vec<u8> {
+    let Some(header) = header.filter(|h| h.len() >= BUCKET_HEADER_SIZE) else {
+        return encode_bucket_header(now, now);
+    };
+    let mut touched = header.to_vec();
+    touched[8..16].copy_from_slice(&to_micros(now).to_le_bytes());
+    touched
+}
+
+/// How a key-limited bucket picks entries to evict.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum EvictionPolicy {
+    /// Evict the entries inserted first.
+    OldestInserted,
+    /// Evict the entries with the smallest keys.
+    SmallestKey,
+}
+
+/// Whether `WriteTx::delete_bucket_if_empty()` treats sub-buckets holding
+/// no keys as empty.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub enum EmptySubBuckets {
+    /// Any sub-bucket keeps the bucket from being deleted.
+    #[default]
+    Keep,
+    /// Sub-buckets holding no keys count as empty and are deleted with
+    /// the bucket.
+    Delete,
+}
+
+/// What `WriteTx::truncate_bucket()` does with the bucket's sequence
+/// counter.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub enum TruncateSequence {
+    /// The counter carries on, so keys generated after truncating never
+    /// repeat earlier ones.
+    #[default]
+    Keep,
+    /// The counter restarts at 0, as in a newly created bucket.
+    Reset,
+}
+
+/// Maximum number of keys a bucket holds, and how it makes room.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct KeyLimit {
+    /// Maximum number of keys.
+    pub max_keys: u64,
+    /// Which entries are evicted when the limit is exceeded.
+    pub policy: EvictionPolicy,
+}
+
+/// Decodes the key limit and next insertion sequence number from a
+/// bucket metadata header.
+///
+/// Returns `None` if the bucket has no key limit.
+pub fn decode_key_limit(header: &[u8]) -> Option<(KeyLimit, u64)> {
+    let fields = header.get(BUCKET_HEADER_SIZE..BUCKET_HEADER_SIZE + KEY_LIMIT_SIZE)?;
+    let max_keys = u64::from_le_bytes(fields[0..8].try_into().ok()?);
+    let policy = match fields[8] {
+        0 => EvictionPolicy::OldestInserted,
+        1 => EvictionPolicy::SmallestKey,
+        _ => return None,
+    };
+    let next_seq = u64::from_le_bytes(fields[9..17].try_into().ok()?);
+    Some((KeyLimit { max_keys, policy }, next_seq))
+}
+
+/// Returns `header` with its key limit replaced, or removed if `limit` is
+/// `None`.
+pub fn with_key_limit(header: Option<&[u8]>, limit: Option<(KeyLimit, u64)>) -> Vec<u8> {
+    let priority = header.map_or(CompactionPriority::Normal, decode_compaction_priority);
+    let sequence = header.map_or(0, decode_sequence);
+    let bloom = header.and_then(decode_bloom_bits);
+    encode_header_fields(header, limit, priority, sequence, bloom)
+}
+
+/// How eagerly auto-compaction reclaims space left by a bucket.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, PartialOrd, Ord)]
+pub enum CompactionPriority {
+    /// Tolerate more fragmentation before compacting.
+    Low,
+    /// The default thresholds.
+    #[default]
+    Normal,
+    /// Compact at the lowest fragmentation.
+    High,
+}
+
+/// Decodes the compaction priority from a bucket metadata header.
+pub fn decode_compaction_priority(header: &[u8]) -> CompactionPriority {
+    match header.get(BUCKET_HEADER_SIZE + KEY_LIMIT_SIZE) {
+        Some(0) => CompactionPriority::Low,
+        Some(2) => CompactionPriority::High,
+        _ => CompactionPriority::Normal,
+    }
+}
+
+/// Returns `header` with its compaction priority replaced.
+pub fn with_compaction_priority(header: Option<&[u8]>, priority: CompactionPriority) -> Vec<u8> {
+    let limit = header.and_then(decode_key_limit);
+    let sequence = header.map_or(0, decode_sequence);
+    let bloom = header.and_then(decode_bloom_bits);
+    encode_header_fields(header, limit, priority, sequence, bloom)
+}
+
+/// Decodes the sequence counter from a bucket metadata header.
+pub fn decode_sequence(header: &[u8]) -> u64 {
+    let start = BUCKET_HEADER_SIZE + KEY_LIMIT_SIZE + 1;
+    header
+        .get(start..start + 8)
+        .and_then(|bytes| bytes.try_into().ok())
+        .map_or(0, u64::from_le_bytes)
+}
+
+/// Returns `header` with its sequence counter replaced.
+pub fn with_sequence(header: Option<&[u8]>, sequence: u64) -> Vec<u8> {
+    let limit = header.and_then(decode_key_limit);
+    let priority = header.map_or(CompactionPriority::Normal, decode_compaction_priority);
+    let bloom = header.and_then(decode_bloom_bits);
+    encode_header_fields(header, limit, priority, sequence, bloom)
+}
+
+/// Decodes the Bloom filter bits per key from a bucket metadata header.
+///
+/// Returns `None` if the bucket has no filter.
+pub fn decode_bloom_bits(header: &[u8]) -> Option<u8> {
+    header
+        .get(BUCKET_HEADER_SIZE + KEY_LIMIT_SIZE + 9)
+        .copied()
+        .filter(|&bits| bits != 0)
+}
+
+/// Returns `header` with its Bloom filter bits per key replaced, or the
+/// filter removed if `bits_per_key` is `None`.
+pub fn with_bloom_bits(header: Option<&[u8]>, bits_per_key: Option<u8>) -> Vec<u8> {
+    let limit = header.and_then(decode_key_limit);
+    let priority = header.map_or(CompactionPriority::Normal, decode_compaction_priority);
+    let sequence = header.map_or(0, decode_sequence);
+    encode_header_fields(header, limit, priority, sequence, bits_per_key)
+}
+
+/// Re-encodes the fields following the timestamps of `header`.
+///
+/// Fields are positional, so a priority is preceded by key limit fields
+/// even when the bucket has no limit; those carry the `NO_LIMIT` policy.
+/// Likewise a sequence is preceded by a priority, and Bloom filter bits
+/// by a sequence.
+fn encode_header_fields(
+    header: Option<&[u8]>,
+    limit: Option<(KeyLimit, u64)>,
+    priority: CompactionPriority,
+    sequence: u64,
+    bloom: Option<u8>,
+) -> Vec<u8> {
+    let mut updated = match header.filter(|h| h.len() >= BUCKET_HEADER_SIZE) {
+        Some(header) => header[..BUCKET_HEADER_SIZE].to_vec(),
+        None => new_bucket_header(),
+    };
+    if limit.is_none() && priority == CompactionPriority::Normal && sequence == 0 && bloom.is_none()
+    {
+        return updated;
+    }
+
+    let (max_keys, policy, next_seq) = match limit {
+        Some((limit, next_seq)) => {
+            let policy = match limit.policy {
+                EvictionPolicy::OldestInserted => 0,
+                EvictionPolicy::SmallestKey => 1,
+            };
+            (limit.max_keys, policy, next_seq)
+        }
+        None => (0, NO_LIMIT, 0),
+    };
+    updated.extend_from_slice(&max_keys.to_le_bytes());
+    updated.push(policy);
+    updated.extend_from_slice(&next_seq.to_le_bytes());
+
+    if priority != CompactionPriority::Normal || sequence != 0 || bloom.is_some() {
+        updated.push(match priority {
+            CompactionPriority::Low => 0,
+            CompactionPriority::Normal => 1,
+            CompactionPriority::High => 2,
+        });
+    }
+    if sequence != 0 || bloom.is_some() {
+        updated.extend_from_slice(&sequence.to_le_bytes());
+    }
+    if let Some(bits) = bloom {
+        updated.push(bits);
+    }
+    updated
+}
+
+/// Creates the internal key holding the insertion sequence number of a key
+/// in a key-limited bucket.
+///
+/// Format: `[BUCKET_ORDER_PREFIX][bucket_name_len:u8][bucket_name][user_key]`
+#[inline]
+pub fn bucket_order_key(bucket_name: &[u8], user_key: &[u8]) -> Vec<u8> {
+    let mut key = bucket_order_prefix(bucket_name);
+    key.extend_from_slice(user_key);
+    key
+}
+
+/// Returns the prefix for all order entries of a bucket.
+#[inline]
+pub fn bucket_order_prefix(bucket_name: &[u8]) -> Vec<u8> {
+    let mut prefix = Vec::with_capacity(2 + bucket_name.len());
+    prefix.push(BUCKET_ORDER_PREFIX);
+    prefix.push(bucket_name.len() as u8);
+    prefix.extend_from_slice(bucket_name);
+    prefix
+}
+
+/// Returns true if `key` is a bucket order entry key.
+#[inline]
+pub fn is_bucket_order_key(key: &[u8]) -> bool {
+    key.first() == Some(&BUCKET_ORDER_PREFIX)
+}
+
+/// Returns true if `key` is a companion entry kept alongside another entry:
+/// a value checksum, an original key, a bucket order entry or a deadline.
+#[inline]
+pub(crate) fn is_internal_companion(key: &[u8]) -> bool {
+    checksum::is_checksum_key(key)
+        || normalize::is_original_key_entry(key)
+        || is_bucket_order_key(key)
+        || expiry::is_expiry_key(key)
+}
+
+/// Returns whether `tree` holds any companion entries.
+pub(crate) fn has_internal_companions(tree: &BTree) -> bool {
+    // The companion prefixes are adjacent, so the first key at or past the
+    // lowest one tells.
+    tree.cursor()
+        .seek(&[checksum::VALUE_CHECKSUM_PREFIX])
+        .is_some_and(|(key, _)| is_internal_companion(key))
+}
+
+/// Returns the top-level bucket a stored key belongs to.
+///
+/// Covers the bucket's metadata, data and insertion order entries.
+pub fn bucket_name_of_key(key: &[u8]) -> Option<&[u8]> {
+    match key.first() {
+        Some(&BUCKET_META_PREFIX) | Some(&BUCKET_DATA_PREFIX) | Some(&BUCKET_ORDER_PREFIX) => {
+            let name_len = *key.get(1)? as usize;
+            key.get(2..2 + name_len)
+        }
+        _ => None,
+    }
+}
+
+/// Returns `key` moved from top-level bucket `old` to bucket `new`, or
+/// `None` if it does not belong to `old`.
+///
+/// Covers the bucket's metadata, data and insertion order entries, the
+/// entries of its nested buckets, and the checksum and expiry entries of
+/// any of those.
+pub fn renamed_bucket_key(key: &[u8], old: &[u8], new: &[u8]) -> Option<Vec<u8>> {
+    let prefix = *key.first()?;
+    if checksum::is_checksum_key(key) || expiry::is_expiry_key(key) {
+        let mut renamed = vec![prefix];
+        renamed.extend_from_slice(&renamed_bucket_key(&key[1..], old, new)?);
+        return Some(renamed);
+    }
+    // Nested keys start with their component count.
+    let name_at = match prefix {
+        BUCKET_META_PREFIX | BUCKET_DATA_PREFIX | BUCKET_ORDER_PREFIX => 1,
+        NESTED_BUCKET_META_PREFIX | NESTED_BUCKET_DATA_PREFIX => 2,
+        _ => return None,
+    };
+    let name_len = *key.get(name_at)? as usize;
+    if key.get(name_at + 1..name_at + 1 + name_len)? != old {
+        return None;
+    }
+    let mut renamed = Vec::with_capacity(key.len() - old.len() + new.len());
+    renamed.extend_from_slice(&key[..name_at]);
+    renamed.push(new.len() as u8);
+    renamed.extend_from_slice(new);
+    renamed.extend_from_slice(&key[name_at + 1 + name_len..]);
+    Some(renamed)
+}
+
+/// Returns the bucket name a data key belongs to.
+///
+/// Returns `None` if `key` is not a top-level bucket data key.
+#[inline]
+pub fn bucket_name_of_data_key(key: &[u8]) -> Option<&[u8]> {
+    if key.first() != Some(&BUCKET_DATA_PREFIX) || key.len() < 2 {
+        return None;
+    }
+    let name_len = key[1] as usize;
+    key.get(2..2 + name_len)
+}
+
 /// Creates the internal key for a data entry within a bucket.
 ///
 /// Format: `[BUCKET_DATA_PREFIX][bucket_name_len:u8][bucket_name][user_key]`
@@ -138,8 +557,7 @@ pub fn create_bucket(tree: &mut BTree, name: &[u8]) -> Result<()> {
         });
     }
 
-    // Store bucket metadata (empty value for now, can add stats later).
-    tree.insert(meta_key, Vec::new());
+    tree.insert(meta_key, new_bucket_header());
     Ok(())
 }
 
@@ -158,7 +576,7 @@ pub fn create_bucket_if_not_exists(tree: &mut BTree, name: &[u8]) -> Result<bool
         return Ok(false);
     }
 
-    tree.insert(meta_key, Vec::new());
+    tree.insert(meta_key, new_bucket_header());
     Ok(true)
 }
 
@@ -180,10 +598,11 @@ pub fn delete_bucket(tree: &mut BTree, name: &[u8]) -> Result<()> {
 
     // Collect all keys to delete (bucket metadata + all data entries).
     let prefix = bucket_data_prefix(name);
+    let order_prefix = bucket_order_prefix(name);
     let keys_to_delete: Vec<Vec<u8>> = tree
         .iter()
         .filter_map(|(k, _)| {
-            if k.starts_with(&prefix) {
+            if k.starts_with(&prefix) || k.starts_with(&order_prefix) {
                 Some(k.to_vec())
             } else {
                 None
@@ -267,6 +686,62 @@ pub fn nested_bucket_data_prefix(path: &[&[u8]]) -> Vec<u8> {
     encode_path(NESTED_BUCKET_DATA_PREFIX, path)
 }
 
+/// Returns true if `key` is a nested bucket metadata key.
+#[inline]
+pub fn is_nested_bucket_meta_key(key: &[u8]) -> bool {
+    key.first() == Some(&NESTED_BUCKET_META_PREFIX)
+}
+
+/// Splits a bucket data key into its bucket path and user key.
+///
+/// The path has one component for a top-level bucket and one per level for
+/// a nested bucket. Returns `None` if `key` is not a well-formed bucket
+/// data key.
+pub fn split_data_key(key: &[u8]) -> Option<(Vec<&[u8]>, &[u8])> {
+    match key.first() {
+        Some(&BUCKET_DATA_PREFIX) => {
+            let name = bucket_name_of_data_key(key)?;
+            Some((vec![name], &key[2 + name.len()..]))
+        }
+        Some(&NESTED_BUCKET_DATA_PREFIX) => {
+            let count = *key.get(1)? as usize;
+            let mut path = Vec::with_capacity(count);
+            let mut pos = 2;
+            for _ in 0..count {
+                let len = *key.get(pos)? as usize;
+                path.push(key.get(pos + 1..pos + 1 + len)?);
+                pos += 1 + len;
+            }
+            Some((path, &key[pos..]))
+        }
+        _ => None,
+    }
+}
+
+/// Returns the length of the bucket path part of a data key, so that
+/// `&key[len..]` is its user key.
+///
+/// Like [`split_data_key()`] but without collecting the path. Returns
+/// `None` if `key` is not a well-formed bucket data key.
+#[inline]
+pub(crate) fn data_key_prefix_len(key: &[u8]) -> Option<usize> {
+    match key.first() {
+        Some(&BUCKET_DATA_PREFIX) => {
+            let len = 2 + *key.get(1)? as usize;
+            (len <= key.len()).then_some(len)
+        }
+        Some(&NESTED_BUCKET_DATA_PREFIX) => {
+            let count = *key.get(1)? as usize;
+            let mut pos = 2;
+            for _ in 0..count {
+                pos += 1 + *key.get(pos)? as usize;
+            }
+            (pos <= key.len()).then_some(pos)
+        }
+        _ => None,
+    }
+}
+
 /// Validates a nested bucket path.
 ///
 /// # Errors
@@ -493,6 +968,15 @@ fn is_child_path(key: &[u8], parent_path: &[&[u8]]) -> bool {
 /// For a top-level bucket, pass the bucket name.
 /// For a nested bucket, pass the full path.
 pub fn list_nested_buckets(tree: &BTree, parent_path: &[&[u8]]) -> Vec<Vec<u8>> {
+    nested_bucket_names(tree, parent_path)
+        .into_iter()
+        .map(<[u8]>::to_vec)
+        .collect()
+}
+
+/// Returns the names of the buckets directly under `parent_path`, borrowed
+/// from the tree, in the order of their metadata keys.
+fn nested_bucket_names<'a>(tree: &'a BTree, parent_path: &[&[u8]]) -> Vec<&'a [u8]> {
     let expected_depth = parent_path.len() + 1;
 
     tree.iter()
@@ -535,7 +1019,7 @@ pub fn list_nested_buckets(tree: &BTree, parent_path: &[&[u8]]) -> Vec<Vec<u8>>
             if offset + child_len > k.len() {
                 return None;
             }
-            Some(k[offset..offset + child_len].to_vec())
+            Some(&k[offset..offset + child_len])
         })
         .collect()
 }
@@ -644,6 +1128,12 @@ impl<'a> Iterator for NestedBucketIter<'a> {
 pub struct BucketRef<'a> {
     tree: &'a BTree,
     name: Vec<u8>,
+    /// Hides entries past their TTL.
+    expiry: ExpiryCheck<'a>,
+    /// Cancels the transaction this reference was taken from, if any.
+    cancel: Option<CancelToken>,
+    /// The bucket's Bloom filter, consulted before descending the tree.
+    bloom: Option<&'a BloomFilter>,
 }
 
 impl<'a> BucketRef<'a> {
@@ -664,9 +1154,32 @@ impl<'a> BucketRef<'a> {
         Ok(Self {
             tree,
             name: name.to_vec(),
+            expiry: ExpiryCheck::new(tree),
+            cancel: None,
+            bloom: None,
         })
     }
 
+    /// Returns the reference, with its scans stopping once `cancel` is
+    /// cancelled.
+    pub(crate) fn with_cancel(mut self, cancel: Option<CancelToken>) -> Self {
+        self.cancel = cancel;
+        self
+    }
+
+    /// Returns the reference, with lookups first consulting `bloom`.
+    ///
+    /// `bloom` must cover every key of the bucket in `tree`.
+    pub(crate) fn with_bloom(mut self, bloom: Option<&'a BloomFilter>) -> Self {
+        self.bloom = bloom;
+        self
+    }
+
+    /// Returns fresh cancellation checks for a scan of the bucket.
+    fn cancel_check(&self) -> CancelCheck {
+        CancelCheck::new(self.cancel.clone())
+    }
+
     /// Returns the bucket name.
     #[inline]
     pub fn name(&self) -> &[u8] {
@@ -675,17 +1188,199 @@ impl<'a> BucketRef<'a> {
 
     /// Retrieves the value associated with the given key.
     ///
-    /// Returns `None` if the key does not exist in this bucket.
-    pub fn get(&self, key: &[u8]) -> Option<&[u8]> {
+    /// Returns `None` if the key does not exist in this bucket or has
+    /// expired. Keys the bucket's Bloom filter rules out are answered
+    /// without descending the tree.
+    pub fn get(&self, key: &[u8]) -> Option<&'a [u8]> {
+        if self.bloom.is_some_and(|bloom| !bloom.may_contain(key)) {
+            return None;
+        }
         let internal_key = bucket_data_key(&self.name, key);
-        self.tree.get(&internal_key)
+        let value = self.tree.get(&internal_key)?;
+        (!self.expiry.is_expired_now(&internal_key)).then_some(value)
+    }
+
+    /// Retrieves the values of several keys at once.
+    ///
+    /// Returns the values in the order of `keys`, `None` for keys that do
+    /// not exist or have expired. The keys are looked up in sorted order
+    /// with one walk of the tree, which is cheaper than calling
+    /// [`get()`](Self::get) for each when there are many.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let rtx = db.read_tx();
+    /// let values = rtx.bucket(b"users")?.get_many(&[b"carol", b"alice"]);
+    /// ```
+    pub fn get_many<K: AsRef<[u8]>>(&self, keys: &[K]) -> Vec<Option<&'a [u8]>> {
+        // Drop definite misses before walking the tree.
+        let (probes, internal_keys): (Vec<usize>, Vec<Vec<u8>>) = keys
+            .iter()
+            .enumerate()
+            .filter(|(_, key)| {
+                self.bloom
+                    .is_none_or(|bloom| bloom.may_contain(key.as_ref()))
+            })
+            .map(|(i, key)| (i, bucket_data_key(&self.name, key.as_ref())))
+            .unzip();
+
+        let expiry = self.expiry.refreshed();
+        let mut values = vec![None; keys.len()];
+        for ((i, internal_key), value) in probes
+            .into_iter()
+            .zip(&internal_keys)
+            .zip(self.tree.get_many(&internal_keys))
+        {
+            values[i] = value.filter(|_| !expiry.is_expired(internal_key));
+        }
+        values
+    }
+
+    /// Returns a reader over the value of `key`, or `None` if the key does
+    /// not exist.
+    ///
+    /// Reads straight from the transaction's view of the committed tree
+    /// without copying the value, so streaming a large value to a file or
+    /// socket needs no buffer of its size. The reader sees the value as of
+    /// the transaction or snapshot it came from, even if the key is
+    /// overwritten meanwhile.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let rtx = db.read_tx();
+    /// if let Some(mut reader) = rtx.bucket(b"blobs")?.value_reader(b"video.mp4") {
+    ///     std::io::copy(&mut reader, &mut response)?;
+    /// }
+    /// ```
+    pub fn value_reader(&self, key: &[u8]) -> Option<std::io::Cursor<&'a [u8]>> {
+        self.get(key).map(std::io::Cursor::new)
+    }
+
+    /// Returns when the bucket was created.
+    ///
+    /// Returns `None` for buckets created before timestamps were recorded.
+    pub fn created_at(&self) -> Option<SystemTime> {
+        self.header().map(|(created, _)| created)
+    }
+
+    /// Returns when a committed transaction last wrote to the bucket.
+    ///
+    /// Equals the creation time until the bucket is first written to.
+    /// Returns `None` for buckets created before timestamps were recorded.
+    pub fn modified_at(&self) -> Option<SystemTime> {
+        self.header().map(|(_, modified)| modified)
+    }
+
+    /// Returns the bucket's key limit, if it has one.
+    pub fn key_limit(&self) -> Option<KeyLimit> {
+        let header = self.tree.get(&bucket_meta_key(&self.name))?;
+        decode_key_limit(header).map(|(limit, _)| limit)
+    }
+
+    /// Returns the bucket's sequence counter: the value last returned by
+    /// `WriteTx::next_bucket_sequence()`, or 0 if it was never advanced.
+    pub fn sequence(&self) -> u64 {
+        self.tree
+            .get(&bucket_meta_key(&self.name))
+            .map_or(0, decode_sequence)
+    }
+
+    /// Returns the bucket's compaction priority.
+    pub fn compaction_priority(&self) -> CompactionPriority {
+        self.tree
+            .get(&bucket_meta_key(&self.name))
+            .map_or(CompactionPriority::Normal, decode_compaction_priority)
+    }
+
+    /// Returns the bits per key of the bucket's Bloom filter, or `None` if
+    /// it has none.
+    pub fn bloom_bits_per_key(&self) -> Option<u8> {
+        self.tree
+            .get(&bucket_meta_key(&self.name))
+            .and_then(decode_bloom_bits)
+    }
+
+    /// Decodes the bucket's metadata header.
+    fn header(&self) -> Option<(SystemTime, SystemTime)> {
+        decode_bucket_header(self.tree.get(&bucket_meta_key(&self.name))?)
     }
 
     /// Returns an iterator over all key-value pairs in the bucket.
     ///
     /// Keys are returned without the bucket prefix.
     pub fn iter(&self) -> BucketIter<'_> {
-        BucketIter::new(self.tree, &self.name)
+        BucketIter::new(self.tree, &self.name, self.expiry.refreshed())
+            .cancellable(self.cancel_check())
+    }
+
+    /// Returns an iterator over the keys in the bucket, in sorted order.
+    ///
+    /// Keys are returned without the bucket prefix. Tree leaves store keys
+    /// apart from values, so a keys-only scan reads only key bytes, however
+    /// large the values are.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let bucket = rtx.bucket(b"documents")?;
+    /// let ids: Vec<&[u8]> = bucket.keys().collect();
+    /// ```
+    pub fn keys(&self) -> BucketKeys<'_> {
+        BucketKeys::new(self.tree, &self.name, self.expiry.refreshed())
+            .cancellable(self.cancel_check())
+    }
+
+    /// Returns a read-only view of a sub-bucket of this bucket.
+    ///
+    /// Sub-buckets are created with `WriteTx::create_nested_bucket()`.
+    ///
+    /// # Errors
+    ///
+    /// Returns `BucketNotFound` if the sub-bucket doesn't exist.
+    /// Returns `InvalidBucketName` if the name is invalid.
+    pub fn bucket(&self, name: &[u8]) -> Result<NestedBucketRef<'a>> {
+        NestedBucketRef::new(self.tree, &[&self.name, name])
+    }
+
+    /// Returns an iterator over the bucket's entries and sub-buckets, in
+    /// name order.
+    ///
+    /// Entries are returned as `(key, Some(value))` and sub-buckets as
+    /// `(name, None)`, following bbolt's convention of a nil value for
+    /// buckets. Keys and sub-buckets live in separate namespaces, so a key
+    /// and a sub-bucket may share a name; the sub-bucket comes first.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let bucket = rtx.bucket(b"accounts")?;
+    /// for (name, value) in bucket.iter_with_buckets() {
+    ///     match value {
+    ///         Some(value) => print_entry(name, value),
+    ///         None => print_child(name, bucket.bucket(name)?),
+    ///     }
+    /// }
+    /// ```
+    pub fn iter_with_buckets(&self) -> BucketWithChildrenIter<'a> {
+        let mut children = nested_bucket_names(self.tree, &[&self.name]);
+        children.sort_unstable();
+        BucketWithChildrenIter {
+            entries: BucketIter::new(self.tree, &self.name, self.expiry.refreshed())
+                .cancellable(self.cancel_check())
+                .peekable(),
+            children: children.into_iter().peekable(),
+        }
+    }
+
+    /// Returns a cursor over the bucket's entries that can step in both
+    /// directions.
+    ///
+    /// See the [`cursor`](crate::cursor) module for how it moves.
+    pub fn cursor(&self) -> Cursor<'a> {
+        Cursor::with_expiry(self.tree, &self.name, self.expiry.refreshed())
+            .cancellable(self.cancel_check())
     }
 
     /// Returns an iterator over a range of key-value pairs in the bucket.
@@ -696,10 +1391,438 @@ impl<'a> BucketRef<'a> {
     where
         R: std::ops::RangeBounds<&'a [u8]>,
     {
-        BucketRangeIter::new(self.tree, &self.name, range)
+        BucketRangeIter::new(self.tree, &self.name, range, self.expiry.refreshed())
+            .cancellable(self.cancel_check())
+    }
+
+    /// Visits every entry in the bucket, in key order.
+    ///
+    /// Stops at the first error returned by `f` and returns it, so `f` can
+    /// end the scan early. The key and value are borrowed for the duration
+    /// of the call only; copy them (e.g. with `to_vec()`) to keep them
+    /// afterwards.
+    ///
+    /// # Errors
+    ///
+    /// Returns the first error returned by `f`, or `TxCancelled` if the
+    /// transaction is cancelled during the scan.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let bucket = rtx.bucket(b"events")?;
+    /// let mut total = 0u64;
+    /// bucket.for_each(|_key, value| {
+    ///     total += decode_amount(value)?;
+    ///     Ok(())
+    /// })?;
+    /// ```
+    pub fn for_each<F>(&self, f: F) -> Result<()>
+    where
+        F: FnMut(&[u8], &[u8]) -> Result<()>,
+    {
+        self.for_each_range(None, None, f)
+    }
+
+    /// Visits every key in the bucket, in key order, without its value.
+    ///
+    /// The keys-only counterpart of [`for_each()`](Self::for_each), built
+    /// on [`keys()`](Self::keys): values are never touched, so counting or
+    /// collecting the keys of a bucket of large values reads only key
+    /// bytes. Stops at the first error returned by `f` and returns it.
+    ///
+    /// # Errors
+    ///
+    /// Returns the first error returned by `f`, or `TxCancelled` if the
+    /// transaction is cancelled during the scan.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let bucket = rtx.bucket(b"blobs")?;
+    /// let mut ids = HashSet::new();
+    /// bucket.for_each_key(|key| {
+    ///     ids.insert(key.to_vec());
+    ///     Ok(())
+    /// })?;
+    /// ```
+    pub fn for_each_key<F>(&self, mut f: F) -> Result<()>
+    where
+        F: FnMut(&[u8]) -> Result<()>,
+    {
+        for key in self.keys() {
+            f(key)?;
+        }
+        self.cancel_check().check()
+    }
+
+    /// Visits the entries whose keys start with `prefix`, in key order.
+    ///
+    /// Seeks straight to the first matching key and stops at the first key
+    /// that no longer matches, so the cost depends on the number of matches
+    /// rather than the size of the bucket. Scanning stops at the first error
+    /// returned by `f`.
+    ///
+    /// # Errors
+    ///
+    /// Returns the first error returned by `f`, or `TxCancelled` if the
+    /// transaction is cancelled during the scan.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let bucket = rtx.bucket(b"users")?;
+    /// bucket.for_each_prefix(b"user:42:", |key, value| {
+    ///     profile.set_field(&key[b"user:42:".len()..], value);
+    ///     Ok(())
+    /// })?;
+    /// ```
+    pub fn for_each_prefix<F>(&self, prefix: &[u8], mut f: F) -> Result<()>
+    where
+        F: FnMut(&[u8], &[u8]) -> Result<()>,
+    {
+        let mut cursor = self.cursor();
+        let mut entry = cursor.seek(prefix);
+        while let Some((key, value)) = entry.filter(|(key, _)| key.starts_with(prefix)) {
+            f(key, value)?;
+            entry = cursor.next();
+        }
+        self.cancel_check().check()
+    }
+
+    /// Visits the entries with keys in `[start, end)`, in key order.
+    ///
+    /// `start` is inclusive and `end` exclusive; `None` leaves that side
+    /// unbounded. Seeks straight to `start` instead of scanning from the
+    /// beginning of the bucket, so reading a window of a large bucket costs
+    /// only the entries inside it. A range with `start >= end` visits
+    /// nothing. Scanning stops at the first error returned by `f`.
+    ///
+    /// # Errors
+    ///
+    /// Returns the first error returned by `f`, or `TxCancelled` if the
+    /// transaction is cancelled during the scan.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let bucket = rtx.bucket(b"metrics")?;
+    /// // One hour of samples keyed by big-endian timestamp.
+    /// bucket.for_each_range(Some(&from.to_be_bytes()), Some(&to.to_be_bytes()), |key, value| {
+    ///     plot(key, value);
+    ///     Ok(())
+    /// })?;
+    /// ```
+    pub fn for_each_range<F>(
+        &self,
+        start: Option<&[u8]>,
+        end: Option<&[u8]>,
+        mut f: F,
+    ) -> Result<()>
+    where
+        F: FnMut(&[u8], &[u8]) -> Result<()>,
+    {
+        let mut cursor = self.cursor();
+        let mut entry = match start {
+            Some(start) => cursor.seek(start),
+            None => cursor.first(),
+        };
+        let order = self.tree.order();
+        while let Some((key, value)) =
+            entry.filter(|(key, _)| end.is_none_or(|end| order.cmp_in_bucket(key, end).is_lt()))
+        {
+            f(key, value)?;
+            entry = cursor.next();
+        }
+        self.cancel_check().check()
+    }
+
+    /// Returns the total bytes of the keys and values with keys in
+    /// `[start, end)`.
+    ///
+    /// `start` is inclusive and `end` exclusive; `None` leaves that side
+    /// unbounded. The tree caches the size of every subtree, so only the
+    /// nodes along the two bounds are visited: the cost does not grow with
+    /// the number of entries in the range, which makes it cheap to call
+    /// repeatedly when searching for split points. The result is exact,
+    /// except that it includes entries past their TTL that have not been
+    /// purged yet. Keys are counted without the bucket prefix.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let bucket = rtx.bucket(b"users")?;
+    /// let total = bucket.range_size(None, None);
+    /// let left = bucket.range_size(None, Some(b"m"));
+    /// println!("{:.0}% of the bytes sort before \"m\"", 100.0 * left as f64 / total as f64);
+    /// ```
+    pub fn range_size(&self, start: Option<&[u8]>, end: Option<&[u8]>) -> u64 {
+        let prefix = bucket_data_prefix(&self.name);
+        let start_key = bucket_data_key(&self.name, start.unwrap_or_default());
+        let end_key = match end {
+            Some(end) => bucket_data_key(&self.name, end),
+            None => crate::cursor::prefix_end(&prefix),
+        };
+        let (len, bytes) = self.tree.range_size(
+            crate::btree::Bound::Included(&start_key),
+            crate::btree::Bound::Excluded(&end_key),
+        );
+        bytes - (len * prefix.len()) as u64
+    }
+
+    /// Scans the bucket, selecting entries by a prefix of their value.
+    ///
+    /// For each entry, `filter` receives the key and at most the first
+    /// `prefix_len` bytes of the value. Only entries accepted by the filter
+    /// have their full value handed to `f`. Scanning stops at the first
+    /// error returned by `f`.
+    ///
+    /// This is a convenience over filtering [`iter()`](Self::iter), not an
+    /// optimization: every value, overflow values included, is loaded into
+    /// memory when the database opens, so the scan visits each entry and
+    /// rejecting one on its prefix saves no I/O.
+    ///
+    /// # Arguments
+    ///
+    /// * `prefix_len` - Maximum number of value bytes passed to `filter`.
+    /// * `filter` - Predicate over the key and value prefix.
+    /// * `f` - Callback invoked with the full value of accepted entries.
+    ///
+    /// # Errors
+    ///
+    /// Returns the first error returned by `f`, or `TxCancelled` if the
+    /// transaction is cancelled during the scan.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let bucket = rtx.bucket(b"events")?;
+    /// bucket.scan_filter(
+    ///     1,
+    ///     |_key, prefix| prefix == b"E",
+    ///     |key, value| {
+    ///         handle_error_event(key, value);
+    ///         Ok(())
+    ///     },
+    /// )?;
+    /// ```
+    pub fn scan_filter<P, F>(&self, prefix_len: usize, mut filter: P, mut f: F) -> Result<()>
+    where
+        P: FnMut(&[u8], &[u8]) -> bool,
+        F: FnMut(&[u8], &[u8]) -> Result<()>,
+    {
+        for (key, value) in self.iter() {
+            let prefix = &value[..value.len().min(prefix_len)];
+            if filter(key, prefix) {
+                f(key, value)?;
+            }
+        }
+        self.cancel_check().check()
+    }
+
+    /// Scans the bucket one group of entries at a time.
+    ///
+    /// `group_of` derives a group id from each key, such as the `group`
+    /// part of `group:item` keys. Entries are visited in key order, so
+    /// `group_of` should map keys sharing a prefix to the same id: each run
+    /// of consecutive entries with the same id is passed to `f` as one
+    /// group, with an iterator over its entries in key order. A group id
+    /// that reappears after a different one starts a new group. Scanning
+    /// stops at the first error returned by `f`.
+    ///
+    /// # Errors
+    ///
+    /// Returns the first error returned by `f`, or `TxCancelled` if the
+    /// transaction is cancelled during the scan.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let bucket = rtx.bucket(b"orders")?;
+    /// bucket.for_each_group(
+    ///     |key| key.split(|&b| b == b':').next().unwrap_or(key).to_vec(),
+    ///     |customer, orders| {
+    ///         let total: u64 = orders.map(|(_, v)| decode_amount(v)).sum();
+    ///         record_total(customer, total);
+    ///         Ok(())
+    ///     },
+    /// )?;
+    /// ```
+    pub fn for_each_group<G, F>(&self, mut group_of: G, mut f: F) -> Result<()>
+    where
+        G: FnMut(&[u8]) -> Vec<u8>,
+        F: FnMut(&[u8], GroupItems<'_, 'a>) -> Result<()>,
+    {
+        let mut group: Option<Vec<u8>> = None;
+        let mut items = Vec::new();
+        let entries = BucketIter::new(self.tree, &self.name, self.expiry.refreshed())
+            .cancellable(self.cancel_check());
+        for (key, value) in entries {
+            let id = group_of(key);
+            if group.as_ref() != Some(&id)
+                && let Some(finished) = group.replace(id)
+            {
+                f(&finished, GroupItems::new(&items))?;
+                items.clear();
+            }
+            items.push((key, value));
+        }
+        if let Some(current) = group {
+            f(&current, GroupItems::new(&items))?;
+        }
+        self.cancel_check().check()
+    }
+
+    /// Returns up to `limit` entries ordered by value instead of key.
+    ///
+    /// `compare` orders two values; entries with equal values keep key
+    /// order. This collects references to every entry of the bucket in
+    /// memory, so it suits small and medium buckets; keep an index bucket
+    /// for large ones. When `limit` is below the bucket's size, only the
+    /// `limit` first entries are sorted, after selecting them in linear
+    /// time.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let bucket = rtx.bucket(b"scores")?;
+    /// // Top 10 scores, highest first.
+    /// let top = bucket.sorted_by_value(|a, b| decode_score(b).cmp(&decode_score(a)), 10);
+    /// ```
+    pub fn sorted_by_value<C>(&self, mut compare: C, limit: usize) -> Vec<(&'a [u8], &'a [u8])>
+    where
+        C: FnMut(&[u8], &[u8]) -> Ordering,
+    {
+        if limit == 0 {
+            return Vec::new();
+        }
+        let mut entries: Vec<(&'a [u8], &'a [u8])> =
+            BucketIter::new(self.tree, &self.name, self.expiry.refreshed()).collect();
+        let mut order =
+            |a: &(&[u8], &[u8]), b: &(&[u8], &[u8])| compare(a.1, b.1).then_with(|| a.0.cmp(b.0));
+        if limit < entries.len() {
+            entries.select_nth_unstable_by(limit - 1, &mut order);
+            entries.truncate(limit);
+        }
+        entries.sort_unstable_by(order);
+        entries
+    }
+
+    /// Returns a hash of the bucket's contents.
+    ///
+    /// Every key and value is hashed in key order, each prefixed by its
+    /// length, so two buckets hold the same entries exactly when (barring
+    /// collisions) their checksums match, whichever file or layout they
+    /// live in. This makes comparing replicas a matter of exchanging eight
+    /// bytes. Sub-buckets are not included.
+    ///
+    /// The hash is computed on demand and takes time linear in the size of
+    /// the bucket. It is stable across releases and platforms.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let local = rtx.bucket(b"accounts")?.checksum();
+    /// if local != checksum_from_replica {
+    ///     resync(b"accounts")?;
+    /// }
+    /// ```
+    pub fn checksum(&self) -> u64 {
+        let mut hash = FNV_OFFSET_BASIS;
+        for (key, value) in BucketIter::new(self.tree, &self.name, self.expiry.refreshed()) {
+            for part in [key, value] {
+                hash = fnv1a(hash, &(part.len() as u64).to_le_bytes());
+                hash = fnv1a(hash, part);
+            }
+        }
+        hash
+    }
+
+    /// Returns statistics about the bucket's size and layout.
+    ///
+    /// Gathered from memory in one pass over the bucket, without I/O, so it
+    /// is cheap enough to call from a read transaction on a schedule. Like
+    /// bbolt's `BucketStats`, it separates key bytes from value bytes.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let stats = rtx.bucket(b"sessions")?.stats();
+    /// metrics.gauge("sessions.keys", stats.keys);
+    /// metrics.gauge("sessions.value_bytes", stats.value_bytes);
+    /// ```
+    pub fn stats(&self) -> BucketStats {
+        let mut stats = BucketStats {
+            depth: self.tree.depth(),
+            sub_buckets: nested_bucket_names(self.tree, &[&self.name]).len() as u64,
+            ..BucketStats::default()
+        };
+        for (key, value) in BucketIter::new(self.tree, &self.name, self.expiry.refreshed()) {
+            stats.keys += 1;
+            stats.key_bytes += key.len() as u64;
+            stats.value_bytes += value.len() as u64;
+        }
+        stats
     }
 }
 
+/// Size and layout of a bucket, returned by [`BucketRef::stats()`].
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct BucketStats {
+    /// Keys in the bucket, not counting sub-buckets.
+    pub keys: u64,
+    /// Bytes of those keys, without the bucket prefix.
+    pub key_bytes: u64,
+    /// Bytes of their values.
+    pub value_bytes: u64,
+    /// Direct sub-buckets.
+    pub sub_buckets: u64,
+    /// Levels of the tree holding the bucket. Buckets share the database's
+    /// tree, so this is the same for every bucket.
+    pub depth: usize,
+}
+
+/// Initial state of the FNV-1a hash used by [`BucketRef::checksum()`].
+const FNV_OFFSET_BASIS: u64 = 0xcbf29ce484222325;
+
+/// Continues an FNV-1a hash from `hash` over `data`.
+fn fnv1a(mut hash: u64, data: &[u8]) -> u64 {
+    const FNV_PRIME: u64 = 0x100000001b3;
+    for &byte in data {
+        hash ^= byte as u64;
+        hash = hash.wrapping_mul(FNV_PRIME);
+    }
+    hash
+}
+
+/// The entries of one group passed to [`BucketRef::for_each_group()`], in
+/// key order.
+pub struct GroupItems<'g, 'a> {
+    inner: std::slice::Iter<'g, (&'a [u8], &'a [u8])>,
+}
+
+impl<'g, 'a> GroupItems<'g, 'a> {
+    fn new(items: &'g [(&'a [u8], &'a [u8])]) -> Self {
+        Self {
+            inner: items.iter(),
+        }
+    }
+}
+
+impl<'a> Iterator for GroupItems<'_, 'a> {
+    type Item = (&'a [u8], &'a [u8]);
+
+    fn next(&mut self) -> Option<Self::Item> {
+        self.inner.next().copied()
+    }
+
+    fn size_hint(&self) -> (usize, Option<usize>) {
+        self.inner.size_hint()
+    }
+}
+
+impl ExactSizeIterator for GroupItems<'_, '_> {}
+
 /// A mutable view of a bucket for write transactions.
 ///
 /// Provides read and write access to key-value pairs within the bucket's namespace.
@@ -766,18 +1889,29 @@ pub struct BucketIter<'a> {
     inner: crate::btree::BTreeIter<'a>,
     prefix: Vec<u8>,
     prefix_len: usize,
+    expiry: ExpiryCheck<'a>,
+    cancel: CancelCheck,
 }
 
 impl<'a> BucketIter<'a> {
-    fn new(tree: &'a BTree, bucket_name: &[u8]) -> Self {
+    fn new(tree: &'a BTree, bucket_name: &[u8], expiry: ExpiryCheck<'a>) -> Self {
         let prefix = bucket_data_prefix(bucket_name);
         let prefix_len = prefix.len();
         Self {
             inner: tree.iter(),
             prefix,
             prefix_len,
+            expiry,
+            cancel: CancelCheck::default(),
         }
     }
+
+    /// Returns the iterator, made to end once `cancel` reports its
+    /// transaction cancelled.
+    fn cancellable(mut self, cancel: CancelCheck) -> Self {
+        self.cancel = cancel;
+        self
+    }
 }
 
 impl<'a> Iterator for BucketIter<'a> {
@@ -785,6 +1919,9 @@ impl<'a> Iterator for BucketIter<'a> {
 
     fn next(&mut self) -> Option<Self::Item> {
         loop {
+            if self.cancel.tick() {
+                return None;
+            }
             let (key, value) = self.inner.next()?;
 
             // Skip keys before our prefix.
@@ -797,11 +1934,117 @@ impl<'a> Iterator for BucketIter<'a> {
                 return None;
             }
 
+            if self.expiry.is_expired(key) {
+                continue;
+            }
+
             // Return the user key (without prefix).
             let user_key = &key[self.prefix_len..];
             return Some((user_key, value));
         }
     }
+
+    /// Skips `n` entries a leaf at a time, then returns the next one.
+    fn nth(&mut self, n: usize) -> Option<Self::Item> {
+        // Position inside the bucket first; the skip may not cross its end.
+        let first = self.next()?;
+        if n == 0 {
+            return Some(first);
+        }
+        // Expired entries do not count towards `n`, so step one at a time.
+        if self.expiry.is_active() {
+            for _ in 1..n {
+                self.next()?;
+            }
+            return self.next();
+        }
+        let (key, value) = self.inner.nth(n - 1)?;
+        key.starts_with(&self.prefix)
+            .then(|| (&key[self.prefix_len..], value))
+    }
+}
+
+/// Iterator over the entries and sub-buckets of a bucket, created by
+/// [`BucketRef::iter_with_buckets()`].
+pub struct BucketWithChildrenIter<'a> {
+    entries: std::iter::Peekable<BucketIter<'a>>,
+    /// Names of the direct sub-buckets, sorted.
+    children: std::iter::Peekable<std::vec::IntoIter<&'a [u8]>>,
+}
+
+impl<'a> Iterator for BucketWithChildrenIter<'a> {
+    type Item = (&'a [u8], Option<&'a [u8]>);
+
+    fn next(&mut self) -> Option<Self::Item> {
+        let child_first = match (self.children.peek(), self.entries.peek()) {
+            (Some(child), Some((key, _))) => child <= key,
+            (child, _) => child.is_some(),
+        };
+        if child_first {
+            return self.children.next().map(|name| (name, None));
+        }
+        self.entries.next().map(|(key, value)| (key, Some(value)))
+    }
+}
+
+/// Iterator over the keys of a bucket, created by [`BucketRef::keys()`].
+pub struct BucketKeys<'a> {
+    inner: crate::btree::BTreeIter<'a>,
+    prefix: Vec<u8>,
+    expiry: ExpiryCheck<'a>,
+    cancel: CancelCheck,
+}
+
+impl<'a> BucketKeys<'a> {
+    fn new(tree: &'a BTree, bucket_name: &[u8], expiry: ExpiryCheck<'a>) -> Self {
+        Self {
+            inner: tree.iter(),
+            prefix: bucket_data_prefix(bucket_name),
+            expiry,
+            cancel: CancelCheck::default(),
+        }
+    }
+
+    /// Returns the iterator, made to end once `cancel` reports its
+    /// transaction cancelled.
+    fn cancellable(mut self, cancel: CancelCheck) -> Self {
+        self.cancel = cancel;
+        self
+    }
+}
+
+impl<'a> Iterator for BucketKeys<'a> {
+    type Item = &'a [u8];
+
+    fn next(&mut self) -> Option<Self::Item> {
+        loop {
+            if self.cancel.tick() {
+                return None;
+            }
+            let key = self.inner.next_key()?;
+            if key < self.prefix.as_slice() {
+                continue;
+            }
+            if !key.starts_with(&self.prefix) {
+                return None;
+            }
+            if self.expiry.is_expired(key) {
+                continue;
+            }
+            return Some(&key[self.prefix.len()..]);
+        }
+    }
+}
+
+/// What to do with an entry visited by `WriteTx::bucket_transform()`.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum TransformAction {
+    /// Leave the entry unchanged.
+    Keep,
+    /// Replace the entry's value.
+    Update(Vec<u8>),
+    /// Delete the entry.
+    Delete,
 }
 
 /// Bound type for bucket range queries.
@@ -822,12 +2065,15 @@ pub struct BucketRangeIter<'a> {
     prefix_len: usize,
     start_bound: BucketBound<'a>,
     end_bound: BucketBound<'a>,
+    order: KeyOrder<'a>,
     started: bool,
     finished: bool,
+    expiry: ExpiryCheck<'a>,
+    cancel: CancelCheck,
 }
 
 impl<'a> BucketRangeIter<'a> {
-    fn new<R>(tree: &'a BTree, bucket_name: &[u8], range: R) -> Self
+    fn new<R>(tree: &'a BTree, bucket_name: &[u8], range: R, expiry: ExpiryCheck<'a>) -> Self
     where
         R: std::ops::RangeBounds<&'a [u8]>,
     {
@@ -851,18 +2097,28 @@ impl<'a> BucketRangeIter<'a> {
             prefix_len,
             start_bound,
             end_bound,
+            order: tree.order(),
             started: false,
             finished: false,
+            expiry,
+            cancel: CancelCheck::default(),
         }
     }
 
+    /// Returns the iterator, made to end once `cancel` reports its
+    /// transaction cancelled.
+    fn cancellable(mut self, cancel: CancelCheck) -> Self {
+        self.cancel = cancel;
+        self
+    }
+
     /// Checks if a user key is at or past the start bound.
     #[inline]
     fn is_at_or_past_start(&self, user_key: &[u8]) -> bool {
         match &self.start_bound {
             BucketBound::Unbounded => true,
-            BucketBound::Included(start) => user_key >= *start,
-            BucketBound::Excluded(start) => user_key > *start,
+            BucketBound::Included(start) => self.order.cmp_in_bucket(user_key, start).is_ge(),
+            BucketBound::Excluded(start) => self.order.cmp_in_bucket(user_key, start).is_gt(),
         }
     }
 
@@ -871,8 +2127,8 @@ impl<'a> BucketRangeIter<'a> {
     fn is_past_end(&self, user_key: &[u8]) -> bool {
         match &self.end_bound {
             BucketBound::Unbounded => false,
-            BucketBound::Included(end) => user_key > *end,
-            BucketBound::Excluded(end) => user_key >= *end,
+            BucketBound::Included(end) => self.order.cmp_in_bucket(user_key, end).is_gt(),
+            BucketBound::Excluded(end) => self.order.cmp_in_bucket(user_key, end).is_ge(),
         }
     }
 }
@@ -886,6 +2142,9 @@ impl<'a> Iterator for BucketRangeIter<'a> {
         }
 
         loop {
+            if self.cancel.tick() {
+                return None;
+            }
             let (key, value) = self.inner.next()?;
 
             // Skip keys before our bucket prefix.
@@ -917,6 +2176,10 @@ impl<'a> Iterator for BucketRangeIter<'a> {
                 return None;
             }
 
+            if self.expiry.is_expired(key) {
+                continue;
+            }
+
             return Some((user_key, value));
         }
     }
@@ -948,6 +2211,27 @@ mod tests {
         assert_eq!(&data_key[10..], b"mykey");
     }
 
+    #[test]
+    fn test_bucket_iter_nth_stays_in_bucket() {
+        let mut tree = BTree::new();
+        for name in [b"a", b"b", b"c"] {
+            create_bucket(&mut tree, name).unwrap();
+            let mut bucket = BucketMut::new(&mut tree, name).unwrap();
+            for i in 0..500u32 {
+                bucket.put(&i.to_be_bytes(), name);
+            }
+        }
+
+        let bucket = BucketRef::new(&tree, b"b").unwrap();
+        let mut iter = bucket.iter();
+        assert_eq!(iter.next(), Some((&0u32.to_be_bytes()[..], &b"b"[..])));
+        assert_eq!(iter.nth(299), Some((&300u32.to_be_bytes()[..], &b"b"[..])));
+        assert_eq!(bucket.iter().nth(499).unwrap().0, 499u32.to_be_bytes());
+        // Skipping past the end does not run into the next bucket.
+        assert_eq!(bucket.iter().nth(500), None);
+        assert_eq!(bucket.iter().nth(700), None);
+    }
+
     #[test]
     fn test_create_delete_bucket() {
         let mut tree = BTree::new();
@@ -1023,6 +2307,40 @@ mod tests {
         assert_eq!(&data_key[data_key.len() - 5..], b"mykey");
     }
 
+    #[test]
+    fn test_renamed_bucket_key() {
+        let rename = |key: &[u8]| renamed_bucket_key(key, b"v1", b"events_v2");
+        assert_eq!(
+            rename(&bucket_meta_key(b"v1")),
+            Some(bucket_meta_key(b"events_v2"))
+        );
+        assert_eq!(
+            rename(&bucket_data_key(b"v1", b"k")),
+            Some(bucket_data_key(b"events_v2", b"k"))
+        );
+        assert_eq!(
+            rename(&bucket_order_key(b"v1", b"k")),
+            Some(bucket_order_key(b"events_v2", b"k"))
+        );
+        assert_eq!(
+            rename(&nested_bucket_data_key(&[b"v1", b"c"], b"k")),
+            Some(nested_bucket_data_key(&[b"events_v2", b"c"], b"k"))
+        );
+        let data_key = bucket_data_key(b"v1", b"k");
+        assert_eq!(
+            rename(&checksum::checksum_key(&data_key)),
+            Some(checksum::checksum_key(&bucket_data_key(b"events_v2", b"k")))
+        );
+        assert_eq!(
+            rename(&expiry::expiry_key(&data_key)),
+            Some(expiry::expiry_key(&bucket_data_key(b"events_v2", b"k")))
+        );
+
+        assert_eq!(rename(&bucket_data_key(b"v10", b"k")), None);
+        assert_eq!(rename(&nested_bucket_meta_key(&[b"p", b"v1"])), None);
+        assert_eq!(rename(b"top-level"), None);
+    }
+
     #[test]
     fn test_nested_bucket_create_delete() {
         let mut tree = BTree::new();
@@ -0,0 +1,365 @@
+//! Summary: External merge sort for bulk loading unsorted data.
+//! Copyright (c) YOAB. All rights reserved.
+//!
+//! `Database::bulk_load_unsorted()` accepts entries in any order. Entries are
+//! buffered until the buffer reaches `BulkOptions::mem_budget`, sorted, and
+//! spilled to a temporary run file. Once the input is exhausted, the runs
+//! are merged into a single sorted stream that is inserted in key order.
+//!
+//! # Duplicates
+//!
+//! When the input contains the same key more than once, the last occurrence
+//! wins, exactly as if the entries had been `put` one by one.
+//!
+//! # Run Format
+//!
+//! Each run file is a sequence of `[key_len:u32][key][value_len:u32][value]`
+//! records in ascending key order with duplicates already removed.
+
+use std::cmp::Ordering;
+use std::collections::BinaryHeap;
+use std::fs::{self, File};
+use std::io::{BufReader, BufWriter, ErrorKind, Read, Write};
+use std::path::{Path, PathBuf};
+use std::sync::atomic::{AtomicU64, Ordering as AtomicOrdering};
+
+use crate::error::{Error, Result};
+
+/// Default memory budget for buffered entries (64MB).
+pub const DEFAULT_BULK_MEM_BUDGET: usize = 64 * 1024 * 1024;
+
+/// Per-entry bookkeeping overhead counted against the memory budget.
+const ENTRY_OVERHEAD: usize = 2 * std::mem::size_of::<Vec<u8>>();
+
+/// Buffer size for run file readers and writers.
+const RUN_IO_BUFFER_SIZE: usize = 256 * 1024;
+
+/// Options for `Database::bulk_load_unsorted()`.
+#[derive(Debug, Clone)]
+pub struct BulkOptions {
+    /// Maximum bytes of entries buffered in memory before a sorted run is
+    /// spilled to a temporary file.
+    pub mem_budget: usize,
+    /// Directory for temporary run files.
+    ///
+    /// Defaults to the directory containing the database file.
+    pub temp_dir: Option<PathBuf>,
+}
+
+impl Default for BulkOptions {
+    fn default() -> Self {
+        Self {
+            mem_budget: DEFAULT_BULK_MEM_BUDGET,
+            temp_dir: None,
+        }
+    }
+}
+
+impl BulkOptions {
+    /// Sets the memory budget for buffered entries.
+    #[must_use]
+    pub fn mem_budget(mut self, bytes: usize) -> Self {
+        self.mem_budget = bytes;
+        self
+    }
+
+    /// Sets the directory for temporary run files.
+    #[must_use]
+    pub fn temp_dir<P: Into<PathBuf>>(mut self, dir: P) -> Self {
+        self.temp_dir = Some(dir.into());
+        self
+    }
+}
+
+/// A sorted run spilled to a temporary file.
+///
+/// The file is removed when the run is dropped.
+struct RunFile {
+    path: PathBuf,
+}
+
+impl Drop for RunFile {
+    fn drop(&mut self) {
+        let _ = fs::remove_file(&self.path);
+    }
+}
+
+/// Sorts a buffer by key, keeping only the last occurrence of each key.
+fn sort_dedup_last(buffer: &mut Vec<(Vec<u8>, Vec<u8>)>) {
+    // Stable sort keeps input order among equal keys.
+    buffer.sort_by(|a, b| a.0.cmp(&b.0));
+    let mut out: Vec<(Vec<u8>, Vec<u8>)> = Vec::with_capacity(buffer.len());
+    for entry in buffer.drain(..) {
+        match out.last_mut() {
+            Some(last) if last.0 == entry.0 => *last = entry,
+            _ => out.push(entry),
+        }
+    }
+    *buffer = out;
+}
+
+/// Writes a sorted buffer to a new run file in `dir`.
+fn spill_run(dir: &Path, buffer: &[(Vec<u8>, Vec<u8>)]) -> Result<RunFile> {
+    static RUN_COUNTER: AtomicU64 = AtomicU64::new(0);
+    let id = RUN_COUNTER.fetch_add(1, AtomicOrdering::Relaxed);
+    let path = dir.join(format!(".thunder-bulk-{}-{id}.run", std::process::id()));
+
+    let file = File::create(&path).map_err(|e| Error::FileOpen {
+        path: path.clone(),
+        source: e,
+    })?;
+    let run = RunFile { path };
+
+    let mut writer = BufWriter::with_capacity(RUN_IO_BUFFER_SIZE, file);
+    let mut offset = 0u64;
+    for (key, value) in buffer {
+        for field in [key, value] {
+            let write = writer
+                .write_all(&(field.len() as u32).to_le_bytes())
+                .and_then(|()| writer.write_all(field));
+            write.map_err(|e| Error::FileWrite {
+                offset,
+                len: 4 + field.len(),
+                context: "writing bulk load run",
+                source: e,
+            })?;
+            offset += 4 + field.len() as u64;
+        }
+    }
+    writer.flush().map_err(|e| Error::FileWrite {
+        offset,
+        len: 0,
+        context: "flushing bulk load run",
+        source: e,
+    })?;
+    Ok(run)
+}
+
+/// Sequential reader over a run file.
+struct RunReader {
+    reader: BufReader<File>,
+    offset: u64,
+}
+
+impl RunReader {
+    fn open(run: &RunFile) -> Result<Self> {
+        let file = File::open(&run.path).map_err(|e| Error::FileOpen {
+            path: run.path.clone(),
+            source: e,
+        })?;
+        Ok(Self {
+            reader: BufReader::with_capacity(RUN_IO_BUFFER_SIZE, file),
+            offset: 0,
+        })
+    }
+
+    /// Reads one length-prefixed field.
+    ///
+    /// Returns `Ok(None)` at a clean end of file.
+    fn read_field(&mut self, at_record_start: bool) -> Result<Option<Vec<u8>>> {
+        let mut len_buf = [0u8; 4];
+        match self.reader.read_exact(&mut len_buf) {
+            Ok(()) => {}
+            Err(e) if at_record_start && e.kind() == ErrorKind::UnexpectedEof => {
+                return Ok(None);
+            }
+            Err(e) => return Err(self.read_error(4, e)),
+        }
+        let len = u32::from_le_bytes(len_buf) as usize;
+        let mut field = vec![0u8; len];
+        self.reader
+            .read_exact(&mut field)
+            .map_err(|e| self.read_error(len, e))?;
+        self.offset += 4 + len as u64;
+        Ok(Some(field))
+    }
+
+    fn read_error(&self, len: usize, source: std::io::Error) -> Error {
+        Error::FileRead {
+            offset: self.offset,
+            len,
+            context: "reading bulk load run",
+            source,
+        }
+    }
+
+    /// Reads the next record.
+    fn next_entry(&mut self) -> Result<Option<(Vec<u8>, Vec<u8>)>> {
+        let Some(key) = self.read_field(true)? else {
+            return Ok(None);
+        };
+        let value = self.read_field(false)?.ok_or_else(|| Error::Corrupted {
+            context: "reading bulk load run",
+            details: "run ends between a key and its value".to_string(),
+        })?;
+        Ok(Some((key, value)))
+    }
+}
+
+/// Head entry of a run during the merge.
+struct HeapEntry {
+    key: Vec<u8>,
+    value: Vec<u8>,
+    run: usize,
+}
+
+impl PartialEq for HeapEntry {
+    fn eq(&self, other: &Self) -> bool {
+        self.cmp(other) == Ordering::Equal
+    }
+}
+
+impl Eq for HeapEntry {}
+
+impl PartialOrd for HeapEntry {
+    fn partial_cmp(&self, other: &Self) -> Option<Ordering> {
+        Some(self.cmp(other))
+    }
+}
+
+impl Ord for HeapEntry {
+    fn cmp(&self, other: &Self) -> Ordering {
+        // Reversed for a min-heap on key; among equal keys the newest run
+        // (highest index) pops first so it wins.
+        other
+            .key
+            .cmp(&self.key)
+            .then_with(|| self.run.cmp(&other.run))
+    }
+}
+
+/// Sorts `src` with bounded memory and passes each unique entry to `sink`
+/// in ascending key order.
+///
+/// Returns the number of entries passed to `sink`.
+///
+/// # Errors
+///
+/// Returns an I/O error if a run file cannot be written or read back, or
+/// the first error returned by `sink`.
+pub(crate) fn external_sort<I, F>(
+    src: I,
+    options: &BulkOptions,
+    default_dir: &Path,
+    mut sink: F,
+) -> Result<u64>
+where
+    I: IntoIterator<Item = (Vec<u8>, Vec<u8>)>,
+    F: FnMut(Vec<u8>, Vec<u8>) -> Result<()>,
+{
+    let dir = options.temp_dir.as_deref().unwrap_or(default_dir);
+    let mut runs = Vec::new();
+    let mut buffer = Vec::new();
+    let mut buffered_bytes = 0usize;
+
+    for (key, value) in src {
+        buffered_bytes += key.len() + value.len() + ENTRY_OVERHEAD;
+        buffer.push((key, value));
+        if buffered_bytes >= options.mem_budget {
+            sort_dedup_last(&mut buffer);
+            runs.push(spill_run(dir, &buffer)?);
+            buffer.clear();
+            buffered_bytes = 0;
+        }
+    }
+    sort_dedup_last(&mut buffer);
+
+    // Everything fit in memory: no merge needed.
+    if runs.is_empty() {
+        let count = buffer.len() as u64;
+        for (key, value) in buffer {
+            sink(key, value)?;
+        }
+        return Ok(count);
+    }
+
+    // The in-memory tail is the newest input, so it merges as the last run.
+    let mut readers = runs
+        .iter()
+        .map(RunReader::open)
+        .collect::<Result<Vec<_>>>()?;
+    let tail_run = readers.len();
+    let mut tail = buffer.into_iter();
+
+    let mut heap = BinaryHeap::with_capacity(tail_run + 1);
+    for (run, reader) in readers.iter_mut().enumerate() {
+        if let Some((key, value)) = reader.next_entry()? {
+            heap.push(HeapEntry { key, value, run });
+        }
+    }
+    if let Some((key, value)) = tail.next() {
+        heap.push(HeapEntry {
+            key,
+            value,
+            run: tail_run,
+        });
+    }
+
+    let mut count = 0u64;
+    while let Some(HeapEntry { key, value, run }) = heap.pop() {
+        // Refill from the run we just consumed.
+        let next = if run == tail_run {
+            tail.next()
+        } else {
+            readers[run].next_entry()?
+        };
+        if let Some((key, value)) = next {
+            heap.push(HeapEntry { key, value, run });
+        }
+
+        // Drop older duplicates of this key from other runs.
+        while heap.peek().is_some_and(|top| top.key == key) {
+            let stale = heap.pop().expect("peeked entry exists");
+            let next = if stale.run == tail_run {
+                tail.next()
+            } else {
+                readers[stale.run].next_entry()?
+            };
+            if let Some((key, value)) = next {
+                heap.push(HeapEntry {
+                    key,
+                    value,
+                    run: stale.run,
+                });
+            }
+        }
+
+        sink(key, value)?;
+        count += 1;
+    }
+
+    Ok(count)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_external_sort_spills_and_merges() {
+        let dir = std::env::temp_dir();
+        let options = BulkOptions::default().mem_budget(256);
+
+        // Interleaved duplicates across runs; the last occurrence wins.
+        let input: Vec<(Vec<u8>, Vec<u8>)> = (0..200u32)
+            .map(|i| {
+                let key = format!("k{:03}", (i * 37) % 50).into_bytes();
+                (key, i.to_le_bytes().to_vec())
+            })
+            .collect();
+        let mut expected = std::collections::BTreeMap::new();
+        for (k, v) in &input {
+            expected.insert(k.clone(), v.clone());
+        }
+
+        let mut out = Vec::new();
+        let count = external_sort(input, &options, &dir, |k, v| {
+            out.push((k, v));
+            Ok(())
+        })
+        .unwrap();
+
+        assert_eq!(count, 50);
+        assert_eq!(out, expected.into_iter().collect::<Vec<_>>());
+    }
+}
@@ -0,0 +1,193 @@
+//! Summary: Cancelling transactions from another thread or by deadline.
+//! Copyright (c) YOAB. All rights reserved.
+//!
+//! A [`CancelToken`] lets a caller stop a transaction that is no longer
+//! wanted, such as a scan serving a client that disconnected.
+//! `Database::view_with_cancel()` and `Database::update_with_cancel()` run
+//! a closure in a transaction carrying the token, and fail with
+//! `TxCancelled` once it is cancelled; a cancelled update is never
+//! committed. `ReadTx::set_cancel_token()` and
+//! `WriteTx::set_cancel_token()` attach a token to a transaction directly.
+//!
+//! # What Is Checked
+//!
+//! Scans check the token every [`CHECK_INTERVAL`] entries, so a cancelled
+//! scan stops promptly instead of running to the end:
+//!
+//! - Bucket iterators, range iterators and cursors obtained through the
+//!   transaction end early, as if the bucket ended there. The enclosing
+//!   `view_with_cancel()` still reports the cancellation, so a truncated
+//!   scan is never mistaken for a complete one.
+//! - `BucketRef::for_each()` and the other callback scans (prefix, range,
+//!   group and filtered), and the transaction's collecting helpers, return
+//!   `TxCancelled`.
+//! - `WriteTx::commit()` fails with `TxCancelled` and discards the changes.
+//!
+//! Point reads are not checked, since they finish quickly either way, nor
+//! are whole-bucket summaries such as `BucketRef::checksum()` and
+//! `BucketRef::stats()`, whose results would be wrong if cut short.
+//!
+//! # Deadlines
+//!
+//! [`CancelToken::with_timeout()`] creates a token that cancels itself once
+//! the timeout passes, reported as `TxCancelled { deadline_exceeded: true }`.
+
+use std::sync::Arc;
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::time::{Duration, Instant};
+
+use crate::error::{Error, Result};
+
+/// Number of entries a scan visits between checks of its token.
+pub const CHECK_INTERVAL: u32 = 256;
+
+/// Signals that a transaction should stop.
+///
+/// Cheap to clone; clones share the same state, so one clone can be
+/// cancelled from another thread while the transaction holds another.
+///
+/// # Example
+///
+/// ```ignore
+/// let token = CancelToken::new();
+/// let watcher = token.clone();
+/// std::thread::spawn(move || {
+///     client.wait_for_disconnect();
+///     watcher.cancel();
+/// });
+/// let rows = db.view_with_cancel(&token, |rtx| rtx.bucket_entries(b"events"))?;
+/// ```
+#[derive(Debug, Clone, Default)]
+pub struct CancelToken {
+    cancelled: Arc<AtomicBool>,
+    deadline: Option<Instant>,
+}
+
+impl CancelToken {
+    /// Creates a token that is cancelled only by [`cancel()`](Self::cancel).
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Creates a token that also cancels itself once `timeout` has passed.
+    pub fn with_timeout(timeout: Duration) -> Self {
+        Self {
+            cancelled: Arc::default(),
+            deadline: Instant::now().checked_add(timeout),
+        }
+    }
+
+    /// Cancels the token and every clone of it.
+    pub fn cancel(&self) {
+        self.cancelled.store(true, Ordering::Release);
+    }
+
+    /// Returns whether the token was cancelled or its deadline has passed.
+    pub fn is_cancelled(&self) -> bool {
+        self.check().is_err()
+    }
+
+    /// Returns `TxCancelled` if the token was cancelled or its deadline has
+    /// passed.
+    ///
+    /// # Errors
+    ///
+    /// Returns `TxCancelled`, with `deadline_exceeded` set if the deadline
+    /// passed without an explicit cancel.
+    pub fn check(&self) -> Result<()> {
+        if self.cancelled.load(Ordering::Acquire) {
+            return Err(Error::TxCancelled {
+                deadline_exceeded: false,
+            });
+        }
+        if self
+            .deadline
+            .is_some_and(|deadline| Instant::now() >= deadline)
+        {
+            return Err(Error::TxCancelled {
+                deadline_exceeded: true,
+            });
+        }
+        Ok(())
+    }
+}
+
+/// Periodic cancellation checks for a scan.
+#[derive(Debug, Clone, Default)]
+pub(crate) struct CancelCheck {
+    token: Option<CancelToken>,
+    /// Entries visited since the token was last checked.
+    steps: u32,
+    /// Set once the token is seen cancelled, so the scan stays stopped.
+    stopped: bool,
+}
+
+impl CancelCheck {
+    /// Creates checks against `token`; `None` never stops.
+    pub(crate) fn new(token: Option<CancelToken>) -> Self {
+        Self {
+            token,
+            steps: 0,
+            stopped: false,
+        }
+    }
+
+    /// Counts one visited entry, returning whether the scan should stop.
+    #[inline]
+    pub(crate) fn tick(&mut self) -> bool {
+        let Some(token) = &self.token else {
+            return false;
+        };
+        if !self.stopped {
+            self.steps += 1;
+            if self.steps >= CHECK_INTERVAL {
+                self.steps = 0;
+                self.stopped = token.is_cancelled();
+            }
+        }
+        self.stopped
+    }
+
+    /// Returns `TxCancelled` if the token has been cancelled.
+    pub(crate) fn check(&self) -> Result<()> {
+        self.token.as_ref().map_or(Ok(()), CancelToken::check)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_cancel_check() {
+        let mut unchecked = CancelCheck::default();
+        assert!(!unchecked.tick());
+        assert!(unchecked.check().is_ok());
+
+        let token = CancelToken::new();
+        let mut check = CancelCheck::new(Some(token.clone()));
+        for _ in 0..CHECK_INTERVAL {
+            assert!(!check.tick());
+        }
+        token.cancel();
+        // Noticed at the next interval, then sticky.
+        let steps = (0..CHECK_INTERVAL).take_while(|_| !check.tick()).count();
+        assert_eq!(steps as u32, CHECK_INTERVAL - 1);
+        assert!(check.tick());
+        assert!(matches!(
+            check.check(),
+            Err(Error::TxCancelled {
+                deadline_exceeded: false
+            })
+        ));
+
+        let expired = CancelToken::with_timeout(Duration::ZERO);
+        assert!(matches!(
+            expired.check(),
+            Err(Error::TxCancelled {
+                deadline_exceeded: true
+            })
+        ));
+        assert!(!CancelToken::with_timeout(Duration::from_secs(3600)).is_cancelled());
+    }
+}
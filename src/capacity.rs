@@ -0,0 +1,92 @@
+//! Summary: Headroom of the database's internal counters and id spaces.
+//! Copyright (c) YOAB. All rights reserved.
+//!
+//! A long-lived database consumes several monotonic counters: the version
+//! advances on every commit and open, page ids grow with the file, and
+//! key-limited buckets number their insertions. All of them are 64-bit, so
+//! none is a practical concern for normal workloads, but a
+//! [`CapacityReport`] shows how much of each remains so operators can plan
+//! ahead instead of discovering a ceiling.
+//!
+//! # Limits
+//!
+//! - Versions are `u64` and must strictly increase.
+//! - Page ids address byte offsets, so the largest addressable page is
+//!   `u64::MAX / page_size`.
+//! - Insertion sequences of key-limited buckets are `u64`.
+
+use crate::page::PageId;
+
+/// Headroom below which [`CapacityReport::is_low()`] reports a counter,
+/// in percent.
+pub const LOW_HEADROOM_PERCENT: f64 = 1.0;
+
+/// How much of each internal counter a database has used.
+///
+/// Returned by `Database::capacity()`.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct CapacityReport {
+    /// The committed version.
+    pub version: u64,
+    /// The largest version that can be committed.
+    pub max_version: u64,
+    /// The highest page id in use.
+    pub page_id: PageId,
+    /// The largest page id the file can address.
+    pub max_page_id: PageId,
+    /// The next insertion sequence of the key-limited bucket furthest along.
+    pub sequence: u64,
+    /// The largest insertion sequence.
+    pub max_sequence: u64,
+}
+
+impl CapacityReport {
+    /// Returns the percentage of versions still available.
+    pub fn version_headroom(&self) -> f64 {
+        headroom(self.version, self.max_version)
+    }
+
+    /// Returns the percentage of page ids still available.
+    pub fn page_id_headroom(&self) -> f64 {
+        headroom(self.page_id, self.max_page_id)
+    }
+
+    /// Returns the percentage of insertion sequences still available.
+    pub fn sequence_headroom(&self) -> f64 {
+        headroom(self.sequence, self.max_sequence)
+    }
+
+    /// Returns the smallest headroom of any counter, in percent.
+    pub fn min_headroom(&self) -> f64 {
+        self.version_headroom()
+            .min(self.page_id_headroom())
+            .min(self.sequence_headroom())
+    }
+
+    /// Returns whether any counter has less than
+    /// [`LOW_HEADROOM_PERCENT`] of its range left.
+    pub fn is_low(&self) -> bool {
+        self.min_headroom() < LOW_HEADROOM_PERCENT
+    }
+}
+
+/// Returns the percentage of `0..=max` above `used`.
+fn headroom(used: u64, max: u64) -> f64 {
+    if max == 0 {
+        return 0.0;
+    }
+    max.saturating_sub(used) as f64 / max as f64 * 100.0
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_headroom() {
+        assert_eq!(headroom(0, 100), 100.0);
+        assert_eq!(headroom(75, 100), 25.0);
+        assert_eq!(headroom(150, 100), 0.0);
+        assert_eq!(headroom(0, 0), 0.0);
+    }
+}
@@ -0,0 +1,332 @@
+//! Summary: Background committer with a submission queue.
+//! Copyright (c) YOAB. All rights reserved.
+//!
+//! The committer owns a [`Database`] on a dedicated thread. Callers submit
+//! update functions and receive a channel that reports the outcome once the
+//! update is durable, so request-handling threads never wait on fsync.
+//!
+//! # Coalescing
+//!
+//! Updates queued while a commit is in progress are applied together in a
+//! single write transaction and share one fsync. If one update fails, the
+//! transaction is discarded, that update receives its error, and the rest
+//! are retried without it. Update functions may therefore run more than
+//! once and must not have side effects outside the transaction.
+//!
+//! Coalescing stops early when the process-wide commit threshold is reached
+//! (see the `memory` module); the remaining updates go into the next
+//! transaction.
+//!
+//! # Batch Size and Delay
+//!
+//! [`CommitterConfig`] bounds a transaction to `max_batch_size` updates.
+//! With a non-zero `max_batch_delay`, the committer waits up to that long
+//! after the first update for more to arrive, trading latency for fewer
+//! fsyncs when callers submit one at a time.
+//!
+//! # Expiry
+//!
+//! With `DatabaseOptions::expiry_interval` set, the committer also purges
+//! expired entries while no updates arrive, so an idle database still
+//! reclaims them. See the `expiry` module.
+//!
+//! # Nested Updates
+//!
+//! An update runs on the committer thread, so it cannot wait for another
+//! update through the same committer: [`BackgroundCommitter::batch()`]
+//! called from an update returns `NestedTransaction` instead of
+//! deadlocking. Apply the nested writes to the update's own transaction.
+//!
+//! # Panics in Updates
+//!
+//! An update that panics is treated like one that returns an error: the
+//! transaction is discarded, that update receives `GroupCommitFailed`, and
+//! the others are retried without it. The committer thread keeps running.
+
+use std::panic::{self, AssertUnwindSafe};
+use std::sync::mpsc::{self, Receiver, RecvTimeoutError, Sender};
+use std::thread::{JoinHandle, ThreadId};
+use std::time::{Duration, Instant};
+
+use crate::db::Database;
+use crate::error::{Error, Result};
+use crate::memory;
+use crate::tx::WriteTx;
+
+/// Default maximum number of updates coalesced into one transaction.
+pub const DEFAULT_MAX_BATCH_SIZE: usize = 1000;
+
+/// How the background committer groups updates into transactions.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct CommitterConfig {
+    /// Maximum number of updates coalesced into one transaction.
+    pub max_batch_size: usize,
+    /// How long to wait after the first update for more to coalesce.
+    /// Zero coalesces only updates already queued.
+    pub max_batch_delay: Duration,
+}
+
+impl Default for CommitterConfig {
+    fn default() -> Self {
+        Self {
+            max_batch_size: DEFAULT_MAX_BATCH_SIZE,
+            max_batch_delay: Duration::ZERO,
+        }
+    }
+}
+
+/// An update function run inside a background write transaction.
+type UpdateFn = Box<dyn FnMut(&mut WriteTx<'_>) -> Result<()> + Send>;
+
+/// A queued update and its completion channel.
+struct Job {
+    update: UpdateFn,
+    done: Sender<Result<()>>,
+}
+
+/// Runs write transactions on a dedicated background thread.
+///
+/// # Example
+///
+/// ```ignore
+/// let committer = BackgroundCommitter::start(db);
+/// let done = committer.submit_update(|wtx| {
+///     wtx.put(b"key", b"value");
+///     Ok(())
+/// });
+/// // ... do other work ...
+/// done.recv().unwrap()?; // durable once Ok(()) arrives
+/// let db = committer.shutdown();
+/// ```
+pub struct BackgroundCommitter {
+    sender: Option<Sender<Job>>,
+    handle: Option<JoinHandle<Database>>,
+    /// The committer thread, on which updates run.
+    thread: ThreadId,
+}
+
+impl BackgroundCommitter {
+    /// Moves the database onto a background commit thread.
+    pub fn start(db: Database) -> Self {
+        Self::start_with_config(db, CommitterConfig::default())
+    }
+
+    /// Moves the database onto a background commit thread that batches
+    /// updates as `config` describes.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let committer = BackgroundCommitter::start_with_config(
+    ///     db,
+    ///     CommitterConfig {
+    ///         max_batch_size: 500,
+    ///         max_batch_delay: Duration::from_millis(10),
+    ///     },
+    /// );
+    /// ```
+    pub fn start_with_config(db: Database, config: CommitterConfig) -> Self {
+        let (sender, receiver) = mpsc::channel();
+        let handle = std::thread::Builder::new()
+            .name("thunder-committer".to_string())
+            .spawn(move || run(db, receiver, config))
+            .expect("failed to spawn committer thread");
+        Self {
+            sender: Some(sender),
+            thread: handle.thread().id(),
+            handle: Some(handle),
+        }
+    }
+
+    /// Queues an update for the background committer.
+    ///
+    /// The returned channel receives `Ok(())` once the update has been
+    /// committed and synced, or the error that prevented it.
+    ///
+    /// # Arguments
+    ///
+    /// * `update` - Function applied to the write transaction. It may be
+    ///   called more than once if a coalesced update fails.
+    pub fn submit_update<F>(&self, update: F) -> Receiver<Result<()>>
+    where
+        F: FnMut(&mut WriteTx<'_>) -> Result<()> + Send + 'static,
+    {
+        let (done, result) = mpsc::channel();
+        let job = Job {
+            update: Box::new(update),
+            done,
+        };
+        if let Some(sender) = &self.sender
+            && let Err(mpsc::SendError(job)) = sender.send(job)
+        {
+            // The committer thread is gone (it panicked); report it.
+            let _ = job.done.send(Err(Error::GroupCommitFailed {
+                reason: "background committer is not running".to_string(),
+            }));
+        }
+        result
+    }
+
+    /// Runs an update in the next batch and waits until it is durable.
+    ///
+    /// Concurrent callers are coalesced into shared transactions, so each
+    /// pays for a fraction of an fsync. Each caller gets its own result: an
+    /// update that fails or panics does not fail the others.
+    ///
+    /// # Errors
+    ///
+    /// Returns the error returned by `update`, or `GroupCommitFailed` if it
+    /// panicked, the commit failed, or the committer is not running.
+    /// Returns `NestedTransaction` without queueing `update` when called
+    /// from an update this committer is running, which would otherwise wait
+    /// forever.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// std::thread::scope(|s| {
+    ///     for event in events {
+    ///         s.spawn(|| committer.batch(move |wtx| wtx.bucket_put(b"events", &event.id, &event.body)));
+    ///     }
+    /// });
+    /// ```
+    pub fn batch<F>(&self, update: F) -> Result<()>
+    where
+        F: FnMut(&mut WriteTx<'_>) -> Result<()> + Send + 'static,
+    {
+        if std::thread::current().id() == self.thread {
+            return Err(Error::NestedTransaction);
+        }
+        self.submit_update(update).recv().unwrap_or_else(|_| {
+            Err(Error::GroupCommitFailed {
+                reason: "background committer is not running".to_string(),
+            })
+        })
+    }
+
+    /// Waits for all queued updates and returns the database.
+    pub fn shutdown(mut self) -> Database {
+        self.stop().expect("committer thread panicked")
+    }
+
+    /// Closes the queue and joins the committer thread.
+    fn stop(&mut self) -> Option<Database> {
+        drop(self.sender.take());
+        self.handle.take()?.join().ok()
+    }
+}
+
+impl Drop for BackgroundCommitter {
+    fn drop(&mut self) {
+        // Queued updates still complete; the database is dropped afterwards.
+        let _ = self.stop();
+    }
+}
+
+/// Committer thread main loop.
+fn run(mut db: Database, receiver: Receiver<Job>, config: CommitterConfig) -> Database {
+    let max_batch_size = config.max_batch_size.max(1);
+    while let Some(first) = next_job(&mut db, &receiver) {
+        let deadline = Instant::now() + config.max_batch_delay;
+        let mut jobs = vec![first];
+        while jobs.len() < max_batch_size {
+            let timeout = deadline.saturating_duration_since(Instant::now());
+            match receiver.recv_timeout(timeout) {
+                Ok(job) => jobs.push(job),
+                Err(RecvTimeoutError::Timeout | RecvTimeoutError::Disconnected) => break,
+            }
+        }
+        commit_jobs(&mut db, jobs);
+    }
+    db
+}
+
+/// Waits for the next job, returning `None` once every handle is gone.
+///
+/// With `expiry_interval` set, expired entries are purged whenever the
+/// queue stays idle that long.
+fn next_job(db: &mut Database, receiver: &Receiver<Job>) -> Option<Job> {
+    let Some(interval) = db.options().expiry_interval else {
+        return receiver.recv().ok();
+    };
+    loop {
+        match receiver.recv_timeout(interval) {
+            Ok(job) => return Some(job),
+            Err(RecvTimeoutError::Timeout) => db.maybe_purge_expired(),
+            Err(RecvTimeoutError::Disconnected) => return None,
+        }
+    }
+}
+
+/// Applies a group of jobs in as few transactions as possible, retrying
+/// around failures.
+///
+/// Commits early once the process-wide commit threshold is reached, leaving
+/// the remaining jobs for the next transaction.
+fn commit_jobs(db: &mut Database, mut jobs: Vec<Job>) {
+    while !jobs.is_empty() {
+        let mut wtx = db.write_tx();
+        let mut failed = None;
+        let mut applied = jobs.len();
+        // Each job's outcome hooks, so a job retried in the next
+        // transaction does not run the hooks of this one.
+        let mut hooks = Vec::with_capacity(jobs.len());
+        for (i, job) in jobs.iter_mut().enumerate() {
+            let result = run_update(job, &mut wtx);
+            hooks.push(wtx.take_hooks());
+            if let Err(e) = result {
+                failed = Some((i, e));
+                break;
+            }
+            if memory::over_commit_threshold() {
+                applied = i + 1;
+                break;
+            }
+        }
+
+        if let Some((i, e)) = failed {
+            wtx.rollback();
+            if let Some(job_hooks) = hooks.pop() {
+                job_hooks.rolled_back();
+            }
+            let job = jobs.remove(i);
+            // The submitter may have dropped its receiver; nothing to do then.
+            let _ = job.done.send(Err(e));
+            continue;
+        }
+
+        match wtx.commit() {
+            Ok(()) => {
+                for (job, job_hooks) in jobs.drain(..applied).zip(hooks) {
+                    job_hooks.committed();
+                    let _ = job.done.send(Ok(()));
+                }
+            }
+            Err(e) => {
+                for job_hooks in hooks {
+                    job_hooks.rolled_back();
+                }
+                let reason = e.to_string();
+                for job in jobs.drain(..applied) {
+                    let _ = job.done.send(Err(Error::GroupCommitFailed {
+                        reason: reason.clone(),
+                    }));
+                }
+            }
+        }
+    }
+}
+
+/// Runs a job's update, turning a panic into an error.
+fn run_update(job: &mut Job, wtx: &mut WriteTx<'_>) -> Result<()> {
+    panic::catch_unwind(AssertUnwindSafe(|| (job.update)(wtx))).unwrap_or_else(|payload| {
+        let message = payload
+            .downcast_ref::<&str>()
+            .map(|s| s.to_string())
+            .or_else(|| payload.downcast_ref::<String>().cloned())
+            .unwrap_or_else(|| "unknown panic".to_string());
+        Err(Error::GroupCommitFailed {
+            reason: format!("update panicked: {message}"),
+        })
+    })
+}
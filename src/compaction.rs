@@ -0,0 +1,230 @@
+//! Summary: Online compaction into a side file with an atomic swap.
+//! Copyright (c) YOAB. All rights reserved.
+//!
+//! Compaction rewrites the database into a fresh file holding only live
+//! entries, dropping space left by superseded entries and overflow values.
+//! It runs in three steps so the slow part never blocks readers:
+//!
+//! 1. `Database::begin_compaction()` captures the committed tree as a
+//!    snapshot. It only needs a shared borrow and is O(1).
+//! 2. [`Compaction::run()`] writes the snapshot to a side file next to the
+//!    database (`<path>.compact`). It does not borrow the database, so it
+//!    can run on another thread while read transactions continue against
+//!    the live database with unchanged results.
+//! 3. `Database::finish_compaction()` renames the side file over the
+//!    database file and reopens it. It takes `&mut self`, so it is atomic
+//!    with respect to transactions: every transaction started afterwards
+//!    sees the compacted file.
+//!
+//! `Database::compact()` performs all three steps in one call.
+//!
+//! # Readers at Swap Time
+//!
+//! Read transactions borrow the database and must end before the swap.
+//! Snapshots taken before the swap keep the tree they were created from
+//! and finish on the pre-compaction state; reads are served from memory,
+//! so they are unaffected by the file being replaced.
+//!
+//! # Concurrent Writes
+//!
+//! The side file reflects the version captured when compaction began. If a
+//! transaction commits before the swap, `finish_compaction()` fails with
+//! `CompactionStale` and leaves the database untouched; compaction can be
+//! retried. Compaction assumes this is the only handle on the file.
+//!
+//! # Single-Bucket Compaction
+//!
+//! `Database::compact_bucket()` compacts one bucket in place. The data
+//! section is a flat list of entries, so the bucket cannot be given pages
+//! of its own; instead its superseded entries are dropped and its live
+//! entries are rewritten contiguously at the end of the section, while
+//! every other entry keeps its bytes and relative order, including the
+//! entries of the bucket's nested buckets.
+//!
+//! Entries are moved byte for byte, so overflow values stay on their
+//! pages, and the file is not truncated: the space given back is reused by
+//! later appends. Compressed blocks are kept whole, so the bucket's
+//! superseded entries inside them remain until a full compaction.
+//!
+//! # Auto-Compaction
+//!
+//! With `DatabaseOptions::auto_compaction` set, the database measures
+//! per-bucket fragmentation every `check_interval` commits and compacts
+//! when any bucket exceeds the threshold for its [`CompactionPriority`].
+//! Fragmentation is the share of a bucket's persisted entries that were
+//! superseded by later appends, such as the bucket header copies appended
+//! by every commit that writes to the bucket.
+//!
+//! Buckets over their threshold are scheduled highest priority first, so a
+//! high-priority bucket triggers compaction at a fragmentation a
+//! low-priority bucket is left alone at. Compaction rewrites the whole
+//! file, so every bucket is defragmented once it runs. Auto-compaction
+//! runs inside the commit that reaches the check interval; its failures
+//! are logged and do not fail the commit.
+
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
+
+use crate::btree::BTree;
+use crate::bucket::CompactionPriority;
+use crate::db::{Database, DatabaseOptions};
+use crate::error::Result;
+
+/// Suffix appended to the database path for the side file.
+const SIDE_FILE_SUFFIX: &str = ".compact";
+
+/// An in-progress compaction of a database.
+///
+/// Created by `Database::begin_compaction()`. Dropping it before the swap
+/// removes the side file.
+#[derive(Debug)]
+pub struct Compaction {
+    /// The committed tree being compacted.
+    tree: Arc<BTree>,
+    /// The version the tree was committed as.
+    version: u64,
+    /// Options for writing the side file.
+    options: DatabaseOptions,
+    /// Path of the side file.
+    side_path: PathBuf,
+    /// Whether the side file has been written.
+    written: bool,
+}
+
+impl Compaction {
+    /// Creates a compaction of `tree`, committed as `version`, for the
+    /// database at `path`.
+    pub(crate) fn new(
+        tree: Arc<BTree>,
+        version: u64,
+        path: &Path,
+        options: DatabaseOptions,
+    ) -> Self {
+        let mut side_path = path.as_os_str().to_owned();
+        side_path.push(SIDE_FILE_SUFFIX);
+        Self {
+            tree,
+            version,
+            options,
+            side_path: PathBuf::from(side_path),
+            written: false,
+        }
+    }
+
+    /// Returns the version being compacted.
+    #[inline]
+    pub fn version(&self) -> u64 {
+        self.version
+    }
+
+    /// Returns the path of the side file.
+    #[inline]
+    pub fn side_path(&self) -> &Path {
+        &self.side_path
+    }
+
+    /// Marks the side file as moved into place.
+    pub(crate) fn mark_swapped(&mut self) {
+        self.written = false;
+    }
+
+    /// Writes the captured tree to the side file.
+    ///
+    /// Does nothing if the side file was already written.
+    ///
+    /// # Errors
+    ///
+    /// Returns an error if the side file cannot be created or written.
+    pub fn run(&mut self) -> Result<()> {
+        if self.written {
+            return Ok(());
+        }
+        let _ = fs::remove_file(&self.side_path);
+        let written = Database::open_with_options(&self.side_path, self.options.clone())
+            .and_then(|mut side| side.persist_as(Arc::clone(&self.tree), self.version));
+        if let Err(e) = written {
+            let _ = fs::remove_file(&self.side_path);
+            return Err(e);
+        }
+        self.written = true;
+        Ok(())
+    }
+}
+
+impl Drop for Compaction {
+    fn drop(&mut self) {
+        if self.written {
+            let _ = fs::remove_file(&self.side_path);
+        }
+    }
+}
+
+/// Settings for compacting automatically as buckets fragment.
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub struct AutoCompactionConfig {
+    /// Commits between fragmentation checks.
+    pub check_interval: u64,
+    /// Fragmentation at which a high-priority bucket triggers compaction.
+    pub high_threshold: f64,
+    /// Fragmentation at which a normal-priority bucket triggers compaction.
+    pub normal_threshold: f64,
+    /// Fragmentation at which a low-priority bucket triggers compaction.
+    pub low_threshold: f64,
+}
+
+impl AutoCompactionConfig {
+    /// Returns the fragmentation threshold for `priority`.
+    pub fn threshold(&self, priority: CompactionPriority) -> f64 {
+        match priority {
+            CompactionPriority::High => self.high_threshold,
+            CompactionPriority::Normal => self.normal_threshold,
+            CompactionPriority::Low => self.low_threshold,
+        }
+    }
+}
+
+impl Default for AutoCompactionConfig {
+    fn default() -> Self {
+        Self {
+            check_interval: 64,
+            high_threshold: 0.25,
+            normal_threshold: 0.5,
+            low_threshold: 0.75,
+        }
+    }
+}
+
+/// Fragmentation of one bucket in the database file.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct BucketFragmentation {
+    /// The bucket name.
+    pub name: Vec<u8>,
+    /// The bucket's compaction priority.
+    pub priority: CompactionPriority,
+    /// Persisted entries holding the bucket's current data and metadata.
+    pub live_entries: u64,
+    /// Persisted entries superseded by later ones.
+    pub dead_entries: u64,
+}
+
+impl BucketFragmentation {
+    /// Returns the share of the bucket's persisted entries that are dead.
+    pub fn ratio(&self) -> f64 {
+        let total = self.live_entries + self.dead_entries;
+        if total == 0 {
+            0.0
+        } else {
+            self.dead_entries as f64 / total as f64
+        }
+    }
+}
+
+/// Record of a compaction started by auto-compaction.
+#[derive(Debug, Clone, PartialEq)]
+pub struct AutoCompaction {
+    /// The version that was compacted.
+    pub version: u64,
+    /// Buckets over their threshold, in the order they were scheduled.
+    pub buckets: Vec<BucketFragmentation>,
+}
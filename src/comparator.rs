@@ -0,0 +1,186 @@
+//! Summary: Configurable ordering of keys within buckets.
+//! Copyright (c) YOAB. All rights reserved.
+//!
+//! By default keys are ordered byte-wise. When
+//! `DatabaseOptions::comparator` is set, keys within each bucket, nested
+//! buckets included, are ordered by the comparator instead: it governs how
+//! the tree stores them and so the order of iteration, cursors and range
+//! scans over a bucket, and the bounds of those range scans.
+//!
+//! # Scope
+//!
+//! Only user keys are compared with the comparator. Each bucket's entries
+//! stay together, buckets are ordered by name byte-wise, and keys written
+//! outside buckets with `WriteTx::put` keep byte-wise order, since they
+//! share the key space with the database's own bookkeeping. The empty key
+//! always sorts first in a bucket, whatever the comparator says.
+//!
+//! # Consistency
+//!
+//! The comparator must be a total order that reports `Equal` only for
+//! identical keys, since keys it considers equal address the same entry.
+//!
+//! It is not recorded in the file, and every open must use the comparator
+//! the data was written with: opening with a different one is unsafe. The
+//! entries are sorted again as the database loads, so scans change order
+//! without warning, and if the new comparator reports two stored keys as
+//! equal, only one of them is kept and the other is lost at the next
+//! commit that rewrites the file.
+
+use std::cmp::Ordering;
+use std::fmt;
+use std::sync::Arc;
+
+use crate::bucket;
+
+/// The boxed comparison function.
+type CompareFn = dyn Fn(&[u8], &[u8]) -> Ordering + Send + Sync;
+
+/// A function ordering the user keys of buckets.
+///
+/// Cloning is cheap (reference counted).
+///
+/// # Example
+///
+/// ```ignore
+/// // Orders "item-2" before "item-10".
+/// let options = DatabaseOptions {
+///     comparator: Some(KeyComparator::new(|a, b| {
+///         let split = |k: &[u8]| {
+///             let at = k.iter().rposition(|c| !c.is_ascii_digit()).map_or(0, |i| i + 1);
+///             let digits = &k[at..];
+///             (&k[..at], digits.len(), digits)
+///         };
+///         split(a).cmp(&split(b))
+///     })),
+///     ..DatabaseOptions::default()
+/// };
+/// ```
+#[derive(Clone)]
+pub struct KeyComparator(Arc<CompareFn>);
+
+impl KeyComparator {
+    /// Creates a comparator from the given function.
+    pub fn new<F>(f: F) -> Self
+    where
+        F: Fn(&[u8], &[u8]) -> Ordering + Send + Sync + 'static,
+    {
+        Self(Arc::new(f))
+    }
+
+    /// Compares two user keys.
+    #[inline]
+    pub fn compare(&self, a: &[u8], b: &[u8]) -> Ordering {
+        (self.0)(a, b)
+    }
+
+    /// Compares two internal keys, applying the comparator to the user
+    /// keys of entries in the same bucket.
+    ///
+    /// Keys of one bucket share the prefix that names it, and any key
+    /// starting with that prefix belongs to the bucket, so reordering
+    /// within buckets keeps them contiguous in byte-wise order.
+    pub(crate) fn compare_internal(&self, a: &[u8], b: &[u8]) -> Ordering {
+        if let (Some(a_len), Some(b_len)) = (
+            bucket::data_key_prefix_len(a),
+            bucket::data_key_prefix_len(b),
+        ) && a[..a_len] == b[..b_len]
+        {
+            return self.compare_in_bucket(&a[a_len..], &b[b_len..]);
+        }
+        a.cmp(b)
+    }
+
+    /// Compares two user keys of one bucket, putting the empty key first.
+    #[inline]
+    fn compare_in_bucket(&self, a: &[u8], b: &[u8]) -> Ordering {
+        // The bare prefix bounds a bucket's scans, so it must come first.
+        match (a.is_empty(), b.is_empty()) {
+            (false, false) => self.compare(a, b),
+            (a_empty, b_empty) => b_empty.cmp(&a_empty),
+        }
+    }
+}
+
+impl fmt::Debug for KeyComparator {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str("KeyComparator")
+    }
+}
+
+/// The order of a tree's keys: byte-wise, or by a [`KeyComparator`].
+#[derive(Clone, Copy, Default)]
+pub(crate) struct KeyOrder<'a>(Option<&'a KeyComparator>);
+
+impl<'a> KeyOrder<'a> {
+    /// Orders keys by `comparator`, or byte-wise if there is none.
+    #[inline]
+    pub(crate) fn new(comparator: Option<&'a KeyComparator>) -> Self {
+        Self(comparator)
+    }
+
+    /// Compares two internal keys.
+    #[inline]
+    pub(crate) fn cmp(self, a: &[u8], b: &[u8]) -> Ordering {
+        match self.0 {
+            None => a.cmp(b),
+            Some(comparator) => comparator.compare_internal(a, b),
+        }
+    }
+
+    /// Returns whether `a` sorts before `b`.
+    #[inline]
+    pub(crate) fn lt(self, a: &[u8], b: &[u8]) -> bool {
+        self.cmp(a, b) == Ordering::Less
+    }
+
+    /// Compares two user keys of the same bucket.
+    #[inline]
+    pub(crate) fn cmp_in_bucket(self, a: &[u8], b: &[u8]) -> Ordering {
+        match self.0 {
+            None => a.cmp(b),
+            Some(comparator) => comparator.compare_in_bucket(a, b),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn reversed() -> KeyComparator {
+        KeyComparator::new(|a, b| b.cmp(a))
+    }
+
+    #[test]
+    fn test_compare_internal_reorders_within_buckets_only() {
+        let comparator = reversed();
+        let key = bucket::bucket_data_key;
+
+        // Within a bucket the comparator decides, but the prefix is first.
+        assert_eq!(
+            comparator.compare_internal(&key(b"b", b"a"), &key(b"b", b"z")),
+            Ordering::Greater
+        );
+        assert_eq!(
+            comparator.compare_internal(&key(b"b", b""), &key(b"b", b"z")),
+            Ordering::Less
+        );
+        let nested = |k| bucket::nested_bucket_data_key(&[b"p", b"c"], k);
+        assert_eq!(
+            comparator.compare_internal(&nested(b"1"), &nested(b"2")),
+            Ordering::Greater
+        );
+
+        // Bucket names and keys outside buckets stay byte-wise.
+        assert_eq!(
+            comparator.compare_internal(&key(b"a", b"z"), &key(b"b", b"a")),
+            Ordering::Less
+        );
+        assert_eq!(
+            comparator.compare_internal(b"plain-a", b"plain-b"),
+            Ordering::Less
+        );
+        assert_eq!(KeyOrder::default().cmp(b"a", b"b"), Ordering::Less);
+    }
+}
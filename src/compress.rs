@@ -0,0 +1,687 @@
+//! Summary: Page-level and per-value compression of the entry data section.
+//! Copyright (c) YOAB. All rights reserved.
+//!
+//! With `DatabaseOptions::page_compression` enabled, inline entries are
+//! grouped into page-sized blocks and each block is compressed as a whole,
+//! so keys, length headers and neighbouring small values compress together.
+//! Values stored in overflow pages are not part of any block, and commits
+//! that write them fall back to a full rewrite.
+//!
+//! # Block Format
+//!
+//! A block takes the place of an entry in the data section and is recognized
+//! by a reserved key length:
+//!
+//! `[BLOCK_MARKER:u32][codec:u8][entry_count:u32][raw_len:u32][stored_len:u32][crc:u32][stored]`
+//!
+//! `stored` holds the block's entries in the usual `[key_len][key][value_len][value]`
+//! format, encoded with `codec`. The CRC32 covers the stored (compressed)
+//! bytes, so corruption is detected before decompression. Blocks that do
+//! not shrink are stored with the `raw` codec, and entries written while
+//! compression was disabled stay plain, so a data section can mix
+//! compressed blocks, raw blocks and plain entries. A database written with
+//! compression can be reopened with it disabled.
+//!
+//! Encrypted databases write every entry in blocks, sealing each block
+//! after compressing it; see the `encrypt` module.
+//!
+//! # Value Format
+//!
+//! With `DatabaseOptions::value_compression` enabled instead, each inline
+//! value is compressed on its own and recognized by a reserved value
+//! length:
+//!
+//! `[key_len:u32][key][VALUE_MARKER:u32][codec:u8][raw_len:u32][stored_len:u32][crc:u32][stored]`
+//!
+//! Values shorter than `DatabaseOptions::value_compression_min_size`, and
+//! values that do not shrink, keep the plain format. Since the codec is
+//! recorded with each value, changing the setting only affects values
+//! written afterwards. Values are decompressed when the database is
+//! loaded, so reads see them as plain bytes. Values in overflow pages and
+//! entries inside blocks are never compressed individually.
+//!
+//! # Codecs
+//!
+//! | Id | Codec    | Format                                                 |
+//! |----|----------|--------------------------------------------------------|
+//! | 0  | `raw`    | Stored as is (blocks only)                             |
+//! | 1  | `lz`     | Built-in LZ77 variant in the LZ4 block style           |
+//! | 2  | `snappy` | Raw Snappy block format; see the `snappy` module       |
+//! | 3  | `zstd`   | Zstandard frame at the default level                   |
+//!
+//! The `lz` format is a sequence of token bytes (literal length and match
+//! length nibbles), optional length extension bytes, literals, and 2-byte
+//! match offsets. Every codec can be read whatever the current setting.
+
+use crate::encrypt::{Cipher, SEALED_CODEC};
+use crate::error::{Error, Result};
+
+/// Reserved key length marking a block in the data section.
+pub const BLOCK_MARKER: u32 = 0xFFFF_FFFE;
+
+/// Size of a block header after the marker.
+pub const BLOCK_HEADER_SIZE: usize = 1 + 4 + 4 + 4 + 4;
+
+/// Reserved value length marking a compressed value.
+pub const VALUE_MARKER: u32 = 0xFFFF_FFFD;
+
+/// Size of a compressed value header after the marker.
+pub const VALUE_HEADER_SIZE: usize = 1 + 4 + 4 + 4;
+
+/// Default for `DatabaseOptions::value_compression_min_size`.
+pub const DEFAULT_VALUE_COMPRESSION_MIN_SIZE: usize = 128;
+
+/// Codec id for blocks stored uncompressed.
+const CODEC_RAW: u8 = 0;
+
+/// Codec id for LZ-compressed blocks and values.
+const CODEC_LZ: u8 = 1;
+
+/// Codec id for Snappy-compressed blocks and values.
+const CODEC_SNAPPY: u8 = 2;
+
+/// Codec id for Zstandard-compressed blocks and values.
+const CODEC_ZSTD: u8 = 3;
+
+/// Minimum match length for the LZ codec.
+const MIN_MATCH: usize = 4;
+
+/// Hash table size (log2) for the LZ match finder.
+const HASH_BITS: u32 = 12;
+
+/// Page compression setting.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Default)]
+#[non_exhaustive]
+pub enum PageCompression {
+    /// Entries are written uncompressed.
+    #[default]
+    None,
+    /// Pages are compressed with the built-in LZ codec.
+    Lz,
+    /// Pages are compressed with Snappy.
+    Snappy,
+    /// Pages are compressed with Zstandard.
+    Zstd,
+}
+
+impl PageCompression {
+    /// Returns the codec id blocks are compressed with, if any.
+    fn codec(self) -> Option<u8> {
+        match self {
+            Self::None => None,
+            Self::Lz => Some(CODEC_LZ),
+            Self::Snappy => Some(CODEC_SNAPPY),
+            Self::Zstd => Some(CODEC_ZSTD),
+        }
+    }
+}
+
+/// Per-value compression setting.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Default)]
+#[non_exhaustive]
+pub enum ValueCompression {
+    /// Values are written uncompressed.
+    #[default]
+    None,
+    /// Values are compressed with the built-in LZ codec.
+    Lz,
+    /// Values are compressed with Snappy.
+    Snappy,
+    /// Values are compressed with Zstandard.
+    Zstd,
+}
+
+impl ValueCompression {
+    /// Returns the codec id values are compressed with, if any.
+    fn codec(self) -> Option<u8> {
+        match self {
+            Self::None => None,
+            Self::Lz => Some(CODEC_LZ),
+            Self::Snappy => Some(CODEC_SNAPPY),
+            Self::Zstd => Some(CODEC_ZSTD),
+        }
+    }
+}
+
+/// Compresses `input` with `codec`.
+///
+/// Returns `None` if the codec fails, in which case the caller stores the
+/// bytes uncompressed.
+fn compress_with(codec: u8, input: &[u8]) -> Option<Vec<u8>> {
+    match codec {
+        CODEC_LZ => Some(lz_compress(input)),
+        CODEC_SNAPPY => Some(crate::snappy::compress(input)),
+        CODEC_ZSTD => zstd::bulk::compress(input, zstd::DEFAULT_COMPRESSION_LEVEL).ok(),
+        _ => None,
+    }
+}
+
+/// Decompresses `stored`, written with the compressing `codec`, to exactly
+/// `raw_len` bytes.
+///
+/// # Errors
+///
+/// Returns the reason if the codec is unknown or the stream is malformed.
+fn decompress_with(
+    codec: u8,
+    stored: &[u8],
+    raw_len: usize,
+) -> std::result::Result<Vec<u8>, String> {
+    let decoded = match codec {
+        CODEC_LZ => lz_decompress(stored, raw_len),
+        CODEC_SNAPPY => crate::snappy::decompress(stored, raw_len),
+        CODEC_ZSTD => zstd::bulk::decompress(stored, raw_len)
+            .ok()
+            .filter(|raw| raw.len() == raw_len),
+        _ => return Err(format!("unknown codec {codec}")),
+    };
+    decoded.ok_or_else(|| format!("invalid {} stream", codec_name(codec)))
+}
+
+/// Returns the name of a compressing codec, for error messages.
+fn codec_name(codec: u8) -> &'static str {
+    match codec {
+        CODEC_LZ => "LZ",
+        CODEC_SNAPPY => "Snappy",
+        _ => "Zstandard",
+    }
+}
+
+/// Parsed block header.
+#[derive(Debug, Clone, Copy)]
+pub struct BlockHeader {
+    codec: u8,
+    /// Number of entries in the block.
+    pub entry_count: u32,
+    raw_len: u32,
+    /// Length of the stored bytes following the header.
+    pub stored_len: u32,
+    crc: u32,
+}
+
+impl BlockHeader {
+    /// Parses a header from the bytes following the block marker.
+    pub fn from_bytes(bytes: &[u8; BLOCK_HEADER_SIZE]) -> Self {
+        let u32_at =
+            |i: usize| u32::from_le_bytes([bytes[i], bytes[i + 1], bytes[i + 2], bytes[i + 3]]);
+        Self {
+            codec: bytes[0],
+            entry_count: u32_at(1),
+            raw_len: u32_at(5),
+            stored_len: u32_at(9),
+            crc: u32_at(13),
+        }
+    }
+
+    /// Verifies and decodes the stored bytes of this block, opening it
+    /// with `cipher` if it is sealed.
+    ///
+    /// # Errors
+    ///
+    /// Returns `Corrupted` if the checksum does not match, the block is
+    /// sealed and cannot be opened, the codec is unknown, or the stored
+    /// bytes do not decode to `raw_len` bytes.
+    pub fn decode(&self, stored: &[u8], cipher: Option<&Cipher>) -> Result<Vec<u8>> {
+        let corrupted = |details: String| Error::Corrupted {
+            context: "decoding compressed block",
+            details,
+        };
+
+        let actual = crc32fast::hash(stored);
+        if actual != self.crc {
+            return Err(corrupted(format!(
+                "checksum mismatch: expected {:#010x}, got {actual:#010x}",
+                self.crc
+            )));
+        }
+
+        let opened;
+        let stored = if self.codec & SEALED_CODEC != 0 {
+            let cipher = cipher.ok_or_else(|| corrupted("block is encrypted".to_string()))?;
+            opened = cipher
+                .open(stored, &self.sealed_aad())
+                .ok_or_else(|| corrupted("block failed authentication".to_string()))?;
+            opened.as_slice()
+        } else {
+            stored
+        };
+
+        let raw_len = self.raw_len as usize;
+        match self.codec & !SEALED_CODEC {
+            CODEC_RAW if stored.len() == raw_len => Ok(stored.to_vec()),
+            CODEC_RAW => Err(corrupted(format!(
+                "raw block length {} does not match {raw_len}",
+                stored.len()
+            ))),
+            codec => decompress_with(codec, stored, raw_len).map_err(corrupted),
+        }
+    }
+
+    /// Returns the header fields authenticated with a sealed block.
+    fn sealed_aad(&self) -> [u8; 9] {
+        sealed_aad(self.codec, self.entry_count, self.raw_len)
+    }
+}
+
+/// Returns the header fields authenticated with a sealed block: its codec,
+/// entry count and raw length.
+fn sealed_aad(codec: u8, entry_count: u32, raw_len: u32) -> [u8; 9] {
+    let mut aad = [0u8; 9];
+    aad[0] = codec;
+    aad[1..5].copy_from_slice(&entry_count.to_le_bytes());
+    aad[5..9].copy_from_slice(&raw_len.to_le_bytes());
+    aad
+}
+
+/// Groups entries into blocks and encodes them.
+pub struct BlockWriter {
+    compression: PageCompression,
+    cipher: Option<Cipher>,
+    target_size: usize,
+    raw: Vec<u8>,
+    entry_count: u32,
+}
+
+impl BlockWriter {
+    /// Creates a writer producing blocks of about `target_size` raw bytes.
+    pub fn new(compression: PageCompression, target_size: usize) -> Self {
+        Self {
+            compression,
+            cipher: None,
+            target_size,
+            raw: Vec::with_capacity(target_size),
+            entry_count: 0,
+        }
+    }
+
+    /// Seals every block with `cipher`, if given.
+    pub(crate) fn sealed(mut self, cipher: Option<Cipher>) -> Self {
+        self.cipher = cipher;
+        self
+    }
+
+    /// Returns true if entries should be routed through this writer.
+    #[inline]
+    pub fn is_enabled(&self) -> bool {
+        self.compression != PageCompression::None || self.cipher.is_some()
+    }
+
+    /// Adds an entry, emitting a block to `out` once full.
+    ///
+    /// # Errors
+    ///
+    /// Returns an error if a block cannot be sealed.
+    pub fn push(&mut self, key: &[u8], value: &[u8], out: &mut Vec<u8>) -> Result<()> {
+        self.raw
+            .extend_from_slice(&(key.len() as u32).to_le_bytes());
+        self.raw.extend_from_slice(key);
+        self.raw
+            .extend_from_slice(&(value.len() as u32).to_le_bytes());
+        self.raw.extend_from_slice(value);
+        self.entry_count += 1;
+        if self.raw.len() >= self.target_size {
+            self.flush(out)?;
+        }
+        Ok(())
+    }
+
+    /// Emits any buffered entries as a block to `out`.
+    ///
+    /// # Errors
+    ///
+    /// Returns an error if the block cannot be sealed.
+    pub fn flush(&mut self, out: &mut Vec<u8>) -> Result<()> {
+        if self.entry_count == 0 {
+            return Ok(());
+        }
+
+        let compressed = self
+            .compression
+            .codec()
+            .and_then(|codec| Some((codec, compress_with(codec, &self.raw)?)));
+        let (mut codec, mut stored) = match &compressed {
+            Some((codec, c)) if c.len() < self.raw.len() => (*codec, c.as_slice()),
+            _ => (CODEC_RAW, self.raw.as_slice()),
+        };
+        let raw_len = self.raw.len() as u32;
+
+        let mut sealed = Vec::new();
+        if let Some(cipher) = &self.cipher {
+            codec |= SEALED_CODEC;
+            cipher.seal(
+                stored,
+                &sealed_aad(codec, self.entry_count, raw_len),
+                &mut sealed,
+            )?;
+            stored = &sealed;
+        }
+
+        out.extend_from_slice(&BLOCK_MARKER.to_le_bytes());
+        out.push(codec);
+        out.extend_from_slice(&self.entry_count.to_le_bytes());
+        out.extend_from_slice(&raw_len.to_le_bytes());
+        out.extend_from_slice(&(stored.len() as u32).to_le_bytes());
+        out.extend_from_slice(&crc32fast::hash(stored).to_le_bytes());
+        out.extend_from_slice(stored);
+
+        self.raw.clear();
+        self.entry_count = 0;
+        Ok(())
+    }
+}
+
+/// Appends the value half of an inline entry to `out`.
+///
+/// Writes the compressed format if `compression` is enabled, `value` is at
+/// least `min_size` bytes and compressing it saves space; otherwise the
+/// plain `[value_len][value]` format.
+pub fn encode_value(
+    compression: ValueCompression,
+    min_size: usize,
+    value: &[u8],
+    out: &mut Vec<u8>,
+) {
+    let compressed = compression
+        .codec()
+        .filter(|_| value.len() >= min_size)
+        .and_then(|codec| Some((codec, compress_with(codec, value)?)));
+    match compressed {
+        Some((codec, stored)) if stored.len() + VALUE_HEADER_SIZE < value.len() => {
+            out.extend_from_slice(&VALUE_MARKER.to_le_bytes());
+            out.push(codec);
+            out.extend_from_slice(&(value.len() as u32).to_le_bytes());
+            out.extend_from_slice(&(stored.len() as u32).to_le_bytes());
+            out.extend_from_slice(&crc32fast::hash(&stored).to_le_bytes());
+            out.extend_from_slice(&stored);
+        }
+        _ => {
+            out.extend_from_slice(&(value.len() as u32).to_le_bytes());
+            out.extend_from_slice(value);
+        }
+    }
+}
+
+/// Parsed compressed value header.
+#[derive(Debug, Clone, Copy)]
+pub struct ValueHeader {
+    codec: u8,
+    raw_len: u32,
+    /// Length of the stored bytes following the header.
+    pub stored_len: u32,
+    crc: u32,
+}
+
+impl ValueHeader {
+    /// Parses a header from the bytes following the value marker.
+    pub fn from_bytes(bytes: &[u8; VALUE_HEADER_SIZE]) -> Self {
+        let u32_at =
+            |i: usize| u32::from_le_bytes([bytes[i], bytes[i + 1], bytes[i + 2], bytes[i + 3]]);
+        Self {
+            codec: bytes[0],
+            raw_len: u32_at(1),
+            stored_len: u32_at(5),
+            crc: u32_at(9),
+        }
+    }
+
+    /// Verifies and decodes the stored bytes of this value.
+    ///
+    /// # Errors
+    ///
+    /// Returns `Corrupted` if the checksum does not match, the codec is
+    /// unknown, or the stored bytes do not decode to `raw_len` bytes.
+    pub fn decode(&self, stored: &[u8]) -> Result<Vec<u8>> {
+        let corrupted = |details: String| Error::Corrupted {
+            context: "decoding compressed value",
+            details,
+        };
+
+        let actual = crc32fast::hash(stored);
+        if actual != self.crc {
+            return Err(corrupted(format!(
+                "checksum mismatch: expected {:#010x}, got {actual:#010x}",
+                self.crc
+            )));
+        }
+
+        decompress_with(self.codec, stored, self.raw_len as usize).map_err(corrupted)
+    }
+}
+
+/// Compresses `input` with the LZ codec.
+pub fn lz_compress(input: &[u8]) -> Vec<u8> {
+    let mut out = Vec::with_capacity(input.len() / 2 + 16);
+    let mut table = vec![usize::MAX; 1 << HASH_BITS];
+    let mut anchor = 0;
+    let mut i = 0;
+
+    while i + MIN_MATCH <= input.len() {
+        let seq = u32::from_le_bytes([input[i], input[i + 1], input[i + 2], input[i + 3]]);
+        let slot = (seq.wrapping_mul(2_654_435_761) >> (32 - HASH_BITS)) as usize;
+        let candidate = table[slot];
+        table[slot] = i;
+
+        if candidate != usize::MAX
+            && i - candidate <= u16::MAX as usize
+            && input[candidate..candidate + MIN_MATCH] == input[i..i + MIN_MATCH]
+        {
+            let mut len = MIN_MATCH;
+            while i + len < input.len() && input[candidate + len] == input[i + len] {
+                len += 1;
+            }
+            emit_sequence(
+                &mut out,
+                &input[anchor..i],
+                Some(((i - candidate) as u16, len)),
+            );
+            i += len;
+            anchor = i;
+        } else {
+            i += 1;
+        }
+    }
+
+    emit_sequence(&mut out, &input[anchor..], None);
+    out
+}
+
+/// Writes one sequence: token, literals and an optional match.
+fn emit_sequence(out: &mut Vec<u8>, literals: &[u8], matched: Option<(u16, usize)>) {
+    let match_code = matched.map_or(0, |(_, len)| len - MIN_MATCH);
+    let token = ((literals.len().min(15) as u8) << 4) | match_code.min(15) as u8;
+    out.push(token);
+    if literals.len() >= 15 {
+        write_length(out, literals.len() - 15);
+    }
+    out.extend_from_slice(literals);
+    if let Some((offset, _)) = matched {
+        out.extend_from_slice(&offset.to_le_bytes());
+        if match_code >= 15 {
+            write_length(out, match_code - 15);
+        }
+    }
+}
+
+/// Writes a length extension as a run of 255s and a final byte.
+fn write_length(out: &mut Vec<u8>, mut len: usize) {
+    while len >= 255 {
+        out.push(255);
+        len -= 255;
+    }
+    out.push(len as u8);
+}
+
+/// Reads a length extension written by `write_length`.
+fn read_length(input: &[u8], pos: &mut usize) -> Option<usize> {
+    let mut len = 0usize;
+    loop {
+        let byte = *input.get(*pos)?;
+        *pos += 1;
+        len = len.checked_add(byte as usize)?;
+        if byte != 255 {
+            return Some(len);
+        }
+    }
+}
+
+/// Decompresses an LZ stream that must expand to exactly `raw_len` bytes.
+///
+/// Returns `None` if the stream is malformed.
+pub fn lz_decompress(input: &[u8], raw_len: usize) -> Option<Vec<u8>> {
+    let mut out = Vec::with_capacity(raw_len);
+    let mut pos = 0;
+
+    while pos < input.len() {
+        let token = input[pos];
+        pos += 1;
+
+        let mut literal_len = (token >> 4) as usize;
+        if literal_len == 15 {
+            literal_len += read_length(input, &mut pos)?;
+        }
+        let literals = input.get(pos..pos.checked_add(literal_len)?)?;
+        if out.len() + literal_len > raw_len {
+            return None;
+        }
+        out.extend_from_slice(literals);
+        pos += literal_len;
+
+        // The final sequence has literals only.
+        if pos == input.len() {
+            break;
+        }
+
+        let offset = u16::from_le_bytes([*input.get(pos)?, *input.get(pos + 1)?]) as usize;
+        pos += 2;
+        let mut match_len = (token & 0x0f) as usize;
+        if match_len == 15 {
+            match_len += read_length(input, &mut pos)?;
+        }
+        match_len += MIN_MATCH;
+
+        if offset == 0 || offset > out.len() || out.len() + match_len > raw_len {
+            return None;
+        }
+        // Byte by byte: the match may overlap the bytes it produces.
+        let start = out.len() - offset;
+        for k in 0..match_len {
+            let byte = out[start + k];
+            out.push(byte);
+        }
+    }
+
+    (out.len() == raw_len).then_some(out)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_lz_round_trip() {
+        let inputs: Vec<Vec<u8>> = vec![
+            Vec::new(),
+            b"abc".to_vec(),
+            b"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa".to_vec(),
+            (0..5000u32)
+                .flat_map(|i| format!("key_{i:06}=value_{}", i % 7).into_bytes())
+                .collect(),
+            (0..4096u32)
+                .map(|i| (i.wrapping_mul(2_654_435_761) >> 13) as u8)
+                .collect(),
+        ];
+        for input in inputs {
+            let compressed = lz_compress(&input);
+            assert_eq!(lz_decompress(&compressed, input.len()), Some(input));
+        }
+    }
+
+    #[test]
+    fn test_block_round_trip_and_corruption() {
+        for (compression, codec) in [
+            (PageCompression::Lz, CODEC_LZ),
+            (PageCompression::Snappy, CODEC_SNAPPY),
+            (PageCompression::Zstd, CODEC_ZSTD),
+        ] {
+            let mut writer = BlockWriter::new(compression, 1 << 20);
+            let mut out = Vec::new();
+            for i in 0..100u32 {
+                writer
+                    .push(format!("key_{i:04}").as_bytes(), b"value", &mut out)
+                    .unwrap();
+            }
+            writer.flush(&mut out).unwrap();
+
+            assert_eq!(&out[0..4], &BLOCK_MARKER.to_le_bytes());
+            let header_bytes: [u8; BLOCK_HEADER_SIZE] =
+                out[4..4 + BLOCK_HEADER_SIZE].try_into().unwrap();
+            let header = BlockHeader::from_bytes(&header_bytes);
+            assert_eq!(header.entry_count, 100);
+            assert_eq!(header.codec, codec);
+
+            let mut stored = out[4 + BLOCK_HEADER_SIZE..].to_vec();
+            assert_eq!(stored.len(), header.stored_len as usize);
+            let raw = header.decode(&stored, None).unwrap();
+            assert_eq!(raw.len(), header.raw_len as usize);
+
+            stored[0] ^= 0xff;
+            assert!(matches!(
+                header.decode(&stored, None),
+                Err(Error::Corrupted { .. })
+            ));
+        }
+    }
+
+    #[test]
+    fn test_value_encoding() {
+        let json =
+            br#"{"id":1,"tags":["a","b"],"body":"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"}"#.repeat(8);
+
+        for (compression, codec) in [
+            (ValueCompression::Lz, CODEC_LZ),
+            (ValueCompression::Snappy, CODEC_SNAPPY),
+            (ValueCompression::Zstd, CODEC_ZSTD),
+        ] {
+            let mut out = Vec::new();
+            encode_value(compression, 128, &json, &mut out);
+            assert_eq!(&out[0..4], &VALUE_MARKER.to_le_bytes());
+            let header_bytes: [u8; VALUE_HEADER_SIZE] =
+                out[4..4 + VALUE_HEADER_SIZE].try_into().unwrap();
+            let header = ValueHeader::from_bytes(&header_bytes);
+            assert_eq!(header.codec, codec);
+            let mut stored = out[4 + VALUE_HEADER_SIZE..].to_vec();
+            assert_eq!(stored.len(), header.stored_len as usize);
+            assert!(stored.len() < json.len());
+            assert_eq!(header.decode(&stored).unwrap(), json);
+
+            stored[0] ^= 0xff;
+            assert!(matches!(
+                header.decode(&stored),
+                Err(Error::Corrupted { .. })
+            ));
+        }
+
+        // Short values, incompressible values and disabled compression stay plain.
+        let mut state = 0x2545_f491_4f6c_dd1du64;
+        let noise: Vec<u8> = (0..512)
+            .map(|_| {
+                state ^= state << 13;
+                state ^= state >> 7;
+                state ^= state << 17;
+                (state >> 24) as u8
+            })
+            .collect();
+        for (compression, value) in [
+            (ValueCompression::Lz, &json[..64]),
+            (ValueCompression::Lz, &noise[..]),
+            (ValueCompression::Snappy, &noise[..]),
+            (ValueCompression::Zstd, &noise[..]),
+            (ValueCompression::None, &json[..]),
+        ] {
+            let mut out = Vec::new();
+            encode_value(compression, 128, value, &mut out);
+            assert_eq!(&out[0..4], &(value.len() as u32).to_le_bytes());
+            assert_eq!(&out[4..], value);
+        }
+    }
+}
@@ -0,0 +1,323 @@
+//! Summary: Loading CSV records into a bucket.
+//! Copyright (c) YOAB. All rights reserved.
+//!
+//! `Database::import_csv()` reads CSV records and writes one column as the
+//! key and another as the value of each entry. Later rows overwrite earlier
+//! ones with the same key.
+//!
+//! # Parsing
+//!
+//! Records follow RFC 4180: fields are split on `CsvOptions::delimiter`,
+//! a field wrapped in double quotes may contain the delimiter, line breaks
+//! and `""` for a literal quote, and records end with `\n` or `\r\n`. Blank
+//! lines are skipped. Fields are taken as raw bytes, so the input does not
+//! have to be UTF-8. Errors name the 1-based line they were found on.
+//!
+//! # Memory
+//!
+//! Rows are committed every [`IMPORT_BATCH_BYTES`] of keys and values, so
+//! memory use stays bounded but the import is not atomic: a failed import
+//! leaves the batches committed before the failure.
+
+use std::io::{BufRead, BufReader, Read};
+
+use crate::bucket;
+use crate::db::Database;
+use crate::error::{Error, Result};
+use crate::export::IMPORT_BATCH_BYTES;
+
+/// Options for `Database::import_csv()`.
+#[derive(Debug, Clone)]
+pub struct CsvOptions {
+    /// Zero-based column holding the key.
+    pub key_column: usize,
+    /// Zero-based column holding the value.
+    pub value_column: usize,
+    /// Byte separating fields. Must not be `"`, `\r` or `\n`.
+    pub delimiter: u8,
+    /// Skip the first record.
+    pub has_header: bool,
+}
+
+impl Default for CsvOptions {
+    fn default() -> Self {
+        Self {
+            key_column: 0,
+            value_column: 1,
+            delimiter: b',',
+            has_header: false,
+        }
+    }
+}
+
+impl CsvOptions {
+    /// Sets the key and value columns.
+    #[must_use]
+    pub fn columns(mut self, key_column: usize, value_column: usize) -> Self {
+        self.key_column = key_column;
+        self.value_column = value_column;
+        self
+    }
+
+    /// Sets the field delimiter.
+    #[must_use]
+    pub fn delimiter(mut self, delimiter: u8) -> Self {
+        self.delimiter = delimiter;
+        self
+    }
+
+    /// Sets whether the first record is a header to skip.
+    #[must_use]
+    pub fn has_header(mut self, has_header: bool) -> Self {
+        self.has_header = has_header;
+        self
+    }
+}
+
+/// Reads CSV records from `reader` into `bucket`, returning the number of
+/// rows written.
+pub(crate) fn import_csv<R: Read>(
+    db: &mut Database,
+    name: &[u8],
+    reader: R,
+    options: &CsvOptions,
+) -> Result<u64> {
+    if matches!(options.delimiter, b'"' | b'\r' | b'\n') {
+        return Err(Error::InvalidCsv {
+            line: 1,
+            reason: format!(
+                "{:?} cannot be used as a delimiter",
+                options.delimiter as char
+            ),
+        });
+    }
+    if !bucket::bucket_exists(db.tree(), name) {
+        return Err(Error::BucketNotFound {
+            name: name.to_vec(),
+        });
+    }
+
+    let mut records = CsvReader::new(BufReader::new(reader), options.delimiter);
+    let mut fields = Vec::new();
+    let mut batch: Vec<(Vec<u8>, Vec<u8>)> = Vec::new();
+    let mut batch_bytes = 0;
+    let mut rows = 0;
+    let mut skip = options.has_header;
+
+    while records.next_record(&mut fields)? {
+        if std::mem::take(&mut skip) {
+            continue;
+        }
+        let column = options.key_column.max(options.value_column);
+        if fields.len() <= column {
+            return Err(Error::InvalidCsv {
+                line: records.record_line,
+                reason: format!(
+                    "record has {} fields, column {column} is missing",
+                    fields.len()
+                ),
+            });
+        }
+        let key = fields[options.key_column].clone();
+        let value = fields[options.value_column].clone();
+        batch_bytes += key.len() + value.len();
+        batch.push((key, value));
+
+        if batch_bytes >= IMPORT_BATCH_BYTES {
+            rows += write_batch(db, name, &mut batch)?;
+            batch_bytes = 0;
+        }
+    }
+    rows += write_batch(db, name, &mut batch)?;
+    Ok(rows)
+}
+
+/// Commits `batch` into the bucket, leaving it empty.
+fn write_batch(db: &mut Database, name: &[u8], batch: &mut Vec<(Vec<u8>, Vec<u8>)>) -> Result<u64> {
+    if batch.is_empty() {
+        return Ok(0);
+    }
+    let mut wtx = db.write_tx();
+    for (key, value) in batch.iter() {
+        wtx.bucket_put(name, key, value)?;
+    }
+    wtx.commit()?;
+    let rows = batch.len() as u64;
+    batch.clear();
+    Ok(rows)
+}
+
+/// Splits a byte stream into CSV records.
+struct CsvReader<R> {
+    reader: R,
+    delimiter: u8,
+    /// The physical line being read.
+    line: Vec<u8>,
+    /// Lines read so far.
+    line_number: u64,
+    /// The line the current record started on.
+    record_line: u64,
+}
+
+impl<R: BufRead> CsvReader<R> {
+    fn new(reader: R, delimiter: u8) -> Self {
+        Self {
+            reader,
+            delimiter,
+            line: Vec::new(),
+            line_number: 0,
+            record_line: 0,
+        }
+    }
+
+    /// Reads the next line into `self.line` without its line ending.
+    /// Returns `false` at the end of the input.
+    fn read_line(&mut self) -> Result<bool> {
+        self.line.clear();
+        if self.reader.read_until(b'\n', &mut self.line)? == 0 {
+            return Ok(false);
+        }
+        self.line_number += 1;
+        if self.line.last() == Some(&b'\n') {
+            self.line.pop();
+            if self.line.last() == Some(&b'\r') {
+                self.line.pop();
+            }
+        }
+        Ok(true)
+    }
+
+    /// Reads the next non-blank record into `fields`. Returns `false` at
+    /// the end of the input.
+    fn next_record(&mut self, fields: &mut Vec<Vec<u8>>) -> Result<bool> {
+        loop {
+            if !self.read_line()? {
+                return Ok(false);
+            }
+            if !self.line.is_empty() {
+                break;
+            }
+        }
+        self.record_line = self.line_number;
+        fields.clear();
+
+        let mut field = Vec::new();
+        let mut pos = 0;
+        loop {
+            if self.line.get(pos) == Some(&b'"') {
+                pos = self.quoted_field(pos + 1, &mut field)?;
+                match self.line.get(pos) {
+                    None => {}
+                    Some(&b) if b == self.delimiter => {}
+                    Some(_) => {
+                        return Err(self.invalid("unexpected text after a closing quote"));
+                    }
+                }
+            } else {
+                let end = self.line[pos..]
+                    .iter()
+                    .position(|&b| b == self.delimiter)
+                    .map_or(self.line.len(), |i| pos + i);
+                let raw = &self.line[pos..end];
+                if raw.contains(&b'"') {
+                    return Err(self.invalid("quote inside an unquoted field"));
+                }
+                field.extend_from_slice(raw);
+                pos = end;
+            }
+            fields.push(std::mem::take(&mut field));
+            if pos == self.line.len() {
+                return Ok(true);
+            }
+            // Skip the delimiter.
+            pos += 1;
+        }
+    }
+
+    /// Reads a quoted field starting after its opening quote, reading
+    /// further lines if it spans line breaks. Returns the position after
+    /// the closing quote.
+    fn quoted_field(&mut self, mut pos: usize, field: &mut Vec<u8>) -> Result<usize> {
+        loop {
+            match self.line[pos..].iter().position(|&b| b == b'"') {
+                Some(i) => {
+                    field.extend_from_slice(&self.line[pos..pos + i]);
+                    pos += i + 1;
+                    if self.line.get(pos) == Some(&b'"') {
+                        field.push(b'"');
+                        pos += 1;
+                    } else {
+                        return Ok(pos);
+                    }
+                }
+                None => {
+                    field.extend_from_slice(&self.line[pos..]);
+                    field.push(b'\n');
+                    if !self.read_line()? {
+                        return Err(Error::InvalidCsv {
+                            line: self.record_line,
+                            reason: "unterminated quoted field".to_string(),
+                        });
+                    }
+                    pos = 0;
+                }
+            }
+        }
+    }
+
+    fn invalid(&self, reason: &str) -> Error {
+        Error::InvalidCsv {
+            line: self.line_number,
+            reason: reason.to_string(),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn parse(input: &[u8], delimiter: u8) -> Result<Vec<Vec<Vec<u8>>>> {
+        let mut reader = CsvReader::new(input, delimiter);
+        let mut fields = Vec::new();
+        let mut records = Vec::new();
+        while reader.next_record(&mut fields)? {
+            records.push(fields.clone());
+        }
+        Ok(records)
+    }
+
+    #[test]
+    fn test_csv_reader_fields_and_quotes() {
+        let records = parse(
+            b"a,b,c\r\n\n\"x,1\",\"say \"\"hi\"\"\",\n\"two\nlines\",,z",
+            b',',
+        )
+        .unwrap();
+        assert_eq!(
+            records,
+            vec![
+                vec![b"a".to_vec(), b"b".to_vec(), b"c".to_vec()],
+                vec![b"x,1".to_vec(), b"say \"hi\"".to_vec(), Vec::new()],
+                vec![b"two\nlines".to_vec(), Vec::new(), b"z".to_vec()],
+            ]
+        );
+
+        let records = parse(b"k\tv,w\n", b'\t').unwrap();
+        assert_eq!(records, vec![vec![b"k".to_vec(), b"v,w".to_vec()]]);
+    }
+
+    #[test]
+    fn test_csv_reader_reports_lines() {
+        for (input, line) in [
+            (&b"a,b\nc,d\"e\n"[..], 2),
+            (b"a,b\n\n\"c\"d,e\n", 3),
+            (b"a,b\n\"open,\nstill open\n", 2),
+        ] {
+            match parse(input, b',') {
+                Err(Error::InvalidCsv { line: got, .. }) => assert_eq!(got, line),
+                other => panic!("expected InvalidCsv, got {other:?}"),
+            }
+        }
+    }
+}
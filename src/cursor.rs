@@ -0,0 +1,474 @@
+//! Summary: Bidirectional cursors over the entries of a bucket.
+//! Copyright (c) YOAB. All rights reserved.
+//!
+//! A [`Cursor`] is a movable position in a bucket, created with
+//! `BucketRef::cursor()`. Unlike the bucket iterators, it can step
+//! backwards as well as forwards, so views like "the latest N events" walk
+//! from the largest key down without collecting and reversing the bucket.
+//!
+//! # Positioning
+//!
+//! The semantics follow bbolt's cursors:
+//!
+//! - A new cursor is unpositioned; [`first()`](Cursor::first),
+//!   [`last()`](Cursor::last), [`seek()`](Cursor::seek) or
+//!   [`next()`](Cursor::next) place it.
+//! - Moving past either end returns `None`. The cursor then rests just
+//!   outside the bucket, and stepping back in the other direction returns
+//!   the entry at that end.
+//! - `next()` and `prev()` can be mixed freely: stepping back after
+//!   stepping forward returns the entry before the current one.
+//!
+//! A cursor borrows the transaction's view of the tree, so it always sees
+//! the state the transaction started with.
+//!
+//! # Deleting While Iterating
+//!
+//! A [`CursorMut`], created with `WriteTx::bucket_cursor()`, moves the same
+//! way over the bucket as the write transaction sees it, including the
+//! transaction's own writes and deletions, and can also put entries and
+//! delete the entry it is on. The cursor keeps its position through both:
+//! `next()` after `delete()` returns the entry that followed the deleted
+//! one.
+
+use crate::btree::{BTree, BTreeCursor};
+use crate::bucket::bucket_data_prefix;
+use crate::cancel::CancelCheck;
+use crate::error::Result;
+use crate::expiry::ExpiryCheck;
+use crate::tx::WriteTx;
+
+/// A cursor over the entries of a bucket, in key order.
+///
+/// Keys are returned without the bucket prefix.
+///
+/// # Example
+///
+/// ```ignore
+/// let rtx = db.read_tx();
+/// let events = rtx.bucket(b"events")?;
+/// let mut cursor = events.cursor();
+///
+/// // The ten most recent events, newest first.
+/// let mut entry = cursor.last();
+/// for _ in 0..10 {
+///     let Some((key, value)) = entry else { break };
+///     render(key, value);
+///     entry = cursor.prev();
+/// }
+/// ```
+pub struct Cursor<'a> {
+    inner: BTreeCursor<'a>,
+    /// Prefix shared by every data key of the bucket.
+    prefix: Vec<u8>,
+    /// The smallest key above every data key of the bucket.
+    end: Vec<u8>,
+    /// Skips entries past their TTL.
+    expiry: ExpiryCheck<'a>,
+    /// Stops the cursor once its transaction is cancelled.
+    cancel: CancelCheck,
+}
+
+impl<'a> Cursor<'a> {
+    /// Creates an unpositioned cursor over a bucket's entries.
+    pub(crate) fn new(tree: &'a BTree, bucket_name: &[u8]) -> Self {
+        Self::with_expiry(tree, bucket_name, ExpiryCheck::new(tree))
+    }
+
+    /// Creates an unpositioned cursor that skips entries `expiry` reports
+    /// as expired.
+    pub(crate) fn with_expiry(
+        tree: &'a BTree,
+        bucket_name: &[u8],
+        expiry: ExpiryCheck<'a>,
+    ) -> Self {
+        let prefix = bucket_data_prefix(bucket_name);
+        let end = prefix_end(&prefix);
+        Self {
+            inner: tree.cursor(),
+            prefix,
+            end,
+            expiry,
+            cancel: CancelCheck::default(),
+        }
+    }
+
+    /// Returns the cursor, made to stop moving once `cancel` reports its
+    /// transaction cancelled.
+    pub(crate) fn cancellable(mut self, cancel: CancelCheck) -> Self {
+        self.cancel = cancel;
+        self
+    }
+
+    /// Moves to the first entry of the bucket.
+    ///
+    /// Returns `None` if the bucket is empty.
+    pub fn first(&mut self) -> Option<(&'a [u8], &'a [u8])> {
+        let entry = self.inner.seek(&self.prefix);
+        self.forward(entry)
+    }
+
+    /// Moves to the last entry of the bucket.
+    ///
+    /// Returns `None` if the bucket is empty.
+    pub fn last(&mut self) -> Option<(&'a [u8], &'a [u8])> {
+        self.inner.seek(&self.end);
+        let entry = self.inner.prev();
+        self.backward(entry)
+    }
+
+    /// Moves to the first entry whose key is at least `key`.
+    ///
+    /// Descends the tree directly to the position, so seeking costs the
+    /// same wherever the key lies. Returns `None` if every key is smaller;
+    /// the cursor then rests after the last entry. `next()` and `prev()`
+    /// continue from the position found.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// // All entries with keys starting with "2024-06".
+    /// let mut cursor = bucket.cursor();
+    /// let mut entry = cursor.seek(b"2024-06");
+    /// while let Some((key, value)) = entry.filter(|(k, _)| k.starts_with(b"2024-06")) {
+    ///     process(key, value);
+    ///     entry = cursor.next();
+    /// }
+    /// ```
+    pub fn seek(&mut self, key: &[u8]) -> Option<(&'a [u8], &'a [u8])> {
+        let mut target = Vec::with_capacity(self.prefix.len() + key.len());
+        target.extend_from_slice(&self.prefix);
+        target.extend_from_slice(key);
+        let entry = self.inner.seek(&target);
+        self.forward(entry)
+    }
+
+    /// Moves to the next entry.
+    ///
+    /// An unpositioned cursor, or one resting before the first entry, moves
+    /// to the first entry. Returns `None` once the cursor moves past the
+    /// last entry.
+    // Not `Iterator::next`: the cursor can step back after running out.
+    #[allow(clippy::should_implement_trait)]
+    pub fn next(&mut self) -> Option<(&'a [u8], &'a [u8])> {
+        match self.inner.current() {
+            None if self.inner.is_before_first() => self.first(),
+            Some((key, _)) if key < self.prefix.as_slice() => self.first(),
+            Some((key, _)) if key.starts_with(&self.prefix) => {
+                let entry = self.inner.next();
+                self.forward(entry)
+            }
+            // Past the last entry already.
+            _ => None,
+        }
+    }
+
+    /// Moves to the previous entry.
+    ///
+    /// A cursor resting after the last entry moves to the last entry.
+    /// Returns `None` once the cursor moves before the first entry, or if
+    /// it is unpositioned.
+    pub fn prev(&mut self) -> Option<(&'a [u8], &'a [u8])> {
+        match self.inner.current() {
+            None if self.inner.is_before_first() => None,
+            Some((key, _)) if key < self.prefix.as_slice() => None,
+            Some((key, _)) if key.starts_with(&self.prefix) => {
+                let entry = self.inner.prev();
+                self.backward(entry)
+            }
+            // Past the last entry.
+            _ => self.last(),
+        }
+    }
+
+    /// Steps forward from `entry` past expired entries of the bucket.
+    fn forward(&mut self, mut entry: Option<(&'a [u8], &'a [u8])>) -> Option<(&'a [u8], &'a [u8])> {
+        if self.cancel.tick() {
+            return None;
+        }
+        while entry.is_some_and(|(key, _)| self.is_expired(key)) {
+            entry = self.inner.next();
+        }
+        self.in_bucket(entry)
+    }
+
+    /// Steps backward from `entry` past expired entries of the bucket.
+    fn backward(
+        &mut self,
+        mut entry: Option<(&'a [u8], &'a [u8])>,
+    ) -> Option<(&'a [u8], &'a [u8])> {
+        if self.cancel.tick() {
+            return None;
+        }
+        while entry.is_some_and(|(key, _)| self.is_expired(key)) {
+            entry = self.inner.prev();
+        }
+        self.in_bucket(entry)
+    }
+
+    /// Returns whether `key` is an expired entry of the bucket.
+    fn is_expired(&self, key: &[u8]) -> bool {
+        key.starts_with(&self.prefix) && self.expiry.is_expired(key)
+    }
+
+    /// Strips the bucket prefix from `entry`, or returns `None` if it lies
+    /// outside the bucket.
+    fn in_bucket(&self, entry: Option<(&'a [u8], &'a [u8])>) -> Option<(&'a [u8], &'a [u8])> {
+        let (key, value) = entry?;
+        key.starts_with(&self.prefix)
+            .then(|| (&key[self.prefix.len()..], value))
+    }
+}
+
+/// Where a [`CursorMut`] rests between calls.
+enum Position {
+    Unpositioned,
+    BeforeFirst,
+    /// On the entry with this key.
+    At(Vec<u8>),
+    AfterLast,
+}
+
+/// A move of a [`CursorMut`], relative to a key where it has one.
+#[derive(Clone, Copy)]
+enum Step<'k> {
+    First,
+    Last,
+    /// To the first key at least this one.
+    Seek(&'k [u8]),
+    /// To the first key above this one.
+    After(&'k [u8]),
+    /// To the last key below this one.
+    Before(&'k [u8]),
+}
+
+impl Step<'_> {
+    /// Returns whether the move looks for larger keys.
+    fn is_forward(self) -> bool {
+        matches!(self, Step::First | Step::Seek(_) | Step::After(_))
+    }
+}
+
+/// A cursor over a bucket in a write transaction that can write and
+/// delete entries.
+///
+/// Moves like [`Cursor`], over the bucket as the transaction sees it:
+/// writes staged earlier in the transaction, or through the cursor, appear
+/// in key order, and deleted entries are skipped. The cursor remembers the
+/// key it is on rather than a place in the tree, so changes never disturb
+/// its position: after [`delete()`](Self::delete), `next()` returns the
+/// entry that followed the deleted one, and a key put ahead of the cursor
+/// is reached when the cursor gets there.
+///
+/// # Example
+///
+/// ```ignore
+/// let mut wtx = db.write_tx();
+/// let mut cursor = wtx.bucket_cursor(b"jobs")?;
+/// let mut entry = cursor.first();
+/// while let Some((_, value)) = entry {
+///     if is_done(value) {
+///         cursor.delete()?;
+///     }
+///     entry = cursor.next();
+/// }
+/// wtx.commit()?;
+/// ```
+pub struct CursorMut<'t, 'db> {
+    tx: &'t mut WriteTx<'db>,
+    bucket_name: Vec<u8>,
+    position: Position,
+}
+
+impl<'t, 'db> CursorMut<'t, 'db> {
+    /// Creates an unpositioned cursor over an existing bucket.
+    pub(crate) fn new(tx: &'t mut WriteTx<'db>, bucket_name: &[u8]) -> Self {
+        Self {
+            tx,
+            bucket_name: bucket_name.to_vec(),
+            position: Position::Unpositioned,
+        }
+    }
+
+    /// Moves to the first entry of the bucket.
+    ///
+    /// Returns `None` if the bucket is empty.
+    pub fn first(&mut self) -> Option<(&[u8], &[u8])> {
+        let entry = locate(self.tx, &self.bucket_name, Step::First);
+        self.position = at_or(entry, Position::AfterLast);
+        entry
+    }
+
+    /// Moves to the last entry of the bucket.
+    ///
+    /// Returns `None` if the bucket is empty.
+    pub fn last(&mut self) -> Option<(&[u8], &[u8])> {
+        let entry = locate(self.tx, &self.bucket_name, Step::Last);
+        self.position = at_or(entry, Position::BeforeFirst);
+        entry
+    }
+
+    /// Moves to the first entry whose key is at least `key`.
+    ///
+    /// Returns `None` if every key is smaller; the cursor then rests after
+    /// the last entry.
+    pub fn seek(&mut self, key: &[u8]) -> Option<(&[u8], &[u8])> {
+        let entry = locate(self.tx, &self.bucket_name, Step::Seek(key));
+        self.position = at_or(entry, Position::AfterLast);
+        entry
+    }
+
+    /// Moves to the next entry.
+    ///
+    /// After [`delete()`](Self::delete), this is the entry that followed
+    /// the deleted one. Returns `None` once the cursor moves past the last
+    /// entry.
+    // Not `Iterator::next`: the cursor can step back after running out.
+    #[allow(clippy::should_implement_trait)]
+    pub fn next(&mut self) -> Option<(&[u8], &[u8])> {
+        let step = match &self.position {
+            Position::Unpositioned | Position::BeforeFirst => Step::First,
+            Position::At(key) => Step::After(key),
+            Position::AfterLast => return None,
+        };
+        let entry = locate(self.tx, &self.bucket_name, step);
+        self.position = at_or(entry, Position::AfterLast);
+        entry
+    }
+
+    /// Moves to the previous entry.
+    ///
+    /// Returns `None` once the cursor moves before the first entry, or if
+    /// it is unpositioned.
+    pub fn prev(&mut self) -> Option<(&[u8], &[u8])> {
+        let step = match &self.position {
+            Position::Unpositioned | Position::BeforeFirst => return None,
+            Position::At(key) => Step::Before(key),
+            Position::AfterLast => Step::Last,
+        };
+        let entry = locate(self.tx, &self.bucket_name, step);
+        self.position = at_or(entry, Position::BeforeFirst);
+        entry
+    }
+
+    /// Puts a key-value pair into the bucket without moving the cursor.
+    ///
+    /// The write is staged in the transaction like
+    /// `WriteTx::bucket_put()`. A key ahead of the cursor is returned when
+    /// the cursor reaches it.
+    ///
+    /// # Errors
+    ///
+    /// Returns `BucketNotFound` if the bucket was deleted in this
+    /// transaction.
+    pub fn put(&mut self, key: &[u8], value: &[u8]) -> Result<()> {
+        self.tx.bucket_put(&self.bucket_name, key, value)
+    }
+
+    /// Deletes the entry the cursor is on.
+    ///
+    /// The cursor stays where it is, so `next()` and `prev()` continue from
+    /// the deleted entry's neighbours. Does nothing if the cursor is not on
+    /// an entry.
+    ///
+    /// # Errors
+    ///
+    /// Returns `BucketNotFound` if the bucket was deleted in this
+    /// transaction.
+    pub fn delete(&mut self) -> Result<()> {
+        match &self.position {
+            Position::At(key) => self.tx.bucket_delete(&self.bucket_name, key),
+            _ => Ok(()),
+        }
+    }
+}
+
+/// Returns the entry `step` moves to in a bucket as `tx` sees it.
+///
+/// Merges the committed entries, minus those deleted or overwritten in
+/// the transaction, with the transaction's staged ones.
+fn locate<'a>(
+    tx: &'a WriteTx<'_>,
+    bucket_name: &[u8],
+    step: Step<'_>,
+) -> Option<(&'a [u8], &'a [u8])> {
+    let committed = Cursor::new(tx.committed_tree(), bucket_name);
+    if !tx.reads_own_writes() {
+        return step_to(committed, step, |_| false);
+    }
+
+    let pending = tx.pending_tree();
+    let prefix = bucket_data_prefix(bucket_name);
+    let mut internal_key = Vec::with_capacity(prefix.len() + 64);
+    let changed = |key: &[u8]| {
+        internal_key.clear();
+        internal_key.extend_from_slice(&prefix);
+        internal_key.extend_from_slice(key);
+        pending.get(&internal_key).is_some() || tx.is_staged_delete(&internal_key)
+    };
+    let old = step_to(committed, step, changed);
+    let new = step_to(Cursor::new(pending, bucket_name), step, |_| false);
+    match (old, new) {
+        (Some(old), Some(new)) => {
+            // The keys differ: staged keys are skipped in the committed tree.
+            let order = tx.committed_tree().order();
+            if order.cmp_in_bucket(old.0, new.0).is_lt() == step.is_forward() {
+                Some(old)
+            } else {
+                Some(new)
+            }
+        }
+        (old, new) => old.or(new),
+    }
+}
+
+/// Makes `step` with `cursor`, moving on past entries `skip` rejects.
+fn step_to<'a>(
+    mut cursor: Cursor<'a>,
+    step: Step<'_>,
+    mut skip: impl FnMut(&[u8]) -> bool,
+) -> Option<(&'a [u8], &'a [u8])> {
+    let mut entry = match step {
+        Step::First => cursor.first(),
+        Step::Last => cursor.last(),
+        Step::Seek(key) => cursor.seek(key),
+        Step::After(key) => match cursor.seek(key) {
+            Some((found, _)) if found == key => cursor.next(),
+            entry => entry,
+        },
+        Step::Before(key) => {
+            cursor.seek(key);
+            cursor.prev()
+        }
+    };
+    while entry.is_some_and(|(key, _)| skip(key)) {
+        entry = if step.is_forward() {
+            cursor.next()
+        } else {
+            cursor.prev()
+        };
+    }
+    entry
+}
+
+/// Returns the position of `entry`, or `otherwise` if there is none.
+fn at_or(entry: Option<(&[u8], &[u8])>, otherwise: Position) -> Position {
+    match entry {
+        Some((key, _)) => Position::At(key.to_vec()),
+        None => otherwise,
+    }
+}
+
+/// Returns the smallest key greater than every key starting with `prefix`.
+///
+/// Bucket data prefixes start with a byte below `0xFF`, so one exists.
+pub(crate) fn prefix_end(prefix: &[u8]) -> Vec<u8> {
+    let mut end = prefix.to_vec();
+    while end.last() == Some(&0xFF) {
+        end.pop();
+    }
+    if let Some(last) = end.last_mut() {
+        *last += 1;
+    }
+    end
+}
@@ -4,6 +4,8 @@
 use std::fs::{File, OpenOptions};
 use std::io::{Read, Seek, SeekFrom, Write};
 use std::path::{Path, PathBuf};
+use std::sync::mpsc::Receiver;
+use std::time::SystemTime;
 
 #[cfg(unix)]
 use std::os::unix::io::AsRawFd;
@@ -13,18 +15,47 @@ use std::os::unix::fs::FileExt;
 
 use rayon::prelude::*;
 
-use crate::bloom::BloomFilter;
+use crate::audit::AuditWriter;
+use crate::backup::Backup;
+use crate::bloom::{BloomFilter, BucketBlooms};
 use crate::btree::BTree;
+use crate::bucket::{self, BucketMut, CompactionPriority};
+use crate::bulk::BulkOptions;
+use crate::cancel::CancelToken;
+use crate::capacity::CapacityReport;
+use crate::check::{self, CheckTarget};
 use crate::checkpoint::{CheckpointConfig, CheckpointInfo, CheckpointManager};
+use crate::compaction::{AutoCompaction, AutoCompactionConfig, BucketFragmentation, Compaction};
+use crate::comparator::KeyComparator;
+use crate::compress::{
+    self, BlockHeader, BlockWriter, DEFAULT_VALUE_COMPRESSION_MIN_SIZE, PageCompression,
+    ValueCompression, ValueHeader,
+};
 use crate::concurrent::PARALLEL_THRESHOLD;
+use crate::encrypt::{self, Cipher, EncryptionKey};
 use crate::error::{Error, Result};
+use crate::freelist::FreelistType;
+use crate::freeze::{Freeze, FreezeGate};
+use crate::layout::{self, AllocationRange, PageInfo};
+use crate::logger::Logger;
+use crate::merge::MergeOperator;
 use crate::meta::Meta;
-use crate::mmap::Mmap;
+use crate::mmap::{self, Mmap};
+use crate::normalize::KeyNormalizer;
 use crate::overflow::{DEFAULT_OVERFLOW_THRESHOLD, OverflowManager, OverflowRef};
-use crate::page::{PAGE_SIZE, PageId, PageSizeConfig};
-use crate::tx::{ReadTx, WriteTx};
+use crate::page::{MAGIC, PAGE_SIZE, PageId, PageSizeConfig, PageType, VERSION};
+use crate::retention::{RetainedStats, VersionHistory};
+use crate::scrub::{DEFAULT_SCRUB_BYTES_PER_SEC, ScrubConfig, ScrubErrorHook, Scrubber};
+use crate::slow_read::SlowReadHook;
+use crate::snapshot::ReadHandle;
+use crate::stats::{self, DatabaseStats, StatsCollector};
+use crate::tx::{ChunkedTx, ReadTx, WriteTx};
+use crate::tx_monitor::TxMonitor;
+use crate::upgrade::UpgradeProgress;
+use crate::version_watch::VersionWatch;
 use crate::wal::{Lsn, SyncPolicy, Wal, WalConfig};
 use crate::wal_record::WalRecord;
+use crate::watch::{Unwatch, WatchEvent, Watchers};
 
 /// Default write buffer size (256KB).
 /// Larger buffers reduce syscall overhead for batch writes.
@@ -52,7 +83,12 @@ type TreeLoadResult = (
 #[derive(Debug, Clone)]
 pub struct DatabaseOptions {
     /// Page size for new databases.
-    /// Ignored when opening existing databases (uses stored value).
+    ///
+    /// Stored in the meta pages when the file is created. Opening an
+    /// existing database with a different page size fails with
+    /// `PageSizeMismatch`, which reports the stored size. Larger pages
+    /// suit large values, which then span fewer pages; see
+    /// `PageSizeConfig::os_default()` to match the OS page size.
     pub page_size: PageSizeConfig,
     /// Overflow threshold (values larger than this use overflow pages).
     pub overflow_threshold: usize,
@@ -71,6 +107,189 @@ pub struct DatabaseOptions {
     pub checkpoint_interval_secs: u64,
     /// WAL size threshold for checkpoint (bytes).
     pub checkpoint_wal_threshold: usize,
+    /// Destination for diagnostic warnings.
+    pub logger: Logger,
+    /// Warn when a write transaction is dropped without commit or rollback.
+    ///
+    /// Each write transaction captures its creation backtrace, which is
+    /// included in the warning. Off by default because capturing a
+    /// backtrace on every transaction is expensive.
+    pub detect_tx_leaks: bool,
+    /// Store a CRC32 alongside each committed value.
+    ///
+    /// Checked reads (`get_checked`, `bucket_get_checked`) verify it and
+    /// return `ValueCorrupt` on mismatch. Each checksum is stored as a
+    /// companion entry, costing the key length plus 13 bytes per value.
+    pub value_checksums: bool,
+    /// Warn when a write transaction stays open longer than this.
+    ///
+    /// Enables a watchdog thread and captures each write transaction's
+    /// creation backtrace, which is included in the warning.
+    pub max_tx_duration: Option<std::time::Duration>,
+    /// Abort write transactions that exceed `max_tx_duration`.
+    ///
+    /// An aborted transaction's commit fails with `TxTimedOut` and its
+    /// changes are discarded.
+    pub abort_long_tx: bool,
+    /// Cap on the bytes a write transaction may stage, or `None` for no
+    /// cap.
+    ///
+    /// Counts the keys and values written and the keys deleted. A bucket
+    /// write that would take the transaction past the cap fails with
+    /// `TxTooLarge` without being staged, so the caller can commit what is
+    /// staged and continue in a new transaction. Top-level `put()` and
+    /// `delete()` cannot fail: they count towards the cap but are never
+    /// refused.
+    pub max_tx_size: Option<u64>,
+    /// Normalizes top-level keys for storage and lookup (e.g. to make
+    /// them case-insensitive). Must stay the same across opens.
+    ///
+    /// The original key is kept alongside each entry; normalized order
+    /// governs iteration. See the `normalize` module for details.
+    pub key_normalizer: Option<KeyNormalizer>,
+    /// Combines operands passed to `WriteTx::bucket_merge()` with existing
+    /// values. Without it, merges fail with `MergeOperatorMissing`.
+    ///
+    /// See the `merge` module for details.
+    pub merge_operator: Option<MergeOperator>,
+    /// Orders the keys within buckets; `None` orders them byte-wise.
+    /// Governs iteration, cursors and range scans over buckets.
+    ///
+    /// Not recorded in the file, so every open must use the comparator
+    /// the data was written with: opening with another is unsafe. See the
+    /// `comparator` module for details.
+    pub comparator: Option<KeyComparator>,
+    /// Compress inline entries in page-sized blocks.
+    ///
+    /// Helps most with many small keys and values, where compressing each
+    /// value alone is ineffective. See the `compress` module for the format.
+    pub page_compression: PageCompression,
+    /// Compress each inline value on its own.
+    ///
+    /// Suits larger, repetitive values such as JSON documents. The codec is
+    /// recorded with each value, so the setting can change between opens.
+    /// `page_compression` takes precedence when both are enabled. See the
+    /// `compress` module for the format.
+    pub value_compression: ValueCompression,
+    /// Values shorter than this are stored uncompressed, since compressing
+    /// them rarely pays for the header.
+    pub value_compression_min_size: usize,
+    /// Encrypt new databases with this key, and open encrypted ones.
+    ///
+    /// Opening an encrypted database with a different key, or without one,
+    /// fails with `InvalidKey`. Cannot be combined with `wal_enabled`. See
+    /// the `encrypt` module for details.
+    pub encryption_key: Option<EncryptionKey>,
+    /// Keep every committed version for this long to serve as-of reads.
+    ///
+    /// Versions share the tree copy-on-write, so each commit inside the
+    /// window can hold a full copy of the tree in memory. See the
+    /// `retention` module for details.
+    pub retain_duration: Option<std::time::Duration>,
+    /// External sink receiving a record of every committed transaction.
+    ///
+    /// Records are written and flushed before `commit()` returns. See the
+    /// `audit` module for the ordering guarantees and record format.
+    pub audit_writer: Option<AuditWriter>,
+    /// Compact automatically once buckets fragment past their priority's
+    /// threshold.
+    ///
+    /// See the `compaction` module for details.
+    pub auto_compaction: Option<AutoCompactionConfig>,
+    /// Purge expired entries at most this often. Commits purge once the
+    /// interval has passed, as does a `BackgroundCommitter` while idle.
+    /// `None` leaves expired entries until `purge_expired()` is called.
+    ///
+    /// See the `expiry` module for details.
+    pub expiry_interval: Option<std::time::Duration>,
+    /// Refuse commits while the file is in an older format.
+    ///
+    /// See the `upgrade` module for details.
+    pub require_upgrade: bool,
+    /// How long a commit waits for a freeze to end before failing with
+    /// `FreezeTimedOut`. `None` waits indefinitely.
+    ///
+    /// See the `freeze` module for details.
+    pub freeze_timeout: Option<std::time::Duration>,
+    /// Report top-level lookups and range seeks taking at least this long
+    /// to `on_slow_read`.
+    ///
+    /// See the `slow_read` module for what is timed and what it costs.
+    pub slow_read_threshold: Option<std::time::Duration>,
+    /// Receives reads slower than `slow_read_threshold`.
+    pub on_slow_read: Option<SlowReadHook>,
+    /// Verify on-disk checksums in the background, starting a pass this
+    /// often. `None` disables scrubbing.
+    ///
+    /// See the `scrub` module for what is verified.
+    pub scrub_interval: Option<std::time::Duration>,
+    /// Most bytes per second the scrubber reads; 0 reads unthrottled.
+    pub scrub_bytes_per_sec: u64,
+    /// Receives corruption found by the scrubber. Without it, corruption
+    /// is logged.
+    pub on_scrub_error: Option<ScrubErrorHook>,
+    /// Skip syncing the data file when committing.
+    ///
+    /// Commits become much faster, but are only durable once something
+    /// syncs the file: `Database::sync()`, a commit made after
+    /// `set_no_sync(false)`, or the operating system flushing on its own.
+    /// A crash or power loss can lose every commit since the last sync;
+    /// the dual meta pages keep the file openable, but a torn write may
+    /// leave it at any of those commits or fail its checksums. Meant for
+    /// bulk imports that can be redone from scratch. The WAL follows
+    /// `wal_sync_policy` regardless.
+    pub no_sync: bool,
+    /// Hold an exclusive lock on the file for as long as this handle is
+    /// open.
+    ///
+    /// By default, handles on the same file, in this process or others,
+    /// share it, and take the lock only while writing. An exclusive handle
+    /// takes the lock at open and keeps it, so every other handle waits for
+    /// it to close before opening the file or writing to it.
+    pub exclusive: bool,
+    /// How long to wait for the file lock before failing with
+    /// `LockTimedOut`. `None` waits indefinitely.
+    pub lock_timeout: Option<std::time::Duration>,
+    /// Open an existing database for reading only, alongside handles that
+    /// write to it.
+    ///
+    /// Every write to the file takes the exclusive file lock, and a
+    /// read-only handle loads the committed state under a shared one, so
+    /// it always sees a complete commit, never part of one being written.
+    /// The state is the one committed when the handle opened, and stays
+    /// that way until [`Database::refresh()`] loads the latest commit;
+    /// reads never see a commit made in between. While an `exclusive`
+    /// handle is open, opening and refreshing wait for it to close, up to
+    /// `lock_timeout`.
+    ///
+    /// Commits and other writes through the handle fail with `ReadOnly`.
+    /// The file is not created if missing, the WAL is not replayed, and
+    /// `exclusive` does not apply. A compaction by another handle replaces
+    /// the file; handles opened before it keep reading the old one until
+    /// reopened.
+    pub read_only: bool,
+    /// How free overflow pages are indexed for reuse.
+    ///
+    /// `Array` uses the least memory; `HashMap` keeps runs of adjacent free
+    /// pages indexed, so large values find space quickly on a long,
+    /// fragmented freelist. Free pages are tracked in memory only, so the
+    /// type can differ between opens without rewriting the file. See the
+    /// [`freelist`](crate::freelist) module for the trade-offs.
+    pub freelist_type: FreelistType,
+    /// Bytes of the file to map at open, ahead of the file's growth.
+    ///
+    /// `Database::mmap_slice()` reads through a memory mapping of the file,
+    /// which is remapped larger whenever a commit grows the file past it:
+    /// doubled while under 1 GiB, then in 1 GiB steps. Each remap unmaps
+    /// and maps the file again, so a large import can stall on several.
+    /// Mapping the expected size up front avoids them; only address space
+    /// is reserved, and the file itself does not grow. 0 maps the file's
+    /// current length. Ignored on platforms without mmap.
+    pub initial_mmap_size: usize,
+    /// Fails a chosen write or sync of the database file, for crash
+    /// testing. See [`FaultInjector`](crate::failpoint::FaultInjector).
+    #[cfg(feature = "failpoint")]
+    pub fault_injector: Option<crate::failpoint::FaultInjector>,
 }
 
 impl Default for DatabaseOptions {
@@ -85,6 +304,38 @@ impl Default for DatabaseOptions {
             wal_segment_size: 64 * 1024 * 1024,          // 64MB
             checkpoint_interval_secs: 300,               // 5 minutes
             checkpoint_wal_threshold: 128 * 1024 * 1024, // 128MB
+            logger: Logger::default(),
+            detect_tx_leaks: false,
+            value_checksums: false,
+            max_tx_duration: None,
+            abort_long_tx: false,
+            max_tx_size: None,
+            key_normalizer: None,
+            merge_operator: None,
+            comparator: None,
+            page_compression: PageCompression::None,
+            value_compression: ValueCompression::None,
+            value_compression_min_size: DEFAULT_VALUE_COMPRESSION_MIN_SIZE,
+            encryption_key: None,
+            retain_duration: None,
+            audit_writer: None,
+            auto_compaction: None,
+            expiry_interval: None,
+            require_upgrade: false,
+            freeze_timeout: None,
+            slow_read_threshold: None,
+            on_slow_read: None,
+            scrub_interval: None,
+            scrub_bytes_per_sec: DEFAULT_SCRUB_BYTES_PER_SEC,
+            on_scrub_error: None,
+            no_sync: false,
+            exclusive: false,
+            lock_timeout: None,
+            read_only: false,
+            freelist_type: FreelistType::default(),
+            initial_mmap_size: 0,
+            #[cfg(feature = "failpoint")]
+            fault_injector: None,
         }
     }
 }
@@ -104,6 +355,7 @@ impl DatabaseOptions {
             wal_segment_size: 64 * 1024 * 1024,
             checkpoint_interval_secs: 300,
             checkpoint_wal_threshold: 128 * 1024 * 1024,
+            ..Self::default()
         }
     }
 
@@ -128,6 +380,7 @@ impl DatabaseOptions {
             wal_segment_size: 64 * 1024 * 1024,
             checkpoint_interval_secs: 300,
             checkpoint_wal_threshold: 128 * 1024 * 1024,
+            ..Self::default()
         }
     }
 
@@ -142,6 +395,28 @@ impl DatabaseOptions {
     }
 }
 
+/// Sizes of the database file and its memory mapping.
+///
+/// Returned by [`Database::info()`].
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct DatabaseInfo {
+    /// Bytes of the file that are mapped; 0 when nothing is mapped.
+    pub mmap_size: usize,
+    /// Length of the database file in bytes.
+    pub data_size: u64,
+    /// Number of times the mapping has been grown since the database was
+    /// opened.
+    pub remaps: u64,
+}
+
+impl DatabaseInfo {
+    /// Returns how many more bytes the file can grow before the mapping
+    /// must be remapped.
+    pub fn mmap_headroom(&self) -> u64 {
+        (self.mmap_size as u64).saturating_sub(self.data_size)
+    }
+}
+
 /// The main database handle.
 ///
 /// A `Database` represents an open connection to a thunder database file.
@@ -169,9 +444,18 @@ pub struct Database {
     /// Used for efficient read access to committed data.
     #[cfg(unix)]
     mmap: Option<Mmap>,
+    /// Length of the file when it was last mapped; bytes of the mapping
+    /// past it are not backed by the file.
+    #[cfg(unix)]
+    mapped_file_len: usize,
+    /// Number of times the mapping has been grown since open.
+    #[cfg(unix)]
+    mmap_remaps: u64,
     /// Bloom filter for fast negative lookups.
     /// Returns false = definitely not present, true = possibly present.
     bloom: BloomFilter,
+    /// Bloom filters of the buckets that enabled one.
+    bucket_blooms: BucketBlooms,
     /// Effective page size for this database.
     page_size: usize,
     /// Database options.
@@ -180,6 +464,8 @@ pub struct Database {
     overflow_manager: OverflowManager,
     /// Maps keys to their overflow references (for large values).
     overflow_refs: std::collections::HashMap<Vec<u8>, OverflowRef>,
+    /// Seals the data section, if the file is encrypted.
+    cipher: Option<Cipher>,
     // Phase 4: WAL & Checkpoint fields
     /// Write-ahead log (if enabled).
     wal: Option<Wal>,
@@ -191,6 +477,42 @@ pub struct Database {
     /// Maps snapshot IDs to their tree states for explicit snapshot API.
     explicit_snapshots:
         std::collections::HashMap<crate::snapshot::SnapshotId, std::sync::Arc<BTree>>,
+    /// Whether open found the database still marked open by a previous handle.
+    was_recovered: bool,
+    /// Tracks open write transactions when `max_tx_duration` is set.
+    tx_monitor: TxMonitor,
+    /// Committed versions kept for as-of reads when `retain_duration` is set.
+    versions: Option<VersionHistory>,
+    /// Publishes the committed version to waiting threads.
+    version_watch: VersionWatch,
+    /// Watches notified of committed changes.
+    watchers: Watchers,
+    /// Publishes committed versions to read handles on other threads.
+    read_handle: ReadHandle,
+    /// Commits since auto-compaction last checked fragmentation.
+    commits_since_compaction_check: u64,
+    /// The most recent compaction started by auto-compaction.
+    last_auto_compaction: Option<AutoCompaction>,
+    /// When expired entries were last purged for `expiry_interval`.
+    last_expiry_purge: std::time::Instant,
+    /// Records live statistics.
+    stats: StatsCollector,
+    /// Holds commits while the database is frozen.
+    freeze_gate: FreezeGate,
+    /// The lock held for the handle's lifetime when `exclusive` is set.
+    file_lock: Option<FileLockGuard>,
+    /// Number of nested writes in progress; the outermost takes the file
+    /// lock.
+    write_depth: std::sync::Arc<std::sync::atomic::AtomicUsize>,
+    /// Tells the scrubber thread what to verify, when `scrub_interval` is
+    /// set.
+    scrubber: Option<Scrubber>,
+    /// Whether commits have written since the data file was last synced.
+    unsynced: std::sync::atomic::AtomicBool,
+    /// The file contents as of the last sync, tracked to simulate losing
+    /// unsynced writes in a crash.
+    #[cfg(feature = "failpoint")]
+    durable_image: std::sync::Mutex<Option<Vec<u8>>>,
 }
 
 impl Database {
@@ -217,17 +539,25 @@ impl Database {
     /// - The file cannot be opened or created
     /// - The database file is corrupted
     /// - Page size mismatch (existing database has different page size than expected)
+    /// - The file was written by a newer release (`IncompatibleVersion`)
     pub fn open_with_options<P: AsRef<Path>>(path: P, options: DatabaseOptions) -> Result<Self> {
         let path = path.as_ref();
         let path_buf = path.to_path_buf();
 
+        // The WAL would hold values in the clear.
+        if options.encryption_key.is_some() && options.wal_enabled {
+            return Err(Error::EncryptionUnsupported {
+                feature: "write-ahead logging",
+            });
+        }
+
         // Check if file exists to determine if we need to initialize.
         let file_exists = path.exists();
 
-        let mut file = match OpenOptions::new()
+        let file = match OpenOptions::new()
             .read(true)
-            .write(true)
-            .create(true)
+            .write(!options.read_only)
+            .create(!options.read_only)
             .truncate(false)
             .open(path)
         {
@@ -239,6 +569,90 @@ impl Database {
                 });
             }
         };
+        Self::open_file(file, path_buf, file_exists, options)
+    }
+
+    /// Opens a database that lives only in memory.
+    ///
+    /// Supports the same transactions, buckets, and cursors as a file-backed
+    /// database, and the data is discarded when the database is closed or
+    /// dropped. Useful for tests and ephemeral caches.
+    ///
+    /// On Linux the database is backed by an anonymous memory file and
+    /// nothing touches the filesystem. Other platforms fall back to a file
+    /// in the system temporary directory, unlinked as soon as it is open
+    /// where the platform allows it, so the data may be written to disk.
+    ///
+    /// # Errors
+    ///
+    /// Returns an error if the anonymous backing file cannot be created.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let mut db = Database::open_in_memory()?;
+    /// db.update(|wtx| {
+    ///     wtx.put(b"key", b"value");
+    ///     Ok(())
+    /// })?;
+    /// ```
+    pub fn open_in_memory() -> Result<Self> {
+        Self::open_in_memory_with_options(DatabaseOptions::default())
+    }
+
+    /// Opens a database that lives only in memory, with custom options.
+    ///
+    /// # Errors
+    ///
+    /// Returns `InMemoryUnsupported` if `options` enable something that
+    /// needs a file on disk: write-ahead logging, scrubbing,
+    /// auto-compaction, or read-only mode.
+    pub fn open_in_memory_with_options(options: DatabaseOptions) -> Result<Self> {
+        let unsupported = if options.wal_enabled {
+            Some("write-ahead logging")
+        } else if options.scrub_interval.is_some() {
+            Some("scrubbing")
+        } else if options.auto_compaction.is_some() {
+            Some("auto-compaction")
+        } else if options.read_only {
+            Some("read-only mode")
+        } else {
+            None
+        };
+        if let Some(feature) = unsupported {
+            return Err(Error::InMemoryUnsupported { feature });
+        }
+        Self::open_file(anonymous_file()?, PathBuf::new(), false, options)
+    }
+
+    /// Returns true if the database was opened with
+    /// [`open_in_memory()`](Self::open_in_memory).
+    pub fn is_in_memory(&self) -> bool {
+        self.path.as_os_str().is_empty()
+    }
+
+    /// Loads or initializes the database held in `file`.
+    ///
+    /// `path_buf` is empty for an in-memory database.
+    fn open_file(
+        mut file: File,
+        path_buf: PathBuf,
+        file_exists: bool,
+        options: DatabaseOptions,
+    ) -> Result<Self> {
+        // Taken before reading, so an exclusive handle never loads a file
+        // another one is writing.
+        let file_lock = if options.exclusive && !options.read_only {
+            Some(FileLockGuard::acquire(&file, options.lock_timeout)?)
+        } else {
+            None
+        };
+        // A read-only handle only needs writers kept out while it loads.
+        let load_lock = if options.read_only {
+            Some(FileLockGuard::acquire_shared(&file, options.lock_timeout)?)
+        } else {
+            None
+        };
 
         let file_len = match file.metadata() {
             Ok(m) => m.len(),
@@ -258,6 +672,7 @@ impl Database {
             bloom,
             page_size,
             overflow_refs,
+            cipher,
         ) = if file_exists && file_len > 0 {
             // Existing database: read and validate meta pages, load data.
             let meta = Self::load_meta(&mut file, &path_buf)?;
@@ -280,11 +695,15 @@ impl Database {
                 });
             }
 
+            // Fail on a wrong key before reading any data.
+            let cipher = encrypt::open_cipher(&meta, options.encryption_key.as_ref())?;
+
             let (tree, data_end, count, bloom, overflow_refs) = Self::load_tree(
                 &mut file,
                 &meta,
                 stored_page_size,
-                options.overflow_threshold,
+                options.comparator.as_ref(),
+                cipher.as_ref(),
             )?;
             (
                 meta,
@@ -294,33 +713,49 @@ impl Database {
                 bloom,
                 stored_page_size,
                 overflow_refs,
+                cipher,
             )
+        } else if options.read_only {
+            return Err(Error::BothMetaPagesInvalid);
         } else {
             // New database: initialize with two meta pages.
             let page_size = options.page_size.as_usize();
-            let meta = Self::init_db(&mut file, &path_buf, page_size)?;
+            let meta = Self::init_db(
+                &mut file,
+                &path_buf,
+                page_size,
+                options.encryption_key.as_ref(),
+            )?;
+            let cipher = encrypt::open_cipher(&meta, options.encryption_key.as_ref())?;
             let data_offset = 2 * PAGE_SIZE as u64 + 8; // After meta pages + entry count
             let bloom = BloomFilter::new(DEFAULT_BLOOM_EXPECTED_KEYS, DEFAULT_BLOOM_FP_RATE);
             (
                 meta,
-                BTree::new(),
+                BTree::with_comparator(options.comparator.clone()),
                 data_offset,
                 0,
                 bloom,
                 page_size,
                 std::collections::HashMap::new(),
+                cipher,
             )
         };
 
+        drop(load_lock);
+
         // Calculate next page ID for overflow manager
         let next_overflow_page = Self::calculate_next_overflow_page(data_end_offset, page_size);
 
         // Initialize mmap for efficient read access (Unix only).
         #[cfg(unix)]
-        let mmap = Self::init_mmap(&file);
+        let (mmap, mapped_file_len) = Self::init_mmap(&file, options.initial_mmap_size);
 
         // Initialize WAL if enabled
-        let (wal, checkpoint_manager) = if options.wal_enabled {
+        // A set open flag means the previous handle never closed cleanly.
+        // Read-only handles share the file with open writers, which set it.
+        let was_recovered = meta.flags & Meta::FLAG_OPEN != 0 && !options.read_only;
+
+        let (wal, checkpoint_manager) = if options.wal_enabled && !options.read_only {
             let wal_dir = options.wal_dir.clone().unwrap_or_else(|| {
                 let mut wal_path = path_buf.clone();
                 wal_path.set_extension("wal");
@@ -402,25 +837,138 @@ impl Database {
             }
         }
 
-        Ok(Self {
+        let tx_monitor = TxMonitor::new();
+        if let Some(limit) = options.max_tx_duration {
+            tx_monitor.spawn_watchdog(limit, options.abort_long_tx, &options.logger);
+        }
+
+        let scrubber = options.scrub_interval.map(|interval| {
+            let scrubber = Scrubber::default();
+            scrubber.spawn(ScrubConfig {
+                path: path_buf.clone(),
+                page_size,
+                interval,
+                bytes_per_sec: options.scrub_bytes_per_sec,
+                hook: options.on_scrub_error.clone(),
+                logger: options.logger.clone(),
+            });
+            scrubber
+        });
+
+        let bucket_blooms = BucketBlooms::build(&tree);
+        let tree = std::sync::Arc::new(tree);
+        let versions = options.retain_duration.map(|retain| {
+            let mut history = VersionHistory::new(retain);
+            history.record(SystemTime::now(), std::sync::Arc::clone(&tree));
+            history
+        });
+
+        let snapshot_manager = std::sync::Arc::new(crate::snapshot::SnapshotManager::new());
+        let mut db = Self {
             path: path_buf,
             file,
             meta,
-            tree: std::sync::Arc::new(tree),
+            tree,
             data_end_offset,
             persisted_entry_count,
             #[cfg(unix)]
             mmap,
+            #[cfg(unix)]
+            mapped_file_len,
+            #[cfg(unix)]
+            mmap_remaps: 0,
             bloom,
+            bucket_blooms,
             page_size,
+            overflow_manager: OverflowManager::new(page_size, next_overflow_page)
+                .with_freelist(options.freelist_type),
             options,
-            overflow_manager: OverflowManager::new(page_size, next_overflow_page),
             overflow_refs,
+            cipher,
             wal,
             checkpoint_manager,
-            snapshot_manager: std::sync::Arc::new(crate::snapshot::SnapshotManager::new()),
+            read_handle: ReadHandle::new(std::sync::Arc::clone(&snapshot_manager)),
+            snapshot_manager,
             explicit_snapshots: std::collections::HashMap::new(),
-        })
+            was_recovered,
+            tx_monitor,
+            versions,
+            version_watch: VersionWatch::default(),
+            watchers: Watchers::default(),
+            commits_since_compaction_check: 0,
+            last_auto_compaction: None,
+            last_expiry_purge: std::time::Instant::now(),
+            stats: StatsCollector::default(),
+            freeze_gate: FreezeGate::default(),
+            file_lock,
+            write_depth: std::sync::Arc::default(),
+            scrubber,
+            unsynced: std::sync::atomic::AtomicBool::new(false),
+            #[cfg(feature = "failpoint")]
+            durable_image: std::sync::Mutex::new(None),
+        };
+        db.publish_scrub_targets();
+        if file_exists && file_len > 0 {
+            db.stats.record_read(db.loaded_bytes());
+        }
+
+        // Mark the database open until close() clears the flag again.
+        if !db.options.read_only {
+            db.meta.flags |= Meta::FLAG_OPEN;
+            db.sync_meta_flags()?;
+        }
+        db.version_watch.advance(db.meta.txid);
+        db.refresh_stats();
+
+        Ok(db)
+    }
+
+    /// Closes the database cleanly.
+    ///
+    /// Syncs the WAL (if enabled) and clears the open flag in the meta
+    /// page. Dropping the database does the same but ignores errors; call
+    /// `close()` to see them.
+    ///
+    /// # Errors
+    ///
+    /// Returns an error if the WAL or meta page cannot be synced.
+    pub fn close(mut self) -> Result<()> {
+        self.clear_open_flag()?;
+        if self.options.read_only {
+            return Ok(());
+        }
+        self.sync()
+    }
+
+    /// Syncs the WAL and clears the open flag set at open, if it is set.
+    ///
+    /// Rewrites the meta page as last committed on disk rather than as
+    /// held in memory, which a commit that failed partway may have
+    /// advanced, so this never changes the committed state.
+    fn clear_open_flag(&mut self) -> Result<()> {
+        if self.options.read_only || self.meta.flags & Meta::FLAG_OPEN == 0 {
+            return Ok(());
+        }
+        if let Some(wal) = &mut self.wal {
+            wal.sync()?;
+        }
+        let _lock = self.write_lock()?;
+        let mut meta = Self::load_meta(&mut self.file, &self.path)?;
+        meta.flags &= !Meta::FLAG_OPEN;
+        self.meta = meta;
+        self.write_meta_page()
+    }
+
+    /// Returns true if open detected an unclean shutdown.
+    ///
+    /// This is the case when the previous handle was not closed or
+    /// dropped, because the process crashed, was killed, or panicked while
+    /// the handle was in use. Recovery
+    /// (meta page selection and WAL replay) has already run by the time
+    /// this returns.
+    #[inline]
+    pub fn was_recovered(&self) -> bool {
+        self.was_recovered
     }
 
     /// Calculates the next available page ID for overflow pages.
@@ -431,37 +979,52 @@ impl Database {
         data_end_offset.div_ceil(page_size_u64) + 1
     }
 
-    /// Initializes the memory mapping for the database file.
+    /// Initializes the memory mapping for the database file, returning it
+    /// with the file length it covers.
+    ///
+    /// Maps at least `initial_size` bytes; otherwise the file is mapped
+    /// only once it holds data beyond the meta pages.
     #[cfg(unix)]
-    fn init_mmap(file: &File) -> Option<Mmap> {
-        let file_len = file.metadata().ok()?.len() as usize;
-        // Only mmap if file has data beyond meta pages
-        if file_len > 2 * PAGE_SIZE {
-            Mmap::new(file, file_len).ok()
+    fn init_mmap(file: &File, initial_size: usize) -> (Option<Mmap>, usize) {
+        let Ok(metadata) = file.metadata() else {
+            return (None, 0);
+        };
+        let file_len = metadata.len() as usize;
+        if file_len > 2 * PAGE_SIZE || initial_size > 0 {
+            (Mmap::new(file, file_len.max(initial_size)).ok(), file_len)
         } else {
-            None
+            (None, file_len)
         }
     }
 
     /// Refreshes the memory mapping after file size changes.
     ///
     /// Uses lazy remapping: only remaps when the file has grown beyond
-    /// the current mapping, avoiding expensive syscalls on every commit.
+    /// the current mapping, growing it by [`mmap::grow_size()`] so that
+    /// steady growth remaps rarely.
     #[cfg(unix)]
     fn refresh_mmap(&mut self) -> Result<()> {
-        // Only check if we know the file has grown
-        // The caller knows the new size from the write operations
-        Ok(())
-    }
+        let file_len = self
+            .file
+            .metadata()
+            .map_err(|e| Error::FileMetadata {
+                path: self.path.clone(),
+                source: e,
+            })?
+            .len() as usize;
+        self.mapped_file_len = file_len;
 
-    /// Forces a refresh of the memory mapping with the new file length.
-    /// Call this when the file has grown and you need to read the new data.
-    #[cfg(unix)]
-    #[allow(dead_code)]
-    fn refresh_mmap_to_size(&mut self, new_len: usize) -> Result<()> {
-        let current_mmap_len = self.mmap.as_ref().map(|m| m.len()).unwrap_or(0);
-        if new_len > current_mmap_len && new_len > 2 * PAGE_SIZE {
-            self.mmap = Mmap::new(&self.file, new_len).ok();
+        let current = self.mmap.as_ref().map_or(0, Mmap::len);
+        if file_len <= current || file_len <= 2 * PAGE_SIZE {
+            return Ok(());
+        }
+        let size = mmap::grow_size(current, file_len).max(self.options.initial_mmap_size);
+        // The mapping only speeds up reads; keep the old one if it fails.
+        if let Ok(mapping) = Mmap::new(&self.file, size) {
+            self.mmap = Some(mapping);
+            if current > 0 {
+                self.mmap_remaps += 1;
+            }
         }
         Ok(())
     }
@@ -481,7 +1044,8 @@ impl Database {
         let mmap = self.mmap.as_ref()?;
         let start = offset as usize;
         let end = start.checked_add(len)?;
-        if end <= mmap.len() {
+        // Pages mapped past the end of the file fault when read.
+        if end <= mmap.len().min(self.mapped_file_len) {
             Some(&mmap.as_slice()[start..end])
         } else {
             None
@@ -500,95 +1064,624 @@ impl Database {
         self.page_size
     }
 
-    /// Returns the overflow threshold for this database.
-    #[inline]
-    pub fn overflow_threshold(&self) -> usize {
-        self.options.overflow_threshold
+    /// Returns the page holding the persisted entry for an internal key,
+    /// and the entry's byte offset within that page.
+    ///
+    /// Entries in a compressed block report the block's position. Returns
+    /// `None` if the key has no persisted entry.
+    pub(crate) fn entry_location(&self, key: &[u8]) -> Result<Option<(PageId, usize)>> {
+        let page_size = self.page_size as u64;
+        let mut found = None;
+        // Later entries supersede earlier ones, so keep the last match.
+        layout::scan_entries(
+            &self.file,
+            2 * PAGE_SIZE as u64 + 8,
+            self.data_end_offset,
+            self.cipher.as_ref(),
+            |pos, entry_key| {
+                if entry_key == key {
+                    found = Some((pos.offset / page_size, (pos.offset % page_size) as usize));
+                }
+            },
+        )?;
+        Ok(found)
     }
 
-    /// Initializes a new database file with two meta pages.
-    fn init_db(file: &mut File, path: &std::path::PathBuf, page_size: usize) -> Result<Meta> {
-        let meta = Meta::with_page_size(page_size as u32);
-        let meta_bytes = meta.to_bytes();
-
-        // Seek to beginning of file.
-        if let Err(e) = file.seek(SeekFrom::Start(0)) {
-            return Err(Error::FileSeek {
-                offset: 0,
-                context: "initializing database, seeking to start",
+    /// Describes a page of the database file for layout analysis.
+    ///
+    /// Scans the data section, so this costs a full pass over the entries.
+    /// See the [`layout`](crate::layout) module for how pages are classified.
+    ///
+    /// Returns `None` if the page lies past the end of the file.
+    ///
+    /// # Errors
+    ///
+    /// Returns an error if the data section cannot be read or is corrupted.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let (page_id, _) = db.read_tx().page_of(b"key")?.unwrap();
+    /// let info = db.page_info(page_id)?.unwrap();
+    /// println!("{:?} page with {} keys", info.page_type, info.key_count);
+    /// ```
+    pub fn page_info(&self, page_id: PageId) -> Result<Option<PageInfo>> {
+        let page_size = self.page_size as u64;
+        let file_len = self
+            .file
+            .metadata()
+            .map_err(|e| Error::FileMetadata {
+                path: self.path.clone(),
                 source: e,
-            });
+            })?
+            .len();
+        let page_start = page_id.saturating_mul(page_size);
+        if page_start >= file_len {
+            return Ok(None);
         }
 
-        // Write meta page 0.
-        if let Err(e) = file.write_all(&meta_bytes) {
-            return Err(Error::FileWrite {
-                offset: 0,
-                len: PAGE_SIZE,
-                context: "writing initial meta page 0",
-                source: e,
-            });
+        let data_offset = 2 * PAGE_SIZE as u64;
+        let page_end = page_start + page_size;
+        let mut info = PageInfo {
+            page_id,
+            page_type: PageType::Overflow,
+            key_count: 0,
+            compressed: false,
+        };
+        if page_start < data_offset {
+            info.page_type = PageType::Meta;
+        } else if page_start < self.data_end_offset {
+            info.page_type = PageType::Leaf;
+            layout::scan_entries(
+                &self.file,
+                data_offset + 8,
+                self.data_end_offset,
+                self.cipher.as_ref(),
+                |pos, _| {
+                    if (page_start..page_end).contains(&pos.offset) {
+                        info.key_count += 1;
+                        info.compressed |= pos.compressed;
+                    }
+                },
+            )?;
         }
+        Ok(Some(info))
+    }
 
-        // Write meta page 1 (identical initially).
-        if let Err(e) = file.write_all(&meta_bytes) {
-            return Err(Error::FileWrite {
-                offset: PAGE_SIZE as u64,
-                len: PAGE_SIZE,
-                context: "writing initial meta page 1",
+    /// Classifies every byte of the database file, for capacity audits.
+    ///
+    /// Returns contiguous byte ranges, in file order, covering the whole
+    /// file: meta pages, live entries and overflow values attributed to
+    /// their top-level bucket, compressed blocks, and free space. The map
+    /// reflects the committed state, which cannot change while it is built.
+    /// See the [`layout`](crate::layout) module for how space is classified.
+    ///
+    /// Scans the data section and follows every overflow value, so this
+    /// costs a full pass over the file.
+    ///
+    /// # Errors
+    ///
+    /// Returns an error if the file cannot be read or is corrupted.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let mut footprint: HashMap<Vec<u8>, u64> = HashMap::new();
+    /// for range in db.allocation_map()? {
+    ///     if let AllocationKind::Entries { bucket: Some(name) }
+    ///     | AllocationKind::Overflow { bucket: Some(name) } = range.kind
+    ///     {
+    ///         *footprint.entry(name).or_default() += range.size();
+    ///     }
+    /// }
+    /// ```
+    pub fn allocation_map(&self) -> Result<Vec<AllocationRange>> {
+        let file_len = self
+            .file
+            .metadata()
+            .map_err(|e| Error::FileMetadata {
+                path: self.path.clone(),
                 source: e,
-            });
-        }
+            })?
+            .len();
+        layout::allocation_map(
+            &self.file,
+            self.page_size,
+            self.data_end_offset,
+            file_len,
+            &self.tree,
+            &self.overflow_refs,
+            self.cipher.as_ref(),
+        )
+    }
 
-        // Ensure data is persisted to disk.
-        if let Err(e) = file.sync_all() {
-            return Err(Error::FileSync {
-                context: "syncing initial meta pages",
-                source: e,
-            });
-        }
+    /// Verifies the integrity of the database, returning every problem found.
+    ///
+    /// Checks the meta pages, walks the data section, verifies the location
+    /// and checksum of every live overflow value, checks that no page is
+    /// both free and reachable, and checks the ordering of the tree. An
+    /// empty result means the database is sound. See the
+    /// [`check`](crate::check) module for what is verified.
+    ///
+    /// Reads the whole file, so this costs a full pass over it. Problems
+    /// are returned rather than stopping the check, so a damaged database
+    /// is described in full.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let db = Database::open("restored.db")?;
+    /// let problems = db.check();
+    /// for problem in &problems {
+    ///     eprintln!("integrity check: {problem}");
+    /// }
+    /// assert!(problems.is_empty(), "refusing to use a damaged restore");
+    /// ```
+    pub fn check(&self) -> Vec<Error> {
+        let file_len = match self.file.metadata() {
+            Ok(metadata) => metadata.len(),
+            Err(e) => {
+                return vec![Error::FileMetadata {
+                    path: self.path.clone(),
+                    source: e,
+                }];
+            }
+        };
+        let free_pages = self.overflow_manager.free_pages();
+        check::check(&CheckTarget {
+            file: &self.file,
+            page_size: self.page_size,
+            has_data: self.meta.root != 0,
+            data_end: self.data_end_offset,
+            file_len,
+            tree: &self.tree,
+            overflow_refs: &self.overflow_refs,
+            free_pages: &free_pages,
+            cipher: self.cipher.as_ref(),
+        })
+    }
 
-        // Log successful initialization (only in debug builds).
-        #[cfg(debug_assertions)]
-        {
-            eprintln!("[thunder] initialized new database at '{}'", path.display());
-        }
-        let _ = path; // Suppress unused warning in release.
+    /// Merges adjacent free overflow pages into runs that large values can
+    /// reuse.
+    ///
+    /// Freed pages are tracked one at a time, so a value needing several
+    /// contiguous pages grows the file even when enough adjacent pages are
+    /// free. This reorders the free list so later large allocations take
+    /// the lowest long-enough run first. No live data moves, so it is much
+    /// cheaper than [`compact()`](Self::compact) when only allocation
+    /// locality is the problem.
+    ///
+    /// Returns the number of runs of two or more adjacent free pages.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let runs = db.defragment_freelist();
+    /// println!("{runs} reusable runs of free pages");
+    /// ```
+    pub fn defragment_freelist(&mut self) -> usize {
+        self.overflow_manager.coalesce_free_pages()
+    }
 
-        Ok(meta)
+    /// Returns a handle for inspecting open write transactions.
+    ///
+    /// Unlike the database itself, the handle can be queried from another
+    /// thread while a write transaction is open.
+    pub fn tx_monitor(&self) -> TxMonitor {
+        self.tx_monitor.clone()
     }
 
-    /// Loads and validates meta pages from an existing database file.
-    fn load_meta(file: &mut File, _path: &std::path::PathBuf) -> Result<Meta> {
-        let mut buf = [0u8; PAGE_SIZE];
+    /// Returns the age and creation stack of the oldest open write transaction.
+    ///
+    /// Only tracked when `max_tx_duration` is set; returns `None` otherwise
+    /// or when no write transaction is open.
+    pub fn longest_open_tx(&self) -> Option<(std::time::Duration, String)> {
+        self.tx_monitor.longest_open_tx()
+    }
 
-        // Seek to meta page 0.
-        if let Err(e) = file.seek(SeekFrom::Start(0)) {
-            return Err(Error::FileSeek {
-                offset: 0,
-                context: "seeking to meta page 0",
-                source: e,
-            });
-        }
+    /// Returns the committed version.
+    ///
+    /// This is the txid of the most recently written meta page; every
+    /// successful commit advances it.
+    #[inline]
+    pub fn version(&self) -> u64 {
+        self.meta.txid
+    }
 
-        // Read meta page 0.
-        if let Err(e) = file.read_exact(&mut buf) {
-            return Err(Error::FileRead {
-                offset: 0,
-                len: PAGE_SIZE,
-                context: "reading meta page 0",
-                source: e,
-            });
+    /// Reports how much of each internal counter has been used.
+    ///
+    /// See the [`capacity`](crate::capacity) module.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let report = db.capacity();
+    /// if report.is_low() {
+    ///     alert(format!("thunder counters nearly exhausted: {report:?}"));
+    /// }
+    /// ```
+    pub fn capacity(&self) -> CapacityReport {
+        let page_size = self.page_size as u64;
+        let file_pages = self
+            .file
+            .metadata()
+            .map_or(0, |m| m.len())
+            .div_ceil(page_size);
+        let page_id = file_pages
+            .max(self.overflow_manager.next_page_id())
+            .saturating_sub(1);
+        let sequence = bucket::list_buckets(&self.tree)
+            .iter()
+            .filter_map(|name| self.tree.get(&bucket::bucket_meta_key(name)))
+            .filter_map(bucket::decode_key_limit)
+            .map(|(_, next_seq)| next_seq)
+            .max()
+            .unwrap_or(0);
+        CapacityReport {
+            version: self.meta.txid,
+            max_version: u64::MAX,
+            page_id,
+            max_page_id: u64::MAX / page_size,
+            sequence,
+            max_sequence: u64::MAX,
         }
-        let meta0 = Meta::from_bytes(&buf);
+    }
 
-        // Seek to meta page 1.
-        let meta1_offset = PAGE_SIZE as u64;
-        if let Err(e) = file.seek(SeekFrom::Start(meta1_offset)) {
-            return Err(Error::FileSeek {
-                offset: meta1_offset,
-                context: "seeking to meta page 1",
-                source: e,
+    /// Reports the size of the file and of its memory mapping.
+    ///
+    /// The mapping grows as commits grow the file; watching its headroom
+    /// shows when `DatabaseOptions::initial_mmap_size` is too small to
+    /// avoid remaps.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let info = db.info();
+    /// println!("{} of {} mapped bytes used", info.data_size, info.mmap_size);
+    /// ```
+    pub fn info(&self) -> DatabaseInfo {
+        let data_size = self.file.metadata().map_or(0, |m| m.len());
+        #[cfg(unix)]
+        {
+            DatabaseInfo {
+                mmap_size: self.mmap.as_ref().map_or(0, Mmap::len),
+                data_size,
+                remaps: self.mmap_remaps,
+            }
+        }
+        #[cfg(not(unix))]
+        {
+            DatabaseInfo {
+                mmap_size: 0,
+                data_size,
+                remaps: 0,
+            }
+        }
+    }
+
+    /// Moves the next overflow page id, to exercise capacity reporting
+    /// without growing the file.
+    #[cfg(feature = "failpoint")]
+    pub fn set_next_page_id_for_testing(&mut self, page_id: PageId) {
+        self.overflow_manager.set_next_page_id(page_id);
+    }
+
+    /// Stamps the file with another format version, to exercise upgrades
+    /// and version checks without another release at hand.
+    #[cfg(feature = "failpoint")]
+    pub fn set_format_version_for_testing(&mut self, version: u32) -> Result<()> {
+        self.meta.version = version;
+        self.sync_meta_only()
+    }
+
+    /// Returns a handle for waiting until the committed version reaches a
+    /// target.
+    ///
+    /// Unlike the database itself, the handle can be used from another
+    /// thread while this one applies writes.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let watch = db.version_watch();
+    /// let reader = std::thread::spawn(move || watch.wait_for_version(target, timeout));
+    /// apply_replicated_writes(&mut db)?;
+    /// ```
+    pub fn version_watch(&self) -> VersionWatch {
+        self.version_watch.clone()
+    }
+
+    /// Watches committed changes to top-level keys starting with `prefix`.
+    ///
+    /// Returns a channel receiving an event for each change, in commit
+    /// order, and an [`Unwatch`] that ends the watch. With `buffer` set,
+    /// at most that many undelivered events are held and later ones are
+    /// dropped, leaving a gap in the event sequence numbers; without it,
+    /// no event is dropped. Commits never wait for a watcher. See the
+    /// [`watch`](crate::watch) module.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let (events, unwatch) = db.watch(b"config/", Some(1024));
+    /// std::thread::spawn(move || {
+    ///     for event in events {
+    ///         cache.invalidate(&event.key);
+    ///     }
+    /// });
+    /// ```
+    pub fn watch(&self, prefix: &[u8], buffer: Option<usize>) -> (Receiver<WatchEvent>, Unwatch) {
+        self.watchers.subscribe(None, prefix, buffer)
+    }
+
+    /// Watches committed changes to keys of `bucket` starting with
+    /// `prefix`.
+    ///
+    /// Event keys are given without the bucket prefix. The bucket need not
+    /// exist yet. See [`watch()`](Self::watch).
+    ///
+    /// # Errors
+    ///
+    /// Returns `InvalidBucketName` if the bucket name is invalid.
+    pub fn watch_bucket(
+        &self,
+        bucket: &[u8],
+        prefix: &[u8],
+        buffer: Option<usize>,
+    ) -> Result<(Receiver<WatchEvent>, Unwatch)> {
+        bucket::validate_bucket_name(bucket)?;
+        Ok(self.watchers.subscribe(Some(bucket), prefix, buffer))
+    }
+
+    /// Returns the watches notified of committed changes.
+    #[inline]
+    pub(crate) fn watchers(&self) -> &Watchers {
+        &self.watchers
+    }
+
+    /// Returns a handle for taking snapshots of the last committed version.
+    ///
+    /// Unlike the database itself, the handle can be used from other
+    /// threads while this one has a write transaction open; readers never
+    /// see its changes before it commits. See the
+    /// [`snapshot`](crate::snapshot) module for the isolation guarantees.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let handle = db.read_handle();
+    /// let reader = std::thread::spawn(move || handle.snapshot().get(b"config"));
+    /// let mut wtx = db.write_tx();
+    /// wtx.put(b"config", b"v2");
+    /// wtx.commit()?;
+    /// ```
+    pub fn read_handle(&self) -> ReadHandle {
+        self.read_handle.publish(Some(&self.tree), self.meta.txid);
+        self.read_handle.clone()
+    }
+
+    /// Publishes the committed tree to read handles, if any are held.
+    fn publish_read_view(&self) {
+        if self.read_handle.is_shared() {
+            self.read_handle.publish(Some(&self.tree), self.meta.txid);
+        } else {
+            // Release the last published tree so commits need not copy it.
+            self.read_handle.publish(None, self.meta.txid);
+        }
+    }
+
+    /// Flushes the committed state to disk and holds further commits until
+    /// the returned guard is released.
+    ///
+    /// Meant for taking filesystem snapshots of a consistent file: take
+    /// the snapshot while the guard is held. Commits attempted meanwhile
+    /// wait, up to `freeze_timeout`. See the [`freeze`](crate::freeze)
+    /// module for details.
+    ///
+    /// # Errors
+    ///
+    /// Returns an error if the file or the WAL cannot be synced; the
+    /// database is not frozen.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let freeze = db.freeze()?;
+    /// Command::new("zfs").args(["snapshot", "tank/db@nightly"]).status()?;
+    /// freeze.unfreeze();
+    /// ```
+    pub fn freeze(&mut self) -> Result<Freeze> {
+        if let Some(wal) = self.wal.as_mut() {
+            wal.sync()?;
+        }
+        Self::fdatasync(&self.file)?;
+        Ok(self.freeze_gate.freeze())
+    }
+
+    /// Returns whether a freeze is held.
+    pub fn is_frozen(&self) -> bool {
+        self.freeze_gate.is_frozen()
+    }
+
+    /// Returns the gate commits wait on while frozen.
+    #[inline]
+    pub(crate) fn freeze_gate(&self) -> &FreezeGate {
+        &self.freeze_gate
+    }
+
+    /// Returns a snapshot of the database's live statistics.
+    ///
+    /// See the [`stats`](crate::stats) module.
+    pub fn stats(&self) -> DatabaseStats {
+        self.stats.snapshot()
+    }
+
+    /// Returns a handle to the database's statistics.
+    ///
+    /// Like [`version_watch()`](Self::version_watch), the handle can be
+    /// read from another thread while this one uses the database.
+    pub fn stats_collector(&self) -> StatsCollector {
+        self.stats.clone()
+    }
+
+    /// Publishes the database's statistics under `name`.
+    ///
+    /// Shorthand for `stats::publish(name, db.stats_collector())`; the
+    /// stats then appear in [`stats::published_json()`] and
+    /// [`stats::published_prometheus()`].
+    ///
+    /// # Errors
+    ///
+    /// Returns `StatsNameTaken` if stats are already published under `name`.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// db.publish_stats("orders_db")?;
+    /// let body = thunderdb::stats::published_json();
+    /// // {"orders_db":{"file_size":...,"commits":...}}
+    /// ```
+    pub fn publish_stats(&self, name: &str) -> Result<()> {
+        stats::publish(name, self.stats.clone())
+    }
+
+    /// Returns the collector recording this database's statistics.
+    #[inline]
+    pub(crate) fn stats_recorder(&self) -> &StatsCollector {
+        &self.stats
+    }
+
+    /// Pauses the scrubber while the file is written.
+    fn begin_scrub_write(&self) {
+        if let Some(scrubber) = &self.scrubber {
+            scrubber.begin_write();
+        }
+    }
+
+    /// Hands the scrubber the overflow values of the committed state.
+    fn publish_scrub_targets(&self) {
+        if let Some(scrubber) = &self.scrubber {
+            scrubber.publish(self.overflow_refs.values().copied());
+        }
+    }
+
+    /// Updates the statistics gauges from the committed state.
+    fn refresh_stats(&self) {
+        let file_size = self.file.metadata().map_or(0, |m| m.len());
+        self.stats.set_gauges(
+            file_size,
+            self.loaded_bytes(),
+            file_size.div_ceil(self.page_size as u64),
+            self.overflow_manager.free_page_count() as u64,
+            self.tree.len() as u64,
+            self.meta.txid,
+        );
+    }
+
+    /// Returns the options this database was opened with.
+    #[inline]
+    pub(crate) fn options(&self) -> &DatabaseOptions {
+        &self.options
+    }
+
+    /// Returns the overflow threshold for this database.
+    #[inline]
+    pub fn overflow_threshold(&self) -> usize {
+        self.options.overflow_threshold
+    }
+
+    /// Initializes a new database file with two meta pages, encrypted
+    /// under `key` if given.
+    fn init_db(
+        file: &mut File,
+        path: &std::path::PathBuf,
+        page_size: usize,
+        key: Option<&EncryptionKey>,
+    ) -> Result<Meta> {
+        let mut meta = Meta::with_page_size(page_size as u32);
+        if let Some(key) = key {
+            encrypt::init_meta(&mut meta, key)?;
+        }
+        let meta_bytes = meta.to_bytes();
+
+        // Seek to beginning of file.
+        if let Err(e) = file.seek(SeekFrom::Start(0)) {
+            return Err(Error::FileSeek {
+                offset: 0,
+                context: "initializing database, seeking to start",
+                source: e,
+            });
+        }
+
+        // Write meta page 0.
+        if let Err(e) = file.write_all(&meta_bytes) {
+            return Err(Error::FileWrite {
+                offset: 0,
+                len: PAGE_SIZE,
+                context: "writing initial meta page 0",
+                source: e,
+            });
+        }
+
+        // Write meta page 1 (identical initially).
+        if let Err(e) = file.write_all(&meta_bytes) {
+            return Err(Error::FileWrite {
+                offset: PAGE_SIZE as u64,
+                len: PAGE_SIZE,
+                context: "writing initial meta page 1",
+                source: e,
+            });
+        }
+
+        // Ensure data is persisted to disk.
+        if let Err(e) = file.sync_all() {
+            return Err(Error::FileSync {
+                context: "syncing initial meta pages",
+                source: e,
+            });
+        }
+
+        // Log successful initialization (only in debug builds).
+        #[cfg(debug_assertions)]
+        {
+            eprintln!("[thunder] initialized new database at '{}'", path.display());
+        }
+        let _ = path; // Suppress unused warning in release.
+
+        Ok(meta)
+    }
+
+    /// Loads and validates meta pages from an existing database file.
+    fn load_meta(file: &mut File, _path: &std::path::PathBuf) -> Result<Meta> {
+        let mut buf = [0u8; PAGE_SIZE];
+
+        // Seek to meta page 0.
+        if let Err(e) = file.seek(SeekFrom::Start(0)) {
+            return Err(Error::FileSeek {
+                offset: 0,
+                context: "seeking to meta page 0",
+                source: e,
+            });
+        }
+
+        // Read meta page 0.
+        if let Err(e) = file.read_exact(&mut buf) {
+            return Err(Error::FileRead {
+                offset: 0,
+                len: PAGE_SIZE,
+                context: "reading meta page 0",
+                source: e,
+            });
+        }
+        let meta0 = Meta::from_bytes(&buf);
+
+        // Seek to meta page 1.
+        let meta1_offset = PAGE_SIZE as u64;
+        if let Err(e) = file.seek(SeekFrom::Start(meta1_offset)) {
+            return Err(Error::FileSeek {
+                offset: meta1_offset,
+                context: "seeking to meta page 1",
+                source: e,
             });
         }
 
@@ -603,6 +1696,19 @@ impl Database {
         }
         let meta1 = Meta::from_bytes(&buf);
 
+        // A newer release wrote at least one meta page; the other holds an
+        // older state, so neither can be used.
+        if let Some(newer) = [&meta0, &meta1]
+            .into_iter()
+            .flatten()
+            .find(|m| m.magic == MAGIC && m.version > VERSION)
+        {
+            return Err(Error::IncompatibleVersion {
+                found: newer.version,
+                supported: VERSION,
+            });
+        }
+
         // Select the valid meta page with the highest txid.
         match (meta0, meta1) {
             (Some(m0), Some(m1)) => {
@@ -652,9 +1758,10 @@ impl Database {
         file: &mut File,
         meta: &Meta,
         page_size: usize,
-        _overflow_threshold: usize,
+        comparator: Option<&KeyComparator>,
+        cipher: Option<&Cipher>,
     ) -> Result<TreeLoadResult> {
-        let mut tree = BTree::new();
+        let mut tree = BTree::with_comparator(comparator.cloned());
         let mut overflow_refs = std::collections::HashMap::new();
 
         // Data starts after the two meta pages.
@@ -700,8 +1807,9 @@ impl Database {
         // Create overflow manager for reading overflow values
         let overflow_manager = OverflowManager::new(page_size, 0);
 
-        // Read each entry.
-        for entry_idx in 0..entry_count {
+        // Read each entry (a compressed block holds several).
+        let mut entry_idx = 0;
+        while entry_idx < entry_count {
             // Read key length.
             let mut len_buf = [0u8; 4];
             if let Err(e) = file.read_exact(&mut len_buf) {
@@ -714,6 +1822,12 @@ impl Database {
             let key_len = u32::from_le_bytes(len_buf) as usize;
             current_offset += 4;
 
+            if key_len == compress::BLOCK_MARKER as usize {
+                entry_idx +=
+                    Self::load_block(file, &mut tree, entry_idx, &mut current_offset, cipher)?;
+                continue;
+            }
+
             // Validate key length.
             const MAX_KEY_LEN: usize = 64 * 1024; // 64KB max key.
             if key_len > MAX_KEY_LEN {
@@ -785,6 +1899,8 @@ impl Database {
                 }
 
                 value
+            } else if value_len == compress::VALUE_MARKER {
+                Self::load_compressed_value(file, entry_idx, &mut current_offset)?
             } else {
                 // Validate inline value length.
                 let value_len = value_len as usize;
@@ -813,6 +1929,7 @@ impl Database {
             };
 
             tree.insert(key, value);
+            entry_idx += 1;
         }
 
         // Build bloom filter from loaded keys.
@@ -826,9 +1943,119 @@ impl Database {
         Ok((tree, current_offset, entry_count, bloom, overflow_refs))
     }
 
+    /// Reads and decodes a compressed value, returning the raw bytes.
+    fn load_compressed_value(
+        file: &mut File,
+        entry_idx: u64,
+        current_offset: &mut u64,
+    ) -> Result<Vec<u8>> {
+        let mut header_buf = [0u8; compress::VALUE_HEADER_SIZE];
+        if let Err(e) = file.read_exact(&mut header_buf) {
+            return Err(Error::EntryReadFailed {
+                entry_index: entry_idx,
+                field: "compressed value header",
+                source: e,
+            });
+        }
+        *current_offset += compress::VALUE_HEADER_SIZE as u64;
+        let header = ValueHeader::from_bytes(&header_buf);
+
+        const MAX_VALUE_LEN: u32 = 512 * 1024 * 1024;
+        if header.stored_len > MAX_VALUE_LEN {
+            return Err(Error::Corrupted {
+                context: "loading compressed value",
+                details: format!(
+                    "entry {entry_idx}: value length {} exceeds maximum {MAX_VALUE_LEN}",
+                    header.stored_len
+                ),
+            });
+        }
+
+        let mut stored = vec![0u8; header.stored_len as usize];
+        if let Err(e) = file.read_exact(&mut stored) {
+            return Err(Error::EntryReadFailed {
+                entry_index: entry_idx,
+                field: "compressed value data",
+                source: e,
+            });
+        }
+        *current_offset += header.stored_len as u64;
+
+        header.decode(&stored)
+    }
+
+    /// Loads the entries of a compressed block into `tree`.
+    ///
+    /// Called with the file positioned just after the block marker.
+    /// Returns the number of entries loaded.
+    fn load_block(
+        file: &mut File,
+        tree: &mut BTree,
+        entry_idx: u64,
+        current_offset: &mut u64,
+        cipher: Option<&Cipher>,
+    ) -> Result<u64> {
+        let mut header_buf = [0u8; compress::BLOCK_HEADER_SIZE];
+        if let Err(e) = file.read_exact(&mut header_buf) {
+            return Err(Error::EntryReadFailed {
+                entry_index: entry_idx,
+                field: "block header",
+                source: e,
+            });
+        }
+        *current_offset += compress::BLOCK_HEADER_SIZE as u64;
+        let header = BlockHeader::from_bytes(&header_buf);
+
+        const MAX_BLOCK_LEN: u32 = 512 * 1024 * 1024;
+        if header.stored_len > MAX_BLOCK_LEN {
+            return Err(Error::Corrupted {
+                context: "loading compressed block",
+                details: format!(
+                    "entry {entry_idx}: block length {} exceeds maximum {MAX_BLOCK_LEN}",
+                    header.stored_len
+                ),
+            });
+        }
+
+        let mut stored = vec![0u8; header.stored_len as usize];
+        if let Err(e) = file.read_exact(&mut stored) {
+            return Err(Error::EntryReadFailed {
+                entry_index: entry_idx,
+                field: "block data",
+                source: e,
+            });
+        }
+        *current_offset += header.stored_len as u64;
+
+        let raw = header.decode(&stored, cipher)?;
+        let truncated = || Error::Corrupted {
+            context: "loading compressed block",
+            details: format!("entry {entry_idx}: block entries are truncated"),
+        };
+        let mut pos = 0usize;
+        let mut read_field = || -> Result<Vec<u8>> {
+            let len_bytes = raw.get(pos..pos + 4).ok_or_else(truncated)?;
+            let len = u32::from_le_bytes([len_bytes[0], len_bytes[1], len_bytes[2], len_bytes[3]])
+                as usize;
+            let field = raw.get(pos + 4..pos + 4 + len).ok_or_else(truncated)?;
+            pos += 4 + len;
+            Ok(field.to_vec())
+        };
+        for _ in 0..header.entry_count {
+            let key = read_field()?;
+            let value = read_field()?;
+            tree.insert(key, value);
+        }
+
+        Ok(header.entry_count as u64)
+    }
+
     /// Persists the B+ tree data to the database file.
     /// This performs a FULL rewrite of all data - use `persist_incremental` for better performance.
     pub(crate) fn persist_tree(&mut self) -> Result<()> {
+        let _lock = self.write_lock()?;
+        self.begin_scrub_write();
+
         // Data starts after the two meta pages.
         let data_offset = 2 * PAGE_SIZE as u64;
 
@@ -845,29 +2072,45 @@ impl Database {
         let entry_count = entries.len() as u64;
         entry_buf.extend_from_slice(&entry_count.to_le_bytes());
 
-        // First pass: prepare all entry data and collect overflow allocations
-        // We'll compute overflow page positions after we know the total entry data size
-        #[allow(clippy::type_complexity)]
-        let mut _overflow_values: Vec<(&[u8], &[u8], Vec<u8>)> = Vec::new(); // (key, original_value, needs_overflow)
+        // First pass: prepare all entry data and remember where each overflow
+        // reference goes. Overflow page positions are only known once the
+        // total entry data size is.
+        let mut block_writer =
+            BlockWriter::new(self.options.page_compression, page_size).sealed(self.cipher.clone());
+        let mut overflow_slots: Vec<(usize, &[u8], &[u8])> = Vec::new(); // (ref offset, key, value)
 
         for (key, value) in &entries {
-            // Write key length and key
-            entry_buf.extend_from_slice(&(key.len() as u32).to_le_bytes());
-            entry_buf.extend_from_slice(key);
+            // Encrypted files keep large values in sealed blocks too.
+            if value.len() > overflow_threshold && self.cipher.is_none() {
+                // Keep blocks ahead of the entries that follow them.
+                block_writer.flush(&mut entry_buf)?;
+
+                // Write key length and key
+                entry_buf.extend_from_slice(&(key.len() as u32).to_le_bytes());
+                entry_buf.extend_from_slice(key);
 
-            if value.len() > overflow_threshold {
-                // Mark for overflow - we'll write the actual reference later
-                _overflow_values.push((key, value, Vec::new()));
                 // Placeholder: write overflow marker + empty ref (will be filled in second pass)
                 entry_buf.extend_from_slice(&OverflowRef::MARKER.to_le_bytes());
+                overflow_slots.push((entry_buf.len(), key, value));
                 let placeholder_ref = OverflowRef::new(0, value.len() as u32);
                 entry_buf.extend_from_slice(&placeholder_ref.to_bytes());
+            } else if block_writer.is_enabled() {
+                block_writer.push(key, value, &mut entry_buf)?;
             } else {
-                // Write inline value
-                entry_buf.extend_from_slice(&(value.len() as u32).to_le_bytes());
-                entry_buf.extend_from_slice(value);
+                // Write key length and key
+                entry_buf.extend_from_slice(&(key.len() as u32).to_le_bytes());
+                entry_buf.extend_from_slice(key);
+
+                // Write inline value, compressed if enabled
+                compress::encode_value(
+                    self.options.value_compression,
+                    self.options.value_compression_min_size,
+                    value,
+                    &mut entry_buf,
+                );
             }
         }
+        block_writer.flush(&mut entry_buf)?;
 
         // Calculate where overflow pages will start (after data section)
         let data_section_end = data_offset + entry_buf.len() as u64;
@@ -876,44 +2119,32 @@ impl Database {
         let overflow_start_page = overflow_start / page_size as u64;
 
         // Reset overflow manager to allocate pages starting from overflow section
-        self.overflow_manager = OverflowManager::new(page_size, overflow_start_page);
+        self.overflow_manager = OverflowManager::new(page_size, overflow_start_page)
+            .with_freelist(self.options.freelist_type);
 
         // Collect all overflow data into a single buffer for one write syscall
         let mut all_overflow_data: Vec<u8> = Vec::new();
         let mut first_overflow_page: Option<u64> = None;
 
         // Second pass: create overflow pages and update references in entry_buf
-        let mut buf_offset = 8; // Skip entry count
-        for (key, value) in &entries {
-            // Skip key length + key
-            buf_offset += 4 + key.len();
-
-            if value.len() > overflow_threshold {
-                // Allocate overflow pages as single contiguous buffer
-                let (oref, overflow_buffer) =
-                    self.overflow_manager.allocate_overflow_contiguous(value);
+        for (ref_offset, key, value) in overflow_slots {
+            // Allocate overflow pages as single contiguous buffer
+            let (oref, overflow_buffer) = self.overflow_manager.allocate_overflow_contiguous(value);
 
-                // Track the first overflow page for the combined write
-                if first_overflow_page.is_none() && !overflow_buffer.is_empty() {
-                    first_overflow_page = Some(oref.start_page);
-                }
+            // Track the first overflow page for the combined write
+            if first_overflow_page.is_none() && !overflow_buffer.is_empty() {
+                first_overflow_page = Some(oref.start_page);
+            }
 
-                // Append to the combined overflow buffer
-                all_overflow_data.extend_from_slice(&overflow_buffer);
+            // Append to the combined overflow buffer
+            all_overflow_data.extend_from_slice(&overflow_buffer);
 
-                // Update the reference in entry_buf
-                buf_offset += 4; // Skip marker
-                entry_buf[buf_offset..buf_offset + 8]
-                    .copy_from_slice(&oref.start_page.to_le_bytes());
-                entry_buf[buf_offset + 8..buf_offset + 12]
-                    .copy_from_slice(&oref.total_len.to_le_bytes());
-                buf_offset += 12;
+            // Update the reference in entry_buf
+            entry_buf[ref_offset..ref_offset + 8].copy_from_slice(&oref.start_page.to_le_bytes());
+            entry_buf[ref_offset + 8..ref_offset + 12]
+                .copy_from_slice(&oref.total_len.to_le_bytes());
 
-                new_overflow_refs.insert(key.to_vec(), oref);
-            } else {
-                // Skip inline value
-                buf_offset += 4 + value.len();
-            }
+            new_overflow_refs.insert(key.to_vec(), oref);
         }
 
         // Write entry data (sequential data) first
@@ -927,7 +2158,7 @@ impl Database {
                 source: e,
             });
         }
-        if let Err(e) = self.file.write_all(&entry_buf) {
+        if let Err(e) = self.write_file(&entry_buf) {
             return Err(Error::FileWrite {
                 offset: data_offset,
                 len: entry_buf.len(),
@@ -952,7 +2183,7 @@ impl Database {
                     source: e,
                 });
             }
-            if let Err(e) = self.file.write_all(&all_overflow_data) {
+            if let Err(e) = self.write_file(&all_overflow_data) {
                 return Err(Error::FileWrite {
                     offset,
                     len: all_overflow_data.len(),
@@ -1010,7 +2241,7 @@ impl Database {
         }
 
         let meta_bytes = self.meta.to_bytes();
-        if let Err(e) = self.file.write_all(&meta_bytes) {
+        if let Err(e) = self.write_file(&meta_bytes) {
             return Err(Error::FileWrite {
                 offset: meta_offset,
                 len: PAGE_SIZE,
@@ -1022,11 +2253,14 @@ impl Database {
         #[cfg(feature = "failpoint")]
         crate::failpoint!("after_meta_write");
 
+        self.stats
+            .record_write((entry_buf.len() + all_overflow_data.len() + meta_bytes.len()) as u64);
+
         // Use fdatasync instead of fsync for better performance (skips metadata sync).
         #[cfg(feature = "failpoint")]
         crate::failpoint!("before_fsync");
 
-        Self::fdatasync(&self.file)?;
+        self.commit_sync()?;
 
         #[cfg(feature = "failpoint")]
         crate::failpoint!("after_fsync");
@@ -1054,7 +2288,7 @@ impl Database {
                     source: e,
                 });
             }
-            if let Err(e) = self.file.write_all(&batch.sequential_data) {
+            if let Err(e) = self.write_file(&batch.sequential_data) {
                 return Err(Error::FileWrite {
                     offset: data_offset,
                     len: batch.sequential_data.len(),
@@ -1074,7 +2308,7 @@ impl Database {
                     source: e,
                 });
             }
-            if let Err(e) = self.file.write_all(data) {
+            if let Err(e) = self.write_file(data) {
                 return Err(Error::FileWrite {
                     offset,
                     len: data.len(),
@@ -1104,7 +2338,7 @@ impl Database {
                     source: e,
                 });
             }
-            if let Err(e) = self.file.write_all(data) {
+            if let Err(e) = self.write_file(data) {
                 return Err(Error::FileWrite {
                     offset,
                     len: data.len(),
@@ -1123,7 +2357,7 @@ impl Database {
                     source: e,
                 });
             }
-            if let Err(e) = self.file.write_all(&batch.sequential_data) {
+            if let Err(e) = self.write_file(&batch.sequential_data) {
                 return Err(Error::FileWrite {
                     offset: data_offset,
                     len: batch.sequential_data.len(),
@@ -1156,6 +2390,9 @@ impl Database {
     where
         I: Iterator<Item = (&'a [u8], &'a [u8])>,
     {
+        let _lock = self.write_lock()?;
+        self.begin_scrub_write();
+
         // If there are deletions, we need to do a full rewrite.
         // In the future, we could implement lazy compaction.
         if has_deletions {
@@ -1174,8 +2411,15 @@ impl Database {
         let overflow_threshold = self.options.overflow_threshold;
         let page_size = self.page_size;
 
-        // Use parallel processing for large batches
-        if entries.len() >= PARALLEL_THRESHOLD {
+        if self.options.page_compression != PageCompression::None
+            || self.options.value_compression != ValueCompression::None
+            || self.cipher.is_some()
+        {
+            return self.persist_incremental_compressed(&entries, total_entry_count);
+        }
+
+        // Use parallel processing for large batches
+        if entries.len() >= PARALLEL_THRESHOLD {
             return self.persist_incremental_parallel(&entries, total_entry_count);
         }
 
@@ -1335,7 +2579,7 @@ impl Database {
             let meta_bytes = self.meta.to_bytes();
 
             // Write meta page using pwrite
-            if let Err(e) = self.file.write_at(&meta_bytes, meta_offset) {
+            if let Err(e) = self.write_file_at(&meta_bytes, meta_offset) {
                 return Err(Error::FileWrite {
                     offset: meta_offset,
                     len: PAGE_SIZE,
@@ -1352,10 +2596,7 @@ impl Database {
 
             // Write entry count using pwrite
             let data_offset = 2 * PAGE_SIZE as u64;
-            if let Err(e) = self
-                .file
-                .write_at(&total_entry_count.to_le_bytes(), data_offset)
-            {
+            if let Err(e) = self.write_file_at(&total_entry_count.to_le_bytes(), data_offset) {
                 return Err(Error::FileWrite {
                     offset: data_offset,
                     len: 8,
@@ -1366,7 +2607,7 @@ impl Database {
 
             // Write entry data using pwrite
             let entry_write_offset = self.data_end_offset - entry_buf.len() as u64;
-            if let Err(e) = self.file.write_at(&entry_buf, entry_write_offset) {
+            if let Err(e) = self.write_file_at(&entry_buf, entry_write_offset) {
                 return Err(Error::FileWrite {
                     offset: entry_write_offset,
                     len: entry_buf.len(),
@@ -1380,7 +2621,7 @@ impl Database {
 
             // Write overflow data using pwrite at the calculated byte offset
             if has_overflow_data
-                && let Err(e) = self.file.write_at(&all_overflow_data, overflow_start)
+                && let Err(e) = self.write_file_at(&all_overflow_data, overflow_start)
             {
                 return Err(Error::FileWrite {
                     offset: overflow_start,
@@ -1403,7 +2644,7 @@ impl Database {
                     source: e,
                 });
             }
-            if let Err(e) = self.file.write_all(&meta_bytes) {
+            if let Err(e) = self.write_file(&meta_bytes) {
                 return Err(Error::FileWrite {
                     offset: meta_offset,
                     len: PAGE_SIZE,
@@ -1420,7 +2661,7 @@ impl Database {
                     source: e,
                 });
             }
-            if let Err(e) = self.file.write_all(&total_entry_count.to_le_bytes()) {
+            if let Err(e) = self.write_file(&total_entry_count.to_le_bytes()) {
                 return Err(Error::FileWrite {
                     offset: data_offset,
                     len: 8,
@@ -1437,7 +2678,7 @@ impl Database {
                     source: e,
                 });
             }
-            if let Err(e) = self.file.write_all(&entry_buf) {
+            if let Err(e) = self.write_file(&entry_buf) {
                 return Err(Error::FileWrite {
                     offset: entry_write_offset,
                     len: entry_buf.len(),
@@ -1454,7 +2695,7 @@ impl Database {
                         source: e,
                     });
                 }
-                if let Err(e) = self.file.write_all(&all_overflow_data) {
+                if let Err(e) = self.write_file(&all_overflow_data) {
                     return Err(Error::FileWrite {
                         offset: overflow_start,
                         len: all_overflow_data.len(),
@@ -1465,11 +2706,19 @@ impl Database {
             }
         }
 
+        let overflow_written = if has_overflow_data {
+            all_overflow_data.len()
+        } else {
+            0
+        };
+        self.stats
+            .record_write((PAGE_SIZE + 8 + entry_buf.len() + overflow_written) as u64);
+
         // Use fdatasync for better performance.
         #[cfg(feature = "failpoint")]
         crate::failpoint!("incr_before_fsync");
 
-        Self::fdatasync(&self.file)?;
+        self.commit_sync()?;
 
         #[cfg(feature = "failpoint")]
         crate::failpoint!("incr_after_fsync");
@@ -1481,6 +2730,92 @@ impl Database {
         Ok(())
     }
 
+    /// Appends new entries as compressed or sealed blocks, or as
+    /// compressed values.
+    ///
+    /// Used by `persist_incremental` when page or value compression or
+    /// encryption is enabled. Callers route batches with overflow values
+    /// through `persist_tree`.
+    fn persist_incremental_compressed(
+        &mut self,
+        entries: &[(&[u8], &[u8])],
+        total_entry_count: u64,
+    ) -> Result<()> {
+        debug_assert!(
+            entries
+                .iter()
+                .all(|(_, v)| v.len() <= self.options.overflow_threshold)
+        );
+
+        let mut entry_buf = Vec::new();
+        let mut block_writer = BlockWriter::new(self.options.page_compression, self.page_size)
+            .sealed(self.cipher.clone());
+        for (key, value) in entries {
+            if block_writer.is_enabled() {
+                block_writer.push(key, value, &mut entry_buf)?;
+            } else {
+                entry_buf.extend_from_slice(&(key.len() as u32).to_le_bytes());
+                entry_buf.extend_from_slice(key);
+                compress::encode_value(
+                    self.options.value_compression,
+                    self.options.value_compression_min_size,
+                    value,
+                    &mut entry_buf,
+                );
+            }
+        }
+        block_writer.flush(&mut entry_buf)?;
+
+        // Append the blocks, then publish them via the entry count and meta.
+        let entry_write_offset = self.data_end_offset;
+        if let Err(e) = self.file.seek(SeekFrom::Start(entry_write_offset)) {
+            return Err(Error::FileSeek {
+                offset: entry_write_offset,
+                context: "seeking to append position (compressed)",
+                source: e,
+            });
+        }
+        if let Err(e) = self.write_file(&entry_buf) {
+            return Err(Error::FileWrite {
+                offset: entry_write_offset,
+                len: entry_buf.len(),
+                context: "writing compressed blocks (incremental)",
+                source: e,
+            });
+        }
+
+        let data_offset = 2 * PAGE_SIZE as u64;
+        if let Err(e) = self.file.seek(SeekFrom::Start(data_offset)) {
+            return Err(Error::FileSeek {
+                offset: data_offset,
+                context: "seeking to update entry count",
+                source: e,
+            });
+        }
+        if let Err(e) = self.write_file(&total_entry_count.to_le_bytes()) {
+            return Err(Error::FileWrite {
+                offset: data_offset,
+                len: 8,
+                context: "updating entry count",
+                source: e,
+            });
+        }
+
+        self.data_end_offset += entry_buf.len() as u64;
+        self.persisted_entry_count = total_entry_count;
+        self.meta.root = 1; // We have data
+        self.stats.record_write((entry_buf.len() + 8) as u64);
+
+        // Bumps txid, writes the alternate meta page and syncs.
+        self.sync_meta_only()?;
+
+        // Refresh mmap to reflect new file size.
+        #[cfg(unix)]
+        self.refresh_mmap()?;
+
+        Ok(())
+    }
+
     /// Parallel version of persist_incremental for large batches.
     ///
     /// Uses rayon to parallelize entry serialization across multiple cores.
@@ -1628,7 +2963,7 @@ impl Database {
         {
             let meta_bytes = self.meta.to_bytes();
 
-            if let Err(e) = self.file.write_at(&meta_bytes, meta_offset) {
+            if let Err(e) = self.write_file_at(&meta_bytes, meta_offset) {
                 return Err(Error::FileWrite {
                     offset: meta_offset,
                     len: PAGE_SIZE,
@@ -1638,10 +2973,7 @@ impl Database {
             }
 
             let data_offset = 2 * PAGE_SIZE as u64;
-            if let Err(e) = self
-                .file
-                .write_at(&total_entry_count.to_le_bytes(), data_offset)
-            {
+            if let Err(e) = self.write_file_at(&total_entry_count.to_le_bytes(), data_offset) {
                 return Err(Error::FileWrite {
                     offset: data_offset,
                     len: 8,
@@ -1651,7 +2983,7 @@ impl Database {
             }
 
             let entry_write_offset = self.data_end_offset - entry_buf.len() as u64;
-            if let Err(e) = self.file.write_at(&entry_buf, entry_write_offset) {
+            if let Err(e) = self.write_file_at(&entry_buf, entry_write_offset) {
                 return Err(Error::FileWrite {
                     offset: entry_write_offset,
                     len: entry_buf.len(),
@@ -1661,7 +2993,7 @@ impl Database {
             }
 
             if has_overflow_data
-                && let Err(e) = self.file.write_at(&all_overflow_data, overflow_start)
+                && let Err(e) = self.write_file_at(&all_overflow_data, overflow_start)
             {
                 return Err(Error::FileWrite {
                     offset: overflow_start,
@@ -1683,7 +3015,7 @@ impl Database {
                     source: e,
                 });
             }
-            if let Err(e) = self.file.write_all(&meta_bytes) {
+            if let Err(e) = self.write_file(&meta_bytes) {
                 return Err(Error::FileWrite {
                     offset: meta_offset,
                     len: PAGE_SIZE,
@@ -1700,7 +3032,7 @@ impl Database {
                     source: e,
                 });
             }
-            if let Err(e) = self.file.write_all(&total_entry_count.to_le_bytes()) {
+            if let Err(e) = self.write_file(&total_entry_count.to_le_bytes()) {
                 return Err(Error::FileWrite {
                     offset: data_offset,
                     len: 8,
@@ -1717,7 +3049,7 @@ impl Database {
                     source: e,
                 });
             }
-            if let Err(e) = self.file.write_all(&entry_buf) {
+            if let Err(e) = self.write_file(&entry_buf) {
                 return Err(Error::FileWrite {
                     offset: entry_write_offset,
                     len: entry_buf.len(),
@@ -1734,7 +3066,7 @@ impl Database {
                         source: e,
                     });
                 }
-                if let Err(e) = self.file.write_all(&all_overflow_data) {
+                if let Err(e) = self.write_file(&all_overflow_data) {
                     return Err(Error::FileWrite {
                         offset: overflow_start,
                         len: all_overflow_data.len(),
@@ -1745,7 +3077,15 @@ impl Database {
             }
         }
 
-        Self::fdatasync(&self.file)?;
+        let overflow_written = if has_overflow_data {
+            all_overflow_data.len()
+        } else {
+            0
+        };
+        self.stats
+            .record_write((PAGE_SIZE + 8 + entry_buf.len() + overflow_written) as u64);
+
+        self.commit_sync()?;
 
         #[cfg(unix)]
         self.refresh_mmap()?;
@@ -1755,8 +3095,25 @@ impl Database {
 
     /// Syncs only the meta page (for commits with no data changes).
     fn sync_meta_only(&mut self) -> Result<()> {
+        let _lock = self.write_lock()?;
         self.meta.txid += 1;
+        self.write_meta_page()
+    }
+
+    /// Rewrites the current meta page in place after a change to its
+    /// flags.
+    ///
+    /// Unlike [`sync_meta_only()`](Self::sync_meta_only), this keeps the
+    /// txid, so opening and closing the database leave `version()` alone.
+    /// The meta page is written with a single write well within one
+    /// sector, so a crash leaves either the old or the new flags.
+    fn sync_meta_flags(&mut self) -> Result<()> {
+        let _lock = self.write_lock()?;
+        self.write_meta_page()
+    }
 
+    /// Writes the meta page to the slot its txid selects and syncs it.
+    fn write_meta_page(&mut self) -> Result<()> {
         let meta_page = if self.meta.txid.is_multiple_of(2) {
             0
         } else {
@@ -1773,7 +3130,7 @@ impl Database {
         }
 
         let meta_bytes = self.meta.to_bytes();
-        if let Err(e) = self.file.write_all(&meta_bytes) {
+        if let Err(e) = self.write_file(&meta_bytes) {
             return Err(Error::FileWrite {
                 offset: meta_offset,
                 len: PAGE_SIZE,
@@ -1781,8 +3138,163 @@ impl Database {
                 source: e,
             });
         }
+        self.stats.record_write(meta_bytes.len() as u64);
 
-        Self::fdatasync(&self.file)?;
+        self.commit_sync()?;
+        Ok(())
+    }
+
+    /// Writes `buf` at the file's current position.
+    ///
+    /// Writes to the data file go through here or
+    /// [`write_file_at()`](Self::write_file_at), so the fault injector sees
+    /// each one.
+    fn write_file(&self, buf: &[u8]) -> std::io::Result<()> {
+        #[cfg(feature = "failpoint")]
+        self.inject_fault(crate::failpoint::FaultOp::Write)?;
+        (&self.file).write_all(buf)
+    }
+
+    /// Writes `buf` at `offset` without moving the file position.
+    #[cfg(unix)]
+    fn write_file_at(&self, buf: &[u8], offset: u64) -> std::io::Result<usize> {
+        #[cfg(feature = "failpoint")]
+        self.inject_fault(crate::failpoint::FaultOp::Write)?;
+        self.file.write_at(buf, offset)
+    }
+
+    /// Counts a write or sync of the data file with the fault injector, if
+    /// one is set, failing it once the injector has fired.
+    #[cfg(feature = "failpoint")]
+    fn inject_fault(&self, op: crate::failpoint::FaultOp) -> std::io::Result<()> {
+        match &self.options.fault_injector {
+            Some(injector) => injector.before(op),
+            None => Ok(()),
+        }
+    }
+
+    /// Syncs the data file at the end of a commit, unless `no_sync` is set.
+    fn commit_sync(&self) -> Result<()> {
+        if self.options.no_sync {
+            self.unsynced
+                .store(true, std::sync::atomic::Ordering::Release);
+            return Ok(());
+        }
+        self.sync_file()
+    }
+
+    /// Syncs the data file, making every write so far durable.
+    fn sync_file(&self) -> Result<()> {
+        self.unsynced
+            .store(false, std::sync::atomic::Ordering::Release);
+        #[cfg(feature = "failpoint")]
+        if let Err(source) = self.inject_fault(crate::failpoint::FaultOp::Sync) {
+            self.unsynced
+                .store(true, std::sync::atomic::Ordering::Release);
+            return Err(Error::FileSync {
+                context: "fdatasync failed",
+                source,
+            });
+        }
+        if let Err(e) = Self::fdatasync(&self.file) {
+            self.unsynced
+                .store(true, std::sync::atomic::Ordering::Release);
+            return Err(e);
+        }
+        #[cfg(feature = "failpoint")]
+        self.capture_durable_image();
+        Ok(())
+    }
+
+    /// Enables or disables syncing the data file on commit.
+    ///
+    /// See `DatabaseOptions::no_sync` for the crash-safety tradeoff.
+    /// Turning syncing back on does not sync earlier commits; call
+    /// [`sync()`](Self::sync) for that.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// db.set_no_sync(true);
+    /// bulk_import(&mut db)?;
+    /// db.set_no_sync(false);
+    /// db.sync()?; // the import is durable from here on
+    /// ```
+    pub fn set_no_sync(&mut self, no_sync: bool) {
+        self.options.no_sync = no_sync;
+    }
+
+    /// Returns whether commits skip syncing the data file.
+    #[inline]
+    pub fn no_sync(&self) -> bool {
+        self.options.no_sync
+    }
+
+    /// Syncs the data file, making every commit so far durable.
+    ///
+    /// Only needed with `no_sync`; otherwise each commit is durable when it
+    /// returns. Takes a shared borrow, so it can run while read
+    /// transactions are open, and returns without touching the disk when
+    /// no commit has skipped its sync since the last one.
+    ///
+    /// # Errors
+    ///
+    /// Returns an error if the file cannot be synced; the commits stay
+    /// unsynced and a later call retries.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// for batch in import.chunks(10_000) {
+    ///     load(&mut db, batch)?;
+    ///     db.sync()?;
+    ///     checkpoint_progress(batch)?;
+    /// }
+    /// ```
+    pub fn sync(&self) -> Result<()> {
+        if !self.unsynced.load(std::sync::atomic::Ordering::Acquire) {
+            return Ok(());
+        }
+        self.sync_file()
+    }
+
+    /// Starts recording the file contents at every sync, so
+    /// [`crash_for_testing()`](Self::crash_for_testing) can drop the writes
+    /// made since.
+    #[cfg(feature = "failpoint")]
+    pub fn track_durability_for_testing(&self) {
+        let image = std::fs::read(&self.path).unwrap_or_default();
+        *self.durable_image.lock().unwrap_or_else(|e| e.into_inner()) = Some(image);
+    }
+
+    /// Records the synced file contents, when tracking durability.
+    #[cfg(feature = "failpoint")]
+    fn capture_durable_image(&self) {
+        let mut image = self.durable_image.lock().unwrap_or_else(|e| e.into_inner());
+        if image.is_some() {
+            *image = Some(std::fs::read(&self.path).unwrap_or_default());
+        }
+    }
+
+    /// Simulates a crash: drops the handle and rolls the file back to its
+    /// contents at the last sync, as if unsynced writes never reached the
+    /// disk.
+    ///
+    /// Requires [`track_durability_for_testing()`](Self::track_durability_for_testing).
+    #[cfg(feature = "failpoint")]
+    pub fn crash_for_testing(mut self) -> Result<()> {
+        let path = self.path.clone();
+        let image = self
+            .durable_image
+            .lock()
+            .unwrap_or_else(|e| e.into_inner())
+            .take();
+        // A crash never gets to clear the open flag.
+        self.meta.flags &= !Meta::FLAG_OPEN;
+        drop(self);
+        if let Some(image) = image {
+            std::fs::write(&path, image)?;
+        }
         Ok(())
     }
 
@@ -1813,6 +3325,8 @@ impl Database {
     }
 
     /// Returns the path to the database file.
+    ///
+    /// Empty for an in-memory database.
     #[allow(dead_code)]
     pub fn path(&self) -> &Path {
         &self.path
@@ -1866,6 +3380,18 @@ impl Database {
         self.bloom.may_contain(key)
     }
 
+    /// Returns the Bloom filter of bucket `name`, if it has one.
+    #[inline]
+    pub(crate) fn bucket_bloom(&self, name: &[u8]) -> Option<&BloomFilter> {
+        self.bucket_blooms.get(name)
+    }
+
+    /// Updates the bucket Bloom filters for a commit that wrote or deleted
+    /// `changed` keys, once the commit is applied to the tree.
+    pub(crate) fn update_bucket_blooms<'k>(&mut self, changed: impl IntoIterator<Item = &'k [u8]>) {
+        self.bucket_blooms.apply(&self.tree, changed);
+    }
+
     /// Begins a new read-only transaction.
     ///
     /// Read transactions provide a consistent snapshot view of the database.
@@ -1874,6 +3400,47 @@ impl Database {
         ReadTx::new(self)
     }
 
+    /// Returns copies of the entries of a bucket in `[start, end)`.
+    ///
+    /// Runs in its own read transaction, so the results reflect the
+    /// database when the query ran and stay valid after later writes.
+    /// With `limit` set, fails instead of copying more than `limit`
+    /// entries, guarding against loading an unexpectedly large range.
+    ///
+    /// # Errors
+    ///
+    /// Returns `BucketNotFound` if the bucket does not exist, or
+    /// `QueryLimitExceeded` if more than `limit` entries match.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let recent = db.query(b"events", b"2024-06-01", b"2024-07-01", Some(10_000))?;
+    /// for (key, value) in recent {
+    ///     publish(key, value);
+    /// }
+    /// ```
+    pub fn query(
+        &self,
+        bucket: &[u8],
+        start: &[u8],
+        end: &[u8],
+        limit: Option<usize>,
+    ) -> Result<Vec<(Vec<u8>, Vec<u8>)>> {
+        let rtx = self.read_tx();
+        let bucket = rtx.bucket(bucket)?;
+        let mut results = Vec::new();
+        for (key, value) in bucket.range(start..end) {
+            if let Some(limit) = limit
+                && results.len() == limit
+            {
+                return Err(Error::QueryLimitExceeded { limit });
+            }
+            results.push((key.to_vec(), value.to_vec()));
+        }
+        Ok(results)
+    }
+
     /// Begins a new read-write transaction.
     ///
     /// Only one write transaction can be active at a time.
@@ -1882,51 +3449,1162 @@ impl Database {
         WriteTx::new(self)
     }
 
-    // ==================== Phase 4: WAL & Checkpoint Methods ====================
+    /// Runs `f` in a write transaction, committing it if `f` succeeds and
+    /// rolling it back if `f` fails.
+    ///
+    /// A write transaction is not tied to a bucket: writes to any number
+    /// of buckets within `f` commit together or not at all, so a data
+    /// bucket and its index bucket can never disagree.
+    ///
+    /// # Errors
+    ///
+    /// Returns the error returned by `f`, or `TxCommitFailed` if the
+    /// commit fails.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// db.update(|wtx| {
+    ///     wtx.bucket_put(b"users", b"alice", &record)?;
+    ///     wtx.bucket_put(b"users_by_email", b"alice@example.com", b"alice")?;
+    ///     Ok(())
+    /// })?;
+    /// ```
+    pub fn update<T, F>(&mut self, f: F) -> Result<T>
+    where
+        F: FnOnce(&mut WriteTx<'_>) -> Result<T>,
+    {
+        let mut wtx = self.write_tx();
+        let value = match f(&mut wtx) {
+            Ok(value) => value,
+            Err(e) => {
+                wtx.rollback();
+                return Err(e);
+            }
+        };
+        wtx.commit()?;
+        Ok(value)
+    }
 
-    /// Returns whether WAL is enabled for this database.
-    pub fn wal_enabled(&self) -> bool {
-        self.wal.is_some()
+    /// Runs `f` in a read transaction that stops once `token` is cancelled.
+    ///
+    /// Scans inside `f` check the token periodically and stop early; see
+    /// the [`cancel`](crate::cancel) module. If the token is cancelled by
+    /// the time `f` returns, the result of `f` is discarded, since a scan
+    /// cut short may have produced it.
+    ///
+    /// # Errors
+    ///
+    /// Returns `TxCancelled` if the token is cancelled before or while `f`
+    /// runs, or the error returned by `f`.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let token = CancelToken::with_timeout(Duration::from_millis(200));
+    /// let rows = db.view_with_cancel(&token, |rtx| {
+    ///     let mut rows = Vec::new();
+    ///     for (key, value) in rtx.bucket(b"events")?.iter() {
+    ///         rows.push(render(key, value));
+    ///     }
+    ///     Ok(rows)
+    /// })?;
+    /// ```
+    pub fn view_with_cancel<T, F>(&self, token: &CancelToken, f: F) -> Result<T>
+    where
+        F: FnOnce(&ReadTx<'_>) -> Result<T>,
+    {
+        token.check()?;
+        let mut rtx = self.read_tx();
+        rtx.set_cancel_token(token.clone());
+        let result = f(&rtx);
+        token.check()?;
+        result
     }
 
-    /// Returns a mutable reference to the WAL, if enabled.
+    /// Runs `f` in a write transaction that stops once `token` is
+    /// cancelled, committing it if `f` succeeds.
     ///
-    /// Reserved for future WAL integration enhancements.
-    #[allow(dead_code)]
-    pub(crate) fn wal_mut(&mut self) -> Option<&mut Wal> {
-        self.wal.as_mut()
+    /// Scans inside `f` stop early once the token is cancelled, and a
+    /// cancelled transaction is rolled back instead of committed. See the
+    /// [`cancel`](crate::cancel) module.
+    ///
+    /// # Errors
+    ///
+    /// Returns `TxCancelled` if the token is cancelled before the commit,
+    /// the error returned by `f`, or the commit's error. The transaction
+    /// is rolled back in each case.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// db.update_with_cancel(&token, |wtx| {
+    ///     for (key, value) in rows {
+    ///         wtx.bucket_put(b"events", &key, &value)?;
+    ///     }
+    ///     Ok(())
+    /// })?;
+    /// ```
+    pub fn update_with_cancel<T, F>(&mut self, token: &CancelToken, f: F) -> Result<T>
+    where
+        F: FnOnce(&mut WriteTx<'_>) -> Result<T>,
+    {
+        token.check()?;
+        let mut wtx = self.write_tx();
+        wtx.set_cancel_token(token.clone());
+        let value = match f(&mut wtx) {
+            Ok(value) => value,
+            Err(e) => {
+                wtx.rollback();
+                return Err(e);
+            }
+        };
+        wtx.commit()?;
+        Ok(value)
     }
 
-    /// Returns the checkpoint LSN, if WAL is enabled and a checkpoint exists.
-    pub fn checkpoint_lsn(&self) -> Option<Lsn> {
-        if self.meta.checkpoint_lsn > 0 {
-            Some(self.meta.checkpoint_lsn)
-        } else {
-            None
+    /// Loads unsorted entries into a bucket using an external merge sort.
+    ///
+    /// Entries are sorted with memory bounded by `options.mem_budget`,
+    /// spilling sorted runs to temporary files, then inserted in key order
+    /// and committed in a single write transaction. The bucket is created
+    /// if it does not exist. If a key appears more than once in `src`, the
+    /// last occurrence wins.
+    ///
+    /// Returns the number of distinct keys loaded.
+    ///
+    /// # Arguments
+    ///
+    /// * `bucket` - Name of the bucket to load into.
+    /// * `src` - Entries in any order.
+    /// * `options` - Memory budget and temporary directory for the sort.
+    ///
+    /// # Errors
+    ///
+    /// Returns `InvalidBucketName` if the bucket name is invalid, an I/O
+    /// error if a temporary run file cannot be written or read,
+    /// `TxTooLarge` if the load would exceed `max_tx_size`, or
+    /// `TxCommitFailed` if the final commit fails.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let options = BulkOptions::default().mem_budget(256 * 1024 * 1024);
+    /// let loaded = db.bulk_load_unsorted(b"users", records, options)?;
+    /// ```
+    pub fn bulk_load_unsorted<I>(
+        &mut self,
+        bucket: &[u8],
+        src: I,
+        options: BulkOptions,
+    ) -> Result<u64>
+    where
+        I: IntoIterator<Item = (Vec<u8>, Vec<u8>)>,
+    {
+        let default_dir = self
+            .path
+            .parent()
+            .map(Path::to_path_buf)
+            .unwrap_or_default();
+
+        let mut wtx = self.write_tx();
+        wtx.create_bucket_if_not_exists(bucket)?;
+        let count = crate::bulk::external_sort(src, &options, &default_dir, |key, value| {
+            wtx.stage_put(crate::bucket::bucket_data_key(bucket, &key), value)
+        })?;
+        wtx.commit()?;
+        Ok(count)
+    }
+
+    /// Runs `f` in a write transaction committed in chunks.
+    ///
+    /// For bulk writes too large for one transaction: `f` writes through
+    /// the [`ChunkedTx`] and calls [`ChunkedTx::commit()`] at points where
+    /// a chunk may end. Each call commits once the chunk has staged at
+    /// least `chunk_size` writes and deletes; the last chunk is committed
+    /// when `f` returns. Each chunk is durable once committed, so a run
+    /// that fails can resume after the last commit point.
+    ///
+    /// Returns the number of chunks committed.
+    ///
+    /// # Errors
+    ///
+    /// Returns the error returned by `f`, after discarding the chunk in
+    /// progress, or `TxCommitFailed` if a commit fails. Chunks committed
+    /// earlier are kept either way.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// db.chunked_update(1000, |tx| {
+    ///     for (key, value) in source.rows_after(checkpoint)? {
+    ///         tx.put(&key, &value);
+    ///         tx.put(b"migration:checkpoint", &key);
+    ///         tx.commit()?;
+    ///     }
+    ///     Ok(())
+    /// })?;
+    /// ```
+    pub fn chunked_update<F>(&mut self, chunk_size: usize, f: F) -> Result<u64>
+    where
+        F: FnOnce(&mut ChunkedTx<'_>) -> Result<()>,
+    {
+        let mut tx = ChunkedTx::new(self.write_tx(), chunk_size);
+        match f(&mut tx) {
+            Ok(()) => tx.finish(),
+            Err(e) => {
+                tx.rollback();
+                Err(e)
+            }
         }
     }
 
-    /// Creates a checkpoint.
+    /// Runs `f` in a write transaction and commits it as `version`.
     ///
-    /// This persists all data to the main database file and updates the
-    /// checkpoint LSN in the meta page. WAL segments before the checkpoint
-    /// can then be safely truncated.
+    /// Used to replay a history into another database with the source's
+    /// versions, e.g. for deterministic simulation or log replay. Versions
+    /// must strictly increase. Automatic versions continue from the last
+    /// assigned one; keeping manual and automatic versions from colliding
+    /// with a history being replayed is the caller's responsibility.
+    ///
+    /// If `f` fails, the transaction is rolled back and its error returned.
+    /// Auto-compaction and expiry purges, which commit on their own, are
+    /// not run after a versioned commit; they catch up after the next
+    /// ordinary one.
     ///
     /// # Errors
     ///
-    /// Returns an error if WAL is not enabled or if the checkpoint fails.
-    pub fn checkpoint(&mut self) -> Result<()> {
-        // Get checkpoint LSN from WAL
-        let checkpoint_lsn = {
-            let wal = self.wal.as_ref().ok_or_else(|| Error::CheckpointFailed {
-                lsn: 0,
-                reason: "WAL not enabled".to_string(),
-            })?;
-            wal.current_lsn()
-        };
+    /// Returns `VersionRegression` if `version` is not greater than
+    /// [`version()`](Self::version), the error returned by `f`, or
+    /// `TxCommitFailed` if the commit fails.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// for (version, ops) in log {
+    ///     replica.update_with_version(version, |wtx| apply(wtx, ops))?;
+    /// }
+    /// ```
+    pub fn update_with_version<F>(&mut self, version: u64, f: F) -> Result<()>
+    where
+        F: FnOnce(&mut WriteTx<'_>) -> Result<()>,
+    {
+        let current = self.meta.txid;
+        if version <= current {
+            return Err(Error::VersionRegression { version, current });
+        }
+
+        let mut wtx = self.write_tx();
+        wtx.set_version(version);
+        let result = match f(&mut wtx) {
+            Ok(()) => wtx.commit(),
+            Err(e) => {
+                wtx.rollback();
+                Err(e)
+            }
+        };
+        if let Err(e) = result {
+            // Undo the numbering if the commit failed before persisting.
+            if self.meta.txid == version - 1 {
+                self.meta.txid = current;
+            }
+            return Err(e);
+        }
+        if self.meta.txid != version {
+            return Err(Error::TxCommitFailed {
+                reason: format!(
+                    "committed as version {} instead of {version}",
+                    self.meta.txid
+                ),
+                source: None,
+            });
+        }
+        Ok(())
+    }
+
+    /// Creates a bucket and seeds it exactly once across all handles.
+    ///
+    /// Takes an exclusive lock on the database file, reloads anything
+    /// committed by other handles or processes since this handle last
+    /// looked, and checks whether the bucket exists. If it does not, the
+    /// bucket is created and `seed` populates it inside the same write
+    /// transaction, which is committed before the lock is released. If the
+    /// bucket already exists, `seed` is not called.
+    ///
+    /// Returns `true` if this call created and seeded the bucket.
+    ///
+    /// # Arguments
+    ///
+    /// * `name` - Name of the bucket to create.
+    /// * `seed` - Populates the new bucket.
+    ///
+    /// # Errors
+    ///
+    /// Returns `InvalidBucketName` if the name is invalid, `FileLock` if the
+    /// file lock cannot be taken, `LockTimedOut` if it is not free within
+    /// `lock_timeout`, the error returned by `seed` (in which case nothing
+    /// is committed), or `TxCommitFailed` if the commit fails.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// db.ensure_bucket(b"config", |bucket| {
+    ///     bucket.put(b"version", b"1");
+    ///     Ok(())
+    /// })?;
+    /// ```
+    pub fn ensure_bucket<F>(&mut self, name: &[u8], seed: F) -> Result<bool>
+    where
+        F: FnOnce(&mut BucketMut<'_>) -> Result<()>,
+    {
+        crate::bucket::validate_bucket_name(name)?;
+
+        let _lock = self.write_lock()?;
+        self.reload_if_changed()?;
+
+        let mut wtx = self.write_tx();
+        if !wtx.create_bucket_if_not_exists(name)? {
+            return Ok(false);
+        }
+        seed(&mut wtx.pending_bucket_mut(name)?)?;
+        wtx.commit()?;
+        Ok(true)
+    }
+
+    /// Loads the latest state committed to the file by other handles.
+    ///
+    /// A handle loads the committed state when it opens and, apart from
+    /// its own commits, keeps serving it: this is how a handle opened with
+    /// `DatabaseOptions::read_only`, or any other handle sharing the file,
+    /// catches up with writers. The state is loaded under a shared file
+    /// lock, so it is always a complete commit. Read transactions and
+    /// snapshots taken before the call keep the state they started with.
+    ///
+    /// Returns whether a newer commit was loaded.
+    ///
+    /// # Errors
+    ///
+    /// Returns `LockTimedOut` if writers hold the file lock past
+    /// `lock_timeout`, or an error if the file cannot be read.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let options = DatabaseOptions { read_only: true, ..Default::default() };
+    /// let mut db = Database::open_with_options("app.db", options)?;
+    /// loop {
+    ///     db.refresh()?;
+    ///     report(&db.read_tx());
+    ///     std::thread::sleep(Duration::from_secs(10));
+    /// }
+    /// ```
+    pub fn refresh(&mut self) -> Result<bool> {
+        // An exclusive handle is the only writer, so it is always current.
+        if self.file_lock.is_some() {
+            return Ok(false);
+        }
+        let _lock = FileLockGuard::acquire_shared(&self.file, self.options.lock_timeout)?;
+        let txid = self.meta.txid;
+        self.reload_if_changed()?;
+        Ok(self.meta.txid != txid)
+    }
+
+    /// Returns `ReadOnly` if the handle was opened read-only.
+    fn check_writable(&self) -> Result<()> {
+        if self.options.read_only {
+            return Err(Error::ReadOnly);
+        }
+        Ok(())
+    }
+
+    /// Returns `InMemoryUnsupported` for `feature` if the database has no
+    /// file on disk.
+    fn check_on_disk(&self, feature: &'static str) -> Result<()> {
+        if self.is_in_memory() {
+            return Err(Error::InMemoryUnsupported { feature });
+        }
+        Ok(())
+    }
+
+    /// Takes the file lock for a write, unless an enclosing write or the
+    /// handle's exclusive lock already holds it.
+    ///
+    /// Every write to the file holds the lock, so read-only handles never
+    /// load a commit that is partly written.
+    pub(crate) fn write_lock(&self) -> Result<WriteLock> {
+        use std::sync::atomic::Ordering;
+
+        self.check_writable()?;
+        let depth = std::sync::Arc::clone(&self.write_depth);
+        let outermost = depth.fetch_add(1, Ordering::AcqRel) == 0;
+        let guard = if outermost && self.file_lock.is_none() {
+            match FileLockGuard::acquire(&self.file, self.options.lock_timeout) {
+                Ok(guard) => Some(guard),
+                Err(e) => {
+                    depth.fetch_sub(1, Ordering::AcqRel);
+                    return Err(e);
+                }
+            }
+        } else {
+            None
+        };
+        Ok(WriteLock { guard, depth })
+    }
+
+    /// Reloads the committed state if another handle has written to the file.
+    fn reload_if_changed(&mut self) -> Result<()> {
+        let meta = Self::load_meta(&mut self.file, &self.path)?;
+        if meta.txid == self.meta.txid {
+            return Ok(());
+        }
+        self.reload(meta)
+    }
+
+    /// Reloads the committed state from the file, whose current meta page
+    /// is `meta`.
+    fn reload(&mut self, meta: Meta) -> Result<()> {
+        self.begin_scrub_write();
+        // A compacted file has its own salt.
+        let cipher = encrypt::open_cipher(&meta, self.options.encryption_key.as_ref())?;
+        let (tree, data_end, count, bloom, overflow_refs) = Self::load_tree(
+            &mut self.file,
+            &meta,
+            self.page_size,
+            self.options.comparator.as_ref(),
+            cipher.as_ref(),
+        )?;
+
+        // Adopt the on-disk txid so our next meta write supersedes it.
+        let flags = self.meta.flags;
+        self.meta = meta;
+        self.meta.flags = flags;
+        self.tree = std::sync::Arc::new(tree);
+        self.data_end_offset = data_end;
+        self.persisted_entry_count = count;
+        self.bloom = bloom;
+        self.bucket_blooms = BucketBlooms::build(&self.tree);
+        self.overflow_refs = overflow_refs;
+        self.cipher = cipher;
+        self.overflow_manager = OverflowManager::new(
+            self.page_size,
+            Self::calculate_next_overflow_page(data_end, self.page_size),
+        )
+        .with_freelist(self.options.freelist_type);
+
+        #[cfg(unix)]
+        self.refresh_mmap()?;
+
+        self.stats.record_read(self.loaded_bytes());
+        self.publish_read_view();
+        self.refresh_stats();
+        self.publish_scrub_targets();
+        Ok(())
+    }
+
+    /// Returns the bytes loading the committed state reads: the meta pages
+    /// and entry data, then the overflow values.
+    fn loaded_bytes(&self) -> u64 {
+        let overflow: u64 = self
+            .overflow_refs
+            .values()
+            .map(|oref| oref.total_len as u64)
+            .sum();
+        self.data_end_offset + overflow
+    }
+
+    /// Compacts the database file, dropping space held by superseded data.
+    ///
+    /// Equivalent to [`begin_compaction()`](Self::begin_compaction),
+    /// [`Compaction::run()`] and
+    /// [`finish_compaction()`](Self::finish_compaction). To keep serving
+    /// reads while the side file is written, call those separately.
+    ///
+    /// # Errors
+    ///
+    /// Returns an error if the side file cannot be written or swapped in.
+    pub fn compact(&mut self) -> Result<()> {
+        self.check_writable()?;
+        self.check_on_disk("compaction")?;
+        let mut compaction = self.begin_compaction();
+        compaction.run()?;
+        self.finish_compaction(compaction)
+    }
+
+    /// Starts compacting the committed state into a side file.
+    ///
+    /// Only captures a snapshot; the returned [`Compaction`] writes the
+    /// side file without borrowing the database. See the `compaction`
+    /// module for details.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let mut compaction = db.begin_compaction();
+    /// std::thread::scope(|s| {
+    ///     s.spawn(|| serve_reads(&db));
+    ///     compaction.run()
+    /// })?;
+    /// db.finish_compaction(compaction)?;
+    /// ```
+    pub fn begin_compaction(&self) -> Compaction {
+        Compaction::new(
+            std::sync::Arc::clone(&self.tree),
+            self.meta.txid,
+            &self.path,
+            self.side_file_options(),
+        )
+    }
+
+    /// Options for writing the committed state to another file, as
+    /// compaction and backups do.
+    fn side_file_options(&self) -> DatabaseOptions {
+        DatabaseOptions {
+            page_size: PageSizeConfig::from_u32(self.page_size as u32).unwrap_or_default(),
+            wal_enabled: false,
+            max_tx_duration: None,
+            retain_duration: None,
+            audit_writer: None,
+            auto_compaction: None,
+            expiry_interval: None,
+            scrub_interval: None,
+            no_sync: false,
+            ..self.options.clone()
+        }
+    }
+
+    /// Captures the committed state for a hot backup.
+    ///
+    /// O(1); the returned [`Backup`] writes the copy without borrowing the
+    /// database, so commits can continue meanwhile. See the `backup`
+    /// module for details.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let backup = db.begin_backup();
+    /// std::thread::spawn(move || backup.write_to(&mut socket));
+    /// ```
+    pub fn begin_backup(&self) -> Backup {
+        Backup::new(
+            std::sync::Arc::clone(&self.tree),
+            self.meta.txid,
+            &self.path,
+            self.side_file_options(),
+        )
+    }
+
+    /// Writes a consistent copy of the database to `w`.
+    ///
+    /// The copy is a complete database file holding the committed state.
+    /// Returns the number of bytes written. Use
+    /// [`begin_backup()`](Self::begin_backup) to keep committing while the
+    /// copy is written.
+    ///
+    /// # Errors
+    ///
+    /// Returns an error if the copy cannot be produced or written to `w`.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let mut file = File::create("backup.thunder")?;
+    /// let bytes = db.write_to(&mut file)?;
+    /// assert_eq!(bytes, file.metadata()?.len());
+    /// ```
+    pub fn write_to<W: std::io::Write>(&self, w: &mut W) -> Result<u64> {
+        self.begin_backup().write_to(w)
+    }
+
+    /// Writes every bucket and its entries to `writer` as a JSON document.
+    ///
+    /// The document is portable: it can be read back with
+    /// [`import_json()`](Self::import_json) into a database with any
+    /// options, or inspected by hand. It is written while the buckets are
+    /// visited, without building it in memory. See the
+    /// [`export`](crate::export) module for the format and what it leaves
+    /// out.
+    ///
+    /// # Errors
+    ///
+    /// Returns `Io` if writing to `writer` fails.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let file = File::create("dump.json")?;
+    /// db.export_json(file)?;
+    /// ```
+    pub fn export_json<W: std::io::Write>(&self, writer: W) -> Result<()> {
+        crate::export::export_json(&self.tree, writer)
+    }
+
+    /// Writes the buckets and entries of a document produced by
+    /// [`export_json()`](Self::export_json) into this database.
+    ///
+    /// Buckets are created where missing and entries overwrite existing
+    /// keys; nothing else is removed. The document is read as a stream and
+    /// committed in batches of [`IMPORT_BATCH_BYTES`](crate::IMPORT_BATCH_BYTES),
+    /// so memory use stays bounded, but the import is not atomic. Returns
+    /// the number of entries written.
+    ///
+    /// # Errors
+    ///
+    /// Returns `InvalidExport` if the document is malformed, `Io` if
+    /// reading fails, or an error from committing a batch. Batches
+    /// committed before the error are kept.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let mut fresh = Database::open("migrated.db")?;
+    /// let entries = fresh.import_json(File::open("dump.json")?)?;
+    /// ```
+    pub fn import_json<R: std::io::Read>(&mut self, reader: R) -> Result<u64> {
+        crate::export::import_json(self, reader)
+    }
+
+    /// Loads CSV records from `reader` into the bucket `name`, writing the
+    /// selected key and value columns of each record as an entry.
+    ///
+    /// Rows are committed in batches of
+    /// [`IMPORT_BATCH_BYTES`](crate::IMPORT_BATCH_BYTES), so memory use
+    /// stays bounded, but the import is not atomic. Returns the number of
+    /// rows written, not counting a skipped header.
+    ///
+    /// # Errors
+    ///
+    /// Returns `BucketNotFound` if the bucket does not exist, `InvalidCsv`
+    /// with the line number if a record is malformed or too short, `Io` if
+    /// reading fails, or an error from committing a batch. Batches
+    /// committed before the error are kept.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let options = CsvOptions::default().columns(0, 2).has_header(true);
+    /// let rows = db.import_csv(b"users", File::open("users.csv")?, &options)?;
+    /// ```
+    pub fn import_csv<R: std::io::Read>(
+        &mut self,
+        name: &[u8],
+        reader: R,
+        options: &crate::csv::CsvOptions,
+    ) -> Result<u64> {
+        crate::csv::import_csv(self, name, reader, options)
+    }
+
+    /// Writes a compacted copy of the database to a new file at `path`.
+    ///
+    /// The copy holds only the committed live entries, packed with no free
+    /// pages, and opens like any database file. The database itself is
+    /// left as it is; unlike [`compact()`](Self::compact), nothing is
+    /// swapped. Returns the size of the new file. Use
+    /// [`begin_backup()`](Self::begin_backup) and
+    /// [`Backup::write_to_path()`] to keep committing while the copy is
+    /// written.
+    ///
+    /// # Errors
+    ///
+    /// Returns `FileOpen` if `path` already exists or cannot be created,
+    /// or an error if the copy cannot be written.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let before = std::fs::metadata("data.thunder")?.len();
+    /// let after = db.compact_to("data.compacted.thunder")?;
+    /// println!("{before} -> {after} bytes");
+    /// ```
+    pub fn compact_to<P: AsRef<Path>>(&self, path: P) -> Result<u64> {
+        self.begin_backup().write_to_path(path)
+    }
+
+    /// Swaps a compacted side file in place of the database file.
+    ///
+    /// Runs the compaction first if it has not been run. Transactions
+    /// started afterwards read and write the compacted file; snapshots
+    /// taken before keep the state they captured.
+    ///
+    /// # Errors
+    ///
+    /// Returns `CompactionStale` if a transaction committed since the
+    /// compaction began; the database is left unchanged. Returns an I/O
+    /// error if the side file cannot be renamed or reopened.
+    pub fn finish_compaction(&mut self, mut compaction: Compaction) -> Result<()> {
+        self.check_on_disk("compaction")?;
+        let _lock = self.write_lock()?;
+        if compaction.version() != self.meta.txid {
+            return Err(Error::CompactionStale {
+                version: compaction.version(),
+                current: self.meta.txid,
+            });
+        }
+        compaction.run()?;
+
+        let side_path = compaction.side_path().to_path_buf();
+        std::fs::rename(&side_path, &self.path).map_err(|e| Error::FileRename {
+            from: side_path,
+            to: self.path.clone(),
+            source: e,
+        })?;
+        compaction.mark_swapped();
+
+        self.file = OpenOptions::new()
+            .read(true)
+            .write(true)
+            .open(&self.path)
+            .map_err(|e| Error::FileOpen {
+                path: self.path.clone(),
+                source: e,
+            })?;
+        // The held lock is on the replaced file.
+        if self.file_lock.is_some() {
+            self.file_lock = Some(FileLockGuard::acquire(
+                &self.file,
+                self.options.lock_timeout,
+            )?);
+        }
+        let meta = Self::load_meta(&mut self.file, &self.path)?;
+        self.reload(meta)?;
+
+        // The compacted file may be smaller; map it afresh.
+        #[cfg(unix)]
+        {
+            self.mmap = None;
+            (self.mmap, self.mapped_file_len) =
+                Self::init_mmap(&self.file, self.options.initial_mmap_size);
+        }
+        Ok(())
+    }
+
+    /// Returns the format version of the database file.
+    ///
+    /// Files in an older format than [`VERSION`](crate::page::VERSION) open
+    /// and can be upgraded; files in a newer one fail to open with
+    /// `IncompatibleVersion`.
+    #[inline]
+    pub fn format_version(&self) -> u32 {
+        self.meta.version
+    }
+
+    /// Returns whether the file is in an older format than this release
+    /// writes.
+    ///
+    /// See the [`upgrade`](crate::upgrade) module for details.
+    #[inline]
+    pub fn needs_upgrade(&self) -> bool {
+        self.meta.version < VERSION
+    }
+
+    /// Upgrades the file to the current format.
+    ///
+    /// Equivalent to [`upgrade_with_progress()`](Self::upgrade_with_progress)
+    /// without a progress callback.
+    ///
+    /// # Errors
+    ///
+    /// Returns an error if the file cannot be rewritten or swapped in.
+    pub fn upgrade(&mut self) -> Result<bool> {
+        self.upgrade_with_progress(|_| {})
+    }
+
+    /// Upgrades the file to the current format, reporting each step to
+    /// `progress`.
+    ///
+    /// Rewrites the committed state into a side file and swaps it in, so
+    /// a crash leaves either the old or the upgraded file. Returns whether
+    /// an upgrade was needed; does nothing if the file is already current.
+    ///
+    /// # Errors
+    ///
+    /// Returns an error if the file cannot be rewritten or swapped in; the
+    /// database is left in its old format.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// if db.needs_upgrade() {
+    ///     db.upgrade_with_progress(|step| println!("upgrade: {step:?}"))?;
+    /// }
+    /// ```
+    pub fn upgrade_with_progress<F>(&mut self, mut progress: F) -> Result<bool>
+    where
+        F: FnMut(UpgradeProgress),
+    {
+        if !self.needs_upgrade() {
+            return Ok(false);
+        }
+        self.check_writable()?;
+        let mut compaction = self.begin_compaction();
+        progress(UpgradeProgress::Rewriting {
+            from_version: self.meta.version,
+            entries: self.tree.len() as u64,
+        });
+        compaction.run()?;
+        progress(UpgradeProgress::Swapping);
+        self.finish_compaction(compaction)?;
+        progress(UpgradeProgress::Done {
+            version: self.meta.version,
+        });
+        Ok(true)
+    }
+
+    /// Compacts a single bucket in place, leaving other buckets' entries as
+    /// they are.
+    ///
+    /// Drops the bucket's superseded entries from the data section and
+    /// rewrites its live entries contiguously, in key order, at the end of
+    /// the section. Entries of other buckets keep their bytes and relative
+    /// order, including their own superseded entries. Commits a new version.
+    /// See the [`compaction`](crate::compaction) module for the limits.
+    ///
+    /// # Errors
+    ///
+    /// Returns `BucketNotFound` if the bucket does not exist, or an error if
+    /// the data section cannot be read or rewritten.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let churned = db.fragmentation()?.into_iter().find(|f| f.name == b"sessions");
+    /// if churned.is_some_and(|f| f.ratio() > 0.5) {
+    ///     db.compact_bucket(b"sessions")?;
+    /// }
+    /// ```
+    pub fn compact_bucket(&mut self, name: &[u8]) -> Result<()> {
+        let _lock = self.write_lock()?;
+        if self.tree.get(&bucket::bucket_meta_key(name)).is_none() {
+            return Err(Error::BucketNotFound {
+                name: name.to_vec(),
+            });
+        }
+        let data_offset = 2 * PAGE_SIZE as u64;
+        let section_start = data_offset + 8;
+
+        // Stored items in file order: (offset, entry count, holds bucket
+        // entries, is a compressed block).
+        let mut items: Vec<(u64, u64, bool, bool)> = Vec::new();
+        // The last uncompressed copy of each bucket entry, by key.
+        let mut live: std::collections::BTreeMap<Vec<u8>, usize> =
+            std::collections::BTreeMap::new();
+        layout::scan_entries(
+            &self.file,
+            section_start,
+            self.data_end_offset,
+            self.cipher.as_ref(),
+            |pos, key| {
+                let in_bucket = bucket::bucket_name_of_key(key) == Some(name);
+                match items.last_mut() {
+                    Some(item) if item.0 == pos.offset => {
+                        item.1 += 1;
+                        item.2 |= in_bucket;
+                    }
+                    _ => items.push((pos.offset, 1, in_bucket, pos.compressed)),
+                }
+                if in_bucket {
+                    if pos.compressed {
+                        live.remove(key);
+                    } else {
+                        live.insert(key.to_vec(), items.len() - 1);
+                    }
+                }
+            },
+        )?;
+
+        let mut section = vec![0u8; (self.data_end_offset - section_start) as usize];
+        self.file
+            .seek(SeekFrom::Start(section_start))
+            .map_err(|e| Error::FileSeek {
+                offset: section_start,
+                context: "seeking to data section for bucket compaction",
+                source: e,
+            })?;
+        self.file
+            .read_exact(&mut section)
+            .map_err(|e| Error::FileRead {
+                offset: section_start,
+                len: section.len(),
+                context: "reading data section for bucket compaction",
+                source: e,
+            })?;
+        let item_bytes = |i: usize| {
+            let end = items.get(i + 1).map_or(self.data_end_offset, |next| next.0);
+            &section[(items[i].0 - section_start) as usize..(end - section_start) as usize]
+        };
+
+        // Other entries keep their order, then the bucket's live entries
+        // follow in key order. Blocks are kept whole; copies of bucket
+        // entries in them are superseded by the ones that follow.
+        let mut entry_buf = Vec::with_capacity(section.len() + 8);
+        entry_buf.extend_from_slice(&0u64.to_le_bytes());
+        let mut entry_count = 0u64;
+        for (i, &(_, count, in_bucket, compressed)) in items.iter().enumerate() {
+            if in_bucket && !compressed {
+                continue;
+            }
+            entry_buf.extend_from_slice(item_bytes(i));
+            entry_count += count;
+        }
+        for &i in live.values() {
+            entry_buf.extend_from_slice(item_bytes(i));
+            entry_count += 1;
+        }
+        entry_buf[..8].copy_from_slice(&entry_count.to_le_bytes());
+        let data_end = data_offset + entry_buf.len() as u64;
+
+        self.file
+            .seek(SeekFrom::Start(data_offset))
+            .map_err(|e| Error::FileSeek {
+                offset: data_offset,
+                context: "seeking to data section",
+                source: e,
+            })?;
+        self.write_file(&entry_buf).map_err(|e| Error::FileWrite {
+            offset: data_offset,
+            len: entry_buf.len(),
+            context: "writing compacted bucket",
+            source: e,
+        })?;
+        self.data_end_offset = data_end;
+        self.persisted_entry_count = entry_count;
+        self.sync_meta_only()?;
+
+        #[cfg(unix)]
+        self.refresh_mmap()?;
+
+        self.record_version();
+        Ok(())
+    }
+
+    /// Measures how fragmented each bucket is in the database file.
+    ///
+    /// Scans the data section, so this costs a full pass over the entries.
+    /// Buckets are returned in name order.
+    ///
+    /// # Errors
+    ///
+    /// Returns an error if the data section cannot be read or is corrupted.
+    pub fn fragmentation(&self) -> Result<Vec<BucketFragmentation>> {
+        let mut seen: std::collections::HashSet<Vec<u8>> = std::collections::HashSet::new();
+        let mut counts: std::collections::BTreeMap<Vec<u8>, (u64, u64)> =
+            bucket::list_buckets(&self.tree)
+                .into_iter()
+                .map(|name| (name, (0, 0)))
+                .collect();
+        layout::scan_entries(
+            &self.file,
+            2 * PAGE_SIZE as u64 + 8,
+            self.data_end_offset,
+            self.cipher.as_ref(),
+            |_, key| {
+                let Some((live, dead)) =
+                    bucket::bucket_name_of_key(key).and_then(|name| counts.get_mut(name))
+                else {
+                    return;
+                };
+                if seen.insert(key.to_vec()) {
+                    *live += 1;
+                } else {
+                    // Only the last copy is current; count any one as live.
+                    *dead += 1;
+                }
+            },
+        )?;
+
+        Ok(counts
+            .into_iter()
+            .map(|(name, (live_entries, dead_entries))| {
+                let priority = self.tree.get(&bucket::bucket_meta_key(&name)).map_or(
+                    CompactionPriority::Normal,
+                    bucket::decode_compaction_priority,
+                );
+                BucketFragmentation {
+                    name,
+                    priority,
+                    live_entries,
+                    dead_entries,
+                }
+            })
+            .collect())
+    }
+
+    /// Returns the most recent compaction started by auto-compaction.
+    pub fn last_auto_compaction(&self) -> Option<&AutoCompaction> {
+        self.last_auto_compaction.as_ref()
+    }
+
+    /// Runs auto-compaction if it is enabled and due.
+    ///
+    /// Called after each successful commit. Failures are logged.
+    pub(crate) fn maybe_auto_compact(&mut self) {
+        let Some(config) = self.options.auto_compaction else {
+            return;
+        };
+        self.commits_since_compaction_check += 1;
+        if self.commits_since_compaction_check < config.check_interval {
+            return;
+        }
+        self.commits_since_compaction_check = 0;
+
+        if let Err(e) = self.auto_compact(&config) {
+            self.options
+                .logger
+                .log(&format!("auto-compaction failed: {e}"));
+        }
+    }
+
+    /// Deletes every expired bucket entry, returning how many were deleted.
+    ///
+    /// Expired entries are already invisible to reads; this reclaims the
+    /// space they hold. Commits nothing if no entry has expired. See the
+    /// `expiry` module for details.
+    ///
+    /// # Errors
+    ///
+    /// Returns an error if the commit fails.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let purged = db.purge_expired()?;
+    /// println!("purged {purged} expired entries");
+    /// ```
+    pub fn purge_expired(&mut self) -> Result<usize> {
+        let mut wtx = self.write_tx();
+        let purged = wtx.delete_expired();
+        if purged == 0 {
+            wtx.rollback();
+            return Ok(0);
+        }
+        wtx.commit()?;
+        Ok(purged)
+    }
+
+    /// Purges expired entries if `expiry_interval` is set and has passed
+    /// since the last purge.
+    ///
+    /// Called after each successful commit and by an idle
+    /// `BackgroundCommitter`. Failures are logged.
+    pub(crate) fn maybe_purge_expired(&mut self) {
+        let Some(interval) = self.options.expiry_interval else {
+            return;
+        };
+        if self.last_expiry_purge.elapsed() < interval {
+            return;
+        }
+        // Reset first: the purge commits, which calls back in here.
+        self.last_expiry_purge = std::time::Instant::now();
+
+        if let Err(e) = self.purge_expired() {
+            self.options
+                .logger
+                .log(&format!("purging expired entries failed: {e}"));
+        }
+    }
+
+    /// Compacts if any bucket is over its priority's threshold.
+    fn auto_compact(&mut self, config: &AutoCompactionConfig) -> Result<()> {
+        let mut due: Vec<BucketFragmentation> = self
+            .fragmentation()?
+            .into_iter()
+            .filter(|f| f.dead_entries > 0 && f.ratio() >= config.threshold(f.priority))
+            .collect();
+        if due.is_empty() {
+            return Ok(());
+        }
+        due.sort_by(|a, b| {
+            b.priority
+                .cmp(&a.priority)
+                .then(b.ratio().total_cmp(&a.ratio()))
+        });
+
+        self.compact()?;
+        self.last_auto_compaction = Some(AutoCompaction {
+            version: self.meta.txid,
+            buckets: due,
+        });
+        Ok(())
+    }
+
+    /// Stamps a file in an older format with the current version before a
+    /// commit writes an encoding the older format lacks: compressed blocks
+    /// or values. Releases that only know the older format then refuse
+    /// the file with `IncompatibleVersion` instead of misreading it.
+    ///
+    /// The new version is written with the commit's meta page.
+    pub(crate) fn stamp_format_version(&mut self) {
+        if self.meta.version < VERSION
+            && (self.options.page_compression != PageCompression::None
+                || self.options.value_compression != ValueCompression::None)
+        {
+            self.meta.version = VERSION;
+        }
+    }
+
+    /// Sets the txid the next commit advances from.
+    ///
+    /// Used to commit a replayed history under its own versions.
+    pub(crate) fn set_txid(&mut self, txid: u64) {
+        self.meta.txid = txid;
+    }
+
+    /// Replaces the committed state with `tree` and writes it in full as
+    /// `version`.
+    ///
+    /// Used to write a compaction's side file.
+    pub(crate) fn persist_as(&mut self, tree: std::sync::Arc<BTree>, version: u64) -> Result<()> {
+        self.tree = tree;
+        self.meta.txid = version.saturating_sub(1);
+        self.persist_tree()
+    }
+
+    // ==================== Phase 4: WAL & Checkpoint Methods ====================
+
+    /// Returns whether WAL is enabled for this database.
+    pub fn wal_enabled(&self) -> bool {
+        self.wal.is_some()
+    }
+
+    /// Returns a mutable reference to the WAL, if enabled.
+    ///
+    /// Reserved for future WAL integration enhancements.
+    #[allow(dead_code)]
+    pub(crate) fn wal_mut(&mut self) -> Option<&mut Wal> {
+        self.wal.as_mut()
+    }
+
+    /// Returns the checkpoint LSN, if WAL is enabled and a checkpoint exists.
+    pub fn checkpoint_lsn(&self) -> Option<Lsn> {
+        if self.meta.checkpoint_lsn > 0 {
+            Some(self.meta.checkpoint_lsn)
+        } else {
+            None
+        }
+    }
+
+    /// Creates a checkpoint.
+    ///
+    /// This persists all data to the main database file and updates the
+    /// checkpoint LSN in the meta page. WAL segments before the checkpoint
+    /// can then be safely truncated.
+    ///
+    /// # Errors
+    ///
+    /// Returns an error if WAL is not enabled or if the checkpoint fails.
+    pub fn checkpoint(&mut self) -> Result<()> {
+        let _lock = self.write_lock()?;
+        // Get checkpoint LSN from WAL
+        let checkpoint_lsn = {
+            let wal = self.wal.as_ref().ok_or_else(|| Error::CheckpointFailed {
+                lsn: 0,
+                reason: "WAL not enabled".to_string(),
+            })?;
+            wal.current_lsn()
+        };
 
         // Persist all data to main database file
         self.persist_tree()?;
+        self.publish_scrub_targets();
 
         // Update meta with checkpoint info
         let ckpt_info = CheckpointInfo {
@@ -1956,14 +4634,12 @@ impl Database {
             })?;
 
         let meta_bytes = self.meta.to_bytes();
-        self.file
-            .write_all(&meta_bytes)
-            .map_err(|e| Error::FileWrite {
-                offset: meta_offset,
-                len: PAGE_SIZE,
-                context: "writing meta page for checkpoint",
-                source: e,
-            })?;
+        self.write_file(&meta_bytes).map_err(|e| Error::FileWrite {
+            offset: meta_offset,
+            len: PAGE_SIZE,
+            context: "writing meta page for checkpoint",
+            source: e,
+        })?;
 
         Self::fdatasync(&self.file)?;
 
@@ -2170,6 +4846,95 @@ impl Database {
         self.snapshot_manager.unregister_snapshot(id);
     }
 
+    /// Records the current tree as a committed version and publishes the
+    /// new version to waiting threads.
+    ///
+    /// Called after each successful commit.
+    pub(crate) fn record_version(&mut self) {
+        if let Some(versions) = &mut self.versions {
+            versions.record(SystemTime::now(), std::sync::Arc::clone(&self.tree));
+        }
+        self.publish_read_view();
+        self.version_watch.advance(self.meta.txid);
+        self.refresh_stats();
+        self.publish_scrub_targets();
+    }
+
+    /// Returns a snapshot of the database as it was at `at`.
+    ///
+    /// Requires `retain_duration`; any instant inside the retention window
+    /// can be read. See the [`retention`](crate::retention) module.
+    ///
+    /// # Errors
+    ///
+    /// Returns `VersionGced` if the version current at `at` is no longer
+    /// retained, or if `retain_duration` is not set.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let ten_minutes_ago = SystemTime::now() - Duration::from_secs(600);
+    /// let snapshot = db.view_as_of(ten_minutes_ago)?;
+    /// let old = snapshot.get(b"config");
+    /// ```
+    pub fn view_as_of(&self, at: SystemTime) -> Result<crate::snapshot::Snapshot> {
+        let tree = match &self.versions {
+            Some(versions) => versions.as_of(at)?,
+            None => {
+                return Err(Error::VersionGced {
+                    requested: at,
+                    oldest: None,
+                });
+            }
+        };
+        Ok(crate::snapshot::Snapshot::with_arc(
+            tree,
+            Some(std::sync::Arc::clone(&self.snapshot_manager)),
+        ))
+    }
+
+    /// Returns the value of `key` as it was at `at`.
+    ///
+    /// See [`view_as_of()`](Self::view_as_of).
+    ///
+    /// # Errors
+    ///
+    /// Returns `VersionGced` if the version current at `at` is no longer
+    /// retained, or if `retain_duration` is not set.
+    pub fn get_as_of(&self, key: &[u8], at: SystemTime) -> Result<Option<Vec<u8>>> {
+        Ok(self.view_as_of(at)?.get(key))
+    }
+
+    /// Drops retained versions that fell out of the retention window.
+    ///
+    /// Also runs on every commit. Returns the number of versions dropped.
+    pub fn gc_versions(&mut self) -> usize {
+        self.versions
+            .as_mut()
+            .map_or(0, |versions| versions.gc(SystemTime::now()))
+    }
+
+    /// Returns how many versions the retention window holds and what they
+    /// cost.
+    ///
+    /// All zero when `retain_duration` is not set. Computed from the
+    /// retained trees' keys and value lengths, without reading values;
+    /// useful for choosing `retain_duration`.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let stats = db.retained_version_stats();
+    /// println!("{} versions, {} bytes held for history", stats.versions, stats.bytes);
+    /// ```
+    pub fn retained_version_stats(&self) -> RetainedStats {
+        self.versions
+            .as_ref()
+            .map_or_else(RetainedStats::default, |versions| {
+                versions.stats(&self.tree)
+            })
+    }
+
     /// Returns statistics about active snapshots.
     ///
     /// Useful for monitoring snapshot usage and detecting potential
@@ -2186,3 +4951,144 @@ impl Database {
         self.snapshot_manager.stats()
     }
 }
+
+/// Creates a file with no name on disk to back an in-memory database.
+///
+/// The file is freed with its last handle, so closing the database
+/// discards its contents.
+#[cfg(target_os = "linux")]
+fn anonymous_file() -> Result<File> {
+    use std::os::unix::io::FromRawFd;
+
+    // SAFETY: the name is a valid C string and the returned descriptor is
+    // owned by nothing else.
+    let fd = unsafe { libc::memfd_create(c"thunderdb".as_ptr(), libc::MFD_CLOEXEC) };
+    if fd < 0 {
+        return Err(Error::FileOpen {
+            path: PathBuf::new(),
+            source: std::io::Error::last_os_error(),
+        });
+    }
+    Ok(unsafe { File::from_raw_fd(fd) })
+}
+
+/// Creates a file with no name on disk to back an in-memory database.
+///
+/// Falls back to a temporary file that is unlinked as soon as it is open.
+/// Where an open file cannot be removed, as on Windows, it is left in the
+/// temporary directory.
+#[cfg(not(target_os = "linux"))]
+fn anonymous_file() -> Result<File> {
+    static NEXT: std::sync::atomic::AtomicU64 = std::sync::atomic::AtomicU64::new(0);
+
+    let seq = NEXT.fetch_add(1, std::sync::atomic::Ordering::Relaxed);
+    let path = std::env::temp_dir().join(format!("thunderdb-memory-{}-{seq}", std::process::id()));
+    let file = OpenOptions::new()
+        .read(true)
+        .write(true)
+        .create_new(true)
+        .open(&path)
+        .map_err(|e| Error::FileOpen {
+            path: path.clone(),
+            source: e,
+        })?;
+    let _ = std::fs::remove_file(&path);
+    Ok(file)
+}
+
+/// Exclusive advisory lock on the database file, released on drop.
+///
+/// Locks a duplicate of the handle's descriptor, which shares its open file
+/// description, so other handles (in this or another process) contend for
+/// the lock while this one holds it.
+struct FileLockGuard(File);
+
+impl FileLockGuard {
+    /// How often a bounded wait retries the lock.
+    const RETRY_INTERVAL: std::time::Duration = std::time::Duration::from_millis(50);
+
+    /// Takes the lock, waiting at most `timeout` for other handles to
+    /// release it, or indefinitely if `None`.
+    fn acquire(file: &File, timeout: Option<std::time::Duration>) -> Result<Self> {
+        Self::take(file, timeout, false)
+    }
+
+    /// Takes the lock shared with other readers, waiting at most `timeout`
+    /// for writers to release it, or indefinitely if `None`.
+    fn acquire_shared(file: &File, timeout: Option<std::time::Duration>) -> Result<Self> {
+        Self::take(file, timeout, true)
+    }
+
+    fn take(file: &File, timeout: Option<std::time::Duration>, shared: bool) -> Result<Self> {
+        let context = if shared {
+            "acquiring shared lock"
+        } else {
+            "acquiring exclusive lock"
+        };
+        let dup = file.try_clone().map_err(|e| Error::FileLock {
+            context: "duplicating file handle",
+            source: e,
+        })?;
+        let Some(timeout) = timeout else {
+            let locked = if shared {
+                dup.lock_shared()
+            } else {
+                dup.lock()
+            };
+            locked.map_err(|e| Error::FileLock { context, source: e })?;
+            return Ok(Self(dup));
+        };
+
+        let start = std::time::Instant::now();
+        loop {
+            let locked = if shared {
+                dup.try_lock_shared()
+            } else {
+                dup.try_lock()
+            };
+            match locked {
+                Ok(()) => return Ok(Self(dup)),
+                Err(std::fs::TryLockError::WouldBlock) => {}
+                Err(std::fs::TryLockError::Error(e)) => {
+                    return Err(Error::FileLock { context, source: e });
+                }
+            }
+            let waited = start.elapsed();
+            if waited >= timeout {
+                return Err(Error::LockTimedOut { waited });
+            }
+            std::thread::sleep(Self::RETRY_INTERVAL.min(timeout - waited));
+        }
+    }
+}
+
+impl Drop for Database {
+    fn drop(&mut self) {
+        // A panic may have left a write half done; leave the flag set so
+        // the next open reports it.
+        if !std::thread::panicking() {
+            let _ = self.clear_open_flag();
+        }
+    }
+}
+
+impl Drop for FileLockGuard {
+    fn drop(&mut self) {
+        let _ = self.0.unlock();
+    }
+}
+
+/// A write in progress on a [`Database`], holding the file lock if it is
+/// the outermost one. See `Database::write_lock()`.
+pub(crate) struct WriteLock {
+    guard: Option<FileLockGuard>,
+    depth: std::sync::Arc<std::sync::atomic::AtomicUsize>,
+}
+
+impl Drop for WriteLock {
+    fn drop(&mut self) {
+        // Unlock before an enclosing write could take the lock again.
+        self.guard = None;
+        self.depth.fetch_sub(1, std::sync::atomic::Ordering::AcqRel);
+    }
+}
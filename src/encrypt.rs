@@ -0,0 +1,293 @@
+//! Summary: Encryption at rest with AES-256-GCM.
+//! Copyright (c) YOAB. All rights reserved.
+//!
+//! With `DatabaseOptions::encryption_key` set, a new database is created
+//! encrypted: every entry is written inside a block of the data section
+//! (see the `compress` module), and each block is sealed with AES-256-GCM
+//! before it reaches the file. Large values are stored in blocks as well,
+//! so an encrypted file has no overflow pages. Only the meta pages, block
+//! headers and the entry count are stored in the clear.
+//!
+//! # Keys
+//!
+//! The 32-byte key given in the options is never used directly. Each file
+//! stores a random salt in its meta pages, and HKDF-SHA256 derives two
+//! values from the key and salt: the data key that seals blocks, and a
+//! key check stored next to the salt. Opening compares the key check
+//! before reading any data, so a wrong key fails with `InvalidKey` rather
+//! than with corrupted blocks. Backups and compaction write a new file
+//! with its own salt, sealed with the same key.
+//!
+//! # Block Sealing
+//!
+//! A sealed block sets [`SEALED_CODEC`] in its codec byte and stores a
+//! random 96-bit nonce followed by the ciphertext and its 16-byte tag. The
+//! block's codec, entry count and raw length are authenticated with it, so
+//! a tampered header fails to open like tampered data does. Blocks are
+//! compressed before they are sealed.
+//!
+//! # Limits
+//!
+//! The write-ahead log is not encrypted, so opening an encrypted database
+//! with `wal_enabled` fails with `EncryptionUnsupported`. Run files that
+//! `Database::bulk_load_unsorted()` spills to `BulkOptions::temp_dir` are
+//! not encrypted either. An existing unencrypted database cannot be opened
+//! with a key; write it to an encrypted file through a backup instead.
+
+use std::fmt;
+use std::io;
+
+use ring::aead::{self, AES_256_GCM, Aad, LessSafeKey, NONCE_LEN, Nonce, UnboundKey};
+use ring::hkdf::{HKDF_SHA256, KeyType, Salt};
+use ring::rand::{SecureRandom, SystemRandom};
+
+use crate::error::{Error, Result};
+use crate::meta::Meta;
+
+/// Length of an encryption key in bytes.
+pub const KEY_SIZE: usize = 32;
+
+/// Length of the per-file salt in bytes.
+pub const SALT_SIZE: usize = 16;
+
+/// Length of the key check in bytes.
+pub const KEY_CHECK_SIZE: usize = 16;
+
+/// Bit set in a block's codec byte when the block is sealed.
+pub const SEALED_CODEC: u8 = 0x80;
+
+/// Bytes a sealed block adds to its stored data: nonce and tag.
+pub const SEAL_OVERHEAD: usize = NONCE_LEN + aead::MAX_TAG_LEN;
+
+/// HKDF info for the key that seals blocks.
+const DATA_KEY_INFO: &[u8] = b"thunderdb data key";
+
+/// HKDF info for the key check stored in the meta pages.
+const KEY_CHECK_INFO: &[u8] = b"thunderdb key check";
+
+/// A 256-bit key for `DatabaseOptions::encryption_key`.
+///
+/// `Debug` output omits the key bytes, so options can be logged safely.
+///
+/// # Example
+///
+/// ```ignore
+/// let key = EncryptionKey::from_slice(&secret_store.fetch("db-key")?)?;
+/// let options = DatabaseOptions {
+///     encryption_key: Some(key),
+///     ..DatabaseOptions::default()
+/// };
+/// ```
+#[derive(Clone)]
+pub struct EncryptionKey([u8; KEY_SIZE]);
+
+impl EncryptionKey {
+    /// Creates a key from its 32 bytes.
+    pub fn new(bytes: [u8; KEY_SIZE]) -> Self {
+        Self(bytes)
+    }
+
+    /// Creates a key from a slice, which must hold exactly 32 bytes.
+    ///
+    /// # Errors
+    ///
+    /// Returns `InvalidKey` if `bytes` is not 32 bytes long.
+    pub fn from_slice(bytes: &[u8]) -> Result<Self> {
+        let bytes = bytes.try_into().map_err(|_| Error::InvalidKey {
+            reason: "encryption key must be 32 bytes",
+        })?;
+        Ok(Self(bytes))
+    }
+}
+
+impl fmt::Debug for EncryptionKey {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str("EncryptionKey(..)")
+    }
+}
+
+/// HKDF output length for values that are not AEAD keys.
+struct OutputLen(usize);
+
+impl KeyType for OutputLen {
+    fn len(&self) -> usize {
+        self.0
+    }
+}
+
+/// Seals and opens blocks with the data key of one file.
+///
+/// Created by the database when it opens an encrypted file.
+#[derive(Clone)]
+pub struct Cipher {
+    key: LessSafeKey,
+}
+
+impl fmt::Debug for Cipher {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str("Cipher(..)")
+    }
+}
+
+impl Cipher {
+    /// Derives the data key and key check of a file from `key` and `salt`.
+    fn derive(key: &EncryptionKey, salt: &[u8; SALT_SIZE]) -> (Self, [u8; KEY_CHECK_SIZE]) {
+        let prk = Salt::new(HKDF_SHA256, salt).extract(&key.0);
+        let data_key = prk
+            .expand(&[DATA_KEY_INFO], &AES_256_GCM)
+            .expect("AES-256 key length is a valid HKDF output length");
+        let mut key_check = [0u8; KEY_CHECK_SIZE];
+        prk.expand(&[KEY_CHECK_INFO], OutputLen(KEY_CHECK_SIZE))
+            .and_then(|okm| okm.fill(&mut key_check))
+            .expect("key check length is a valid HKDF output length");
+        let cipher = Self {
+            key: LessSafeKey::new(UnboundKey::from(data_key)),
+        };
+        (cipher, key_check)
+    }
+
+    /// Seals `plaintext` under a fresh nonce, appending the nonce,
+    /// ciphertext and tag to `out`.
+    ///
+    /// # Errors
+    ///
+    /// Returns `Io` if the system random number generator fails.
+    pub(crate) fn seal(&self, plaintext: &[u8], aad: &[u8], out: &mut Vec<u8>) -> Result<()> {
+        let mut nonce = [0u8; NONCE_LEN];
+        fill_random(&mut nonce)?;
+        let mut sealed = Vec::with_capacity(plaintext.len() + aead::MAX_TAG_LEN);
+        sealed.extend_from_slice(plaintext);
+        self.key
+            .seal_in_place_append_tag(
+                Nonce::assume_unique_for_key(nonce),
+                Aad::from(aad),
+                &mut sealed,
+            )
+            .map_err(|_| io::Error::other("block too large to seal"))?;
+        out.extend_from_slice(&nonce);
+        out.extend_from_slice(&sealed);
+        Ok(())
+    }
+
+    /// Opens bytes written by [`seal()`](Self::seal).
+    ///
+    /// Returns `None` if they were not sealed with this key and `aad`, or
+    /// were modified since.
+    pub(crate) fn open(&self, sealed: &[u8], aad: &[u8]) -> Option<Vec<u8>> {
+        let (nonce, ciphertext) = sealed.split_at_checked(NONCE_LEN)?;
+        let nonce = Nonce::try_assume_unique_for_key(nonce).ok()?;
+        let mut buf = ciphertext.to_vec();
+        let len = self
+            .key
+            .open_in_place(nonce, Aad::from(aad), &mut buf)
+            .ok()?
+            .len();
+        buf.truncate(len);
+        Some(buf)
+    }
+}
+
+/// Marks a new file's meta as encrypted under `key`, with a fresh salt.
+///
+/// # Errors
+///
+/// Returns `Io` if the system random number generator fails.
+pub(crate) fn init_meta(meta: &mut Meta, key: &EncryptionKey) -> Result<()> {
+    let mut salt = [0u8; SALT_SIZE];
+    fill_random(&mut salt)?;
+    let (_, key_check) = Cipher::derive(key, &salt);
+    meta.flags |= Meta::FLAG_ENCRYPTED;
+    meta.salt = salt;
+    meta.key_check = key_check;
+    Ok(())
+}
+
+/// Returns the cipher for a file with meta page `meta`, or `None` if the
+/// file is not encrypted.
+///
+/// # Errors
+///
+/// Returns `InvalidKey` if the file is encrypted and `key` is missing or
+/// does not match its key check, or if `key` is given for a file that is
+/// not encrypted.
+pub(crate) fn open_cipher(meta: &Meta, key: Option<&EncryptionKey>) -> Result<Option<Cipher>> {
+    let encrypted = meta.flags & Meta::FLAG_ENCRYPTED != 0;
+    match (encrypted, key) {
+        (false, None) => Ok(None),
+        (false, Some(_)) => Err(Error::InvalidKey {
+            reason: "database is not encrypted",
+        }),
+        (true, None) => Err(Error::InvalidKey {
+            reason: "database is encrypted and no key was given",
+        }),
+        (true, Some(key)) => {
+            let (cipher, key_check) = Cipher::derive(key, &meta.salt);
+            if key_check != meta.key_check {
+                return Err(Error::InvalidKey {
+                    reason: "key does not match the database",
+                });
+            }
+            Ok(Some(cipher))
+        }
+    }
+}
+
+/// Fills `buf` from the system random number generator.
+fn fill_random(buf: &mut [u8]) -> Result<()> {
+    SystemRandom::new()
+        .fill(buf)
+        .map_err(|_| Error::Io(io::Error::other("system random number generator failed")))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_seal_and_open() {
+        let key = EncryptionKey::new([7u8; KEY_SIZE]);
+        let mut meta = Meta::new();
+        init_meta(&mut meta, &key).unwrap();
+        let cipher = open_cipher(&meta, Some(&key)).unwrap().unwrap();
+
+        let mut sealed = Vec::new();
+        cipher.seal(b"block data", b"header", &mut sealed).unwrap();
+        assert_eq!(sealed.len(), b"block data".len() + SEAL_OVERHEAD);
+        assert_eq!(cipher.open(&sealed, b"header").unwrap(), b"block data");
+
+        // Sealing twice uses different nonces.
+        let mut again = Vec::new();
+        cipher.seal(b"block data", b"header", &mut again).unwrap();
+        assert_ne!(sealed, again);
+
+        assert!(cipher.open(&sealed, b"other header").is_none());
+        assert!(cipher.open(&sealed[..NONCE_LEN], b"header").is_none());
+        sealed[NONCE_LEN] ^= 1;
+        assert!(cipher.open(&sealed, b"header").is_none());
+    }
+
+    #[test]
+    fn test_open_cipher_checks_key() {
+        let key = EncryptionKey::new([7u8; KEY_SIZE]);
+        let mut meta = Meta::new();
+        init_meta(&mut meta, &key).unwrap();
+
+        let wrong = EncryptionKey::new([8u8; KEY_SIZE]);
+        assert!(matches!(
+            open_cipher(&meta, Some(&wrong)),
+            Err(Error::InvalidKey { .. })
+        ));
+        assert!(matches!(
+            open_cipher(&meta, None),
+            Err(Error::InvalidKey { .. })
+        ));
+        assert!(matches!(
+            open_cipher(&Meta::new(), Some(&key)),
+            Err(Error::InvalidKey { .. })
+        ));
+        assert!(open_cipher(&Meta::new(), None).unwrap().is_none());
+
+        assert!(EncryptionKey::from_slice(&[0u8; 16]).is_err());
+        assert_eq!(format!("{key:?}"), "EncryptionKey(..)");
+    }
+}
@@ -44,6 +44,17 @@ pub enum Error {
         context: &'static str,
         source: io::Error,
     },
+    /// Failed to rename a file.
+    FileRename {
+        from: PathBuf,
+        to: PathBuf,
+        source: io::Error,
+    },
+    /// Failed to lock or unlock the database file.
+    FileLock {
+        context: &'static str,
+        source: io::Error,
+    },
     /// Database file is corrupted or invalid.
     Corrupted {
         context: &'static str,
@@ -58,6 +69,12 @@ pub enum Error {
     BothMetaPagesInvalid,
     /// Invalid page encountered during read.
     InvalidPage { page_id: u64, reason: String },
+    /// A value failed its checksum verification.
+    ValueCorrupt {
+        key: Vec<u8>,
+        expected: u32,
+        actual: u32,
+    },
     /// Failed to read entry during data load.
     EntryReadFailed {
         entry_index: u64,
@@ -71,18 +88,81 @@ pub enum Error {
         reason: String,
         source: Option<Box<Error>>,
     },
+    /// Transaction was aborted for exceeding the maximum duration.
+    TxTimedOut {
+        elapsed: std::time::Duration,
+        limit: std::time::Duration,
+    },
+    /// Transaction was stopped by its cancel token.
+    TxCancelled { deadline_exceeded: bool },
+    /// A write would take the transaction past `max_tx_size`; it was not
+    /// staged.
+    TxTooLarge { size: u64, limit: u64 },
+    /// The version requested by an as-of read is no longer retained.
+    VersionGced {
+        requested: std::time::SystemTime,
+        oldest: Option<std::time::SystemTime>,
+    },
+    /// An explicitly assigned version is not greater than the current one.
+    VersionRegression { version: u64, current: u64 },
+    /// A transaction committed while a compaction was in progress.
+    CompactionStale { version: u64, current: u64 },
+    /// Waiting for a committed version timed out.
+    WaitTimedOut { version: u64, current: u64 },
+    /// Writing the audit record for a commit failed.
+    AuditWrite { version: u64, source: io::Error },
+    /// Stats are already published under the name.
+    StatsNameTaken { name: String },
+    /// A query matched more entries than its limit allows.
+    QueryLimitExceeded { limit: usize },
+    /// A collecting helper would have visited more entries than the
+    /// transaction's scan limit.
+    ScanLimitExceeded { limit: usize },
+    /// Keys given as a sorted stream were not strictly increasing.
+    KeysOutOfOrder { key: Vec<u8> },
+    /// A commit waited longer than `freeze_timeout` for a freeze to end.
+    FreezeTimedOut { waited: std::time::Duration },
+    /// The file lock was not released by other handles within
+    /// `lock_timeout`.
+    LockTimedOut { waited: std::time::Duration },
+    /// The file is in an older format and must be upgraded before writing.
+    UpgradeRequired { version: u32, current: u32 },
+    /// The file was written in a newer format than this release can read.
+    IncompatibleVersion { found: u32, supported: u32 },
     /// Key not found in the database.
     KeyNotFound,
     /// Bucket not found.
     BucketNotFound { name: Vec<u8> },
     /// Bucket already exists.
     BucketAlreadyExists { name: Vec<u8> },
+    /// An operation that requires an empty bucket found keys in it.
+    BucketNotEmpty { name: Vec<u8> },
+    /// A bucket's sequence counter is at `u64::MAX` and cannot advance.
+    SequenceExhausted { name: Vec<u8> },
     /// Invalid bucket name (empty or too long).
     InvalidBucketName { reason: &'static str },
     /// Database is already open.
     DatabaseAlreadyOpen,
+    /// A write was attempted through a handle opened read-only.
+    ReadOnly,
+    /// `bucket_merge` was called on a database opened without a
+    /// `merge_operator`.
+    MergeOperatorMissing,
+    /// An import document is malformed or not an export.
+    InvalidExport { offset: u64, reason: String },
+    /// A CSV record could not be parsed or lacks a selected column.
+    InvalidCsv { line: u64, reason: String },
     /// Page size mismatch when opening existing database.
     PageSizeMismatch { expected: u32, actual: u32 },
+    /// The encryption key is malformed, missing, or does not match the
+    /// database.
+    InvalidKey { reason: &'static str },
+    /// An option was combined with encryption that would store data
+    /// unencrypted.
+    EncryptionUnsupported { feature: &'static str },
+    /// An option or operation needs a database file on disk, which an
+    /// in-memory database does not have.
+    InMemoryUnsupported { feature: &'static str },
     /// Generic I/O error (legacy, prefer specific variants).
     Io(io::Error),
 
@@ -132,6 +212,13 @@ pub enum Error {
 
     /// Group commit operation failed.
     GroupCommitFailed { reason: String },
+
+    /// An update waited on the committer that was running it.
+    ///
+    /// Waiting would never finish, since the committer applies updates one
+    /// batch at a time. Nested write transactions on one `Database` are
+    /// already ruled out at compile time, as each borrows it mutably.
+    NestedTransaction,
 }
 
 impl fmt::Display for Error {
@@ -185,6 +272,17 @@ impl fmt::Display for Error {
             Error::FileSync { context, source } => {
                 write!(f, "failed to sync to disk ({context}): {source}")
             }
+            Error::FileRename { from, to, source } => {
+                write!(
+                    f,
+                    "failed to rename {} to {}: {source}",
+                    from.display(),
+                    to.display()
+                )
+            }
+            Error::FileLock { context, source } => {
+                write!(f, "failed to lock database file ({context}): {source}")
+            }
             Error::Corrupted { context, details } => {
                 write!(f, "database corrupted ({context}): {details}")
             }
@@ -200,6 +298,17 @@ impl fmt::Display for Error {
             Error::InvalidPage { page_id, reason } => {
                 write!(f, "invalid page {page_id}: {reason}")
             }
+            Error::ValueCorrupt {
+                key,
+                expected,
+                actual,
+            } => {
+                write!(
+                    f,
+                    "value checksum mismatch for key {:?}: expected {expected:#010x}, computed {actual:#010x}",
+                    String::from_utf8_lossy(key)
+                )
+            }
             Error::EntryReadFailed {
                 entry_index,
                 field,
@@ -218,6 +327,89 @@ impl fmt::Display for Error {
                     write!(f, "transaction commit failed: {reason}")
                 }
             }
+            Error::TxCancelled { deadline_exceeded } => {
+                if *deadline_exceeded {
+                    write!(f, "transaction cancelled: deadline exceeded")
+                } else {
+                    write!(f, "transaction cancelled")
+                }
+            }
+            Error::TxTooLarge { size, limit } => {
+                write!(f, "transaction would stage {size} bytes (maximum {limit})")
+            }
+            Error::TxTimedOut { elapsed, limit } => {
+                write!(
+                    f,
+                    "transaction aborted after {elapsed:?} (maximum duration {limit:?})"
+                )
+            }
+            Error::VersionGced { requested, oldest } => match oldest {
+                Some(oldest) => write!(
+                    f,
+                    "version as of {requested:?} is no longer retained (oldest is {oldest:?})"
+                ),
+                None => write!(f, "version as of {requested:?} is not retained"),
+            },
+            Error::VersionRegression { version, current } => {
+                write!(
+                    f,
+                    "version {version} is not greater than the current version {current}"
+                )
+            }
+            Error::CompactionStale { version, current } => {
+                write!(
+                    f,
+                    "compaction of version {version} is stale (current version {current})"
+                )
+            }
+            Error::WaitTimedOut { version, current } => {
+                write!(
+                    f,
+                    "timed out waiting for version {version} (current version {current})"
+                )
+            }
+            Error::QueryLimitExceeded { limit } => {
+                write!(f, "query matched more than {limit} entries")
+            }
+            Error::ScanLimitExceeded { limit } => {
+                write!(f, "scan visited more than {limit} entries")
+            }
+            Error::KeysOutOfOrder { key } => {
+                write!(f, "key {key:?} is not greater than the key before it")
+            }
+            Error::FreezeTimedOut { waited } => {
+                write!(
+                    f,
+                    "commit gave up after waiting {waited:?} for the database to be unfrozen"
+                )
+            }
+            Error::LockTimedOut { waited } => {
+                write!(
+                    f,
+                    "gave up after waiting {waited:?} for another handle to release the database file lock"
+                )
+            }
+            Error::UpgradeRequired { version, current } => {
+                write!(
+                    f,
+                    "database file is in format version {version}; upgrade to version {current} before writing"
+                )
+            }
+            Error::IncompatibleVersion { found, supported } => {
+                write!(
+                    f,
+                    "database file is in format version {found}, but this release reads versions up to {supported}"
+                )
+            }
+            Error::StatsNameTaken { name } => {
+                write!(f, "stats already published under {name:?}")
+            }
+            Error::AuditWrite { version, source } => {
+                write!(
+                    f,
+                    "failed to write audit record for version {version}: {source}"
+                )
+            }
             Error::KeyNotFound => write!(f, "key not found"),
             Error::BucketNotFound { name } => {
                 write!(f, "bucket not found: {:?}", String::from_utf8_lossy(name))
@@ -229,16 +421,49 @@ impl fmt::Display for Error {
                     String::from_utf8_lossy(name)
                 )
             }
+            Error::BucketNotEmpty { name } => {
+                write!(
+                    f,
+                    "bucket is not empty: {:?}",
+                    String::from_utf8_lossy(name)
+                )
+            }
+            Error::SequenceExhausted { name } => {
+                write!(
+                    f,
+                    "sequence of bucket {:?} is exhausted",
+                    String::from_utf8_lossy(name)
+                )
+            }
             Error::InvalidBucketName { reason } => {
                 write!(f, "invalid bucket name: {reason}")
             }
             Error::DatabaseAlreadyOpen => write!(f, "database is already open"),
+            Error::ReadOnly => write!(f, "database is opened read-only"),
+            Error::InvalidExport { offset, reason } => {
+                write!(f, "invalid export document at byte {offset}: {reason}")
+            }
+            Error::InvalidCsv { line, reason } => {
+                write!(f, "invalid CSV at line {line}: {reason}")
+            }
+            Error::MergeOperatorMissing => write!(
+                f,
+                "cannot merge: the database was opened without a merge_operator"
+            ),
             Error::PageSizeMismatch { expected, actual } => {
                 write!(
                     f,
-                    "page size mismatch: expected {expected} bytes, found {actual} bytes"
+                    "page size mismatch: expected {expected} bytes, found {actual} bytes; \
+                     the file was created with {actual}-byte pages, open it with that page size"
                 )
             }
+            Error::InvalidKey { reason } => write!(f, "invalid encryption key: {reason}"),
+            Error::EncryptionUnsupported { feature } => {
+                write!(f, "{feature} is not supported for encrypted databases")
+            }
+            Error::InMemoryUnsupported { feature } => {
+                write!(f, "{feature} is not supported for in-memory databases")
+            }
             Error::Io(err) => write!(f, "I/O error: {err}"),
 
             // Phase 3: I/O Stack Errors
@@ -289,6 +514,11 @@ impl fmt::Display for Error {
             Error::GroupCommitFailed { reason } => {
                 write!(f, "group commit failed: {reason}")
             }
+            Error::NestedTransaction => write!(
+                f,
+                "an update waited for the background committer running it; \
+                 apply nested writes to the write transaction it was given"
+            ),
         }
     }
 }
@@ -302,6 +532,9 @@ impl std::error::Error for Error {
             Error::FileRead { source, .. } => Some(source),
             Error::FileWrite { source, .. } => Some(source),
             Error::FileSync { source, .. } => Some(source),
+            Error::FileRename { source, .. } => Some(source),
+            Error::FileLock { source, .. } => Some(source),
+            Error::AuditWrite { source, .. } => Some(source),
             Error::EntryReadFailed { source, .. } => Some(source),
             Error::TxCommitFailed { source, .. } => source
                 .as_ref()
@@ -0,0 +1,197 @@
+//! Summary: Per-key expiry for bucket entries.
+//! Copyright (c) YOAB. All rights reserved.
+//!
+//! `WriteTx::bucket_put_with_ttl()` stores a value together with a deadline.
+//! Once the deadline passes, reads through buckets treat the key as absent:
+//! `get()`, the bucket iterators and cursors skip it, as do `bucket_get()`
+//! and the other bucket reads of transactions. A TTL of zero expires the key
+//! immediately.
+//!
+//! Writing the key again with `bucket_put()` removes its deadline, and
+//! deleting the key or its bucket removes the deadline with it.
+//!
+//! # Reclaiming Expired Entries
+//!
+//! Expired entries stay in the file until they are deleted.
+//! `Database::purge_expired()` deletes them in one transaction. With
+//! `DatabaseOptions::expiry_interval` set, commits purge them whenever the
+//! interval has passed since the last purge, and a `BackgroundCommitter`
+//! also purges on its own thread while idle, so the file does not grow
+//! with entries nobody can read.
+//!
+//! # Format
+//!
+//! The deadline of a bucket entry is stored in a companion entry under the
+//! internal key `[EXPIRY_PREFIX][data key]`, as microseconds since the Unix
+//! epoch in 8 little-endian bytes. Entries without a companion never
+//! expire. Reads only look up companions when the tree holds any, so
+//! databases that never use TTLs pay nothing for them.
+
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+use crate::btree::BTree;
+
+/// Magic prefix byte for expiry entries.
+const EXPIRY_PREFIX: u8 = 0x07;
+
+/// Creates the internal key holding the deadline of the entry `key`.
+#[inline]
+pub fn expiry_key(key: &[u8]) -> Vec<u8> {
+    let mut ek = Vec::with_capacity(1 + key.len());
+    ek.push(EXPIRY_PREFIX);
+    ek.extend_from_slice(key);
+    ek
+}
+
+/// Returns true if `key` is an expiry entry key.
+#[inline]
+pub fn is_expiry_key(key: &[u8]) -> bool {
+    key.first() == Some(&EXPIRY_PREFIX)
+}
+
+/// Returns the key of the entry an expiry entry key belongs to, or `None`
+/// if `key` is not an expiry entry key.
+#[inline]
+pub fn entry_key_of(key: &[u8]) -> Option<&[u8]> {
+    is_expiry_key(key).then(|| &key[1..])
+}
+
+/// Returns `time` as microseconds since the Unix epoch.
+fn to_micros(time: SystemTime) -> u64 {
+    time.duration_since(UNIX_EPOCH)
+        .map_or(0, |d| d.as_micros().min(u64::MAX as u128) as u64)
+}
+
+/// Encodes the deadline `ttl` from now as an expiry entry value.
+pub fn encode_deadline(ttl: Duration) -> Vec<u8> {
+    let deadline = to_micros(SystemTime::now()).saturating_add(ttl.as_micros() as u64);
+    deadline.to_le_bytes().to_vec()
+}
+
+/// Returns whether an expiry entry value lies at or before `now`.
+///
+/// A malformed value counts as expired, so a damaged deadline can only
+/// hide an entry early, never keep it alive.
+fn is_past(value: &[u8], now: u64) -> bool {
+    <[u8; 8]>::try_from(value).map_or(true, |bytes| u64::from_le_bytes(bytes) <= now)
+}
+
+/// Returns whether `tree` holds any expiry entries.
+fn has_expiry_entries(tree: &BTree) -> bool {
+    tree.cursor()
+        .seek(&[EXPIRY_PREFIX])
+        .is_some_and(|(key, _)| is_expiry_key(key))
+}
+
+/// Expiry checks against a tree, as of a fixed instant.
+///
+/// Taken when a read starts, so every entry it returns was live at that
+/// instant.
+#[derive(Debug, Clone, Copy)]
+pub(crate) struct ExpiryCheck<'a> {
+    /// The tree to look deadlines up in; `None` if it holds none.
+    tree: Option<&'a BTree>,
+    /// The instant checked against, in microseconds since the epoch.
+    now: u64,
+}
+
+impl<'a> ExpiryCheck<'a> {
+    /// Creates a check of the deadlines in `tree` as of now.
+    pub(crate) fn new(tree: &'a BTree) -> Self {
+        Self {
+            tree: has_expiry_entries(tree).then_some(tree),
+            now: to_micros(SystemTime::now()),
+        }
+    }
+
+    /// Returns the same check as of now.
+    ///
+    /// Cheaper than [`new()`](Self::new) since whether the tree holds
+    /// deadlines is already known; free if it holds none.
+    #[inline]
+    pub(crate) fn refreshed(self) -> Self {
+        if !self.is_active() {
+            return self;
+        }
+        Self {
+            tree: self.tree,
+            now: to_micros(SystemTime::now()),
+        }
+    }
+
+    /// Returns whether the tree holds any deadlines to check.
+    #[inline]
+    pub(crate) fn is_active(&self) -> bool {
+        self.tree.is_some()
+    }
+
+    /// Returns whether the entry stored under `key` has expired.
+    #[inline]
+    pub(crate) fn is_expired(&self, key: &[u8]) -> bool {
+        self.tree
+            .and_then(|tree| tree.get(&expiry_key(key)))
+            .is_some_and(|value| is_past(value, self.now))
+    }
+
+    /// Returns whether the entry stored under `key` has expired as of now.
+    ///
+    /// Like `refreshed().is_expired(key)`, but reads the clock only if the
+    /// entry has a deadline.
+    #[inline]
+    pub(crate) fn is_expired_now(&self, key: &[u8]) -> bool {
+        self.tree
+            .and_then(|tree| tree.get(&expiry_key(key)))
+            .is_some_and(|value| is_past(value, to_micros(SystemTime::now())))
+    }
+}
+
+/// Returns the keys of the expired entries in `tree`, in key order.
+pub(crate) fn expired_keys(tree: &BTree) -> Vec<Vec<u8>> {
+    let now = to_micros(SystemTime::now());
+    let mut cursor = tree.cursor();
+    let mut expired = Vec::new();
+    let mut entry = cursor.seek(&[EXPIRY_PREFIX]);
+    while let Some((key, value)) = entry.filter(|(key, _)| is_expiry_key(key)) {
+        if is_past(value, now) {
+            expired.extend(entry_key_of(key).map(<[u8]>::to_vec));
+        }
+        entry = cursor.next();
+    }
+    expired
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_expiry_check() {
+        let mut tree = BTree::new();
+        tree.insert(b"a".to_vec(), b"1".to_vec());
+        assert!(!ExpiryCheck::new(&tree).is_expired(b"a"));
+
+        tree.insert(b"b".to_vec(), b"2".to_vec());
+        tree.insert(expiry_key(b"b"), encode_deadline(Duration::ZERO));
+        tree.insert(b"c".to_vec(), b"3".to_vec());
+        tree.insert(expiry_key(b"c"), encode_deadline(Duration::from_secs(3600)));
+
+        let check = ExpiryCheck::new(&tree);
+        assert!(!check.is_expired(b"a"));
+        assert!(check.is_expired(b"b"));
+        assert!(!check.is_expired(b"c"));
+        assert!(check.is_expired_now(b"b"));
+        assert!(!check.is_expired_now(b"a"));
+        assert_eq!(expired_keys(&tree), vec![b"b".to_vec()]);
+
+        // A check of a tree without deadlines never reads the clock again.
+        let empty = BTree::new();
+        let idle = ExpiryCheck::new(&empty);
+        assert_eq!(idle.refreshed().now, idle.now);
+
+        // A damaged deadline hides the entry rather than keeping it.
+        tree.insert(expiry_key(b"a"), b"bad".to_vec());
+        assert!(ExpiryCheck::new(&tree).is_expired(b"a"));
+        assert_eq!(entry_key_of(&expiry_key(b"a")), Some(&b"a"[..]));
+        assert!(!is_expiry_key(b"a"));
+    }
+}
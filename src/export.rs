@@ -0,0 +1,547 @@
+//! Summary: Portable JSON dumps of a database's buckets.
+//! Copyright (c) YOAB. All rights reserved.
+//!
+//! `Database::export_json()` writes every bucket, nested buckets included,
+//! with its key/value pairs as one JSON document, and
+//! `Database::import_json()` writes such a document back into a database.
+//! The dump is meant for debugging and for moving data between versions or
+//! settings, such as a different page size or encryption key.
+//!
+//! # Format
+//!
+//! Names, keys and values are arbitrary bytes, so they are written as
+//! standard base64 strings with padding. Entries are listed in key order,
+//! one per line:
+//!
+//! ```text
+//! {"format":"thunder-export","version":1,"buckets":[
+//! {"name":"dXNlcnM=","entries":[
+//! ["YWxpY2U=","MQ=="],
+//! ["Ym9i","Mg=="]
+//! ],"buckets":[
+//! {"name":"cHJlZnM=","entries":[],"buckets":[]}
+//! ]}
+//! ]}
+//! ```
+//!
+//! Import accepts any whitespace and field order, except that a bucket's
+//! `name` must come before its `entries` and `buckets`.
+//!
+//! # What Is Exported
+//!
+//! Only bucket contents: keys written outside buckets with `WriteTx::put`
+//! share the key space with the database's own bookkeeping and are not
+//! exported, and neither are bucket settings such as sequences, key limits
+//! or TTLs. Entries already past their TTL are skipped.
+//!
+//! # Memory
+//!
+//! Export writes each entry as it is visited, so the document is never
+//! held in memory. Import reads it as a stream and commits every
+//! [`IMPORT_BATCH_BYTES`] of keys and values, so it is not atomic: a
+//! failed import leaves the batches committed before the failure.
+
+use std::io::{self, BufRead, BufReader, BufWriter, Read, Write};
+
+use crate::btree::BTree;
+use crate::bucket::{self, BucketRef, NestedBucketRef};
+use crate::db::Database;
+use crate::error::{Error, Result};
+
+/// Bytes of keys and values imported per write transaction.
+pub const IMPORT_BATCH_BYTES: usize = 8 * 1024 * 1024;
+
+/// The `format` field of an export document.
+const FORMAT: &str = "thunder-export";
+
+/// The `version` field of an export document.
+const VERSION: u64 = 1;
+
+/// Writes every bucket in `tree` to `writer` as an export document.
+pub(crate) fn export_json<W: Write>(tree: &BTree, writer: W) -> Result<()> {
+    let mut out = BufWriter::new(writer);
+    write!(
+        out,
+        "{{\"format\":\"{FORMAT}\",\"version\":{VERSION},\"buckets\":["
+    )?;
+    let mut scratch = String::new();
+    for (i, name) in bucket::list_buckets(tree).iter().enumerate() {
+        if i > 0 {
+            out.write_all(b",")?;
+        }
+        let bucket = BucketRef::new(tree, name)?;
+        write_bucket(tree, &mut out, &mut scratch, &[name], bucket.iter())?;
+    }
+    out.write_all(b"\n]}\n")?;
+    out.flush()?;
+    Ok(())
+}
+
+/// Writes one bucket object: its name, entries and sub-buckets.
+fn write_bucket<'a, W: Write>(
+    tree: &BTree,
+    out: &mut W,
+    scratch: &mut String,
+    path: &[&[u8]],
+    entries: impl Iterator<Item = (&'a [u8], &'a [u8])>,
+) -> Result<()> {
+    out.write_all(b"\n{\"name\":")?;
+    write_base64(out, scratch, path[path.len() - 1])?;
+    out.write_all(b",\"entries\":[")?;
+    for (i, (key, value)) in entries.enumerate() {
+        out.write_all(if i > 0 { b",\n[" } else { b"\n[" })?;
+        write_base64(out, scratch, key)?;
+        out.write_all(b",")?;
+        write_base64(out, scratch, value)?;
+        out.write_all(b"]")?;
+    }
+    out.write_all(b"\n],\"buckets\":[")?;
+    for (i, child) in bucket::list_nested_buckets(tree, path).iter().enumerate() {
+        if i > 0 {
+            out.write_all(b",")?;
+        }
+        let mut child_path = path.to_vec();
+        child_path.push(child);
+        let nested = NestedBucketRef::new(tree, &child_path)?;
+        write_bucket(tree, out, scratch, &child_path, nested.iter())?;
+    }
+    out.write_all(b"\n]}")?;
+    Ok(())
+}
+
+/// Writes `bytes` as a quoted base64 string.
+fn write_base64<W: Write>(out: &mut W, scratch: &mut String, bytes: &[u8]) -> io::Result<()> {
+    scratch.clear();
+    scratch.push('"');
+    encode_base64(bytes, scratch);
+    scratch.push('"');
+    out.write_all(scratch.as_bytes())
+}
+
+/// Reads an export document from `reader` into `db`, returning the number
+/// of entries written.
+pub(crate) fn import_json<R: Read>(db: &mut Database, reader: R) -> Result<u64> {
+    let mut importer = Importer {
+        json: JsonReader::new(BufReader::new(reader)),
+        batch: Vec::new(),
+        batch_bytes: 0,
+        imported: 0,
+    };
+
+    importer.json.expect(b'{')?;
+    let mut first = true;
+    while let Some(field) = importer.json.next_field(&mut first)? {
+        match field.as_str() {
+            "format" => {
+                let format = importer.json.string()?;
+                if format != FORMAT {
+                    return Err(importer.json.invalid(format!("unknown format {format:?}")));
+                }
+            }
+            "version" => {
+                let version = importer.json.number()?;
+                if version != VERSION {
+                    return Err(importer
+                        .json
+                        .invalid(format!("unsupported version {version}")));
+                }
+            }
+            "buckets" => importer.buckets(db, &[])?,
+            other => return Err(importer.json.invalid(format!("unknown field {other:?}"))),
+        }
+    }
+    importer.json.end()?;
+    importer.flush(db)?;
+    Ok(importer.imported)
+}
+
+/// A bucket path and the entries to write into it.
+type PendingBucket = (Vec<Vec<u8>>, Vec<(Vec<u8>, Vec<u8>)>);
+
+/// Streams bucket objects into batched write transactions.
+struct Importer<R> {
+    json: JsonReader<R>,
+    /// Buckets to create and the entries to write into them, in order.
+    batch: Vec<PendingBucket>,
+    /// Bytes of keys and values in `batch`.
+    batch_bytes: usize,
+    imported: u64,
+}
+
+impl<R: BufRead> Importer<R> {
+    /// Reads an array of bucket objects under `parent`.
+    fn buckets(&mut self, db: &mut Database, parent: &[Vec<u8>]) -> Result<()> {
+        self.json.expect(b'[')?;
+        let mut first = true;
+        while self.json.next_element(&mut first)? {
+            self.bucket(db, parent)?;
+        }
+        Ok(())
+    }
+
+    /// Reads one bucket object under `parent`.
+    fn bucket(&mut self, db: &mut Database, parent: &[Vec<u8>]) -> Result<()> {
+        self.json.expect(b'{')?;
+        let mut first = true;
+        if self.json.next_field(&mut first)?.as_deref() != Some("name") {
+            return Err(self.json.invalid("bucket object must start with its name"));
+        }
+        let mut path = parent.to_vec();
+        path.push(self.json.base64()?);
+        self.batch.push((path.clone(), Vec::new()));
+
+        while let Some(field) = self.json.next_field(&mut first)? {
+            match field.as_str() {
+                "entries" => self.entries(db, &path)?,
+                "buckets" => self.buckets(db, &path)?,
+                other => return Err(self.json.invalid(format!("unknown field {other:?}"))),
+            }
+        }
+        Ok(())
+    }
+
+    /// Reads an array of `[key, value]` pairs into the bucket at `path`.
+    fn entries(&mut self, db: &mut Database, path: &[Vec<u8>]) -> Result<()> {
+        self.json.expect(b'[')?;
+        let mut first = true;
+        while self.json.next_element(&mut first)? {
+            self.json.expect(b'[')?;
+            let key = self.json.base64()?;
+            self.json.expect(b',')?;
+            let value = self.json.base64()?;
+            self.json.expect(b']')?;
+
+            if self.batch_bytes >= IMPORT_BATCH_BYTES {
+                self.flush(db)?;
+                self.batch.push((path.to_vec(), Vec::new()));
+            }
+            self.batch_bytes += key.len() + value.len();
+            if let Some((_, entries)) = self.batch.last_mut() {
+                entries.push((key, value));
+            }
+        }
+        Ok(())
+    }
+
+    /// Commits the batch, creating its buckets where missing.
+    fn flush(&mut self, db: &mut Database) -> Result<()> {
+        if self.batch.is_empty() {
+            return Ok(());
+        }
+        let mut wtx = db.write_tx();
+        for (path, entries) in self.batch.drain(..) {
+            let path: Vec<&[u8]> = path.iter().map(Vec::as_slice).collect();
+            if let [name] = path[..] {
+                wtx.create_bucket_if_not_exists(name)?;
+                for (key, value) in &entries {
+                    wtx.bucket_put(name, key, value)?;
+                }
+            } else {
+                let (child, parent) = path.split_last().expect("bucket paths are not empty");
+                if !wtx.nested_bucket_exists_at_path(&path) {
+                    wtx.create_nested_bucket_at_path(parent, child)?;
+                }
+                for (key, value) in &entries {
+                    wtx.nested_bucket_put_at_path(&path, key, value)?;
+                }
+            }
+            self.imported += entries.len() as u64;
+        }
+        wtx.commit()?;
+        self.batch_bytes = 0;
+        Ok(())
+    }
+}
+
+/// A pull parser for the subset of JSON export documents use.
+struct JsonReader<R> {
+    reader: R,
+    /// Bytes consumed so far, for error messages.
+    offset: u64,
+}
+
+impl<R: BufRead> JsonReader<R> {
+    fn new(reader: R) -> Self {
+        Self { reader, offset: 0 }
+    }
+
+    /// Returns an `InvalidExport` error at the current offset.
+    fn invalid(&self, reason: impl Into<String>) -> Error {
+        Error::InvalidExport {
+            offset: self.offset,
+            reason: reason.into(),
+        }
+    }
+
+    /// Returns the next byte without consuming it.
+    fn peek(&mut self) -> Result<Option<u8>> {
+        Ok(self.reader.fill_buf()?.first().copied())
+    }
+
+    /// Consumes and returns the next byte.
+    fn byte(&mut self) -> Result<u8> {
+        let byte = self
+            .peek()?
+            .ok_or_else(|| self.invalid("unexpected end of document"))?;
+        self.reader.consume(1);
+        self.offset += 1;
+        Ok(byte)
+    }
+
+    /// Skips whitespace and returns the next byte without consuming it.
+    fn peek_token(&mut self) -> Result<Option<u8>> {
+        while let Some(byte) = self.peek()? {
+            if !matches!(byte, b' ' | b'\t' | b'\n' | b'\r') {
+                return Ok(Some(byte));
+            }
+            self.reader.consume(1);
+            self.offset += 1;
+        }
+        Ok(None)
+    }
+
+    /// Consumes `expected`, after any whitespace.
+    fn expect(&mut self, expected: u8) -> Result<()> {
+        self.peek_token()?;
+        let byte = self.byte()?;
+        if byte != expected {
+            return Err(self.invalid(format!(
+                "expected '{}', found '{}'",
+                expected as char,
+                byte.escape_ascii()
+            )));
+        }
+        Ok(())
+    }
+
+    /// Checks that only whitespace remains.
+    fn end(&mut self) -> Result<()> {
+        match self.peek_token()? {
+            None => Ok(()),
+            Some(_) => Err(self.invalid("trailing data after document")),
+        }
+    }
+
+    /// Moves to the next field of an object whose `{` was consumed,
+    /// returning its name, or `None` once the closing `}` is consumed.
+    fn next_field(&mut self, first: &mut bool) -> Result<Option<String>> {
+        if !self.next_element_or(b'}', first)? {
+            return Ok(None);
+        }
+        let name = self.string()?;
+        self.expect(b':')?;
+        Ok(Some(name))
+    }
+
+    /// Moves to the next element of an array whose `[` was consumed,
+    /// returning `false` once the closing `]` is consumed.
+    fn next_element(&mut self, first: &mut bool) -> Result<bool> {
+        self.next_element_or(b']', first)
+    }
+
+    fn next_element_or(&mut self, close: u8, first: &mut bool) -> Result<bool> {
+        if self.peek_token()? == Some(close) {
+            self.byte()?;
+            return Ok(false);
+        }
+        if !*first {
+            self.expect(b',')?;
+        }
+        *first = false;
+        Ok(true)
+    }
+
+    /// Reads a non-negative integer.
+    fn number(&mut self) -> Result<u64> {
+        self.peek_token()?;
+        let mut value: u64 = 0;
+        let mut digits = 0;
+        while let Some(byte @ b'0'..=b'9') = self.peek()? {
+            self.byte()?;
+            value = value
+                .checked_mul(10)
+                .and_then(|v| v.checked_add(u64::from(byte - b'0')))
+                .ok_or_else(|| self.invalid("number out of range"))?;
+            digits += 1;
+        }
+        if digits == 0 {
+            return Err(self.invalid("expected a number"));
+        }
+        Ok(value)
+    }
+
+    /// Reads a string.
+    fn string(&mut self) -> Result<String> {
+        self.expect(b'"')?;
+        let mut bytes = Vec::new();
+        loop {
+            match self.byte()? {
+                b'"' => break,
+                b'\\' => {
+                    let escaped = match self.byte()? {
+                        b'"' => '"',
+                        b'\\' => '\\',
+                        b'/' => '/',
+                        b'b' => '\u{8}',
+                        b'f' => '\u{c}',
+                        b'n' => '\n',
+                        b'r' => '\r',
+                        b't' => '\t',
+                        b'u' => self.unicode_escape()?,
+                        other => {
+                            return Err(self
+                                .invalid(format!("invalid escape '\\{}'", other.escape_ascii())));
+                        }
+                    };
+                    let mut buf = [0u8; 4];
+                    bytes.extend_from_slice(escaped.encode_utf8(&mut buf).as_bytes());
+                }
+                byte => bytes.push(byte),
+            }
+        }
+        String::from_utf8(bytes).map_err(|_| self.invalid("string is not valid UTF-8"))
+    }
+
+    /// Reads the code point of a `\u` escape, including a surrogate pair.
+    fn unicode_escape(&mut self) -> Result<char> {
+        let high = self.hex4()?;
+        let code = if (0xD800..0xDC00).contains(&high) {
+            if self.byte()? != b'\\' || self.byte()? != b'u' {
+                return Err(self.invalid("unpaired surrogate in string"));
+            }
+            let low = self.hex4()?;
+            if !(0xDC00..0xE000).contains(&low) {
+                return Err(self.invalid("unpaired surrogate in string"));
+            }
+            0x10000 + ((high - 0xD800) << 10) + (low - 0xDC00)
+        } else {
+            high
+        };
+        char::from_u32(code).ok_or_else(|| self.invalid("invalid code point in string"))
+    }
+
+    fn hex4(&mut self) -> Result<u32> {
+        let mut code = 0;
+        for _ in 0..4 {
+            let byte = self.byte()?;
+            let digit = (byte as char)
+                .to_digit(16)
+                .ok_or_else(|| self.invalid("invalid \\u escape"))?;
+            code = code * 16 + digit;
+        }
+        Ok(code)
+    }
+
+    /// Reads a base64 string and decodes it.
+    fn base64(&mut self) -> Result<Vec<u8>> {
+        let text = self.string()?;
+        decode_base64(&text).ok_or_else(|| self.invalid("invalid base64 string"))
+    }
+}
+
+const BASE64_ALPHABET: &[u8; 64] =
+    b"ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/";
+
+/// Appends the standard base64 encoding of `bytes`, with padding.
+fn encode_base64(bytes: &[u8], out: &mut String) {
+    out.reserve(bytes.len().div_ceil(3) * 4);
+    for chunk in bytes.chunks(3) {
+        let n = (u32::from(chunk[0]) << 16)
+            | (u32::from(*chunk.get(1).unwrap_or(&0)) << 8)
+            | u32::from(*chunk.get(2).unwrap_or(&0));
+        for i in 0..4 {
+            if i <= chunk.len() {
+                out.push(BASE64_ALPHABET[(n >> (18 - 6 * i)) as usize & 63] as char);
+            } else {
+                out.push('=');
+            }
+        }
+    }
+}
+
+/// Decodes standard base64 with padding, or returns `None` if malformed.
+fn decode_base64(text: &str) -> Option<Vec<u8>> {
+    let bytes = text.as_bytes();
+    if !bytes.len().is_multiple_of(4) {
+        return None;
+    }
+    let mut out = Vec::with_capacity(bytes.len() / 4 * 3);
+    for (index, chunk) in bytes.chunks(4).enumerate() {
+        let last = index + 1 == bytes.len() / 4;
+        let padding = chunk.iter().rev().take_while(|&&b| b == b'=').count();
+        if padding > 2 || (padding > 0 && !last) {
+            return None;
+        }
+        let mut n: u32 = 0;
+        for &byte in &chunk[..4 - padding] {
+            let digit = match byte {
+                b'A'..=b'Z' => byte - b'A',
+                b'a'..=b'z' => byte - b'a' + 26,
+                b'0'..=b'9' => byte - b'0' + 52,
+                b'+' => 62,
+                b'/' => 63,
+                _ => return None,
+            };
+            n = (n << 6) | u32::from(digit);
+        }
+        n <<= 6 * padding as u32;
+        let decoded = [(n >> 16) as u8, (n >> 8) as u8, n as u8];
+        out.extend_from_slice(&decoded[..3 - padding]);
+    }
+    Some(out)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_base64_roundtrip() {
+        let cases: [(&[u8], &str); 5] = [
+            (b"", ""),
+            (b"f", "Zg=="),
+            (b"fo", "Zm8="),
+            (b"foo", "Zm9v"),
+            (&[0xFB, 0xFF, 0x00, 0x10], "+/8AEA=="),
+        ];
+        for (bytes, text) in cases {
+            let mut encoded = String::new();
+            encode_base64(bytes, &mut encoded);
+            assert_eq!(encoded, text);
+            assert_eq!(decode_base64(text).as_deref(), Some(bytes));
+        }
+        assert_eq!(decode_base64("Zg="), None);
+        assert_eq!(decode_base64("Zg==Zm8="), None);
+        assert_eq!(decode_base64("Z!=="), None);
+    }
+
+    #[test]
+    fn test_json_reader_strings_and_structure() {
+        let doc = br#" { "a\u00e9\n" : [ 1 , "x\"\\" ] } "#;
+        let mut json = JsonReader::new(&doc[..]);
+        json.expect(b'{').unwrap();
+        let mut first = true;
+        assert_eq!(
+            json.next_field(&mut first).unwrap().as_deref(),
+            Some("a\u{e9}\n")
+        );
+        json.expect(b'[').unwrap();
+        let mut first_element = true;
+        assert!(json.next_element(&mut first_element).unwrap());
+        assert_eq!(json.number().unwrap(), 1);
+        assert!(json.next_element(&mut first_element).unwrap());
+        assert_eq!(json.string().unwrap(), "x\"\\");
+        assert!(!json.next_element(&mut first_element).unwrap());
+        assert_eq!(json.next_field(&mut first).unwrap(), None);
+        json.end().unwrap();
+
+        let mut truncated = JsonReader::new(&br#"{"a":"#[..]);
+        truncated.expect(b'{').unwrap();
+        let mut first = true;
+        truncated.next_field(&mut first).unwrap();
+        assert!(matches!(
+            truncated.string(),
+            Err(Error::InvalidExport { offset: 5, .. })
+        ));
+    }
+}
@@ -22,7 +22,7 @@
 
 use std::collections::HashMap;
 use std::sync::atomic::{AtomicBool, AtomicU64, Ordering};
-use std::sync::{Mutex, OnceLock};
+use std::sync::{Arc, Mutex, OnceLock};
 
 /// Global failpoint registry singleton.
 static REGISTRY: OnceLock<FailpointRegistry> = OnceLock::new();
@@ -499,6 +499,116 @@ impl Drop for FailpointScopeGuard {
     }
 }
 
+// ============================================================================
+// Fault Injector (per database)
+// ============================================================================
+
+/// File operations a [`FaultInjector`] counts and can fail.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum FaultOp {
+    /// A write to the database file.
+    Write,
+    /// A sync of the database file.
+    Sync,
+}
+
+/// Fails the Nth write or sync of one database, simulating a crash there.
+///
+/// Unlike the global failpoints, which fire at named locations, an injector
+/// is set per database through `DatabaseOptions::fault_injector` and counts
+/// the writes and syncs the database issues to its file. Once it fires,
+/// every later write and sync fails too, since nothing reaches the disk
+/// after a crash. Drop the handle, or call `crash_for_testing()` to also
+/// lose unsynced writes, then reopen to check what survived.
+///
+/// Run a workload once with [`counting()`](Self::counting) to learn how many
+/// operations it issues, then once per offset to crash at each of them.
+///
+/// # Example
+///
+/// ```ignore
+/// let injector = FaultInjector::fail_nth(FaultOp::Write, 3);
+/// let options = DatabaseOptions {
+///     fault_injector: Some(injector.clone()),
+///     ..DatabaseOptions::default()
+/// };
+/// let mut db = Database::open_with_options(&path, options)?;
+/// assert!(load(&mut db).is_err());
+/// assert!(injector.fired());
+/// ```
+#[derive(Clone, Default)]
+pub struct FaultInjector(Arc<FaultState>);
+
+#[derive(Default)]
+struct FaultState {
+    /// The operation to fail and its 1-based position, if any.
+    target: Option<(FaultOp, u64)>,
+    writes: AtomicU64,
+    syncs: AtomicU64,
+    fired: AtomicBool,
+}
+
+impl FaultInjector {
+    /// Creates an injector that only counts operations.
+    pub fn counting() -> Self {
+        Self::default()
+    }
+
+    /// Creates an injector that fails the `n`th operation of kind `op`,
+    /// counting from 1, and every write and sync after it.
+    pub fn fail_nth(op: FaultOp, n: u64) -> Self {
+        Self(Arc::new(FaultState {
+            target: Some((op, n)),
+            ..FaultState::default()
+        }))
+    }
+
+    /// Returns the number of writes attempted so far.
+    pub fn writes(&self) -> u64 {
+        self.0.writes.load(Ordering::SeqCst)
+    }
+
+    /// Returns the number of syncs attempted so far.
+    pub fn syncs(&self) -> u64 {
+        self.0.syncs.load(Ordering::SeqCst)
+    }
+
+    /// Returns whether the injector has started failing operations.
+    pub fn fired(&self) -> bool {
+        self.0.fired.load(Ordering::SeqCst)
+    }
+
+    /// Counts an operation of kind `op`, failing it once the injector has
+    /// fired.
+    pub(crate) fn before(&self, op: FaultOp) -> std::io::Result<()> {
+        let counter = match op {
+            FaultOp::Write => &self.0.writes,
+            FaultOp::Sync => &self.0.syncs,
+        };
+        let count = counter.fetch_add(1, Ordering::SeqCst) + 1;
+        if self.0.target == Some((op, count)) {
+            self.0.fired.store(true, Ordering::SeqCst);
+        }
+        if self.fired() {
+            return Err(std::io::Error::other(format!(
+                "injected fault at {op:?} #{count}"
+            )));
+        }
+        Ok(())
+    }
+}
+
+impl std::fmt::Debug for FaultInjector {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_struct("FaultInjector")
+            .field("target", &self.0.target)
+            .field("writes", &self.writes())
+            .field("syncs", &self.syncs())
+            .field("fired", &self.fired())
+            .finish()
+    }
+}
+
 // ============================================================================
 // Random Failpoint Selector (for fuzzing)
 // ============================================================================
@@ -644,6 +754,27 @@ mod tests {
         assert!(registry.is_enabled("builder_test2"));
     }
 
+    #[test]
+    fn test_fault_injector_fails_nth_and_later() {
+        let injector = FaultInjector::fail_nth(FaultOp::Sync, 2);
+        assert!(injector.before(FaultOp::Write).is_ok());
+        assert!(injector.before(FaultOp::Sync).is_ok());
+        assert!(injector.before(FaultOp::Write).is_ok());
+        assert!(!injector.fired());
+
+        assert!(injector.before(FaultOp::Sync).is_err());
+        assert!(injector.fired());
+        assert!(injector.before(FaultOp::Write).is_err());
+        assert_eq!((injector.writes(), injector.syncs()), (3, 2));
+
+        let counting = FaultInjector::counting();
+        for _ in 0..10 {
+            assert!(counting.before(FaultOp::Write).is_ok());
+        }
+        assert_eq!(counting.writes(), 10);
+        assert!(!counting.fired());
+    }
+
     #[test]
     fn test_random_selector() {
         let mut selector = RandomFailpointSelector::new(12345);
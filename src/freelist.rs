@@ -4,9 +4,241 @@
 //! The freelist tracks pages that have been freed and can be reused.
 //! This enables efficient space reclamation when data is deleted,
 //! preventing unbounded file growth.
+//!
+//! # Freelist Types
+//!
+//! The overflow page allocator keeps its free pages in one of two
+//! structures, chosen with `DatabaseOptions::freelist_type`:
+//!
+//! - [`FreelistType::Array`] keeps a plain list of page IDs. It costs 8
+//!   bytes per free page, but runs of adjacent pages are only found after
+//!   `Database::defragment_freelist()` sorts the list, and each multi-page
+//!   allocation scans it.
+//! - [`FreelistType::HashMap`] indexes runs of adjacent pages by start,
+//!   end and length, merging neighbours as pages are freed. It costs
+//!   several times the memory, but finds a run in time independent of the
+//!   freelist's size, without sorting.
+//!
+//! The free pages are held in memory only and never written to the file,
+//! so the type can change between opens and opening never reads them.
 
 use crate::page::PageId;
-use std::collections::BTreeSet;
+use std::collections::{BTreeSet, HashMap, HashSet};
+
+/// How the free pages are indexed for allocation.
+///
+/// See the module documentation for the trade-offs.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub enum FreelistType {
+    /// A list of page IDs, sorted on demand.
+    #[default]
+    Array,
+    /// Runs of adjacent pages, indexed by position and length.
+    HashMap,
+}
+
+/// The free pages of an allocator, in the structure its
+/// [`FreelistType`] selects.
+#[derive(Debug)]
+pub(crate) enum FreePages {
+    Array {
+        pages: Vec<PageId>,
+        /// Whether `pages` is sorted in descending order without
+        /// duplicates, so contiguous runs can be found in it.
+        coalesced: bool,
+    },
+    HashMap(SpanIndex),
+}
+
+impl FreePages {
+    /// Creates an empty set of free pages of the given type.
+    pub(crate) fn new(kind: FreelistType) -> Self {
+        match kind {
+            FreelistType::Array => FreePages::Array {
+                pages: Vec::new(),
+                coalesced: true,
+            },
+            FreelistType::HashMap => FreePages::HashMap(SpanIndex::default()),
+        }
+    }
+
+    /// Returns the number of free pages.
+    pub(crate) fn len(&self) -> usize {
+        match self {
+            FreePages::Array { pages, .. } => pages.len(),
+            FreePages::HashMap(index) => index.pages.len(),
+        }
+    }
+
+    /// Returns the free pages, in no particular order.
+    pub(crate) fn to_vec(&self) -> Vec<PageId> {
+        match self {
+            FreePages::Array { pages, .. } => pages.clone(),
+            FreePages::HashMap(index) => {
+                let mut pages: Vec<PageId> = index.pages.iter().copied().collect();
+                pages.sort_unstable();
+                pages
+            }
+        }
+    }
+
+    /// Adds a page.
+    pub(crate) fn free(&mut self, page_id: PageId) {
+        match self {
+            FreePages::Array { pages, coalesced } => {
+                pages.push(page_id);
+                *coalesced = false;
+            }
+            FreePages::HashMap(index) => index.free(page_id),
+        }
+    }
+
+    /// Takes a single page.
+    pub(crate) fn allocate(&mut self) -> Option<PageId> {
+        match self {
+            FreePages::Array { pages, .. } => pages.pop(),
+            FreePages::HashMap(index) => index.allocate(1),
+        }
+    }
+
+    /// Takes `count` adjacent pages, returning the first, if a run that
+    /// long can be found.
+    ///
+    /// An array finds runs only once coalesced, taking the lowest; a hash
+    /// map takes the lowest of the shortest runs that fit.
+    pub(crate) fn allocate_run(&mut self, count: usize) -> Option<PageId> {
+        match self {
+            FreePages::Array { pages, coalesced } => {
+                if !*coalesced || count == 0 || count > pages.len() {
+                    return None;
+                }
+                // The list is descending, so scanning from its end visits
+                // pages in ascending order; a run ending at index `i` spans
+                // `i..i + count`.
+                let mut run_len = 0;
+                let mut found = None;
+                for i in (0..pages.len()).rev() {
+                    let extends = i + 1 < pages.len() && pages[i] == pages[i + 1] + 1;
+                    run_len = if extends { run_len + 1 } else { 1 };
+                    if run_len == count {
+                        found = Some(i);
+                        break;
+                    }
+                }
+                let top = found?;
+                let start = pages[top + count - 1];
+                pages.drain(top..top + count);
+                Some(start)
+            }
+            FreePages::HashMap(index) => index.allocate(count as u64),
+        }
+    }
+
+    /// Orders the free pages into contiguous runs, returning the number of
+    /// runs of two or more pages.
+    ///
+    /// An array is sorted and deduplicated; a hash map keeps its runs
+    /// merged already.
+    pub(crate) fn coalesce(&mut self) -> usize {
+        match self {
+            FreePages::Array { pages, coalesced } => {
+                pages.sort_unstable_by(|a, b| b.cmp(a));
+                pages.dedup();
+                *coalesced = true;
+
+                let mut runs = 0;
+                let mut run_len = 1;
+                for pair in pages.windows(2) {
+                    if pair[0] == pair[1] + 1 {
+                        run_len += 1;
+                        if run_len == 2 {
+                            runs += 1;
+                        }
+                    } else {
+                        run_len = 1;
+                    }
+                }
+                runs
+            }
+            FreePages::HashMap(index) => index.starts.values().filter(|&&len| len >= 2).count(),
+        }
+    }
+}
+
+/// Free pages grouped into maximal runs of adjacent pages.
+#[derive(Debug, Default)]
+pub(crate) struct SpanIndex {
+    /// Every free page, to ignore pages freed twice.
+    pages: HashSet<PageId>,
+    /// Run length by first page.
+    starts: HashMap<PageId, u64>,
+    /// Run length by last page.
+    ends: HashMap<PageId, u64>,
+    /// First pages of the runs of each length.
+    by_len: HashMap<u64, BTreeSet<PageId>>,
+}
+
+impl SpanIndex {
+    /// Adds a page, merging it with the runs on either side.
+    fn free(&mut self, page_id: PageId) {
+        if !self.pages.insert(page_id) {
+            return;
+        }
+        let mut start = page_id;
+        let mut len = 1;
+        if let Some(before) = page_id.checked_sub(1).and_then(|end| self.ends.get(&end)) {
+            let before = *before;
+            start -= before;
+            self.remove_span(start, before);
+            len += before;
+        }
+        if let Some(&after) = self.starts.get(&(page_id + 1)) {
+            self.remove_span(page_id + 1, after);
+            len += after;
+        }
+        self.add_span(start, len);
+    }
+
+    /// Takes the lowest of the shortest runs of at least `count` pages,
+    /// returning the first page taken.
+    fn allocate(&mut self, count: u64) -> Option<PageId> {
+        if count == 0 {
+            return None;
+        }
+        let len = self
+            .by_len
+            .keys()
+            .copied()
+            .filter(|&len| len >= count)
+            .min()?;
+        let start = *self.by_len[&len].first()?;
+        self.remove_span(start, len);
+        if len > count {
+            self.add_span(start + count, len - count);
+        }
+        for page in start..start + count {
+            self.pages.remove(&page);
+        }
+        Some(start)
+    }
+
+    fn add_span(&mut self, start: PageId, len: u64) {
+        self.starts.insert(start, len);
+        self.ends.insert(start + len - 1, len);
+        self.by_len.entry(len).or_default().insert(start);
+    }
+
+    fn remove_span(&mut self, start: PageId, len: u64) {
+        self.starts.remove(&start);
+        self.ends.remove(&(start + len - 1));
+        if let Some(starts) = self.by_len.get_mut(&len) {
+            starts.remove(&start);
+            if starts.is_empty() {
+                self.by_len.remove(&len);
+            }
+        }
+    }
+}
 
 /// A freelist for tracking available (freed) pages.
 ///
@@ -136,6 +368,26 @@ impl Default for FreeList {
 mod tests {
     use super::*;
 
+    #[test]
+    fn test_hashmap_free_pages_merge_and_split_runs() {
+        let mut pages = FreePages::new(FreelistType::HashMap);
+        for page in [3, 1, 2, 2, 9, 10, 6] {
+            pages.free(page);
+        }
+        // Runs 1..=3, 6 and 9..=10; the duplicate is ignored.
+        assert_eq!(pages.len(), 6);
+        assert_eq!(pages.coalesce(), 2);
+
+        // The shortest fitting run is taken, and a longer one is split.
+        assert_eq!(pages.allocate_run(2), Some(9));
+        assert_eq!(pages.allocate_run(2), Some(1));
+        assert_eq!(pages.allocate_run(2), None);
+        assert_eq!(pages.to_vec(), vec![3, 6]);
+        assert_eq!(pages.allocate(), Some(3));
+        assert_eq!(pages.allocate(), Some(6));
+        assert_eq!(pages.allocate(), None);
+    }
+
     #[test]
     fn test_freelist_basic_operations() {
         let mut fl = FreeList::new();
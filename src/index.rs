@@ -0,0 +1,212 @@
+//! Summary: Secondary indexes maintained alongside a bucket's records.
+//! Copyright (c) YOAB. All rights reserved.
+//!
+//! An [`Index`] pairs a primary bucket with an index bucket and a function
+//! extracting index keys from each record. Writing records through
+//! `Index::put()` and `Index::delete()` updates both buckets in the same
+//! write transaction, so the index commits or rolls back with the records
+//! it describes.
+//!
+//! # Format
+//!
+//! Each index key of a record is stored as one entry of the index bucket
+//! with key `[index_key_len:u32][index_key][primary_key]` and an empty
+//! value. The length prefix keeps index keys that are prefixes of one
+//! another apart, and lets a lookup collect every primary key of an index
+//! key with a single prefix scan.
+//!
+//! # Consistency
+//!
+//! The index is only kept in step with writes made through it: records
+//! written directly to the primary bucket are not indexed. Maintenance
+//! reads a record's previous value to remove its old index entries, so it
+//! relies on read-your-writes, which write transactions have unless
+//! `WriteTx::disable_read_your_writes()` was called.
+
+use std::fmt;
+use std::sync::Arc;
+
+use crate::error::Result;
+use crate::tx::{ReadTx, WriteTx};
+
+/// The boxed index key extraction function.
+type ExtractFn = dyn Fn(&[u8], &[u8]) -> Vec<Vec<u8>> + Send + Sync;
+
+/// A secondary index over a bucket.
+///
+/// The extractor maps a record's key and value to the index keys it
+/// should be found under; it may return none, or several. It must be
+/// deterministic, since deleting a record removes the index keys it
+/// returns for the stored value. Cloning is cheap (reference counted).
+///
+/// # Example
+///
+/// ```ignore
+/// let by_city = Index::new(b"users", b"users_by_city", |_, user| {
+///     vec![city_of(user).to_vec()]
+/// });
+///
+/// db.update(|wtx| {
+///     by_city.create(wtx)?;
+///     by_city.put(wtx, b"alice", &alice)
+/// })?;
+///
+/// let rtx = db.read_tx();
+/// let users = by_city.lookup(&rtx, b"Lisbon")?;
+/// ```
+#[derive(Clone)]
+pub struct Index {
+    bucket: Vec<u8>,
+    index_bucket: Vec<u8>,
+    extract: Arc<ExtractFn>,
+}
+
+impl Index {
+    /// Creates an index over `bucket`, stored in `index_bucket`.
+    pub fn new<F>(bucket: &[u8], index_bucket: &[u8], extract: F) -> Self
+    where
+        F: Fn(&[u8], &[u8]) -> Vec<Vec<u8>> + Send + Sync + 'static,
+    {
+        Self {
+            bucket: bucket.to_vec(),
+            index_bucket: index_bucket.to_vec(),
+            extract: Arc::new(extract),
+        }
+    }
+
+    /// Returns the name of the indexed bucket.
+    #[inline]
+    pub fn bucket(&self) -> &[u8] {
+        &self.bucket
+    }
+
+    /// Returns the name of the bucket holding the index entries.
+    #[inline]
+    pub fn index_bucket(&self) -> &[u8] {
+        &self.index_bucket
+    }
+
+    /// Creates the indexed bucket and the index bucket if they do not
+    /// exist.
+    ///
+    /// # Errors
+    ///
+    /// Returns `InvalidBucketName` if either name is invalid.
+    pub fn create(&self, wtx: &mut WriteTx<'_>) -> Result<()> {
+        wtx.create_bucket_if_not_exists(&self.bucket)?;
+        wtx.create_bucket_if_not_exists(&self.index_bucket)?;
+        Ok(())
+    }
+
+    /// Puts a record into the indexed bucket and updates its index
+    /// entries.
+    ///
+    /// Index keys of the record's previous value that `value` no longer
+    /// produces are removed.
+    ///
+    /// # Errors
+    ///
+    /// Returns `BucketNotFound` if either bucket does not exist.
+    pub fn put(&self, wtx: &mut WriteTx<'_>, key: &[u8], value: &[u8]) -> Result<()> {
+        let old = self.index_keys_of(wtx, key)?;
+        let new = self.index_keys(key, value);
+        for index_key in old.iter().filter(|k| !new.contains(k)) {
+            wtx.bucket_delete(&self.index_bucket, &entry_key(index_key, key))?;
+        }
+        for index_key in new.iter().filter(|k| !old.contains(k)) {
+            wtx.bucket_put(&self.index_bucket, &entry_key(index_key, key), &[])?;
+        }
+        wtx.bucket_put(&self.bucket, key, value)
+    }
+
+    /// Deletes a record from the indexed bucket along with all of its
+    /// index entries.
+    ///
+    /// Returns whether the record existed.
+    ///
+    /// # Errors
+    ///
+    /// Returns `BucketNotFound` if either bucket does not exist.
+    pub fn delete(&self, wtx: &mut WriteTx<'_>, key: &[u8]) -> Result<bool> {
+        let Some(value) = wtx.bucket_get(&self.bucket, key)? else {
+            return Ok(false);
+        };
+        for index_key in self.index_keys(key, &value) {
+            wtx.bucket_delete(&self.index_bucket, &entry_key(&index_key, key))?;
+        }
+        wtx.bucket_delete(&self.bucket, key)?;
+        Ok(true)
+    }
+
+    /// Returns the keys of the records indexed under `index_key`, in key
+    /// order.
+    ///
+    /// # Errors
+    ///
+    /// Returns `BucketNotFound` if the index bucket does not exist, or
+    /// `ScanLimitExceeded` if more records match than the transaction's
+    /// scan limit allows.
+    pub fn lookup(&self, rtx: &ReadTx<'_>, index_key: &[u8]) -> Result<Vec<Vec<u8>>> {
+        let prefix = entry_prefix(index_key);
+        let entries = rtx.bucket_get_prefix(&self.index_bucket, &prefix)?;
+        Ok(entries
+            .into_iter()
+            .map(|(mut entry, _)| entry.split_off(prefix.len()))
+            .collect())
+    }
+
+    /// Returns the distinct index keys of a record.
+    fn index_keys(&self, key: &[u8], value: &[u8]) -> Vec<Vec<u8>> {
+        let mut keys = (self.extract)(key, value);
+        keys.sort_unstable();
+        keys.dedup();
+        keys
+    }
+
+    /// Returns the index keys of the record currently stored under `key`.
+    fn index_keys_of(&self, wtx: &WriteTx<'_>, key: &[u8]) -> Result<Vec<Vec<u8>>> {
+        Ok(wtx
+            .bucket_get(&self.bucket, key)?
+            .map(|value| self.index_keys(key, &value))
+            .unwrap_or_default())
+    }
+}
+
+impl fmt::Debug for Index {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.debug_struct("Index")
+            .field("bucket", &String::from_utf8_lossy(&self.bucket))
+            .field("index_bucket", &String::from_utf8_lossy(&self.index_bucket))
+            .finish_non_exhaustive()
+    }
+}
+
+/// Creates the prefix shared by the entries of `index_key`.
+fn entry_prefix(index_key: &[u8]) -> Vec<u8> {
+    let mut prefix = Vec::with_capacity(4 + index_key.len());
+    prefix.extend_from_slice(&(index_key.len() as u32).to_be_bytes());
+    prefix.extend_from_slice(index_key);
+    prefix
+}
+
+/// Creates the index bucket key mapping `index_key` to `primary_key`.
+fn entry_key(index_key: &[u8], primary_key: &[u8]) -> Vec<u8> {
+    let mut key = entry_prefix(index_key);
+    key.extend_from_slice(primary_key);
+    key
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_entry_keys_separate_prefix_index_keys() {
+        let short = entry_key(b"ab", b"cd");
+        let long = entry_key(b"abc", b"d");
+        assert_ne!(short, long);
+        assert!(short.starts_with(&entry_prefix(b"ab")));
+        assert!(!long.starts_with(&entry_prefix(b"ab")));
+        assert_eq!(&short[entry_prefix(b"ab").len()..], b"cd");
+    }
+}
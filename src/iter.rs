@@ -5,6 +5,7 @@
 //! - `IterOptions`: Configuration for iterator behavior (prefetch hints, etc.)
 //! - `ScanMetrics`: Statistics collected during iteration
 //! - `MetricsIter`: Iterator wrapper that collects scan metrics
+//! - `VisibleIter`: Iterator wrapper that skips internal companion entries
 //!
 //! # Performance Considerations
 //!
@@ -324,6 +325,64 @@ where
     }
 }
 
+/// Iterator over the entries a read transaction exposes.
+///
+/// Skips the companion entries the database keeps alongside user entries:
+/// value checksums, original keys, bucket order entries and deadlines.
+pub struct VisibleIter<I> {
+    /// The underlying iterator.
+    inner: I,
+
+    /// Whether companion entries are skipped.
+    hide_companions: bool,
+}
+
+impl<I> VisibleIter<I> {
+    /// Creates an iterator that skips companion entries if
+    /// `hide_companions` is set.
+    pub(crate) fn new(inner: I, hide_companions: bool) -> Self {
+        Self {
+            inner,
+            hide_companions,
+        }
+    }
+}
+
+impl<'a, I> Iterator for VisibleIter<I>
+where
+    I: Iterator<Item = (&'a [u8], &'a [u8])>,
+{
+    type Item = (&'a [u8], &'a [u8]);
+
+    fn next(&mut self) -> Option<Self::Item> {
+        if !self.hide_companions {
+            return self.inner.next();
+        }
+        self.inner
+            .find(|(key, _)| !crate::bucket::is_internal_companion(key))
+    }
+
+    /// Delegates to the underlying iterator when nothing is skipped, so
+    /// `skip(n)` keeps hopping over whole leaves.
+    fn nth(&mut self, n: usize) -> Option<Self::Item> {
+        if !self.hide_companions {
+            return self.inner.nth(n);
+        }
+        for _ in 0..n {
+            self.next()?;
+        }
+        self.next()
+    }
+
+    fn size_hint(&self) -> (usize, Option<usize>) {
+        if self.hide_companions {
+            (0, self.inner.size_hint().1)
+        } else {
+            self.inner.size_hint()
+        }
+    }
+}
+
 #[cfg(test)]
 mod tests {
     use super::*;
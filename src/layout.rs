@@ -0,0 +1,428 @@
+//! Summary: Physical layout introspection for debugging.
+//! Copyright (c) YOAB. All rights reserved.
+//!
+//! Maps keys to the pages their entries occupy and describes individual
+//! pages of the database file, for correlating keys with the on-disk
+//! layout when diagnosing locality or corruption issues.
+//!
+//! Entries are not indexed by position, so both lookups walk the data
+//! section on disk. They are meant for diagnostics, not hot paths.
+//!
+//! # Page Classification
+//!
+//! - Pages before the data section hold the meta pages.
+//! - Pages overlapping the data section hold entries (`PageType::Leaf`).
+//!   An entry belongs to the page its first byte falls on.
+//! - Remaining pages up to the end of the file hold overflow values
+//!   (`PageType::Overflow`), including space left by superseded ones.
+//!
+//! # Allocation Map
+//!
+//! `Database::allocation_map()` classifies every byte of the file rather
+//! than whole pages: the meta pages, live entries attributed to the
+//! top-level bucket that owns them, compressed blocks, live overflow
+//! values, and free space. Free space covers superseded entries, overflow
+//! space no live value references and alignment padding. Freed overflow
+//! pages are only tracked in memory, so they show up as free space rather
+//! than as a persisted freelist.
+//!
+//! Ranges are byte ranges because entries are packed across page
+//! boundaries; [`AllocationRange::pages()`] gives the pages a range
+//! touches.
+
+use std::collections::HashMap;
+use std::fs::File;
+use std::io::{BufReader, Read, Seek, SeekFrom};
+use std::ops::Range;
+
+use crate::btree::BTree;
+use crate::bucket;
+use crate::checksum;
+use crate::compress::{self, BlockHeader, ValueHeader};
+use crate::encrypt::Cipher;
+use crate::error::{Error, Result};
+use crate::expiry;
+use crate::overflow::{OVERFLOW_HEADER_SIZE, OverflowHeader, OverflowManager, OverflowRef};
+use crate::page::{PAGE_SIZE, PageId, PageType};
+
+/// Buffer size for the data section scan.
+const SCAN_BUFFER_SIZE: usize = 256 * 1024;
+
+/// Description of a page in the database file.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct PageInfo {
+    /// The page id (byte offset divided by the page size).
+    pub page_id: PageId,
+    /// What the page holds.
+    pub page_type: PageType,
+    /// Number of entries whose first byte is on this page.
+    ///
+    /// Entries in a compressed block all count towards the page the block
+    /// starts on. Always zero for meta and overflow pages.
+    pub key_count: usize,
+    /// Whether any entry on this page is stored in a compressed block.
+    pub compressed: bool,
+}
+
+/// What a range of the database file holds.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum AllocationKind {
+    /// The meta pages and the entry count heading the data section.
+    Meta,
+    /// Live entries, with the top-level bucket owning them; `None` for
+    /// keys outside any bucket.
+    Entries { bucket: Option<Vec<u8>> },
+    /// A compressed block holding at least one live entry. Blocks may mix
+    /// buckets, so they are not attributed.
+    CompressedBlock,
+    /// A live overflow value, with the top-level bucket owning its key.
+    Overflow { bucket: Option<Vec<u8>> },
+    /// Space holding no live data.
+    Free,
+}
+
+/// A byte range of the database file and what it holds.
+///
+/// Returned by `Database::allocation_map()`.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct AllocationRange {
+    /// Offset of the first byte.
+    pub start: u64,
+    /// Offset just past the last byte.
+    pub end: u64,
+    /// What the range holds.
+    pub kind: AllocationKind,
+}
+
+impl AllocationRange {
+    /// Returns the size of the range in bytes.
+    #[inline]
+    pub fn size(&self) -> u64 {
+        self.end - self.start
+    }
+
+    /// Returns the pages the range touches.
+    pub fn pages(&self, page_size: usize) -> Range<PageId> {
+        let page_size = page_size as u64;
+        self.start / page_size..self.end.div_ceil(page_size)
+    }
+}
+
+/// Location of a persisted entry.
+#[derive(Debug, Clone, Copy)]
+pub(crate) struct EntryPos {
+    /// File offset of the entry, or of its block if compressed.
+    pub offset: u64,
+    /// Whether the entry is stored in a compressed block.
+    pub compressed: bool,
+}
+
+/// Walks the entries in the data section `[start, end)`, calling `f` with
+/// the position and key of each one.
+///
+/// `start` is the offset of the first entry, just past the entry count.
+///
+/// # Errors
+///
+/// Returns an I/O error if the data section cannot be read, or
+/// `Corrupted` if an entry or block is malformed.
+pub(crate) fn scan_entries<F>(
+    file: &File,
+    start: u64,
+    end: u64,
+    cipher: Option<&Cipher>,
+    mut f: F,
+) -> Result<()>
+where
+    F: FnMut(EntryPos, &[u8]),
+{
+    let mut reader = BufReader::with_capacity(SCAN_BUFFER_SIZE, file);
+    reader
+        .seek(SeekFrom::Start(start))
+        .map_err(|e| Error::FileSeek {
+            offset: start,
+            context: "seeking to data section for layout scan",
+            source: e,
+        })?;
+
+    let mut offset = start;
+    let mut key = Vec::new();
+    while offset < end {
+        let entry_offset = offset;
+        let key_len = read_u32(&mut reader, &mut offset)?;
+
+        if key_len == compress::BLOCK_MARKER {
+            let mut header_buf = [0u8; compress::BLOCK_HEADER_SIZE];
+            read_exact(&mut reader, &mut offset, &mut header_buf)?;
+            let header = BlockHeader::from_bytes(&header_buf);
+            let mut stored = vec![0u8; header.stored_len as usize];
+            read_exact(&mut reader, &mut offset, &mut stored)?;
+            let raw = header.decode(&stored, cipher)?;
+
+            let pos = EntryPos {
+                offset: entry_offset,
+                compressed: true,
+            };
+            let mut cursor = 0usize;
+            for _ in 0..header.entry_count {
+                let block_key = block_field(&raw, &mut cursor)?;
+                f(pos, block_key);
+                block_field(&raw, &mut cursor)?;
+            }
+            continue;
+        }
+
+        key.resize(key_len as usize, 0);
+        read_exact(&mut reader, &mut offset, &mut key)?;
+
+        let value_len = read_u32(&mut reader, &mut offset)?;
+        let skip = if value_len == OverflowRef::MARKER {
+            OverflowRef::SIZE as i64
+        } else if value_len == compress::VALUE_MARKER {
+            let mut header_buf = [0u8; compress::VALUE_HEADER_SIZE];
+            read_exact(&mut reader, &mut offset, &mut header_buf)?;
+            ValueHeader::from_bytes(&header_buf).stored_len as i64
+        } else {
+            value_len as i64
+        };
+        reader.seek_relative(skip).map_err(|e| Error::FileSeek {
+            offset,
+            context: "skipping value during layout scan",
+            source: e,
+        })?;
+        offset += skip as u64;
+
+        f(
+            EntryPos {
+                offset: entry_offset,
+                compressed: false,
+            },
+            &key,
+        );
+    }
+
+    Ok(())
+}
+
+fn read_exact(reader: &mut impl Read, offset: &mut u64, buf: &mut [u8]) -> Result<()> {
+    reader.read_exact(buf).map_err(|e| Error::FileRead {
+        offset: *offset,
+        len: buf.len(),
+        context: "reading data section for layout scan",
+        source: e,
+    })?;
+    *offset += buf.len() as u64;
+    Ok(())
+}
+
+fn read_u32(reader: &mut impl Read, offset: &mut u64) -> Result<u32> {
+    let mut buf = [0u8; 4];
+    read_exact(reader, offset, &mut buf)?;
+    Ok(u32::from_le_bytes(buf))
+}
+
+/// Reads one length-prefixed field from a decoded block.
+fn block_field<'a>(raw: &'a [u8], cursor: &mut usize) -> Result<&'a [u8]> {
+    let truncated = || Error::Corrupted {
+        context: "scanning compressed block",
+        details: "block entries are truncated".to_string(),
+    };
+    let len_bytes = raw.get(*cursor..*cursor + 4).ok_or_else(truncated)?;
+    let len = u32::from_le_bytes([len_bytes[0], len_bytes[1], len_bytes[2], len_bytes[3]]) as usize;
+    let field = raw
+        .get(*cursor + 4..*cursor + 4 + len)
+        .ok_or_else(truncated)?;
+    *cursor += 4 + len;
+    Ok(field)
+}
+
+/// Returns the top-level bucket owning a stored key.
+///
+/// Unlike `bucket::bucket_name_of_key()`, also covers nested buckets and
+/// value checksums.
+fn owning_bucket(key: &[u8]) -> Option<&[u8]> {
+    if checksum::is_checksum_key(key) || expiry::is_expiry_key(key) {
+        return owning_bucket(&key[1..]);
+    }
+    if let Some(name) = bucket::bucket_name_of_key(key) {
+        return Some(name);
+    }
+    if bucket::is_nested_bucket_meta_key(key) {
+        // [prefix][component_count][len1][name1]...
+        let len = *key.get(2)? as usize;
+        return key.get(3..3 + len);
+    }
+    bucket::split_data_key(key).and_then(|(path, _)| path.first().copied())
+}
+
+/// Returns the `(start, end)` byte ranges holding an overflow value.
+///
+/// Handles both the direct format, where the reference holds a byte
+/// offset, and page chains, where it holds the first page id.
+pub(crate) fn overflow_extents(
+    file: &File,
+    page_size: usize,
+    oref: OverflowRef,
+) -> Result<Vec<(u64, u64)>> {
+    let mut reader = file;
+    let mut read_at = |offset: u64, buf: &mut [u8]| -> Result<()> {
+        reader
+            .seek(SeekFrom::Start(offset))
+            .map_err(|e| Error::FileSeek {
+                offset,
+                context: "seeking to overflow value for allocation map",
+                source: e,
+            })?;
+        reader.read_exact(buf).map_err(|e| Error::FileRead {
+            offset,
+            len: buf.len(),
+            context: "reading overflow value for allocation map",
+            source: e,
+        })
+    };
+
+    if oref.start_page == 0 {
+        return Ok(Vec::new());
+    }
+    let mut magic = [0u8; 4];
+    if read_at(oref.start_page, &mut magic).is_ok()
+        && u32::from_le_bytes(magic) == OverflowManager::DIRECT_FORMAT_MAGIC
+    {
+        let len = OverflowManager::direct_buffer_size(oref.total_len as usize) as u64;
+        return Ok(vec![(oref.start_page, oref.start_page + len)]);
+    }
+
+    // Guards against cycles in a corrupted chain.
+    let max_pages = (oref.total_len as usize).div_ceil(page_size - OVERFLOW_HEADER_SIZE);
+    let mut extents = Vec::new();
+    let mut page = oref.start_page;
+    let mut header_buf = [0u8; OVERFLOW_HEADER_SIZE];
+    while page != 0 && extents.len() < max_pages {
+        let offset = page * page_size as u64;
+        read_at(offset, &mut header_buf)?;
+        let header = OverflowHeader::from_bytes(&header_buf).ok_or_else(|| Error::Corrupted {
+            context: "building allocation map",
+            details: format!("page {page} is not an overflow page"),
+        })?;
+        extents.push((offset, offset + page_size as u64));
+        page = header.next_page;
+    }
+    Ok(extents)
+}
+
+/// Classifies every byte of a database file.
+///
+/// `data_end` is the end of the data section, `tree` the committed state
+/// and `overflow_refs` the overflow references of its live values.
+/// Returns contiguous ranges covering `[0, file_len)`, with adjacent
+/// ranges of the same kind merged.
+///
+/// # Errors
+///
+/// Returns an I/O error if the file cannot be read, or `Corrupted` if the
+/// data section or an overflow chain is malformed.
+pub(crate) fn allocation_map(
+    file: &File,
+    page_size: usize,
+    data_end: u64,
+    file_len: u64,
+    tree: &BTree,
+    overflow_refs: &HashMap<Vec<u8>, OverflowRef>,
+    cipher: Option<&Cipher>,
+) -> Result<Vec<AllocationRange>> {
+    let section_start = 2 * PAGE_SIZE as u64 + 8;
+
+    // Stored items in file order, with the keys they hold.
+    let mut items: Vec<(EntryPos, Vec<Vec<u8>>)> = Vec::new();
+    scan_entries(
+        file,
+        section_start,
+        data_end,
+        cipher,
+        |pos, key| match items.last_mut() {
+            Some((last, keys)) if last.offset == pos.offset => keys.push(key.to_vec()),
+            _ => items.push((pos, vec![key.to_vec()])),
+        },
+    )?;
+
+    // Later copies of a key supersede earlier ones.
+    let mut last_copy: HashMap<&[u8], usize> = HashMap::new();
+    for (i, (_, keys)) in items.iter().enumerate() {
+        for key in keys {
+            last_copy.insert(key, i);
+        }
+    }
+    let is_live = |i: usize, key: &[u8]| last_copy.get(key) == Some(&i) && tree.get(key).is_some();
+
+    let mut ranges = vec![AllocationRange {
+        start: 0,
+        end: section_start,
+        kind: AllocationKind::Meta,
+    }];
+    for (i, (pos, keys)) in items.iter().enumerate() {
+        let end = items.get(i + 1).map_or(data_end, |(next, _)| next.offset);
+        let kind = if pos.compressed {
+            if keys.iter().any(|key| is_live(i, key)) {
+                AllocationKind::CompressedBlock
+            } else {
+                AllocationKind::Free
+            }
+        } else if is_live(i, &keys[0]) {
+            AllocationKind::Entries {
+                bucket: owning_bucket(&keys[0]).map(<[u8]>::to_vec),
+            }
+        } else {
+            AllocationKind::Free
+        };
+        ranges.push(AllocationRange {
+            start: pos.offset,
+            end,
+            kind,
+        });
+    }
+
+    for (key, oref) in overflow_refs {
+        if tree.get(key).is_none() {
+            continue;
+        }
+        let bucket = owning_bucket(key).map(<[u8]>::to_vec);
+        for (start, end) in overflow_extents(file, page_size, *oref)? {
+            ranges.push(AllocationRange {
+                start,
+                end,
+                kind: AllocationKind::Overflow {
+                    bucket: bucket.clone(),
+                },
+            });
+        }
+    }
+
+    // Lay the ranges end to end, filling gaps with free space. An earlier
+    // range keeps any bytes a later one overlaps.
+    ranges.sort_by_key(|range| range.start);
+    let mut map: Vec<AllocationRange> = Vec::with_capacity(ranges.len());
+    let mut covered = 0u64;
+    let push =
+        |map: &mut Vec<AllocationRange>, start: u64, end: u64, kind: AllocationKind| match map
+            .last_mut()
+        {
+            Some(last) if last.kind == kind => last.end = end,
+            _ => map.push(AllocationRange { start, end, kind }),
+        };
+    for range in ranges {
+        let start = range.start.max(covered);
+        let end = range.end.min(file_len);
+        if start >= end {
+            continue;
+        }
+        if start > covered {
+            push(&mut map, covered, start, AllocationKind::Free);
+        }
+        push(&mut map, start, end, range.kind);
+        covered = end;
+    }
+    if covered < file_len {
+        push(&mut map, covered, file_len, AllocationKind::Free);
+    }
+    Ok(map)
+}
@@ -3,32 +3,64 @@
 
 pub mod aligned;
 pub mod arena;
+pub mod audit;
+pub mod backup;
 pub mod bloom;
 pub mod btree;
 pub mod bucket;
+pub mod bulk;
+pub mod cancel;
+pub mod capacity;
+pub mod check;
 pub mod checkpoint;
+pub mod checksum;
 pub mod coalescer;
+pub mod committer;
+pub mod compaction;
+pub mod comparator;
+pub mod compress;
 pub mod concurrent;
+pub mod csv;
+pub mod cursor;
 pub mod db;
+pub mod encrypt;
 pub mod error;
+pub mod expiry;
+pub mod export;
 #[cfg(feature = "failpoint")]
 pub mod failpoint;
 pub mod freelist;
+pub mod freeze;
 pub mod group_commit;
+pub mod index;
 pub mod io_backend;
 pub mod iter;
 pub mod ivec;
+pub mod layout;
+pub mod logger;
+pub mod memory;
+pub mod merge;
 pub mod meta;
 pub mod mmap;
 pub mod node_pool;
+pub mod normalize;
 pub mod overflow;
 pub mod page;
 pub mod parallel;
+pub mod retention;
+pub mod scrub;
+pub mod slow_read;
+pub mod snappy;
 pub mod snapshot;
+pub mod stats;
 pub mod tx;
+pub mod tx_monitor;
+pub mod upgrade;
 pub mod value;
+pub mod version_watch;
 pub mod wal;
 pub mod wal_record;
+pub mod watch;
 
 // io_uring backend (Linux only, feature-gated)
 #[cfg(all(target_os = "linux", feature = "io_uring"))]
@@ -37,28 +69,58 @@ pub mod uring;
 // Re-export public API at crate root for convenience.
 pub use aligned::{AlignedBuffer, AlignedBufferPool, DEFAULT_ALIGNMENT};
 pub use arena::{Arena, DEFAULT_ARENA_SIZE, TypedArena};
-pub use btree::{BTreeIter, BTreeRangeIter, Bound};
+pub use audit::{AuditOp, AuditRecord, AuditWriter};
+pub use backup::Backup;
+pub use btree::{BTreeIter, BTreeKeys, BTreeRangeIter, Bound};
 pub use bucket::{
-    BucketBound, BucketIter, BucketMut, BucketRangeIter, BucketRef, MAX_BUCKET_NAME_LEN,
-    MAX_NESTING_DEPTH, NestedBucketIter, NestedBucketRef,
+    BucketBound, BucketIter, BucketKeys, BucketMut, BucketRangeIter, BucketRef,
+    BucketWithChildrenIter, CompactionPriority, EmptySubBuckets, EvictionPolicy, GroupItems,
+    KeyLimit, MAX_BUCKET_NAME_LEN, MAX_NESTING_DEPTH, NestedBucketIter, NestedBucketRef,
+    TransformAction, TruncateSequence,
 };
+pub use bulk::{BulkOptions, DEFAULT_BULK_MEM_BUDGET};
+pub use cancel::CancelToken;
+pub use capacity::{CapacityReport, LOW_HEADROOM_PERCENT};
 pub use checkpoint::{CheckpointConfig, CheckpointInfo, CheckpointManager};
+pub use committer::{BackgroundCommitter, CommitterConfig, DEFAULT_MAX_BATCH_SIZE};
+pub use compaction::{AutoCompaction, AutoCompactionConfig, BucketFragmentation, Compaction};
+pub use comparator::KeyComparator;
+pub use compress::{PageCompression, ValueCompression};
 pub use concurrent::{PARALLEL_THRESHOLD, ParallelWriteStats, prepare_entries_parallel};
-pub use db::{Database, DatabaseOptions};
+pub use csv::CsvOptions;
+pub use cursor::{Cursor, CursorMut};
+pub use db::{Database, DatabaseInfo, DatabaseOptions};
+pub use encrypt::EncryptionKey;
 pub use error::{Error, Result};
+pub use export::IMPORT_BATCH_BYTES;
+pub use freelist::FreelistType;
+pub use freeze::Freeze;
 pub use group_commit::{GroupCommitConfig, GroupCommitManager};
+pub use index::Index;
 pub use io_backend::{IoBackend, ReadOp, ReadResult, SyncBackend, WriteOp};
-pub use iter::{IterOptions, MetricsIter, PrefetchIter, ScanMetrics};
+pub use iter::{IterOptions, MetricsIter, PrefetchIter, ScanMetrics, VisibleIter};
+pub use layout::{AllocationKind, AllocationRange, PageInfo};
+pub use logger::Logger;
+pub use merge::MergeOperator;
 pub use mmap::{AccessPattern, Mmap, MmapOptions};
 pub use node_pool::{DEFAULT_MAX_POOLED, NodePool, PoolStats, PooledBranchNode, PooledLeafNode};
+pub use normalize::KeyNormalizer;
 pub use overflow::{DEFAULT_OVERFLOW_THRESHOLD, OverflowRef};
-pub use page::PageSizeConfig;
+pub use page::{PageSizeConfig, PageType};
 pub use parallel::{ParallelConfig, ParallelWriter, partition_for_parallel};
-pub use snapshot::{Snapshot, SnapshotId, SnapshotManager, SnapshotStats};
-pub use tx::{ReadTx, WriteTx};
+pub use retention::RetainedStats;
+pub use scrub::{DEFAULT_SCRUB_BYTES_PER_SEC, ScrubErrorHook};
+pub use slow_read::SlowReadHook;
+pub use snapshot::{ReadHandle, Snapshot, SnapshotId, SnapshotManager, SnapshotStats};
+pub use stats::{DatabaseStats, LatencyPercentiles, StatsCollector};
+pub use tx::{ChunkedTx, ReadTx, TxBatch, WriteTx};
+pub use tx_monitor::TxMonitor;
+pub use upgrade::UpgradeProgress;
 pub use value::{BorrowedValue, MaybeOwnedValue, OwnedValue};
+pub use version_watch::VersionWatch;
 pub use wal::{Lsn, SyncPolicy, Wal, WalConfig};
 pub use wal_record::{RECORD_HEADER_SIZE, WalRecord};
+pub use watch::{Unwatch, WatchEvent};
 
 #[cfg(all(target_os = "linux", feature = "io_uring"))]
 pub use uring::UringBackend;
@@ -66,5 +128,5 @@ pub use uring::UringBackend;
 #[cfg(feature = "failpoint")]
 pub use failpoint::{
     FailAction, FailpointBuilder, FailpointGuard, FailpointRegistry, FailpointScopeGuard,
-    RandomFailpointSelector,
+    FaultInjector, FaultOp, RandomFailpointSelector,
 };
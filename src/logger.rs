@@ -0,0 +1,77 @@
+//! Summary: Pluggable logger for diagnostic warnings.
+//! Copyright (c) YOAB. All rights reserved.
+//!
+//! Some conditions are worth reporting but are not errors of the operation
+//! that detects them (for example, a transaction dropped without being
+//! committed or rolled back). These are routed through a [`Logger`] so
+//! applications can forward them to their own logging setup.
+
+use std::fmt;
+use std::sync::Arc;
+
+/// A sink for diagnostic messages emitted by the database.
+///
+/// The default logger writes each message to stderr with a `[thunder]`
+/// prefix. Cloning a logger is cheap (reference counted).
+///
+/// # Example
+///
+/// ```ignore
+/// let options = DatabaseOptions {
+///     logger: Logger::new(|msg| log::warn!("{msg}")),
+///     ..DatabaseOptions::default()
+/// };
+/// ```
+#[derive(Clone)]
+pub struct Logger(Arc<dyn Fn(&str) + Send + Sync>);
+
+impl Logger {
+    /// Creates a logger that forwards messages to the given function.
+    pub fn new<F>(f: F) -> Self
+    where
+        F: Fn(&str) + Send + Sync + 'static,
+    {
+        Self(Arc::new(f))
+    }
+
+    /// Creates a logger that writes messages to stderr.
+    pub fn stderr() -> Self {
+        Self::new(|msg| eprintln!("[thunder] {msg}"))
+    }
+
+    /// Emits a message.
+    #[inline]
+    pub fn log(&self, msg: &str) {
+        (self.0)(msg)
+    }
+}
+
+impl Default for Logger {
+    fn default() -> Self {
+        Self::stderr()
+    }
+}
+
+impl fmt::Debug for Logger {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str("Logger")
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::sync::Mutex;
+
+    #[test]
+    fn test_logger_forwards_messages() {
+        let messages = Arc::new(Mutex::new(Vec::new()));
+        let sink = Arc::clone(&messages);
+        let logger = Logger::new(move |msg| sink.lock().unwrap().push(msg.to_string()));
+
+        logger.log("first");
+        logger.clone().log("second");
+
+        assert_eq!(*messages.lock().unwrap(), vec!["first", "second"]);
+    }
+}
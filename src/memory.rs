@@ -0,0 +1,93 @@
+//! Summary: Process-wide commit threshold for write buffers.
+//! Copyright (c) YOAB. All rights reserved.
+//!
+//! [`set_commit_threshold`] sets how much memory uncommitted write buffers
+//! may hold, across every open database in the process, before the
+//! background committer commits early. It is an advisory signal for the
+//! committer only, not a cap: no write is ever refused for crossing it.
+//! Each write transaction charges the keys and values it stages and
+//! releases them when it commits or is dropped; [`memory_usage`] reports
+//! the total. A key staged again in the same transaction is charged again,
+//! so the total is an upper bound.
+//!
+//! # Back-Pressure
+//!
+//! The `BackgroundCommitter` checks [`over_commit_threshold`] after each
+//! queued update: once it holds, the committer stops coalescing updates
+//! into the current transaction and commits it, so buffered writes are
+//! flushed instead of accumulating. A transaction driven directly by the
+//! caller is never committed implicitly; callers can check
+//! [`over_commit_threshold`] themselves to split large transactions.
+//!
+//! # Scope
+//!
+//! The committed data itself lives in the in-memory tree of each database
+//! and is not counted: it cannot be shed without closing the database.
+//! Accounting is skipped entirely while no threshold is set.
+
+use std::sync::atomic::{AtomicU64, Ordering};
+
+/// Threshold in bytes; 0 means none.
+static THRESHOLD: AtomicU64 = AtomicU64::new(0);
+
+/// Bytes currently charged.
+static USAGE: AtomicU64 = AtomicU64::new(0);
+
+/// Sets the process-wide commit threshold for uncommitted write buffers.
+///
+/// Pass 0 to remove the threshold. Takes effect for writes staged after
+/// the call; charges already made are still released.
+///
+/// # Example
+///
+/// ```ignore
+/// thunderdb::memory::set_commit_threshold(64 * 1024 * 1024);
+/// ```
+pub fn set_commit_threshold(bytes: u64) {
+    THRESHOLD.store(bytes, Ordering::Relaxed);
+}
+
+/// Returns the process-wide commit threshold, or `None` if none is set.
+pub fn commit_threshold() -> Option<u64> {
+    match THRESHOLD.load(Ordering::Relaxed) {
+        0 => None,
+        bytes => Some(bytes),
+    }
+}
+
+/// Returns the bytes currently held in uncommitted write buffers.
+///
+/// Always 0 while no threshold is set.
+pub fn memory_usage() -> u64 {
+    USAGE.load(Ordering::Relaxed)
+}
+
+/// Returns true if usage has reached the commit threshold.
+pub fn over_commit_threshold() -> bool {
+    commit_threshold().is_some_and(|threshold| memory_usage() >= threshold)
+}
+
+/// Bytes charged by one owner, released when dropped.
+#[derive(Debug, Default)]
+pub(crate) struct MemoryCharge {
+    bytes: u64,
+}
+
+impl MemoryCharge {
+    /// Charges `bytes` towards the threshold, if one is set.
+    #[inline]
+    pub(crate) fn charge(&mut self, bytes: usize) {
+        if THRESHOLD.load(Ordering::Relaxed) != 0 {
+            USAGE.fetch_add(bytes as u64, Ordering::Relaxed);
+            self.bytes += bytes as u64;
+        }
+    }
+}
+
+impl Drop for MemoryCharge {
+    fn drop(&mut self) {
+        if self.bytes != 0 {
+            USAGE.fetch_sub(self.bytes, Ordering::Relaxed);
+        }
+    }
+}
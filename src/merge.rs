@@ -0,0 +1,70 @@
+//! Summary: Merge operators for read-modify-write values.
+//! Copyright (c) YOAB. All rights reserved.
+//!
+//! A [`MergeOperator`] set as `DatabaseOptions::merge_operator` lets
+//! `WriteTx::bucket_merge()` combine an operand with a key's value in
+//! place of a get followed by a put. Counters, set unions and appends fit
+//! this shape: callers describe the change, and the operator applies it.
+//!
+//! # Atomicity
+//!
+//! The operator runs when the merge is staged, against the value the
+//! transaction sees, including its own earlier writes. A write transaction
+//! has the database to itself until it commits or rolls back, so no other
+//! commit can change the value in between, and concurrent merges through
+//! `BackgroundCommitter` or a shared handle are each applied exactly once.
+//!
+//! # Persistence
+//!
+//! Only merged values are stored, never operands, so the operator is not
+//! needed to read the database and may change between opens.
+
+use std::fmt;
+use std::sync::Arc;
+
+/// The boxed merge function.
+type MergeFn = dyn Fn(Option<&[u8]>, &[u8]) -> Vec<u8> + Send + Sync;
+
+/// A function combining a key's value with a merge operand.
+///
+/// Called with the existing value, or `None` if the key is absent, and the
+/// operand, returning the new value. It runs inside the write transaction,
+/// so it should be quick and must not panic. Cloning is cheap (reference
+/// counted).
+///
+/// # Example
+///
+/// ```ignore
+/// // Little-endian u64 counters.
+/// let options = DatabaseOptions {
+///     merge_operator: Some(MergeOperator::new(|existing, operand| {
+///         let read = |v: &[u8]| u64::from_le_bytes(v.try_into().unwrap_or([0; 8]));
+///         let total = existing.map_or(0, read).wrapping_add(read(operand));
+///         total.to_le_bytes().to_vec()
+///     })),
+///     ..DatabaseOptions::default()
+/// };
+/// ```
+#[derive(Clone)]
+pub struct MergeOperator(Arc<MergeFn>);
+
+impl MergeOperator {
+    /// Creates a merge operator from the given function.
+    pub fn new<F>(f: F) -> Self
+    where
+        F: Fn(Option<&[u8]>, &[u8]) -> Vec<u8> + Send + Sync + 'static,
+    {
+        Self(Arc::new(f))
+    }
+
+    /// Combines `existing` with `operand`.
+    pub(crate) fn merge(&self, existing: Option<&[u8]>, operand: &[u8]) -> Vec<u8> {
+        (self.0)(existing, operand)
+    }
+}
+
+impl fmt::Debug for MergeOperator {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str("MergeOperator")
+    }
+}
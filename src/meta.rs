@@ -2,6 +2,7 @@
 //! Copyright (c) YOAB. All rights reserved.
 
 use crate::checkpoint::CheckpointInfo;
+use crate::encrypt::{KEY_CHECK_SIZE, SALT_SIZE};
 use crate::page::{MAGIC, PAGE_SIZE, PageId, PageSizeConfig, VERSION};
 use crate::wal::Lsn;
 
@@ -18,6 +19,8 @@ pub struct Meta {
     pub version: u32,
     /// Page size in bytes.
     pub page_size: u32,
+    /// State flags (bytes 12-16, zero for older databases).
+    pub flags: u32,
     /// Transaction ID (incremented on each commit).
     pub txid: u64,
     /// Root page ID of the B+ tree.
@@ -35,11 +38,29 @@ pub struct Meta {
     pub checkpoint_timestamp: u64,
     /// Entry count at last checkpoint.
     pub checkpoint_entry_count: u64,
+    // Encryption fields (bytes 88-120, zero unless FLAG_ENCRYPTED is set)
+    /// Salt the file's keys are derived with.
+    pub salt: [u8; SALT_SIZE],
+    /// Value derived from the key, for detecting a wrong key on open.
+    pub key_check: [u8; KEY_CHECK_SIZE],
 }
 
 impl Meta {
-    /// Size of the meta structure in bytes (extended for checkpoint fields).
-    pub const SIZE: usize = 88;
+    /// Size of the meta structure in bytes (extended for checkpoint and
+    /// encryption fields).
+    pub const SIZE: usize = 120;
+
+    /// Flag set while a handle has the database open.
+    ///
+    /// Cleared by a clean close, so finding it set on open means the
+    /// previous process exited without closing the database.
+    pub const FLAG_OPEN: u32 = 1 << 0;
+
+    /// Flag set when the file is encrypted; see the `encrypt` module.
+    ///
+    /// Also extends the checksum over the encryption fields, which older
+    /// databases leave out.
+    pub const FLAG_ENCRYPTED: u32 = 1 << 1;
 
     /// Creates a new meta page with default values for a fresh database.
     pub fn new() -> Self {
@@ -52,6 +73,7 @@ impl Meta {
             magic: MAGIC,
             version: VERSION,
             page_size,
+            flags: 0,
             txid: 0,
             root: 0,
             freelist: 0,
@@ -60,6 +82,8 @@ impl Meta {
             checkpoint_lsn: 0,
             checkpoint_timestamp: 0,
             checkpoint_entry_count: 0,
+            salt: [0; SALT_SIZE],
+            key_check: [0; KEY_CHECK_SIZE],
         }
     }
 
@@ -104,6 +128,7 @@ impl Meta {
         buf[0..4].copy_from_slice(&self.magic.to_le_bytes());
         buf[4..8].copy_from_slice(&self.version.to_le_bytes());
         buf[8..12].copy_from_slice(&self.page_size.to_le_bytes());
+        buf[12..16].copy_from_slice(&self.flags.to_le_bytes());
         buf[16..24].copy_from_slice(&self.txid.to_le_bytes());
         buf[24..32].copy_from_slice(&self.root.to_le_bytes());
         buf[32..40].copy_from_slice(&self.freelist.to_le_bytes());
@@ -112,8 +137,12 @@ impl Meta {
         buf[64..72].copy_from_slice(&self.checkpoint_lsn.to_le_bytes());
         buf[72..80].copy_from_slice(&self.checkpoint_timestamp.to_le_bytes());
         buf[80..88].copy_from_slice(&self.checkpoint_entry_count.to_le_bytes());
+        // Encryption fields (bytes 88-120)
+        buf[88..104].copy_from_slice(&self.salt);
+        buf[104..120].copy_from_slice(&self.key_check);
 
-        // Calculate checksum over bytes 0-56 and 64-88 (excluding checksum field at 56-64).
+        // Calculate checksum over bytes 0-56 and 64-88 (excluding checksum field at 56-64),
+        // and 88-120 if encrypted.
         let checksum = Self::compute_checksum_extended(&buf);
         buf[56..64].copy_from_slice(&checksum.to_le_bytes());
 
@@ -129,6 +158,7 @@ impl Meta {
         let magic = u32::from_le_bytes(buf[0..4].try_into().ok()?);
         let version = u32::from_le_bytes(buf[4..8].try_into().ok()?);
         let page_size = u32::from_le_bytes(buf[8..12].try_into().ok()?);
+        let flags = u32::from_le_bytes(buf[12..16].try_into().ok()?);
         let txid = u64::from_le_bytes(buf[16..24].try_into().ok()?);
         let root = u64::from_le_bytes(buf[24..32].try_into().ok()?);
         let freelist = u64::from_le_bytes(buf[32..40].try_into().ok()?);
@@ -140,6 +170,10 @@ impl Meta {
         let checkpoint_timestamp = u64::from_le_bytes(buf[72..80].try_into().ok()?);
         let checkpoint_entry_count = u64::from_le_bytes(buf[80..88].try_into().ok()?);
 
+        // Encryption fields (zero for unencrypted databases)
+        let salt = buf[88..104].try_into().ok()?;
+        let key_check = buf[104..120].try_into().ok()?;
+
         // Verify checksum - try extended first, fall back to legacy
         let expected_checksum_ext = Self::compute_checksum_extended(buf);
         let expected_checksum_legacy = Self::compute_checksum(&buf[0..56]);
@@ -152,6 +186,7 @@ impl Meta {
             magic,
             version,
             page_size,
+            flags,
             txid,
             root,
             freelist,
@@ -160,6 +195,8 @@ impl Meta {
             checkpoint_lsn,
             checkpoint_timestamp,
             checkpoint_entry_count,
+            salt,
+            key_check,
         })
     }
 
@@ -179,6 +216,15 @@ impl Meta {
             hash ^= u64::from(*byte);
             hash = hash.wrapping_mul(FNV_PRIME);
         }
+        // Hash bytes 88-120 (encryption fields) only when present, so older
+        // checksums stay valid.
+        let flags = u32::from_le_bytes([buf[12], buf[13], buf[14], buf[15]]);
+        if flags & Self::FLAG_ENCRYPTED != 0 {
+            for byte in &buf[88..120] {
+                hash ^= u64::from(*byte);
+                hash = hash.wrapping_mul(FNV_PRIME);
+            }
+        }
         hash
     }
 
@@ -244,6 +290,7 @@ mod tests {
         original.root = 100;
         original.freelist = 50;
         original.page_count = 200;
+        original.flags = Meta::FLAG_OPEN;
 
         let bytes = original.to_bytes();
         let restored = Meta::from_bytes(&bytes).expect("should parse");
@@ -252,6 +299,7 @@ mod tests {
         assert_eq!(original.root, restored.root);
         assert_eq!(original.freelist, restored.freelist);
         assert_eq!(original.page_count, restored.page_count);
+        assert_eq!(original.flags, restored.flags);
     }
 
     #[test]
@@ -271,4 +319,22 @@ mod tests {
         // Too short
         assert!(Meta::from_bytes(&[0u8; Meta::SIZE - 1]).is_none());
     }
+
+    #[test]
+    fn test_meta_encryption_fields() {
+        let mut meta = Meta::new();
+        meta.flags |= Meta::FLAG_ENCRYPTED;
+        meta.salt = [3; SALT_SIZE];
+        meta.key_check = [5; KEY_CHECK_SIZE];
+
+        let bytes = meta.to_bytes();
+        let restored = Meta::from_bytes(&bytes).expect("should parse");
+        assert_eq!(restored.salt, meta.salt);
+        assert_eq!(restored.key_check, meta.key_check);
+
+        // The checksum covers the salt and key check.
+        let mut corrupted = bytes;
+        corrupted[100] ^= 0xFF;
+        assert!(Meta::from_bytes(&corrupted).is_none());
+    }
 }
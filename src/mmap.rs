@@ -14,6 +14,26 @@ use std::ptr::NonNull;
 
 use crate::page::PAGE_SIZE;
 
+/// Largest step by which [`grow_size()`] extends a mapping, 1 GiB.
+pub const MAX_MMAP_STEP: usize = 1 << 30;
+
+/// Returns the length to remap a `current`-byte mapping to so that
+/// `needed` bytes fit.
+///
+/// The mapping doubles while under [`MAX_MMAP_STEP`] and then grows by
+/// that step, so a growing file is remapped a logarithmic number of times
+/// without reserving much more address space than it uses.
+pub fn grow_size(current: usize, needed: usize) -> usize {
+    if current == 0 {
+        return needed;
+    }
+    let mut size = current;
+    while size < needed {
+        size = size.saturating_add(size.min(MAX_MMAP_STEP));
+    }
+    size
+}
+
 /// Access pattern hint for memory-mapped regions.
 ///
 /// These hints inform the kernel's readahead and caching strategies.
@@ -454,6 +474,22 @@ impl Drop for Mmap {
 mod tests {
     use super::*;
     use std::fs::{self, OpenOptions};
+
+    #[test]
+    fn test_grow_size_doubles_then_steps() {
+        assert_eq!(grow_size(0, 5000), 5000);
+        assert_eq!(grow_size(4096, 4096), 4096);
+        assert_eq!(grow_size(4096, 4097), 8192);
+        assert_eq!(grow_size(4096, 20_000), 32_768);
+        assert_eq!(
+            grow_size(MAX_MMAP_STEP, MAX_MMAP_STEP + 1),
+            2 * MAX_MMAP_STEP
+        );
+        assert_eq!(
+            grow_size(2 * MAX_MMAP_STEP, 3 * MAX_MMAP_STEP),
+            3 * MAX_MMAP_STEP
+        );
+    }
     use std::io::Write;
 
     fn test_file_path(name: &str) -> String {
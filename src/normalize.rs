@@ -0,0 +1,100 @@
+//! Summary: Configurable key normalization for case-insensitive lookups.
+//! Copyright (c) YOAB. All rights reserved.
+//!
+//! When `DatabaseOptions::key_normalizer` is set, top-level keys passed to
+//! `put`, `delete` and the read methods are normalized before they reach the
+//! tree, so keys that normalize to the same bytes address the same entry.
+//! The key as originally written is kept in a companion entry and can be
+//! recovered with `ReadTx::original_key()`.
+//!
+//! # Ordering
+//!
+//! Entries are stored under their normalized keys, so normalized order
+//! governs iteration and range scans, and iterators yield normalized keys.
+//! `ReadTx::iter()` and `ReadTx::range()` skip the companion entries.
+//!
+//! # Format
+//!
+//! The companion entry uses the internal key `[ORIGINAL_KEY_PREFIX][key]`,
+//! where `key` is the normalized key, and holds the original key bytes.
+//! Bucket keys are not normalized.
+
+use std::fmt;
+use std::sync::Arc;
+
+/// Magic prefix byte for original-key entries.
+const ORIGINAL_KEY_PREFIX: u8 = 0x05;
+
+/// The boxed normalization function.
+type NormalizeFn = dyn Fn(&[u8]) -> Vec<u8> + Send + Sync;
+
+/// A function mapping keys to their normalized form.
+///
+/// Normalizers must be deterministic and idempotent, and must not change
+/// between opens of the same database. Cloning is cheap (reference counted).
+///
+/// # Example
+///
+/// ```ignore
+/// let options = DatabaseOptions {
+///     key_normalizer: Some(KeyNormalizer::ascii_lowercase()),
+///     ..DatabaseOptions::default()
+/// };
+/// ```
+#[derive(Clone)]
+pub struct KeyNormalizer(Arc<NormalizeFn>);
+
+impl KeyNormalizer {
+    /// Creates a normalizer from the given function.
+    pub fn new<F>(f: F) -> Self
+    where
+        F: Fn(&[u8]) -> Vec<u8> + Send + Sync + 'static,
+    {
+        Self(Arc::new(f))
+    }
+
+    /// Creates a normalizer that lowercases ASCII letters.
+    pub fn ascii_lowercase() -> Self {
+        Self::new(<[u8]>::to_ascii_lowercase)
+    }
+
+    /// Returns the normalized form of `key`.
+    #[inline]
+    pub fn normalize(&self, key: &[u8]) -> Vec<u8> {
+        (self.0)(key)
+    }
+}
+
+impl fmt::Debug for KeyNormalizer {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str("KeyNormalizer")
+    }
+}
+
+/// Creates the internal key holding the original form of a normalized key.
+#[inline]
+pub fn original_key_entry(normalized: &[u8]) -> Vec<u8> {
+    let mut key = Vec::with_capacity(1 + normalized.len());
+    key.push(ORIGINAL_KEY_PREFIX);
+    key.extend_from_slice(normalized);
+    key
+}
+
+/// Returns true if `key` is an original-key entry.
+#[inline]
+pub fn is_original_key_entry(key: &[u8]) -> bool {
+    key.first() == Some(&ORIGINAL_KEY_PREFIX)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_ascii_lowercase() {
+        let normalizer = KeyNormalizer::ascii_lowercase();
+        assert_eq!(normalizer.normalize(b"Alice"), b"alice");
+        assert_eq!(normalizer.normalize(b"ALICE"), b"alice");
+        assert_eq!(original_key_entry(b"alice")[0], ORIGINAL_KEY_PREFIX);
+    }
+}
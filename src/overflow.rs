@@ -12,6 +12,7 @@
 //! - Zero-copy buffer operations where possible
 //! - Contiguous page allocation for sequential I/O
 
+use crate::freelist::{FreePages, FreelistType};
 use crate::mmap::Mmap;
 use crate::page::PageId;
 
@@ -193,7 +194,7 @@ pub struct OverflowManager {
     /// Next available page ID for overflow allocation.
     next_page_id: PageId,
     /// Free overflow pages available for reuse.
-    free_pages: Vec<PageId>,
+    free_pages: FreePages,
     /// Page size for this database.
     page_size: usize,
     /// Usable data per overflow page (page_size - header).
@@ -210,12 +211,24 @@ impl OverflowManager {
     pub fn new(page_size: usize, next_page_id: PageId) -> Self {
         Self {
             next_page_id,
-            free_pages: Vec::new(),
+            free_pages: FreePages::new(FreelistType::default()),
             page_size,
             overflow_data_size: page_size - OVERFLOW_HEADER_SIZE,
         }
     }
 
+    /// Returns the manager, keeping its free pages in a `kind` freelist.
+    ///
+    /// Pages already freed are carried over.
+    pub fn with_freelist(mut self, kind: FreelistType) -> Self {
+        let pages = self.free_pages.to_vec();
+        self.free_pages = FreePages::new(kind);
+        for page in pages {
+            self.free_pages.free(page);
+        }
+        self
+    }
+
     /// Returns the overflow data size for this manager.
     #[inline]
     pub fn overflow_data_size(&self) -> usize {
@@ -228,6 +241,24 @@ impl OverflowManager {
         self.next_page_id
     }
 
+    /// Returns the number of freed pages available for reuse.
+    #[inline]
+    pub fn free_page_count(&self) -> usize {
+        self.free_pages.len()
+    }
+
+    /// Returns the freed pages available for reuse, in no particular
+    /// order.
+    pub fn free_pages(&self) -> Vec<PageId> {
+        self.free_pages.to_vec()
+    }
+
+    /// Marks a page as free for later allocations to reuse.
+    #[inline]
+    pub fn free_page(&mut self, page_id: PageId) {
+        self.free_pages.free(page_id);
+    }
+
     /// Sets the next page ID (used when loading from disk).
     #[inline]
     pub fn set_next_page_id(&mut self, page_id: PageId) {
@@ -585,7 +616,7 @@ impl OverflowManager {
             if let Some(page_data) = mmap.page_with_size(current_page, self.page_size)
                 && let Some(header) = OverflowHeader::from_bytes(page_data)
             {
-                self.free_pages.push(current_page);
+                self.free_page(current_page);
                 current_page = header.next_page;
                 pages_freed += 1;
                 continue;
@@ -596,16 +627,34 @@ impl OverflowManager {
 
     /// Allocates a page ID, either from the free list or by incrementing.
     fn alloc_page(&mut self) -> PageId {
-        self.free_pages.pop().unwrap_or_else(|| {
+        self.free_pages.allocate().unwrap_or_else(|| {
             let id = self.next_page_id;
             self.next_page_id += 1;
             id
         })
     }
 
+    /// Orders the free pages into contiguous runs.
+    ///
+    /// Pages are freed one at a time as chains are released, so an array
+    /// freelist holds them in release order and contiguous allocations
+    /// cannot use it. This sorts and deduplicates it, after which
+    /// contiguous allocations take the lowest run of free pages that is
+    /// long enough before growing the file. A hash map freelist keeps its
+    /// runs merged as pages are freed, so there is nothing to do. No page
+    /// is moved; only the list changes.
+    ///
+    /// Returns the number of runs of two or more adjacent free pages.
+    pub fn coalesce_free_pages(&mut self) -> usize {
+        self.free_pages.coalesce()
+    }
+
     /// Allocates contiguous pages for a large value.
     ///
-    /// Always allocates at the end to ensure contiguity (ignores free list).
+    /// Takes a run of free pages when the free list holds a long enough
+    /// one, which an array freelist only finds once coalesced with
+    /// [`coalesce_free_pages()`](Self::coalesce_free_pages); otherwise
+    /// allocates at the end of the file.
     ///
     /// # Arguments
     ///
@@ -614,7 +663,10 @@ impl OverflowManager {
     /// # Returns
     ///
     /// The starting page ID of the contiguous block.
-    fn alloc_contiguous_pages(&mut self, count: usize) -> PageId {
+    pub fn alloc_contiguous_pages(&mut self, count: usize) -> PageId {
+        if let Some(start) = self.free_pages.allocate_run(count) {
+            return start;
+        }
         let start = self.next_page_id;
         self.next_page_id += count as PageId;
         start
@@ -756,7 +808,7 @@ impl OverflowManager {
 
     /// Magic marker for direct format to distinguish from legacy page chain format.
     /// This is 0xDDDDDDDD which is >3GB so will never be a valid value length in practice.
-    const DIRECT_FORMAT_MAGIC: u32 = 0xDDDD_DDDD;
+    pub(crate) const DIRECT_FORMAT_MAGIC: u32 = 0xDDDD_DDDD;
 
     /// Writes a large value directly without page chain overhead.
     ///
@@ -1006,6 +1058,58 @@ mod tests {
         assert_eq!(mgr.next_page_id(), 13);
     }
 
+    #[test]
+    fn test_coalesced_free_runs_are_reused() {
+        let mut mgr = OverflowManager::new(4096, 100);
+        // Freed out of order, with a duplicate: runs 10..13 and 20..22.
+        for page in [21, 12, 5, 10, 20, 11, 12, 30] {
+            mgr.free_page(page);
+        }
+
+        // Without coalescing, a 3-page value grows the file.
+        let value = vec![0x5Au8; 3 * mgr.overflow_data_size()];
+        let (oref, _) = mgr.allocate_overflow_contiguous(&value);
+        assert_eq!(oref.start_page, 100);
+        assert_eq!(mgr.next_page_id(), 103);
+
+        assert_eq!(mgr.coalesce_free_pages(), 2);
+        assert_eq!(mgr.free_page_count(), 7);
+
+        // Now it takes the lowest long-enough run instead.
+        let (oref, buffer) = mgr.allocate_overflow_contiguous(&value);
+        assert_eq!(oref.start_page, 10);
+        assert_eq!(buffer.len(), 3 * 4096);
+        assert_eq!(mgr.next_page_id(), 103);
+        assert_eq!(mgr.free_pages(), vec![30, 21, 20, 5]);
+
+        let (oref, _) = mgr.allocate_overflow_contiguous(&value[..2 * mgr.overflow_data_size()]);
+        assert_eq!(oref.start_page, 20);
+        let (oref, _) = mgr.allocate_overflow_contiguous(&value[..2 * mgr.overflow_data_size()]);
+        assert_eq!(oref.start_page, 103);
+        assert_eq!(mgr.alloc_page(), 5);
+    }
+
+    #[test]
+    fn test_both_freelist_types_reuse_freed_pages() {
+        for kind in [FreelistType::Array, FreelistType::HashMap] {
+            let mut mgr = OverflowManager::new(4096, 100).with_freelist(kind);
+            for page in [40, 12, 7, 5, 6] {
+                mgr.free_page(page);
+            }
+            assert_eq!(mgr.coalesce_free_pages(), 1, "{kind:?}");
+
+            let value = vec![0xA5u8; 3 * mgr.overflow_data_size()];
+            let (oref, _) = mgr.allocate_overflow_contiguous(&value);
+            assert_eq!(oref.start_page, 5, "{kind:?}");
+
+            let mut reused = vec![mgr.alloc_page(), mgr.alloc_page()];
+            reused.sort_unstable();
+            assert_eq!(reused, vec![12, 40], "{kind:?}");
+            assert_eq!(mgr.free_page_count(), 0, "{kind:?}");
+            assert_eq!(mgr.alloc_page(), 100, "{kind:?}");
+        }
+    }
+
     #[test]
     fn test_overflow_contiguous_empty_value() {
         let mut mgr = OverflowManager::new(32768, 10);
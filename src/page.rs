@@ -8,7 +8,12 @@ pub const PAGE_SIZE: usize = 32768;
 pub const MAGIC: u32 = 0x54_48_4E_44; // "THND" in ASCII
 
 /// Current database file format version.
-pub const VERSION: u32 = 3; // Bumped for 32KB HPC page size
+///
+/// Version 4 added compressed blocks and values in the data section and
+/// the encryption fields of the meta page. Files in version 3 stay in it
+/// until a commit writes one of those encodings; see
+/// `Database::needs_upgrade()`.
+pub const VERSION: u32 = 4;
 
 /// Page identifier type.
 pub type PageId = u64;
@@ -63,6 +68,25 @@ impl PageSizeConfig {
     pub fn is_valid(value: u32) -> bool {
         Self::from_u32(value).is_some()
     }
+
+    /// Returns the operating system's memory page size, or 4KB if it is
+    /// not a supported size.
+    ///
+    /// The default stays 32KB, the size existing files were created with;
+    /// pass this to `DatabaseOptions::page_size` to match the OS instead.
+    pub fn os_default() -> Self {
+        #[cfg(unix)]
+        {
+            // SAFETY: sysconf has no preconditions.
+            let size = unsafe { libc::sysconf(libc::_SC_PAGESIZE) };
+            if let Ok(size) = u32::try_from(size)
+                && let Some(config) = Self::from_u32(size)
+            {
+                return config;
+            }
+        }
+        Self::Size4K
+    }
 }
 
 /// Page types used in the database file.
@@ -91,7 +115,7 @@ mod tests {
         assert!(PAGE_SIZE.is_power_of_two());
         assert_eq!(MAGIC, 0x54_48_4E_44);
         assert_eq!(&MAGIC.to_be_bytes(), b"THND");
-        assert_eq!(VERSION, 3);
+        assert_eq!(VERSION, 4);
     }
 
     #[test]
@@ -134,5 +158,8 @@ mod tests {
         assert!(!PageSizeConfig::is_valid(1000));
 
         assert_eq!(PageSizeConfig::default(), PageSizeConfig::Size32K);
+        assert!(PageSizeConfig::is_valid(
+            PageSizeConfig::os_default().as_usize() as u32
+        ));
     }
 }
@@ -0,0 +1,172 @@
+//! Summary: Time-based retention of committed versions for as-of reads.
+//! Copyright (c) YOAB. All rights reserved.
+//!
+//! When `DatabaseOptions::retain_duration` is set, the database keeps the
+//! tree committed by every write transaction for that long, so
+//! `Database::view_as_of()` and `Database::get_as_of()` can read the state
+//! at any instant inside the window without holding a snapshot.
+//!
+//! # Garbage Collection
+//!
+//! Versions are collected on every commit and by `Database::gc_versions()`.
+//! A version is dropped once a newer version was already committed before
+//! the start of the window; the newest such version is kept because it
+//! describes the state at the window's start. Snapshots and open readers
+//! hold their own reference to a version and are unaffected.
+//!
+//! # Space Cost
+//!
+//! Versions share the tree through copy-on-write at whole-tree
+//! granularity: a commit made while older versions are retained clones the
+//! tree. Memory therefore grows with the number of commits inside the
+//! window times the size of the tree, and a long window with frequent
+//! commits can hold many full copies. `Database::retained_version_stats()`
+//! reports how much is held this way.
+
+use std::cmp::Ordering;
+use std::collections::VecDeque;
+use std::sync::Arc;
+use std::time::{Duration, SystemTime};
+
+use crate::btree::BTree;
+use crate::error::{Error, Result};
+
+/// What the retention window holds beyond the current state.
+///
+/// Returned by `Database::retained_version_stats()`.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct RetainedStats {
+    /// Historical versions retained, not counting the current one.
+    pub versions: u64,
+    /// Keys deleted by a commit whose earlier versions are retained, one
+    /// per deleting commit.
+    pub tombstones: u64,
+    /// Key and value bytes of the historical versions: the memory that
+    /// dropping them (a zero retention window) would free.
+    pub bytes: u64,
+}
+
+/// Committed versions inside the retention window, oldest first.
+#[derive(Debug)]
+pub(crate) struct VersionHistory {
+    retain: Duration,
+    versions: VecDeque<(SystemTime, Arc<BTree>)>,
+}
+
+impl VersionHistory {
+    /// Creates an empty history retaining versions for `retain`.
+    pub(crate) fn new(retain: Duration) -> Self {
+        Self {
+            retain,
+            versions: VecDeque::new(),
+        }
+    }
+
+    /// Records `tree` as the version committed at `at`, then collects
+    /// versions that fell out of the window.
+    pub(crate) fn record(&mut self, at: SystemTime, tree: Arc<BTree>) {
+        self.versions.push_back((at, tree));
+        self.gc(at);
+    }
+
+    /// Drops versions no longer needed to serve reads inside the window
+    /// ending at `now`.
+    ///
+    /// Returns the number of versions dropped.
+    pub(crate) fn gc(&mut self, now: SystemTime) -> usize {
+        let Some(cutoff) = now.checked_sub(self.retain) else {
+            return 0;
+        };
+        let mut dropped = 0;
+        while self.versions.get(1).is_some_and(|(at, _)| *at <= cutoff) {
+            self.versions.pop_front();
+            dropped += 1;
+        }
+        dropped
+    }
+
+    /// Measures the versions retained besides `current`.
+    ///
+    /// Reads key and value lengths but not value bytes; takes time linear
+    /// in the total size of the retained trees.
+    pub(crate) fn stats(&self, current: &Arc<BTree>) -> RetainedStats {
+        let mut stats = RetainedStats::default();
+        let historical = self
+            .versions
+            .iter()
+            .map(|(_, tree)| tree)
+            .filter(|tree| !Arc::ptr_eq(tree, current));
+        for tree in historical {
+            stats.versions += 1;
+            stats.bytes += tree
+                .iter()
+                .map(|(key, value)| (key.len() + value.len()) as u64)
+                .sum::<u64>();
+        }
+
+        let mut newer = self.versions.iter().map(|(_, tree)| tree).skip(1);
+        for older in self.versions.iter().map(|(_, tree)| tree) {
+            let newer = newer.next().unwrap_or(current);
+            if !Arc::ptr_eq(older, newer) {
+                stats.tombstones += deleted_keys(older, newer);
+            }
+        }
+        stats
+    }
+
+    /// Returns the version that was current at `at`.
+    ///
+    /// # Errors
+    ///
+    /// Returns `VersionGced` if that version is no longer retained.
+    pub(crate) fn as_of(&self, at: SystemTime) -> Result<Arc<BTree>> {
+        self.versions
+            .iter()
+            .rev()
+            .find(|(committed, _)| *committed <= at)
+            .map(|(_, tree)| Arc::clone(tree))
+            .ok_or_else(|| Error::VersionGced {
+                requested: at,
+                oldest: self.versions.front().map(|(committed, _)| *committed),
+            })
+    }
+}
+
+/// Counts the keys of `older` missing from `newer`.
+fn deleted_keys(older: &BTree, newer: &BTree) -> u64 {
+    let mut deleted = 0;
+    let mut newer_keys = newer.keys().peekable();
+    for key in older.keys() {
+        while newer_keys.next_if(|newer| *newer < key).is_some() {}
+        match newer_keys.peek().map(|newer| (*newer).cmp(key)) {
+            Some(Ordering::Equal) => {}
+            _ => deleted += 1,
+        }
+    }
+    deleted
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_gc_keeps_version_at_window_start() {
+        let start = SystemTime::UNIX_EPOCH + Duration::from_secs(1000);
+        let secs = |s: u64| start + Duration::from_secs(s);
+        let mut history = VersionHistory::new(Duration::from_secs(10));
+
+        for s in [0, 5, 8] {
+            history.record(secs(s), Arc::new(BTree::new()));
+        }
+        assert_eq!(history.versions.len(), 3);
+
+        // Window is [9, 19]: the version from 8 is current at 9.
+        assert_eq!(history.gc(secs(19)), 2);
+        assert!(history.as_of(secs(9)).is_ok());
+        assert!(matches!(
+            history.as_of(secs(6)),
+            Err(Error::VersionGced { .. })
+        ));
+    }
+}
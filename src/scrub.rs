@@ -0,0 +1,282 @@
+//! Summary: Background verification of on-disk checksums.
+//! Copyright (c) YOAB. All rights reserved.
+//!
+//! With `DatabaseOptions::scrub_interval` set, a background thread
+//! periodically re-reads the checksummed records of the database file and
+//! verifies them, so storage degradation is noticed before a read or a
+//! reopen runs into it. Each corrupt record is reported once to
+//! `DatabaseOptions::on_scrub_error` with the page it starts on, or logged
+//! when no hook is set.
+//!
+//! # What Is Verified
+//!
+//! Overflow values are the records stored with their own CRC32, so they
+//! are what a pass verifies. Entries stored inline have no on-disk
+//! checksum and are not scrubbed; meta pages are verified on every open.
+//!
+//! # Throttling
+//!
+//! The scrubber reads through its own file handle at no more than
+//! `scrub_bytes_per_sec`, sleeping between records, and takes no lock the
+//! database needs for reads or commits, so normal operations only share
+//! disk bandwidth with it.
+//!
+//! # Concurrent Writes
+//!
+//! Commits may rewrite records in the middle of a pass. The scrubber does
+//! not start a pass while a commit is writing, and a record that fails
+//! verification is only reported if no commit has written since the pass
+//! began; otherwise the pass is abandoned and retried at the next interval.
+
+use std::collections::HashSet;
+use std::fs::File;
+use std::io::{Read, Seek, SeekFrom};
+use std::path::PathBuf;
+use std::sync::{Arc, Mutex, MutexGuard, Weak};
+use std::time::Duration;
+
+use crate::error::Error;
+use crate::logger::Logger;
+use crate::overflow::{OverflowManager, OverflowRef};
+use crate::page::PageId;
+
+/// Default read rate of the scrubber, in bytes per second.
+pub const DEFAULT_SCRUB_BYTES_PER_SEC: u64 = 8 * 1024 * 1024;
+
+/// Longest the thread sleeps before checking whether the database is gone.
+const MAX_IDLE_SLEEP: Duration = Duration::from_secs(1);
+
+/// The boxed hook function.
+type HookFn = dyn Fn(PageId, &Error) + Send + Sync;
+
+/// A function receiving corruption found by the scrubber.
+///
+/// Called on the scrubber thread with the page the corrupt record starts
+/// on and an error describing it. Cloning is cheap (reference counted).
+///
+/// # Example
+///
+/// ```ignore
+/// let options = DatabaseOptions {
+///     scrub_interval: Some(Duration::from_secs(3600)),
+///     on_scrub_error: Some(ScrubErrorHook::new(|page_id, err| {
+///         alert(format!("corruption on page {page_id}: {err}"));
+///     })),
+///     ..DatabaseOptions::default()
+/// };
+/// ```
+#[derive(Clone)]
+pub struct ScrubErrorHook(Arc<HookFn>);
+
+impl ScrubErrorHook {
+    /// Creates a hook from the given function.
+    pub fn new<F>(f: F) -> Self
+    where
+        F: Fn(PageId, &Error) + Send + Sync + 'static,
+    {
+        Self(Arc::new(f))
+    }
+}
+
+impl std::fmt::Debug for ScrubErrorHook {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.write_str("ScrubErrorHook")
+    }
+}
+
+/// Records to verify, as of the last commit.
+#[derive(Default)]
+struct Targets {
+    /// Advances whenever the file is written.
+    generation: u64,
+    /// Overflow values of the committed state; `None` while a write is in
+    /// progress or after one failed.
+    refs: Option<Vec<OverflowRef>>,
+}
+
+/// How a scrubber thread reads and reports.
+pub(crate) struct ScrubConfig {
+    pub(crate) path: PathBuf,
+    pub(crate) page_size: usize,
+    pub(crate) interval: Duration,
+    pub(crate) bytes_per_sec: u64,
+    pub(crate) hook: Option<ScrubErrorHook>,
+    pub(crate) logger: Logger,
+}
+
+/// Handle through which the database tells its scrubber what to verify.
+///
+/// Cheap to clone; clones share the same state.
+#[derive(Clone, Default)]
+pub(crate) struct Scrubber {
+    targets: Arc<Mutex<Targets>>,
+}
+
+impl Scrubber {
+    /// Locks the targets, recovering from a poisoned mutex.
+    fn lock(&self) -> MutexGuard<'_, Targets> {
+        self.targets.lock().unwrap_or_else(|e| e.into_inner())
+    }
+
+    /// Marks the file as being written, pausing verification until the
+    /// next [`publish()`](Self::publish).
+    pub(crate) fn begin_write(&self) {
+        let mut targets = self.lock();
+        targets.generation += 1;
+        targets.refs = None;
+    }
+
+    /// Publishes the overflow values of the newly committed state.
+    pub(crate) fn publish(&self, refs: impl Iterator<Item = OverflowRef>) {
+        let mut targets = self.lock();
+        targets.generation += 1;
+        targets.refs = Some(refs.collect());
+    }
+
+    /// Starts the scrubber thread.
+    ///
+    /// The thread exits once every handle to this scrubber is dropped.
+    pub(crate) fn spawn(&self, config: ScrubConfig) {
+        let weak = Arc::downgrade(&self.targets);
+        let logger = config.logger.clone();
+        let spawned = std::thread::Builder::new()
+            .name("thunder-scrubber".to_string())
+            .spawn(move || {
+                let mut reported = Reported::default();
+                while idle(&weak, config.interval) && scrub_pass(&weak, &config, &mut reported) {}
+            });
+        if let Err(e) = spawned {
+            // Scrubbing is best effort; the database works without it.
+            logger.log(&format!("failed to start scrubber: {e}"));
+        }
+    }
+}
+
+/// Corrupt records already reported for the committed state, so each is
+/// reported once rather than on every pass.
+#[derive(Default)]
+struct Reported {
+    generation: u64,
+    records: HashSet<PageId>,
+}
+
+/// Verifies every published target once.
+///
+/// Returns false once the database has been dropped.
+fn scrub_pass(weak: &Weak<Mutex<Targets>>, config: &ScrubConfig, reported: &mut Reported) -> bool {
+    let Some(scrubber) = upgrade(weak) else {
+        return false;
+    };
+    let (generation, refs) = {
+        let targets = scrubber.lock();
+        (targets.generation, targets.refs.clone())
+    };
+    drop(scrubber);
+    let Some(refs) = refs else {
+        return true;
+    };
+    if reported.generation != generation {
+        reported.generation = generation;
+        reported.records.clear();
+    }
+    // The file may be mid-swap after a compaction; retry next interval.
+    let Ok(mut file) = File::open(&config.path) else {
+        return true;
+    };
+
+    let manager = OverflowManager::new(config.page_size, 0);
+    for oref in refs {
+        let valid = manager.read_overflow_from_file(oref, &mut file).is_some();
+        throttle(oref, config.bytes_per_sec);
+
+        let Some(scrubber) = upgrade(weak) else {
+            return false;
+        };
+        if scrubber.lock().generation != generation {
+            return true;
+        }
+        if valid || !reported.records.insert(oref.start_page) {
+            continue;
+        }
+        let page_id = record_page(&mut file, oref, config.page_size);
+        let err = Error::Corrupted {
+            context: "scrubbing overflow value",
+            details: format!(
+                "{}-byte value on page {page_id} failed checksum verification",
+                oref.total_len
+            ),
+        };
+        match &config.hook {
+            Some(hook) => (hook.0)(page_id, &err),
+            None => config
+                .logger
+                .log(&format!("scrub found corruption on page {page_id}: {err}")),
+        }
+    }
+    true
+}
+
+/// Sleeps for `interval`, waking regularly to check on the database.
+///
+/// Returns false once the database has been dropped.
+fn idle(weak: &Weak<Mutex<Targets>>, interval: Duration) -> bool {
+    let mut remaining = interval;
+    while !remaining.is_zero() {
+        let step = remaining.min(MAX_IDLE_SLEEP);
+        std::thread::sleep(step);
+        remaining -= step;
+        if weak.strong_count() == 0 {
+            return false;
+        }
+    }
+    true
+}
+
+/// Returns a handle to the scrubber unless the database has been dropped.
+fn upgrade(weak: &Weak<Mutex<Targets>>) -> Option<Scrubber> {
+    weak.upgrade().map(|targets| Scrubber { targets })
+}
+
+/// Sleeps long enough to keep reading `oref` within `bytes_per_sec`.
+fn throttle(oref: OverflowRef, bytes_per_sec: u64) {
+    if bytes_per_sec == 0 {
+        return;
+    }
+    let bytes = OverflowManager::direct_buffer_size(oref.total_len as usize) as f64;
+    std::thread::sleep(Duration::from_secs_f64(bytes / bytes_per_sec as f64));
+}
+
+/// Returns the page an overflow value starts on.
+///
+/// Direct-format values record their byte offset, page chains their first
+/// page.
+fn record_page(file: &mut File, oref: OverflowRef, page_size: usize) -> PageId {
+    let mut magic = [0u8; 4];
+    let direct = file.seek(SeekFrom::Start(oref.start_page)).is_ok()
+        && file.read_exact(&mut magic).is_ok()
+        && u32::from_le_bytes(magic) == OverflowManager::DIRECT_FORMAT_MAGIC;
+    if direct {
+        oref.start_page / page_size as u64
+    } else {
+        oref.start_page
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_writes_pause_targets() {
+        let scrubber = Scrubber::default();
+        assert!(scrubber.lock().refs.is_none());
+
+        scrubber.publish([OverflowRef::new(4096, 10)].into_iter());
+        let published = scrubber.lock().generation;
+        assert_eq!(scrubber.lock().refs.as_ref().map(Vec::len), Some(1));
+
+        scrubber.begin_write();
+        assert!(scrubber.lock().refs.is_none());
+        assert!(scrubber.lock().generation > published);
+    }
+}
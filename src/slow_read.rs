@@ -0,0 +1,97 @@
+//! Summary: Reporting of read-path outliers to a user hook.
+//! Copyright (c) YOAB. All rights reserved.
+//!
+//! With both `DatabaseOptions::slow_read_threshold` and
+//! `DatabaseOptions::on_slow_read` set, top-level key lookups and range
+//! seeks are timed, and any that takes at least the threshold is reported
+//! to the hook with its key, its duration and the page faults the reading
+//! thread took meanwhile. Lookups through a `BucketRef` are not timed.
+//!
+//! # Cost
+//!
+//! When either option is unset, reads only check the options. When both
+//! are set, each read also reads the clock and the thread's page fault
+//! counters twice. Page faults are counted on Linux only and reported as
+//! zero elsewhere.
+//!
+//! # Page Faults
+//!
+//! Values are served from memory, so a slow read usually means its pages
+//! were swapped out or evicted; the fault count tells such reads apart
+//! from ones slowed by contention.
+
+use std::fmt;
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+
+/// The boxed hook function.
+type HookFn = dyn Fn(&[u8], Duration, u64) + Send + Sync;
+
+/// A function receiving reads slower than `slow_read_threshold`.
+///
+/// Called with the key, how long the read took and the page faults taken
+/// during it, on the reading thread, so it should return quickly. Cloning
+/// is cheap (reference counted).
+///
+/// # Example
+///
+/// ```ignore
+/// let options = DatabaseOptions {
+///     slow_read_threshold: Some(Duration::from_millis(5)),
+///     on_slow_read: Some(SlowReadHook::new(|key, elapsed, faults| {
+///         eprintln!("slow read of {key:?}: {elapsed:?}, {faults} page faults");
+///     })),
+///     ..DatabaseOptions::default()
+/// };
+/// ```
+#[derive(Clone)]
+pub struct SlowReadHook(Arc<HookFn>);
+
+impl SlowReadHook {
+    /// Creates a hook from the given function.
+    pub fn new<F>(f: F) -> Self
+    where
+        F: Fn(&[u8], Duration, u64) + Send + Sync + 'static,
+    {
+        Self(Arc::new(f))
+    }
+
+    /// Runs `read` and reports it if it takes at least `threshold`.
+    pub(crate) fn time<T>(&self, threshold: Duration, key: &[u8], read: impl FnOnce() -> T) -> T {
+        let faults = page_faults();
+        let started = Instant::now();
+
+        #[cfg(feature = "failpoint")]
+        let _ = crate::failpoint::FailpointRegistry::global().trigger("slow_read");
+
+        let result = read();
+        let elapsed = started.elapsed();
+        if elapsed >= threshold {
+            (self.0)(key, elapsed, page_faults().saturating_sub(faults));
+        }
+        result
+    }
+}
+
+impl fmt::Debug for SlowReadHook {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str("SlowReadHook")
+    }
+}
+
+/// Returns the page faults the calling thread has taken so far.
+#[cfg(target_os = "linux")]
+fn page_faults() -> u64 {
+    // SAFETY: getrusage only writes to the zero-initialized struct.
+    let mut usage: libc::rusage = unsafe { std::mem::zeroed() };
+    if unsafe { libc::getrusage(libc::RUSAGE_THREAD, &mut usage) } != 0 {
+        return 0;
+    }
+    (usage.ru_minflt + usage.ru_majflt) as u64
+}
+
+/// Returns the page faults the calling thread has taken so far.
+#[cfg(not(target_os = "linux"))]
+fn page_faults() -> u64 {
+    0
+}
@@ -0,0 +1,303 @@
+//! Summary: Snappy codec for value and block compression.
+//! Copyright (c) YOAB. All rights reserved.
+//!
+//! Implements the raw Snappy block format (not the framing format), so
+//! streams written here decode with any Snappy implementation and the
+//! other way round. A stream is the uncompressed length as a varint,
+//! followed by elements that are either literal runs or copies of earlier
+//! output:
+//!
+//! | Tag bits | Element                                                |
+//! |----------|--------------------------------------------------------|
+//! | `00`     | Literal; length in the tag or in 1-4 following bytes   |
+//! | `01`     | Copy of 4-11 bytes at an 11-bit offset                 |
+//! | `10`     | Copy of 1-64 bytes at a 2-byte offset                  |
+//! | `11`     | Copy of 1-64 bytes at a 4-byte offset                  |
+//!
+//! Like the reference implementation, the compressor only emits offsets
+//! below 64 KiB; the decompressor accepts all four element kinds.
+
+/// Minimum match length worth a copy.
+const MIN_MATCH: usize = 4;
+
+/// Hash table size (log2) for the match finder.
+const HASH_BITS: u32 = 14;
+
+/// Largest offset the compressor emits.
+const MAX_OFFSET: usize = u16::MAX as usize;
+
+/// Inputs shorter than this are written as a single literal, as the
+/// reference implementation does.
+const INPUT_MARGIN: usize = 15;
+
+/// Compresses `input`, which must be under 4 GiB, into a Snappy stream.
+pub fn compress(input: &[u8]) -> Vec<u8> {
+    debug_assert!(u32::try_from(input.len()).is_ok());
+    let mut out = Vec::with_capacity(input.len() / 2 + 16);
+    write_varint(&mut out, input.len() as u32);
+
+    if input.len() < INPUT_MARGIN {
+        emit_literal(&mut out, input);
+        return out;
+    }
+
+    let mut table = vec![usize::MAX; 1 << HASH_BITS];
+    let mut anchor = 0;
+    let mut i = 0;
+    while i + MIN_MATCH <= input.len() {
+        let seq = u32::from_le_bytes([input[i], input[i + 1], input[i + 2], input[i + 3]]);
+        let slot = (seq.wrapping_mul(0x1e35_a7bd) >> (32 - HASH_BITS)) as usize;
+        let candidate = table[slot];
+        table[slot] = i;
+
+        if candidate != usize::MAX
+            && i - candidate <= MAX_OFFSET
+            && input[candidate..candidate + MIN_MATCH] == input[i..i + MIN_MATCH]
+        {
+            let mut len = MIN_MATCH;
+            while i + len < input.len() && input[candidate + len] == input[i + len] {
+                len += 1;
+            }
+            emit_literal(&mut out, &input[anchor..i]);
+            emit_copy(&mut out, i - candidate, len);
+            i += len;
+            anchor = i;
+        } else {
+            i += 1;
+        }
+    }
+
+    emit_literal(&mut out, &input[anchor..]);
+    out
+}
+
+/// Writes a literal element, if `literal` is not empty.
+fn emit_literal(out: &mut Vec<u8>, literal: &[u8]) {
+    if literal.is_empty() {
+        return;
+    }
+    let n = (literal.len() - 1) as u32;
+    if n < 60 {
+        out.push((n as u8) << 2);
+    } else {
+        // The length follows in as few little-endian bytes as it needs.
+        let count = 4 - n.leading_zeros() as usize / 8;
+        out.push(((59 + count) as u8) << 2);
+        out.extend_from_slice(&n.to_le_bytes()[..count]);
+    }
+    out.extend_from_slice(literal);
+}
+
+/// Writes copy elements repeating `len` bytes from `offset` back.
+fn emit_copy(out: &mut Vec<u8>, offset: usize, mut len: usize) {
+    // Split long matches so the last piece is at least 4 bytes.
+    while len >= 68 {
+        emit_copy_2(out, offset, 64);
+        len -= 64;
+    }
+    if len > 64 {
+        emit_copy_2(out, offset, 60);
+        len -= 60;
+    }
+    if len < 12 && offset < 2048 {
+        out.push(0b01 | (((len - 4) as u8) << 2) | (((offset >> 8) as u8) << 5));
+        out.push(offset as u8);
+    } else {
+        emit_copy_2(out, offset, len);
+    }
+}
+
+/// Writes a copy element with a 2-byte offset.
+fn emit_copy_2(out: &mut Vec<u8>, offset: usize, len: usize) {
+    out.push(0b10 | (((len - 1) as u8) << 2));
+    out.extend_from_slice(&(offset as u16).to_le_bytes());
+}
+
+/// Decompresses a Snappy stream that must expand to exactly `raw_len`
+/// bytes.
+///
+/// Returns `None` if the stream is malformed.
+pub fn decompress(input: &[u8], raw_len: usize) -> Option<Vec<u8>> {
+    let mut pos = 0;
+    if read_varint(input, &mut pos)? as usize != raw_len {
+        return None;
+    }
+    let mut out = Vec::with_capacity(raw_len);
+
+    while pos < input.len() {
+        let tag = input[pos];
+        pos += 1;
+
+        let (offset, len) = match tag & 0b11 {
+            0b00 => {
+                let mut len = (tag >> 2) as usize;
+                if len >= 60 {
+                    let count = len - 59;
+                    let bytes = input.get(pos..pos + count)?;
+                    len = bytes
+                        .iter()
+                        .rev()
+                        .fold(0, |acc, &b| (acc << 8) | usize::from(b));
+                    pos += count;
+                }
+                let len = len + 1;
+                let literal = input.get(pos..pos.checked_add(len)?)?;
+                if out.len() + len > raw_len {
+                    return None;
+                }
+                out.extend_from_slice(literal);
+                pos += len;
+                continue;
+            }
+            0b01 => {
+                let low = usize::from(*input.get(pos)?);
+                pos += 1;
+                (
+                    (usize::from(tag >> 5) << 8) | low,
+                    usize::from((tag >> 2) & 0b111) + 4,
+                )
+            }
+            0b10 => {
+                let offset = u16::from_le_bytes([*input.get(pos)?, *input.get(pos + 1)?]);
+                pos += 2;
+                (usize::from(offset), usize::from(tag >> 2) + 1)
+            }
+            _ => {
+                let bytes = input.get(pos..pos + 4)?;
+                pos += 4;
+                let offset = u32::from_le_bytes([bytes[0], bytes[1], bytes[2], bytes[3]]);
+                (offset as usize, usize::from(tag >> 2) + 1)
+            }
+        };
+
+        if offset == 0 || offset > out.len() || out.len() + len > raw_len {
+            return None;
+        }
+        // Byte by byte: the copy may overlap the bytes it produces.
+        let start = out.len() - offset;
+        for k in 0..len {
+            let byte = out[start + k];
+            out.push(byte);
+        }
+    }
+
+    (out.len() == raw_len).then_some(out)
+}
+
+/// Writes `value` as a little-endian base-128 varint.
+fn write_varint(out: &mut Vec<u8>, mut value: u32) {
+    while value >= 0x80 {
+        out.push(value as u8 | 0x80);
+        value >>= 7;
+    }
+    out.push(value as u8);
+}
+
+/// Reads a varint written by `write_varint`.
+fn read_varint(input: &[u8], pos: &mut usize) -> Option<u32> {
+    let mut value = 0u32;
+    for shift in (0..35).step_by(7) {
+        let byte = *input.get(*pos)?;
+        *pos += 1;
+        value |= u32::from(byte & 0x7f).checked_shl(shift)?;
+        if byte & 0x80 == 0 {
+            return Some(value);
+        }
+    }
+    None
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_round_trip() {
+        let inputs: Vec<Vec<u8>> = vec![
+            Vec::new(),
+            b"abc".to_vec(),
+            vec![b'a'; 1000],
+            (0..5000u32)
+                .flat_map(|i| format!("key_{i:06}=value_{}", i % 7).into_bytes())
+                .collect(),
+            (0..70_000u32)
+                .map(|i| (i.wrapping_mul(2_654_435_761) >> 13) as u8)
+                .collect(),
+        ];
+        for input in inputs {
+            let compressed = compress(&input);
+            assert_eq!(decompress(&compressed, input.len()), Some(input));
+        }
+    }
+
+    #[test]
+    fn test_stream_format() {
+        assert_eq!(compress(b""), [0x00]);
+        assert_eq!(compress(b"abc"), [0x03, 0x08, b'a', b'b', b'c']);
+        // Short inputs are a single literal, however repetitive.
+        let mut stream = vec![0x08, 0x1c];
+        stream.extend_from_slice(b"abcdabcd");
+        assert_eq!(compress(b"abcdabcd"), stream);
+        // A literal, then a copy of 12 bytes from 4 back with a 2-byte offset.
+        let stream = [0x10, 0x0c, b'a', b'b', b'c', b'd', 0x2e, 0x04, 0x00];
+        assert_eq!(compress(b"abcdabcdabcdabcd"), stream);
+
+        // A copy of 4 bytes with 1-, 2- and 4-byte offsets.
+        let copy_1 = [0x08, 0x0c, b'a', b'b', b'c', b'd', 0x01, 0x04];
+        let copy_2 = [0x08, 0x0c, b'a', b'b', b'c', b'd', 0x0e, 0x04, 0x00];
+        let copy_4 = [0x08, 0x0c, b'a', b'b', b'c', b'd', 0x0f, 0x04, 0, 0, 0];
+        for stream in [&copy_1[..], &copy_2[..], &copy_4[..]] {
+            assert_eq!(decompress(stream, 8), Some(b"abcdabcd".to_vec()));
+        }
+    }
+
+    /// Streams from the reference implementation's decoder tests.
+    #[test]
+    fn test_reference_streams() {
+        let valid: [(&[u8], &[u8]); 13] = [
+            (b"\x00", b""),
+            (b"\x03\x08\xff\xff\xff", b"\xff\xff\xff"),
+            (b"\x03\xf0\x02\xff\xff\xff", b"\xff\xff\xff"),
+            (b"\x03\xf4\x02\x00\xff\xff\xff", b"\xff\xff\xff"),
+            (b"\x03\xf8\x02\x00\x00\xff\xff\xff", b"\xff\xff\xff"),
+            (b"\x03\xfc\x02\x00\x00\x00\xff\xff\xff", b"\xff\xff\xff"),
+            (b"\x04\x0cabcd", b"abcd"),
+            (b"\x0d\x0cabcd\x15\x04", b"abcdabcdabcda"),
+            (b"\x08\x0cabcd\x01\x04", b"abcdabcd"),
+            (b"\x08\x0cabcd\x01\x02", b"abcdcdcd"),
+            (b"\x08\x0cabcd\x01\x01", b"abcddddd"),
+            (b"\x06\x0cabcd\x06\x03\x00", b"abcdbc"),
+            (b"\x06\x0cabcd\x07\x03\x00\x00\x00", b"abcdbc"),
+        ];
+        for (stream, raw) in valid {
+            assert_eq!(decompress(stream, raw.len()).as_deref(), Some(raw));
+        }
+        // The reference encoder writes short inputs as one literal with the
+        // length in the tag.
+        for (stream, raw) in [&valid[0], &valid[1], &valid[6]] {
+            assert_eq!(compress(raw), *stream);
+        }
+
+        // Streams paired with the length they declare.
+        let corrupt: [(&[u8], usize); 6] = [
+            (b"\x02\x08\xff\xff\xff", 2),
+            (b"\x03\x00\xff\xff\xff", 3),
+            (b"\x08\x0cabcd\x01\x00", 8),
+            (b"\x09\x0cabcd\x01\x04", 9),
+            (b"\x08\x0cabcd\x01\x05", 8),
+            (b"\x07\x0cabcd\x01\x04", 7),
+        ];
+        for (stream, raw_len) in corrupt {
+            assert_eq!(decompress(stream, raw_len), None);
+        }
+    }
+
+    #[test]
+    fn test_rejects_malformed_streams() {
+        let stream = [0x08, 0x0c, b'a', b'b', b'c', b'd', 0x01, 0x04];
+        // Wrong declared length, truncation, and a copy from before the start.
+        assert_eq!(decompress(&stream, 9), None);
+        assert_eq!(decompress(&stream[..stream.len() - 1], 8), None);
+        assert_eq!(decompress(&[0x04, 0x01, 0x04], 4), None);
+    }
+}
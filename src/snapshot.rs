@@ -5,6 +5,7 @@
 //! - `Snapshot`: A consistent, immutable view of the database at a point in time
 //! - `SnapshotManager`: Manages snapshot lifecycle and memory reclamation
 //! - `SnapshotStats`: Statistics about active snapshots
+//! - `ReadHandle`: Takes snapshots from other threads while a writer runs
 //!
 //! # Design
 //!
@@ -14,12 +15,46 @@
 //! - Multiple snapshots can coexist
 //! - Memory is reclaimed when snapshots are released
 //!
+//! # Isolation
+//!
+//! Reads run under snapshot isolation. A read transaction, snapshot or
+//! bucket view sees exactly the versions committed before it began: never
+//! a write transaction's pending changes, and never part of a commit.
+//! Commits apply their changes to a copy of the tree once any reader
+//! shares it, so readers are not blocked and do not block the writer.
+//!
+//! Write transactions are serialized, since each borrows the database
+//! mutably, and see their own pending changes. With a single writer at a
+//! time, committed histories are serializable.
+//!
+//! # Reading While Writing
+//!
+//! A write transaction borrows the database mutably, so other threads
+//! cannot call `Database::snapshot()` while it is open. They take
+//! snapshots through a [`ReadHandle`] from `Database::read_handle()`
+//! instead, which always yields the last committed version, even while a
+//! write transaction is open or committing. While any handle exists, each
+//! commit publishes its tree to the handles, so the next commit copies it
+//! as if a snapshot were held.
+//!
 //! # Performance Considerations
 //!
 //! - Snapshot creation is O(1) (just an Arc clone, ~microseconds)
 //! - Copy-on-write: tree is only cloned when mutations occur while snapshots exist
 //! - No data copying occurs during iteration (zero-copy reads)
 //! - Long-lived snapshots may prevent page reclamation
+//!
+//! # Cost of Long-Lived Snapshots
+//!
+//! A snapshot pins the in-memory tree of the version it was taken from,
+//! values included, so reads never touch the file and writers never wait
+//! for it. The first commit after the snapshot copies the tree, leaving
+//! the snapshot as the only owner of the old one. Holding a snapshot open
+//! therefore costs up to one extra copy of the database in memory, however
+//! many commits happen meanwhile; snapshots of the same version share it.
+//! The memory is freed when the last snapshot of that version is released
+//! with [`Snapshot::release()`] or dropped. File space is unaffected:
+//! commits may reuse the pages the snapshot's version was read from.
 
 use std::collections::HashMap;
 use std::sync::atomic::{AtomicU64, Ordering};
@@ -27,6 +62,8 @@ use std::sync::{Arc, RwLock};
 use std::time::Instant;
 
 use crate::btree::{BTree, BTreeIter, BTreeRangeIter, Bound};
+use crate::bucket::BucketRef;
+use crate::error::Result;
 
 /// A unique identifier for a snapshot.
 pub type SnapshotId = u64;
@@ -188,6 +225,43 @@ impl Snapshot {
         self.tree.range(start, end)
     }
 
+    /// Returns a read-only view of a bucket as of this snapshot.
+    ///
+    /// The bucket supports the same reads as in a read transaction,
+    /// including cursors, for as long as the snapshot is held.
+    ///
+    /// # Errors
+    ///
+    /// Returns `BucketNotFound` if the bucket did not exist when the
+    /// snapshot was taken.
+    /// Returns `InvalidBucketName` if the name is invalid.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let snapshot = db.snapshot();
+    /// let handle = std::thread::spawn(move || {
+    ///     let orders = snapshot.bucket(b"orders")?;
+    ///     let mut cursor = orders.cursor();
+    ///     let mut entry = cursor.first();
+    ///     while let Some((key, value)) = entry {
+    ///         client.send(key, value)?;
+    ///         entry = cursor.next();
+    ///     }
+    ///     snapshot.release();
+    ///     Ok(())
+    /// });
+    /// ```
+    pub fn bucket(&self, name: &[u8]) -> Result<BucketRef<'_>> {
+        BucketRef::new(&self.tree, name)
+    }
+
+    /// Releases the snapshot.
+    ///
+    /// Equivalent to dropping it; spelled out for code that wants the end
+    /// of a long-lived snapshot to be visible.
+    pub fn release(self) {}
+
     /// Returns the number of key-value pairs visible in this snapshot.
     #[inline]
     pub fn len(&self) -> usize {
@@ -215,12 +289,92 @@ unsafe impl Send for Snapshot {}
 // Snapshot can also be shared (read-only access to Arc<BTree>)
 unsafe impl Sync for Snapshot {}
 
+/// The last committed version, as published to read handles.
+struct Published {
+    /// The committed tree; `None` while no handle is held.
+    tree: Option<Arc<BTree>>,
+    version: u64,
+}
+
+/// Handle for taking snapshots of the last committed version from other
+/// threads.
+///
+/// Cheap to clone and safe to share across threads. Unlike the database,
+/// the handle can be used while a write transaction is open. See the
+/// module documentation for the cost of holding one.
+///
+/// # Example
+///
+/// ```ignore
+/// let handle = db.read_handle();
+/// let reader = std::thread::spawn(move || {
+///     let snapshot = handle.snapshot();
+///     snapshot.bucket(b"orders").map(|orders| orders.len())
+/// });
+/// let mut wtx = db.write_tx();
+/// wtx.bucket_put(b"orders", b"1001", b"pending")?;
+/// wtx.commit()?;
+/// ```
+#[derive(Clone)]
+pub struct ReadHandle {
+    published: Arc<RwLock<Published>>,
+    manager: Arc<SnapshotManager>,
+}
+
+impl ReadHandle {
+    /// Creates a handle with nothing published yet.
+    pub(crate) fn new(manager: Arc<SnapshotManager>) -> Self {
+        Self {
+            published: Arc::new(RwLock::new(Published {
+                tree: None,
+                version: 0,
+            })),
+            manager,
+        }
+    }
+
+    /// Returns a snapshot of the last committed version.
+    ///
+    /// O(1); never waits for an open write transaction.
+    pub fn snapshot(&self) -> Snapshot {
+        let tree = self
+            .published
+            .read()
+            .unwrap_or_else(|e| e.into_inner())
+            .tree
+            .clone()
+            .unwrap_or_default();
+        Snapshot::with_arc(tree, Some(Arc::clone(&self.manager)))
+    }
+
+    /// Returns the last committed version.
+    pub fn version(&self) -> u64 {
+        self.published
+            .read()
+            .unwrap_or_else(|e| e.into_inner())
+            .version
+    }
+
+    /// Returns true if any clone of the handle is held outside the database.
+    pub(crate) fn is_shared(&self) -> bool {
+        Arc::strong_count(&self.published) > 1
+    }
+
+    /// Publishes `tree` as the last committed version, or drops the
+    /// published tree if `tree` is `None`.
+    pub(crate) fn publish(&self, tree: Option<&Arc<BTree>>, version: u64) {
+        let mut published = self.published.write().unwrap_or_else(|e| e.into_inner());
+        published.tree = tree.map(Arc::clone);
+        published.version = version;
+    }
+}
+
 /// Clone implementation for BTree to support snapshot isolation.
 /// This performs a deep clone of the tree structure.
 impl Clone for BTree {
     fn clone(&self) -> Self {
         // Create a new tree and insert all entries
-        let mut new_tree = BTree::new();
+        let mut new_tree = BTree::with_comparator(self.comparator().cloned());
         for (key, value) in self.iter() {
             new_tree.insert(key.to_vec(), value.to_vec());
         }
@@ -0,0 +1,640 @@
+//! Summary: Live database statistics and a process-wide registry of published stats.
+//! Copyright (c) YOAB. All rights reserved.
+//!
+//! Every database records counters and gauges in a [`StatsCollector`]: the
+//! transactions it started, commit latencies, lookups answered by the bloom
+//! filter alone, and the size of its file. `Database::stats()` returns a
+//! [`DatabaseStats`] snapshot of them.
+//!
+//! Because committing mutably borrows the database, the collector is handed
+//! out as a separate, cloneable handle, like `VersionWatch`, so another
+//! thread can read the stats while the database is in use.
+//!
+//! # Publishing
+//!
+//! [`publish`] registers a collector under a name, and [`published_json`]
+//! renders every registered collector as one JSON object keyed by name, the
+//! layout `expvar` serves at `/debug/vars`. Snapshots are taken when the
+//! JSON is rendered, so a scrape always sees current values without any
+//! periodic export. `Database::publish_stats()` publishes the database's
+//! own collector.
+//!
+//! # Prometheus
+//!
+//! [`published_prometheus`] renders the same collectors in the Prometheus
+//! text exposition format, one `db` label per published name, for serving
+//! at `/metrics`; [`DatabaseStats::to_prometheus`] renders a single
+//! snapshot without labels. Metric names start with `thunderdb_`. Counters
+//! end in `_total`, and commit latency percentiles are a gauge in seconds
+//! with a `quantile` label. Rendering only loads atomic counters and
+//! briefly locks the latency window, so scrapes never wait on a
+//! transaction. The format is plain text, so no client library is needed.
+//!
+//! # Gauges
+//!
+//! Counters are updated as operations happen. The file size and page
+//! count, data size, free page count, entry count and version are gauges
+//! refreshed at open and after every commit and compaction.
+//!
+//! Commits that delete rewrite the committed state from the start of the
+//! file without shrinking it, so `file_size` only drops on compaction.
+//! `data_size` counts the bytes the committed state occupies and drops as
+//! soon as deleted data is gone; the difference is what compacting would
+//! reclaim.
+//!
+//! # Bytes Read and Written
+//!
+//! `bytes_written` counts what commits write to the database file: entry
+//! data, overflow values and meta pages. `bytes_read` counts what loading
+//! the database reads from it, at open and when reloading after recovery;
+//! the data is then served from memory, so read transactions add nothing. Reads are served from memory, so there is
+//! no page cache; the bloom filter rejection rate is the share of lookups
+//! answered without consulting the tree.
+
+use std::collections::{BTreeMap, VecDeque};
+use std::fmt::Write as _;
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::{Arc, Mutex, MutexGuard};
+use std::time::Duration;
+
+use crate::error::{Error, Result};
+
+/// Number of recent commit latencies kept for percentiles.
+const LATENCY_WINDOW: usize = 1024;
+
+/// Collectors registered with [`publish`], by name.
+static REGISTRY: Mutex<BTreeMap<String, StatsCollector>> = Mutex::new(BTreeMap::new());
+
+#[derive(Default)]
+struct StatsState {
+    read_txs: AtomicU64,
+    write_txs: AtomicU64,
+    commits: AtomicU64,
+    failed_commits: AtomicU64,
+    lookups: AtomicU64,
+    bloom_rejections: AtomicU64,
+    bytes_written: AtomicU64,
+    bytes_read: AtomicU64,
+    file_size: AtomicU64,
+    data_size: AtomicU64,
+    pages: AtomicU64,
+    free_pages: AtomicU64,
+    entries: AtomicU64,
+    version: AtomicU64,
+    /// The most recent commit latencies, oldest first.
+    latencies: Mutex<VecDeque<Duration>>,
+}
+
+/// Handle recording a database's statistics.
+///
+/// Cheap to clone and safe to share across threads.
+#[derive(Clone, Default)]
+pub struct StatsCollector {
+    state: Arc<StatsState>,
+}
+
+impl StatsCollector {
+    /// Locks the latency window, recovering from a poisoned mutex.
+    fn latencies(&self) -> MutexGuard<'_, VecDeque<Duration>> {
+        self.state
+            .latencies
+            .lock()
+            .unwrap_or_else(|e| e.into_inner())
+    }
+
+    /// Records that a read transaction started.
+    #[inline]
+    pub(crate) fn record_read_tx(&self) {
+        self.state.read_txs.fetch_add(1, Ordering::Relaxed);
+    }
+
+    /// Records that a write transaction started.
+    #[inline]
+    pub(crate) fn record_write_tx(&self) {
+        self.state.write_txs.fetch_add(1, Ordering::Relaxed);
+    }
+
+    /// Records the outcome of a commit that took `latency`.
+    pub(crate) fn record_commit(&self, latency: Duration, succeeded: bool) {
+        if !succeeded {
+            self.state.failed_commits.fetch_add(1, Ordering::Relaxed);
+            return;
+        }
+        self.state.commits.fetch_add(1, Ordering::Relaxed);
+        let mut latencies = self.latencies();
+        if latencies.len() == LATENCY_WINDOW {
+            latencies.pop_front();
+        }
+        latencies.push_back(latency);
+    }
+
+    /// Records a key lookup and whether the bloom filter rejected it.
+    #[inline]
+    pub(crate) fn record_lookup(&self, rejected: bool) {
+        self.state.lookups.fetch_add(1, Ordering::Relaxed);
+        if rejected {
+            self.state.bloom_rejections.fetch_add(1, Ordering::Relaxed);
+        }
+    }
+
+    /// Records `bytes` written to the database file.
+    #[inline]
+    pub(crate) fn record_write(&self, bytes: u64) {
+        self.state.bytes_written.fetch_add(bytes, Ordering::Relaxed);
+    }
+
+    /// Records `bytes` read from the database file.
+    #[inline]
+    pub(crate) fn record_read(&self, bytes: u64) {
+        self.state.bytes_read.fetch_add(bytes, Ordering::Relaxed);
+    }
+
+    /// Updates the gauges describing the committed state.
+    pub(crate) fn set_gauges(
+        &self,
+        file_size: u64,
+        data_size: u64,
+        pages: u64,
+        free_pages: u64,
+        entries: u64,
+        version: u64,
+    ) {
+        self.state.file_size.store(file_size, Ordering::Relaxed);
+        self.state.data_size.store(data_size, Ordering::Relaxed);
+        self.state.pages.store(pages, Ordering::Relaxed);
+        self.state.free_pages.store(free_pages, Ordering::Relaxed);
+        self.state.entries.store(entries, Ordering::Relaxed);
+        self.state.version.store(version, Ordering::Relaxed);
+    }
+
+    /// Returns a snapshot of the current statistics.
+    pub fn snapshot(&self) -> DatabaseStats {
+        let s = &self.state;
+        DatabaseStats {
+            file_size: s.file_size.load(Ordering::Relaxed),
+            data_size: s.data_size.load(Ordering::Relaxed),
+            pages: s.pages.load(Ordering::Relaxed),
+            free_pages: s.free_pages.load(Ordering::Relaxed),
+            entries: s.entries.load(Ordering::Relaxed),
+            version: s.version.load(Ordering::Relaxed),
+            read_txs: s.read_txs.load(Ordering::Relaxed),
+            write_txs: s.write_txs.load(Ordering::Relaxed),
+            commits: s.commits.load(Ordering::Relaxed),
+            failed_commits: s.failed_commits.load(Ordering::Relaxed),
+            commit_latency: LatencyPercentiles::from_samples(self.latencies().iter().copied()),
+            lookups: s.lookups.load(Ordering::Relaxed),
+            bloom_rejections: s.bloom_rejections.load(Ordering::Relaxed),
+            bytes_written: s.bytes_written.load(Ordering::Relaxed),
+            bytes_read: s.bytes_read.load(Ordering::Relaxed),
+        }
+    }
+}
+
+impl std::fmt::Debug for StatsCollector {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_tuple("StatsCollector")
+            .field(&self.snapshot())
+            .finish()
+    }
+}
+
+/// Percentiles of recent commit latencies.
+///
+/// All zero until the first commit.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct LatencyPercentiles {
+    pub p50: Duration,
+    pub p90: Duration,
+    pub p99: Duration,
+    pub max: Duration,
+}
+
+impl LatencyPercentiles {
+    /// Computes percentiles from latency samples, using the nearest rank.
+    fn from_samples(samples: impl Iterator<Item = Duration>) -> Self {
+        let mut sorted: Vec<Duration> = samples.collect();
+        if sorted.is_empty() {
+            return Self::default();
+        }
+        sorted.sort_unstable();
+        let rank = |pct: usize| sorted[(sorted.len() * pct).div_ceil(100).max(1) - 1];
+        Self {
+            p50: rank(50),
+            p90: rank(90),
+            p99: rank(99),
+            max: sorted[sorted.len() - 1],
+        }
+    }
+}
+
+/// A snapshot of a database's statistics.
+#[derive(Debug, Clone, Copy, Default, PartialEq)]
+pub struct DatabaseStats {
+    /// Size of the database file in bytes.
+    pub file_size: u64,
+    /// Bytes of the file holding the committed state: meta pages, entry
+    /// data and overflow values. Space beyond it is reclaimed by
+    /// compaction.
+    pub data_size: u64,
+    /// Pages the database file spans.
+    pub pages: u64,
+    /// Overflow pages freed and available for reuse. Commits that delete
+    /// rewrite the file with overflow values packed together, so deletes
+    /// shrink the used space instead of growing this list.
+    pub free_pages: u64,
+    /// Entries in the tree, including internal bookkeeping entries.
+    pub entries: u64,
+    /// The committed version.
+    pub version: u64,
+    /// Read transactions started.
+    pub read_txs: u64,
+    /// Write transactions started.
+    pub write_txs: u64,
+    /// Write transactions committed.
+    pub commits: u64,
+    /// Commits that failed.
+    pub failed_commits: u64,
+    /// Percentiles over the most recent 1024 commits.
+    pub commit_latency: LatencyPercentiles,
+    /// Top-level key lookups.
+    pub lookups: u64,
+    /// Lookups the bloom filter answered without consulting the tree.
+    pub bloom_rejections: u64,
+    /// Bytes commits wrote to the database file.
+    pub bytes_written: u64,
+    /// Bytes read from the database file while loading it.
+    pub bytes_read: u64,
+}
+
+impl DatabaseStats {
+    /// Returns the share of lookups answered by the bloom filter alone.
+    pub fn bloom_rejection_rate(&self) -> f64 {
+        if self.lookups == 0 {
+            0.0
+        } else {
+            self.bloom_rejections as f64 / self.lookups as f64
+        }
+    }
+
+    /// Renders the snapshot in the Prometheus text exposition format,
+    /// without labels.
+    ///
+    /// See [`published_prometheus()`] for stats of several databases.
+    pub fn to_prometheus(&self) -> String {
+        let mut out = String::new();
+        write_prometheus(&mut out, &[(None, *self)]);
+        out
+    }
+
+    /// Renders the snapshot as a JSON object.
+    ///
+    /// Latencies are in microseconds.
+    pub fn to_json(&self) -> String {
+        let micros = |d: Duration| d.as_micros() as u64;
+        let latency = &self.commit_latency;
+        format!(
+            concat!(
+                "{{\"file_size\":{},\"data_size\":{},\"pages\":{},\"free_pages\":{},",
+                "\"entries\":{},\"version\":{},",
+                "\"read_txs\":{},\"write_txs\":{},\"commits\":{},\"failed_commits\":{},",
+                "\"commit_latency_us\":{{\"p50\":{},\"p90\":{},\"p99\":{},\"max\":{}}},",
+                "\"lookups\":{},\"bloom_rejections\":{},\"bloom_rejection_rate\":{},",
+                "\"bytes_written\":{},\"bytes_read\":{}}}"
+            ),
+            self.file_size,
+            self.data_size,
+            self.pages,
+            self.free_pages,
+            self.entries,
+            self.version,
+            self.read_txs,
+            self.write_txs,
+            self.commits,
+            self.failed_commits,
+            micros(latency.p50),
+            micros(latency.p90),
+            micros(latency.p99),
+            micros(latency.max),
+            self.lookups,
+            self.bloom_rejections,
+            self.bloom_rejection_rate(),
+            self.bytes_written,
+            self.bytes_read,
+        )
+    }
+}
+
+/// A metric exported in the Prometheus format.
+struct Metric {
+    /// Name without the `thunderdb_` prefix.
+    name: &'static str,
+    kind: &'static str,
+    help: &'static str,
+    value: fn(&DatabaseStats) -> u64,
+}
+
+/// Prefix of every exported metric name.
+const METRIC_PREFIX: &str = "thunderdb_";
+
+/// Metrics exported with one sample per database.
+const METRICS: &[Metric] = &[
+    Metric {
+        name: "file_size_bytes",
+        kind: "gauge",
+        help: "Size of the database file in bytes.",
+        value: |s| s.file_size,
+    },
+    Metric {
+        name: "data_size_bytes",
+        kind: "gauge",
+        help: "Bytes of the database file holding the committed state.",
+        value: |s| s.data_size,
+    },
+    Metric {
+        name: "pages",
+        kind: "gauge",
+        help: "Pages the database file spans.",
+        value: |s| s.pages,
+    },
+    Metric {
+        name: "free_pages",
+        kind: "gauge",
+        help: "Overflow pages freed and available for reuse.",
+        value: |s| s.free_pages,
+    },
+    Metric {
+        name: "entries",
+        kind: "gauge",
+        help: "Entries in the tree, including internal bookkeeping entries.",
+        value: |s| s.entries,
+    },
+    Metric {
+        name: "version",
+        kind: "gauge",
+        help: "The committed version.",
+        value: |s| s.version,
+    },
+    Metric {
+        name: "read_txs_total",
+        kind: "counter",
+        help: "Read transactions started.",
+        value: |s| s.read_txs,
+    },
+    Metric {
+        name: "write_txs_total",
+        kind: "counter",
+        help: "Write transactions started.",
+        value: |s| s.write_txs,
+    },
+    Metric {
+        name: "commits_total",
+        kind: "counter",
+        help: "Write transactions committed.",
+        value: |s| s.commits,
+    },
+    Metric {
+        name: "failed_commits_total",
+        kind: "counter",
+        help: "Commits that failed.",
+        value: |s| s.failed_commits,
+    },
+    Metric {
+        name: "lookups_total",
+        kind: "counter",
+        help: "Top-level key lookups.",
+        value: |s| s.lookups,
+    },
+    Metric {
+        name: "bloom_rejections_total",
+        kind: "counter",
+        help: "Lookups the bloom filter answered without consulting the tree.",
+        value: |s| s.bloom_rejections,
+    },
+    Metric {
+        name: "written_bytes_total",
+        kind: "counter",
+        help: "Bytes commits wrote to the database file.",
+        value: |s| s.bytes_written,
+    },
+    Metric {
+        name: "read_bytes_total",
+        kind: "counter",
+        help: "Bytes read from the database file while loading it.",
+        value: |s| s.bytes_read,
+    },
+];
+
+/// Renders `series` in the Prometheus text exposition format, labeling
+/// each snapshot with its database name if it has one.
+fn write_prometheus(out: &mut String, series: &[(Option<&str>, DatabaseStats)]) {
+    let labels = |name: Option<&str>, extra: &str| {
+        let mut labels: Vec<String> = Vec::new();
+        if let Some(name) = name {
+            labels.push(format!("db=\"{}\"", escape_label_value(name)));
+        }
+        if !extra.is_empty() {
+            labels.push(extra.to_string());
+        }
+        if labels.is_empty() {
+            String::new()
+        } else {
+            format!("{{{}}}", labels.join(","))
+        }
+    };
+
+    // Writing to a String cannot fail.
+    for metric in METRICS {
+        let _ = writeln!(out, "# HELP {METRIC_PREFIX}{} {}", metric.name, metric.help);
+        let _ = writeln!(out, "# TYPE {METRIC_PREFIX}{} {}", metric.name, metric.kind);
+        for (name, stats) in series {
+            let _ = writeln!(
+                out,
+                "{METRIC_PREFIX}{}{} {}",
+                metric.name,
+                labels(*name, ""),
+                (metric.value)(stats)
+            );
+        }
+    }
+
+    let name = "commit_latency_seconds";
+    let _ = writeln!(
+        out,
+        "# HELP {METRIC_PREFIX}{name} Percentiles of the most recent 1024 commit latencies."
+    );
+    let _ = writeln!(out, "# TYPE {METRIC_PREFIX}{name} gauge");
+    for (db, stats) in series {
+        let latency = &stats.commit_latency;
+        for (quantile, value) in [
+            ("0.5", latency.p50),
+            ("0.9", latency.p90),
+            ("0.99", latency.p99),
+            ("1", latency.max),
+        ] {
+            let _ = writeln!(
+                out,
+                "{METRIC_PREFIX}{name}{} {}",
+                labels(*db, &format!("quantile=\"{quantile}\"")),
+                value.as_secs_f64()
+            );
+        }
+    }
+}
+
+/// Escapes a Prometheus label value.
+fn escape_label_value(value: &str) -> String {
+    value
+        .replace('\\', "\\\\")
+        .replace('"', "\\\"")
+        .replace('\n', "\\n")
+}
+
+/// Locks the registry, recovering from a poisoned mutex.
+fn registry() -> MutexGuard<'static, BTreeMap<String, StatsCollector>> {
+    REGISTRY.lock().unwrap_or_else(|e| e.into_inner())
+}
+
+/// Publishes `collector` under `name`.
+///
+/// The collector stays published, reporting its last values, after its
+/// database is dropped, until it is [unpublished](unpublish).
+///
+/// # Errors
+///
+/// Returns `StatsNameTaken` if a collector is already published under
+/// `name`.
+///
+/// # Example
+///
+/// ```ignore
+/// thunderdb::stats::publish("orders_db", db.stats_collector())?;
+/// // Serve from a debug endpoint:
+/// let body = thunderdb::stats::published_json();
+/// ```
+pub fn publish(name: &str, collector: StatsCollector) -> Result<()> {
+    let mut registry = registry();
+    if registry.contains_key(name) {
+        return Err(Error::StatsNameTaken {
+            name: name.to_string(),
+        });
+    }
+    registry.insert(name.to_string(), collector);
+    Ok(())
+}
+
+/// Removes the collector published under `name`.
+///
+/// Returns whether one was published.
+pub fn unpublish(name: &str) -> bool {
+    registry().remove(name).is_some()
+}
+
+/// Returns a snapshot of the collector published under `name`.
+pub fn published(name: &str) -> Option<DatabaseStats> {
+    registry().get(name).map(StatsCollector::snapshot)
+}
+
+/// Renders every published collector as one JSON object keyed by name.
+pub fn published_json() -> String {
+    let registry = registry();
+    let mut json = String::from("{");
+    for (i, (name, collector)) in registry.iter().enumerate() {
+        if i > 0 {
+            json.push(',');
+        }
+        write_json_string(&mut json, name);
+        json.push(':');
+        json.push_str(&collector.snapshot().to_json());
+    }
+    json.push('}');
+    json
+}
+
+/// Renders every published collector in the Prometheus text exposition
+/// format, labeled `db` with its published name.
+///
+/// # Example
+///
+/// ```ignore
+/// db.publish_stats("orders_db")?;
+/// // Serve from the metrics endpoint:
+/// let body = thunderdb::stats::published_prometheus();
+/// // thunderdb_commits_total{db="orders_db"} 42
+/// ```
+pub fn published_prometheus() -> String {
+    let series: Vec<(String, DatabaseStats)> = registry()
+        .iter()
+        .map(|(name, collector)| (name.clone(), collector.snapshot()))
+        .collect();
+    let series: Vec<(Option<&str>, DatabaseStats)> = series
+        .iter()
+        .map(|(name, stats)| (Some(name.as_str()), *stats))
+        .collect();
+    let mut out = String::new();
+    write_prometheus(&mut out, &series);
+    out
+}
+
+/// Appends `s` to `out` as a quoted JSON string.
+fn write_json_string(out: &mut String, s: &str) {
+    out.push('"');
+    for c in s.chars() {
+        match c {
+            '"' => out.push_str("\\\""),
+            '\\' => out.push_str("\\\\"),
+            c if c < ' ' => {
+                let _ = write!(out, "\\u{:04x}", c as u32);
+            }
+            c => out.push(c),
+        }
+    }
+    out.push('"');
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_latency_percentiles() {
+        let samples = (1..=100).map(Duration::from_micros);
+        let latency = LatencyPercentiles::from_samples(samples);
+        assert_eq!(latency.p50, Duration::from_micros(50));
+        assert_eq!(latency.p90, Duration::from_micros(90));
+        assert_eq!(latency.p99, Duration::from_micros(99));
+        assert_eq!(latency.max, Duration::from_micros(100));
+        assert_eq!(
+            LatencyPercentiles::from_samples(std::iter::empty()),
+            LatencyPercentiles::default()
+        );
+    }
+
+    #[test]
+    fn test_prometheus_format() {
+        let stats = DatabaseStats {
+            commits: 3,
+            commit_latency: LatencyPercentiles {
+                p50: Duration::from_millis(2),
+                ..LatencyPercentiles::default()
+            },
+            ..DatabaseStats::default()
+        };
+        let text = stats.to_prometheus();
+        assert!(
+            text.contains("# TYPE thunderdb_commits_total counter\nthunderdb_commits_total 3\n")
+        );
+        assert!(text.contains("thunderdb_commit_latency_seconds{quantile=\"0.5\"} 0.002\n"));
+
+        let mut text = String::new();
+        write_prometheus(&mut text, &[(Some("a\"b"), stats)]);
+        assert!(text.contains("thunderdb_commits_total{db=\"a\\\"b\"} 3\n"));
+        assert!(text.contains("{db=\"a\\\"b\",quantile=\"1\"}"));
+    }
+
+    #[test]
+    fn test_json_string_escaping() {
+        let mut out = String::new();
+        write_json_string(&mut out, "a\"b\\c\n");
+        assert_eq!(out, r#""a\"b\\c\u000a""#);
+    }
+}
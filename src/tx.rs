@@ -1,13 +1,31 @@
 //! Summary: Read and write transaction types.
 //! Copyright (c) YOAB. All rights reserved.
 
+use std::backtrace::Backtrace;
+use std::collections::HashSet;
+use std::io::Read;
 use std::ops::RangeBounds;
+use std::sync::Arc;
+use std::time::{Duration, Instant, SystemTime};
 
+use crate::audit::{AuditOp, AuditRecord};
 use crate::btree::{BTree, BTreeIter, BTreeRangeIter, Bound};
-use crate::bucket::{self, BucketRef, NestedBucketRef, bucket_exists, list_buckets};
+use crate::bucket::{
+    self, BucketMut, BucketRef, CompactionPriority, EmptySubBuckets, EvictionPolicy, KeyLimit,
+    NestedBucketRef, TransformAction, TruncateSequence, bucket_exists, list_buckets,
+};
+use crate::cancel::{CancelCheck, CancelToken};
+use crate::checksum;
+use crate::compress::{PageCompression, ValueCompression};
+use crate::cursor::CursorMut;
 use crate::db::Database;
 use crate::error::{Error, Result};
-use crate::iter::{IterOptions, MetricsIter, PrefetchIter};
+use crate::expiry::{self, ExpiryCheck};
+use crate::iter::{IterOptions, MetricsIter, PrefetchIter, VisibleIter};
+use crate::memory::MemoryCharge;
+use crate::normalize;
+use crate::page::{PageId, VERSION};
+use crate::tx_monitor::TxRegistration;
 use crate::value::{BorrowedValue, OwnedValue};
 
 /// A read-only transaction.
@@ -22,12 +40,21 @@ use crate::value::{BorrowedValue, OwnedValue};
 /// outlive it.
 pub struct ReadTx<'db> {
     db: &'db Database,
+    /// Most entries a collecting helper may visit, if limited.
+    scan_limit: Option<usize>,
+    /// Stops scans once cancelled.
+    cancel: Option<CancelToken>,
 }
 
 impl<'db> ReadTx<'db> {
     /// Creates a new read transaction.
     pub(crate) fn new(db: &'db Database) -> Self {
-        Self { db }
+        db.stats_recorder().record_read_tx();
+        Self {
+            db,
+            scan_limit: None,
+            cancel: None,
+        }
     }
 
     /// Retrieves the value associated with the given key.
@@ -38,11 +65,7 @@ impl<'db> ReadTx<'db> {
     ///
     /// This method clones the value. For zero-copy access, use [`get_ref()`](Self::get_ref).
     pub fn get(&self, key: &[u8]) -> Option<Vec<u8>> {
-        // Fast path: bloom filter says key definitely not present.
-        if !self.db.may_contain_key(key) {
-            return None;
-        }
-        self.db.tree().get(key).map(|v| v.to_vec())
+        self.get_ref(key).map(|v| v.to_vec())
     }
 
     /// Retrieves a reference to the value associated with the given key.
@@ -68,11 +91,51 @@ impl<'db> ReadTx<'db> {
     /// ```
     #[inline]
     pub fn get_ref(&self, key: &[u8]) -> Option<&[u8]> {
-        // Fast path: bloom filter says key definitely not present.
-        if !self.db.may_contain_key(key) {
-            return None;
+        if let Some(normalizer) = &self.db.options().key_normalizer {
+            return self.get_stored(&normalizer.normalize(key));
+        }
+        self.get_stored(key)
+    }
+
+    /// Looks up a key exactly as stored in the tree.
+    #[inline]
+    fn get_stored(&self, key: &[u8]) -> Option<&[u8]> {
+        self.timed(key, || {
+            // Fast path: bloom filter says key definitely not present.
+            let rejected = !self.db.may_contain_key(key);
+            self.db.stats_recorder().record_lookup(rejected);
+            if rejected {
+                return None;
+            }
+            self.db.tree().get(key)
+        })
+    }
+
+    /// Runs a read of `key`, reporting it if slow-read reporting is on.
+    #[inline]
+    fn timed<T>(&self, key: &[u8], read: impl FnOnce() -> T) -> T {
+        let options = self.db.options();
+        match (options.slow_read_threshold, &options.on_slow_read) {
+            (Some(threshold), Some(hook)) => hook.time(threshold, key, read),
+            _ => read(),
         }
-        self.db.tree().get(key)
+    }
+
+    /// Returns the key as originally written, before normalization.
+    ///
+    /// Only available when `key_normalizer` is set; `key` may be given in
+    /// any form that normalizes to the stored key.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// // With an ASCII-lowercase normalizer, after `wtx.put(b"Alice", ..)`:
+    /// assert_eq!(rtx.original_key(b"ALICE"), Some(b"Alice".to_vec()));
+    /// ```
+    pub fn original_key(&self, key: &[u8]) -> Option<Vec<u8>> {
+        let normalizer = self.db.options().key_normalizer.as_ref()?;
+        let entry = normalize::original_key_entry(&normalizer.normalize(key));
+        self.db.tree().get(&entry).map(|v| v.to_vec())
     }
 
     /// Retrieves a borrowed value with explicit lifetime marker.
@@ -125,6 +188,27 @@ impl<'db> ReadTx<'db> {
         self.get_ref(key).map(OwnedValue::from_slice)
     }
 
+    /// Retrieves a value and verifies it against its stored checksum.
+    ///
+    /// Returns `Ok(None)` if the key does not exist. Values written
+    /// without `value_checksums` enabled have no checksum and are
+    /// returned unverified.
+    ///
+    /// # Errors
+    ///
+    /// Returns `ValueCorrupt` if the value does not match its checksum.
+    pub fn get_checked(&self, key: &[u8]) -> Result<Option<&[u8]>> {
+        let stored_key = match &self.db.options().key_normalizer {
+            Some(normalizer) => normalizer.normalize(key),
+            None => key.to_vec(),
+        };
+        let Some(value) = self.get_stored(&stored_key) else {
+            return Ok(None);
+        };
+        checksum::verify(self.db.tree(), &stored_key, value)?;
+        Ok(Some(value))
+    }
+
     /// Returns a read-only reference to a bucket.
     ///
     /// # Errors
@@ -132,7 +216,130 @@ impl<'db> ReadTx<'db> {
     /// Returns `BucketNotFound` if the bucket does not exist.
     /// Returns `InvalidBucketName` if the name is invalid.
     pub fn bucket(&self, name: &[u8]) -> Result<BucketRef<'_>> {
-        BucketRef::new(self.db.tree(), name)
+        BucketRef::new(self.db.tree(), name).map(|bucket| {
+            bucket
+                .with_cancel(self.cancel.clone())
+                .with_bloom(self.db.bucket_bloom(name))
+        })
+    }
+
+    /// Retrieves keys from several buckets at once.
+    ///
+    /// Takes `(bucket, key)` pairs and returns their values in the same
+    /// order, `None` for missing keys. Each bucket is resolved once and
+    /// reused for all of its keys, and every value comes from this
+    /// transaction's consistent view.
+    ///
+    /// Keys the bloom filter rules out are answered without descending the
+    /// tree, and the rest are looked up in key order, so probing a large
+    /// bucket for mostly absent keys costs little more than hashing them.
+    ///
+    /// # Errors
+    ///
+    /// Returns `BucketNotFound` if any bucket does not exist.
+    /// Returns `InvalidBucketName` if any bucket name is invalid.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let rtx = db.read_tx();
+    /// let values = rtx.multi_bucket_get(&[
+    ///     (b"users", b"alice"),
+    ///     (b"sessions", b"s1"),
+    /// ])?;
+    /// ```
+    pub fn multi_bucket_get(&self, requests: &[(&[u8], &[u8])]) -> Result<Vec<Option<&[u8]>>> {
+        let mut resolved: HashSet<&[u8]> = HashSet::new();
+        for &(name, _) in requests {
+            if resolved.insert(name) {
+                BucketRef::new(self.db.tree(), name)?;
+            }
+        }
+
+        // Drop definite misses, then walk the tree once in key order.
+        let (indices, internal_keys): (Vec<usize>, Vec<Vec<u8>>) = requests
+            .iter()
+            .enumerate()
+            .map(|(i, &(name, key))| (i, bucket::bucket_data_key(name, key)))
+            .filter(|(_, internal_key)| self.db.may_contain_key(internal_key))
+            .unzip();
+
+        let expiry = ExpiryCheck::new(self.db.tree());
+        let mut values = vec![None; requests.len()];
+        for ((i, internal_key), value) in indices
+            .into_iter()
+            .zip(&internal_keys)
+            .zip(self.db.tree().get_many(&internal_keys))
+        {
+            values[i] = value.filter(|_| !expiry.is_expired(internal_key));
+        }
+        Ok(values)
+    }
+
+    /// Retrieves a value from a bucket and verifies its checksum.
+    ///
+    /// See [`get_checked()`](Self::get_checked).
+    ///
+    /// # Errors
+    ///
+    /// Returns `BucketNotFound` if the bucket does not exist.
+    /// Returns `InvalidBucketName` if the name is invalid.
+    /// Returns `ValueCorrupt` if the value does not match its checksum.
+    pub fn bucket_get_checked(&self, bucket_name: &[u8], key: &[u8]) -> Result<Option<&[u8]>> {
+        // Validates the name and checks the bucket exists.
+        BucketRef::new(self.db.tree(), bucket_name)?;
+        if self
+            .db
+            .bucket_bloom(bucket_name)
+            .is_some_and(|bloom| !bloom.may_contain(key))
+        {
+            return Ok(None);
+        }
+        let internal_key = bucket::bucket_data_key(bucket_name, key);
+        let Some(value) = self.db.tree().get(&internal_key) else {
+            return Ok(None);
+        };
+        if ExpiryCheck::new(self.db.tree()).is_expired(&internal_key) {
+            return Ok(None);
+        }
+        checksum::verify(self.db.tree(), &internal_key, value)?;
+        Ok(Some(value))
+    }
+
+    /// Returns the page holding a key's entry and the entry's byte offset
+    /// within that page.
+    ///
+    /// Scans the data section on disk; meant for layout analysis. Entries
+    /// stored in a compressed block report the block's position. Returns
+    /// `None` if the key has no persisted entry.
+    ///
+    /// # Errors
+    ///
+    /// Returns an error if the data section cannot be read or is corrupted.
+    pub fn page_of(&self, key: &[u8]) -> Result<Option<(PageId, usize)>> {
+        match &self.db.options().key_normalizer {
+            Some(normalizer) => self.db.entry_location(&normalizer.normalize(key)),
+            None => self.db.entry_location(key),
+        }
+    }
+
+    /// Returns the page holding a bucket key's entry and the entry's byte
+    /// offset within that page.
+    ///
+    /// See [`page_of()`](Self::page_of).
+    ///
+    /// # Errors
+    ///
+    /// Returns `BucketNotFound` if the bucket does not exist.
+    /// Returns `InvalidBucketName` if the name is invalid.
+    pub fn bucket_page_of(
+        &self,
+        bucket_name: &[u8],
+        key: &[u8],
+    ) -> Result<Option<(PageId, usize)>> {
+        BucketRef::new(self.db.tree(), bucket_name)?;
+        self.db
+            .entry_location(&bucket::bucket_data_key(bucket_name, key))
     }
 
     /// Checks if a bucket exists.
@@ -147,9 +354,21 @@ impl<'db> ReadTx<'db> {
 
     /// Returns an iterator over all key-value pairs in the database.
     ///
-    /// Keys are returned in sorted (lexicographic) order.
-    pub fn iter(&self) -> BTreeIter<'_> {
-        self.db.tree().iter()
+    /// Keys are returned in sorted (lexicographic) order. Internal
+    /// companion entries (value checksums, original keys, bucket order
+    /// entries and deadlines) are skipped; use
+    /// [`original_key()`](Self::original_key) to read original keys.
+    pub fn iter(&self) -> VisibleIter<BTreeIter<'_>> {
+        self.visible(self.db.tree().iter())
+    }
+
+    /// Wraps `iter` to skip the entries reads do not expose.
+    fn visible<I>(&self, iter: I) -> VisibleIter<I> {
+        let options = self.db.options();
+        let hide = options.value_checksums
+            || options.key_normalizer.is_some()
+            || bucket::has_internal_companions(self.db.tree());
+        VisibleIter::new(iter, hide)
     }
 
     /// Returns an iterator with custom options for optimized scanning.
@@ -167,8 +386,11 @@ impl<'db> ReadTx<'db> {
     ///     // Process entries with prefetching
     /// }
     /// ```
-    pub fn iter_with_options(&self, options: IterOptions) -> PrefetchIter<'_, BTreeIter<'_>> {
-        PrefetchIter::new(self.db.tree().iter(), options.prefetch_count)
+    pub fn iter_with_options(
+        &self,
+        options: IterOptions,
+    ) -> PrefetchIter<'_, VisibleIter<BTreeIter<'_>>> {
+        PrefetchIter::new(self.iter(), options.prefetch_count)
     }
 
     /// Returns an iterator that collects scan metrics.
@@ -187,8 +409,8 @@ impl<'db> ReadTx<'db> {
     ///     metrics.keys_scanned,
     ///     std::time::Duration::from_nanos(metrics.scan_duration_ns));
     /// ```
-    pub fn iter_with_metrics(&self) -> MetricsIter<BTreeIter<'_>> {
-        MetricsIter::new(self.db.tree().iter())
+    pub fn iter_with_metrics(&self) -> MetricsIter<VisibleIter<BTreeIter<'_>>> {
+        MetricsIter::new(self.iter())
     }
 
     /// Returns an iterator over a range of key-value pairs.
@@ -201,8 +423,9 @@ impl<'db> ReadTx<'db> {
     /// - `start..end` for keys >= start and < end
     /// - `start..=end` for keys >= start and <= end
     ///
-    /// Keys are returned in sorted (lexicographic) order.
-    pub fn range<'a, R>(&'a self, range: R) -> BTreeRangeIter<'a>
+    /// Keys are returned in sorted (lexicographic) order, skipping the
+    /// same entries as [`iter()`](Self::iter).
+    pub fn range<'a, R>(&'a self, range: R) -> VisibleIter<BTreeRangeIter<'a>>
     where
         R: RangeBounds<&'a [u8]>,
     {
@@ -216,7 +439,126 @@ impl<'db> ReadTx<'db> {
             std::ops::Bound::Included(k) => Bound::Included(k),
             std::ops::Bound::Excluded(k) => Bound::Excluded(k),
         };
-        self.db.tree().range(start, end)
+        let seek_key = match start {
+            Bound::Included(k) | Bound::Excluded(k) => k,
+            Bound::Unbounded => &[],
+        };
+        self.visible(self.timed(seek_key, || self.db.tree().range(start, end)))
+    }
+
+    // ==================== Collecting Helpers ====================
+
+    /// Limits how many entries the collecting helpers may visit.
+    ///
+    /// [`get_prefix()`](Self::get_prefix),
+    /// [`bucket_get_prefix()`](Self::bucket_get_prefix) and
+    /// [`bucket_entries()`](Self::bucket_entries) fail with
+    /// `ScanLimitExceeded` instead of visiting more than `limit` entries,
+    /// protecting the process from materializing an accidental full scan.
+    /// Iterators such as [`iter()`](Self::iter) and
+    /// [`range()`](Self::range) are not limited, since the caller decides
+    /// how far they go.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let mut rtx = db.read_tx();
+    /// rtx.set_scan_limit(100_000);
+    /// let rows = rtx.bucket_get_prefix(b"events", user_prefix)?;
+    /// ```
+    pub fn set_scan_limit(&mut self, limit: usize) {
+        self.scan_limit = Some(limit);
+    }
+
+    /// Removes the limit set by [`set_scan_limit()`](Self::set_scan_limit).
+    pub fn clear_scan_limit(&mut self) {
+        self.scan_limit = None;
+    }
+
+    /// Returns the scan limit, if one is set.
+    pub fn scan_limit(&self) -> Option<usize> {
+        self.scan_limit
+    }
+
+    /// Stops the transaction's scans once `token` is cancelled.
+    ///
+    /// Buckets obtained afterwards carry the token: their iterators and
+    /// cursors end early and their callback scans, like the collecting
+    /// helpers, return `TxCancelled`. See the [`cancel`](crate::cancel)
+    /// module for what is checked.
+    pub fn set_cancel_token(&mut self, token: CancelToken) {
+        self.cancel = Some(token);
+    }
+
+    /// Returns copies of the entries whose keys start with `prefix`.
+    ///
+    /// Keys are matched and returned as stored, so this also sees the
+    /// internal entries of buckets; use
+    /// [`bucket_get_prefix()`](Self::bucket_get_prefix) for bucket keys.
+    ///
+    /// # Errors
+    ///
+    /// Returns `ScanLimitExceeded` if more entries match than the scan
+    /// limit allows.
+    pub fn get_prefix(&self, prefix: &[u8]) -> Result<Vec<(Vec<u8>, Vec<u8>)>> {
+        self.collect_prefix(prefix, 0)
+    }
+
+    /// Returns copies of the entries of a bucket whose keys start with
+    /// `prefix`.
+    ///
+    /// Keys are returned without the bucket prefix, in sorted order.
+    ///
+    /// # Errors
+    ///
+    /// Returns `BucketNotFound` if the bucket does not exist,
+    /// `InvalidBucketName` if the name is invalid, or `ScanLimitExceeded`
+    /// if more entries match than the scan limit allows.
+    pub fn bucket_get_prefix(
+        &self,
+        bucket_name: &[u8],
+        prefix: &[u8],
+    ) -> Result<Vec<(Vec<u8>, Vec<u8>)>> {
+        self.bucket(bucket_name)?;
+        let data_prefix = bucket::bucket_data_prefix(bucket_name);
+        let mut scan = data_prefix.clone();
+        scan.extend_from_slice(prefix);
+        self.collect_prefix(&scan, data_prefix.len())
+    }
+
+    /// Returns copies of all entries of a bucket.
+    ///
+    /// # Errors
+    ///
+    /// Returns `BucketNotFound` if the bucket does not exist,
+    /// `InvalidBucketName` if the name is invalid, or `ScanLimitExceeded`
+    /// if the bucket holds more entries than the scan limit allows.
+    pub fn bucket_entries(&self, bucket_name: &[u8]) -> Result<Vec<(Vec<u8>, Vec<u8>)>> {
+        self.bucket_get_prefix(bucket_name, &[])
+    }
+
+    /// Copies the entries under `prefix`, dropping the first `strip` bytes
+    /// of each key, and enforcing the scan limit.
+    fn collect_prefix(&self, prefix: &[u8], strip: usize) -> Result<Vec<(Vec<u8>, Vec<u8>)>> {
+        let mut results = Vec::new();
+        let expiry = ExpiryCheck::new(self.db.tree());
+        let mut cancel = CancelCheck::new(self.cancel.clone());
+        let entries = self
+            .range(prefix..)
+            .take_while(|(key, _)| key.starts_with(prefix))
+            .filter(|(key, _)| !expiry.is_expired(key));
+        for (key, value) in entries {
+            if cancel.tick() {
+                cancel.check()?;
+            }
+            if let Some(limit) = self.scan_limit
+                && results.len() == limit
+            {
+                return Err(Error::ScanLimitExceeded { limit });
+            }
+            results.push((key[strip..].to_vec(), value.to_vec()));
+        }
+        Ok(results)
     }
 
     // ==================== Nested Bucket Methods ====================
@@ -329,27 +671,169 @@ pub struct WriteTx<'db> {
     deleted: Vec<Vec<u8>>,
     /// Whether this transaction has been committed.
     committed: bool,
+    /// Creation backtrace, captured when leak detection or the duration
+    /// watchdog is enabled. Cleared once the transaction is committed or
+    /// rolled back.
+    creation_trace: Option<Arc<Backtrace>>,
+    /// Registration with the transaction monitor (if `max_tx_duration` is set).
+    registration: Option<TxRegistration>,
+    /// Whether reads merge this transaction's pending writes.
+    read_your_writes: bool,
+    /// Pending bytes charged towards the process-wide commit threshold.
+    memory: MemoryCharge,
+    /// Bytes staged so far, counted against `max_tx_size`.
+    staged_bytes: u64,
+    /// Whether any deadline has been staged, so plain puts must clear it.
+    staged_expiry: bool,
+    /// Stops scans and refuses the commit once cancelled.
+    cancel: Option<CancelToken>,
+    /// Callbacks to run once the transaction's outcome is decided.
+    hooks: TxHooks,
+    /// Version to commit as, set by `Database::update_with_version()`.
+    version: Option<u64>,
+}
+
+/// A callback registered with `WriteTx::on_commit()` or
+/// `WriteTx::on_rollback()`.
+type TxHook = Box<dyn FnOnce() + Send>;
+
+/// The outcome callbacks registered with a write transaction.
+#[derive(Default)]
+pub(crate) struct TxHooks {
+    on_commit: Vec<TxHook>,
+    on_rollback: Vec<TxHook>,
+}
+
+impl TxHooks {
+    /// Runs the commit callbacks in registration order.
+    pub(crate) fn committed(self) {
+        for hook in self.on_commit {
+            hook();
+        }
+    }
+
+    /// Runs the rollback callbacks in registration order.
+    pub(crate) fn rolled_back(self) {
+        for hook in self.on_rollback {
+            hook();
+        }
+    }
 }
 
 impl<'db> WriteTx<'db> {
     /// Creates a new write transaction.
     pub(crate) fn new(db: &'db mut Database) -> Self {
+        let (creation_trace, registration) = Self::begin(db);
+        let pending = BTree::with_comparator(db.options().comparator.clone());
         Self {
             db,
-            pending: BTree::new(),
+            pending,
             deleted: Vec::new(),
             committed: false,
+            creation_trace,
+            registration,
+            read_your_writes: true,
+            memory: MemoryCharge::default(),
+            staged_bytes: 0,
+            staged_expiry: false,
+            cancel: None,
+            hooks: TxHooks::default(),
+            version: None,
         }
     }
 
+    /// Records the start of a transaction, capturing its creation trace and
+    /// registering it with the monitor when those are enabled.
+    fn begin(db: &Database) -> (Option<Arc<Backtrace>>, Option<TxRegistration>) {
+        db.stats_recorder().record_write_tx();
+        let options = db.options();
+        let creation_trace = (options.detect_tx_leaks || options.max_tx_duration.is_some())
+            .then(|| Arc::new(Backtrace::force_capture()));
+        let registration = match (&creation_trace, options.max_tx_duration) {
+            (Some(trace), Some(_)) => Some(db.tx_monitor().register(Arc::clone(trace))),
+            _ => None,
+        };
+        (creation_trace, registration)
+    }
+
+    /// Makes reads in this transaction see only committed state.
+    ///
+    /// By default, `bucket_get()`, `nested_bucket_get()` and cursors from
+    /// `bucket_cursor()` merge the transaction's own pending writes and
+    /// deletions into their results. After this call they skip that merge
+    /// and read the committed tree directly, including for bucket existence
+    /// checks, which is faster in transactions with many pending changes.
+    ///
+    /// Only use this when the transaction never reads keys or buckets it
+    /// has written: such reads return the committed state, not the
+    /// transaction's own writes.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let mut wtx = db.write_tx();
+    /// wtx.disable_read_your_writes();
+    /// for (key, value) in updates {
+    ///     let current = wtx.bucket_get(b"totals", &key)?; // committed value
+    ///     wtx.bucket_put(b"totals", &key, &merge(current, value))?;
+    /// }
+    /// wtx.commit()?;
+    /// ```
+    pub fn disable_read_your_writes(&mut self) {
+        self.read_your_writes = false;
+    }
+
+    /// Stops the transaction once `token` is cancelled.
+    ///
+    /// Scans of buckets obtained afterwards stop early, and `commit()`
+    /// fails with `TxCancelled`, discarding the changes. See the
+    /// [`cancel`](crate::cancel) module for what is checked.
+    pub fn set_cancel_token(&mut self, token: CancelToken) {
+        self.cancel = Some(token);
+    }
+
+    /// Registers `hook` to run after the transaction commits.
+    ///
+    /// Hooks run in registration order on the committing thread, once
+    /// `commit()` has persisted the changes, so they never run for changes
+    /// that could be lost to a crash. They do not run if the commit fails,
+    /// the transaction is rolled back or dropped, or the process dies
+    /// before the commit completes. Hooks must not use the database: it is
+    /// still borrowed by the transaction.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let mut wtx = db.write_tx();
+    /// wtx.bucket_put(b"users", b"alice", b"admin")?;
+    /// let cache = Arc::clone(&cache);
+    /// wtx.on_commit(move || cache.invalidate(b"alice"));
+    /// wtx.commit()?;
+    /// ```
+    pub fn on_commit(&mut self, hook: impl FnOnce() + Send + 'static) {
+        self.hooks.on_commit.push(Box::new(hook));
+    }
+
+    /// Registers `hook` to run if the transaction does not commit.
+    ///
+    /// Hooks run in registration order when the transaction is rolled back
+    /// or dropped, or when `commit()` returns an error.
+    pub fn on_rollback(&mut self, hook: impl FnOnce() + Send + 'static) {
+        self.hooks.on_rollback.push(Box::new(hook));
+    }
+
+    /// Removes the hooks registered so far, so the caller decides when
+    /// they run.
+    pub(crate) fn take_hooks(&mut self) -> TxHooks {
+        std::mem::take(&mut self.hooks)
+    }
+
     /// Inserts or updates a key-value pair.
     ///
     /// If the key already exists, its value will be overwritten.
     pub fn put(&mut self, key: &[u8], value: &[u8]) {
-        // Remove from deleted list if present.
-        self.deleted.retain(|k| k.as_slice() != key);
-        // Add to pending changes.
-        self.pending.insert(key.to_vec(), value.to_vec());
+        let key = self.normalize_for_put(key);
+        self.stage_put_uncapped(key, value.to_vec());
     }
 
     /// Inserts or updates a key-value pair, taking ownership of the data.
@@ -360,10 +844,12 @@ impl<'db> WriteTx<'db> {
     /// If the key already exists, its value will be overwritten.
     #[inline]
     pub fn put_owned(&mut self, key: Vec<u8>, value: Vec<u8>) {
-        // Remove from deleted list if present.
-        self.deleted.retain(|k| k.as_slice() != key);
-        // Add to pending changes without copying.
-        self.pending.insert(key, value);
+        let key = if self.db.options().key_normalizer.is_some() {
+            self.normalize_for_put(&key)
+        } else {
+            key
+        };
+        self.stage_put_uncapped(key, value);
     }
 
     /// Inserts multiple key-value pairs in bulk.
@@ -394,10 +880,7 @@ impl<'db> WriteTx<'db> {
         I: IntoIterator<Item = (Vec<u8>, Vec<u8>)>,
     {
         for (key, value) in entries {
-            // Remove from deleted list if present.
-            self.deleted.retain(|k| k.as_slice() != key);
-            // Add to pending changes.
-            self.pending.insert(key, value);
+            self.put_owned(key, value);
         }
     }
 
@@ -414,8 +897,7 @@ impl<'db> WriteTx<'db> {
         I: IntoIterator<Item = (&'a [u8], &'a [u8])>,
     {
         for (key, value) in entries {
-            self.deleted.retain(|k| k.as_slice() != key);
-            self.pending.insert(key.to_vec(), value.to_vec());
+            self.put(key, value);
         }
     }
 
@@ -423,11 +905,13 @@ impl<'db> WriteTx<'db> {
     ///
     /// Does nothing if the key does not exist.
     pub fn delete(&mut self, key: &[u8]) {
-        // Remove from pending if present.
-        self.pending.remove(key);
-        // Mark for deletion from main tree.
-        if !self.deleted.iter().any(|k| k.as_slice() == key) {
-            self.deleted.push(key.to_vec());
+        match &self.db.options().key_normalizer {
+            Some(normalizer) => {
+                let normalized = normalizer.normalize(key);
+                self.stage_delete_uncapped(&normalize::original_key_entry(&normalized));
+                self.stage_delete_uncapped(&normalized);
+            }
+            None => self.stage_delete_uncapped(key),
         }
     }
 
@@ -441,10 +925,128 @@ impl<'db> WriteTx<'db> {
         I: IntoIterator<Item = &'a [u8]>,
     {
         for key in keys {
-            self.pending.remove(key);
-            if !self.deleted.iter().any(|k| k.as_slice() == key) {
-                self.deleted.push(key.to_vec());
-            }
+            self.delete(key);
+        }
+    }
+
+    /// Normalizes a key about to be written, recording its original form.
+    ///
+    /// Returns the key unchanged when no normalizer is configured.
+    fn normalize_for_put(&mut self, key: &[u8]) -> Vec<u8> {
+        let Some(normalizer) = &self.db.options().key_normalizer else {
+            return key.to_vec();
+        };
+        let normalized = normalizer.normalize(key);
+        self.stage_put_uncapped(normalize::original_key_entry(&normalized), key.to_vec());
+        normalized
+    }
+
+    /// Stages a write of an internal key.
+    ///
+    /// Returns `TxTooLarge`, staging nothing, if the write would exceed
+    /// `max_tx_size`.
+    #[inline]
+    pub(crate) fn stage_put(&mut self, key: Vec<u8>, value: Vec<u8>) -> Result<()> {
+        self.reserve_tx_size(key.len() + value.len())?;
+        self.insert_pending(key, value);
+        Ok(())
+    }
+
+    /// Stages a write of an internal key that counts towards
+    /// `max_tx_size` but is never refused.
+    #[inline]
+    fn stage_put_uncapped(&mut self, key: Vec<u8>, value: Vec<u8>) {
+        self.staged_bytes += (key.len() + value.len()) as u64;
+        self.insert_pending(key, value);
+    }
+
+    /// Stages a deletion of an internal key.
+    ///
+    /// Returns `TxTooLarge`, staging nothing, if the deletion would exceed
+    /// `max_tx_size`.
+    #[inline]
+    fn stage_delete(&mut self, key: &[u8]) -> Result<()> {
+        self.reserve_tx_size(key.len())?;
+        self.remove_pending(key);
+        Ok(())
+    }
+
+    /// Stages a deletion of an internal key that counts towards
+    /// `max_tx_size` but is never refused.
+    #[inline]
+    fn stage_delete_uncapped(&mut self, key: &[u8]) {
+        self.staged_bytes += key.len() as u64;
+        self.remove_pending(key);
+    }
+
+    /// Adds a write to the pending changes, without counting it.
+    #[inline]
+    fn insert_pending(&mut self, key: Vec<u8>, value: Vec<u8>) {
+        // Remove from deleted list if present.
+        self.deleted.retain(|k| k.as_slice() != key);
+        // Add to pending changes.
+        self.memory.charge(key.len() + value.len());
+        self.pending.insert(key, value);
+    }
+
+    /// Adds a deletion to the pending changes, without counting it.
+    #[inline]
+    fn remove_pending(&mut self, key: &[u8]) {
+        // Remove from pending if present.
+        self.pending.remove(key);
+        // Mark for deletion from main tree.
+        if !self.deleted.iter().any(|k| k.as_slice() == key) {
+            self.deleted.push(key.to_vec());
+        }
+    }
+
+    /// Returns the staged size `bytes` more would bring the transaction
+    /// to, or `TxTooLarge` if that is past `max_tx_size`.
+    fn check_tx_size(&self, bytes: usize) -> Result<u64> {
+        let size = self.staged_bytes + bytes as u64;
+        match self.db.options().max_tx_size {
+            Some(limit) if size > limit => Err(Error::TxTooLarge { size, limit }),
+            _ => Ok(size),
+        }
+    }
+
+    /// Counts `bytes` about to be staged against `max_tx_size`.
+    ///
+    /// Returns `TxTooLarge`, counting nothing, if they would take the
+    /// transaction past the cap.
+    fn reserve_tx_size(&mut self, bytes: usize) -> Result<()> {
+        self.staged_bytes = self.check_tx_size(bytes)?;
+        Ok(())
+    }
+
+    /// Returns the bytes staged so far, as counted against
+    /// [`max_tx_size`](crate::DatabaseOptions::max_tx_size).
+    pub fn staged_bytes(&self) -> u64 {
+        self.staged_bytes
+    }
+
+    /// Starts a batch of bucket operations on this transaction.
+    ///
+    /// The returned builder records operations and executes them in an
+    /// efficient order when [`TxBatch::apply()`] is called. The applied
+    /// operations become part of this transaction and are committed
+    /// atomically with it.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let mut wtx = db.write_tx();
+    /// wtx.batch()
+    ///     .create_bucket(b"users")
+    ///     .put(b"users", b"alice", b"1")
+    ///     .delete(b"sessions", b"stale")
+    ///     .apply()?;
+    /// wtx.commit()?;
+    /// ```
+    pub fn batch(&mut self) -> TxBatch<'_, 'db> {
+        TxBatch {
+            tx: self,
+            ops: Vec::new(),
         }
     }
 
@@ -469,7 +1071,7 @@ impl<'db> WriteTx<'db> {
         self.deleted.retain(|k| k.as_slice() != meta_key.as_slice());
 
         // Add bucket metadata to pending.
-        self.pending.insert(meta_key, Vec::new());
+        self.pending.insert(meta_key, bucket::new_bucket_header());
         Ok(())
     }
 
@@ -492,10 +1094,17 @@ impl<'db> WriteTx<'db> {
         let meta_key = bucket::bucket_meta_key(name);
         self.deleted.retain(|k| k.as_slice() != meta_key.as_slice());
 
-        self.pending.insert(meta_key, Vec::new());
+        self.pending.insert(meta_key, bucket::new_bucket_header());
         Ok(true)
     }
 
+    /// Returns a mutable view of a bucket's pending writes.
+    ///
+    /// Used to seed a bucket created in this transaction.
+    pub(crate) fn pending_bucket_mut(&mut self, name: &[u8]) -> Result<BucketMut<'_>> {
+        BucketMut::new(&mut self.pending, name)
+    }
+
     /// Deletes a bucket and all its contents.
     ///
     /// # Errors
@@ -517,13 +1126,14 @@ impl<'db> WriteTx<'db> {
 
         // Collect all data keys to delete from main tree.
         let prefix = bucket::bucket_data_prefix(name);
+        let order_prefix = bucket::bucket_order_prefix(name);
         let keys_from_main: Vec<Vec<u8>> = self
             .db
             .tree()
             .iter()
             .filter_map(|(k, _)| {
-                // Direct bucket data.
-                if k.starts_with(&prefix) {
+                // Direct bucket data and its insertion order.
+                if k.starts_with(&prefix) || k.starts_with(&order_prefix) {
                     return Some(k.to_vec());
                 }
                 // Nested bucket metadata under this bucket.
@@ -550,8 +1160,8 @@ impl<'db> WriteTx<'db> {
             .pending
             .iter()
             .filter_map(|(k, _)| {
-                // Direct bucket data.
-                if k.starts_with(&prefix) {
+                // Direct bucket data and its insertion order.
+                if k.starts_with(&prefix) || k.starts_with(&order_prefix) {
                     return Some(k.to_vec());
                 }
                 // Nested bucket metadata under this bucket.
@@ -579,11 +1189,147 @@ impl<'db> WriteTx<'db> {
         Ok(())
     }
 
-    /// Checks if a bucket is effectively present (exists and not marked for deletion).
-    fn is_bucket_present(&self, name: &[u8]) -> bool {
-        let meta_key = bucket::bucket_meta_key(name);
-
-        // Check if marked for deletion.
+    /// Renames a top-level bucket, keeping its keys, settings and nested
+    /// buckets.
+    ///
+    /// Bucket names are part of the stored keys, so every entry of the
+    /// bucket is staged under the new name and deleted under the old one;
+    /// the values move without being copied by the caller. The rename
+    /// takes effect with the rest of the transaction: readers see the
+    /// bucket under the old name until the commit and under the new one
+    /// after it, never under both or neither. Like any commit with
+    /// deletes, the commit rewrites the file.
+    ///
+    /// # Errors
+    ///
+    /// Returns `BucketNotFound` if `old` doesn't exist,
+    /// `BucketAlreadyExists` if `new` does, `InvalidBucketName` if either
+    /// name is invalid, or `TxTooLarge` if the moved entries would exceed
+    /// `max_tx_size`.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let mut wtx = db.write_tx();
+    /// wtx.rename_bucket(b"events_v1", b"events_v2")?;
+    /// wtx.commit()?;
+    /// ```
+    pub fn rename_bucket(&mut self, old: &[u8], new: &[u8]) -> Result<()> {
+        bucket::validate_bucket_name(old)?;
+        bucket::validate_bucket_name(new)?;
+
+        if !self.is_bucket_present(old) {
+            return Err(Error::BucketNotFound { name: old.to_vec() });
+        }
+        if self.is_bucket_present(new) {
+            return Err(Error::BucketAlreadyExists { name: new.to_vec() });
+        }
+
+        // Entries this transaction sees: its own writes over the
+        // committed ones it hasn't deleted.
+        let mut already_deleted: HashSet<Vec<u8>> = self.deleted.iter().cloned().collect();
+        let mut moves: Vec<(Vec<u8>, Vec<u8>, Vec<u8>)> = Vec::new();
+        for (key, value) in self.db.tree().iter() {
+            if already_deleted.contains(key) || self.pending.get(key).is_some() {
+                continue;
+            }
+            if let Some(renamed) = bucket::renamed_bucket_key(key, old, new) {
+                moves.push((key.to_vec(), renamed, value.to_vec()));
+            }
+        }
+        for (key, value) in self.pending.iter() {
+            if let Some(renamed) = bucket::renamed_bucket_key(key, old, new) {
+                moves.push((key.to_vec(), renamed, value.to_vec()));
+            }
+        }
+
+        let bytes = moves
+            .iter()
+            .map(|(_, renamed, value)| renamed.len() + value.len())
+            .sum();
+        self.reserve_tx_size(bytes)?;
+
+        // Entries of a bucket deleted under the new name earlier in this
+        // transaction are written again, not deleted.
+        let targets: HashSet<&[u8]> = moves.iter().map(|(_, key, _)| key.as_slice()).collect();
+        self.deleted.retain(|k| !targets.contains(k.as_slice()));
+        for (key, renamed, value) in moves {
+            self.pending.remove(&key);
+            if self.db.tree().get(&key).is_some() && already_deleted.insert(key.clone()) {
+                self.deleted.push(key);
+            }
+            self.memory.charge(renamed.len() + value.len());
+            self.pending.insert(renamed, value);
+        }
+        Ok(())
+    }
+
+    /// Deletes a bucket only if it holds no keys.
+    ///
+    /// Keys in sub-buckets, at any depth, make the bucket non-empty;
+    /// `empty_sub_buckets` decides whether sub-buckets holding no keys do.
+    /// Pending writes and deletions of this transaction are taken into
+    /// account, so the check and the delete are atomic.
+    ///
+    /// Returns `true` if the bucket was deleted, `false` if it was left
+    /// because it is not empty.
+    ///
+    /// # Errors
+    ///
+    /// Returns `BucketNotFound` if the bucket doesn't exist.
+    /// Returns `InvalidBucketName` if the name is invalid.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// if !wtx.delete_bucket_if_empty(b"scratch", EmptySubBuckets::Delete)? {
+    ///     println!("scratch still holds data");
+    /// }
+    /// ```
+    pub fn delete_bucket_if_empty(
+        &mut self,
+        name: &[u8],
+        empty_sub_buckets: EmptySubBuckets,
+    ) -> Result<bool> {
+        bucket::validate_bucket_name(name)?;
+        if !self.is_bucket_present(name) {
+            return Err(Error::BucketNotFound {
+                name: name.to_vec(),
+            });
+        }
+
+        let prefix = bucket::bucket_data_prefix(name);
+        let holds_content = |k: &[u8]| {
+            if k.starts_with(&prefix) {
+                return true;
+            }
+            let counts = match k.first() {
+                Some(&0x02) => empty_sub_buckets == EmptySubBuckets::Keep,
+                Some(&0x03) => true,
+                _ => false,
+            };
+            counts && self.is_nested_child_of_bucket(k, name)
+        };
+        let deleted: HashSet<&[u8]> = self.deleted.iter().map(Vec::as_slice).collect();
+        let has_content = self.pending.iter().any(|(k, _)| holds_content(k))
+            || self
+                .db
+                .tree()
+                .iter()
+                .any(|(k, _)| holds_content(k) && !deleted.contains(k));
+        if has_content {
+            return Ok(false);
+        }
+
+        self.delete_bucket(name)?;
+        Ok(true)
+    }
+
+    /// Checks if a bucket is effectively present (exists and not marked for deletion).
+    fn is_bucket_present(&self, name: &[u8]) -> bool {
+        let meta_key = bucket::bucket_meta_key(name);
+
+        // Check if marked for deletion.
         if self
             .deleted
             .iter()
@@ -592,20 +1338,753 @@ impl<'db> WriteTx<'db> {
             return false;
         }
 
-        // Check pending and main tree.
-        self.pending.get(&meta_key).is_some() || self.db.tree().get(&meta_key).is_some()
+        // Check pending and main tree.
+        self.pending.get(&meta_key).is_some() || self.db.tree().get(&meta_key).is_some()
+    }
+
+    /// Returns a read-only reference to a bucket.
+    ///
+    /// Note: This returns a view of the committed state, not including
+    /// pending changes in this transaction. Use [`bucket_get()`](Self::bucket_get)
+    /// or [`bucket_cursor()`](Self::bucket_cursor) to read them.
+    ///
+    /// # Errors
+    ///
+    /// Returns `BucketNotFound` if the bucket does not exist.
+    /// Returns `InvalidBucketName` if the name is invalid.
+    pub fn bucket(&self, name: &[u8]) -> Result<BucketRef<'_>> {
+        bucket::validate_bucket_name(name)?;
+
+        if !self.is_bucket_present(name) {
+            return Err(Error::BucketNotFound {
+                name: name.to_vec(),
+            });
+        }
+
+        // Return view of committed tree (pending changes not visible).
+        BucketRef::new(self.db.tree(), name).map(|bucket| {
+            bucket
+                .with_cancel(self.cancel.clone())
+                .with_bloom(self.db.bucket_bloom(name))
+        })
+    }
+
+    /// Returns a cursor over a bucket that can write and delete as it moves.
+    ///
+    /// Unlike [`bucket()`](Self::bucket), the cursor sees this
+    /// transaction's own changes, as [`bucket_get()`](Self::bucket_get)
+    /// does: writes staged before or through it appear in key order, and
+    /// deleted keys are skipped. Its changes are applied on commit.
+    ///
+    /// # Errors
+    ///
+    /// Returns `BucketNotFound` if the bucket does not exist.
+    /// Returns `InvalidBucketName` if the name is invalid.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let mut wtx = db.write_tx();
+    /// let mut cursor = wtx.bucket_cursor(b"sessions")?;
+    /// while let Some((_, value)) = cursor.next() {
+    ///     if is_expired(value) {
+    ///         cursor.delete()?;
+    ///     }
+    /// }
+    /// wtx.commit()?;
+    /// ```
+    pub fn bucket_cursor(&mut self, name: &[u8]) -> Result<CursorMut<'_, 'db>> {
+        bucket::validate_bucket_name(name)?;
+
+        if !self.is_bucket_present(name) {
+            return Err(Error::BucketNotFound {
+                name: name.to_vec(),
+            });
+        }
+
+        Ok(CursorMut::new(self, name))
+    }
+
+    /// Returns the committed tree this transaction writes on top of.
+    pub(crate) fn committed_tree(&self) -> &BTree {
+        self.db.tree()
+    }
+
+    /// Returns the writes staged in this transaction.
+    pub(crate) fn pending_tree(&self) -> &BTree {
+        &self.pending
+    }
+
+    /// Returns whether the deletion of internal key `key` is staged.
+    pub(crate) fn is_staged_delete(&self, key: &[u8]) -> bool {
+        self.deleted.iter().any(|k| k.as_slice() == key)
+    }
+
+    /// Returns whether reads merge in this transaction's own changes.
+    pub(crate) fn reads_own_writes(&self) -> bool {
+        self.read_your_writes
+    }
+
+    /// Stages the deletion of every committed entry past its deadline.
+    ///
+    /// Returns the number of entries staged for deletion.
+    pub(crate) fn delete_expired(&mut self) -> usize {
+        let expired = expiry::expired_keys(self.db.tree());
+        for key in &expired {
+            self.stage_delete_uncapped(key);
+        }
+        expired.len()
+    }
+
+    /// Puts a key-value pair into a bucket.
+    ///
+    /// # Errors
+    ///
+    /// Returns `BucketNotFound` if the bucket doesn't exist.
+    /// Returns `InvalidBucketName` if the bucket name is invalid.
+    /// Returns `TxTooLarge` if the write would exceed `max_tx_size`.
+    pub fn bucket_put(&mut self, bucket_name: &[u8], key: &[u8], value: &[u8]) -> Result<()> {
+        self.bucket_put_owned(bucket_name, key, value.to_vec())
+    }
+
+    /// Stages `value` under `key` in a bucket without copying it.
+    fn bucket_put_owned(&mut self, bucket_name: &[u8], key: &[u8], value: Vec<u8>) -> Result<()> {
+        bucket::validate_bucket_name(bucket_name)?;
+
+        if !self.is_bucket_present(bucket_name) {
+            return Err(Error::BucketNotFound {
+                name: bucket_name.to_vec(),
+            });
+        }
+
+        let internal_key = bucket::bucket_data_key(bucket_name, key);
+        let expiry_key = self
+            .staged_expiry
+            .then(|| expiry::expiry_key(&internal_key));
+        self.stage_put(internal_key, value)?;
+
+        if let Some(expiry_key) = expiry_key {
+            self.pending.remove(&expiry_key);
+        }
+        Ok(())
+    }
+
+    /// Writes a key-value pair into a bucket without regard to any
+    /// existing value.
+    ///
+    /// A blind write for overwrite-heavy ingest: it inserts the key or
+    /// replaces its value, and does not report whether the key existed.
+    /// It is the same operation as [`bucket_put()`](Self::bucket_put),
+    /// which never reads the committed value either: writes are staged in
+    /// the transaction and applied at commit, so overwriting costs the same
+    /// as inserting.
+    ///
+    /// # Errors
+    ///
+    /// Returns `BucketNotFound` if the bucket doesn't exist.
+    /// Returns `InvalidBucketName` if the bucket name is invalid.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let mut wtx = db.write_tx();
+    /// for (sensor, reading) in latest_readings {
+    ///     wtx.bucket_set(b"sensors", sensor, reading)?;
+    /// }
+    /// wtx.commit()?;
+    /// ```
+    #[inline]
+    pub fn bucket_set(&mut self, bucket_name: &[u8], key: &[u8], value: &[u8]) -> Result<()> {
+        self.bucket_put(bucket_name, key, value)
+    }
+
+    /// Puts a key-value pair into a bucket that expires after `ttl`.
+    ///
+    /// The deadline is taken when this is called. Once it passes, reads
+    /// treat the key as absent, and the entry is deleted by the next
+    /// purge; see the [`expiry`](crate::expiry) module. A zero `ttl`
+    /// expires the key immediately. Writing the key again with
+    /// [`bucket_put()`](Self::bucket_put) removes the deadline.
+    ///
+    /// # Errors
+    ///
+    /// Returns `BucketNotFound` if the bucket doesn't exist.
+    /// Returns `InvalidBucketName` if the bucket name is invalid.
+    /// Returns `TxTooLarge` if the value and its deadline would exceed
+    /// `max_tx_size`.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let mut wtx = db.write_tx();
+    /// wtx.bucket_put_with_ttl(b"sessions", token, &session, Duration::from_secs(1800))?;
+    /// wtx.commit()?;
+    /// ```
+    pub fn bucket_put_with_ttl(
+        &mut self,
+        bucket_name: &[u8],
+        key: &[u8],
+        value: &[u8],
+        ttl: Duration,
+    ) -> Result<()> {
+        let internal_key = bucket::bucket_data_key(bucket_name, key);
+        let expiry_key = expiry::expiry_key(&internal_key);
+        let deadline = expiry::encode_deadline(ttl);
+        // Check the value and its deadline together, so neither is staged
+        // without the other.
+        self.check_tx_size(internal_key.len() + value.len() + expiry_key.len() + deadline.len())?;
+        self.bucket_put(bucket_name, key, value)?;
+        self.staged_expiry = true;
+        self.stage_put(expiry_key, deadline)
+    }
+
+    /// Puts a value of `size` bytes read from `reader` into a bucket.
+    ///
+    /// Reads the value straight into the buffer the transaction stages, so
+    /// the caller never holds a copy of its own. The staged value still
+    /// occupies `size` bytes until the transaction ends, as committed
+    /// values live in the database's in-memory tree.
+    ///
+    /// # Errors
+    ///
+    /// Returns `BucketNotFound` if the bucket doesn't exist.
+    /// Returns `InvalidBucketName` if the bucket name is invalid.
+    /// Returns an I/O error if `reader` fails or ends before `size` bytes,
+    /// in which case nothing is staged.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let file = File::open("video.mp4")?;
+    /// let size = file.metadata()?.len();
+    /// let mut wtx = db.write_tx();
+    /// wtx.bucket_put_reader(b"blobs", b"video.mp4", file, size)?;
+    /// wtx.commit()?;
+    /// ```
+    pub fn bucket_put_reader<R: Read>(
+        &mut self,
+        bucket_name: &[u8],
+        key: &[u8],
+        mut reader: R,
+        size: u64,
+    ) -> Result<()> {
+        bucket::validate_bucket_name(bucket_name)?;
+
+        if !self.is_bucket_present(bucket_name) {
+            return Err(Error::BucketNotFound {
+                name: bucket_name.to_vec(),
+            });
+        }
+
+        let len = usize::try_from(size).map_err(|_| {
+            std::io::Error::new(
+                std::io::ErrorKind::InvalidInput,
+                format!("value of {size} bytes does not fit in memory"),
+            )
+        })?;
+        let mut value = vec![0u8; len];
+        reader.read_exact(&mut value)?;
+        self.bucket_put_owned(bucket_name, key, value)
+    }
+
+    /// Gets a value from a bucket.
+    ///
+    /// Sees this transaction's own writes and deletions unless
+    /// [`disable_read_your_writes()`](Self::disable_read_your_writes) was
+    /// called.
+    ///
+    /// # Errors
+    ///
+    /// Returns `BucketNotFound` if the bucket doesn't exist.
+    /// Returns `InvalidBucketName` if the bucket name is invalid.
+    pub fn bucket_get(&self, bucket_name: &[u8], key: &[u8]) -> Result<Option<Vec<u8>>> {
+        bucket::validate_bucket_name(bucket_name)?;
+
+        if !self.read_your_writes {
+            let bucket = BucketRef::new(self.db.tree(), bucket_name)?
+                .with_bloom(self.db.bucket_bloom(bucket_name));
+            return Ok(bucket.get(key).map(<[u8]>::to_vec));
+        }
+
+        if !self.is_bucket_present(bucket_name) {
+            return Err(Error::BucketNotFound {
+                name: bucket_name.to_vec(),
+            });
+        }
+
+        let internal_key = bucket::bucket_data_key(bucket_name, key);
+        Ok(self.staged_value(&internal_key).map(<[u8]>::to_vec))
+    }
+
+    /// Returns the value of a key as of this transaction's own writes and
+    /// deletions.
+    fn staged_value(&self, internal_key: &[u8]) -> Option<&[u8]> {
+        // Check pending first, then main tree. A pending value carries its
+        // own deadline, if any; commit drops the committed one.
+        if let Some(value) = self.pending.get(internal_key) {
+            if ExpiryCheck::new(&self.pending).is_expired(internal_key) {
+                return None;
+            }
+            return Some(value);
+        }
+
+        // Check if deleted.
+        if self.deleted.iter().any(|k| k.as_slice() == internal_key) {
+            return None;
+        }
+
+        if ExpiryCheck::new(self.db.tree()).is_expired(internal_key) {
+            return None;
+        }
+        self.db.tree().get(internal_key)
+    }
+
+    /// Combines `operand` with a key's value using the database's merge
+    /// operator.
+    ///
+    /// The operator receives the value this transaction sees, including
+    /// its own writes even with read-your-writes disabled, or `None` if the
+    /// key is absent, and its result is written like
+    /// [`bucket_put()`](Self::bucket_put). Since the write transaction has
+    /// the database to itself, no concurrent merge can be lost. See the
+    /// [`merge`](crate::merge) module.
+    ///
+    /// # Errors
+    ///
+    /// Returns `MergeOperatorMissing` if the database has no
+    /// `merge_operator`.
+    /// Returns `BucketNotFound` if the bucket doesn't exist.
+    /// Returns `InvalidBucketName` if the bucket name is invalid.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let mut wtx = db.write_tx();
+    /// wtx.bucket_merge(b"counters", b"page_views", &1u64.to_le_bytes())?;
+    /// wtx.commit()?;
+    /// ```
+    pub fn bucket_merge(&mut self, bucket_name: &[u8], key: &[u8], operand: &[u8]) -> Result<()> {
+        let operator = self
+            .db
+            .options()
+            .merge_operator
+            .clone()
+            .ok_or(Error::MergeOperatorMissing)?;
+        bucket::validate_bucket_name(bucket_name)?;
+
+        if !self.is_bucket_present(bucket_name) {
+            return Err(Error::BucketNotFound {
+                name: bucket_name.to_vec(),
+            });
+        }
+
+        let internal_key = bucket::bucket_data_key(bucket_name, key);
+        let merged = operator.merge(self.staged_value(&internal_key), operand);
+        self.bucket_put_owned(bucket_name, key, merged)
+    }
+
+    /// Replaces the value of a key in a bucket only if it currently equals
+    /// `old`, returning whether it was replaced.
+    ///
+    /// `old` of `None` expects the key to be absent, so it inserts `new`
+    /// only if the key does not exist; an existing empty value does not
+    /// match it. The current value is read as [`bucket_get()`](Self::bucket_get)
+    /// sees it, including this transaction's pending writes and treating
+    /// expired keys as absent. On a mismatch nothing is staged and `false`
+    /// is returned.
+    ///
+    /// The comparison and the write are atomic with respect to other
+    /// writers: a write transaction borrows the database mutably, so no
+    /// other transaction can commit between them. Build optimistic updates
+    /// by reading the value, computing the new one, and retrying from a
+    /// fresh read when this returns `false`.
+    ///
+    /// # Errors
+    ///
+    /// Returns `BucketNotFound` if the bucket doesn't exist.
+    /// Returns `InvalidBucketName` if the bucket name is invalid.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let mut wtx = db.write_tx();
+    /// if wtx.bucket_compare_and_swap(b"accounts", b"alice", Some(b"100"), b"90")? {
+    ///     wtx.commit()?;
+    /// } else {
+    ///     // Someone else changed the balance; re-read and retry.
+    /// }
+    /// ```
+    pub fn bucket_compare_and_swap(
+        &mut self,
+        bucket_name: &[u8],
+        key: &[u8],
+        old: Option<&[u8]>,
+        new: &[u8],
+    ) -> Result<bool> {
+        let current = self.bucket_get(bucket_name, key)?;
+        if current.as_deref() != old {
+            return Ok(false);
+        }
+        self.bucket_put(bucket_name, key, new)?;
+        Ok(true)
+    }
+
+    /// Scans a bucket and updates or deletes entries as directed.
+    ///
+    /// `f` is called for every entry in key order, seeing this transaction's
+    /// pending writes, and returns what to do with it. The requested changes
+    /// are staged and applied after the scan completes, so `f` always sees
+    /// the bucket as it was before the transform. Changes become part of
+    /// this transaction.
+    ///
+    /// Returns the number of entries updated or deleted.
+    ///
+    /// # Errors
+    ///
+    /// Returns `BucketNotFound` if the bucket doesn't exist.
+    /// Returns `InvalidBucketName` if the bucket name is invalid.
+    /// Returns `TxTooLarge` if the changes would exceed `max_tx_size`, in
+    /// which case nothing is staged.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let changed = wtx.bucket_transform(b"sessions", |_key, value| {
+    ///     if is_expired(value) {
+    ///         TransformAction::Delete
+    ///     } else {
+    ///         TransformAction::Keep
+    ///     }
+    /// })?;
+    /// ```
+    pub fn bucket_transform<F>(&mut self, bucket_name: &[u8], mut f: F) -> Result<usize>
+    where
+        F: FnMut(&[u8], &[u8]) -> TransformAction,
+    {
+        bucket::validate_bucket_name(bucket_name)?;
+
+        if !self.is_bucket_present(bucket_name) {
+            return Err(Error::BucketNotFound {
+                name: bucket_name.to_vec(),
+            });
+        }
+
+        let prefix = bucket::bucket_data_prefix(bucket_name);
+        let mut staged: Vec<(Vec<u8>, Option<Vec<u8>>)> = Vec::new();
+        {
+            let deleted: std::collections::HashSet<&[u8]> = self
+                .deleted
+                .iter()
+                .map(Vec::as_slice)
+                .filter(|k| k.starts_with(&prefix))
+                .collect();
+            let mut committed = self
+                .db
+                .tree()
+                .range(Bound::Included(&prefix), Bound::Unbounded)
+                .take_while(|(k, _)| k.starts_with(&prefix))
+                .filter(|(k, _)| !deleted.contains(k))
+                .peekable();
+            let mut pending = self
+                .pending
+                .range(Bound::Included(&prefix), Bound::Unbounded)
+                .take_while(|(k, _)| k.starts_with(&prefix))
+                .peekable();
+
+            let pending_expiry = ExpiryCheck::new(&self.pending);
+            let committed_expiry = ExpiryCheck::new(self.db.tree());
+
+            // Merge both sorted streams; pending values shadow committed ones.
+            let order = self.pending.order();
+            loop {
+                let next = match (committed.peek(), pending.peek()) {
+                    (None, None) => break,
+                    (Some(_), None) => committed.next(),
+                    (None, Some(_)) => pending.next(),
+                    (Some((ck, _)), Some((pk, _))) => match order.cmp(ck, pk) {
+                        std::cmp::Ordering::Less => committed.next(),
+                        std::cmp::Ordering::Greater => pending.next(),
+                        std::cmp::Ordering::Equal => {
+                            committed.next();
+                            pending.next()
+                        }
+                    },
+                };
+                let Some((key, value)) = next else { break };
+                if pending_expiry.is_expired(key)
+                    || (self.pending.get(key).is_none() && committed_expiry.is_expired(key))
+                {
+                    continue;
+                }
+                match f(&key[prefix.len()..], value) {
+                    TransformAction::Keep => {}
+                    TransformAction::Update(new_value) => {
+                        staged.push((key.to_vec(), Some(new_value)));
+                    }
+                    TransformAction::Delete => staged.push((key.to_vec(), None)),
+                }
+            }
+        }
+
+        // Reserve the whole change up front, so it is staged entirely or
+        // not at all.
+        let bytes = staged
+            .iter()
+            .map(|(key, value)| key.len() + value.as_ref().map_or(0, Vec::len))
+            .sum();
+        self.reserve_tx_size(bytes)?;
+
+        let changed = staged.len();
+        for (key, value) in staged {
+            match value {
+                Some(value) => self.insert_pending(key, value),
+                None => self.remove_pending(&key),
+            }
+        }
+        Ok(changed)
+    }
+
+    /// Deletes a key from a bucket.
+    ///
+    /// Deleting a key that does not exist is a no-op.
+    ///
+    /// # Errors
+    ///
+    /// Returns `BucketNotFound` if the bucket doesn't exist.
+    /// Returns `InvalidBucketName` if the bucket name is invalid.
+    /// Returns `TxTooLarge` if the deletion would exceed `max_tx_size`.
+    pub fn bucket_delete(&mut self, bucket_name: &[u8], key: &[u8]) -> Result<()> {
+        bucket::validate_bucket_name(bucket_name)?;
+
+        if !self.is_bucket_present(bucket_name) {
+            return Err(Error::BucketNotFound {
+                name: bucket_name.to_vec(),
+            });
+        }
+
+        let internal_key = bucket::bucket_data_key(bucket_name, key);
+        self.stage_delete(&internal_key)
+    }
+
+    /// Replaces every key in a bucket with `entries`.
+    ///
+    /// `entries` must be sorted by key, without duplicates. The bucket's
+    /// committed keys missing from `entries` are deleted, and writes this
+    /// transaction already made to the bucket are discarded. Nothing is
+    /// visible until commit, which switches readers from the complete old
+    /// contents to the complete new ones: transactions and snapshots
+    /// started before the commit keep seeing the old contents. Because the
+    /// commit deletes keys, it rewrites the file, dropping the old entries.
+    ///
+    /// Sub-buckets are left untouched. Returns the number of entries
+    /// written.
+    ///
+    /// # Errors
+    ///
+    /// Returns `BucketNotFound` if the bucket doesn't exist,
+    /// `InvalidBucketName` if the name is invalid, `KeysOutOfOrder` if the
+    /// keys are not strictly increasing, or `TxTooLarge` if the entries
+    /// would exceed `max_tx_size`, in which case the transaction is left
+    /// unchanged.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let mut wtx = db.write_tx();
+    /// wtx.bucket_replace_all(b"geoip", rebuilt_table.iter())?;
+    /// wtx.commit()?;
+    /// ```
+    pub fn bucket_replace_all<I, K, V>(&mut self, bucket_name: &[u8], entries: I) -> Result<u64>
+    where
+        I: IntoIterator<Item = (K, V)>,
+        K: AsRef<[u8]>,
+        V: AsRef<[u8]>,
+    {
+        bucket::validate_bucket_name(bucket_name)?;
+
+        if !self.is_bucket_present(bucket_name) {
+            return Err(Error::BucketNotFound {
+                name: bucket_name.to_vec(),
+            });
+        }
+
+        // Build the new contents aside, so an unsorted stream changes nothing.
+        let order = self.db.tree().order();
+        let mut contents: Vec<(Vec<u8>, Vec<u8>)> = Vec::new();
+        for (key, value) in entries {
+            let internal_key = bucket::bucket_data_key(bucket_name, key.as_ref());
+            if contents
+                .last()
+                .is_some_and(|(last, _)| !order.lt(last, &internal_key))
+            {
+                return Err(Error::KeysOutOfOrder {
+                    key: key.as_ref().to_vec(),
+                });
+            }
+            contents.push((internal_key, value.as_ref().to_vec()));
+        }
+        let replaced = |k: &[u8]| {
+            contents
+                .binary_search_by(|(key, _)| order.cmp(key, k))
+                .is_ok()
+        };
+        self.reserve_tx_size(contents.iter().map(|(k, v)| k.len() + v.len()).sum())?;
+
+        let prefix = bucket::bucket_data_prefix(bucket_name);
+        let staged: Vec<Vec<u8>> = self
+            .pending
+            .iter()
+            .filter(|(k, _)| k.starts_with(&prefix))
+            .map(|(k, _)| k.to_vec())
+            .collect();
+        for key in staged {
+            self.pending.remove(&key);
+        }
+
+        self.deleted.retain(|k| !replaced(k));
+        let mut already_deleted: HashSet<Vec<u8>> = self.deleted.iter().cloned().collect();
+        for (key, _) in self
+            .db
+            .tree()
+            .range(Bound::Included(&prefix), Bound::Unbounded)
+            .take_while(|(k, _)| k.starts_with(&prefix))
+        {
+            if !replaced(key) && already_deleted.insert(key.to_vec()) {
+                self.deleted.push(key.to_vec());
+            }
+        }
+
+        let written = contents.len() as u64;
+        for (key, value) in contents {
+            self.memory.charge(key.len() + value.len());
+            self.pending.insert(key, value);
+        }
+        Ok(written)
+    }
+
+    /// Loads sorted entries into an empty bucket.
+    ///
+    /// A fast path for initial imports: `entries` must be sorted by key,
+    /// without duplicates, and are staged as one run, so the transaction's
+    /// staged writes and, at commit, the database's tree are built bottom-up
+    /// from it instead of being split one key at a time as
+    /// [`bucket_put()`](Self::bucket_put) does. Into a new database or
+    /// alongside other pure inserts, the commit also takes the append path.
+    ///
+    /// Returns the number of entries loaded.
+    ///
+    /// # Errors
+    ///
+    /// Returns `BucketNotFound` if the bucket doesn't exist,
+    /// `InvalidBucketName` if the name is invalid, `BucketNotEmpty` if the
+    /// bucket already holds keys, counting writes staged in this
+    /// transaction, `KeysOutOfOrder` if the keys are not strictly
+    /// increasing, or `TxTooLarge` if the entries would exceed
+    /// `max_tx_size`. On error the transaction is left unchanged.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let mut wtx = db.write_tx();
+    /// wtx.create_bucket(b"geoip")?;
+    /// wtx.bucket_bulk_load(b"geoip", sorted_export.iter())?;
+    /// wtx.commit()?;
+    /// ```
+    pub fn bucket_bulk_load<I, K, V>(&mut self, bucket_name: &[u8], entries: I) -> Result<u64>
+    where
+        I: IntoIterator<Item = (K, V)>,
+        K: AsRef<[u8]>,
+        V: AsRef<[u8]>,
+    {
+        bucket::validate_bucket_name(bucket_name)?;
+
+        if !self.is_bucket_present(bucket_name) {
+            return Err(Error::BucketNotFound {
+                name: bucket_name.to_vec(),
+            });
+        }
+
+        let prefix = bucket::bucket_data_prefix(bucket_name);
+        let staged = self
+            .pending
+            .range(Bound::Included(&prefix), Bound::Unbounded)
+            .take_while(|(k, _)| k.starts_with(&prefix))
+            .next()
+            .is_some();
+        let deleted: HashSet<&[u8]> = self.deleted.iter().map(Vec::as_slice).collect();
+        let committed = self
+            .db
+            .tree()
+            .range(Bound::Included(&prefix), Bound::Unbounded)
+            .take_while(|(k, _)| k.starts_with(&prefix))
+            .any(|(k, _)| !deleted.contains(k));
+        if staged || committed {
+            return Err(Error::BucketNotEmpty {
+                name: bucket_name.to_vec(),
+            });
+        }
+
+        let order = self.db.tree().order();
+        let mut contents: Vec<(Vec<u8>, Vec<u8>)> = Vec::new();
+        for (key, value) in entries {
+            let internal_key = bucket::bucket_data_key(bucket_name, key.as_ref());
+            if contents
+                .last()
+                .is_some_and(|(last, _)| !order.lt(last, &internal_key))
+            {
+                return Err(Error::KeysOutOfOrder {
+                    key: key.as_ref().to_vec(),
+                });
+            }
+            contents.push((internal_key, value.as_ref().to_vec()));
+        }
+        self.reserve_tx_size(contents.iter().map(|(k, v)| k.len() + v.len()).sum())?;
+
+        // Keys deleted earlier in this transaction are written again.
+        if !deleted.is_empty() {
+            self.deleted.retain(|k| {
+                contents
+                    .binary_search_by(|(key, _)| order.cmp(key, k))
+                    .is_err()
+            });
+        }
+
+        let loaded = contents.len() as u64;
+        for (key, value) in &contents {
+            self.memory.charge(key.len() + value.len());
+        }
+        self.pending.extend_sorted(contents);
+        Ok(loaded)
     }
 
-    /// Returns a read-only reference to a bucket.
+    /// Deletes every key in a bucket, leaving it empty but in place.
     ///
-    /// Note: This returns a view of the committed state, not including
-    /// pending changes in this transaction.
+    /// The bucket's keys are staged for deletion in a single pass over its
+    /// key range, where [`bucket_delete()`](Self::bucket_delete) checks
+    /// each key against the deletes already staged, so emptying a large
+    /// bucket takes time linear in its size rather than quadratic. Writes
+    /// this transaction already made to the bucket are discarded; later
+    /// writes land in the empty bucket. The commit rewrites the file
+    /// without the bucket's entries, and the space they held shows as
+    /// released in `DatabaseStats::data_size`.
+    ///
+    /// The bucket's settings are kept. Its sequence counter is kept or
+    /// restarted at 0 according to `sequence`. Sub-buckets are left
+    /// untouched. Returns the number of keys deleted.
     ///
     /// # Errors
     ///
-    /// Returns `BucketNotFound` if the bucket does not exist.
+    /// Returns `BucketNotFound` if the bucket doesn't exist.
     /// Returns `InvalidBucketName` if the name is invalid.
-    pub fn bucket(&self, name: &[u8]) -> Result<BucketRef<'_>> {
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let mut wtx = db.write_tx();
+    /// wtx.truncate_bucket(b"sessions", TruncateSequence::Keep)?;
+    /// wtx.commit()?;
+    /// ```
+    pub fn truncate_bucket(&mut self, name: &[u8], sequence: TruncateSequence) -> Result<u64> {
         bucket::validate_bucket_name(name)?;
 
         if !self.is_bucket_present(name) {
@@ -614,17 +2093,41 @@ impl<'db> WriteTx<'db> {
             });
         }
 
-        // Return view of committed tree (pending changes not visible).
-        BucketRef::new(self.db.tree(), name)
+        let prefix = bucket::bucket_data_prefix(name);
+        let order_prefix = bucket::bucket_order_prefix(name);
+        let truncated = self.delete_under(&[&prefix, &order_prefix], &prefix);
+
+        if sequence == TruncateSequence::Reset {
+            self.set_bucket_sequence(name, 0)?;
+        }
+        Ok(truncated)
     }
 
-    /// Puts a key-value pair into a bucket.
+    /// Deletes every key in a bucket that starts with `prefix`.
+    ///
+    /// Like [`truncate_bucket()`](Self::truncate_bucket), the keys are
+    /// staged for deletion in a single pass over the prefix's key range,
+    /// rather than one [`bucket_delete()`](Self::bucket_delete) at a time,
+    /// and the commit rewrites the file without them, releasing their space
+    /// together. Writes this transaction already made under the prefix are
+    /// discarded. Keys outside the prefix are never touched, however close
+    /// they sort to it; an empty prefix deletes every key in the bucket.
+    ///
+    /// Sub-buckets are left untouched. Returns the number of keys deleted.
     ///
     /// # Errors
     ///
     /// Returns `BucketNotFound` if the bucket doesn't exist.
-    /// Returns `InvalidBucketName` if the bucket name is invalid.
-    pub fn bucket_put(&mut self, bucket_name: &[u8], key: &[u8], value: &[u8]) -> Result<()> {
+    /// Returns `InvalidBucketName` if the name is invalid.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let mut wtx = db.write_tx();
+    /// let pruned = wtx.bucket_delete_prefix(b"sessions", b"session:expired:")?;
+    /// wtx.commit()?;
+    /// ```
+    pub fn bucket_delete_prefix(&mut self, bucket_name: &[u8], prefix: &[u8]) -> Result<u64> {
         bucket::validate_bucket_name(bucket_name)?;
 
         if !self.is_bucket_present(bucket_name) {
@@ -633,82 +2136,317 @@ impl<'db> WriteTx<'db> {
             });
         }
 
-        let internal_key = bucket::bucket_data_key(bucket_name, key);
+        let mut scan = bucket::bucket_data_prefix(bucket_name);
+        scan.extend_from_slice(prefix);
+        Ok(self.delete_under(&[&scan], &scan))
+    }
 
-        // Remove from deleted list if present.
-        self.deleted
-            .retain(|k| k.as_slice() != internal_key.as_slice());
+    /// Stages the deletion of every key starting with one of `prefixes`,
+    /// discarding pending writes under them, in one pass over each range.
+    ///
+    /// Returns the number of keys under `counted`, one of `prefixes`, that
+    /// were visible to this transaction.
+    fn delete_under(&mut self, prefixes: &[&[u8]], counted: &[u8]) -> u64 {
+        let staged: Vec<Vec<u8>> = self
+            .pending
+            .iter()
+            .filter(|(k, _)| prefixes.iter().any(|p| k.starts_with(p)))
+            .map(|(k, _)| k.to_vec())
+            .collect();
+        // Keys only written by this transaction; committed ones are counted
+        // below.
+        let mut removed = staged
+            .iter()
+            .filter(|k| k.starts_with(counted) && self.db.tree().get(k).is_none())
+            .count() as u64;
+        for key in staged {
+            self.pending.remove(&key);
+        }
 
-        // Add to pending.
-        self.pending.insert(internal_key, value.to_vec());
-        Ok(())
+        let mut already_deleted: HashSet<Vec<u8>> = self.deleted.iter().cloned().collect();
+        for &range_prefix in prefixes {
+            for (key, _) in self
+                .db
+                .tree()
+                .range(Bound::Included(range_prefix), Bound::Unbounded)
+                .take_while(|(k, _)| k.starts_with(range_prefix))
+            {
+                if already_deleted.insert(key.to_vec()) {
+                    self.deleted.push(key.to_vec());
+                    if range_prefix == counted {
+                        removed += 1;
+                    }
+                }
+            }
+        }
+        removed
     }
 
-    /// Gets a value from a bucket.
+    /// Caps the number of keys in a bucket.
+    ///
+    /// Every later commit that would leave the bucket with more than
+    /// `max_keys` keys also deletes entries chosen by `policy` until it
+    /// fits, so puts beyond the limit evict older entries within the same
+    /// transaction. The limit is stored in the bucket header and persists
+    /// across opens. It is enforced when the transaction commits, starting
+    /// with this one; a limit of 0 keeps the bucket empty.
     ///
-    /// Note: This returns from the committed state, not including pending changes.
+    /// Enforcement counts the bucket's keys on each commit that writes to
+    /// it, so it suits small cache-like buckets.
     ///
     /// # Errors
     ///
     /// Returns `BucketNotFound` if the bucket doesn't exist.
     /// Returns `InvalidBucketName` if the bucket name is invalid.
-    pub fn bucket_get(&self, bucket_name: &[u8], key: &[u8]) -> Result<Option<Vec<u8>>> {
-        bucket::validate_bucket_name(bucket_name)?;
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let mut wtx = db.write_tx();
+    /// wtx.create_bucket(b"cache")?;
+    /// wtx.set_bucket_max_keys(b"cache", 1000, EvictionPolicy::OldestInserted)?;
+    /// wtx.commit()?;
+    /// ```
+    pub fn set_bucket_max_keys(
+        &mut self,
+        name: &[u8],
+        max_keys: u64,
+        policy: EvictionPolicy,
+    ) -> Result<()> {
+        self.update_key_limit(name, Some(KeyLimit { max_keys, policy }))
+    }
 
-        if !self.is_bucket_present(bucket_name) {
+    /// Removes a bucket's key limit.
+    ///
+    /// # Errors
+    ///
+    /// Returns `BucketNotFound` if the bucket doesn't exist.
+    /// Returns `InvalidBucketName` if the bucket name is invalid.
+    pub fn clear_bucket_max_keys(&mut self, name: &[u8]) -> Result<()> {
+        self.update_key_limit(name, None)
+    }
+
+    /// Sets how eagerly auto-compaction reclaims space left by a bucket.
+    ///
+    /// The priority is stored in the bucket header. See
+    /// `AutoCompactionConfig` for how it is applied.
+    ///
+    /// # Errors
+    ///
+    /// Returns `BucketNotFound` if the bucket doesn't exist.
+    /// Returns `InvalidBucketName` if the bucket name is invalid.
+    pub fn set_bucket_compaction_priority(
+        &mut self,
+        name: &[u8],
+        priority: CompactionPriority,
+    ) -> Result<()> {
+        bucket::validate_bucket_name(name)?;
+
+        if !self.is_bucket_present(name) {
             return Err(Error::BucketNotFound {
-                name: bucket_name.to_vec(),
+                name: name.to_vec(),
             });
         }
 
-        let internal_key = bucket::bucket_data_key(bucket_name, key);
+        let meta_key = bucket::bucket_meta_key(name);
+        let header = self
+            .pending
+            .get(&meta_key)
+            .or_else(|| self.db.tree().get(&meta_key));
+        let header = bucket::with_compaction_priority(header, priority);
+        self.pending.insert(meta_key, header);
+        Ok(())
+    }
 
-        // Check pending first, then main tree.
-        if let Some(value) = self.pending.get(&internal_key) {
-            return Ok(Some(value.to_vec()));
+    /// Gives a bucket a Bloom filter over its keys, using `bits_per_key`
+    /// bits per key.
+    ///
+    /// Lookups of keys the filter rules out return `None` without
+    /// descending the tree, which makes probing a large bucket for absent
+    /// keys cheap. Keys are never wrongly ruled out. At 10 bits per key
+    /// about 1% of absent keys still take the full lookup; each extra bit
+    /// roughly halves that share at the cost of memory. `bits_per_key` is
+    /// clamped to at least 1.
+    ///
+    /// The setting is stored in the bucket header and persists across
+    /// opens, but the filter itself is not written to the file: it is
+    /// built from the bucket's keys when this transaction commits and
+    /// rebuilt every time the database opens, so each open scans the
+    /// bucket. It applies to lookups through transactions, not snapshots.
+    /// See the [`bloom`](crate::bloom) module.
+    ///
+    /// # Errors
+    ///
+    /// Returns `BucketNotFound` if the bucket doesn't exist.
+    /// Returns `InvalidBucketName` if the bucket name is invalid.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let mut wtx = db.write_tx();
+    /// wtx.set_bucket_bloom(b"sessions", 10)?;
+    /// wtx.commit()?;
+    ///
+    /// let rtx = db.read_tx();
+    /// assert!(rtx.bucket(b"sessions")?.get(b"unknown").is_none());
+    /// ```
+    pub fn set_bucket_bloom(&mut self, name: &[u8], bits_per_key: u8) -> Result<()> {
+        self.update_bloom_bits(name, Some(bits_per_key.max(1)))
+    }
+
+    /// Removes a bucket's Bloom filter.
+    ///
+    /// # Errors
+    ///
+    /// Returns `BucketNotFound` if the bucket doesn't exist.
+    /// Returns `InvalidBucketName` if the bucket name is invalid.
+    pub fn clear_bucket_bloom(&mut self, name: &[u8]) -> Result<()> {
+        self.update_bloom_bits(name, None)
+    }
+
+    /// Stages a bucket header with its Bloom filter bits replaced.
+    fn update_bloom_bits(&mut self, name: &[u8], bits_per_key: Option<u8>) -> Result<()> {
+        bucket::validate_bucket_name(name)?;
+
+        if !self.is_bucket_present(name) {
+            return Err(Error::BucketNotFound {
+                name: name.to_vec(),
+            });
         }
 
-        // Check if deleted.
-        if self
-            .deleted
-            .iter()
-            .any(|k| k.as_slice() == internal_key.as_slice())
-        {
-            return Ok(None);
+        let meta_key = bucket::bucket_meta_key(name);
+        let header = self
+            .pending
+            .get(&meta_key)
+            .or_else(|| self.db.tree().get(&meta_key));
+        let header = bucket::with_bloom_bits(header, bits_per_key);
+        self.pending.insert(meta_key, header);
+        Ok(())
+    }
+
+    /// Advances a bucket's sequence counter and returns the new value.
+    ///
+    /// The first call on a bucket returns 1. The counter is stored in the
+    /// bucket header, so it advances as part of this transaction: if the
+    /// transaction commits, the value is never returned again, even after
+    /// a crash or reopen; if it is rolled back, the value is handed out
+    /// again. Suited to generating keys for entries put in the same
+    /// transaction.
+    ///
+    /// # Errors
+    ///
+    /// Returns `BucketNotFound` if the bucket doesn't exist.
+    /// Returns `InvalidBucketName` if the bucket name is invalid.
+    /// Returns `SequenceExhausted` if the counter is at `u64::MAX`.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let mut wtx = db.write_tx();
+    /// let id = wtx.next_bucket_sequence(b"users")?;
+    /// wtx.bucket_put(b"users", &id.to_be_bytes(), &user)?;
+    /// wtx.commit()?;
+    /// ```
+    pub fn next_bucket_sequence(&mut self, name: &[u8]) -> Result<u64> {
+        let next =
+            self.bucket_sequence(name)?
+                .checked_add(1)
+                .ok_or_else(|| Error::SequenceExhausted {
+                    name: name.to_vec(),
+                })?;
+        self.set_bucket_sequence(name, next)?;
+        Ok(next)
+    }
+
+    /// Sets a bucket's sequence counter, so the next call to
+    /// [`next_bucket_sequence()`](Self::next_bucket_sequence) returns
+    /// `sequence + 1`.
+    ///
+    /// # Errors
+    ///
+    /// Returns `BucketNotFound` if the bucket doesn't exist.
+    /// Returns `InvalidBucketName` if the bucket name is invalid.
+    pub fn set_bucket_sequence(&mut self, name: &[u8], sequence: u64) -> Result<()> {
+        bucket::validate_bucket_name(name)?;
+
+        if !self.is_bucket_present(name) {
+            return Err(Error::BucketNotFound {
+                name: name.to_vec(),
+            });
         }
 
-        Ok(self.db.tree().get(&internal_key).map(|v| v.to_vec()))
+        let meta_key = bucket::bucket_meta_key(name);
+        let header = self
+            .pending
+            .get(&meta_key)
+            .or_else(|| self.db.tree().get(&meta_key));
+        let header = bucket::with_sequence(header, sequence);
+        self.pending.insert(meta_key, header);
+        Ok(())
     }
 
-    /// Deletes a key from a bucket.
+    /// Returns a bucket's sequence counter, including changes made by this
+    /// transaction.
     ///
     /// # Errors
     ///
     /// Returns `BucketNotFound` if the bucket doesn't exist.
     /// Returns `InvalidBucketName` if the bucket name is invalid.
-    pub fn bucket_delete(&mut self, bucket_name: &[u8], key: &[u8]) -> Result<()> {
-        bucket::validate_bucket_name(bucket_name)?;
+    pub fn bucket_sequence(&self, name: &[u8]) -> Result<u64> {
+        bucket::validate_bucket_name(name)?;
 
-        if !self.is_bucket_present(bucket_name) {
+        if !self.is_bucket_present(name) {
             return Err(Error::BucketNotFound {
-                name: bucket_name.to_vec(),
+                name: name.to_vec(),
             });
         }
 
-        let internal_key = bucket::bucket_data_key(bucket_name, key);
+        let meta_key = bucket::bucket_meta_key(name);
+        Ok(self
+            .pending
+            .get(&meta_key)
+            .or_else(|| self.db.tree().get(&meta_key))
+            .map_or(0, bucket::decode_sequence))
+    }
 
-        // Remove from pending if present.
-        self.pending.remove(&internal_key);
+    /// Stages a bucket header carrying `limit`, keeping the insertion
+    /// sequence counter.
+    fn update_key_limit(&mut self, name: &[u8], limit: Option<KeyLimit>) -> Result<()> {
+        bucket::validate_bucket_name(name)?;
 
-        // Mark for deletion from main tree.
-        if !self
-            .deleted
-            .iter()
-            .any(|k| k.as_slice() == internal_key.as_slice())
-        {
-            self.deleted.push(internal_key);
+        if !self.is_bucket_present(name) {
+            return Err(Error::BucketNotFound {
+                name: name.to_vec(),
+            });
+        }
+
+        let meta_key = bucket::bucket_meta_key(name);
+        let header = self
+            .pending
+            .get(&meta_key)
+            .or_else(|| self.db.tree().get(&meta_key));
+        let next_seq = header
+            .and_then(bucket::decode_key_limit)
+            .map_or(0, |(_, next_seq)| next_seq);
+        let header = bucket::with_key_limit(header, limit.map(|limit| (limit, next_seq)));
+
+        // Only oldest-inserted eviction uses the insertion order.
+        if limit.map(|limit| limit.policy) != Some(EvictionPolicy::OldestInserted) {
+            let prefix = bucket::bucket_order_prefix(name);
+            let stale: Vec<Vec<u8>> = self
+                .pending
+                .iter()
+                .chain(self.db.tree().iter())
+                .map(|(k, _)| k)
+                .filter(|k| k.starts_with(&prefix))
+                .map(<[u8]>::to_vec)
+                .collect();
+            for key in stale {
+                self.stage_delete_uncapped(&key);
+            }
         }
 
+        self.pending.insert(meta_key, header);
         Ok(())
     }
 
@@ -1062,6 +2800,7 @@ impl<'db> WriteTx<'db> {
     ///
     /// Returns `BucketNotFound` if the nested bucket doesn't exist.
     /// Returns `InvalidBucketName` if any name is invalid.
+    /// Returns `TxTooLarge` if the write would exceed `max_tx_size`.
     pub fn nested_bucket_put(
         &mut self,
         parent: &[u8],
@@ -1080,10 +2819,7 @@ impl<'db> WriteTx<'db> {
         }
 
         let internal_key = bucket::nested_bucket_data_key(&path, key);
-        self.deleted
-            .retain(|k| k.as_slice() != internal_key.as_slice());
-        self.pending.insert(internal_key, value.to_vec());
-        Ok(())
+        self.stage_put(internal_key, value.to_vec())
     }
 
     /// Puts a key-value pair into a nested bucket at a specific path.
@@ -1092,6 +2828,7 @@ impl<'db> WriteTx<'db> {
     ///
     /// Returns `BucketNotFound` if the nested bucket doesn't exist.
     /// Returns `InvalidBucketName` if any name is invalid.
+    /// Returns `TxTooLarge` if the write would exceed `max_tx_size`.
     pub fn nested_bucket_put_at_path(
         &mut self,
         path: &[&[u8]],
@@ -1107,10 +2844,7 @@ impl<'db> WriteTx<'db> {
         }
 
         let internal_key = bucket::nested_bucket_data_key(path, key);
-        self.deleted
-            .retain(|k| k.as_slice() != internal_key.as_slice());
-        self.pending.insert(internal_key, value.to_vec());
-        Ok(())
+        self.stage_put(internal_key, value.to_vec())
     }
 
     /// Gets a value from a nested bucket.
@@ -1129,6 +2863,11 @@ impl<'db> WriteTx<'db> {
         bucket::validate_bucket_name(child)?;
 
         let path: [&[u8]; 2] = [parent, child];
+        if !self.read_your_writes {
+            let bucket = NestedBucketRef::new(self.db.tree(), &path)?;
+            return Ok(bucket.get(key).map(<[u8]>::to_vec));
+        }
+
         if !self.is_nested_bucket_present(&path) {
             return Err(Error::BucketNotFound {
                 name: child.to_vec(),
@@ -1160,6 +2899,7 @@ impl<'db> WriteTx<'db> {
     ///
     /// Returns `BucketNotFound` if the nested bucket doesn't exist.
     /// Returns `InvalidBucketName` if any name is invalid.
+    /// Returns `TxTooLarge` if the deletion would exceed `max_tx_size`.
     pub fn nested_bucket_delete(&mut self, parent: &[u8], child: &[u8], key: &[u8]) -> Result<()> {
         bucket::validate_bucket_name(parent)?;
         bucket::validate_bucket_name(child)?;
@@ -1172,17 +2912,7 @@ impl<'db> WriteTx<'db> {
         }
 
         let internal_key = bucket::nested_bucket_data_key(&path, key);
-        self.pending.remove(&internal_key);
-
-        if !self
-            .deleted
-            .iter()
-            .any(|k| k.as_slice() == internal_key.as_slice())
-        {
-            self.deleted.push(internal_key);
-        }
-
-        Ok(())
+        self.stage_delete(&internal_key)
     }
 
     /// Checks if a nested bucket exists.
@@ -1292,8 +3022,110 @@ impl<'db> WriteTx<'db> {
     ///
     /// Returns an error if the commit fails due to I/O errors
     /// or other issues. On error, the transaction is effectively
-    /// rolled back (changes are not persisted).
+    /// rolled back (changes are not persisted). Returns
+    /// `UpgradeRequired` if `DatabaseOptions::require_upgrade` is set and
+    /// the file is in an older format. While the database is frozen, waits
+    /// for the freeze to end and returns `FreezeTimedOut` if
+    /// `freeze_timeout` elapses first. Returns `TxCancelled` if the
+    /// transaction's cancel token has been cancelled.
     pub fn commit(mut self) -> Result<()> {
+        let started = Instant::now();
+        let result = self.commit_changes();
+        self.db
+            .stats_recorder()
+            .record_commit(started.elapsed(), result.is_ok());
+        if result.is_ok() {
+            self.take_hooks().committed();
+        }
+        result
+    }
+
+    /// Commits the changes staged so far and starts over as a new
+    /// transaction, keeping its settings.
+    ///
+    /// Even if the commit fails, the staged changes are discarded.
+    pub(crate) fn commit_and_continue(&mut self) -> Result<()> {
+        let started = Instant::now();
+        let result = self.commit_changes();
+        self.db
+            .stats_recorder()
+            .record_commit(started.elapsed(), result.is_ok());
+        let hooks = self.take_hooks();
+        if result.is_ok() {
+            hooks.committed();
+        } else {
+            hooks.rolled_back();
+        }
+
+        let (creation_trace, registration) = Self::begin(self.db);
+        self.pending = BTree::with_comparator(self.db.options().comparator.clone());
+        self.deleted.clear();
+        self.committed = false;
+        self.creation_trace = creation_trace;
+        self.registration = registration;
+        self.memory = MemoryCharge::default();
+        self.version = None;
+        result
+    }
+
+    /// Commits the transaction as `version` instead of the version after
+    /// the current one.
+    ///
+    /// The caller checks that `version` is ahead of the current one.
+    pub(crate) fn set_version(&mut self, version: u64) {
+        self.version = Some(version);
+    }
+
+    /// Returns the number of writes and deletes staged in this transaction.
+    #[inline]
+    pub(crate) fn staged_len(&self) -> usize {
+        self.pending.len() + self.deleted.len()
+    }
+
+    /// Applies and persists the transaction's changes.
+    fn commit_changes(&mut self) -> Result<()> {
+        // Commit closes the transaction even if persisting fails.
+        self.creation_trace = None;
+
+        // The watchdog aborted this transaction; discard its changes.
+        if let Some(registration) = &self.registration
+            && registration.is_aborted()
+        {
+            return Err(Error::TxTimedOut {
+                elapsed: registration.age(),
+                limit: self.db.options().max_tx_duration.unwrap_or_default(),
+            });
+        }
+
+        if let Some(cancel) = &self.cancel {
+            cancel.check()?;
+        }
+
+        if self.db.options().require_upgrade && self.db.needs_upgrade() {
+            return Err(Error::UpgradeRequired {
+                version: self.db.format_version(),
+                current: VERSION,
+            });
+        }
+
+        let freeze_timeout = self.db.options().freeze_timeout;
+        self.db.freeze_gate().wait_thawed(freeze_timeout)?;
+
+        // Held from before the tree changes, so a read-only handle fails
+        // with nothing applied.
+        let _lock = self.db.write_lock()?;
+        self.db.stamp_format_version();
+
+        self.stage_key_limits();
+        self.stage_bucket_timestamps();
+        self.stage_expiry();
+        self.stage_value_checksums();
+
+        // Number the commit before anything records its version.
+        if let Some(version) = self.version {
+            self.db.set_txid(version - 1);
+        }
+
         // Record the number of operations for error context.
         let deletion_count = self.deleted.len();
         let insertion_count = self.pending.len();
@@ -1301,10 +3133,27 @@ impl<'db> WriteTx<'db> {
 
         // Check if any pending writes are updates to existing keys
         // Updates require full rewrite (especially for overflow values)
+        // Bucket headers are tiny inline values; an appended copy supersedes
+        // the old one on load, so refreshing them stays append-only.
         let has_updates = self
             .pending
             .iter()
-            .any(|(k, _)| self.db.tree().get(k).is_some());
+            .any(|(k, _)| !bucket::is_bucket_meta_key(k) && self.db.tree().get(k).is_some());
+
+        // Compressed and encrypted appends hold inline entries only;
+        // overflow values are laid out by a full rewrite.
+        let options = self.db.options();
+        let has_compressed_overflow = (options.page_compression != PageCompression::None
+            || options.value_compression != ValueCompression::None
+            || options.encryption_key.is_some())
+            && self
+                .pending
+                .iter()
+                .any(|(_, v)| v.len() > options.overflow_threshold);
+
+        // The audit record is written ahead so no change is applied unless
+        // it was recorded.
+        self.write_audit_record()?;
 
         // Apply deletions to main tree.
         for key in &self.deleted {
@@ -1313,7 +3162,7 @@ impl<'db> WriteTx<'db> {
 
         // Use incremental persist only for pure insert workloads.
         // Updates and deletions require a full rewrite.
-        let persist_result = if has_deletions || has_updates {
+        let persist_result = if has_deletions || has_updates || has_compressed_overflow {
             // Collect new entries for full rewrite path
             let new_entries: Vec<(Vec<u8>, Vec<u8>)> = self
                 .pending
@@ -1321,21 +3170,20 @@ impl<'db> WriteTx<'db> {
                 .map(|(k, v)| (k.to_vec(), v.to_vec()))
                 .collect();
 
-            // Apply pending insertions to main tree.
-            for (key, value) in self.pending.iter() {
-                self.db.tree_mut().insert(key.to_vec(), value.to_vec());
+            // The keys are in the tree even if persisting fails, so the
+            // bloom filter must cover them either way.
+            for (key, _) in &new_entries {
+                self.db.bloom_mut().insert(key);
             }
 
-            // Deletions or updates require a full rewrite.
-            let result = self.db.persist_tree();
+            // Apply pending insertions to main tree.
+            self.db.tree_mut().extend_sorted(new_entries);
+            let changed = self.deleted.iter().map(Vec::as_slice);
+            self.db
+                .update_bucket_blooms(changed.chain(self.pending.keys()));
 
-            // Update bloom filter with newly inserted keys on success.
-            if result.is_ok() {
-                for (key, _) in &new_entries {
-                    self.db.bloom_mut().insert(key);
-                }
-            }
-            result
+            // Deletions or updates require a full rewrite.
+            self.db.persist_tree()
         } else {
             // Append-only: use incremental persist for massive speedup.
             // First persist using references to avoid cloning for I/O.
@@ -1345,10 +3193,13 @@ impl<'db> WriteTx<'db> {
                 // Apply pending insertions to main tree and update bloom filter.
                 // Note: We have to clone here because BTree.iter() returns references.
                 // A future optimization would be to use a consuming iterator.
+                let mut new_entries = Vec::with_capacity(self.pending.len());
                 for (key, value) in self.pending.iter() {
                     self.db.bloom_mut().insert(key);
-                    self.db.tree_mut().insert(key.to_vec(), value.to_vec());
+                    new_entries.push((key.to_vec(), value.to_vec()));
                 }
+                self.db.tree_mut().extend_sorted(new_entries);
+                self.db.update_bucket_blooms(self.pending.keys());
             }
             result
         };
@@ -1356,6 +3207,18 @@ impl<'db> WriteTx<'db> {
         match persist_result {
             Ok(()) => {
                 self.committed = true;
+                self.db.record_version();
+                let deletes = self.deleted.iter().map(|key| (key.as_slice(), None));
+                let puts = self.pending.iter().map(|(key, value)| (key, Some(value)));
+                self.db
+                    .watchers()
+                    .notify(self.db.version(), deletes.chain(puts));
+                // Maintenance commits would take the next version of a
+                // replayed history; it runs after the next ordinary commit.
+                if self.version.is_none() {
+                    self.db.maybe_auto_compact();
+                    self.db.maybe_purge_expired();
+                }
                 Ok(())
             }
             Err(e) => {
@@ -1372,15 +3235,560 @@ impl<'db> WriteTx<'db> {
             }
         }
     }
+
+    /// Writes the audit record for this commit, if an audit writer is set.
+    ///
+    /// # Errors
+    ///
+    /// Returns `AuditWrite` if the record cannot be written or flushed.
+    fn write_audit_record(&self) -> Result<()> {
+        let Some(audit) = &self.db.options().audit_writer else {
+            return Ok(());
+        };
+        let deletes = self
+            .deleted
+            .iter()
+            .filter_map(|key| AuditOp::from_internal(key, None));
+        let puts = self
+            .pending
+            .iter()
+            .filter_map(|(key, value)| AuditOp::from_internal(key, Some(value)));
+        let record = AuditRecord {
+            version: self.db.version() + 1,
+            timestamp: SystemTime::now(),
+            ops: deletes.chain(puts).collect(),
+        };
+        audit.write_record(&record).map_err(|e| Error::AuditWrite {
+            version: record.version,
+            source: e,
+        })
+    }
+
+    /// Evicts entries from key-limited buckets this transaction would leave
+    /// over their limit.
+    ///
+    /// Also maintains the insertion order of buckets evicting their oldest
+    /// entries. Runs as part of commit so evictions are atomic with the
+    /// writes that caused them.
+    fn stage_key_limits(&mut self) {
+        // Buckets written to, or whose header (and so limit) changed.
+        let mut names: Vec<Vec<u8>> = self
+            .pending
+            .iter()
+            .map(|(k, _)| k)
+            .chain(self.deleted.iter().map(Vec::as_slice))
+            .filter_map(|k| {
+                if bucket::is_bucket_meta_key(k) {
+                    k.get(2..)
+                } else {
+                    bucket::bucket_name_of_data_key(k)
+                }
+            })
+            .map(<[u8]>::to_vec)
+            .collect();
+        names.sort_unstable();
+        names.dedup();
+
+        for name in names {
+            if !self.is_bucket_present(&name) {
+                continue;
+            }
+            let meta_key = bucket::bucket_meta_key(&name);
+            let header = self
+                .pending
+                .get(&meta_key)
+                .or_else(|| self.db.tree().get(&meta_key));
+            let Some((limit, next_seq)) = header.and_then(bucket::decode_key_limit) else {
+                continue;
+            };
+
+            let (victims, order_updates, next) = self.plan_evictions(&name, limit, next_seq);
+            for (key, seq) in order_updates {
+                self.pending.insert(key, seq.to_le_bytes().to_vec());
+            }
+            for key in victims {
+                self.stage_delete_uncapped(&key);
+            }
+            if next != next_seq {
+                let header = self
+                    .pending
+                    .get(&meta_key)
+                    .or_else(|| self.db.tree().get(&meta_key));
+                let header = bucket::with_key_limit(header, Some((limit, next)));
+                self.pending.insert(meta_key, header);
+            }
+        }
+    }
+
+    /// Works out how to bring a key-limited bucket within its limit.
+    ///
+    /// Returns the internal keys to delete, the order entries to write and
+    /// the next insertion sequence number.
+    #[allow(clippy::type_complexity)]
+    fn plan_evictions(
+        &self,
+        name: &[u8],
+        limit: KeyLimit,
+        mut next_seq: u64,
+    ) -> (Vec<Vec<u8>>, Vec<(Vec<u8>, u64)>, u64) {
+        let deleted: HashSet<&[u8]> = self.deleted.iter().map(Vec::as_slice).collect();
+        let prefix = bucket::bucket_data_prefix(name);
+        let in_bucket = |(k, _): &(&[u8], &[u8])| k.starts_with(&prefix);
+
+        // Keys the bucket holds after this transaction: committed ones
+        // first, then new ones, each in key order.
+        let mut live: Vec<&[u8]> = self
+            .db
+            .tree()
+            .range(Bound::Included(&prefix), Bound::Unbounded)
+            .take_while(in_bucket)
+            .map(|(k, _)| k)
+            .filter(|k| !deleted.contains(k))
+            .collect();
+        live.extend(
+            self.pending
+                .range(Bound::Included(&prefix), Bound::Unbounded)
+                .take_while(in_bucket)
+                .map(|(k, _)| k)
+                .filter(|k| self.db.tree().get(k).is_none()),
+        );
+
+        let mut victims = Vec::new();
+        let mut order_updates = Vec::new();
+        let excess = (live.len() as u64).saturating_sub(limit.max_keys) as usize;
+
+        match limit.policy {
+            EvictionPolicy::SmallestKey => {
+                let order = self.db.tree().order();
+                live.sort_unstable_by(|a, b| order.cmp(a, b));
+                victims.extend(live[..excess].iter().map(|k| k.to_vec()));
+            }
+            EvictionPolicy::OldestInserted => {
+                // Deleted keys give up their place in the order.
+                for key in &self.deleted {
+                    if let Some(user_key) = bucket::extract_user_key(name, key) {
+                        let order_key = bucket::bucket_order_key(name, user_key);
+                        if self.db.tree().get(&order_key).is_some() {
+                            victims.push(order_key);
+                        }
+                    }
+                }
+
+                let mut ordered: Vec<(u64, &[u8])> = Vec::with_capacity(live.len());
+                for key in live {
+                    let order_key = bucket::bucket_order_key(name, &key[prefix.len()..]);
+                    let seq = if deleted.contains(order_key.as_slice()) {
+                        None
+                    } else {
+                        self.pending
+                            .get(&order_key)
+                            .or_else(|| self.db.tree().get(&order_key))
+                            .and_then(|v| v.try_into().ok())
+                            .map(u64::from_le_bytes)
+                    };
+                    let seq = seq.unwrap_or_else(|| {
+                        let seq = next_seq;
+                        next_seq += 1;
+                        order_updates.push((order_key, seq));
+                        seq
+                    });
+                    ordered.push((seq, key));
+                }
+
+                ordered.sort_unstable();
+                for (_, key) in &ordered[..excess] {
+                    victims.push(key.to_vec());
+                    victims.push(bucket::bucket_order_key(name, &key[prefix.len()..]));
+                }
+                // Evicted new keys need no order entry.
+                order_updates.retain(|(order_key, _)| !victims.contains(order_key));
+            }
+        }
+
+        (victims, order_updates, next_seq)
+    }
+
+    /// Refreshes the modification time of every bucket written to.
+    ///
+    /// Runs as part of commit so the timestamp is persisted atomically
+    /// with the data it describes.
+    fn stage_bucket_timestamps(&mut self) {
+        let mut names: Vec<Vec<u8>> = self
+            .pending
+            .iter()
+            .map(|(k, _)| k)
+            .chain(self.deleted.iter().map(Vec::as_slice))
+            .filter_map(bucket::bucket_name_of_data_key)
+            .map(<[u8]>::to_vec)
+            .collect();
+        names.sort_unstable();
+        names.dedup();
+
+        let now = SystemTime::now();
+        for name in names {
+            if !self.is_bucket_present(&name) {
+                continue;
+            }
+            let meta_key = bucket::bucket_meta_key(&name);
+            let header = self
+                .pending
+                .get(&meta_key)
+                .or_else(|| self.db.tree().get(&meta_key));
+            // Buckets without a header predate timestamps; start tracking now.
+            let header = bucket::touch_bucket_header(header, now);
+            self.pending.insert(meta_key, header);
+        }
+    }
+
+    /// Drops the deadlines of entries this transaction deletes or rewrites
+    /// without a TTL.
+    fn stage_expiry(&mut self) {
+        let mut stale = Vec::new();
+        for (key, _) in self.pending.iter() {
+            // A deadline whose entry was dropped from this transaction, such
+            // as by deleting its bucket.
+            if let Some(entry_key) = expiry::entry_key_of(key) {
+                if self.pending.get(entry_key).is_none() {
+                    stale.push(key.to_vec());
+                }
+                continue;
+            }
+            if bucket::bucket_name_of_data_key(key).is_none() {
+                continue;
+            }
+            let ek = expiry::expiry_key(key);
+            if self.pending.get(&ek).is_none() && self.db.tree().get(&ek).is_some() {
+                stale.push(ek);
+            }
+        }
+        for key in &self.deleted {
+            if bucket::bucket_name_of_data_key(key).is_some() {
+                stale.push(expiry::expiry_key(key));
+            }
+        }
+
+        for ek in stale {
+            self.pending.remove(&ek);
+            if self.db.tree().get(&ek).is_some() && !self.deleted.contains(&ek) {
+                self.deleted.push(ek);
+            }
+        }
+    }
+
+    /// Brings value checksum entries in line with the pending changes.
+    ///
+    /// With `value_checksums` enabled, every pending value gets a fresh
+    /// checksum entry. Checksum entries of deleted values, and of values
+    /// rewritten while checksums are disabled, are removed so they can
+    /// never go stale.
+    fn stage_value_checksums(&mut self) {
+        let enabled = self.db.options().value_checksums;
+        let mut sums = Vec::new();
+        let mut stale = Vec::new();
+
+        for (key, value) in self.pending.iter() {
+            // Bucket headers and companions are bookkeeping, not user values.
+            if bucket::is_internal_companion(key) || bucket::is_bucket_meta_key(key) {
+                continue;
+            }
+            let ck = checksum::checksum_key(key);
+            if enabled {
+                sums.push((ck, checksum::encode_checksum(value)));
+            } else if self.db.tree().get(&ck).is_some() {
+                stale.push(ck);
+            }
+        }
+        for key in &self.deleted {
+            if bucket::is_internal_companion(key) {
+                continue;
+            }
+            let ck = checksum::checksum_key(key);
+            if self.db.tree().get(&ck).is_some() {
+                stale.push(ck);
+            }
+        }
+
+        for (ck, sum) in sums {
+            self.pending.insert(ck, sum);
+        }
+        self.deleted.extend(stale);
+    }
+
+    /// Rolls back the transaction, discarding all pending changes.
+    ///
+    /// Dropping a transaction has the same effect, but an explicit rollback
+    /// is not reported as a leak when `detect_tx_leaks` is enabled.
+    pub fn rollback(mut self) {
+        self.creation_trace = None;
+    }
 }
 
 impl Drop for WriteTx<'_> {
     fn drop(&mut self) {
         // If not committed, changes are automatically discarded
         // since they're only in the pending tree.
-        if !self.committed {
-            // Nothing to do - pending changes are dropped with self.
+        if !self.committed
+            && self.db.options().detect_tx_leaks
+            && let Some(trace) = self.creation_trace.take()
+        {
+            self.db.options().logger.log(&format!(
+                "write transaction dropped without commit or rollback; created at:\n{trace}"
+            ));
+        }
+        // Commit hooks were taken when the commit succeeded, so anything
+        // left belongs to a transaction that did not commit.
+        self.take_hooks().rolled_back();
+    }
+}
+
+/// A single operation recorded by a [`TxBatch`].
+enum BatchOp {
+    CreateBucket {
+        name: Vec<u8>,
+    },
+    Put {
+        bucket: Vec<u8>,
+        key: Vec<u8>,
+        value: Vec<u8>,
+    },
+    Delete {
+        bucket: Vec<u8>,
+        key: Vec<u8>,
+    },
+}
+
+/// A write transaction committed in chunks.
+///
+/// Passed to the callback of `Database::chunked_update()`. It dereferences
+/// to the [`WriteTx`] of the current chunk; [`commit()`](Self::commit)
+/// marks a point where the chunk may be committed and a fresh one started.
+pub struct ChunkedTx<'db> {
+    tx: WriteTx<'db>,
+    chunk_size: usize,
+    chunks: u64,
+}
+
+impl<'db> ChunkedTx<'db> {
+    /// Wraps `tx`, committing chunks of at least `chunk_size` writes.
+    pub(crate) fn new(tx: WriteTx<'db>, chunk_size: usize) -> Self {
+        Self {
+            tx,
+            chunk_size: chunk_size.max(1),
+            chunks: 0,
+        }
+    }
+
+    /// Marks a commit point.
+    ///
+    /// Commits the current chunk if it has staged at least `chunk_size`
+    /// writes and deletes, and starts a new one. Call it between units of
+    /// work that must not be split across chunks.
+    ///
+    /// Returns `true` if a chunk was committed.
+    ///
+    /// # Errors
+    ///
+    /// Returns an error if the commit fails. The chunk's changes are
+    /// discarded.
+    pub fn commit(&mut self) -> Result<bool> {
+        if self.tx.staged_len() < self.chunk_size {
+            return Ok(false);
+        }
+        self.flush()?;
+        Ok(true)
+    }
+
+    /// Commits the current chunk regardless of its size.
+    ///
+    /// # Errors
+    ///
+    /// Returns an error if the commit fails. The chunk's changes are
+    /// discarded.
+    pub fn flush(&mut self) -> Result<()> {
+        self.tx.commit_and_continue()?;
+        self.chunks += 1;
+        Ok(())
+    }
+
+    /// Returns the number of chunks committed so far.
+    #[inline]
+    pub fn chunks_committed(&self) -> u64 {
+        self.chunks
+    }
+
+    /// Commits the final chunk, if it staged anything, and returns the
+    /// number of chunks committed.
+    pub(crate) fn finish(mut self) -> Result<u64> {
+        if self.tx.staged_len() > 0 {
+            self.flush()?;
+        }
+        self.tx.rollback();
+        Ok(self.chunks)
+    }
+
+    /// Discards the current chunk.
+    pub(crate) fn rollback(self) {
+        self.tx.rollback();
+    }
+}
+
+impl<'db> std::ops::Deref for ChunkedTx<'db> {
+    type Target = WriteTx<'db>;
+
+    fn deref(&self) -> &Self::Target {
+        &self.tx
+    }
+}
+
+impl std::ops::DerefMut for ChunkedTx<'_> {
+    fn deref_mut(&mut self) -> &mut Self::Target {
+        &mut self.tx
+    }
+}
+
+/// A fluent builder for multi-bucket batch operations.
+///
+/// Created by [`WriteTx::batch()`]. Operations are only recorded by the
+/// builder methods; nothing touches the transaction until
+/// [`apply()`](Self::apply) is called.
+///
+/// # Ordering
+///
+/// On apply, bucket creations run first, then puts and deletes are
+/// grouped by bucket and sorted by key. Operations on the same key keep
+/// their recorded order, so the last one wins.
+pub struct TxBatch<'tx, 'db> {
+    tx: &'tx mut WriteTx<'db>,
+    ops: Vec<BatchOp>,
+}
+
+impl TxBatch<'_, '_> {
+    /// Records the creation of a bucket.
+    #[must_use]
+    pub fn create_bucket(mut self, name: &[u8]) -> Self {
+        self.ops.push(BatchOp::CreateBucket {
+            name: name.to_vec(),
+        });
+        self
+    }
+
+    /// Records a put of a key-value pair into a bucket.
+    #[must_use]
+    pub fn put(mut self, bucket: &[u8], key: &[u8], value: &[u8]) -> Self {
+        self.ops.push(BatchOp::Put {
+            bucket: bucket.to_vec(),
+            key: key.to_vec(),
+            value: value.to_vec(),
+        });
+        self
+    }
+
+    /// Records the deletion of a key from a bucket.
+    #[must_use]
+    pub fn delete(mut self, bucket: &[u8], key: &[u8]) -> Self {
+        self.ops.push(BatchOp::Delete {
+            bucket: bucket.to_vec(),
+            key: key.to_vec(),
+        });
+        self
+    }
+
+    /// Returns the number of recorded operations.
+    pub fn len(&self) -> usize {
+        self.ops.len()
+    }
+
+    /// Returns true if no operations have been recorded.
+    pub fn is_empty(&self) -> bool {
+        self.ops.is_empty()
+    }
+
+    /// Applies all recorded operations to the transaction.
+    ///
+    /// Every operation is validated, and the batch's total size checked
+    /// against `max_tx_size`, before any of them is applied, so a batch
+    /// that fails leaves the transaction exactly as it was before it. Puts
+    /// and deletes then go through [`WriteTx::bucket_put()`] and
+    /// [`WriteTx::bucket_delete()`], and count towards `max_tx_size` like
+    /// any other write.
+    ///
+    /// # Errors
+    ///
+    /// Returns `InvalidBucketName` if any bucket name is invalid.
+    /// Returns `BucketAlreadyExists` if a created bucket already exists.
+    /// Returns `BucketNotFound` if a put or delete targets a bucket that
+    /// neither exists nor is created by this batch.
+    /// Returns `TxTooLarge` if the batch's writes would exceed
+    /// `max_tx_size`.
+    pub fn apply(self) -> Result<()> {
+        let TxBatch { tx, ops } = self;
+
+        // Validate everything up front. Creations run before any write and
+        // deletes never remove buckets, so this is the complete check.
+        let mut created: Vec<&[u8]> = Vec::new();
+        for op in &ops {
+            if let BatchOp::CreateBucket { name } = op {
+                bucket::validate_bucket_name(name)?;
+                if tx.is_bucket_present(name) || created.contains(&name.as_slice()) {
+                    return Err(Error::BucketAlreadyExists { name: name.clone() });
+                }
+                created.push(name);
+            }
+        }
+        for op in &ops {
+            if let BatchOp::Put { bucket: name, .. } | BatchOp::Delete { bucket: name, .. } = op {
+                bucket::validate_bucket_name(name)?;
+                if !tx.is_bucket_present(name) && !created.contains(&name.as_slice()) {
+                    return Err(Error::BucketNotFound { name: name.clone() });
+                }
+            }
+        }
+
+        // Creating a bucket stages nothing that counts, so once the writes
+        // fit, every operation below succeeds.
+        tx.check_tx_size(ops.iter().map(batch_op_size).sum())?;
+
+        let (creates, mut writes): (Vec<BatchOp>, Vec<BatchOp>) = ops
+            .into_iter()
+            .partition(|op| matches!(op, BatchOp::CreateBucket { .. }));
+
+        for op in creates {
+            if let BatchOp::CreateBucket { name } = op {
+                tx.create_bucket(&name)?;
+            }
+        }
+
+        // Stable sort keeps recorded order for operations on the same key.
+        writes.sort_by(|a, b| batch_op_target(a).cmp(&batch_op_target(b)));
+
+        for op in writes {
+            match op {
+                BatchOp::Put { bucket, key, value } => tx.bucket_put_owned(&bucket, &key, value)?,
+                BatchOp::Delete { bucket, key } => tx.bucket_delete(&bucket, &key)?,
+                BatchOp::CreateBucket { .. } => {}
+            }
         }
+
+        Ok(())
+    }
+}
+
+/// Returns the bytes a batch operation counts towards `max_tx_size`: its
+/// internal bucket data key, as built by `bucket::bucket_data_key()`, and
+/// any value.
+fn batch_op_size(op: &BatchOp) -> usize {
+    match op {
+        BatchOp::Put { bucket, key, value } => 2 + bucket.len() + key.len() + value.len(),
+        BatchOp::Delete { bucket, key } => 2 + bucket.len() + key.len(),
+        BatchOp::CreateBucket { .. } => 0,
+    }
+}
+
+/// Returns the (bucket, key) pair a batch write operation targets.
+fn batch_op_target(op: &BatchOp) -> (&[u8], &[u8]) {
+    match op {
+        BatchOp::Put { bucket, key, .. } | BatchOp::Delete { bucket, key } => (bucket, key),
+        BatchOp::CreateBucket { name } => (name, &[]),
     }
 }
 
@@ -1508,4 +3916,144 @@ mod tests {
 
         cleanup(&path);
     }
+
+    #[test]
+    fn test_write_tx_leak_detection() {
+        use crate::db::DatabaseOptions;
+        use crate::logger::Logger;
+        use std::sync::{Arc, Mutex};
+
+        let path = test_db_path("leak_detection");
+        cleanup(&path);
+
+        let messages = Arc::new(Mutex::new(Vec::<String>::new()));
+        let sink = Arc::clone(&messages);
+        let options = DatabaseOptions {
+            logger: Logger::new(move |msg| sink.lock().unwrap().push(msg.to_string())),
+            detect_tx_leaks: true,
+            ..DatabaseOptions::default()
+        };
+        let mut db = Database::open_with_options(&path, options).expect("open should succeed");
+
+        // Committed and rolled back transactions are not leaks.
+        {
+            let mut wtx = db.write_tx();
+            wtx.put(b"k", b"v");
+            wtx.commit().expect("commit should succeed");
+        }
+        {
+            let mut wtx = db.write_tx();
+            wtx.put(b"k2", b"v2");
+            wtx.rollback();
+        }
+        assert!(messages.lock().unwrap().is_empty());
+
+        // Abandoned transaction is reported with its creation stack.
+        {
+            let mut wtx = db.write_tx();
+            wtx.put(b"abandoned", b"v");
+        }
+        let logged = messages.lock().unwrap();
+        assert_eq!(logged.len(), 1);
+        assert!(logged[0].contains("dropped without commit or rollback"));
+        assert!(logged[0].contains("test_write_tx_leak_detection"));
+
+        cleanup(&path);
+    }
+
+    #[test]
+    fn test_write_tx_max_duration() {
+        use crate::db::DatabaseOptions;
+        use crate::logger::Logger;
+        use std::sync::{Arc, Mutex};
+        use std::time::Duration;
+
+        let path = test_db_path("max_duration");
+        cleanup(&path);
+
+        let messages = Arc::new(Mutex::new(Vec::<String>::new()));
+        let sink = Arc::clone(&messages);
+        let options = DatabaseOptions {
+            logger: Logger::new(move |msg| sink.lock().unwrap().push(msg.to_string())),
+            max_tx_duration: Some(Duration::from_millis(20)),
+            abort_long_tx: true,
+            ..DatabaseOptions::default()
+        };
+        let mut db = Database::open_with_options(&path, options).expect("open should succeed");
+        let monitor = db.tx_monitor();
+        assert!(db.longest_open_tx().is_none());
+
+        {
+            let mut wtx = db.write_tx();
+            wtx.put(b"slow", b"v");
+            std::thread::sleep(Duration::from_millis(150));
+
+            let (age, stack) = monitor.longest_open_tx().expect("tx should be tracked");
+            assert!(age >= Duration::from_millis(150));
+            assert!(stack.contains("test_write_tx_max_duration"));
+
+            let err = wtx.commit().unwrap_err();
+            assert!(matches!(err, Error::TxTimedOut { .. }));
+        }
+
+        {
+            let logged = messages.lock().unwrap();
+            assert_eq!(logged.len(), 1);
+            assert!(logged[0].contains("aborting"));
+            assert!(logged[0].contains("test_write_tx_max_duration"));
+        }
+
+        // The aborted transaction released the database and wrote nothing.
+        assert!(db.longest_open_tx().is_none());
+        assert!(db.read_tx().get(b"slow").is_none());
+        let mut wtx = db.write_tx();
+        wtx.put(b"fast", b"v");
+        wtx.commit().expect("commit should succeed");
+        assert_eq!(db.read_tx().get(b"fast"), Some(b"v".to_vec()));
+
+        cleanup(&path);
+    }
+
+    #[test]
+    fn test_disable_read_your_writes() {
+        let path = test_db_path("disable_ryw");
+        cleanup(&path);
+
+        let mut db = Database::open(&path).expect("open should succeed");
+        {
+            let mut wtx = db.write_tx();
+            wtx.create_bucket(b"b").unwrap();
+            wtx.bucket_put(b"b", b"k", b"committed").unwrap();
+            wtx.commit().expect("commit should succeed");
+        }
+
+        let mut wtx = db.write_tx();
+        wtx.bucket_put(b"b", b"k", b"pending").unwrap();
+        wtx.bucket_put(b"b", b"new", b"pending").unwrap();
+        wtx.create_bucket(b"fresh").unwrap();
+        assert_eq!(
+            wtx.bucket_get(b"b", b"k").unwrap(),
+            Some(b"pending".to_vec())
+        );
+
+        // Reads now ignore this transaction's own writes.
+        wtx.disable_read_your_writes();
+        assert_eq!(
+            wtx.bucket_get(b"b", b"k").unwrap(),
+            Some(b"committed".to_vec())
+        );
+        assert_eq!(wtx.bucket_get(b"b", b"new").unwrap(), None);
+        assert!(matches!(
+            wtx.bucket_get(b"fresh", b"k").unwrap_err(),
+            Error::BucketNotFound { .. }
+        ));
+
+        // The writes still commit.
+        wtx.commit().expect("commit should succeed");
+        let rtx = db.read_tx();
+        assert_eq!(rtx.bucket(b"b").unwrap().get(b"k"), Some(&b"pending"[..]));
+        assert!(rtx.bucket_exists(b"fresh"));
+
+        cleanup(&path);
+    }
 }
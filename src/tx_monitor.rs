@@ -0,0 +1,220 @@
+//! Summary: Open transaction tracking and long-transaction watchdog.
+//! Copyright (c) YOAB. All rights reserved.
+//!
+//! When `DatabaseOptions::max_tx_duration` is set, every write transaction
+//! registers itself with a [`TxMonitor`] together with its creation
+//! backtrace. A watchdog thread logs a warning for any write transaction
+//! that stays open longer than the limit and, with `abort_long_tx`, marks
+//! it aborted so its commit fails instead of persisting stale work.
+//!
+//! Because a write transaction mutably borrows the database, the monitor
+//! is handed out as a separate, cloneable handle that other threads can
+//! query while the transaction is open.
+
+use std::backtrace::Backtrace;
+use std::collections::HashMap;
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::{Arc, Mutex, Weak};
+use std::time::{Duration, Instant};
+
+use crate::logger::Logger;
+
+/// Upper bound on the watchdog polling interval.
+const MAX_POLL_INTERVAL: Duration = Duration::from_secs(1);
+
+/// Lower bound on the watchdog polling interval.
+const MIN_POLL_INTERVAL: Duration = Duration::from_millis(1);
+
+/// An open write transaction as seen by the monitor.
+struct OpenTx {
+    started: Instant,
+    stack: Arc<Backtrace>,
+    warned: bool,
+    aborted: Arc<AtomicBool>,
+}
+
+/// Shared monitor state.
+#[derive(Default)]
+struct MonitorState {
+    open: HashMap<u64, OpenTx>,
+    next_id: u64,
+}
+
+/// Handle for inspecting open write transactions.
+///
+/// Cheap to clone and safe to share across threads.
+#[derive(Clone, Default)]
+pub struct TxMonitor {
+    state: Arc<Mutex<MonitorState>>,
+}
+
+/// Registration of a transaction with the monitor.
+///
+/// Unregisters the transaction when dropped.
+pub(crate) struct TxRegistration {
+    id: u64,
+    monitor: TxMonitor,
+    started: Instant,
+    aborted: Arc<AtomicBool>,
+}
+
+impl TxRegistration {
+    /// Returns how long the transaction has been open.
+    #[inline]
+    pub(crate) fn age(&self) -> Duration {
+        self.started.elapsed()
+    }
+
+    /// Returns true if the watchdog aborted this transaction.
+    #[inline]
+    pub(crate) fn is_aborted(&self) -> bool {
+        self.aborted.load(Ordering::Acquire)
+    }
+}
+
+impl Drop for TxRegistration {
+    fn drop(&mut self) {
+        self.monitor.lock().open.remove(&self.id);
+    }
+}
+
+impl TxMonitor {
+    /// Creates a monitor with no open transactions.
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Locks the state, recovering from a poisoned mutex.
+    fn lock(&self) -> std::sync::MutexGuard<'_, MonitorState> {
+        self.state.lock().unwrap_or_else(|e| e.into_inner())
+    }
+
+    /// Registers a newly opened write transaction.
+    pub(crate) fn register(&self, stack: Arc<Backtrace>) -> TxRegistration {
+        let aborted = Arc::new(AtomicBool::new(false));
+        let started = Instant::now();
+        let mut state = self.lock();
+        let id = state.next_id;
+        state.next_id += 1;
+        state.open.insert(
+            id,
+            OpenTx {
+                started,
+                stack,
+                warned: false,
+                aborted: Arc::clone(&aborted),
+            },
+        );
+        TxRegistration {
+            id,
+            monitor: self.clone(),
+            started,
+            aborted,
+        }
+    }
+
+    /// Returns the age and creation stack of the oldest open write transaction.
+    ///
+    /// Returns `None` if no write transaction is open.
+    pub fn longest_open_tx(&self) -> Option<(Duration, String)> {
+        let state = self.lock();
+        state
+            .open
+            .values()
+            .min_by_key(|tx| tx.started)
+            .map(|tx| (tx.started.elapsed(), tx.stack.to_string()))
+    }
+
+    /// Warns about (and optionally aborts) transactions open past `limit`.
+    fn check(&self, limit: Duration, abort: bool, logger: &Logger) {
+        let mut state = self.lock();
+        for tx in state.open.values_mut() {
+            let age = tx.started.elapsed();
+            if age <= limit || tx.warned {
+                continue;
+            }
+            tx.warned = true;
+            if abort {
+                tx.aborted.store(true, Ordering::Release);
+            }
+            logger.log(&format!(
+                "write transaction open for {age:?} (limit {limit:?}){}; created at:\n{}",
+                if abort { ", aborting" } else { "" },
+                tx.stack
+            ));
+        }
+    }
+
+    /// Starts a watchdog thread that enforces `limit`.
+    ///
+    /// The thread exits once every handle to this monitor is dropped.
+    pub(crate) fn spawn_watchdog(&self, limit: Duration, abort: bool, logger: &Logger) {
+        let weak: Weak<Mutex<MonitorState>> = Arc::downgrade(&self.state);
+        let interval = (limit / 4).clamp(MIN_POLL_INTERVAL, MAX_POLL_INTERVAL);
+        let thread_logger = logger.clone();
+        let spawned = std::thread::Builder::new()
+            .name("thunder-tx-watchdog".to_string())
+            .spawn(move || {
+                loop {
+                    std::thread::sleep(interval);
+                    let Some(state) = weak.upgrade() else {
+                        break;
+                    };
+                    TxMonitor { state }.check(limit, abort, &thread_logger);
+                }
+            });
+        if let Err(e) = spawned {
+            // Monitoring is best effort; the database works without it.
+            logger.log(&format!("failed to start transaction watchdog: {e}"));
+        }
+    }
+}
+
+impl std::fmt::Debug for TxMonitor {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_struct("TxMonitor")
+            .field("open", &self.lock().open.len())
+            .finish()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_monitor_tracks_oldest_transaction() {
+        let monitor = TxMonitor::new();
+        assert!(monitor.longest_open_tx().is_none());
+
+        let first = monitor.register(Arc::new(Backtrace::disabled()));
+        std::thread::sleep(Duration::from_millis(5));
+        let second = monitor.register(Arc::new(Backtrace::disabled()));
+
+        let (oldest, _) = monitor.longest_open_tx().unwrap();
+        assert!(oldest >= Duration::from_millis(5));
+
+        drop(first);
+        let (remaining, _) = monitor.longest_open_tx().unwrap();
+        assert!(remaining < oldest);
+
+        drop(second);
+        assert!(monitor.longest_open_tx().is_none());
+    }
+
+    #[test]
+    fn test_check_aborts_once() {
+        let monitor = TxMonitor::new();
+        let reg = monitor.register(Arc::new(Backtrace::disabled()));
+        let logged = Arc::new(Mutex::new(0usize));
+        let sink = Arc::clone(&logged);
+        let logger = Logger::new(move |_| *sink.lock().unwrap() += 1);
+
+        std::thread::sleep(Duration::from_millis(2));
+        monitor.check(Duration::from_millis(1), true, &logger);
+        monitor.check(Duration::from_millis(1), true, &logger);
+
+        assert!(reg.is_aborted());
+        assert_eq!(*logged.lock().unwrap(), 1);
+    }
+}
@@ -0,0 +1,53 @@
+//! Summary: Explicit, crash-safe upgrades of older database file formats.
+//! Copyright (c) YOAB. All rights reserved.
+//!
+//! A database file records the format version it was written in. Opening a
+//! file written by an older release keeps it in that format: later commits
+//! append to it as they always have, and the stored version is unchanged.
+//! `Database::needs_upgrade()` reports such files, and
+//! `Database::upgrade()` migrates them to the current format.
+//!
+//! The current format, version 4, adds compressed blocks and values to
+//! version 3. Upgrading a version 3 file rewrites it as version 4, after
+//! which releases that only read version 3 refuse it. A commit that
+//! writes compressed data to a version 3 file stamps it as version 4 on
+//! its own, since version 3 readers would misread that data.
+//!
+//! Files written by a newer release cannot be read at all: opening one
+//! fails with `IncompatibleVersion`, naming the version found and the
+//! highest one this release supports, before anything is read or written.
+//!
+//! # Crash Safety
+//!
+//! An upgrade is a compaction: the committed state is rewritten in the
+//! current format into a side file, which is then renamed over the
+//! database file. A crash before the rename leaves the old file intact; a
+//! crash after it leaves the upgraded one. There is no point at which the
+//! file is partly upgraded.
+//!
+//! # Refusing Writes
+//!
+//! With `DatabaseOptions::require_upgrade` set, commits against a file that
+//! needs an upgrade fail with `UpgradeRequired`, so an application can make
+//! sure it never writes to an old-format file by accident. Reads are always
+//! allowed.
+
+/// A step of an upgrade, reported to the progress callback of
+/// `Database::upgrade_with_progress()`.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum UpgradeProgress {
+    /// The committed state is being rewritten into a side file.
+    Rewriting {
+        /// The format version being upgraded from.
+        from_version: u32,
+        /// The number of entries being rewritten.
+        entries: u64,
+    },
+    /// The rewritten file is being swapped in.
+    Swapping,
+    /// The upgrade finished.
+    Done {
+        /// The format version the file is now in.
+        version: u32,
+    },
+}
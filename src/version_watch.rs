@@ -0,0 +1,131 @@
+//! Summary: Waiting for the committed version to reach a target.
+//! Copyright (c) YOAB. All rights reserved.
+//!
+//! Every successful commit advances the database's version (the txid of the
+//! meta page it wrote). A [`VersionWatch`] lets other threads block until
+//! the version reaches a given value, e.g. so a reader on a replica can wait
+//! until the writes a client saw acknowledged have been applied there.
+//!
+//! Because applying writes mutably borrows the database, the watch is handed
+//! out as a separate, cloneable handle, like `TxMonitor`.
+
+use std::sync::{Arc, Condvar, Mutex};
+use std::time::{Duration, Instant};
+
+use crate::error::{Error, Result};
+
+#[derive(Default)]
+struct WatchState {
+    version: Mutex<u64>,
+    advanced: Condvar,
+}
+
+/// Handle for waiting on the committed version.
+///
+/// Cheap to clone and safe to share across threads.
+#[derive(Clone, Default)]
+pub struct VersionWatch {
+    state: Arc<WatchState>,
+}
+
+impl VersionWatch {
+    /// Creates a watch starting at `version`.
+    pub fn new(version: u64) -> Self {
+        let watch = Self::default();
+        *watch.lock() = version;
+        watch
+    }
+
+    /// Locks the version, recovering from a poisoned mutex.
+    fn lock(&self) -> std::sync::MutexGuard<'_, u64> {
+        self.state.version.lock().unwrap_or_else(|e| e.into_inner())
+    }
+
+    /// Returns the current committed version.
+    pub fn version(&self) -> u64 {
+        *self.lock()
+    }
+
+    /// Advances the version and wakes waiters that it satisfies.
+    ///
+    /// The version never moves backwards.
+    pub(crate) fn advance(&self, version: u64) {
+        let mut current = self.lock();
+        if version > *current {
+            *current = version;
+            self.state.advanced.notify_all();
+        }
+    }
+
+    /// Blocks until the committed version is at least `version`.
+    ///
+    /// Returns the version observed once the target is reached.
+    ///
+    /// # Errors
+    ///
+    /// Returns `WaitTimedOut` if `timeout` elapses first.
+    ///
+    /// # Example
+    ///
+    /// ```ignore
+    /// let watch = replica.version_watch();
+    /// // On a reader thread, with `version` returned by the primary:
+    /// watch.wait_for_version(version, Duration::from_secs(5))?;
+    /// ```
+    pub fn wait_for_version(&self, version: u64, timeout: Duration) -> Result<u64> {
+        let deadline = Instant::now() + timeout;
+        let mut current = self.lock();
+        while *current < version {
+            let now = Instant::now();
+            if now >= deadline {
+                return Err(Error::WaitTimedOut {
+                    version,
+                    current: *current,
+                });
+            }
+            current = self
+                .state
+                .advanced
+                .wait_timeout(current, deadline - now)
+                .unwrap_or_else(|e| e.into_inner())
+                .0;
+        }
+        Ok(*current)
+    }
+}
+
+impl std::fmt::Debug for VersionWatch {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_struct("VersionWatch")
+            .field("version", &self.version())
+            .finish()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_wait_for_version() {
+        let watch = VersionWatch::new(5);
+        assert_eq!(watch.wait_for_version(3, Duration::ZERO).unwrap(), 5);
+        assert!(matches!(
+            watch.wait_for_version(6, Duration::from_millis(10)),
+            Err(Error::WaitTimedOut {
+                version: 6,
+                current: 5
+            })
+        ));
+
+        let waiter = {
+            let watch = watch.clone();
+            std::thread::spawn(move || watch.wait_for_version(8, Duration::from_secs(10)))
+        };
+        watch.advance(7);
+        watch.advance(4);
+        assert_eq!(watch.version(), 7);
+        watch.advance(9);
+        assert_eq!(waiter.join().unwrap().unwrap(), 9);
+    }
+}
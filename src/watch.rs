@@ -0,0 +1,207 @@
+//! Summary: Notifications of committed changes under a key prefix.
+//! Copyright (c) YOAB. All rights reserved.
+//!
+//! `Database::watch()` and `Database::watch_bucket()` return a channel
+//! receiving a [`WatchEvent`] for each committed change to a key under a
+//! prefix, at the top level or in one bucket. Events are sent once the
+//! commit is durable, in commit order, and within a commit in the order
+//! the audit log uses: deletions first, then puts in key order. Changes
+//! of rolled back transactions are never sent, and internal bookkeeping
+//! entries are not reported.
+//!
+//! # Back-Pressure
+//!
+//! Sending never blocks the commit. A watch created with a buffer size
+//! holds at most that many undelivered events; events arriving while it
+//! is full are dropped. Each watch numbers the events it matches from 1,
+//! counting dropped ones, so a gap in [`WatchEvent::sequence`] tells a
+//! slow consumer how many it missed. A watch without a buffer size never
+//! drops events and queues as many as the consumer leaves unread.
+//!
+//! # Ending a Watch
+//!
+//! [`Unwatch::unwatch()`] ends a watch and closes its channel once the
+//! queued events are received. Dropping the receiver also ends it.
+
+use std::fmt;
+use std::sync::mpsc::{self, Receiver, Sender, SyncSender, TrySendError};
+use std::sync::{Arc, Mutex, MutexGuard, Weak};
+
+use crate::audit;
+
+/// A committed change to a watched key.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct WatchEvent {
+    /// Position of the event among those the watch matched, from 1.
+    pub sequence: u64,
+    /// The version the change was committed as.
+    pub version: u64,
+    /// The key, without any bucket prefix.
+    pub key: Vec<u8>,
+    /// The new value, or `None` if the key was deleted.
+    pub value: Option<Vec<u8>>,
+}
+
+/// The sending side of a watch's channel.
+enum EventSender {
+    Unbounded(Sender<WatchEvent>),
+    Bounded(SyncSender<WatchEvent>),
+}
+
+impl EventSender {
+    /// Sends `event` without blocking, dropping it if the channel is full.
+    ///
+    /// Returns `false` if the receiver was dropped.
+    fn send(&self, event: WatchEvent) -> bool {
+        match self {
+            Self::Unbounded(sender) => sender.send(event).is_ok(),
+            Self::Bounded(sender) => {
+                !matches!(sender.try_send(event), Err(TrySendError::Disconnected(_)))
+            }
+        }
+    }
+}
+
+struct Watcher {
+    id: u64,
+    /// Watched bucket, or `None` for top-level keys.
+    bucket: Option<Vec<u8>>,
+    prefix: Vec<u8>,
+    sender: EventSender,
+    /// Events matched so far.
+    sequence: u64,
+}
+
+impl Watcher {
+    /// Returns whether a change to `key` in the bucket at `path` matches.
+    fn matches(&self, path: &[&[u8]], key: &[u8]) -> bool {
+        let in_scope = match (&self.bucket, path) {
+            (None, []) => true,
+            (Some(bucket), [name]) => bucket.as_slice() == *name,
+            _ => false,
+        };
+        in_scope && key.starts_with(&self.prefix)
+    }
+}
+
+#[derive(Default)]
+struct WatchersState {
+    next_id: u64,
+    watchers: Vec<Watcher>,
+}
+
+/// The watches registered with a database.
+///
+/// Cheap to clone and safe to share across threads.
+#[derive(Clone, Default)]
+pub(crate) struct Watchers {
+    state: Arc<Mutex<WatchersState>>,
+}
+
+impl Watchers {
+    /// Locks the registered watches, recovering from a poisoned mutex.
+    fn lock(&self) -> MutexGuard<'_, WatchersState> {
+        self.state.lock().unwrap_or_else(|e| e.into_inner())
+    }
+
+    /// Registers a watch of keys under `prefix`, in `bucket` or at the top
+    /// level, holding at most `buffer` undelivered events if given.
+    pub(crate) fn subscribe(
+        &self,
+        bucket: Option<&[u8]>,
+        prefix: &[u8],
+        buffer: Option<usize>,
+    ) -> (Receiver<WatchEvent>, Unwatch) {
+        let (sender, receiver) = match buffer {
+            Some(size) => {
+                let (sender, receiver) = mpsc::sync_channel(size);
+                (EventSender::Bounded(sender), receiver)
+            }
+            None => {
+                let (sender, receiver) = mpsc::channel();
+                (EventSender::Unbounded(sender), receiver)
+            }
+        };
+        let mut state = self.lock();
+        state.next_id += 1;
+        let id = state.next_id;
+        state.watchers.push(Watcher {
+            id,
+            bucket: bucket.map(<[u8]>::to_vec),
+            prefix: prefix.to_vec(),
+            sender,
+            sequence: 0,
+        });
+        let unwatch = Unwatch {
+            state: Arc::downgrade(&self.state),
+            id,
+        };
+        (receiver, unwatch)
+    }
+
+    /// Sends the changes of the commit that produced `version` to the
+    /// watches they match.
+    ///
+    /// `changes` holds internal keys with their new values, `None` for
+    /// deletions, in the order they were applied.
+    pub(crate) fn notify<'k>(
+        &self,
+        version: u64,
+        changes: impl IntoIterator<Item = (&'k [u8], Option<&'k [u8]>)>,
+    ) {
+        let mut state = self.lock();
+        if state.watchers.is_empty() {
+            return;
+        }
+        let mut disconnected = Vec::new();
+        for (internal_key, value) in changes {
+            let Some((path, key)) = audit::user_key_of(internal_key) else {
+                continue;
+            };
+            for watcher in &mut state.watchers {
+                if !watcher.matches(&path, key) {
+                    continue;
+                }
+                watcher.sequence += 1;
+                let event = WatchEvent {
+                    sequence: watcher.sequence,
+                    version,
+                    key: key.to_vec(),
+                    value: value.map(<[u8]>::to_vec),
+                };
+                if !watcher.sender.send(event) {
+                    disconnected.push(watcher.id);
+                }
+            }
+        }
+        state
+            .watchers
+            .retain(|watcher| !disconnected.contains(&watcher.id));
+    }
+}
+
+/// Ends the watch it was returned with.
+pub struct Unwatch {
+    state: Weak<Mutex<WatchersState>>,
+    id: u64,
+}
+
+impl Unwatch {
+    /// Ends the watch. Its channel closes once the events already sent
+    /// are received.
+    ///
+    /// Dropping an `Unwatch` without calling this leaves the watch active
+    /// until its receiver is dropped.
+    pub fn unwatch(self) {
+        if let Some(state) = self.state.upgrade() {
+            let mut state = state.lock().unwrap_or_else(|e| e.into_inner());
+            state.watchers.retain(|watcher| watcher.id != self.id);
+        }
+    }
+}
+
+impl fmt::Debug for Unwatch {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.debug_struct("Unwatch").field("id", &self.id).finish()
+    }
+}
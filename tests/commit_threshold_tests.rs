@@ -0,0 +1,77 @@
+//! Summary: Tests for the process-wide write buffer commit threshold.
+//! Kept in their own test binary because the threshold is global to the process.
+//! Copyright (c) YOAB. All rights reserved.
+
+use std::fs;
+use std::sync::Arc;
+use std::sync::atomic::{AtomicU64, Ordering};
+
+use thunderdb::memory::{memory_usage, set_commit_threshold};
+use thunderdb::{BackgroundCommitter, Database};
+
+fn test_db_path(name: &str) -> String {
+    format!("/tmp/thunder_commit_threshold_test_{name}.db")
+}
+
+#[test]
+fn test_commit_threshold_back_pressure_across_databases() {
+    const THRESHOLD: u64 = 64 * 1024;
+    const VALUE_LEN: usize = 1024;
+    const UPDATES: u32 = 300;
+
+    set_commit_threshold(THRESHOLD);
+    let peak = Arc::new(AtomicU64::new(0));
+
+    let mut committers = Vec::new();
+    for db_idx in 0..3u8 {
+        let path = test_db_path(&db_idx.to_string());
+        let _ = fs::remove_file(&path);
+        let db = Database::open(&path).expect("open should succeed");
+        let start_version = db.version();
+        let committer = BackgroundCommitter::start(db);
+
+        let receivers: Vec<_> = (0..UPDATES)
+            .map(|i| {
+                let peak = Arc::clone(&peak);
+                committer.submit_update(move |wtx| {
+                    wtx.put(&i.to_be_bytes(), &vec![db_idx; VALUE_LEN]);
+                    peak.fetch_max(memory_usage(), Ordering::Relaxed);
+                    Ok(())
+                })
+            })
+            .collect();
+        committers.push((db_idx, path, start_version, committer, receivers));
+    }
+
+    for (db_idx, path, start_version, committer, receivers) in committers {
+        for done in receivers {
+            done.recv().unwrap().expect("update should commit");
+        }
+        let db = committer.shutdown();
+
+        // The threshold forced the queued updates into several commits.
+        let early_commits = UPDATES as u64 * VALUE_LEN as u64 / THRESHOLD;
+        assert!(db.version() - start_version >= early_commits);
+
+        {
+            let rtx = db.read_tx();
+            assert_eq!(rtx.iter().count(), UPDATES as usize);
+            for i in 0..UPDATES {
+                assert_eq!(rtx.get(&i.to_be_bytes()), Some(vec![db_idx; VALUE_LEN]));
+            }
+        }
+        drop(db);
+        let _ = fs::remove_file(&path);
+    }
+
+    // Each database may overshoot by at most one update before committing.
+    let slack = 3 * (VALUE_LEN as u64 + 4);
+    let peak = peak.load(Ordering::Relaxed);
+    assert!(
+        peak <= THRESHOLD + slack,
+        "peak usage {peak} over threshold"
+    );
+    assert_eq!(memory_usage(), 0);
+
+    set_commit_threshold(0);
+}
@@ -1137,6 +1137,54 @@ mod failpoint_tests {
         }
     }
 
+    /// Test that a failed bucket rename leaves the bucket under exactly one
+    /// of its names, with all of its keys.
+    #[test]
+    fn test_rename_bucket_never_half_applied() {
+        let _lock = FAILPOINT_TEST_LOCK.lock().unwrap();
+        for failpoint in [
+            "before_data_write",
+            "after_data_write",
+            "before_meta_write",
+            "after_meta_write",
+        ] {
+            reset_failpoints();
+            let dir = tempdir().unwrap();
+            let db_path = dir.path().join("test.db");
+
+            {
+                let mut db = thunderdb::Database::open(&db_path).unwrap();
+                let mut tx = db.write_tx();
+                tx.create_bucket(b"events_v1").unwrap();
+                for i in 0..500u32 {
+                    tx.bucket_put(b"events_v1", format!("key{i:04}").as_bytes(), b"value")
+                        .unwrap();
+                }
+                tx.commit().unwrap();
+            }
+
+            {
+                FailpointRegistry::global().register(failpoint, FailAction::IoError);
+
+                let mut db = thunderdb::Database::open(&db_path).unwrap();
+                let mut tx = db.write_tx();
+                tx.rename_bucket(b"events_v1", b"events_v2").unwrap();
+
+                let result = tx.commit();
+                reset_failpoints();
+                assert!(result.is_err(), "{failpoint}: commit should fail");
+            }
+
+            let db = thunderdb::Database::open(&db_path).unwrap();
+            let tx = db.read_tx();
+            let keys = |name: &[u8]| tx.bucket(name).ok().map(|b| b.iter().count());
+            match (keys(b"events_v1"), keys(b"events_v2")) {
+                (Some(500), None) | (None, Some(500)) => {}
+                found => panic!("{failpoint}: bucket found as {found:?}"),
+            }
+        }
+    }
+
     /// Randomized crash test with failpoints.
     ///
     /// Tests only the "safe" failpoints - those that occur before data is written
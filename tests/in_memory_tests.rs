@@ -0,0 +1,281 @@
+//! Summary: Tests for in-memory databases.
+//! Copyright (c) YOAB. All rights reserved.
+//!
+//! The shared scenarios run against both a file-backed and an in-memory
+//! database through `backend_tests!`, so the two backends are held to the
+//! same semantics.
+
+use std::fs;
+use thunderdb::{Database, DatabaseOptions, Error};
+
+fn test_db_path(name: &str) -> String {
+    format!("/tmp/thunder_in_memory_test_{name}.db")
+}
+
+fn cleanup(path: &str) {
+    let _ = fs::remove_file(path);
+}
+
+/// Generates a file-backed and an in-memory test for each scenario.
+macro_rules! backend_tests {
+    ($($scenario:ident),* $(,)?) => {
+        mod file_backend {
+            $(
+                #[test]
+                fn $scenario() {
+                    let path = super::test_db_path(stringify!($scenario));
+                    super::cleanup(&path);
+                    let mut db = thunderdb::Database::open(&path).expect("open should succeed");
+                    super::$scenario(&mut db);
+                    drop(db);
+                    super::cleanup(&path);
+                }
+            )*
+        }
+
+        mod memory_backend {
+            $(
+                #[test]
+                fn $scenario() {
+                    let mut db =
+                        thunderdb::Database::open_in_memory().expect("open should succeed");
+                    assert!(db.is_in_memory());
+                    super::$scenario(&mut db);
+                }
+            )*
+        }
+    };
+}
+
+backend_tests!(
+    crud,
+    rollback_on_drop,
+    update_error_rolls_back,
+    buckets,
+    cursor_order,
+    page_splits,
+    large_values,
+    snapshot_isolation,
+);
+
+// ==================== Shared Scenarios ====================
+
+fn crud(db: &mut Database) {
+    {
+        let mut wtx = db.write_tx();
+        wtx.put(b"key1", b"value1");
+        wtx.put(b"key2", b"value2");
+        wtx.commit().expect("commit should succeed");
+    }
+    {
+        let mut wtx = db.write_tx();
+        wtx.put(b"key1", b"updated");
+        wtx.delete(b"key2");
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let rtx = db.read_tx();
+    assert_eq!(rtx.get(b"key1"), Some(b"updated".to_vec()));
+    assert!(rtx.get(b"key2").is_none());
+}
+
+fn rollback_on_drop(db: &mut Database) {
+    {
+        let mut wtx = db.write_tx();
+        wtx.put(b"existing", b"original");
+        wtx.commit().expect("commit should succeed");
+    }
+    {
+        let mut wtx = db.write_tx();
+        wtx.put(b"new_key", b"new_value");
+        wtx.put(b"existing", b"modified");
+        // Dropped without commit.
+    }
+
+    let rtx = db.read_tx();
+    assert_eq!(rtx.get(b"existing"), Some(b"original".to_vec()));
+    assert!(rtx.get(b"new_key").is_none());
+}
+
+fn update_error_rolls_back(db: &mut Database) {
+    let version = db.version();
+    let result: thunderdb::Result<()> = db.update(|wtx| {
+        wtx.put(b"key", b"value");
+        Err(Error::KeyNotFound)
+    });
+    assert!(matches!(result, Err(Error::KeyNotFound)));
+    assert_eq!(db.version(), version);
+    assert!(db.read_tx().get(b"key").is_none());
+}
+
+fn buckets(db: &mut Database) {
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"users").unwrap();
+        wtx.create_bucket(b"groups").unwrap();
+        wtx.bucket_put(b"users", b"alice", b"admin").unwrap();
+        wtx.bucket_put(b"users", b"bob", b"member").unwrap();
+        wtx.bucket_put(b"groups", b"alice", b"staff").unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+    {
+        let mut wtx = db.write_tx();
+        wtx.bucket_delete(b"users", b"bob").unwrap();
+        wtx.delete_bucket(b"groups").unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let rtx = db.read_tx();
+    let users = rtx.bucket(b"users").unwrap();
+    assert_eq!(users.get(b"alice"), Some(&b"admin"[..]));
+    assert!(users.get(b"bob").is_none());
+    assert!(!rtx.bucket_exists(b"groups"));
+}
+
+fn cursor_order(db: &mut Database) {
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"items").unwrap();
+        for i in [3u32, 1, 4, 0, 2] {
+            wtx.bucket_put(b"items", &i.to_be_bytes(), b"v").unwrap();
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let rtx = db.read_tx();
+    let bucket = rtx.bucket(b"items").unwrap();
+    let mut cursor = bucket.cursor();
+    let mut forward = Vec::new();
+    let mut entry = cursor.first();
+    while let Some((key, _)) = entry {
+        forward.push(key.to_vec());
+        entry = cursor.next();
+    }
+    let expected: Vec<_> = (0..5u32).map(|i| i.to_be_bytes().to_vec()).collect();
+    assert_eq!(forward, expected);
+
+    let mut backward = Vec::new();
+    let mut entry = cursor.last();
+    while let Some((key, _)) = entry {
+        backward.push(key.to_vec());
+        entry = cursor.prev();
+    }
+    assert_eq!(backward, expected.into_iter().rev().collect::<Vec<_>>());
+}
+
+fn page_splits(db: &mut Database) {
+    const COUNT: usize = 5_000;
+
+    {
+        let mut wtx = db.write_tx();
+        for i in 0..COUNT {
+            wtx.put(format!("k{i:05}").as_bytes(), format!("v{i}").as_bytes());
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let rtx = db.read_tx();
+    assert_eq!(rtx.iter().count(), COUNT);
+    for i in (0..COUNT).step_by(97) {
+        assert_eq!(
+            rtx.get(format!("k{i:05}").as_bytes()),
+            Some(format!("v{i}").into_bytes())
+        );
+    }
+}
+
+fn large_values(db: &mut Database) {
+    let large = vec![0xAB; db.overflow_threshold() * 8];
+    {
+        let mut wtx = db.write_tx();
+        wtx.put(b"large", &large);
+        wtx.put(b"small", b"inline");
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let rtx = db.read_tx();
+    assert_eq!(rtx.get(b"large"), Some(large));
+    assert_eq!(rtx.get(b"small"), Some(b"inline".to_vec()));
+}
+
+fn snapshot_isolation(db: &mut Database) {
+    {
+        let mut wtx = db.write_tx();
+        wtx.put(b"key", b"before");
+        wtx.commit().expect("commit should succeed");
+    }
+    let snapshot = db.snapshot();
+    {
+        let mut wtx = db.write_tx();
+        wtx.put(b"key", b"after");
+        wtx.commit().expect("commit should succeed");
+    }
+
+    assert_eq!(snapshot.get(b"key"), Some(b"before".to_vec()));
+    assert_eq!(db.read_tx().get(b"key"), Some(b"after".to_vec()));
+}
+
+// ==================== In-Memory Specifics ====================
+
+#[test]
+fn test_in_memory_databases_are_independent_and_discarded() {
+    let mut first = Database::open_in_memory().expect("open should succeed");
+    first
+        .update(|wtx| {
+            wtx.put(b"key", b"value");
+            Ok(())
+        })
+        .expect("update should succeed");
+    assert!(first.path().as_os_str().is_empty());
+
+    // A second in-memory database starts empty.
+    let second = Database::open_in_memory().expect("open should succeed");
+    assert!(second.read_tx().get(b"key").is_none());
+
+    first.close().expect("close should succeed");
+    let reopened = Database::open_in_memory().expect("open should succeed");
+    assert!(reopened.read_tx().get(b"key").is_none());
+}
+
+#[test]
+fn test_in_memory_rejects_disk_only_features() {
+    let wal = DatabaseOptions {
+        wal_enabled: true,
+        ..DatabaseOptions::default()
+    };
+    assert!(matches!(
+        Database::open_in_memory_with_options(wal),
+        Err(Error::InMemoryUnsupported {
+            feature: "write-ahead logging"
+        })
+    ));
+
+    let read_only = DatabaseOptions {
+        read_only: true,
+        ..DatabaseOptions::default()
+    };
+    assert!(matches!(
+        Database::open_in_memory_with_options(read_only),
+        Err(Error::InMemoryUnsupported { .. })
+    ));
+
+    let mut db = Database::open_in_memory().expect("open should succeed");
+    assert!(matches!(
+        db.compact(),
+        Err(Error::InMemoryUnsupported {
+            feature: "compaction"
+        })
+    ));
+}
+
+#[test]
+fn test_file_database_is_not_in_memory() {
+    let path = test_db_path("not_in_memory");
+    cleanup(&path);
+
+    let db = Database::open(&path).expect("open should succeed");
+    assert!(!db.is_in_memory());
+
+    drop(db);
+    cleanup(&path);
+}
@@ -4,7 +4,12 @@
 #![allow(clippy::drop_non_drop)] // Explicit drops for test clarity
 
 use std::fs;
-use thunderdb::{Database, Error};
+use thunderdb::{
+    AllocationKind, AuditOp, AuditRecord, AuditWriter, AutoCompactionConfig, BackgroundCommitter,
+    BucketMut, BulkOptions, CompactionPriority, CsvOptions, Database, DatabaseOptions,
+    DatabaseStats, EmptySubBuckets, Error, EvictionPolicy, FreelistType, KeyComparator, KeyLimit,
+    KeyNormalizer, MergeOperator, PageCompression, PageType, TransformAction,
+};
 
 fn test_db_path(name: &str) -> String {
     format!("/tmp/thunder_integration_test_{name}.db")
@@ -92,6 +97,94 @@ fn test_persistence_across_reopen() {
     cleanup(&path);
 }
 
+#[test]
+fn test_was_recovered_after_unclean_shutdown() {
+    let path = test_db_path("was_recovered");
+    cleanup(&path);
+
+    // Fresh database, abandoned without close() or drop, as in a crash.
+    {
+        let mut db = Database::open(&path).expect("open should succeed");
+        assert!(!db.was_recovered());
+        let mut wtx = db.write_tx();
+        wtx.put(b"key", b"value");
+        wtx.commit().expect("commit should succeed");
+        std::mem::forget(db);
+    }
+
+    // Reopen detects the unclean shutdown, then closes cleanly.
+    {
+        let db = Database::open(&path).expect("reopen should succeed");
+        assert!(db.was_recovered());
+        assert_eq!(db.read_tx().get(b"key"), Some(b"value".to_vec()));
+        db.close().expect("close should succeed");
+    }
+
+    // A clean close is not reported as a recovery.
+    {
+        let db = Database::open(&path).expect("reopen should succeed");
+        assert!(!db.was_recovered());
+        db.close().expect("close should succeed");
+    }
+
+    cleanup(&path);
+}
+
+#[test]
+fn test_drop_is_a_clean_shutdown() {
+    let path = test_db_path("drop_clean_shutdown");
+    cleanup(&path);
+
+    {
+        let mut db = Database::open(&path).expect("open should succeed");
+        db.update(|wtx| {
+            wtx.put(b"key", b"value");
+            Ok(())
+        })
+        .expect("update should succeed");
+    }
+
+    for _ in 0..2 {
+        let db = Database::open(&path).expect("reopen should succeed");
+        assert!(!db.was_recovered());
+        assert_eq!(db.read_tx().get(b"key"), Some(b"value".to_vec()));
+        drop(db);
+    }
+
+    cleanup(&path);
+}
+
+#[test]
+fn test_open_and_close_keep_version() {
+    let path = test_db_path("open_close_version");
+    cleanup(&path);
+
+    let mut db = Database::open(&path).expect("open should succeed");
+    db.update(|wtx| {
+        wtx.put(b"key", b"value");
+        Ok(())
+    })
+    .expect("update should succeed");
+    let version = db.version();
+    db.close().expect("close should succeed");
+
+    // Setting and clearing the open flag is not a commit.
+    for _ in 0..3 {
+        let db = Database::open(&path).expect("reopen should succeed");
+        assert_eq!(db.version(), version);
+        db.close().expect("close should succeed");
+    }
+
+    // Neither is an unclean shutdown.
+    std::mem::forget(Database::open(&path).expect("reopen should succeed"));
+    let db = Database::open(&path).expect("reopen should succeed");
+    assert!(db.was_recovered());
+    assert_eq!(db.version(), version);
+    drop(db);
+
+    cleanup(&path);
+}
+
 // ==================== Copy-on-Write (COW) Tests ====================
 
 #[test]
@@ -294,6 +387,294 @@ fn test_bucket_errors() {
     cleanup(&path);
 }
 
+#[test]
+fn test_many_tiny_buckets_share_pages() {
+    let path = test_db_path("many_tiny_buckets");
+    cleanup(&path);
+
+    const NUM_BUCKETS: usize = 1000;
+    let mut db = Database::open(&path).expect("open should succeed");
+
+    {
+        let mut wtx = db.write_tx();
+        for i in 0..NUM_BUCKETS {
+            let name = format!("tiny_{i:04}");
+            wtx.create_bucket(name.as_bytes()).unwrap();
+            for k in 0..3 {
+                wtx.bucket_put(name.as_bytes(), format!("k{k}").as_bytes(), b"v")
+                    .unwrap();
+            }
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+
+    // Tiny buckets must not cost a page each.
+    let file_len = fs::metadata(&path).unwrap().len() as usize;
+    assert!(
+        file_len < NUM_BUCKETS * db.page_size() / 10,
+        "{NUM_BUCKETS} tiny buckets used {file_len} bytes"
+    );
+
+    // Growing one bucket leaves the others untouched.
+    {
+        let mut wtx = db.write_tx();
+        for k in 0..5000 {
+            wtx.bucket_put(b"tiny_0000", format!("grown_{k:05}").as_bytes(), b"v")
+                .unwrap();
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+    drop(db);
+
+    let db = Database::open(&path).expect("reopen should succeed");
+    let rtx = db.read_tx();
+    assert_eq!(rtx.bucket(b"tiny_0000").unwrap().iter().count(), 5003);
+    assert_eq!(rtx.bucket(b"tiny_0999").unwrap().iter().count(), 3);
+    assert_eq!(rtx.list_buckets().len(), NUM_BUCKETS);
+
+    cleanup(&path);
+}
+
+#[test]
+fn test_bucket_transform() {
+    let path = test_db_path("bucket_transform");
+    cleanup(&path);
+
+    let mut db = Database::open(&path).expect("open should succeed");
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"scores").unwrap();
+        for i in 0..10u8 {
+            wtx.bucket_put(b"scores", &[b'a' + i], &[i]).unwrap();
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+
+    {
+        let mut wtx = db.write_tx();
+        // Pending writes are visible to the transform.
+        wtx.bucket_put(b"scores", b"z", &[100]).unwrap();
+        wtx.bucket_delete(b"scores", b"j").unwrap();
+
+        let mut visited = Vec::new();
+        let changed = wtx
+            .bucket_transform(b"scores", |key, value| {
+                visited.push(key.to_vec());
+                match value[0] {
+                    // Double even scores, drop odd ones below 5, keep the rest.
+                    v if v % 2 == 0 => TransformAction::Update(vec![v * 2]),
+                    v if v < 5 => TransformAction::Delete,
+                    _ => TransformAction::Keep,
+                }
+            })
+            .expect("transform should succeed");
+
+        assert_eq!(visited.len(), 10);
+        assert_eq!(visited.last().unwrap(), b"z");
+        // Updated: a, c, e, g, i, z. Deleted: b, d.
+        assert_eq!(changed, 8);
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let rtx = db.read_tx();
+    let bucket = rtx.bucket(b"scores").unwrap();
+    let contents: Vec<(Vec<u8>, Vec<u8>)> = bucket
+        .iter()
+        .map(|(k, v)| (k.to_vec(), v.to_vec()))
+        .collect();
+    let expected: Vec<(Vec<u8>, Vec<u8>)> = [
+        (b"a", 0u8),
+        (b"c", 4),
+        (b"e", 8),
+        (b"f", 5),
+        (b"g", 12),
+        (b"h", 7),
+        (b"i", 16),
+        (b"z", 200),
+    ]
+    .iter()
+    .map(|(k, v)| (k.to_vec(), vec![*v]))
+    .collect();
+    assert_eq!(contents, expected);
+
+    assert!(matches!(
+        db.write_tx()
+            .bucket_transform(b"missing", |_, _| TransformAction::Keep)
+            .unwrap_err(),
+        Error::BucketNotFound { .. }
+    ));
+
+    cleanup(&path);
+}
+
+#[test]
+fn test_batch_across_buckets() {
+    let path = test_db_path("batch_across_buckets");
+    cleanup(&path);
+
+    let mut db = Database::open(&path).expect("open should succeed");
+
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"users").unwrap();
+        wtx.create_bucket(b"sessions").unwrap();
+        wtx.bucket_put(b"sessions", b"s1", b"alice").unwrap();
+        wtx.bucket_put(b"sessions", b"s2", b"bob").unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+
+    // Batch spanning three buckets with mixed puts and deletes.
+    {
+        let mut wtx = db.write_tx();
+        wtx.batch()
+            .put(b"users", b"carol", b"member")
+            .put(b"audit", b"001", b"login")
+            .delete(b"sessions", b"s1")
+            .put(b"users", b"alice", b"guest")
+            .create_bucket(b"audit")
+            .put(b"users", b"alice", b"admin")
+            .put(b"sessions", b"s3", b"carol")
+            .apply()
+            .expect("batch should apply");
+        wtx.commit().expect("commit should succeed");
+    }
+
+    {
+        let rtx = db.read_tx();
+        let users = rtx.bucket(b"users").unwrap();
+        assert_eq!(users.get(b"alice"), Some(&b"admin"[..]));
+        assert_eq!(users.get(b"carol"), Some(&b"member"[..]));
+        let sessions = rtx.bucket(b"sessions").unwrap();
+        assert!(sessions.get(b"s1").is_none());
+        assert_eq!(sessions.get(b"s2"), Some(&b"bob"[..]));
+        assert_eq!(sessions.get(b"s3"), Some(&b"carol"[..]));
+        let audit = rtx.bucket(b"audit").unwrap();
+        assert_eq!(audit.get(b"001"), Some(&b"login"[..]));
+    }
+
+    // An invalid operation mid-batch rolls back the whole batch.
+    {
+        let mut wtx = db.write_tx();
+        let err = wtx
+            .batch()
+            .put(b"users", b"dave", b"member")
+            .delete(b"sessions", b"s2")
+            .put(b"missing", b"k", b"v")
+            .create_bucket(b"logs")
+            .apply()
+            .unwrap_err();
+        assert!(matches!(err, Error::BucketNotFound { .. }));
+        wtx.commit().expect("commit should succeed");
+    }
+
+    {
+        let rtx = db.read_tx();
+        let users = rtx.bucket(b"users").unwrap();
+        assert!(users.get(b"dave").is_none());
+        let sessions = rtx.bucket(b"sessions").unwrap();
+        assert_eq!(sessions.get(b"s2"), Some(&b"bob"[..]));
+        assert!(!rtx.bucket_exists(b"logs"));
+    }
+
+    cleanup(&path);
+}
+
+#[test]
+fn test_update_spans_buckets_atomically() {
+    let path = test_db_path("update_spans_buckets");
+    cleanup(&path);
+
+    let mut db = Database::open(&path).expect("open should succeed");
+    db.update(|wtx| {
+        wtx.create_bucket(b"users")?;
+        wtx.create_bucket(b"users_by_email")?;
+        wtx.bucket_put(b"users", b"alice", b"alice@example.com")?;
+        wtx.bucket_put(b"users_by_email", b"alice@example.com", b"alice")
+    })
+    .expect("update should succeed");
+
+    // Both buckets are written, then the closure fails before commit.
+    let err = db
+        .update(|wtx| {
+            wtx.bucket_put(b"users", b"alice", b"alice@example.org")?;
+            wtx.bucket_delete(b"users_by_email", b"alice@example.com")?;
+            wtx.bucket_put(b"users_by_email", b"alice@example.org", b"alice")?;
+            wtx.bucket_put(b"missing", b"k", b"v")
+        })
+        .unwrap_err();
+    assert!(matches!(err, Error::BucketNotFound { .. }));
+
+    let check = |db: &Database| {
+        let rtx = db.read_tx();
+        let users = rtx.bucket(b"users").unwrap();
+        assert_eq!(users.get(b"alice"), Some(&b"alice@example.com"[..]));
+        let by_email = rtx.bucket(b"users_by_email").unwrap();
+        assert_eq!(by_email.get(b"alice@example.com"), Some(&b"alice"[..]));
+        assert!(by_email.get(b"alice@example.org").is_none());
+    };
+    check(&db);
+    drop(db);
+    let db = Database::open(&path).expect("reopen should succeed");
+    check(&db);
+
+    drop(db);
+    cleanup(&path);
+}
+
+#[test]
+fn test_bucket_timestamps() {
+    let path = test_db_path("bucket_timestamps");
+    cleanup(&path);
+
+    let created_at;
+    let first_modified;
+    {
+        let mut db = Database::open(&path).expect("open should succeed");
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"cache").unwrap();
+        wtx.create_bucket(b"other").unwrap();
+        wtx.commit().expect("commit should succeed");
+
+        let rtx = db.read_tx();
+        let bucket = rtx.bucket(b"cache").unwrap();
+        created_at = bucket
+            .created_at()
+            .expect("bucket should have a creation time");
+        first_modified = bucket.modified_at().unwrap();
+        assert_eq!(created_at, first_modified);
+    }
+
+    std::thread::sleep(std::time::Duration::from_millis(10));
+
+    // Writing to one bucket only touches that bucket's modification time.
+    {
+        let mut db = Database::open(&path).expect("reopen should succeed");
+        let other_modified = db.read_tx().bucket(b"other").unwrap().modified_at();
+
+        let mut wtx = db.write_tx();
+        wtx.bucket_put(b"cache", b"k", b"v").unwrap();
+        wtx.commit().expect("commit should succeed");
+
+        let rtx = db.read_tx();
+        let bucket = rtx.bucket(b"cache").unwrap();
+        assert_eq!(bucket.created_at(), Some(created_at));
+        assert!(bucket.modified_at().unwrap() > first_modified);
+        assert_eq!(rtx.bucket(b"other").unwrap().modified_at(), other_modified);
+    }
+
+    // Both timestamps survive a reopen.
+    {
+        let db = Database::open(&path).expect("reopen should succeed");
+        let rtx = db.read_tx();
+        let bucket = rtx.bucket(b"cache").unwrap();
+        assert_eq!(bucket.created_at(), Some(created_at));
+        assert!(bucket.modified_at().unwrap() > first_modified);
+        assert_eq!(bucket.get(b"k"), Some(&b"v"[..]));
+    }
+
+    cleanup(&path);
+}
+
 // ==================== Iterator Tests ====================
 
 #[test]
@@ -1513,3 +1894,6764 @@ fn test_nested_bucket_persistence() {
 
     cleanup(&path);
 }
+
+// ==================== Value Checksum Tests ====================
+
+#[test]
+fn test_value_checksum_detects_on_disk_corruption() {
+    let path = test_db_path("value_checksums");
+    cleanup(&path);
+
+    let options = || DatabaseOptions {
+        value_checksums: true,
+        ..DatabaseOptions::default()
+    };
+    const VALUE: &[u8] = b"checksummed-value-0123456789";
+
+    {
+        let mut db = Database::open_with_options(&path, options()).expect("open should succeed");
+        let mut wtx = db.write_tx();
+        wtx.put(b"precious", VALUE);
+        wtx.put(b"intact", b"untouched");
+        wtx.create_bucket(b"bucket").unwrap();
+        wtx.bucket_put(b"bucket", b"inner", b"bucket-value")
+            .unwrap();
+        wtx.commit().expect("commit should succeed");
+        db.close().expect("close should succeed");
+    }
+
+    // Flip one byte of the stored value.
+    let mut bytes = fs::read(&path).unwrap();
+    let pos = bytes
+        .windows(VALUE.len())
+        .position(|w| w == VALUE)
+        .expect("value should be stored on disk");
+    bytes[pos + 5] ^= 0x01;
+    fs::write(&path, &bytes).unwrap();
+
+    let db = Database::open_with_options(&path, options()).expect("reopen should succeed");
+    let rtx = db.read_tx();
+
+    // A normal read silently returns the corrupted bytes.
+    let corrupted = rtx.get(b"precious").expect("key should exist");
+    assert_ne!(corrupted.as_slice(), VALUE);
+
+    // A checked read detects the corruption.
+    assert!(matches!(
+        rtx.get_checked(b"precious").unwrap_err(),
+        Error::ValueCorrupt { .. }
+    ));
+
+    // Untouched values still verify.
+    assert_eq!(rtx.get_checked(b"intact").unwrap(), Some(&b"untouched"[..]));
+    assert_eq!(
+        rtx.bucket_get_checked(b"bucket", b"inner").unwrap(),
+        Some(&b"bucket-value"[..])
+    );
+    assert_eq!(rtx.get_checked(b"missing").unwrap(), None);
+
+    cleanup(&path);
+}
+
+#[test]
+fn test_value_checksum_tracks_updates_and_deletes() {
+    let path = test_db_path("value_checksums_updates");
+    cleanup(&path);
+
+    let options = DatabaseOptions {
+        value_checksums: true,
+        ..DatabaseOptions::default()
+    };
+    let mut db = Database::open_with_options(&path, options).expect("open should succeed");
+
+    {
+        let mut wtx = db.write_tx();
+        wtx.put(b"key", b"v1");
+        wtx.commit().expect("commit should succeed");
+    }
+    {
+        let mut wtx = db.write_tx();
+        wtx.put(b"key", b"v2");
+        wtx.commit().expect("commit should succeed");
+    }
+    assert_eq!(db.read_tx().get_checked(b"key").unwrap(), Some(&b"v2"[..]));
+
+    {
+        let mut wtx = db.write_tx();
+        wtx.delete(b"key");
+        wtx.commit().expect("commit should succeed");
+    }
+    {
+        let mut wtx = db.write_tx();
+        wtx.put(b"key", b"v3");
+        wtx.commit().expect("commit should succeed");
+    }
+    assert_eq!(db.read_tx().get_checked(b"key").unwrap(), Some(&b"v3"[..]));
+
+    cleanup(&path);
+}
+
+#[test]
+fn test_value_checksum_skips_companion_entries() {
+    use std::time::Duration;
+    use thunderdb::bucket::bucket_data_key;
+    use thunderdb::checksum::checksum_key;
+    use thunderdb::expiry::expiry_key;
+
+    let path = test_db_path("value_checksums_companions");
+    cleanup(&path);
+
+    let options = DatabaseOptions {
+        value_checksums: true,
+        ..DatabaseOptions::default()
+    };
+    let mut db = Database::open_with_options(&path, options).expect("open should succeed");
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"sessions").unwrap();
+        wtx.bucket_put_with_ttl(b"sessions", b"token", b"session", Duration::from_secs(3600))
+            .unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let data_key = bucket_data_key(b"sessions", b"token");
+    let rtx = db.read_tx();
+    assert!(rtx.get(&checksum_key(&data_key)).is_some());
+    assert!(rtx.get(&checksum_key(&expiry_key(&data_key))).is_none());
+    drop(rtx);
+
+    cleanup(&path);
+}
+
+#[test]
+fn test_iter_skips_companion_entries() {
+    use std::time::Duration;
+    use thunderdb::bucket::{bucket_data_key, bucket_meta_key};
+
+    let path = test_db_path("iter_skips_companions");
+    cleanup(&path);
+
+    let options = DatabaseOptions {
+        value_checksums: true,
+        ..DatabaseOptions::default()
+    };
+    let mut db = Database::open_with_options(&path, options).expect("open should succeed");
+    {
+        let mut wtx = db.write_tx();
+        wtx.put(b"plain", b"value");
+        wtx.create_bucket(b"sessions").unwrap();
+        wtx.bucket_put_with_ttl(b"sessions", b"token", b"session", Duration::from_secs(3600))
+            .unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let expected = vec![
+        bucket_meta_key(b"sessions"),
+        bucket_data_key(b"sessions", b"token"),
+        b"plain".to_vec(),
+    ];
+    let rtx = db.read_tx();
+    let keys: Vec<Vec<u8>> = rtx.iter().map(|(k, _)| k.to_vec()).collect();
+    assert_eq!(keys, expected);
+    let keys: Vec<Vec<u8>> = rtx.range(..).map(|(k, _)| k.to_vec()).collect();
+    assert_eq!(keys, expected);
+    assert_eq!(rtx.iter().skip(2).count(), 1);
+    drop(rtx);
+
+    // Companions already on disk stay hidden with the option off.
+    drop(db);
+    let db = Database::open(&path).expect("reopen should succeed");
+    let rtx = db.read_tx();
+    let keys: Vec<Vec<u8>> = rtx.iter().map(|(k, _)| k.to_vec()).collect();
+    assert_eq!(keys, expected);
+
+    cleanup(&path);
+}
+
+// ==================== Key Normalization Tests ====================
+
+#[test]
+fn test_key_normalizer_case_insensitive_lookup() {
+    let path = test_db_path("key_normalizer");
+    cleanup(&path);
+
+    let options = || DatabaseOptions {
+        key_normalizer: Some(KeyNormalizer::ascii_lowercase()),
+        ..DatabaseOptions::default()
+    };
+
+    {
+        let mut db = Database::open_with_options(&path, options()).expect("open should succeed");
+        let mut wtx = db.write_tx();
+        wtx.put(b"Alice", b"admin");
+        wtx.put(b"bob", b"member");
+        wtx.commit().expect("commit should succeed");
+
+        let rtx = db.read_tx();
+        assert_eq!(rtx.get(b"Alice"), Some(b"admin".to_vec()));
+        assert_eq!(rtx.get(b"alice"), Some(b"admin".to_vec()));
+        assert_eq!(rtx.get(b"ALICE"), Some(b"admin".to_vec()));
+        assert_eq!(rtx.original_key(b"alice"), Some(b"Alice".to_vec()));
+    }
+
+    // Differently-cased writes address the same entry.
+    {
+        let mut db = Database::open_with_options(&path, options()).expect("reopen should succeed");
+        let mut wtx = db.write_tx();
+        wtx.put(b"ALICE", b"owner");
+        wtx.delete(b"BOB");
+        wtx.commit().expect("commit should succeed");
+
+        let rtx = db.read_tx();
+        assert_eq!(rtx.get(b"alice"), Some(b"owner".to_vec()));
+        assert_eq!(rtx.original_key(b"Alice"), Some(b"ALICE".to_vec()));
+        assert!(rtx.get(b"bob").is_none());
+        assert!(rtx.original_key(b"bob").is_none());
+
+        let user_keys: Vec<Vec<u8>> = rtx.iter().map(|(k, _)| k.to_vec()).collect();
+        assert_eq!(user_keys, vec![b"alice".to_vec()]);
+        assert_eq!(rtx.range(..).count(), 1);
+        assert_eq!(rtx.iter().skip(1).count(), 0);
+    }
+
+    cleanup(&path);
+}
+
+// ==================== Page Compression Tests ====================
+
+#[test]
+fn test_page_compression_small_keys() {
+    let path_plain = test_db_path("page_compression_off");
+    let path_lz = test_db_path("page_compression_on");
+    cleanup(&path_plain);
+    cleanup(&path_lz);
+
+    const NUM_KEYS: usize = 20_000;
+    let key = |i: usize| format!("user:{i:08}:profile").into_bytes();
+    let value = |i: usize| format!("{{\"active\":true,\"tier\":{}}}", i % 4).into_bytes();
+
+    for (path, compression) in [
+        (&path_plain, PageCompression::None),
+        (&path_lz, PageCompression::Lz),
+    ] {
+        let options = DatabaseOptions {
+            page_compression: compression,
+            ..DatabaseOptions::default()
+        };
+        let mut db = Database::open_with_options(path, options).expect("open should succeed");
+        let mut wtx = db.write_tx();
+        for i in 0..NUM_KEYS {
+            wtx.put(&key(i), &value(i));
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let plain_len = fs::metadata(&path_plain).unwrap().len();
+    let lz_len = fs::metadata(&path_lz).unwrap().len();
+    eprintln!("{NUM_KEYS} small keys: uncompressed {plain_len} bytes, compressed {lz_len} bytes");
+    assert!(
+        lz_len * 2 < plain_len,
+        "compressed file ({lz_len}) should be well under half of {plain_len}"
+    );
+
+    // Reopen without compression, mix in a full rewrite and a plain append.
+    {
+        let mut db = Database::open(&path_lz).expect("reopen should succeed");
+        for i in (0..NUM_KEYS).step_by(997) {
+            assert_eq!(db.read_tx().get(&key(i)), Some(value(i)));
+        }
+        let mut wtx = db.write_tx();
+        wtx.put(&key(0), b"updated");
+        wtx.delete(&key(1));
+        wtx.commit().expect("commit should succeed");
+        let mut wtx = db.write_tx();
+        wtx.put(b"appended", b"plain");
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let db = Database::open(&path_lz).expect("reopen should succeed");
+    let rtx = db.read_tx();
+    assert_eq!(rtx.iter().count(), NUM_KEYS);
+    assert_eq!(rtx.get(&key(0)), Some(b"updated".to_vec()));
+    assert!(rtx.get(&key(1)).is_none());
+    assert_eq!(rtx.get(&key(NUM_KEYS - 1)), Some(value(NUM_KEYS - 1)));
+    assert_eq!(rtx.get(b"appended"), Some(b"plain".to_vec()));
+
+    cleanup(&path_plain);
+    cleanup(&path_lz);
+}
+
+#[test]
+fn test_page_compression_with_overflow_values() {
+    let path = test_db_path("page_compression_overflow");
+    cleanup(&path);
+
+    let options = || DatabaseOptions {
+        page_compression: PageCompression::Lz,
+        ..DatabaseOptions::default()
+    };
+    let large = vec![7u8; 64 * 1024];
+    {
+        let mut db = Database::open_with_options(&path, options()).expect("open should succeed");
+        let mut wtx = db.write_tx();
+        for i in 0..100u32 {
+            wtx.put(&i.to_be_bytes(), b"small");
+        }
+        wtx.put(b"large", &large);
+        wtx.commit().expect("commit should succeed");
+
+        let mut wtx = db.write_tx();
+        wtx.put(b"later", b"small");
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let db = Database::open_with_options(&path, options()).expect("reopen should succeed");
+    let rtx = db.read_tx();
+    assert_eq!(rtx.get(b"large"), Some(large));
+    assert_eq!(rtx.get(&42u32.to_be_bytes()), Some(b"small".to_vec()));
+    assert_eq!(rtx.get(b"later"), Some(b"small".to_vec()));
+    assert_eq!(rtx.iter().count(), 102);
+
+    cleanup(&path);
+}
+
+// ==================== Value Compression Tests ====================
+
+#[test]
+fn test_value_compression_reopens_without_compression() {
+    use thunderdb::ValueCompression;
+
+    let path_plain = test_db_path("value_compression_off");
+    let path_lz = test_db_path("value_compression_on");
+    cleanup(&path_plain);
+    cleanup(&path_lz);
+
+    const NUM_DOCS: usize = 500;
+    let key = |i: usize| format!("doc:{i:05}").into_bytes();
+    let doc = |i: usize| {
+        format!(
+            "{{\"id\":{i},\"kind\":\"order\",\"items\":[{}],\"status\":\"shipped\"}}",
+            (0..20)
+                .map(|n| format!("{{\"sku\":\"item-{n}\",\"qty\":{}}}", n % 3))
+                .collect::<Vec<_>>()
+                .join(",")
+        )
+        .into_bytes()
+    };
+
+    for (path, compression) in [
+        (&path_plain, ValueCompression::None),
+        (&path_lz, ValueCompression::Lz),
+    ] {
+        let options = DatabaseOptions {
+            value_compression: compression,
+            ..DatabaseOptions::default()
+        };
+        let mut db = Database::open_with_options(path, options).expect("open should succeed");
+        // The second commit updates "note", so it rewrites the file.
+        for docs in [0..NUM_DOCS / 2, NUM_DOCS / 2..NUM_DOCS] {
+            let mut wtx = db.write_tx();
+            for i in docs {
+                wtx.put(&key(i), &doc(i));
+            }
+            wtx.put(b"note", b"too short to compress");
+            wtx.commit().expect("commit should succeed");
+        }
+    }
+
+    let plain_len = fs::metadata(&path_plain).unwrap().len();
+    let lz_len = fs::metadata(&path_lz).unwrap().len();
+    assert!(
+        lz_len * 3 < plain_len * 2,
+        "compressed file ({lz_len}) should be well under {plain_len}"
+    );
+
+    // Reopen with compression off and mix in plain writes.
+    {
+        let mut db = Database::open(&path_lz).expect("reopen should succeed");
+        assert!(db.check().is_empty());
+        assert!(db.allocation_map().is_ok());
+        for i in 0..NUM_DOCS {
+            assert_eq!(db.read_tx().get(&key(i)), Some(doc(i)));
+        }
+        assert_eq!(
+            db.read_tx().get(b"note"),
+            Some(b"too short to compress".to_vec())
+        );
+
+        let mut wtx = db.write_tx();
+        wtx.put(b"plain", &doc(0));
+        wtx.commit().expect("commit should succeed");
+        let mut wtx = db.write_tx();
+        wtx.put(&key(1), b"updated");
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let db = Database::open(&path_lz).expect("reopen should succeed");
+    let rtx = db.read_tx();
+    assert_eq!(rtx.iter().count(), NUM_DOCS + 2);
+    assert_eq!(rtx.get(&key(0)), Some(doc(0)));
+    assert_eq!(rtx.get(&key(1)), Some(b"updated".to_vec()));
+    assert_eq!(rtx.get(&key(NUM_DOCS - 1)), Some(doc(NUM_DOCS - 1)));
+    assert_eq!(rtx.get(b"plain"), Some(doc(0)));
+
+    cleanup(&path_plain);
+    cleanup(&path_lz);
+}
+
+#[test]
+fn test_snappy_and_zstd_reopen_without_compression() {
+    use thunderdb::ValueCompression;
+
+    let key = |i: usize| format!("doc:{i:05}").into_bytes();
+    let doc = |i: usize| format!("{{\"id\":{i},\"body\":\"{}\"}}", "lorem ipsum ".repeat(20));
+
+    let configs = [
+        (
+            "snappy_values",
+            PageCompression::None,
+            ValueCompression::Snappy,
+        ),
+        ("zstd_values", PageCompression::None, ValueCompression::Zstd),
+        (
+            "snappy_pages",
+            PageCompression::Snappy,
+            ValueCompression::None,
+        ),
+        ("zstd_pages", PageCompression::Zstd, ValueCompression::None),
+    ];
+    for (name, page_compression, value_compression) in configs {
+        let path = test_db_path(name);
+        cleanup(&path);
+
+        {
+            let options = DatabaseOptions {
+                page_compression,
+                value_compression,
+                ..DatabaseOptions::default()
+            };
+            let mut db = Database::open_with_options(&path, options).expect("open should succeed");
+            let mut wtx = db.write_tx();
+            for i in 0..200 {
+                wtx.put(&key(i), doc(i).as_bytes());
+            }
+            wtx.commit().expect("commit should succeed");
+        }
+        let plain_len = 200 * (4 + 9 + 4 + doc(0).len()) as u64;
+        let file_len = fs::metadata(&path).unwrap().len();
+        assert!(
+            file_len < plain_len,
+            "{name}: file ({file_len}) should be smaller than plain data ({plain_len})"
+        );
+
+        // Reopen with compression off, then write and reopen again.
+        {
+            let mut db = Database::open(&path).expect("reopen should succeed");
+            assert!(db.check().is_empty(), "{name}");
+            for i in 0..200 {
+                assert_eq!(
+                    db.read_tx().get(&key(i)),
+                    Some(doc(i).into_bytes()),
+                    "{name}"
+                );
+            }
+            let mut wtx = db.write_tx();
+            wtx.put(&key(0), b"updated");
+            wtx.commit().expect("commit should succeed");
+        }
+        let db = Database::open(&path).expect("reopen should succeed");
+        let rtx = db.read_tx();
+        assert_eq!(rtx.iter().count(), 200, "{name}");
+        assert_eq!(rtx.get(&key(0)), Some(b"updated".to_vec()), "{name}");
+        assert_eq!(rtx.get(&key(199)), Some(doc(199).into_bytes()), "{name}");
+
+        cleanup(&path);
+    }
+}
+
+// ==================== Encryption Tests ====================
+
+#[test]
+fn test_encryption_at_rest() {
+    use thunderdb::EncryptionKey;
+
+    let path = test_db_path("encryption");
+    let backup_path = test_db_path("encryption_backup");
+    cleanup(&path);
+    cleanup(&backup_path);
+
+    let options = |key: [u8; 32]| DatabaseOptions {
+        encryption_key: Some(EncryptionKey::new(key)),
+        ..DatabaseOptions::default()
+    };
+    let secret = b"top-secret-payload";
+    let large = secret.repeat(4096);
+    let contains_secret = |path: &str| {
+        fs::read(path)
+            .unwrap()
+            .windows(secret.len())
+            .any(|w| w == secret)
+    };
+
+    {
+        let mut db = Database::open_with_options(&path, options([1; 32])).expect("open");
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"docs").unwrap();
+        wtx.bucket_put(b"docs", b"small", secret).unwrap();
+        wtx.bucket_put(b"docs", b"large", &large).unwrap();
+        wtx.commit().expect("commit should succeed");
+        // An append, then a rewrite.
+        let mut wtx = db.write_tx();
+        wtx.bucket_put(b"docs", b"appended", secret).unwrap();
+        wtx.commit().expect("commit should succeed");
+        let mut wtx = db.write_tx();
+        wtx.bucket_delete(b"docs", b"appended").unwrap();
+        wtx.commit().expect("commit should succeed");
+
+        assert!(db.check().is_empty());
+        assert!(db.allocation_map().is_ok());
+        db.begin_backup()
+            .write_to_path(&backup_path)
+            .expect("backup should succeed");
+        db.compact().expect("compaction should succeed");
+        assert_eq!(
+            db.read_tx().bucket(b"docs").unwrap().get(b"large"),
+            Some(&large[..])
+        );
+    }
+    assert!(!contains_secret(&path));
+    assert!(!contains_secret(&backup_path));
+
+    // A wrong or missing key fails before any data is read.
+    for file in [&path, &backup_path] {
+        assert!(matches!(
+            Database::open_with_options(file, options([2; 32])),
+            Err(Error::InvalidKey { .. })
+        ));
+        assert!(matches!(
+            Database::open(file),
+            Err(Error::InvalidKey { .. })
+        ));
+
+        let db = Database::open_with_options(file, options([1; 32])).expect("reopen");
+        let rtx = db.read_tx();
+        let bucket = rtx.bucket(b"docs").unwrap();
+        assert_eq!(bucket.get(b"small"), Some(&secret[..]));
+        assert_eq!(bucket.get(b"large"), Some(&large[..]));
+        assert_eq!(bucket.get(b"appended"), None);
+    }
+
+    // Keys of the wrong length, keys for plain files, and the WAL are refused.
+    assert!(matches!(
+        EncryptionKey::from_slice(&[0; 16]),
+        Err(Error::InvalidKey { .. })
+    ));
+    let plain_path = test_db_path("encryption_plain");
+    cleanup(&plain_path);
+    drop(Database::open(&plain_path).expect("open"));
+    assert!(matches!(
+        Database::open_with_options(&plain_path, options([1; 32])),
+        Err(Error::InvalidKey { .. })
+    ));
+    let wal_options = DatabaseOptions {
+        wal_enabled: true,
+        ..options([1; 32])
+    };
+    assert!(matches!(
+        Database::open_with_options(&plain_path, wal_options),
+        Err(Error::EncryptionUnsupported { .. })
+    ));
+
+    cleanup(&path);
+    cleanup(&backup_path);
+    cleanup(&plain_path);
+}
+
+// ==================== Bulk Load Tests ====================
+
+/// Generates `count` entries with shuffled keys and some duplicates.
+fn shuffled_entries(count: usize) -> Vec<(Vec<u8>, Vec<u8>)> {
+    use rand::SeedableRng;
+    use rand::seq::SliceRandom;
+
+    let mut entries: Vec<(Vec<u8>, Vec<u8>)> = (0..count)
+        .map(|i| {
+            // Every tenth entry repeats an earlier key.
+            let k = if i % 10 == 9 { i / 2 } else { i };
+            (
+                format!("key_{k:08}").into_bytes(),
+                format!("value_{i}").into_bytes(),
+            )
+        })
+        .collect();
+    entries.shuffle(&mut rand::rngs::StdRng::seed_from_u64(42));
+    entries
+}
+
+#[test]
+fn test_bulk_load_unsorted_matches_reference() {
+    let path = test_db_path("bulk_load_unsorted");
+    cleanup(&path);
+
+    let entries = shuffled_entries(20_000);
+    let mut reference = std::collections::BTreeMap::new();
+    for (k, v) in &entries {
+        reference.insert(k.clone(), v.clone());
+    }
+
+    {
+        let mut db = Database::open(&path).expect("open should succeed");
+        // A small budget forces many spilled runs.
+        let options = BulkOptions::default().mem_budget(64 * 1024);
+        let loaded = db
+            .bulk_load_unsorted(b"import", entries, options)
+            .expect("bulk load should succeed");
+        assert_eq!(loaded, reference.len() as u64);
+    }
+
+    let db = Database::open(&path).expect("reopen should succeed");
+    let rtx = db.read_tx();
+    let bucket = rtx.bucket(b"import").unwrap();
+    let loaded: Vec<(Vec<u8>, Vec<u8>)> = bucket
+        .iter()
+        .map(|(k, v)| (k.to_vec(), v.to_vec()))
+        .collect();
+    assert_eq!(loaded, reference.into_iter().collect::<Vec<_>>());
+
+    // No temporary run files are left behind.
+    let dir = std::path::Path::new(&path).parent().unwrap();
+    let leftovers = fs::read_dir(dir)
+        .unwrap()
+        .filter_map(|e| e.ok())
+        .filter(|e| {
+            e.file_name()
+                .to_string_lossy()
+                .starts_with(".thunder-bulk-")
+        })
+        .count();
+    assert_eq!(leftovers, 0);
+
+    cleanup(&path);
+}
+
+#[test]
+fn test_bulk_load_unsorted_vs_put() {
+    let path_put = test_db_path("bulk_bench_put");
+    let path_bulk = test_db_path("bulk_bench_bulk");
+    cleanup(&path_put);
+    cleanup(&path_bulk);
+
+    const ENTRIES: usize = 100_000;
+    let entries = shuffled_entries(ENTRIES);
+
+    // Naive: one put per key in input order.
+    let mut db = Database::open(&path_put).expect("open should succeed");
+    let start = std::time::Instant::now();
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"import").unwrap();
+        for (k, v) in &entries {
+            wtx.bucket_put(b"import", k, v).unwrap();
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+    let put_duration = start.elapsed();
+
+    let mut db_bulk = Database::open(&path_bulk).expect("open should succeed");
+    let start = std::time::Instant::now();
+    db_bulk
+        .bulk_load_unsorted(
+            b"import",
+            entries,
+            BulkOptions::default().mem_budget(1 << 20),
+        )
+        .expect("bulk load should succeed");
+    let bulk_duration = start.elapsed();
+
+    eprintln!("{ENTRIES} unsorted entries: put {put_duration:?}, bulk load {bulk_duration:?}");
+    let count_put = db.read_tx().bucket(b"import").unwrap().iter().count();
+    let count_bulk = db_bulk.read_tx().bucket(b"import").unwrap().iter().count();
+    assert_eq!(count_put, count_bulk);
+
+    cleanup(&path_put);
+    cleanup(&path_bulk);
+}
+
+// ==================== Background Committer Tests ====================
+
+#[test]
+fn test_background_committer_concurrent_submissions() {
+    let path = test_db_path("committer_concurrent");
+    cleanup(&path);
+
+    const THREADS: usize = 8;
+    const PER_THREAD: usize = 50;
+
+    let db = Database::open(&path).expect("open should succeed");
+    let committer = BackgroundCommitter::start(db);
+
+    std::thread::scope(|s| {
+        for t in 0..THREADS {
+            let committer = &committer;
+            s.spawn(move || {
+                let pending: Vec<_> = (0..PER_THREAD)
+                    .map(|i| {
+                        let key = format!("t{t}_k{i:03}");
+                        committer.submit_update(move |wtx| {
+                            wtx.put(key.as_bytes(), b"value");
+                            Ok(())
+                        })
+                    })
+                    .collect();
+                for done in pending {
+                    done.recv().unwrap().expect("update should commit");
+                }
+            });
+        }
+    });
+
+    // A failing update is reported without affecting its neighbours.
+    let ok = committer.submit_update(|wtx| {
+        wtx.put(b"after", b"failure");
+        Ok(())
+    });
+    let failing = committer.submit_update(|wtx| wtx.bucket_put(b"missing", b"k", b"v"));
+    assert!(matches!(
+        failing.recv().unwrap().unwrap_err(),
+        Error::BucketNotFound { .. }
+    ));
+    ok.recv().unwrap().expect("update should commit");
+
+    let db = committer.shutdown();
+    drop(db);
+
+    let db = Database::open(&path).expect("reopen should succeed");
+    let rtx = db.read_tx();
+    for t in 0..THREADS {
+        for i in 0..PER_THREAD {
+            let key = format!("t{t}_k{i:03}");
+            assert_eq!(rtx.get(key.as_bytes()), Some(b"value".to_vec()));
+        }
+    }
+    assert_eq!(rtx.get(b"after"), Some(b"failure".to_vec()));
+
+    cleanup(&path);
+}
+
+#[test]
+fn test_background_committer_vs_sync_updates() {
+    let path_sync = test_db_path("committer_bench_sync");
+    let path_bg = test_db_path("committer_bench_bg");
+    cleanup(&path_sync);
+    cleanup(&path_bg);
+
+    const UPDATES: usize = 200;
+
+    // Synchronous: one commit (and fsync) per update.
+    let mut db = Database::open(&path_sync).expect("open should succeed");
+    let start = std::time::Instant::now();
+    for i in 0..UPDATES {
+        let mut wtx = db.write_tx();
+        wtx.put(format!("key_{i:05}").as_bytes(), b"value");
+        wtx.commit().expect("commit should succeed");
+    }
+    let sync_duration = start.elapsed();
+
+    // Background: submit everything, then wait for durability.
+    let committer = BackgroundCommitter::start(Database::open(&path_bg).unwrap());
+    let start = std::time::Instant::now();
+    let pending: Vec<_> = (0..UPDATES)
+        .map(|i| {
+            committer.submit_update(move |wtx| {
+                wtx.put(format!("key_{i:05}").as_bytes(), b"value");
+                Ok(())
+            })
+        })
+        .collect();
+    for done in pending {
+        done.recv().unwrap().expect("update should commit");
+    }
+    let bg_duration = start.elapsed();
+    let db_bg = committer.shutdown();
+
+    eprintln!("{UPDATES} updates: sync {sync_duration:?}, background {bg_duration:?}");
+    assert_eq!(db_bg.read_tx().iter().count(), UPDATES);
+    assert_eq!(db.read_tx().iter().count(), UPDATES);
+
+    cleanup(&path_sync);
+    cleanup(&path_bg);
+}
+
+#[test]
+fn test_background_committer_batch_isolates_failures() {
+    use std::time::Duration;
+    use thunderdb::CommitterConfig;
+
+    let path = test_db_path("committer_batch");
+    cleanup(&path);
+
+    const THREADS: usize = 12;
+
+    let mut db = Database::open(&path).expect("open should succeed");
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"events").unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+    let committer = BackgroundCommitter::start_with_config(
+        db,
+        CommitterConfig {
+            max_batch_size: 4,
+            max_batch_delay: Duration::from_millis(20),
+        },
+    );
+
+    let results: Vec<Result<(), Error>> = std::thread::scope(|s| {
+        let handles: Vec<_> = (0..THREADS)
+            .map(|t| {
+                let committer = &committer;
+                s.spawn(move || {
+                    committer.batch(move |wtx| match t {
+                        3 => panic!("update {t} panicked"),
+                        7 => wtx.bucket_put(b"missing", b"k", b"v"),
+                        _ => wtx.bucket_put(b"events", format!("e{t:02}").as_bytes(), b"v"),
+                    })
+                })
+            })
+            .collect();
+        handles.into_iter().map(|h| h.join().unwrap()).collect()
+    });
+
+    for (t, result) in results.iter().enumerate() {
+        match t {
+            3 => assert!(matches!(result, Err(Error::GroupCommitFailed { .. }))),
+            7 => assert!(matches!(result, Err(Error::BucketNotFound { .. }))),
+            _ => assert!(result.is_ok(), "update {t} failed: {result:?}"),
+        }
+    }
+
+    // The committer survives the panic.
+    committer
+        .batch(|wtx| wtx.bucket_put(b"events", b"last", b"v"))
+        .expect("batch should commit");
+
+    let db = committer.shutdown();
+    let rtx = db.read_tx();
+    let bucket = rtx.bucket(b"events").unwrap();
+    assert_eq!(bucket.iter().count(), THREADS - 2 + 1);
+    assert_eq!(bucket.get(b"e03"), None);
+    drop(rtx);
+    drop(db);
+    cleanup(&path);
+}
+
+#[test]
+fn test_nested_committer_update_returns_error() {
+    let path = test_db_path("committer_nested");
+    cleanup(&path);
+
+    let db = Database::open(&path).expect("open should succeed");
+    let committer = std::sync::Arc::new(BackgroundCommitter::start(db));
+
+    // A helper that commits through the committer, called from an update.
+    let helper = std::sync::Arc::clone(&committer);
+    let result = committer.batch(move |wtx| {
+        wtx.put(b"outer", b"v");
+        helper.batch(|wtx| {
+            wtx.put(b"inner", b"v");
+            Ok(())
+        })
+    });
+    assert!(matches!(result, Err(Error::NestedTransaction)));
+
+    // The committer keeps working, and neither update was applied.
+    committer
+        .batch(|wtx| {
+            wtx.put(b"after", b"v");
+            Ok(())
+        })
+        .expect("update should commit");
+    let db = std::sync::Arc::into_inner(committer)
+        .expect("no other handles remain")
+        .shutdown();
+    let rtx = db.read_tx();
+    assert_eq!(rtx.get(b"outer"), None);
+    assert_eq!(rtx.get(b"inner"), None);
+    assert_eq!(rtx.get(b"after"), Some(b"v".to_vec()));
+    drop(rtx);
+
+    drop(db);
+    cleanup(&path);
+}
+
+#[test]
+fn test_committer_runs_each_jobs_hooks_once() {
+    use std::sync::{Arc, Mutex};
+
+    let path = test_db_path("committer_hooks");
+    cleanup(&path);
+
+    let db = Database::open(&path).expect("open should succeed");
+    let committer = Arc::new(BackgroundCommitter::start(db));
+    let log = Arc::new(Mutex::new(Vec::new()));
+
+    // Failing jobs abort the shared transaction, so the others are retried
+    // in a new one; only the hooks of the attempt that decides count.
+    let handles: Vec<_> = (0..40u32)
+        .map(|i| {
+            let committer = Arc::clone(&committer);
+            let log = Arc::clone(&log);
+            std::thread::spawn(move || {
+                committer.batch(move |wtx| {
+                    wtx.put(&i.to_be_bytes(), b"v");
+                    let on_commit = Arc::clone(&log);
+                    wtx.on_commit(move || on_commit.lock().unwrap().push((i, true)));
+                    let on_rollback = Arc::clone(&log);
+                    wtx.on_rollback(move || on_rollback.lock().unwrap().push((i, false)));
+                    if i % 3 == 0 {
+                        return Err(Error::ReadOnly);
+                    }
+                    Ok(())
+                })
+            })
+        })
+        .collect();
+    for (i, handle) in handles.into_iter().enumerate() {
+        assert_eq!(handle.join().unwrap().is_ok(), i % 3 != 0, "job {i}");
+    }
+
+    let mut outcomes = std::mem::take(&mut *log.lock().unwrap());
+    outcomes.sort();
+    let expected: Vec<_> = (0..40u32).map(|i| (i, i % 3 != 0)).collect();
+    assert_eq!(outcomes, expected);
+
+    drop(committer);
+    cleanup(&path);
+}
+
+// ==================== Ensure Bucket Tests ====================
+
+#[test]
+fn test_ensure_bucket_seeds_once() {
+    use std::sync::atomic::{AtomicUsize, Ordering};
+    use std::sync::{Arc, Barrier, Mutex};
+    use std::thread;
+
+    fn seed_config(seeds: &AtomicUsize, bucket: &mut BucketMut<'_>) -> thunderdb::Result<()> {
+        seeds.fetch_add(1, Ordering::SeqCst);
+        bucket.put(b"version", b"1");
+        bucket.put(b"mode", b"primary");
+        Ok(())
+    }
+
+    // Threads sharing one handle.
+    let path = test_db_path("ensure_bucket_threads");
+    cleanup(&path);
+    let db = Arc::new(Mutex::new(
+        Database::open(&path).expect("open should succeed"),
+    ));
+    let seeds = Arc::new(AtomicUsize::new(0));
+    let created = Arc::new(AtomicUsize::new(0));
+    let barrier = Arc::new(Barrier::new(8));
+    let handles: Vec<_> = (0..8)
+        .map(|_| {
+            let (db, seeds, created, barrier) = (
+                Arc::clone(&db),
+                Arc::clone(&seeds),
+                Arc::clone(&created),
+                Arc::clone(&barrier),
+            );
+            thread::spawn(move || {
+                barrier.wait();
+                let mut db = db.lock().unwrap();
+                if db
+                    .ensure_bucket(b"config", |b| seed_config(&seeds, b))
+                    .expect("ensure_bucket should succeed")
+                {
+                    created.fetch_add(1, Ordering::SeqCst);
+                }
+            })
+        })
+        .collect();
+    for handle in handles {
+        handle.join().unwrap();
+    }
+    assert_eq!(seeds.load(Ordering::SeqCst), 1);
+    assert_eq!(created.load(Ordering::SeqCst), 1);
+    drop(db);
+    cleanup(&path);
+
+    // Separate handles on the same file, as separate processes would have.
+    let path = test_db_path("ensure_bucket_handles");
+    cleanup(&path);
+    let dbs: Vec<Database> = (0..4)
+        .map(|_| Database::open(&path).expect("open should succeed"))
+        .collect();
+    let seeds = Arc::new(AtomicUsize::new(0));
+    let barrier = Arc::new(Barrier::new(dbs.len()));
+    let handles: Vec<_> = dbs
+        .into_iter()
+        .map(|mut db| {
+            let (seeds, barrier) = (Arc::clone(&seeds), Arc::clone(&barrier));
+            thread::spawn(move || {
+                barrier.wait();
+                db.ensure_bucket(b"config", |b| seed_config(&seeds, b))
+                    .expect("ensure_bucket should succeed");
+                // Every handle sees the seeded bucket afterwards.
+                let rtx = db.read_tx();
+                let bucket = rtx.bucket(b"config").expect("bucket should exist");
+                assert_eq!(bucket.get(b"version"), Some(&b"1"[..]));
+            })
+        })
+        .collect();
+    for handle in handles {
+        handle.join().unwrap();
+    }
+    assert_eq!(seeds.load(Ordering::SeqCst), 1);
+
+    let db = Database::open(&path).expect("reopen should succeed");
+    let rtx = db.read_tx();
+    let bucket = rtx.bucket(b"config").expect("bucket should exist");
+    assert_eq!(bucket.get(b"version"), Some(&b"1"[..]));
+    assert_eq!(bucket.get(b"mode"), Some(&b"primary"[..]));
+    assert_eq!(bucket.iter().count(), 2);
+    drop(rtx);
+    drop(db);
+    cleanup(&path);
+}
+
+// ==================== Layout Introspection Tests ====================
+
+#[test]
+fn test_page_of_and_page_info() {
+    let path = test_db_path("page_of");
+    cleanup(&path);
+
+    let mut db = Database::open(&path).expect("open should succeed");
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"small").unwrap();
+        wtx.bucket_put(b"small", b"a", b"1").unwrap();
+        wtx.bucket_put(b"small", b"b", b"2").unwrap();
+        wtx.create_bucket(b"large").unwrap();
+        for i in 0..2000u32 {
+            wtx.bucket_put(b"large", &i.to_be_bytes(), &[0u8; 64])
+                .unwrap();
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let rtx = db.read_tx();
+    let (page_a, offset_a) = rtx.bucket_page_of(b"small", b"a").unwrap().unwrap();
+    let (page_b, offset_b) = rtx.bucket_page_of(b"small", b"b").unwrap().unwrap();
+    assert_eq!(page_a, page_b);
+    assert!(offset_a < offset_b);
+    assert_eq!(rtx.bucket_page_of(b"small", b"missing").unwrap(), None);
+    assert!(matches!(
+        rtx.bucket_page_of(b"nope", b"a"),
+        Err(Error::BucketNotFound { .. })
+    ));
+
+    // Keys adjacent in order are written next to each other.
+    let pages: Vec<u64> = (0..2000u32)
+        .map(|i| {
+            rtx.bucket_page_of(b"large", &i.to_be_bytes())
+                .unwrap()
+                .unwrap()
+                .0
+        })
+        .collect();
+    assert!(pages.windows(2).all(|w| w[0] <= w[1]));
+    let shared = pages.windows(2).filter(|w| w[0] == w[1]).count();
+    assert!(
+        shared * 10 >= pages.len() * 9,
+        "only {shared} neighbours share a page"
+    );
+    drop(rtx);
+
+    let info = db.page_info(page_a).unwrap().unwrap();
+    assert_eq!(info.page_type, PageType::Leaf);
+    assert!(info.key_count >= 2);
+    assert_eq!(db.page_info(0).unwrap().unwrap().page_type, PageType::Meta);
+    assert_eq!(db.page_info(u64::MAX / 2).unwrap(), None);
+
+    cleanup(&path);
+}
+
+// ==================== Version Retention Tests ====================
+
+#[test]
+fn test_retain_duration_as_of_reads() {
+    use std::time::{Duration, SystemTime};
+
+    let path = test_db_path("retain_duration");
+    cleanup(&path);
+
+    let options = DatabaseOptions {
+        retain_duration: Some(Duration::from_millis(300)),
+        ..DatabaseOptions::default()
+    };
+    let mut db = Database::open_with_options(&path, options).expect("open should succeed");
+    let before_writes = SystemTime::now();
+
+    let mut marks = Vec::new();
+    for version in 1..=3u8 {
+        std::thread::sleep(Duration::from_millis(20));
+        let mut wtx = db.write_tx();
+        wtx.put(b"config", &[version]);
+        wtx.commit().expect("commit should succeed");
+        marks.push(SystemTime::now());
+    }
+
+    // Every version inside the window is readable.
+    assert_eq!(db.get_as_of(b"config", before_writes).unwrap(), None);
+    for (i, mark) in marks.iter().enumerate() {
+        assert_eq!(
+            db.get_as_of(b"config", *mark).unwrap(),
+            Some(vec![i as u8 + 1])
+        );
+    }
+    let snapshot = db.view_as_of(marks[0]).unwrap();
+    assert_eq!(snapshot.get(b"config"), Some(vec![1]));
+
+    // Once the window has passed, older versions are collected.
+    std::thread::sleep(Duration::from_millis(400));
+    assert!(db.gc_versions() > 0);
+    assert!(matches!(
+        db.get_as_of(b"config", marks[0]),
+        Err(Error::VersionGced { .. })
+    ));
+    // The version current at the start of the window is still there.
+    assert_eq!(
+        db.get_as_of(b"config", SystemTime::now()).unwrap(),
+        Some(vec![3])
+    );
+    // The snapshot taken earlier keeps its own reference.
+    assert_eq!(snapshot.get(b"config"), Some(vec![1]));
+
+    cleanup(&path);
+}
+
+// ==================== Version Watch Tests ====================
+
+#[test]
+fn test_wait_for_version_unblocks_when_applied() {
+    use std::time::Duration;
+
+    let path = test_db_path("wait_for_version");
+    cleanup(&path);
+
+    let mut replica = Database::open(&path).expect("open should succeed");
+    let start = replica.version();
+    let target = start + 2;
+
+    let watch = replica.version_watch();
+    let waiter =
+        std::thread::spawn(move || watch.wait_for_version(target, Duration::from_secs(10)));
+
+    // The replica lags: one change applied is not enough.
+    let mut wtx = replica.write_tx();
+    wtx.put(b"k1", b"v1");
+    wtx.commit().expect("commit should succeed");
+    std::thread::sleep(Duration::from_millis(50));
+    assert!(!waiter.is_finished());
+
+    let mut wtx = replica.write_tx();
+    wtx.put(b"k2", b"v2");
+    wtx.commit().expect("commit should succeed");
+    assert_eq!(replica.version(), target);
+    assert_eq!(waiter.join().unwrap().unwrap(), target);
+
+    // Waiting for a version the replica never reaches times out.
+    assert!(matches!(
+        replica
+            .version_watch()
+            .wait_for_version(target + 1, Duration::from_millis(10)),
+        Err(Error::WaitTimedOut { .. })
+    ));
+
+    cleanup(&path);
+}
+
+// ==================== Explicit Version Tests ====================
+
+#[test]
+fn test_update_with_version_replays_history() {
+    use std::time::Duration;
+    use thunderdb::WriteTx;
+
+    let source_path = test_db_path("versioned_source");
+    let replay_path = test_db_path("versioned_replay");
+    cleanup(&source_path);
+    cleanup(&replay_path);
+
+    type Ops = Vec<(Vec<u8>, Option<Vec<u8>>)>;
+    fn apply(wtx: &mut WriteTx<'_>, ops: &Ops) -> thunderdb::Result<()> {
+        for (key, value) in ops {
+            match value {
+                Some(value) => wtx.put(key, value),
+                None => wtx.delete(key),
+            }
+        }
+        // An already expired entry, so every commit after this one is due
+        // an expiry purge.
+        if !wtx.bucket_exists(b"ttl") {
+            wtx.create_bucket(b"ttl")?;
+            wtx.bucket_put_with_ttl(b"ttl", b"gone", b"v", Duration::ZERO)?;
+        }
+        Ok(())
+    }
+
+    // Record (version, ops) for each commit to the source.
+    let mut log: Vec<(u64, Ops)> = Vec::new();
+    let mut source = Database::open(&source_path).expect("open should succeed");
+    for round in 0..6u8 {
+        let ops: Ops = vec![
+            (vec![round], Some(vec![round; 4])),
+            (vec![round, 1], Some(vec![round])),
+            (vec![round.saturating_sub(1), 1], None),
+        ];
+        source
+            .update(|wtx| apply(wtx, &ops))
+            .expect("update should succeed");
+        log.push((source.version(), ops));
+        // Leave gaps so replayed versions are clearly not auto-assigned.
+        if round == 2 {
+            source
+                .update(|_| Ok(()))
+                .expect("empty update should succeed");
+        }
+    }
+
+    // The replica runs the maintenance that commits on its own, and is
+    // reopened partway through the replay.
+    let options = || DatabaseOptions {
+        expiry_interval: Some(Duration::ZERO),
+        auto_compaction: Some(AutoCompactionConfig {
+            check_interval: 1,
+            high_threshold: 0.0,
+            normal_threshold: 0.0,
+            low_threshold: 0.0,
+        }),
+        ..DatabaseOptions::default()
+    };
+    let mut replay =
+        Database::open_with_options(&replay_path, options()).expect("open should succeed");
+    for (i, (version, ops)) in log.iter().enumerate() {
+        if i == 3 {
+            replay.close().expect("close should succeed");
+            replay = Database::open_with_options(&replay_path, options())
+                .expect("reopen should succeed");
+            assert_eq!(replay.version(), log[2].0);
+        }
+        replay
+            .update_with_version(*version, |wtx| apply(wtx, ops))
+            .expect("replay should succeed");
+        assert_eq!(replay.version(), *version);
+    }
+
+    let expected: Vec<_> = source
+        .read_tx()
+        .iter()
+        .map(|(k, v)| (k.to_vec(), v.to_vec()))
+        .collect();
+    let actual: Vec<_> = replay
+        .read_tx()
+        .iter()
+        .map(|(k, v)| (k.to_vec(), v.to_vec()))
+        .collect();
+    assert_eq!(actual, expected);
+
+    // Versions may not go backwards, and a failed update changes nothing.
+    let last = replay.version();
+    assert!(matches!(
+        replay.update_with_version(last, |_| Ok(())),
+        Err(Error::VersionRegression { .. })
+    ));
+    assert!(
+        replay
+            .update_with_version(last + 10, |_| Err(Error::KeyNotFound))
+            .is_err()
+    );
+    assert_eq!(replay.version(), last);
+
+    // An ordinary commit runs the maintenance the replay held back, which
+    // commits versions of its own.
+    replay
+        .update(|wtx| {
+            wtx.put(b"after", b"replay");
+            Ok(())
+        })
+        .expect("update should succeed");
+    assert!(replay.version() > last + 1);
+
+    drop(source);
+    drop(replay);
+    cleanup(&source_path);
+    cleanup(&replay_path);
+}
+
+// ==================== Audit Log Tests ====================
+
+/// Audit sink capturing records in memory.
+#[derive(Clone, Default)]
+struct CapturedAudit(std::sync::Arc<std::sync::Mutex<Vec<u8>>>);
+
+impl std::io::Write for CapturedAudit {
+    fn write(&mut self, buf: &[u8]) -> std::io::Result<usize> {
+        self.0.lock().unwrap().extend_from_slice(buf);
+        Ok(buf.len())
+    }
+
+    fn flush(&mut self) -> std::io::Result<()> {
+        Ok(())
+    }
+}
+
+#[test]
+fn test_audit_writer_records_committed_ops() {
+    let path = test_db_path("audit_writer");
+    cleanup(&path);
+
+    let captured = CapturedAudit::default();
+    let options = DatabaseOptions {
+        audit_writer: Some(AuditWriter::new(captured.clone())),
+        ..DatabaseOptions::default()
+    };
+    let mut db = Database::open_with_options(&path, options).expect("open should succeed");
+    let put = |bucket: &[&[u8]], key: &[u8], value: &[u8]| AuditOp::Put {
+        bucket: bucket.iter().map(|b| b.to_vec()).collect(),
+        key: key.to_vec(),
+        value: value.to_vec(),
+    };
+    let delete = |bucket: &[&[u8]], key: &[u8]| AuditOp::Delete {
+        bucket: bucket.iter().map(|b| b.to_vec()).collect(),
+        key: key.to_vec(),
+    };
+
+    let mut expected = Vec::new();
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"users").unwrap();
+        wtx.bucket_put(b"users", b"bob", b"2").unwrap();
+        wtx.bucket_put(b"users", b"alice", b"1").unwrap();
+        wtx.put(b"config", b"on");
+        wtx.commit().expect("commit should succeed");
+    }
+    expected.push((
+        db.version(),
+        vec![
+            put(&[b"users"], b"alice", b"1"),
+            put(&[b"users"], b"bob", b"2"),
+            put(&[], b"config", b"on"),
+        ],
+    ));
+
+    // Rolled back and dropped transactions leave no record.
+    {
+        let mut wtx = db.write_tx();
+        wtx.put(b"discarded", b"x");
+        wtx.rollback();
+    }
+    {
+        let mut wtx = db.write_tx();
+        wtx.bucket_delete(b"users", b"bob").unwrap();
+        drop(wtx);
+    }
+
+    {
+        let mut wtx = db.write_tx();
+        wtx.bucket_delete(b"users", b"bob").unwrap();
+        wtx.delete(b"config");
+        wtx.bucket_put(b"users", b"alice", b"3").unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+    expected.push((
+        db.version(),
+        vec![
+            delete(&[b"users"], b"bob"),
+            delete(&[], b"config"),
+            put(&[b"users"], b"alice", b"3"),
+        ],
+    ));
+
+    let stream = captured.0.lock().unwrap().clone();
+    let records = AuditRecord::decode_all(&stream).expect("stream should decode");
+    let actual: Vec<_> = records.into_iter().map(|r| (r.version, r.ops)).collect();
+    assert_eq!(actual, expected);
+
+    drop(db);
+    cleanup(&path);
+}
+
+#[test]
+fn test_audit_write_failure_aborts_commit() {
+    struct FailingSink;
+
+    impl std::io::Write for FailingSink {
+        fn write(&mut self, _: &[u8]) -> std::io::Result<usize> {
+            Err(std::io::Error::other("sink unavailable"))
+        }
+
+        fn flush(&mut self) -> std::io::Result<()> {
+            Ok(())
+        }
+    }
+
+    let path = test_db_path("audit_write_failure");
+    cleanup(&path);
+
+    let options = DatabaseOptions {
+        audit_writer: Some(AuditWriter::new(FailingSink)),
+        ..DatabaseOptions::default()
+    };
+    let mut db = Database::open_with_options(&path, options).expect("open should succeed");
+    let version = db.version();
+
+    let mut wtx = db.write_tx();
+    wtx.put(b"key", b"value");
+    assert!(matches!(wtx.commit(), Err(Error::AuditWrite { .. })));
+    assert_eq!(db.version(), version);
+    assert_eq!(db.read_tx().get(b"key"), None);
+
+    drop(db);
+    cleanup(&path);
+}
+
+// ==================== Bucket Key Limit Tests ====================
+
+#[test]
+fn test_bucket_max_keys_evicts_per_policy() {
+    let path = test_db_path("bucket_max_keys");
+    cleanup(&path);
+
+    let mut db = Database::open(&path).expect("open should succeed");
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"fifo").unwrap();
+        wtx.create_bucket(b"smallest").unwrap();
+        wtx.set_bucket_max_keys(b"fifo", 3, EvictionPolicy::OldestInserted)
+            .unwrap();
+        wtx.set_bucket_max_keys(b"smallest", 3, EvictionPolicy::SmallestKey)
+            .unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+
+    // Insert in descending key order so the two policies disagree.
+    for key in [b"e", b"d", b"c", b"b"] {
+        let mut wtx = db.write_tx();
+        wtx.bucket_put(b"fifo", key, b"1").unwrap();
+        wtx.bucket_put(b"smallest", key, b"1").unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+    // Overwriting keeps the original insertion position.
+    {
+        let mut wtx = db.write_tx();
+        wtx.bucket_put(b"fifo", b"d", b"2").unwrap();
+        wtx.bucket_put(b"fifo", b"a", b"1").unwrap();
+        wtx.bucket_put(b"smallest", b"z", b"1").unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let keys = |db: &Database, name: &[u8]| -> Vec<Vec<u8>> {
+        let rtx = db.read_tx();
+        let bucket = rtx.bucket(name).unwrap();
+        bucket.iter().map(|(k, _)| k.to_vec()).collect()
+    };
+    assert_eq!(
+        keys(&db, b"fifo"),
+        [b"a".to_vec(), b"b".to_vec(), b"c".to_vec()]
+    );
+    assert_eq!(
+        keys(&db, b"smallest"),
+        [b"d".to_vec(), b"e".to_vec(), b"z".to_vec()]
+    );
+
+    // The limit and insertion order survive a reopen.
+    drop(db);
+    let mut db = Database::open(&path).expect("reopen should succeed");
+    assert_eq!(
+        db.read_tx().bucket(b"fifo").unwrap().key_limit(),
+        Some(KeyLimit {
+            max_keys: 3,
+            policy: EvictionPolicy::OldestInserted,
+        })
+    );
+    {
+        let mut wtx = db.write_tx();
+        wtx.bucket_delete(b"fifo", b"b").unwrap();
+        wtx.bucket_put(b"fifo", b"x", b"1").unwrap();
+        wtx.bucket_put(b"fifo", b"y", b"1").unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+    assert_eq!(
+        keys(&db, b"fifo"),
+        [b"a".to_vec(), b"x".to_vec(), b"y".to_vec()]
+    );
+
+    // Lowering the limit evicts immediately; clearing it stops eviction.
+    {
+        let mut wtx = db.write_tx();
+        wtx.set_bucket_max_keys(b"smallest", 1, EvictionPolicy::SmallestKey)
+            .unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+    assert_eq!(keys(&db, b"smallest"), [b"z".to_vec()]);
+    {
+        let mut wtx = db.write_tx();
+        wtx.clear_bucket_max_keys(b"fifo").unwrap();
+        for key in [b"p", b"q", b"r"] {
+            wtx.bucket_put(b"fifo", key, b"1").unwrap();
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+    assert_eq!(keys(&db, b"fifo").len(), 6);
+    assert_eq!(db.read_tx().bucket(b"fifo").unwrap().key_limit(), None);
+
+    drop(db);
+    cleanup(&path);
+}
+
+// ==================== Online Compaction Tests ====================
+
+#[test]
+fn test_reads_continue_during_compaction() {
+    use std::sync::atomic::{AtomicBool, AtomicUsize, Ordering};
+    use std::time::{Duration, Instant};
+
+    let path = test_db_path("online_compaction");
+    cleanup(&path);
+
+    let mut db = Database::open(&path).expect("open should succeed");
+    let value_of = |i: u32| format!("value_{i}").into_bytes();
+    {
+        let mut wtx = db.write_tx();
+        for i in 0..5000u32 {
+            wtx.put(&i.to_be_bytes(), &value_of(i));
+        }
+        // Large values leave overflow pages behind once deleted.
+        for i in 0..64u32 {
+            wtx.put(format!("big_{i}").as_bytes(), &vec![7u8; 64 * 1024]);
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+    {
+        let mut wtx = db.write_tx();
+        for i in 0..64u32 {
+            wtx.delete(format!("big_{i}").as_bytes());
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+    let size_before = fs::metadata(&path).unwrap().len();
+    let version = db.version();
+    let before_swap = db.snapshot();
+
+    let mut compaction = db.begin_compaction();
+    let done = AtomicBool::new(false);
+    let reads = AtomicUsize::new(0);
+    std::thread::scope(|s| {
+        for t in 0..4u32 {
+            let (db, done, reads) = (&db, &done, &reads);
+            s.spawn(move || {
+                let mut i = t;
+                let mut slowest = Duration::ZERO;
+                while !done.load(Ordering::Acquire) {
+                    let started = Instant::now();
+                    let rtx = db.read_tx();
+                    let key = (i % 5000).to_be_bytes();
+                    assert_eq!(rtx.get(&key), Some(value_of(i % 5000)));
+                    assert_eq!(rtx.get(b"big_0"), None);
+                    slowest = slowest.max(started.elapsed());
+                    reads.fetch_add(1, Ordering::Relaxed);
+                    i = i.wrapping_add(7919);
+                }
+                assert!(
+                    slowest < Duration::from_secs(1),
+                    "read stalled for {slowest:?}"
+                );
+            });
+        }
+        // Let readers get going before compacting.
+        while reads.load(Ordering::Relaxed) < 100 {
+            std::thread::yield_now();
+        }
+        compaction.run().expect("compaction should succeed");
+        done.store(true, Ordering::Release);
+    });
+    assert!(reads.load(Ordering::Relaxed) >= 100);
+
+    db.finish_compaction(compaction)
+        .expect("swap should succeed");
+    assert_eq!(db.version(), version);
+    assert!(fs::metadata(&path).unwrap().len() < size_before);
+    assert_eq!(before_swap.get(&42u32.to_be_bytes()), Some(value_of(42)));
+
+    // The compacted file is live for new transactions and survives reopen.
+    {
+        let mut wtx = db.write_tx();
+        wtx.put(b"after", b"compaction");
+        wtx.commit().expect("commit should succeed");
+    }
+    drop(db);
+    let db = Database::open(&path).expect("reopen should succeed");
+    let rtx = db.read_tx();
+    assert_eq!(rtx.get(b"after"), Some(b"compaction".to_vec()));
+    for i in 0..5000u32 {
+        assert_eq!(rtx.get(&i.to_be_bytes()), Some(value_of(i)));
+    }
+    drop(rtx);
+    drop(db);
+    cleanup(&path);
+}
+
+#[test]
+fn test_compaction_stale_after_commit() {
+    let path = test_db_path("compaction_stale");
+    cleanup(&path);
+
+    let mut db = Database::open(&path).expect("open should succeed");
+    {
+        let mut wtx = db.write_tx();
+        wtx.put(b"a", b"1");
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let mut compaction = db.begin_compaction();
+    compaction.run().expect("compaction should succeed");
+    let side_path = compaction.side_path().to_path_buf();
+    assert!(side_path.exists());
+    {
+        let mut wtx = db.write_tx();
+        wtx.put(b"b", b"2");
+        wtx.commit().expect("commit should succeed");
+    }
+
+    assert!(matches!(
+        db.finish_compaction(compaction),
+        Err(Error::CompactionStale { .. })
+    ));
+    assert!(!side_path.exists());
+    assert_eq!(db.read_tx().get(b"b"), Some(b"2".to_vec()));
+
+    db.compact().expect("retry should succeed");
+    drop(db);
+    let db = Database::open(&path).expect("reopen should succeed");
+    assert_eq!(db.read_tx().get(b"a"), Some(b"1".to_vec()));
+    assert_eq!(db.read_tx().get(b"b"), Some(b"2".to_vec()));
+
+    drop(db);
+    cleanup(&path);
+}
+
+// ==================== Multi-Bucket Get Tests ====================
+
+#[test]
+fn test_multi_bucket_get_preserves_order() {
+    let path = test_db_path("multi_bucket_get");
+    cleanup(&path);
+
+    let mut db = Database::open(&path).expect("open should succeed");
+    {
+        let mut wtx = db.write_tx();
+        for name in [&b"users"[..], b"orders", b"sessions"] {
+            wtx.create_bucket(name).unwrap();
+            for i in 0..3u8 {
+                let value = [name, b":", &[b'0' + i]].concat();
+                wtx.bucket_put(name, &[b'k', b'0' + i], &value).unwrap();
+            }
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let rtx = db.read_tx();
+    let values = rtx
+        .multi_bucket_get(&[
+            (b"orders", b"k2"),
+            (b"users", b"k0"),
+            (b"orders", b"missing"),
+            (b"sessions", b"k1"),
+            (b"users", b"k2"),
+            (b"sessions", b"k9"),
+        ])
+        .expect("multi get should succeed");
+    assert_eq!(
+        values,
+        vec![
+            Some(&b"orders:2"[..]),
+            Some(&b"users:0"[..]),
+            None,
+            Some(&b"sessions:1"[..]),
+            Some(&b"users:2"[..]),
+            None,
+        ]
+    );
+    assert!(
+        rtx.multi_bucket_get(&[(b"users", b"k0"), (b"nope", b"k0")])
+            .is_err()
+    );
+    assert!(rtx.multi_bucket_get(&[]).unwrap().is_empty());
+
+    drop(rtx);
+    drop(db);
+    cleanup(&path);
+}
+
+#[test]
+fn test_bucket_get_many_preserves_order() {
+    use std::time::Duration;
+
+    let path = test_db_path("bucket_get_many");
+    cleanup(&path);
+
+    let mut db = Database::open(&path).expect("open should succeed");
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"users").unwrap();
+        wtx.set_bucket_bloom(b"users", 10).unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+    {
+        let mut wtx = db.write_tx();
+        for i in (0..4000u32).step_by(2) {
+            wtx.bucket_put(b"users", format!("user_{i:05}").as_bytes(), b"v")
+                .unwrap();
+        }
+        wtx.bucket_put_with_ttl(b"users", b"expired", b"gone", Duration::ZERO)
+            .unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+
+    // Unsorted probes with hits, misses, repeats, and an expired key.
+    let mut keys: Vec<Vec<u8>> = (0..2000u32)
+        .map(|i| format!("user_{:05}", (i * 7919) % 4000).into_bytes())
+        .collect();
+    keys.extend([
+        b"user_00002".to_vec(),
+        b"expired".to_vec(),
+        b"absent".to_vec(),
+    ]);
+
+    let rtx = db.read_tx();
+    let bucket = rtx.bucket(b"users").unwrap();
+    let values = bucket.get_many(&keys);
+    let expected: Vec<_> = keys.iter().map(|key| bucket.get(key)).collect();
+    assert_eq!(values, expected);
+    assert_eq!(values.iter().filter(|v| v.is_some()).count(), 1001);
+    assert!(bucket.get_many::<&[u8]>(&[]).is_empty());
+
+    drop(rtx);
+    drop(db);
+    cleanup(&path);
+}
+
+// ==================== Compaction Priority Tests ====================
+
+#[test]
+fn test_auto_compaction_schedules_high_priority_first() {
+    let path = test_db_path("compaction_priority");
+    cleanup(&path);
+
+    let config = AutoCompactionConfig {
+        check_interval: 3,
+        high_threshold: 0.25,
+        normal_threshold: 0.5,
+        low_threshold: 0.35,
+    };
+    let options = || DatabaseOptions {
+        auto_compaction: Some(config),
+        ..DatabaseOptions::default()
+    };
+    let mut db = Database::open_with_options(&path, options()).expect("open should succeed");
+    let mut next_key = 0u32;
+    let mut churn = |db: &mut Database, buckets: &[(&[u8], u32)]| {
+        let mut wtx = db.write_tx();
+        for &(name, count) in buckets {
+            for _ in 0..count {
+                next_key += 1;
+                wtx.bucket_put(name, &next_key.to_be_bytes(), b"v").unwrap();
+            }
+        }
+        wtx.commit().expect("commit should succeed");
+    };
+
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"hot").unwrap();
+        wtx.create_bucket(b"cold").unwrap();
+        wtx.set_bucket_compaction_priority(b"hot", CompactionPriority::High)
+            .unwrap();
+        wtx.set_bucket_compaction_priority(b"cold", CompactionPriority::Low)
+            .unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+
+    // Both buckets fragment; the cold one more so, but hot is scheduled first.
+    churn(&mut db, &[(b"hot", 2), (b"cold", 1)]);
+    assert!(db.last_auto_compaction().is_none());
+    let before: Vec<_> = db.fragmentation().unwrap();
+    assert!(before.iter().all(|f| f.dead_entries > 0));
+    churn(&mut db, &[(b"hot", 2), (b"cold", 1)]);
+
+    let compaction = db.last_auto_compaction().expect("should have compacted");
+    let order: Vec<_> = compaction.buckets.iter().map(|f| f.name.clone()).collect();
+    assert_eq!(order, [b"hot".to_vec(), b"cold".to_vec()]);
+    assert!(compaction.buckets[1].ratio() > compaction.buckets[0].ratio());
+    let compacted_version = compaction.version;
+    assert!(
+        db.fragmentation()
+            .unwrap()
+            .iter()
+            .all(|f| f.dead_entries == 0)
+    );
+
+    // The cold bucket alone is left alone at a fragmentation that would
+    // trigger compaction for a high-priority bucket.
+    for _ in 0..3 {
+        churn(&mut db, &[(b"cold", 1)]);
+    }
+    let cold = db
+        .fragmentation()
+        .unwrap()
+        .into_iter()
+        .find(|f| f.name == b"cold")
+        .unwrap();
+    assert!(cold.ratio() >= config.high_threshold);
+    assert!(cold.ratio() < config.low_threshold);
+    assert_eq!(
+        db.last_auto_compaction().unwrap().version,
+        compacted_version
+    );
+
+    // Priorities persist and the data survived compaction.
+    drop(db);
+    let db = Database::open_with_options(&path, options()).expect("reopen should succeed");
+    let rtx = db.read_tx();
+    assert_eq!(
+        rtx.bucket(b"hot").unwrap().compaction_priority(),
+        CompactionPriority::High
+    );
+    assert_eq!(
+        rtx.bucket(b"cold").unwrap().compaction_priority(),
+        CompactionPriority::Low
+    );
+    assert_eq!(rtx.bucket(b"hot").unwrap().iter().count(), 4);
+    assert_eq!(rtx.bucket(b"cold").unwrap().iter().count(), 5);
+    drop(rtx);
+    drop(db);
+    cleanup(&path);
+}
+
+// ==================== Stats Tests ====================
+
+/// Reads the numeric field `field` of the stats published as `name`.
+fn published_stat(json: &str, name: &str, field: &str) -> f64 {
+    let object = &json[json
+        .find(&format!("\"{name}\":{{"))
+        .expect("stats should be published")..];
+    let start = object
+        .find(&format!("\"{field}\":"))
+        .expect("field should exist")
+        + field.len()
+        + 3;
+    let len = object[start..]
+        .find([',', '}'])
+        .expect("value should be terminated");
+    object[start..start + len]
+        .parse()
+        .expect("value should be a number")
+}
+
+#[test]
+fn test_published_stats_reflect_workload() {
+    let path = test_db_path("published_stats");
+    cleanup(&path);
+
+    let mut db = Database::open(&path).expect("open should succeed");
+    db.publish_stats("integration_published_stats")
+        .expect("publish should succeed");
+    assert!(matches!(
+        db.publish_stats("integration_published_stats"),
+        Err(Error::StatsNameTaken { .. })
+    ));
+
+    for i in 0..3u32 {
+        let mut wtx = db.write_tx();
+        wtx.put(&i.to_be_bytes(), b"value");
+        wtx.commit().expect("commit should succeed");
+    }
+    db.write_tx().rollback();
+    {
+        let rtx = db.read_tx();
+        assert!(rtx.get(&1u32.to_be_bytes()).is_some());
+        for i in 100..110u32 {
+            assert!(rtx.get(&i.to_be_bytes()).is_none());
+        }
+    }
+    let _ = db.read_tx();
+
+    // Scraping renders current values without any export step.
+    let json = thunderdb::stats::published_json();
+    let stat = |field| published_stat(&json, "integration_published_stats", field);
+    assert_eq!(stat("write_txs"), 4.0);
+    assert_eq!(stat("commits"), 3.0);
+    assert_eq!(stat("failed_commits"), 0.0);
+    assert_eq!(stat("read_txs"), 2.0);
+    assert_eq!(stat("lookups"), 11.0);
+    assert_eq!(stat("entries"), 3.0);
+    assert_eq!(stat("version"), db.version() as f64);
+    assert_eq!(stat("file_size"), fs::metadata(&path).unwrap().len() as f64);
+    assert!(stat("bloom_rejections") >= 1.0);
+    assert!(json.contains("\"commit_latency_us\":{\"p50\":"));
+
+    let stats: DatabaseStats = db.stats();
+    assert_eq!(stats.commits, 3);
+    assert!(stats.commit_latency.p50 <= stats.commit_latency.p99);
+    assert!(stats.commit_latency.p99 <= stats.commit_latency.max);
+    assert!(stats.commit_latency.max > std::time::Duration::ZERO);
+    assert_eq!(stat("commits"), 3.0);
+
+    let mut wtx = db.write_tx();
+    wtx.put(b"later", b"value");
+    wtx.commit().expect("commit should succeed");
+    let json = thunderdb::stats::published_json();
+    assert_eq!(
+        published_stat(&json, "integration_published_stats", "commits"),
+        4.0
+    );
+
+    assert!(thunderdb::stats::unpublish("integration_published_stats"));
+    assert!(thunderdb::stats::published("integration_published_stats").is_none());
+    drop(db);
+    cleanup(&path);
+}
+
+#[test]
+fn test_published_stats_prometheus_scrape() {
+    let path = test_db_path("published_stats_prometheus");
+    cleanup(&path);
+
+    let mut db = Database::open(&path).expect("open should succeed");
+    db.publish_stats("integration_prometheus")
+        .expect("publish should succeed");
+    for i in 0..2u32 {
+        let mut wtx = db.write_tx();
+        wtx.put(&i.to_be_bytes(), b"value");
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let text = thunderdb::stats::published_prometheus();
+    for name in [
+        "thunderdb_read_txs_total",
+        "thunderdb_write_txs_total",
+        "thunderdb_commits_total",
+        "thunderdb_failed_commits_total",
+        "thunderdb_commit_latency_seconds",
+        "thunderdb_free_pages",
+        "thunderdb_lookups_total",
+        "thunderdb_bloom_rejections_total",
+        "thunderdb_written_bytes_total",
+        "thunderdb_read_bytes_total",
+        "thunderdb_file_size_bytes",
+    ] {
+        assert!(text.contains(&format!("# TYPE {name} ")), "{name} missing");
+    }
+    assert!(text.contains("thunderdb_commits_total{db=\"integration_prometheus\"} 2\n"));
+    assert!(text.contains(
+        "thunderdb_commit_latency_seconds{db=\"integration_prometheus\",quantile=\"0.99\"} "
+    ));
+    // Every sample line is a name, optional labels and a number.
+    for line in text.lines().filter(|line| !line.starts_with('#')) {
+        let (_, value) = line.rsplit_once(' ').expect("sample should have a value");
+        assert!(value.parse::<f64>().is_ok(), "bad sample: {line}");
+    }
+
+    // A scrape sees commits made since the last one.
+    let mut wtx = db.write_tx();
+    wtx.put(b"later", b"value");
+    wtx.commit().expect("commit should succeed");
+    assert!(
+        thunderdb::stats::published_prometheus()
+            .contains("thunderdb_commits_total{db=\"integration_prometheus\"} 3\n")
+    );
+
+    assert!(thunderdb::stats::unpublish("integration_prometheus"));
+    drop(db);
+    cleanup(&path);
+}
+
+#[test]
+fn test_database_and_bucket_stats() {
+    let path = test_db_path("db_bucket_stats");
+    cleanup(&path);
+    let mut db = Database::open(&path).expect("open should succeed");
+    assert_eq!(db.stats().bytes_read, 0);
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"users").unwrap();
+        wtx.create_nested_bucket(b"users", b"archive").unwrap();
+        for i in 0..1000u32 {
+            wtx.bucket_put(b"users", format!("user{i:04}").as_bytes(), &[0u8; 20])
+                .unwrap();
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let stats = db.stats();
+    let file_size = fs::metadata(&path).unwrap().len();
+    assert_eq!(stats.file_size, file_size);
+    assert_eq!(stats.pages, file_size.div_ceil(db.page_size() as u64));
+    assert!(stats.bytes_written >= 1000 * (8 + 20));
+    assert_eq!(stats.write_txs, 1);
+    assert_eq!(stats.commits, 1);
+
+    {
+        let rtx = db.read_tx();
+        let bucket = rtx.bucket(b"users").unwrap();
+        let bucket_stats = bucket.stats();
+        assert_eq!(bucket_stats.keys, 1000);
+        assert_eq!(bucket_stats.key_bytes, 1000 * 8);
+        assert_eq!(bucket_stats.value_bytes, 1000 * 20);
+        assert_eq!(bucket_stats.sub_buckets, 1);
+        assert!(bucket_stats.depth >= 2);
+    }
+
+    // Space freed by deletes is reused rather than accumulating across
+    // delete cycles: neither the free list nor the file grows.
+    let large = vec![9u8; 64 * 1024];
+    let mut after_cycle = Vec::new();
+    for cycle in 0..8u32 {
+        let mut wtx = db.write_tx();
+        for i in 0..4u32 {
+            wtx.bucket_put(b"users", format!("blob{cycle}-{i}").as_bytes(), &large)
+                .unwrap();
+        }
+        wtx.commit().expect("commit should succeed");
+        let mut wtx = db.write_tx();
+        for i in 0..4u32 {
+            wtx.bucket_delete(b"users", format!("blob{cycle}-{i}").as_bytes())
+                .unwrap();
+        }
+        wtx.commit().expect("commit should succeed");
+        let stats = db.stats();
+        after_cycle.push((stats.free_pages, stats.file_size));
+    }
+    eprintln!("(free pages, file size) per cycle: {after_cycle:?}");
+    assert!(after_cycle.windows(2).all(|w| w[1] <= w[0]));
+
+    let written = db.stats().bytes_written;
+    assert!(written > stats.bytes_written + 8 * 4 * 64 * 1024);
+    drop(db);
+
+    // Reopening reads the file back.
+    let db = Database::open(&path).expect("reopen should succeed");
+    let reopened = db.stats();
+    assert!(reopened.bytes_read >= 1000 * (8 + 20));
+    assert!(reopened.bytes_written < written);
+    drop(db);
+    cleanup(&path);
+}
+
+// ==================== Single-Bucket Compaction Tests ====================
+
+/// Counts the pages of the data section.
+fn leaf_page_count(db: &Database) -> usize {
+    (0..)
+        .map_while(|page_id| db.page_info(page_id).unwrap())
+        .filter(|info| info.page_type == PageType::Leaf)
+        .count()
+}
+
+#[test]
+fn test_compact_bucket_leaves_other_buckets_untouched() {
+    let path = test_db_path("compact_bucket");
+    cleanup(&path);
+    let mut db = Database::open(&path).expect("open should succeed");
+
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"churned").unwrap();
+        wtx.create_bucket(b"steady").unwrap();
+        wtx.bucket_put(b"steady", b"fixed", b"value").unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+    for i in 0..3u32 {
+        let mut wtx = db.write_tx();
+        wtx.bucket_put(b"steady", &i.to_be_bytes(), b"steady")
+            .unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+    // Every commit appends a fresh copy of the bucket header.
+    for i in 0..300u32 {
+        let mut wtx = db.write_tx();
+        wtx.bucket_put(b"churned", &i.to_be_bytes(), &[7u8; 64])
+            .unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let by_name = |db: &Database, name: &[u8]| {
+        db.fragmentation()
+            .unwrap()
+            .into_iter()
+            .find(|f| f.name == name)
+            .unwrap()
+    };
+    let churned_before = by_name(&db, b"churned");
+    let steady_before = by_name(&db, b"steady");
+    assert_eq!(churned_before.dead_entries, 300);
+    assert_eq!(steady_before.dead_entries, 3);
+    let pages_before = leaf_page_count(&db);
+    let version_before = db.version();
+
+    db.compact_bucket(b"churned")
+        .expect("compaction should succeed");
+
+    let churned_after = by_name(&db, b"churned");
+    assert_eq!(churned_after.dead_entries, 0);
+    assert_eq!(churned_after.live_entries, churned_before.live_entries);
+    assert_eq!(by_name(&db, b"steady"), steady_before);
+    assert!(leaf_page_count(&db) < pages_before);
+    assert!(db.version() > version_before);
+    assert!(matches!(
+        db.compact_bucket(b"missing"),
+        Err(Error::BucketNotFound { .. })
+    ));
+
+    // Data is intact, now and after reopening.
+    let mut db = Some(db);
+    for reopen in [false, true] {
+        if reopen {
+            drop(db.take());
+            db = Some(Database::open(&path).expect("reopen should succeed"));
+        }
+        let db = db.as_ref().unwrap();
+        let rtx = db.read_tx();
+        let churned = rtx.bucket(b"churned").unwrap();
+        assert_eq!(churned.iter().count(), 300);
+        assert_eq!(churned.get(&299u32.to_be_bytes()), Some(&[7u8; 64][..]));
+        let steady = rtx.bucket(b"steady").unwrap();
+        assert_eq!(steady.get(b"fixed"), Some(&b"value"[..]));
+        assert_eq!(steady.iter().count(), 4);
+    }
+
+    // Later appends land after the compacted section.
+    let mut db = db.unwrap();
+    let mut wtx = db.write_tx();
+    wtx.bucket_put(b"churned", b"after", b"compaction").unwrap();
+    wtx.commit().expect("commit should succeed");
+    drop(db);
+    let db = Database::open(&path).expect("reopen should succeed");
+    let rtx = db.read_tx();
+    let churned = rtx.bucket(b"churned").unwrap();
+    assert_eq!(churned.iter().count(), 301);
+    drop(rtx);
+    drop(db);
+    cleanup(&path);
+}
+
+// ==================== Capacity Tests ====================
+
+#[test]
+#[cfg(feature = "failpoint")]
+fn test_capacity_reports_low_headroom() {
+    let path = test_db_path("capacity");
+    cleanup(&path);
+    let mut db = Database::open(&path).expect("open should succeed");
+
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"recent").unwrap();
+        wtx.set_bucket_max_keys(b"recent", 10, EvictionPolicy::OldestInserted)
+            .unwrap();
+        wtx.bucket_put(b"recent", b"k", b"v").unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+    let report: thunderdb::CapacityReport = db.capacity();
+    assert_eq!(report.version, db.version());
+    assert!(report.sequence >= 1);
+    assert!(report.page_id >= 2);
+    assert_eq!(report.max_page_id, u64::MAX / db.page_size() as u64);
+    assert!(report.min_headroom() > 99.0);
+    assert!(!report.is_low());
+
+    // Page ids near the end of the addressable range.
+    db.set_next_page_id_for_testing(report.max_page_id - 100);
+    let report = db.capacity();
+    assert!(report.page_id_headroom() < thunderdb::LOW_HEADROOM_PERCENT);
+    assert!(report.version_headroom() > 99.0);
+    assert!(report.is_low());
+    db.set_next_page_id_for_testing(0);
+
+    // A version near the end of its range.
+    db.update_with_version(u64::MAX - 1000, |wtx| {
+        wtx.put(b"late", b"commit");
+        Ok(())
+    })
+    .expect("update should succeed");
+    let report = db.capacity();
+    assert_eq!(report.version, u64::MAX - 1000);
+    assert!(report.version_headroom() < thunderdb::LOW_HEADROOM_PERCENT);
+    assert!(report.page_id_headroom() > 99.0);
+    assert!(report.is_low());
+
+    drop(db);
+    cleanup(&path);
+}
+
+// ==================== Conditional Bucket Deletion Tests ====================
+
+#[test]
+fn test_delete_bucket_if_empty() {
+    let path = test_db_path("delete_bucket_if_empty");
+    cleanup(&path);
+    let mut db = Database::open(&path).expect("open should succeed");
+
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"empty").unwrap();
+        wtx.create_bucket(b"full").unwrap();
+        wtx.bucket_put(b"full", b"key", b"value").unwrap();
+        wtx.create_bucket(b"parent").unwrap();
+        wtx.create_nested_bucket(b"parent", b"child").unwrap();
+        wtx.create_bucket(b"deep").unwrap();
+        wtx.create_nested_bucket(b"deep", b"child").unwrap();
+        wtx.nested_bucket_put(b"deep", b"child", b"key", b"value")
+            .unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let mut wtx = db.write_tx();
+    assert!(
+        wtx.delete_bucket_if_empty(b"empty", EmptySubBuckets::Keep)
+            .unwrap()
+    );
+    assert!(!wtx.bucket_exists(b"empty"));
+
+    // A non-empty bucket is left alone without an error.
+    assert!(
+        !wtx.delete_bucket_if_empty(b"full", EmptySubBuckets::Delete)
+            .unwrap()
+    );
+    assert!(wtx.bucket_exists(b"full"));
+
+    // Keys in sub-buckets always count.
+    assert!(
+        !wtx.delete_bucket_if_empty(b"deep", EmptySubBuckets::Delete)
+            .unwrap()
+    );
+
+    // Whether an empty sub-bucket counts is configurable.
+    assert!(
+        !wtx.delete_bucket_if_empty(b"parent", EmptySubBuckets::Keep)
+            .unwrap()
+    );
+    assert!(wtx.bucket_exists(b"parent"));
+    assert!(
+        wtx.delete_bucket_if_empty(b"parent", EmptySubBuckets::Delete)
+            .unwrap()
+    );
+    assert!(!wtx.bucket_exists(b"parent"));
+
+    // The transaction's own writes and deletes are taken into account.
+    wtx.bucket_delete(b"full", b"key").unwrap();
+    assert!(
+        wtx.delete_bucket_if_empty(b"full", EmptySubBuckets::Keep)
+            .unwrap()
+    );
+    wtx.create_bucket(b"fresh").unwrap();
+    wtx.bucket_put(b"fresh", b"key", b"value").unwrap();
+    assert!(
+        !wtx.delete_bucket_if_empty(b"fresh", EmptySubBuckets::Keep)
+            .unwrap()
+    );
+
+    assert!(matches!(
+        wtx.delete_bucket_if_empty(b"missing", EmptySubBuckets::Keep),
+        Err(Error::BucketNotFound { .. })
+    ));
+    wtx.commit().expect("commit should succeed");
+
+    let rtx = db.read_tx();
+    for (name, exists) in [
+        (&b"empty"[..], false),
+        (b"full", false),
+        (b"parent", false),
+        (b"deep", true),
+        (b"fresh", true),
+    ] {
+        assert_eq!(rtx.bucket_exists(name), exists, "{name:?}");
+    }
+    assert!(!rtx.nested_bucket_exists(b"parent", b"child"));
+    drop(rtx);
+    drop(db);
+    cleanup(&path);
+}
+
+// ==================== Group Scan Tests ====================
+
+#[test]
+fn test_bucket_for_each_group() {
+    let path = test_db_path("for_each_group");
+    cleanup(&path);
+    let mut db = Database::open(&path).expect("open should succeed");
+
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"orders").unwrap();
+        for key in [
+            "alice:3", "alice:1", "bob:1", "carol:2", "carol:1", "carol:3", "dave:9",
+        ] {
+            wtx.bucket_put(b"orders", key.as_bytes(), key.as_bytes())
+                .unwrap();
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let group_of = |key: &[u8]| key.split(|&b| b == b':').next().unwrap().to_vec();
+    let rtx = db.read_tx();
+    let bucket = rtx.bucket(b"orders").unwrap();
+    let mut groups: Vec<(String, Vec<String>)> = Vec::new();
+    bucket
+        .for_each_group(group_of, |group, items| {
+            assert!(items.len() > 0);
+            let items = items
+                .map(|(key, value)| {
+                    assert_eq!(key, value);
+                    String::from_utf8(key.to_vec()).unwrap()
+                })
+                .collect();
+            groups.push((String::from_utf8(group.to_vec()).unwrap(), items));
+            Ok(())
+        })
+        .expect("scan should succeed");
+    assert_eq!(
+        groups,
+        [
+            (
+                "alice".to_string(),
+                vec!["alice:1".into(), "alice:3".into()]
+            ),
+            ("bob".to_string(), vec!["bob:1".into()]),
+            (
+                "carol".to_string(),
+                vec!["carol:1".into(), "carol:2".into(), "carol:3".into()]
+            ),
+            ("dave".to_string(), vec!["dave:9".into()]),
+        ]
+    );
+
+    // Errors stop the scan; unconsumed items are skipped.
+    let mut visited = Vec::new();
+    let result = bucket.for_each_group(group_of, |group, _| {
+        visited.push(group.to_vec());
+        if group == b"bob" {
+            return Err(Error::KeyNotFound);
+        }
+        Ok(())
+    });
+    assert!(matches!(result, Err(Error::KeyNotFound)));
+    assert_eq!(visited, [b"alice".to_vec(), b"bob".to_vec()]);
+
+    drop(rtx);
+    drop(db);
+    cleanup(&path);
+}
+
+// ==================== Transaction Size Limit Tests ====================
+
+#[test]
+fn test_max_tx_size_refuses_writes_past_the_cap() {
+    const LIMIT: u64 = 64 * 1024;
+    const ROWS: u32 = 2000;
+
+    let path = test_db_path("max_tx_size");
+    cleanup(&path);
+
+    let options = DatabaseOptions {
+        max_tx_size: Some(LIMIT),
+        ..DatabaseOptions::default()
+    };
+    let mut db = Database::open_with_options(&path, options.clone()).expect("open should succeed");
+    db.update(|wtx| wtx.create_bucket(b"rows"))
+        .expect("create bucket should succeed");
+
+    let key = |i: u32| format!("row_{i:05}").into_bytes();
+    let value = [0xAB; 100];
+    let entry_size =
+        (thunderdb::bucket::bucket_data_key(b"rows", &key(0)).len() + value.len()) as u64;
+    let fits = (LIMIT / entry_size) as u32;
+
+    // Stream rows in, committing whenever the cap is reached.
+    let mut next = 0;
+    let mut commits = 0;
+    while next < ROWS {
+        let mut wtx = db.write_tx();
+        while next < ROWS {
+            match wtx.bucket_put(b"rows", &key(next), &value) {
+                Ok(()) => next += 1,
+                Err(Error::TxTooLarge { size, limit }) => {
+                    assert_eq!(limit, LIMIT);
+                    assert_eq!(size, (fits as u64 + 1) * entry_size);
+                    // The refused write was not staged.
+                    assert_eq!(wtx.staged_bytes(), fits as u64 * entry_size);
+                    break;
+                }
+                Err(e) => panic!("unexpected error: {e}"),
+            }
+        }
+        wtx.commit().expect("commit should succeed");
+        commits += 1;
+        assert!(next == ROWS || next % fits == 0);
+    }
+    assert_eq!(commits, ROWS.div_ceil(fits));
+
+    // Deletions count too.
+    {
+        let mut wtx = db.write_tx();
+        let mut deleted = 0;
+        while wtx.bucket_delete(b"rows", &key(deleted)).is_ok() {
+            deleted += 1;
+        }
+        let key_size = entry_size - value.len() as u64;
+        assert_eq!(deleted as u64, LIMIT / key_size);
+    }
+
+    // So do batched writes, and a batch that does not fit stages none of
+    // its operations.
+    {
+        let mut wtx = db.write_tx();
+        wtx.bucket_put(b"rows", &key(0), b"before").unwrap();
+        let staged = wtx.staged_bytes();
+
+        let mut batch = wtx.batch().create_bucket(b"extra");
+        for i in 0..=fits {
+            batch = batch.put(b"rows", &key(ROWS + i), &value);
+        }
+        batch = batch.delete(b"rows", &key(1));
+        assert!(matches!(batch.apply(), Err(Error::TxTooLarge { .. })));
+
+        assert_eq!(wtx.staged_bytes(), staged);
+        assert!(!wtx.bucket_exists(b"extra"));
+        assert_eq!(wtx.bucket_get(b"rows", &key(ROWS)).unwrap(), None);
+        assert_eq!(
+            wtx.bucket_get(b"rows", &key(1)).unwrap(),
+            Some(value.to_vec())
+        );
+        assert_eq!(
+            wtx.bucket_get(b"rows", &key(0)).unwrap(),
+            Some(b"before".to_vec())
+        );
+    }
+
+    // And transforms, which stage all of their changes or none.
+    {
+        let mut wtx = db.write_tx();
+        let result = wtx.bucket_transform(b"rows", |_, _| TransformAction::Update(vec![0xCD; 100]));
+        assert!(matches!(result, Err(Error::TxTooLarge { .. })));
+        assert_eq!(wtx.staged_bytes(), 0);
+    }
+    drop(db);
+
+    let db = Database::open_with_options(&path, options).expect("reopen should succeed");
+    let rtx = db.read_tx();
+    let bucket = rtx.bucket(b"rows").unwrap();
+    for i in 0..ROWS {
+        assert_eq!(bucket.get(&key(i)), Some(&value[..]));
+    }
+
+    drop(rtx);
+    drop(db);
+    cleanup(&path);
+}
+
+// ==================== Chunked Update Tests ====================
+
+#[test]
+fn test_chunked_update_keeps_committed_chunks() {
+    const KEYS: u32 = 100_000;
+    const CHUNK: usize = 1000;
+    const FAIL_AT: u32 = 50_500;
+
+    let path = test_db_path("chunked_update");
+    cleanup(&path);
+    let mut db = Database::open(&path).expect("open should succeed");
+
+    let start_version = db.version();
+    let result = db.chunked_update(CHUNK, |tx| {
+        for i in 0..KEYS {
+            if i == FAIL_AT {
+                return Err(Error::KeyNotFound);
+            }
+            tx.put(&i.to_be_bytes(), b"migrated");
+            tx.commit()?;
+        }
+        Ok(())
+    });
+    assert!(matches!(result, Err(Error::KeyNotFound)));
+    assert_eq!(db.version() - start_version, FAIL_AT as u64 / CHUNK as u64);
+    drop(db);
+
+    // Chunks committed before the failure are durable; the rest is not.
+    let mut db = Database::open(&path).expect("reopen should succeed");
+    let resume_from = {
+        let rtx = db.read_tx();
+        let committed = rtx.iter().count() as u32;
+        assert_eq!(committed, 50_000);
+        assert!(rtx.get(&(committed - 1).to_be_bytes()).is_some());
+        assert!(rtx.get(&committed.to_be_bytes()).is_none());
+        committed
+    };
+
+    // Resume after the last commit point.
+    let chunks = db
+        .chunked_update(CHUNK, |tx| {
+            for i in resume_from..KEYS {
+                tx.put(&i.to_be_bytes(), b"migrated");
+                assert_eq!(tx.commit()?, (i + 1) % CHUNK as u32 == 0);
+            }
+            assert_eq!(tx.chunks_committed(), 50);
+            Ok(())
+        })
+        .expect("resumed update should succeed");
+    assert_eq!(chunks, 50);
+    drop(db);
+
+    let db = Database::open(&path).expect("reopen should succeed");
+    assert_eq!(db.read_tx().iter().count(), KEYS as usize);
+    drop(db);
+    cleanup(&path);
+}
+
+// ==================== Query Tests ====================
+
+#[test]
+fn test_query_results_outlive_later_writes() {
+    let path = test_db_path("query");
+    cleanup(&path);
+    let mut db = Database::open(&path).expect("open should succeed");
+
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"events").unwrap();
+        for day in 1..=9u8 {
+            wtx.bucket_put(b"events", &[b'd', b'0' + day], &[day])
+                .unwrap();
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let results = db
+        .query(b"events", b"d3", b"d6", Some(3))
+        .expect("query should succeed");
+
+    // Later writes change neither the copies nor what they reflect.
+    {
+        let mut wtx = db.write_tx();
+        wtx.bucket_put(b"events", b"d4", b"overwritten").unwrap();
+        wtx.bucket_delete(b"events", b"d5").unwrap();
+        wtx.bucket_put(b"events", b"d35", b"inserted").unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+    assert_eq!(
+        results,
+        [
+            (b"d3".to_vec(), vec![3]),
+            (b"d4".to_vec(), vec![4]),
+            (b"d5".to_vec(), vec![5]),
+        ]
+    );
+
+    let now = db.query(b"events", b"d3", b"d6", None).unwrap();
+    assert_eq!(now.len(), 3);
+    assert_eq!(now[1], (b"d35".to_vec(), b"inserted".to_vec()));
+    assert!(db.query(b"events", b"d6", b"d3", None).unwrap().is_empty());
+    assert!(matches!(
+        db.query(b"events", b"d1", b"d9", Some(2)),
+        Err(Error::QueryLimitExceeded { limit: 2 })
+    ));
+    assert!(matches!(
+        db.query(b"missing", b"a", b"z", None),
+        Err(Error::BucketNotFound { .. })
+    ));
+
+    drop(db);
+    cleanup(&path);
+}
+
+// ==================== Format Upgrade Tests ====================
+
+#[test]
+#[cfg(feature = "failpoint")]
+fn test_upgrade_old_format_file() {
+    use thunderdb::page::VERSION;
+
+    let path = test_db_path("upgrade");
+    cleanup(&path);
+
+    {
+        let mut db = Database::open(&path).expect("open should succeed");
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"users").unwrap();
+        for i in 0..50u32 {
+            wtx.bucket_put(b"users", &i.to_be_bytes(), format!("user-{i}").as_bytes())
+                .unwrap();
+        }
+        wtx.put(b"top", b"level");
+        wtx.commit().expect("commit should succeed");
+        // Stamp it as written by a version 3 release.
+        db.set_format_version_for_testing(3)
+            .expect("stamping old format should succeed");
+    }
+
+    let options = DatabaseOptions {
+        require_upgrade: true,
+        ..DatabaseOptions::default()
+    };
+    let mut db = Database::open_with_options(&path, options.clone()).expect("open should succeed");
+    assert!(db.needs_upgrade());
+    assert_eq!(db.format_version(), 3);
+
+    // Reads work; writes are refused until the upgrade.
+    assert_eq!(db.read_tx().get(b"top"), Some(b"level".to_vec()));
+    let mut wtx = db.write_tx();
+    wtx.put(b"blocked", b"1");
+    assert!(matches!(
+        wtx.commit(),
+        Err(Error::UpgradeRequired {
+            version: 3,
+            current: VERSION
+        })
+    ));
+
+    let mut steps = Vec::new();
+    assert!(
+        db.upgrade_with_progress(|step| steps.push(step))
+            .expect("upgrade should succeed")
+    );
+    assert_eq!(
+        steps.first(),
+        Some(&thunderdb::UpgradeProgress::Rewriting {
+            from_version: 3,
+            entries: db.stats().entries,
+        })
+    );
+    assert_eq!(
+        steps.last(),
+        Some(&thunderdb::UpgradeProgress::Done { version: VERSION })
+    );
+    assert!(!db.needs_upgrade());
+    assert!(!db.upgrade().expect("second upgrade should succeed"));
+
+    let mut wtx = db.write_tx();
+    wtx.put(b"after", b"upgrade");
+    wtx.commit().expect("commit should succeed after upgrade");
+    drop(db);
+
+    // The file itself is now in the current format, with its data intact.
+    let db = Database::open_with_options(&path, options).expect("reopen should succeed");
+    assert_eq!(db.format_version(), VERSION);
+    assert!(!db.needs_upgrade());
+    let rtx = db.read_tx();
+    assert_eq!(rtx.get(b"after"), Some(b"upgrade".to_vec()));
+    assert_eq!(rtx.get(b"blocked"), None);
+    assert_eq!(rtx.get(b"top"), Some(b"level".to_vec()));
+    let users = rtx.bucket(b"users").expect("bucket should exist");
+    for i in 0..50u32 {
+        assert_eq!(
+            users.get(&i.to_be_bytes()),
+            Some(format!("user-{i}").as_bytes())
+        );
+    }
+    drop(rtx);
+    drop(db);
+    cleanup(&path);
+}
+
+#[test]
+#[cfg(feature = "failpoint")]
+fn test_open_rejects_newer_format_version() {
+    use thunderdb::page::VERSION;
+
+    let path = test_db_path("future_format");
+    cleanup(&path);
+
+    {
+        let mut db = Database::open(&path).expect("open should succeed");
+        let mut wtx = db.write_tx();
+        wtx.put(b"key", b"value");
+        wtx.commit().expect("commit should succeed");
+        assert_eq!(db.format_version(), VERSION);
+        db.set_format_version_for_testing(VERSION + 1)
+            .expect("stamping a future format should succeed");
+    }
+    let before = fs::read(&path).unwrap();
+
+    for read_only in [false, true] {
+        let options = DatabaseOptions {
+            read_only,
+            ..DatabaseOptions::default()
+        };
+        match Database::open_with_options(&path, options) {
+            Err(Error::IncompatibleVersion { found, supported }) => {
+                assert_eq!((found, supported), (VERSION + 1, VERSION));
+            }
+            Err(e) => panic!("unexpected error: {e}"),
+            Ok(_) => panic!("opening a newer format should fail"),
+        }
+    }
+    let message = Database::open(&path).err().unwrap().to_string();
+    assert!(
+        message.contains(&format!("version {}", VERSION + 1))
+            && message.contains(&VERSION.to_string()),
+        "{message}"
+    );
+    // The file is left exactly as it was.
+    assert!(fs::read(&path).unwrap() == before);
+
+    cleanup(&path);
+}
+
+#[test]
+#[cfg(feature = "failpoint")]
+fn test_compressed_commit_stamps_old_format_file() {
+    use thunderdb::ValueCompression;
+    use thunderdb::page::VERSION;
+
+    let path = test_db_path("stamp_format");
+    cleanup(&path);
+
+    {
+        let mut db = Database::open(&path).expect("open should succeed");
+        db.update(|wtx| {
+            wtx.put(b"plain", b"value");
+            Ok(())
+        })
+        .expect("update should succeed");
+        db.set_format_version_for_testing(VERSION - 1)
+            .expect("stamping old format should succeed");
+    }
+
+    // Plain commits keep the old format.
+    {
+        let mut db = Database::open(&path).expect("reopen should succeed");
+        db.update(|wtx| {
+            wtx.put(b"more", b"plain");
+            Ok(())
+        })
+        .expect("update should succeed");
+        assert_eq!(db.format_version(), VERSION - 1);
+    }
+
+    // Writing compressed values moves the file to the current format, so
+    // older releases refuse it rather than misread the value markers.
+    let options = DatabaseOptions {
+        value_compression: ValueCompression::Lz,
+        ..DatabaseOptions::default()
+    };
+    {
+        let mut db =
+            Database::open_with_options(&path, options.clone()).expect("reopen should succeed");
+        assert_eq!(db.format_version(), VERSION - 1);
+        db.update(|wtx| {
+            wtx.put(b"doc", &b"compressible ".repeat(64));
+            Ok(())
+        })
+        .expect("update should succeed");
+        assert_eq!(db.format_version(), VERSION);
+    }
+    let db = Database::open(&path).expect("reopen should succeed");
+    assert_eq!(db.format_version(), VERSION);
+    assert!(!db.needs_upgrade());
+    assert_eq!(db.read_tx().get(b"doc"), Some(b"compressible ".repeat(64)));
+    drop(db);
+
+    cleanup(&path);
+}
+
+// ==================== Bloom-Filtered Multi-Get Tests ====================
+
+#[test]
+fn test_multi_bucket_get_bloom_has_no_false_negatives() {
+    let path = test_db_path("multi_get_bloom");
+    cleanup(&path);
+
+    let present = |i: u32| format!("user-{:06}", i * 7).into_bytes();
+    let absent = |i: u32| format!("user-{:06}", i * 7 + 3).into_bytes();
+
+    let mut db = Database::open(&path).expect("open should succeed");
+    // Appended inserts, then updates and deletes through a full rewrite.
+    for chunk in 0..4u32 {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket_if_not_exists(b"users").unwrap();
+        for i in chunk * 1000..(chunk + 1) * 1000 {
+            wtx.bucket_put(b"users", &present(i), &i.to_le_bytes())
+                .unwrap();
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+    {
+        let mut wtx = db.write_tx();
+        for i in (0..4000u32).step_by(10) {
+            wtx.bucket_put(b"users", &present(i), b"updated").unwrap();
+        }
+        wtx.bucket_delete(b"users", &present(1)).unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let check = |db: &Database| {
+        let keys: Vec<Vec<u8>> = (0..4000u32).flat_map(|i| [present(i), absent(i)]).collect();
+        let requests: Vec<(&[u8], &[u8])> =
+            keys.iter().map(|k| (&b"users"[..], k.as_slice())).collect();
+        let rtx = db.read_tx();
+        let values = rtx
+            .multi_bucket_get(&requests)
+            .expect("multi get should succeed");
+        let bucket = rtx.bucket(b"users").unwrap();
+        for (key, value) in keys.iter().zip(&values) {
+            assert_eq!(*value, bucket.get(key), "mismatch for {key:?}");
+        }
+        let found = values.iter().filter(|v| v.is_some()).count();
+        assert_eq!(found, 3999);
+    };
+    check(&db);
+
+    // The filter is rebuilt from the file on open.
+    drop(db);
+    let db = Database::open(&path).expect("reopen should succeed");
+    check(&db);
+
+    drop(db);
+    cleanup(&path);
+}
+
+// ==================== Allocation Map Tests ====================
+
+#[test]
+fn test_allocation_map_covers_file() {
+    let path = test_db_path("allocation_map");
+    cleanup(&path);
+    let mut db = Database::open(&path).expect("open should succeed");
+
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"small").unwrap();
+        for i in 0..20u8 {
+            wtx.bucket_put(b"small", &[b'k', i], &[i; 32]).unwrap();
+        }
+        wtx.put(b"top", b"level");
+        wtx.commit().expect("commit should succeed");
+    }
+    // Refreshes the bucket header, superseding the first copy.
+    {
+        let mut wtx = db.write_tx();
+        wtx.bucket_put(b"small", b"late", b"v").unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"big").unwrap();
+        wtx.bucket_put(b"big", b"blob", &vec![7u8; 40_000]).unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let check = |db: &Database| {
+        let map = db.allocation_map().expect("allocation map should succeed");
+        let file_len = fs::metadata(&path).unwrap().len();
+
+        // Contiguous ranges covering the whole file.
+        assert_eq!(map[0].start, 0);
+        assert_eq!(map[0].kind, AllocationKind::Meta);
+        for pair in map.windows(2) {
+            assert_eq!(pair[0].end, pair[1].start);
+            assert_ne!(pair[0].kind, pair[1].kind);
+        }
+        assert_eq!(map.last().unwrap().end, file_len);
+        assert_eq!(map.iter().map(|r| r.size()).sum::<u64>(), file_len);
+
+        let bytes_of = |kind: &AllocationKind| -> u64 {
+            map.iter()
+                .filter(|r| &r.kind == kind)
+                .map(|r| r.size())
+                .sum()
+        };
+        let small = bytes_of(&AllocationKind::Entries {
+            bucket: Some(b"small".to_vec()),
+        });
+        // 21 entries of at least a key and a value each.
+        assert!(
+            small >= 20 * (4 + 3 + 4 + 32),
+            "small bucket holds {small} bytes"
+        );
+        assert!(bytes_of(&AllocationKind::Entries { bucket: None }) > 0);
+        assert!(
+            bytes_of(&AllocationKind::Overflow {
+                bucket: Some(b"big".to_vec()),
+            }) >= 40_000
+        );
+        assert_eq!(bytes_of(&AllocationKind::CompressedBlock), 0);
+        map
+    };
+
+    let map = check(&db);
+    // The superseded header copy is free space inside the data section.
+    let overflow_start = map
+        .iter()
+        .find(|r| matches!(r.kind, AllocationKind::Overflow { .. }))
+        .unwrap()
+        .start;
+    assert!(
+        map.iter()
+            .any(|r| r.kind == AllocationKind::Free && r.end <= overflow_start)
+    );
+
+    // A fresh handle derives the same map from the file alone.
+    drop(db);
+    let db = Database::open(&path).expect("reopen should succeed");
+    assert_eq!(check(&db), map);
+
+    drop(db);
+    cleanup(&path);
+}
+
+// ==================== Freeze Tests ====================
+
+#[test]
+fn test_freeze_holds_commits_until_unfrozen() {
+    use std::sync::mpsc;
+    use std::time::Duration;
+
+    let path = test_db_path("freeze");
+    let copy_path = test_db_path("freeze_copy");
+    cleanup(&path);
+    cleanup(&copy_path);
+    let mut db = Database::open(&path).expect("open should succeed");
+
+    {
+        let mut wtx = db.write_tx();
+        wtx.put(b"before", b"freeze");
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let freeze = db.freeze().expect("freeze should succeed");
+    assert!(db.is_frozen());
+
+    let (done_tx, done_rx) = mpsc::channel();
+    let writer = std::thread::spawn(move || {
+        let mut wtx = db.write_tx();
+        wtx.put(b"during", b"freeze");
+        let result = wtx.commit();
+        done_tx.send(()).unwrap();
+        result.map(|()| db)
+    });
+
+    // The commit waits while the file is copied, as a snapshot tool would.
+    assert!(done_rx.recv_timeout(Duration::from_millis(200)).is_err());
+    fs::copy(&path, &copy_path).expect("copy should succeed");
+    assert!(done_rx.try_recv().is_err());
+
+    freeze.unfreeze();
+    done_rx
+        .recv_timeout(Duration::from_secs(10))
+        .expect("commit should finish once unfrozen");
+    let db = writer
+        .join()
+        .unwrap()
+        .expect("commit should succeed after unfreeze");
+    assert!(!db.is_frozen());
+    assert_eq!(db.read_tx().get(b"during"), Some(b"freeze".to_vec()));
+
+    // The copy taken during the freeze opens cleanly at the frozen state.
+    let copy = Database::open(&copy_path).expect("frozen copy should open");
+    let rtx = copy.read_tx();
+    assert_eq!(rtx.get(b"before"), Some(b"freeze".to_vec()));
+    assert_eq!(rtx.get(b"during"), None);
+    drop(rtx);
+    drop(copy);
+
+    drop(db);
+    cleanup(&path);
+    cleanup(&copy_path);
+}
+
+#[test]
+fn test_freeze_timeout_discards_commit() {
+    let path = test_db_path("freeze_timeout");
+    cleanup(&path);
+    let options = DatabaseOptions {
+        freeze_timeout: Some(std::time::Duration::from_millis(20)),
+        ..DatabaseOptions::default()
+    };
+    let mut db = Database::open_with_options(&path, options).expect("open should succeed");
+
+    let freeze = db.freeze().expect("freeze should succeed");
+    let mut wtx = db.write_tx();
+    wtx.put(b"k", b"v");
+    assert!(matches!(wtx.commit(), Err(Error::FreezeTimedOut { .. })));
+    drop(freeze);
+
+    assert_eq!(db.read_tx().get(b"k"), None);
+    let mut wtx = db.write_tx();
+    wtx.put(b"k", b"v");
+    wtx.commit().expect("commit should succeed once unfrozen");
+
+    drop(db);
+    cleanup(&path);
+}
+
+// ==================== Sorted By Value Tests ====================
+
+#[test]
+fn test_bucket_sorted_by_value_top_n() {
+    let path = test_db_path("sorted_by_value");
+    cleanup(&path);
+    let mut db = Database::open(&path).expect("open should succeed");
+
+    let scores: [(&[u8], u64); 8] = [
+        (b"alice", 40),
+        (b"bob", 95),
+        (b"carol", 12),
+        (b"dave", 95),
+        (b"erin", 67),
+        (b"frank", 3),
+        (b"grace", 88),
+        (b"heidi", 71),
+    ];
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"scores").unwrap();
+        for (name, score) in scores {
+            wtx.bucket_put(b"scores", name, &score.to_be_bytes())
+                .unwrap();
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let decode = |v: &[u8]| u64::from_be_bytes(v.try_into().unwrap());
+    let rtx = db.read_tx();
+    let bucket = rtx.bucket(b"scores").unwrap();
+
+    // Highest first; the tie between bob and dave keeps key order.
+    let top = bucket.sorted_by_value(|a, b| decode(b).cmp(&decode(a)), 5);
+    let top: Vec<(&[u8], u64)> = top.into_iter().map(|(k, v)| (k, decode(v))).collect();
+    assert_eq!(
+        top,
+        vec![
+            (&b"bob"[..], 95),
+            (&b"dave"[..], 95),
+            (&b"grace"[..], 88),
+            (&b"heidi"[..], 71),
+            (&b"erin"[..], 67),
+        ]
+    );
+
+    // A limit past the bucket's size returns every entry in value order.
+    let all = bucket.sorted_by_value(|a, b| decode(a).cmp(&decode(b)), 100);
+    assert_eq!(all.len(), scores.len());
+    assert_eq!(all[0].0, b"frank");
+    assert!(bucket.sorted_by_value(|a, b| a.cmp(b), 0).is_empty());
+
+    drop(rtx);
+    drop(db);
+    cleanup(&path);
+}
+
+// ==================== Slow Read Tests ====================
+
+#[test]
+#[cfg(feature = "failpoint")]
+fn test_slow_read_hook_reports_slow_lookups() {
+    use std::sync::{Arc, Mutex};
+    use std::time::Duration;
+    use thunderdb::{FailAction, FailpointRegistry, SlowReadHook};
+
+    let path = test_db_path("slow_read");
+    cleanup(&path);
+    let reports = Arc::new(Mutex::new(Vec::<(Vec<u8>, Duration)>::new()));
+    let sink = Arc::clone(&reports);
+    let options = DatabaseOptions {
+        slow_read_threshold: Some(Duration::from_millis(10)),
+        on_slow_read: Some(SlowReadHook::new(move |key, elapsed, _faults| {
+            sink.lock().unwrap().push((key.to_vec(), elapsed));
+        })),
+        ..DatabaseOptions::default()
+    };
+    let mut db = Database::open_with_options(&path, options).expect("open should succeed");
+    {
+        let mut wtx = db.write_tx();
+        wtx.put(b"fast", b"1");
+        wtx.put(b"slow", b"2");
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let rtx = db.read_tx();
+    assert_eq!(rtx.get(b"fast"), Some(b"1".to_vec()));
+    assert!(reports.lock().unwrap().is_empty());
+
+    // Inflate read latency past the threshold.
+    FailpointRegistry::global().register("slow_read", FailAction::Sleep(Duration::from_millis(30)));
+    assert_eq!(rtx.get(b"slow"), Some(b"2".to_vec()));
+    assert_eq!(rtx.range(&b"s"[..]..).count(), 1);
+    FailpointRegistry::global().disable("slow_read");
+    assert_eq!(rtx.get(b"fast"), Some(b"1".to_vec()));
+
+    let reports = reports.lock().unwrap();
+    let keys: Vec<&[u8]> = reports.iter().map(|(k, _)| k.as_slice()).collect();
+    assert_eq!(keys, vec![&b"slow"[..], b"s"]);
+    assert!(reports.iter().all(|(_, d)| *d >= Duration::from_millis(30)));
+
+    drop(rtx);
+    drop(db);
+    cleanup(&path);
+}
+
+// ==================== Bucket Replace Tests ====================
+
+#[test]
+fn test_bucket_replace_all_swaps_contents_atomically() {
+    let path = test_db_path("bucket_replace_all");
+    cleanup(&path);
+    let mut db = Database::open(&path).expect("open should succeed");
+
+    let old: Vec<(Vec<u8>, Vec<u8>)> = (0..200u32)
+        .map(|i| (format!("k{i:04}").into_bytes(), b"old".to_vec()))
+        .collect();
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"table").unwrap();
+        for (k, v) in &old {
+            wtx.bucket_put(b"table", k, v).unwrap();
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+
+    // A reader holding the old state sees all of it throughout the swap.
+    let snapshot = db.snapshot();
+    let prefix = thunderdb::bucket::bucket_data_prefix(b"table");
+    let reader = std::thread::spawn(move || {
+        for _ in 0..50 {
+            let seen: Vec<_> = snapshot
+                .iter()
+                .filter(|(k, _)| k.starts_with(&prefix))
+                .map(|(_, v)| v.to_vec())
+                .collect();
+            assert_eq!(seen.len(), 200);
+            assert!(seen.iter().all(|v| v == b"old"));
+        }
+    });
+
+    let new: Vec<(Vec<u8>, Vec<u8>)> = (100..250u32)
+        .map(|i| (format!("k{i:04}").into_bytes(), b"new".to_vec()))
+        .collect();
+    {
+        let mut wtx = db.write_tx();
+        wtx.bucket_put(b"table", b"stale", b"dropped").unwrap();
+        let unsorted = [(b"b".as_slice(), b"1".as_slice()), (b"a", b"2")];
+        assert!(matches!(
+            wtx.bucket_replace_all(b"table", unsorted),
+            Err(Error::KeysOutOfOrder { key }) if key == b"a"
+        ));
+        let written = wtx
+            .bucket_replace_all(b"table", new.iter().map(|(k, v)| (k, v)))
+            .unwrap();
+        assert_eq!(written, 150);
+        wtx.commit().expect("commit should succeed");
+    }
+    reader.join().unwrap();
+
+    let contents = |db: &Database| -> Vec<(Vec<u8>, Vec<u8>)> {
+        let rtx = db.read_tx();
+        let bucket = rtx.bucket(b"table").unwrap();
+        bucket
+            .iter()
+            .map(|(k, v)| (k.to_vec(), v.to_vec()))
+            .collect()
+    };
+    assert_eq!(contents(&db), new);
+
+    drop(db);
+    let db = Database::open(&path).expect("reopen should succeed");
+    assert_eq!(contents(&db), new);
+
+    drop(db);
+    cleanup(&path);
+}
+
+// ==================== Bucket Truncate Tests ====================
+
+#[test]
+fn test_truncate_bucket() {
+    use thunderdb::TruncateSequence;
+
+    let path = test_db_path("truncate_bucket");
+    cleanup(&path);
+    let mut db = Database::open(&path).expect("open should succeed");
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"logs").unwrap();
+        wtx.create_bucket(b"other").unwrap();
+        wtx.create_nested_bucket(b"logs", b"archive").unwrap();
+        wtx.nested_bucket_put(b"logs", b"archive", b"old", b"kept")
+            .unwrap();
+        for _ in 0..3 {
+            let id = wtx.next_bucket_sequence(b"logs").unwrap();
+            wtx.bucket_put(b"logs", &id.to_be_bytes(), &[0u8; 512])
+                .unwrap();
+        }
+        for i in 0..1000u32 {
+            wtx.bucket_put(b"logs", format!("k{i:04}").as_bytes(), &[1u8; 512])
+                .unwrap();
+        }
+        wtx.bucket_put(b"other", b"k", b"v").unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+    let before = db.stats();
+
+    {
+        let mut wtx = db.write_tx();
+        wtx.bucket_put(b"logs", b"staged", b"dropped").unwrap();
+        wtx.bucket_delete(b"logs", b"k0000").unwrap();
+        let truncated = wtx
+            .truncate_bucket(b"logs", TruncateSequence::Keep)
+            .unwrap();
+        assert_eq!(truncated, 1003);
+        assert!(wtx.bucket_get(b"logs", b"k0001").unwrap().is_none());
+
+        // The bucket stays usable within the transaction.
+        wtx.bucket_put(b"logs", b"fresh", b"v").unwrap();
+        assert_eq!(wtx.next_bucket_sequence(b"logs").unwrap(), 4);
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let after = db.stats();
+    // The values alone took 1003 * 512 bytes.
+    assert!(before.data_size - after.data_size > 1003 * 512);
+    assert_eq!(after.file_size, before.file_size);
+    assert!(after.entries < before.entries);
+
+    let check = |db: &Database| {
+        let rtx = db.read_tx();
+        let keys: Vec<Vec<u8>> = rtx
+            .bucket(b"logs")
+            .unwrap()
+            .iter()
+            .map(|(k, _)| k.to_vec())
+            .collect();
+        assert_eq!(keys, vec![b"fresh".to_vec()]);
+        assert_eq!(rtx.bucket(b"other").unwrap().get(b"k"), Some(&b"v"[..]));
+        let archive = rtx.nested_bucket(b"logs", b"archive").unwrap();
+        assert_eq!(archive.get(b"old"), Some(&b"kept"[..]));
+    };
+    check(&db);
+
+    // Resetting restarts the sequence as in a new bucket.
+    {
+        let mut wtx = db.write_tx();
+        assert_eq!(
+            wtx.truncate_bucket(b"logs", TruncateSequence::Reset)
+                .unwrap(),
+            1
+        );
+        assert_eq!(wtx.next_bucket_sequence(b"logs").unwrap(), 1);
+        wtx.commit().expect("commit should succeed");
+    }
+    assert!(matches!(
+        db.write_tx()
+            .truncate_bucket(b"missing", TruncateSequence::Keep),
+        Err(Error::BucketNotFound { .. })
+    ));
+
+    // Compaction gives the released space back to the file system.
+    db.compact().expect("compact should succeed");
+    assert!(db.stats().file_size < before.file_size - 1003 * 512);
+
+    drop(db);
+    let mut db = Database::open(&path).expect("reopen should succeed");
+    assert!(
+        db.read_tx()
+            .bucket(b"logs")
+            .unwrap()
+            .iter()
+            .next()
+            .is_none()
+    );
+    assert_eq!(db.write_tx().bucket_sequence(b"logs").unwrap(), 1);
+
+    drop(db);
+    cleanup(&path);
+}
+
+#[test]
+fn test_truncate_bucket_faster_than_per_key_deletes() {
+    use std::time::Instant;
+    use thunderdb::TruncateSequence;
+
+    let path = test_db_path("truncate_bucket_speed");
+    cleanup(&path);
+    let mut db = Database::open(&path).expect("open should succeed");
+    let keys: Vec<Vec<u8>> = (0..5000u32)
+        .map(|i| format!("key{i:06}").into_bytes())
+        .collect();
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"big").unwrap();
+        for key in &keys {
+            wtx.bucket_put(b"big", key, b"value").unwrap();
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let mut wtx = db.write_tx();
+    let start = Instant::now();
+    for key in &keys {
+        wtx.bucket_delete(b"big", key).unwrap();
+    }
+    let per_key = start.elapsed();
+    wtx.rollback();
+
+    let mut wtx = db.write_tx();
+    let start = Instant::now();
+    assert_eq!(
+        wtx.truncate_bucket(b"big", TruncateSequence::Keep).unwrap(),
+        5000
+    );
+    let truncate = start.elapsed();
+    wtx.commit().expect("commit should succeed");
+
+    assert!(
+        truncate * 10 < per_key,
+        "truncate took {truncate:?}, per-key deletes {per_key:?}"
+    );
+    assert!(db.read_tx().bucket(b"big").unwrap().iter().next().is_none());
+
+    drop(db);
+    cleanup(&path);
+}
+
+#[test]
+fn test_bucket_delete_prefix_only_removes_the_prefix() {
+    let path = test_db_path("bucket_delete_prefix");
+    cleanup(&path);
+    let mut db = Database::open(&path).expect("open should succeed");
+
+    // Interleaved prefixes, including keys sorting right around the range.
+    let doomed: Vec<Vec<u8>> = (0..200u32)
+        .map(|i| format!("session:expired:{i:04}").into_bytes())
+        .collect();
+    let kept: Vec<&[u8]> = vec![
+        b"session:expired",
+        b"session:expire:0001",
+        b"session:expired;0001",
+        b"session:expiree:0001",
+        b"session:active:0001",
+        b"session:active:0002",
+        b"t",
+    ];
+    {
+        let mut wtx = db.write_tx();
+        for name in [&b"sessions"[..], b"other"] {
+            wtx.create_bucket(name).unwrap();
+            for (i, key) in doomed.iter().enumerate() {
+                wtx.bucket_put(name, key, b"v").unwrap();
+                wtx.bucket_put(name, kept[i % kept.len()], b"v").unwrap();
+            }
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let mut wtx = db.write_tx();
+    // A write staged under the prefix is discarded; one outside stays.
+    wtx.bucket_put(b"sessions", b"session:expired:staged", b"v")
+        .unwrap();
+    wtx.bucket_put(b"sessions", b"session:active:staged", b"v")
+        .unwrap();
+    wtx.bucket_delete(b"sessions", &doomed[0]).unwrap();
+    assert_eq!(
+        wtx.bucket_delete_prefix(b"sessions", b"session:expired:")
+            .unwrap(),
+        200
+    );
+    assert!(matches!(
+        wtx.bucket_delete_prefix(b"missing", b"x"),
+        Err(Error::BucketNotFound { .. })
+    ));
+    wtx.commit().expect("commit should succeed");
+    drop(db);
+
+    let db = Database::open(&path).expect("reopen should succeed");
+    let rtx = db.read_tx();
+    let sessions: Vec<Vec<u8>> = rtx
+        .bucket(b"sessions")
+        .unwrap()
+        .iter()
+        .map(|(k, _)| k.to_vec())
+        .collect();
+    let mut expected: Vec<Vec<u8>> = kept.iter().map(|k| k.to_vec()).collect();
+    expected.push(b"session:active:staged".to_vec());
+    expected.sort();
+    assert_eq!(sessions, expected);
+
+    // The same keys in another bucket are untouched.
+    let other = rtx.bucket(b"other").unwrap();
+    assert_eq!(other.iter().count(), doomed.len() + kept.len());
+    assert_eq!(other.get(&doomed[7]), Some(&b"v"[..]));
+    drop(rtx);
+
+    drop(db);
+    cleanup(&path);
+}
+
+// ==================== Bucket Rename Tests ====================
+
+#[test]
+fn test_rename_bucket() {
+    let path = test_db_path("rename_bucket");
+    cleanup(&path);
+    let mut db = Database::open(&path).expect("open should succeed");
+    let keys: Vec<Vec<u8>> = (0..300u32)
+        .map(|i| format!("event{i:04}").into_bytes())
+        .collect();
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"events_v1").unwrap();
+        wtx.create_bucket(b"taken").unwrap();
+        for key in &keys {
+            wtx.bucket_put(b"events_v1", key, key).unwrap();
+        }
+        wtx.create_nested_bucket(b"events_v1", b"meta").unwrap();
+        wtx.nested_bucket_put(b"events_v1", b"meta", b"schema", b"1")
+            .unwrap();
+        wtx.set_bucket_sequence(b"events_v1", 300).unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+
+    {
+        let mut wtx = db.write_tx();
+        assert!(matches!(
+            wtx.rename_bucket(b"events_v1", b"taken"),
+            Err(Error::BucketAlreadyExists { name }) if name == b"taken"
+        ));
+        assert!(matches!(
+            wtx.rename_bucket(b"missing", b"events_v2"),
+            Err(Error::BucketNotFound { .. })
+        ));
+
+        // Writes staged before the rename move with the bucket.
+        wtx.bucket_put(b"events_v1", b"staged", b"v").unwrap();
+        wtx.bucket_delete(b"events_v1", &keys[0]).unwrap();
+        wtx.rename_bucket(b"events_v1", b"events_v2").unwrap();
+        assert!(wtx.bucket_get(b"events_v1", &keys[1]).is_err());
+        assert_eq!(
+            wtx.bucket_get(b"events_v2", &keys[1]).unwrap(),
+            Some(keys[1].clone())
+        );
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let check = |db: &mut Database| {
+        let rtx = db.read_tx();
+        assert!(rtx.bucket(b"events_v1").is_err());
+        let bucket = rtx.bucket(b"events_v2").unwrap();
+        assert_eq!(bucket.iter().count(), keys.len());
+        assert_eq!(bucket.get(&keys[0]), None);
+        for key in &keys[1..] {
+            assert_eq!(bucket.get(key), Some(key.as_slice()));
+        }
+        assert_eq!(bucket.get(b"staged"), Some(&b"v"[..]));
+        let nested = rtx.nested_bucket(b"events_v2", b"meta").unwrap();
+        assert_eq!(nested.get(b"schema"), Some(&b"1"[..]));
+        assert!(!rtx.nested_bucket_exists(b"events_v1", b"meta"));
+        drop(rtx);
+        assert_eq!(db.write_tx().bucket_sequence(b"events_v2").unwrap(), 300);
+    };
+    check(&mut db);
+
+    drop(db);
+    let mut db = Database::open(&path).expect("reopen should succeed");
+    check(&mut db);
+
+    // A rolled back rename changes nothing.
+    {
+        let mut wtx = db.write_tx();
+        wtx.rename_bucket(b"events_v2", b"events_v3").unwrap();
+        wtx.rollback();
+    }
+    check(&mut db);
+
+    drop(db);
+    cleanup(&path);
+}
+
+// ==================== Range Size Tests ====================
+
+#[test]
+fn test_bucket_range_size() {
+    let path = test_db_path("bucket_range_size");
+    cleanup(&path);
+    let mut db = Database::open(&path).expect("open should succeed");
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"shards").unwrap();
+        wtx.create_bucket(b"other").unwrap();
+        // Keys spread uniformly over the u32 space, with varied values.
+        for i in 0..20_000u32 {
+            let key = i.wrapping_mul(2_654_435_761).to_be_bytes();
+            let value = vec![b'v'; 10 + (i % 90) as usize];
+            wtx.bucket_put(b"shards", &key, &value).unwrap();
+        }
+        wtx.bucket_put(b"other", b"k", &[0u8; 4096]).unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let rtx = db.read_tx();
+    let bucket = rtx.bucket(b"shards").unwrap();
+    let exact = |start: Option<&[u8]>, end: Option<&[u8]>| {
+        let mut bytes = 0u64;
+        bucket
+            .for_each_range(start, end, |k, v| {
+                bytes += (k.len() + v.len()) as u64;
+                Ok(())
+            })
+            .unwrap();
+        bytes
+    };
+
+    let total = bucket.range_size(None, None);
+    assert_eq!(total, exact(None, None));
+    let bounds = [0x1000_0000u32, 0x4000_0000, 0x8000_0000, 0xF000_0000].map(u32::to_be_bytes);
+    for start in &bounds {
+        for end in &bounds {
+            assert_eq!(
+                bucket.range_size(Some(start), Some(end)),
+                exact(Some(start), Some(end))
+            );
+        }
+    }
+
+    // Split into four chunks of roughly equal size by bisecting the key
+    // space on the estimate alone.
+    let mut splits = Vec::new();
+    for quarter in 1..4u64 {
+        let target = total * quarter / 4;
+        let (mut low, mut high) = (0u64, 1u64 << 32);
+        while high - low > 1 {
+            let mid = (low + high) / 2;
+            let key = (mid as u32).to_be_bytes();
+            if bucket.range_size(None, Some(&key)) < target {
+                low = mid;
+            } else {
+                high = mid;
+            }
+        }
+        splits.push((high.min(u32::MAX as u64) as u32).to_be_bytes());
+    }
+    let mut start: Option<&[u8]> = None;
+    for end in splits.iter().map(|k| Some(&k[..])).chain([None]) {
+        let chunk = exact(start, end);
+        assert!(
+            chunk.abs_diff(total / 4) <= total / 40,
+            "chunk of {chunk} bytes out of {total}"
+        );
+        start = end;
+    }
+    drop(rtx);
+
+    drop(db);
+    cleanup(&path);
+}
+
+// ==================== Bulk Load Tests ====================
+
+#[test]
+fn test_bucket_bulk_load() {
+    use thunderdb::TruncateSequence;
+
+    let path = test_db_path("bucket_bulk_load");
+    cleanup(&path);
+    let mut db = Database::open(&path).expect("open should succeed");
+    let entries: Vec<(Vec<u8>, Vec<u8>)> = (0..20_000u32)
+        .map(|i| (format!("ip{i:08}").into_bytes(), i.to_be_bytes().to_vec()))
+        .collect();
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"geoip").unwrap();
+        wtx.create_bucket(b"other").unwrap();
+        wtx.bucket_put(b"other", b"k", b"v").unwrap();
+        assert!(matches!(
+            wtx.bucket_bulk_load(b"missing", entries.iter().take(1).map(|(k, v)| (k, v))),
+            Err(Error::BucketNotFound { .. })
+        ));
+        // Staged writes count against emptiness.
+        assert!(matches!(
+            wtx.bucket_bulk_load(b"other", entries.iter().take(1).map(|(k, v)| (k, v))),
+            Err(Error::BucketNotEmpty { name }) if name == b"other"
+        ));
+        assert_eq!(
+            wtx.bucket_bulk_load(b"geoip", entries.iter().map(|(k, v)| (k, v)))
+                .unwrap(),
+            20_000
+        );
+        assert_eq!(
+            wtx.bucket_get(b"geoip", b"ip00000042").unwrap(),
+            Some(42u32.to_be_bytes().to_vec())
+        );
+        wtx.commit().expect("commit should succeed");
+    }
+    assert!(db.check().is_empty(), "{:?}", db.check());
+    drop(db);
+
+    let mut db = Database::open(&path).expect("reopen should succeed");
+    {
+        let rtx = db.read_tx();
+        let geoip = rtx.bucket(b"geoip").unwrap();
+        assert!(
+            geoip
+                .iter()
+                .map(|(k, v)| (k.to_vec(), v.to_vec()))
+                .eq(entries.iter().cloned())
+        );
+    }
+
+    // Committed keys count against emptiness; an emptied bucket loads again.
+    let mut wtx = db.write_tx();
+    assert!(matches!(
+        wtx.bucket_bulk_load(b"geoip", entries.iter().take(1).map(|(k, v)| (k, v))),
+        Err(Error::BucketNotEmpty { .. })
+    ));
+    wtx.truncate_bucket(b"geoip", TruncateSequence::Keep)
+        .unwrap();
+    assert_eq!(
+        wtx.bucket_bulk_load(b"geoip", entries.iter().step_by(2).map(|(k, v)| (k, v)))
+            .unwrap(),
+        10_000
+    );
+    wtx.commit().expect("commit should succeed");
+    assert!(db.check().is_empty(), "{:?}", db.check());
+    let rtx = db.read_tx();
+    let geoip = rtx.bucket(b"geoip").unwrap();
+    assert!(
+        geoip
+            .iter()
+            .map(|(k, v)| (k.to_vec(), v.to_vec()))
+            .eq(entries.iter().step_by(2).cloned())
+    );
+
+    drop(rtx);
+    drop(db);
+    cleanup(&path);
+}
+
+#[test]
+fn test_bucket_bulk_load_rejects_unsorted_input() {
+    let path = test_db_path("bucket_bulk_load_unsorted");
+    cleanup(&path);
+    let mut db = Database::open(&path).expect("open should succeed");
+    let mut wtx = db.write_tx();
+    wtx.create_bucket(b"geoip").unwrap();
+
+    let unsorted = [(&b"a"[..], &b"1"[..]), (b"c", b"3"), (b"b", b"2")];
+    assert!(matches!(
+        wtx.bucket_bulk_load(b"geoip", unsorted),
+        Err(Error::KeysOutOfOrder { key }) if key == b"b"
+    ));
+    let duplicated = [(&b"a"[..], &b"1"[..]), (b"a", b"2")];
+    assert!(matches!(
+        wtx.bucket_bulk_load(b"geoip", duplicated),
+        Err(Error::KeysOutOfOrder { key }) if key == b"a"
+    ));
+
+    // Nothing was staged, so the bucket is still empty and loadable.
+    assert_eq!(wtx.bucket_get(b"geoip", b"a").unwrap(), None);
+    wtx.bucket_bulk_load(b"geoip", [(b"a", b"1"), (b"b", b"2")])
+        .unwrap();
+    wtx.commit().expect("commit should succeed");
+
+    drop(db);
+    cleanup(&path);
+}
+
+// ==================== File Lock Tests ====================
+
+#[test]
+fn test_exclusive_open_times_out_while_file_is_held() {
+    use std::thread;
+    use std::time::{Duration, Instant};
+
+    let path = test_db_path("exclusive_open");
+    cleanup(&path);
+    let exclusive = |lock_timeout| DatabaseOptions {
+        exclusive: true,
+        lock_timeout,
+        ..DatabaseOptions::default()
+    };
+    let holder = Database::open_with_options(&path, exclusive(None)).expect("open should succeed");
+
+    // Separate handles contend for the lock as separate processes would.
+    let contender = {
+        let path = path.clone();
+        let options = exclusive(Some(Duration::from_millis(200)));
+        thread::spawn(move || {
+            let start = Instant::now();
+            (Database::open_with_options(&path, options), start.elapsed())
+        })
+    };
+    let (result, elapsed) = contender.join().unwrap();
+    match result {
+        Err(Error::LockTimedOut { waited }) => {
+            assert!(waited >= Duration::from_millis(200), "{waited:?}");
+        }
+        other => panic!("expected LockTimedOut, got {:?}", other.map(|_| ())),
+    }
+    assert!(elapsed < Duration::from_secs(5), "{elapsed:?}");
+
+    // Opens that are not exclusive wait as well.
+    let shared = DatabaseOptions {
+        lock_timeout: Some(Duration::from_millis(50)),
+        ..DatabaseOptions::default()
+    };
+    assert!(matches!(
+        Database::open_with_options(&path, shared),
+        Err(Error::LockTimedOut { .. })
+    ));
+
+    // Without a timeout, an exclusive open waits until the holder closes.
+    let waiter = {
+        let path = path.clone();
+        thread::spawn(move || Database::open_with_options(&path, exclusive(None)).map(|_| ()))
+    };
+    thread::sleep(Duration::from_millis(100));
+    assert!(!waiter.is_finished());
+    drop(holder);
+    waiter
+        .join()
+        .unwrap()
+        .expect("open should succeed once released");
+
+    cleanup(&path);
+}
+
+#[test]
+fn test_exclusive_handle_keeps_lock_through_ensure_bucket() {
+    use std::time::Duration;
+
+    let path = test_db_path("exclusive_ensure_bucket");
+    cleanup(&path);
+    let exclusive = DatabaseOptions {
+        exclusive: true,
+        lock_timeout: Some(Duration::from_millis(50)),
+        ..DatabaseOptions::default()
+    };
+    let mut db =
+        Database::open_with_options(&path, exclusive.clone()).expect("open should succeed");
+    assert!(db.ensure_bucket(b"config", |_| Ok(())).unwrap());
+    assert!(matches!(
+        Database::open_with_options(&path, exclusive.clone()),
+        Err(Error::LockTimedOut { .. })
+    ));
+
+    // Other handles can neither open nor write until it closes.
+    let shared_options = DatabaseOptions {
+        lock_timeout: Some(Duration::from_millis(50)),
+        ..DatabaseOptions::default()
+    };
+    assert!(matches!(
+        Database::open_with_options(&path, shared_options.clone()),
+        Err(Error::LockTimedOut { .. })
+    ));
+
+    drop(db);
+    let mut shared =
+        Database::open_with_options(&path, shared_options).expect("shared open should succeed");
+    assert!(shared.ensure_bucket(b"other", |_| Ok(())).unwrap());
+    drop(shared);
+    cleanup(&path);
+}
+
+// ==================== Read-Only Tests ====================
+
+#[test]
+fn test_read_only_handle_sees_whole_commits_while_writer_commits() {
+    use std::sync::Arc;
+    use std::sync::atomic::{AtomicBool, Ordering};
+    use std::thread;
+
+    const KEYS: u32 = 300;
+    const GENERATIONS: u64 = 60;
+
+    let path = test_db_path("read_only_live_writer");
+    cleanup(&path);
+    let write_generation = |db: &mut Database, generation: u64| {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket_if_not_exists(b"gen").unwrap();
+        // Updating every key rewrites the file in place.
+        for i in 0..KEYS {
+            let value = [generation.to_le_bytes().as_slice(), &[i as u8; 200]].concat();
+            wtx.bucket_put(b"gen", &i.to_be_bytes(), &value).unwrap();
+        }
+        wtx.commit().expect("commit should succeed");
+    };
+    let mut writer = Database::open(&path).expect("open should succeed");
+    write_generation(&mut writer, 0);
+
+    let read_only = DatabaseOptions {
+        read_only: true,
+        ..DatabaseOptions::default()
+    };
+    // Returns the generation every key agrees on.
+    let generation_of = |db: &Database| {
+        let rtx = db.read_tx();
+        let bucket = rtx.bucket(b"gen").unwrap();
+        let generations: Vec<u64> = bucket
+            .iter()
+            .map(|(_, v)| u64::from_le_bytes(v[..8].try_into().unwrap()))
+            .collect();
+        assert_eq!(generations.len(), KEYS as usize);
+        assert!(
+            generations.iter().all(|g| *g == generations[0]),
+            "mixed generations: {generations:?}"
+        );
+        generations[0]
+    };
+
+    let mut reader = Database::open_with_options(&path, read_only.clone()).unwrap();
+    assert_eq!(generation_of(&reader), 0);
+    assert!(!reader.was_recovered());
+
+    let done = Arc::new(AtomicBool::new(false));
+    let writer_thread = {
+        let done = Arc::clone(&done);
+        thread::spawn(move || {
+            for generation in 1..=GENERATIONS {
+                write_generation(&mut writer, generation);
+            }
+            done.store(true, Ordering::SeqCst);
+            writer
+        })
+    };
+
+    // Refreshing and fresh opens both land on whole commits, moving
+    // forward only.
+    let mut last = 0;
+    let mut refreshes = 0;
+    while !done.load(Ordering::SeqCst) {
+        if reader.refresh().unwrap() {
+            refreshes += 1;
+        }
+        let generation = generation_of(&reader);
+        assert!(generation >= last, "{generation} after {last}");
+        last = generation;
+
+        let fresh = Database::open_with_options(&path, read_only.clone()).unwrap();
+        assert!(generation_of(&fresh) >= last);
+    }
+    let writer = writer_thread.join().unwrap();
+    assert!(refreshes > 0);
+
+    // Until refreshed, the handle keeps serving the state it loaded.
+    reader.refresh().unwrap();
+    assert_eq!(generation_of(&reader), GENERATIONS);
+    assert!(!reader.refresh().unwrap());
+
+    drop(writer);
+    drop(reader);
+    cleanup(&path);
+}
+
+#[test]
+fn test_read_only_handle_rejects_writes() {
+    let path = test_db_path("read_only_rejects");
+    cleanup(&path);
+    let read_only = DatabaseOptions {
+        read_only: true,
+        ..DatabaseOptions::default()
+    };
+    // Nothing to read: the file is not created.
+    assert!(Database::open_with_options(&path, read_only.clone()).is_err());
+    assert!(!std::path::Path::new(&path).exists());
+
+    {
+        let mut db = Database::open(&path).expect("open should succeed");
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"b").unwrap();
+        wtx.bucket_put(b"b", b"k", b"v").unwrap();
+        wtx.commit().expect("commit should succeed");
+        db.close().expect("close should succeed");
+    }
+
+    let mut db = Database::open_with_options(&path, read_only.clone()).unwrap();
+    let mut wtx = db.write_tx();
+    wtx.bucket_put(b"b", b"k", b"changed").unwrap();
+    wtx.bucket_delete(b"b", b"k").unwrap();
+    assert!(matches!(wtx.commit(), Err(Error::ReadOnly)));
+    assert!(matches!(db.compact(), Err(Error::ReadOnly)));
+    assert!(matches!(
+        db.ensure_bucket(b"new", |_| Ok(())),
+        Err(Error::ReadOnly)
+    ));
+    assert_eq!(
+        db.read_tx().bucket(b"b").unwrap().get(b"k"),
+        Some(&b"v"[..])
+    );
+    db.close().expect("close should succeed");
+
+    // The file is untouched and still closed cleanly.
+    let db = Database::open(&path).expect("open should succeed");
+    assert!(!db.was_recovered());
+    assert_eq!(
+        db.read_tx().bucket(b"b").unwrap().get(b"k"),
+        Some(&b"v"[..])
+    );
+
+    drop(db);
+    cleanup(&path);
+}
+
+// ==================== Freelist Type Tests ====================
+
+#[test]
+fn test_freelist_type_can_change_between_opens() {
+    let path = test_db_path("freelist_type_switch");
+    cleanup(&path);
+
+    let large = vec![0x42u8; 200 * 1024];
+    let kinds = [
+        FreelistType::HashMap,
+        FreelistType::Array,
+        FreelistType::HashMap,
+    ];
+    for (round, kind) in kinds.into_iter().enumerate() {
+        let options = DatabaseOptions {
+            freelist_type: kind,
+            ..Default::default()
+        };
+        let mut db = Database::open_with_options(&path, options).expect("open should succeed");
+        for earlier in 0..round {
+            let key = format!("large_{earlier}");
+            let rtx = db.read_tx();
+            assert_eq!(rtx.get(key.as_bytes()).as_deref(), Some(&large[..]));
+        }
+
+        let mut wtx = db.write_tx();
+        wtx.put(format!("large_{round}").as_bytes(), &large);
+        wtx.delete(b"small");
+        wtx.put(b"small", format!("round {round}").as_bytes());
+        wtx.commit().expect("commit should succeed");
+        assert!(db.check().is_empty(), "{kind:?}");
+        db.close().expect("close should succeed");
+    }
+
+    cleanup(&path);
+}
+
+// ==================== Mmap Size Tests ====================
+
+/// Commits `rounds` transactions of 256 KiB each, returning what was
+/// written.
+fn grow_by_commits(db: &mut Database, rounds: usize) -> Vec<(String, Vec<u8>)> {
+    let mut written = Vec::new();
+    for round in 0..rounds {
+        let mut wtx = db.write_tx();
+        for i in 0..64 {
+            let key = format!("chunk_{round:03}_{i:02}");
+            let value = vec![(round * 64 + i) as u8; 4096];
+            wtx.put(key.as_bytes(), &value);
+            written.push((key, value));
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+    written
+}
+
+#[cfg(unix)]
+#[test]
+fn test_initial_mmap_size_avoids_remaps() {
+    let path = test_db_path("mmap_presize");
+    cleanup(&path);
+
+    // Growing to ~10 MiB from an unsized mapping remaps several times.
+    let mut db = Database::open(&path).expect("open should succeed");
+    grow_by_commits(&mut db, 40);
+    let info = db.info();
+    assert!(info.remaps >= 3, "{info:?}");
+    assert!(info.mmap_size as u64 >= info.data_size);
+    drop(db);
+    cleanup(&path);
+
+    let options = DatabaseOptions {
+        initial_mmap_size: 64 * 1024 * 1024,
+        ..Default::default()
+    };
+    let mut db = Database::open_with_options(&path, options).expect("open should succeed");
+    assert_eq!(db.info().mmap_size, 64 * 1024 * 1024);
+    grow_by_commits(&mut db, 40);
+    let info = db.info();
+    assert_eq!(info.remaps, 0, "{info:?}");
+    assert_eq!(info.mmap_size, 64 * 1024 * 1024);
+    assert!(info.data_size > 10 * 1024 * 1024);
+    assert_eq!(info.mmap_headroom(), 64 * 1024 * 1024 - info.data_size);
+
+    drop(db);
+    cleanup(&path);
+}
+
+#[cfg(unix)]
+#[test]
+fn test_data_is_intact_after_mmap_grows() {
+    let path = test_db_path("mmap_grow");
+    cleanup(&path);
+
+    let options = DatabaseOptions {
+        initial_mmap_size: 1024 * 1024,
+        ..Default::default()
+    };
+    let mut db = Database::open_with_options(&path, options).expect("open should succeed");
+    let written = grow_by_commits(&mut db, 16);
+    let info = db.info();
+    assert!(info.remaps >= 1, "{info:?}");
+    assert!(info.mmap_size as u64 >= info.data_size);
+
+    for (key, value) in &written {
+        assert_eq!(db.read_tx().get(key.as_bytes()).as_ref(), Some(value));
+    }
+    // The grown mapping shows the file as written.
+    let on_disk = fs::read(&path).unwrap();
+    assert_eq!(on_disk.len() as u64, info.data_size);
+    assert_eq!(db.mmap_slice(0, on_disk.len()), Some(&on_disk[..]));
+    assert_eq!(db.mmap_slice(0, on_disk.len() + 1), None);
+    db.close().expect("close should succeed");
+
+    let db = Database::open(&path).expect("reopen should succeed");
+    for (key, value) in &written {
+        assert_eq!(db.read_tx().get(key.as_bytes()).as_ref(), Some(value));
+    }
+
+    drop(db);
+    cleanup(&path);
+}
+
+// ==================== Merge Operator Tests ====================
+
+/// Options whose merge operator adds little-endian u64 counters.
+fn counter_merge_options() -> DatabaseOptions {
+    DatabaseOptions {
+        merge_operator: Some(MergeOperator::new(|existing, operand| {
+            let read = |v: &[u8]| u64::from_le_bytes(v.try_into().unwrap());
+            (existing.map_or(0, read) + read(operand))
+                .to_le_bytes()
+                .to_vec()
+        })),
+        ..Default::default()
+    }
+}
+
+#[test]
+fn test_bucket_merge_combines_with_existing_value() {
+    let path = test_db_path("merge_basic");
+    cleanup(&path);
+
+    {
+        let mut db = Database::open(&path).expect("open should succeed");
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"counters").unwrap();
+        assert!(matches!(
+            wtx.bucket_merge(b"counters", b"hits", &1u64.to_le_bytes()),
+            Err(Error::MergeOperatorMissing)
+        ));
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let mut db =
+        Database::open_with_options(&path, counter_merge_options()).expect("open should succeed");
+    let mut wtx = db.write_tx();
+    assert!(matches!(
+        wtx.bucket_merge(b"missing", b"hits", &1u64.to_le_bytes()),
+        Err(Error::BucketNotFound { .. })
+    ));
+    // Merges see the transaction's own writes, even without
+    // read-your-writes.
+    wtx.disable_read_your_writes();
+    wtx.bucket_merge(b"counters", b"hits", &5u64.to_le_bytes())
+        .unwrap();
+    wtx.bucket_merge(b"counters", b"hits", &2u64.to_le_bytes())
+        .unwrap();
+    wtx.bucket_put(b"counters", b"reset", &10u64.to_le_bytes())
+        .unwrap();
+    wtx.bucket_merge(b"counters", b"reset", &1u64.to_le_bytes())
+        .unwrap();
+    wtx.commit().expect("commit should succeed");
+
+    let mut wtx = db.write_tx();
+    wtx.bucket_merge(b"counters", b"hits", &3u64.to_le_bytes())
+        .unwrap();
+    wtx.commit().expect("commit should succeed");
+    drop(db);
+
+    // Merged values are plain values; reading needs no operator.
+    let db = Database::open(&path).expect("reopen should succeed");
+    let rtx = db.read_tx();
+    let counters = rtx.bucket(b"counters").unwrap();
+    assert_eq!(counters.get(b"hits"), Some(&10u64.to_le_bytes()[..]));
+    assert_eq!(counters.get(b"reset"), Some(&11u64.to_le_bytes()[..]));
+    drop(rtx);
+
+    drop(db);
+    cleanup(&path);
+}
+
+#[test]
+fn test_concurrent_merges_are_all_applied() {
+    use std::sync::{Arc, Mutex};
+
+    const THREADS: u64 = 8;
+    const MERGES: u64 = 100;
+
+    let path = test_db_path("merge_concurrent");
+    cleanup(&path);
+    let mut db =
+        Database::open_with_options(&path, counter_merge_options()).expect("open should succeed");
+    db.update(|wtx| wtx.create_bucket(b"counters")).unwrap();
+
+    // Through a shared handle, one transaction per merge.
+    let shared = Arc::new(Mutex::new(db));
+    std::thread::scope(|s| {
+        for _ in 0..THREADS {
+            let shared = &shared;
+            s.spawn(move || {
+                for _ in 0..MERGES {
+                    shared
+                        .lock()
+                        .unwrap()
+                        .update(|wtx| wtx.bucket_merge(b"counters", b"n", &1u64.to_le_bytes()))
+                        .expect("merge should commit");
+                }
+            });
+        }
+    });
+    let db = Arc::into_inner(shared).unwrap().into_inner().unwrap();
+
+    // Through the background committer, coalesced into shared transactions.
+    let committer = BackgroundCommitter::start(db);
+    std::thread::scope(|s| {
+        for _ in 0..THREADS {
+            let committer = &committer;
+            s.spawn(move || {
+                let pending: Vec<_> = (0..MERGES)
+                    .map(|_| {
+                        committer.submit_update(|wtx| {
+                            wtx.bucket_merge(b"counters", b"n", &1u64.to_le_bytes())
+                        })
+                    })
+                    .collect();
+                for done in pending {
+                    done.recv().unwrap().expect("merge should commit");
+                }
+            });
+        }
+    });
+    let db = committer.shutdown();
+    drop(db);
+
+    let db = Database::open(&path).expect("reopen should succeed");
+    let expected = 2 * THREADS * MERGES;
+    assert_eq!(
+        db.read_tx().bucket(b"counters").unwrap().get(b"n"),
+        Some(&expected.to_le_bytes()[..])
+    );
+
+    drop(db);
+    cleanup(&path);
+}
+
+// ==================== JSON Export Tests ====================
+
+#[test]
+fn test_export_json_roundtrip_into_fresh_database() {
+    let source_path = test_db_path("export_source");
+    let copy_path = test_db_path("export_copy");
+    cleanup(&source_path);
+    cleanup(&copy_path);
+
+    let mut db = Database::open(&source_path).expect("open should succeed");
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"users").unwrap();
+        wtx.bucket_put(b"users", b"alice", b"1").unwrap();
+        wtx.bucket_put(b"users", b"quote\"key", &[0, 0xFF, b'"', b'\\'])
+            .unwrap();
+        wtx.bucket_put(b"users", &[0xC3, 0x28], b"").unwrap();
+        wtx.create_bucket(b"empty").unwrap();
+        wtx.create_bucket(&[0xFE, b'b']).unwrap();
+        wtx.bucket_put(&[0xFE, b'b'], b"k", b"binary bucket name")
+            .unwrap();
+
+        wtx.create_bucket(b"tree").unwrap();
+        wtx.bucket_put(b"tree", b"root", b"r").unwrap();
+        wtx.create_nested_bucket(b"tree", b"a").unwrap();
+        wtx.nested_bucket_put(b"tree", b"a", b"leaf", b"1").unwrap();
+        wtx.create_nested_bucket_at_path(&[b"tree", b"a"], b"b")
+            .unwrap();
+        wtx.nested_bucket_put_at_path(&[b"tree", b"a", b"b"], b"deep", b"2")
+            .unwrap();
+        wtx.create_nested_bucket(b"tree", b"c").unwrap();
+
+        // Enough data to span several import batches.
+        wtx.create_bucket(b"bulk").unwrap();
+        for i in 0..40_000u32 {
+            let value = vec![(i % 251) as u8; 250];
+            wtx.bucket_put(b"bulk", format!("row{i:06}").as_bytes(), &value)
+                .unwrap();
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let mut dump = Vec::new();
+    db.export_json(&mut dump).expect("export should succeed");
+    assert!(dump.len() > thunderdb::IMPORT_BATCH_BYTES);
+    drop(db);
+
+    let mut copy = Database::open(&copy_path).expect("open should succeed");
+    assert_eq!(
+        copy.import_json(&dump[..]).expect("import should succeed"),
+        3 + 1 + 1 + 1 + 1 + 40_000
+    );
+    drop(copy);
+
+    let copy = Database::open(&copy_path).expect("reopen should succeed");
+    let mut again = Vec::new();
+    copy.export_json(&mut again).expect("export should succeed");
+    assert!(again == dump, "re-exported document differs");
+
+    let rtx = copy.read_tx();
+    assert_eq!(
+        rtx.bucket(b"users").unwrap().get(b"quote\"key"),
+        Some(&[0, 0xFF, b'"', b'\\'][..])
+    );
+    assert_eq!(
+        rtx.nested_bucket_at_path(&[b"tree", b"a", b"b"])
+            .unwrap()
+            .get(b"deep"),
+        Some(&b"2"[..])
+    );
+    assert!(rtx.nested_bucket(b"tree", b"c").is_ok());
+    assert_eq!(rtx.bucket(b"empty").unwrap().iter().count(), 0);
+    assert_eq!(rtx.bucket(b"bulk").unwrap().iter().count(), 40_000);
+    drop(rtx);
+    drop(copy);
+
+    cleanup(&source_path);
+    cleanup(&copy_path);
+}
+
+#[test]
+fn test_import_json_rejects_malformed_documents() {
+    let path = test_db_path("import_malformed");
+    cleanup(&path);
+    let mut db = Database::open(&path).expect("open should succeed");
+
+    for doc in [
+        &br#"{"format":"other","version":1,"buckets":[]}"#[..],
+        br#"{"format":"thunder-export","version":2,"buckets":[]}"#,
+        br#"{"buckets":[{"entries":[],"name":"YQ=="}]}"#,
+        br#"{"buckets":[{"name":"YQ==","entries":[["!!","YQ=="]]}]}"#,
+        br#"{"buckets":[{"name":"YQ==","entries":[["YQ==","YQ=="]"#,
+        br#"{"buckets":[]} trailing"#,
+    ] {
+        assert!(
+            matches!(db.import_json(doc), Err(Error::InvalidExport { .. })),
+            "{}",
+            String::from_utf8_lossy(doc)
+        );
+    }
+    assert!(db.read_tx().list_buckets().is_empty());
+
+    drop(db);
+    cleanup(&path);
+}
+
+// ==================== Key Comparator Tests ====================
+
+/// Orders keys by their text, then by their trailing number, so that
+/// "item-2" sorts before "item-10".
+fn numeric_suffix_options() -> DatabaseOptions {
+    fn split(key: &[u8]) -> (&[u8], u64) {
+        let at = key
+            .iter()
+            .rposition(|c| !c.is_ascii_digit())
+            .map_or(0, |i| i + 1);
+        let number = std::str::from_utf8(&key[at..])
+            .ok()
+            .and_then(|digits| digits.parse().ok())
+            .unwrap_or(0);
+        (&key[..at], number)
+    }
+    DatabaseOptions {
+        comparator: Some(KeyComparator::new(|a, b| {
+            split(a).cmp(&split(b)).then_with(|| a.cmp(b))
+        })),
+        ..DatabaseOptions::default()
+    }
+}
+
+#[test]
+fn test_custom_comparator_orders_cursors_and_ranges() {
+    let path = test_db_path("comparator");
+    cleanup(&path);
+
+    let names = [
+        "item-10", "item-2", "item-1", "item-100", "item-21", "a-5", "z-0",
+    ];
+    let expected = [
+        "a-5", "item-1", "item-2", "item-10", "item-21", "item-100", "z-0",
+    ];
+    let mut db =
+        Database::open_with_options(&path, numeric_suffix_options()).expect("open should succeed");
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"items").unwrap();
+        wtx.create_nested_bucket(b"items", b"sub").unwrap();
+        for name in names {
+            wtx.bucket_put(b"items", name.as_bytes(), b"v").unwrap();
+            wtx.nested_bucket_put(b"items", b"sub", name.as_bytes(), b"v")
+                .unwrap();
+        }
+        // Keys outside buckets stay byte-wise.
+        wtx.put(b"top-10", b"v");
+        wtx.put(b"top-9", b"v");
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let collect_forward = |db: &Database| {
+        let rtx = db.read_tx();
+        let bucket = rtx.bucket(b"items").unwrap();
+        let mut cursor = bucket.cursor();
+        let mut keys = Vec::new();
+        let mut entry = cursor.first();
+        while let Some((key, _)) = entry {
+            keys.push(String::from_utf8(key.to_vec()).unwrap());
+            entry = cursor.next();
+        }
+        keys
+    };
+    assert_eq!(collect_forward(&db), expected);
+
+    {
+        let rtx = db.read_tx();
+        let bucket = rtx.bucket(b"items").unwrap();
+
+        // Backwards, and seeking to a key between stored ones.
+        let mut cursor = bucket.cursor();
+        let mut backward = Vec::new();
+        let mut entry = cursor.last();
+        while let Some((key, _)) = entry {
+            backward.push(key.to_vec());
+            entry = cursor.prev();
+        }
+        let mut reversed: Vec<_> = expected.iter().map(|k| k.as_bytes().to_vec()).collect();
+        reversed.reverse();
+        assert_eq!(backward, reversed);
+        assert_eq!(
+            cursor.seek(b"item-3").map(|(k, _)| k),
+            Some(&b"item-10"[..])
+        );
+
+        // Range bounds follow the comparator too.
+        let range: Vec<_> = bucket
+            .range(&b"item-2"[..]..&b"item-100"[..])
+            .map(|(k, _)| k.to_vec())
+            .collect();
+        assert_eq!(range, [&b"item-2"[..], b"item-10", b"item-21"]);
+        let mut visited = Vec::new();
+        bucket
+            .for_each_range(Some(b"item-10"), Some(b"z-0"), |k, _| {
+                visited.push(k.to_vec());
+                Ok(())
+            })
+            .unwrap();
+        assert_eq!(visited, [&b"item-10"[..], b"item-21", b"item-100"]);
+
+        let nested: Vec<_> = rtx
+            .nested_bucket(b"items", b"sub")
+            .unwrap()
+            .iter()
+            .map(|(k, _)| String::from_utf8(k.to_vec()).unwrap())
+            .collect();
+        assert_eq!(nested, expected);
+        assert_eq!(rtx.get(b"top-10"), Some(b"v".to_vec()));
+    }
+
+    // A write transaction's cursor merges its staged keys in order.
+    {
+        let mut wtx = db.write_tx();
+        wtx.bucket_put(b"items", b"item-3", b"v").unwrap();
+        let mut cursor = wtx.bucket_cursor(b"items").unwrap();
+        let mut keys = Vec::new();
+        let mut entry = cursor.first().map(|(k, _)| k.to_vec());
+        while let Some(key) = entry {
+            keys.push(String::from_utf8(key).unwrap());
+            entry = cursor.next().map(|(k, _)| k.to_vec());
+        }
+        assert_eq!(
+            keys,
+            [
+                "a-5", "item-1", "item-2", "item-3", "item-10", "item-21", "item-100", "z-0"
+            ]
+        );
+        drop(cursor);
+        wtx.commit().expect("commit should succeed");
+    }
+    drop(db);
+
+    // The order holds after reopening with the same comparator.
+    let db = Database::open_with_options(&path, numeric_suffix_options())
+        .expect("reopen should succeed");
+    assert_eq!(
+        collect_forward(&db),
+        [
+            "a-5", "item-1", "item-2", "item-3", "item-10", "item-21", "item-100", "z-0"
+        ]
+    );
+    assert!(db.check().is_empty());
+
+    drop(db);
+    cleanup(&path);
+}
+
+// ==================== CSV Import Tests ====================
+
+#[test]
+fn test_import_csv_loads_all_rows() {
+    let path = test_db_path("import_csv");
+    cleanup(&path);
+
+    let mut csv = String::from("id;name;score\n");
+    for i in 0..100_000u32 {
+        csv.push_str(&format!("{i};\"user; {i}\";{}\n", i % 97));
+    }
+
+    let mut db = Database::open(&path).expect("open should succeed");
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"users").unwrap();
+        wtx.commit().unwrap();
+    }
+    let options = CsvOptions::default()
+        .columns(0, 1)
+        .delimiter(b';')
+        .has_header(true);
+    let rows = db
+        .import_csv(b"users", csv.as_bytes(), &options)
+        .expect("import should succeed");
+    assert_eq!(rows, 100_000);
+    drop(db);
+
+    let db = Database::open(&path).expect("reopen should succeed");
+    let rtx = db.read_tx();
+    let users = rtx.bucket(b"users").unwrap();
+    for i in 0..100_000u32 {
+        let value = users.get(i.to_string().as_bytes());
+        assert_eq!(value, Some(format!("user; {i}").as_bytes()), "key {i}");
+    }
+    assert_eq!(users.iter().count(), 100_000);
+    drop(rtx);
+    drop(db);
+    cleanup(&path);
+}
+
+#[test]
+fn test_import_csv_reports_line_numbers() {
+    let path = test_db_path("import_csv_errors");
+    cleanup(&path);
+    let mut db = Database::open(&path).expect("open should succeed");
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"b").unwrap();
+        wtx.commit().unwrap();
+    }
+    let options = CsvOptions::default();
+
+    let err = db
+        .import_csv(b"b", &b"a,1\nb,2\n\nc\n"[..], &options)
+        .unwrap_err();
+    assert!(
+        matches!(err, Error::InvalidCsv { line: 4, .. }),
+        "unexpected error: {err}"
+    );
+    let err = db
+        .import_csv(b"b", &b"a,1\n\"b\nc\"x,2\n"[..], &options)
+        .unwrap_err();
+    assert!(
+        matches!(err, Error::InvalidCsv { line: 3, .. }),
+        "unexpected error: {err}"
+    );
+    assert!(matches!(
+        db.import_csv(b"missing", &b"a,1\n"[..], &options),
+        Err(Error::BucketNotFound { .. })
+    ));
+
+    drop(db);
+    cleanup(&path);
+}
+
+// ==================== Scan Limit Tests ====================
+
+#[test]
+fn test_scan_limit_aborts_large_collections() {
+    let path = test_db_path("scan_limit");
+    cleanup(&path);
+    let mut db = Database::open(&path).expect("open should succeed");
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"events").unwrap();
+        for i in 0..1000u32 {
+            wtx.bucket_put(b"events", format!("big/{i:04}").as_bytes(), b"v")
+                .unwrap();
+        }
+        for i in 0..5u32 {
+            wtx.bucket_put(b"events", format!("small/{i}").as_bytes(), b"v")
+                .unwrap();
+            wtx.put(format!("top/{i}").as_bytes(), b"v");
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let mut rtx = db.read_tx();
+    rtx.set_scan_limit(10);
+    assert!(matches!(
+        rtx.bucket_get_prefix(b"events", b"big/"),
+        Err(Error::ScanLimitExceeded { limit: 10 })
+    ));
+    assert!(matches!(
+        rtx.bucket_entries(b"events"),
+        Err(Error::ScanLimitExceeded { limit: 10 })
+    ));
+
+    let small = rtx.bucket_get_prefix(b"events", b"small/").unwrap();
+    assert_eq!(small.len(), 5);
+    assert_eq!(small[0], (b"small/0".to_vec(), b"v".to_vec()));
+    assert_eq!(rtx.get_prefix(b"top/").unwrap().len(), 5);
+
+    // Iterators are not limited.
+    assert_eq!(rtx.bucket(b"events").unwrap().iter().count(), 1005);
+
+    rtx.clear_scan_limit();
+    assert_eq!(rtx.bucket_entries(b"events").unwrap().len(), 1005);
+
+    drop(rtx);
+    drop(db);
+    cleanup(&path);
+}
+
+// ==================== Bucket Checksum Tests ====================
+
+#[test]
+fn test_bucket_checksum_tracks_contents() {
+    let path_a = test_db_path("bucket_checksum_a");
+    let path_b = test_db_path("bucket_checksum_b");
+    cleanup(&path_a);
+    cleanup(&path_b);
+
+    let entries: Vec<(Vec<u8>, Vec<u8>)> = (0..100u32)
+        .map(|i| (format!("key{i:03}").into_bytes(), vec![i as u8; 64]))
+        .collect();
+    let checksum = |db: &Database| db.read_tx().bucket(b"data").unwrap().checksum();
+
+    // Same contents written in different orders and commits.
+    let mut a = Database::open(&path_a).expect("open should succeed");
+    {
+        let mut wtx = a.write_tx();
+        wtx.create_bucket(b"data").unwrap();
+        for (k, v) in &entries {
+            wtx.bucket_put(b"data", k, v).unwrap();
+        }
+        wtx.commit().unwrap();
+    }
+    let mut b = Database::open(&path_b).expect("open should succeed");
+    {
+        let mut wtx = b.write_tx();
+        wtx.create_bucket(b"data").unwrap();
+        wtx.bucket_put(b"data", b"extra", b"gone").unwrap();
+        for (k, v) in entries.iter().rev().take(50) {
+            wtx.bucket_put(b"data", k, v).unwrap();
+        }
+        wtx.commit().unwrap();
+    }
+    {
+        let mut wtx = b.write_tx();
+        for (k, v) in entries.iter().rev().skip(50) {
+            wtx.bucket_put(b"data", k, v).unwrap();
+        }
+        wtx.bucket_delete(b"data", b"extra").unwrap();
+        wtx.commit().unwrap();
+    }
+    assert_eq!(checksum(&a), checksum(&b));
+
+    // A single changed byte in a value or key changes the checksum.
+    let original = checksum(&b);
+    let mut value = entries[42].1.clone();
+    value[7] ^= 1;
+    {
+        let mut wtx = b.write_tx();
+        wtx.bucket_put(b"data", &entries[42].0, &value).unwrap();
+        wtx.commit().unwrap();
+    }
+    assert_ne!(checksum(&b), original);
+    {
+        let mut wtx = b.write_tx();
+        wtx.bucket_put(b"data", &entries[42].0, &entries[42].1)
+            .unwrap();
+        wtx.commit().unwrap();
+    }
+    assert_eq!(checksum(&b), original);
+    {
+        let mut wtx = b.write_tx();
+        wtx.bucket_delete(b"data", b"key099").unwrap();
+        wtx.bucket_put(b"data", b"key098", &entries[98].1).unwrap();
+        wtx.bucket_put(b"data", b"key09:", &entries[99].1).unwrap();
+        wtx.commit().unwrap();
+    }
+    assert_ne!(checksum(&b), original);
+
+    // Checksums survive reopening.
+    let before = checksum(&a);
+    drop(a);
+    let a = Database::open(&path_a).expect("reopen should succeed");
+    assert_eq!(checksum(&a), before);
+
+    drop(a);
+    drop(b);
+    cleanup(&path_a);
+    cleanup(&path_b);
+}
+
+// ==================== Bucket Keys Tests ====================
+
+#[test]
+fn test_bucket_keys_only_scan() {
+    let path = test_db_path("bucket_keys");
+    cleanup(&path);
+    let mut db = Database::open(&path).expect("open should succeed");
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"a").unwrap();
+        wtx.create_bucket(b"docs").unwrap();
+        wtx.create_bucket(b"z").unwrap();
+        wtx.bucket_put(b"a", b"before", b"x").unwrap();
+        wtx.bucket_put(b"z", b"after", b"x").unwrap();
+        for i in 0..500u32 {
+            wtx.bucket_put(
+                b"docs",
+                format!("doc{i:04}").as_bytes(),
+                &vec![i as u8; 2048],
+            )
+            .unwrap();
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+    {
+        let mut wtx = db.write_tx();
+        wtx.bucket_delete(b"docs", b"doc0100").unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let rtx = db.read_tx();
+    let bucket = rtx.bucket(b"docs").unwrap();
+    let keys: Vec<&[u8]> = bucket.keys().collect();
+    let expected: Vec<&[u8]> = bucket.iter().map(|(k, _)| k).collect();
+    assert_eq!(keys.len(), 499);
+    assert_eq!(keys, expected);
+    assert!(!keys.contains(&&b"doc0100"[..]));
+
+    let mut visited = Vec::new();
+    bucket
+        .for_each_key(|key| {
+            visited.push(key.to_vec());
+            Ok(())
+        })
+        .unwrap();
+    assert_eq!(visited, keys);
+    let mut seen = 0;
+    let stopped = bucket.for_each_key(|_| {
+        seen += 1;
+        if seen == 10 {
+            return Err(Error::KeyNotFound);
+        }
+        Ok(())
+    });
+    assert!(matches!(stopped, Err(Error::KeyNotFound)));
+    assert_eq!(seen, 10);
+
+    // Values are still reachable from the keys.
+    for key in keys.iter().step_by(50) {
+        assert_eq!(bucket.get(key).map(|v| v.len()), Some(2048));
+    }
+    assert_eq!(
+        rtx.bucket(b"a").unwrap().keys().collect::<Vec<_>>(),
+        vec![&b"before"[..]]
+    );
+
+    drop(rtx);
+    drop(db);
+    cleanup(&path);
+}
+
+// ==================== Blind Write Tests ====================
+
+#[test]
+fn test_bucket_set_overwrites() {
+    let path = test_db_path("bucket_set");
+    cleanup(&path);
+    let mut db = Database::open(&path).expect("open should succeed");
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"ingest").unwrap();
+        wtx.bucket_set(b"ingest", b"k1", b"first").unwrap();
+        wtx.bucket_set(b"ingest", b"k2", b"first").unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+    {
+        let mut wtx = db.write_tx();
+        wtx.bucket_set(b"ingest", b"k1", b"second").unwrap();
+        wtx.bucket_delete(b"ingest", b"k2").unwrap();
+        wtx.bucket_set(b"ingest", b"k2", b"revived").unwrap();
+        wtx.bucket_set(b"ingest", b"k1", b"third").unwrap();
+        assert!(matches!(
+            wtx.bucket_set(b"missing", b"k", b"v"),
+            Err(Error::BucketNotFound { .. })
+        ));
+        wtx.commit().expect("commit should succeed");
+    }
+
+    drop(db);
+    let db = Database::open(&path).expect("reopen should succeed");
+    let rtx = db.read_tx();
+    let bucket = rtx.bucket(b"ingest").unwrap();
+    assert_eq!(bucket.get(b"k1"), Some(&b"third"[..]));
+    assert_eq!(bucket.get(b"k2"), Some(&b"revived"[..]));
+    assert_eq!(bucket.iter().count(), 2);
+
+    drop(rtx);
+    drop(db);
+    cleanup(&path);
+}
+
+// ==================== Scrub Tests ====================
+
+#[test]
+fn test_scrubber_reports_corrupted_page() {
+    use std::io::{Seek, SeekFrom, Write};
+    use std::sync::mpsc;
+    use std::time::Duration;
+    use thunderdb::ScrubErrorHook;
+
+    let path = test_db_path("scrub");
+    cleanup(&path);
+    let (sender, reports) = mpsc::channel();
+    let sender = std::sync::Mutex::new(sender);
+    let options = DatabaseOptions {
+        scrub_interval: Some(Duration::from_millis(10)),
+        on_scrub_error: Some(ScrubErrorHook::new(move |page_id, err| {
+            let _ = sender.lock().unwrap().send((page_id, err.to_string()));
+        })),
+        ..DatabaseOptions::default()
+    };
+    let mut db = Database::open_with_options(&path, options).expect("open should succeed");
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"archive").unwrap();
+        for i in 0..4u8 {
+            wtx.bucket_put(b"archive", &[b'k', i], &vec![i; 64 * 1024])
+                .unwrap();
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+
+    // Intact data produces no reports across several passes.
+    assert!(reports.recv_timeout(Duration::from_millis(100)).is_err());
+
+    // Flip a byte inside the third overflow value. Values are stored back
+    // to back, each framed by 12 bytes of header and checksum.
+    let overflow: Vec<_> = db
+        .allocation_map()
+        .unwrap()
+        .into_iter()
+        .filter(|range| matches!(range.kind, AllocationKind::Overflow { .. }))
+        .collect();
+    let record_len = 64 * 1024 + 12;
+    assert_eq!(
+        overflow.iter().map(|r| r.size()).sum::<u64>(),
+        4 * record_len
+    );
+    let record = overflow[0].start + 2 * record_len;
+    let mut file = std::fs::OpenOptions::new().write(true).open(&path).unwrap();
+    file.seek(SeekFrom::Start(record + 1000)).unwrap();
+    file.write_all(&[0xFF]).unwrap();
+    file.sync_all().unwrap();
+
+    let (page_id, message) = reports
+        .recv_timeout(Duration::from_secs(10))
+        .expect("scrubber should report the corruption");
+    assert_eq!(page_id, record / db.page_size() as u64);
+    assert!(message.contains("checksum"), "{message}");
+    assert!(reports.recv_timeout(Duration::from_millis(100)).is_err());
+
+    // Reads are served from memory and unaffected.
+    let rtx = db.read_tx();
+    assert_eq!(rtx.bucket(b"archive").unwrap().iter().count(), 4);
+
+    drop(rtx);
+    drop(db);
+    cleanup(&path);
+}
+
+// ==================== Retained Version Stats Tests ====================
+
+#[test]
+fn test_retained_version_stats() {
+    let path = test_db_path("retained_stats");
+    cleanup(&path);
+    let mut db = Database::open(&path).expect("open should succeed");
+    {
+        let mut wtx = db.write_tx();
+        wtx.put(b"key", b"value");
+        wtx.commit().expect("commit should succeed");
+    }
+    assert_eq!(
+        db.retained_version_stats(),
+        thunderdb::RetainedStats::default()
+    );
+    drop(db);
+
+    let options = DatabaseOptions {
+        retain_duration: Some(std::time::Duration::from_secs(3600)),
+        ..DatabaseOptions::default()
+    };
+    let mut db = Database::open_with_options(&path, options).expect("reopen should succeed");
+    let stats = db.retained_version_stats();
+    assert_eq!((stats.versions, stats.tombstones, stats.bytes), (0, 0, 0));
+
+    let commit = |db: &mut Database, puts: &[(&[u8], &[u8])], deletes: &[&[u8]]| {
+        let mut wtx = db.write_tx();
+        for (k, v) in puts {
+            wtx.put(k, v);
+        }
+        for k in deletes {
+            wtx.delete(k);
+        }
+        wtx.commit().expect("commit should succeed");
+    };
+    // Opened state: {key: value} (8 bytes).
+    commit(&mut db, &[(b"a", b"1111"), (b"b", b"2222")], &[]);
+    // {key, a, b}: 18 bytes.
+    commit(&mut db, &[(b"a", b"3333")], &[]);
+    // {key, a, b}: 18 bytes.
+    commit(&mut db, &[], &[b"a", b"b"]);
+    // Current: {key}.
+
+    let stats = db.retained_version_stats();
+    assert_eq!(stats.versions, 3);
+    assert_eq!(stats.tombstones, 2);
+    assert_eq!(stats.bytes, 8 + 18 + 18);
+
+    drop(db);
+    cleanup(&path);
+}
+
+// ==================== Cursor Tests ====================
+
+#[test]
+fn test_cursor_scans_both_directions() {
+    let path = test_db_path("cursor_reverse");
+    cleanup(&path);
+    let mut db = Database::open(&path).expect("open should succeed");
+    {
+        let mut wtx = db.write_tx();
+        // Neighboring buckets on both sides must not leak into the scan.
+        wtx.create_bucket(b"a").unwrap();
+        wtx.create_bucket(b"events").unwrap();
+        wtx.create_bucket(b"zz").unwrap();
+        wtx.bucket_put(b"a", b"k", b"v").unwrap();
+        wtx.bucket_put(b"zz", b"k", b"v").unwrap();
+        for i in 0..10_000u32 {
+            wtx.bucket_put(b"events", format!("{i:05}").as_bytes(), &i.to_le_bytes())
+                .unwrap();
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let rtx = db.read_tx();
+    let bucket = rtx.bucket(b"events").unwrap();
+
+    let mut cursor = bucket.cursor();
+    let mut forward = Vec::new();
+    let mut entry = cursor.first();
+    while let Some((key, _)) = entry {
+        forward.push(key.to_vec());
+        entry = cursor.next();
+    }
+    assert_eq!(forward.len(), 10_000);
+    assert_eq!(cursor.next(), None);
+
+    let mut cursor = bucket.cursor();
+    let mut backward = Vec::new();
+    let mut entry = cursor.last();
+    while let Some((key, value)) = entry {
+        assert_eq!(bucket.get(key), Some(value));
+        backward.push(key.to_vec());
+        entry = cursor.prev();
+    }
+    assert_eq!(cursor.prev(), None);
+    backward.reverse();
+    assert_eq!(backward, forward);
+
+    // Mixing directions steps back over the entry just returned.
+    let mut cursor = bucket.cursor();
+    assert_eq!(cursor.prev(), None);
+    assert_eq!(cursor.next().unwrap().0, b"00000");
+    assert_eq!(cursor.next().unwrap().0, b"00001");
+    assert_eq!(cursor.prev().unwrap().0, b"00000");
+    assert_eq!(cursor.prev(), None);
+    assert_eq!(cursor.next().unwrap().0, b"00000");
+    assert_eq!(cursor.last().unwrap().0, b"09999");
+    assert_eq!(cursor.next(), None);
+    assert_eq!(cursor.prev().unwrap().0, b"09999");
+    assert_eq!(cursor.prev().unwrap().0, b"09998");
+
+    // An empty bucket has no entries in either direction.
+    drop(rtx);
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"empty").unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+    let rtx = db.read_tx();
+    let mut cursor = rtx.bucket(b"empty").unwrap().cursor();
+    assert_eq!(cursor.first(), None);
+    assert_eq!(cursor.last(), None);
+    assert_eq!(cursor.next(), None);
+    assert_eq!(cursor.prev(), None);
+
+    drop(rtx);
+    drop(db);
+    cleanup(&path);
+}
+
+#[test]
+fn test_cursor_seek() {
+    let path = test_db_path("cursor_seek");
+    cleanup(&path);
+    let mut db = Database::open(&path).expect("open should succeed");
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"log").unwrap();
+        wtx.create_bucket(b"next").unwrap();
+        wtx.bucket_put(b"next", b"0", b"other").unwrap();
+        // Even keys only, so odd targets fall between two keys.
+        for i in (0..2000u32).step_by(2) {
+            wtx.bucket_put(b"log", format!("{i:04}").as_bytes(), b"v")
+                .unwrap();
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let rtx = db.read_tx();
+    let bucket = rtx.bucket(b"log").unwrap();
+    let mut cursor = bucket.cursor();
+
+    // Exact hit.
+    assert_eq!(cursor.seek(b"1000").unwrap().0, b"1000");
+    // Between two keys lands on the successor.
+    assert_eq!(cursor.seek(b"1001").unwrap().0, b"1002");
+    assert_eq!(cursor.seek(b"10015").unwrap().0, b"1002");
+    // Stepping continues from the sought position.
+    assert_eq!(cursor.next().unwrap().0, b"1004");
+    assert_eq!(cursor.prev().unwrap().0, b"1002");
+    assert_eq!(cursor.prev().unwrap().0, b"1000");
+
+    // Before every key: the first entry; nothing before it.
+    assert_eq!(cursor.seek(b"").unwrap().0, b"0000");
+    assert_eq!(cursor.prev(), None);
+    assert_eq!(cursor.next().unwrap().0, b"0000");
+
+    // Past every key: nothing, then stepping back finds the last entry.
+    assert_eq!(cursor.seek(b"2000"), None);
+    assert_eq!(cursor.next(), None);
+    assert_eq!(cursor.prev().unwrap().0, b"1998");
+
+    // A prefix scan built on seek.
+    let mut prefixed = Vec::new();
+    let mut entry = cursor.seek(b"19");
+    while let Some((key, _)) = entry.filter(|(k, _)| k.starts_with(b"19")) {
+        prefixed.push(key.to_vec());
+        entry = cursor.next();
+    }
+    assert_eq!(prefixed.len(), 50);
+    assert_eq!(prefixed.first().unwrap(), b"1900");
+    assert_eq!(prefixed.last().unwrap(), b"1998");
+
+    drop(rtx);
+    drop(db);
+    cleanup(&path);
+}
+
+#[test]
+fn test_bucket_delete_and_cursor_delete() {
+    let path = test_db_path("cursor_delete");
+    cleanup(&path);
+    let mut db = Database::open(&path).expect("open should succeed");
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"jobs").unwrap();
+        for i in 0..10u32 {
+            wtx.bucket_put(b"jobs", format!("{i:02}").as_bytes(), &[(i % 2) as u8])
+                .unwrap();
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+
+    // Deleting an absent key is a no-op.
+    {
+        let mut wtx = db.write_tx();
+        wtx.bucket_delete(b"jobs", b"missing").unwrap();
+        wtx.bucket_delete(b"jobs", b"03").unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+
+    // Delete every odd entry while iterating; the cursor moves on to the
+    // entry after each deleted one.
+    {
+        let mut wtx = db.write_tx();
+        let mut cursor = wtx.bucket_cursor(b"jobs").unwrap();
+        // Not on an entry yet: nothing to delete.
+        cursor.delete().unwrap();
+
+        let mut visited = Vec::new();
+        let mut entry = cursor.first();
+        while let Some((key, value)) = entry {
+            visited.push(key.to_vec());
+            if value == [1] {
+                cursor.delete().unwrap();
+            }
+            entry = cursor.next();
+        }
+        assert_eq!(visited.len(), 9);
+        assert_eq!(visited[3], b"04");
+
+        // Stepping back after running out still works, skipping the
+        // entries deleted on the way.
+        assert_eq!(cursor.prev().unwrap().0, b"08");
+        assert_eq!(cursor.prev().unwrap().0, b"06");
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let rtx = db.read_tx();
+    let bucket = rtx.bucket(b"jobs").unwrap();
+    let keys: Vec<Vec<u8>> = bucket.iter().map(|(k, _)| k.to_vec()).collect();
+    assert_eq!(
+        keys,
+        vec![
+            b"00".to_vec(),
+            b"02".to_vec(),
+            b"04".to_vec(),
+            b"06".to_vec(),
+            b"08".to_vec()
+        ]
+    );
+    drop(rtx);
+
+    assert!(matches!(
+        db.write_tx().bucket_cursor(b"nope"),
+        Err(Error::BucketNotFound { .. })
+    ));
+
+    drop(db);
+    cleanup(&path);
+}
+
+#[test]
+fn test_write_tx_reads_its_own_writes() {
+    let path = test_db_path("read_own_writes");
+    cleanup(&path);
+    let mut db = Database::open(&path).expect("open should succeed");
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"kv").unwrap();
+        for key in [b"a", b"c", b"e", b"g"] {
+            wtx.bucket_put(b"kv", key, b"committed").unwrap();
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let mut wtx = db.write_tx();
+    // Put then get.
+    wtx.bucket_put(b"kv", b"b", b"staged").unwrap();
+    wtx.bucket_put(b"kv", b"c", b"staged").unwrap();
+    assert_eq!(
+        wtx.bucket_get(b"kv", b"b").unwrap(),
+        Some(b"staged".to_vec())
+    );
+    assert_eq!(
+        wtx.bucket_get(b"kv", b"c").unwrap(),
+        Some(b"staged".to_vec())
+    );
+    // Delete then get.
+    wtx.bucket_delete(b"kv", b"e").unwrap();
+    wtx.bucket_delete(b"kv", b"b").unwrap();
+    assert_eq!(wtx.bucket_get(b"kv", b"e").unwrap(), None);
+    assert_eq!(wtx.bucket_get(b"kv", b"b").unwrap(), None);
+
+    // A cursor sees the same state, both ways.
+    let mut cursor = wtx.bucket_cursor(b"kv").unwrap();
+    let mut forward = Vec::new();
+    let mut entry = cursor.first();
+    while let Some((key, value)) = entry {
+        forward.push((key.to_vec(), value.to_vec()));
+        entry = cursor.next();
+    }
+    assert_eq!(
+        forward,
+        vec![
+            (b"a".to_vec(), b"committed".to_vec()),
+            (b"c".to_vec(), b"staged".to_vec()),
+            (b"g".to_vec(), b"committed".to_vec()),
+        ]
+    );
+    assert_eq!(cursor.prev().unwrap().0, b"g");
+    assert_eq!(cursor.prev().unwrap().0, b"c");
+    assert_eq!(cursor.seek(b"d").unwrap().0, b"g");
+
+    // Mutations through an open cursor show up as it moves on.
+    assert_eq!(cursor.first().unwrap().0, b"a");
+    cursor.put(b"f", b"new").unwrap();
+    cursor.put(b"0", b"behind").unwrap();
+    assert_eq!(cursor.next().unwrap().0, b"c");
+    cursor.delete().unwrap();
+    assert_eq!(cursor.next(), Some((&b"f"[..], &b"new"[..])));
+    assert_eq!(cursor.next().unwrap().0, b"g");
+    assert_eq!(cursor.next(), None);
+    assert_eq!(cursor.prev().unwrap().0, b"g");
+    assert_eq!(cursor.prev().unwrap().0, b"f");
+    assert_eq!(cursor.prev().unwrap().0, b"a");
+    assert_eq!(cursor.prev().unwrap().0, b"0");
+    assert_eq!(cursor.prev(), None);
+    assert_eq!(wtx.bucket_get(b"kv", b"c").unwrap(), None);
+    wtx.commit().expect("commit should succeed");
+
+    let rtx = db.read_tx();
+    let keys: Vec<Vec<u8>> = rtx
+        .bucket(b"kv")
+        .unwrap()
+        .iter()
+        .map(|(k, _)| k.to_vec())
+        .collect();
+    assert_eq!(keys, [&b"0"[..], b"a", b"f", b"g"]);
+    drop(rtx);
+
+    // A bucket created in the transaction is readable before commit.
+    let mut wtx = db.write_tx();
+    wtx.create_bucket(b"fresh").unwrap();
+    wtx.bucket_put(b"fresh", b"k", b"v").unwrap();
+    assert_eq!(wtx.bucket_get(b"fresh", b"k").unwrap(), Some(b"v".to_vec()));
+    let mut cursor = wtx.bucket_cursor(b"fresh").unwrap();
+    assert_eq!(cursor.last(), Some((&b"k"[..], &b"v"[..])));
+    drop(wtx);
+
+    drop(db);
+    cleanup(&path);
+}
+
+#[test]
+fn test_bucket_for_each_stops_at_error() {
+    let path = test_db_path("for_each");
+    cleanup(&path);
+    let mut db = Database::open(&path).expect("open should succeed");
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"items").unwrap();
+        wtx.create_bucket(b"items2").unwrap();
+        wtx.bucket_put(b"items2", b"a", b"other").unwrap();
+        for i in (0..10u8).rev() {
+            wtx.bucket_put(b"items", &[b'k', i], &[i]).unwrap();
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let rtx = db.read_tx();
+    let bucket = rtx.bucket(b"items").unwrap();
+
+    let mut seen = Vec::new();
+    bucket
+        .for_each(|key, value| {
+            assert_eq!(key[1], value[0]);
+            seen.push(key.to_vec());
+            Ok(())
+        })
+        .unwrap();
+    assert_eq!(seen, (0..10u8).map(|i| vec![b'k', i]).collect::<Vec<_>>());
+
+    // A sentinel error stops the scan at exactly the key that returned it.
+    let mut seen = Vec::new();
+    let result = bucket.for_each(|key, _| {
+        seen.push(key.to_vec());
+        if key == [b'k', 6] {
+            return Err(Error::KeyNotFound);
+        }
+        Ok(())
+    });
+    assert!(matches!(result, Err(Error::KeyNotFound)));
+    assert_eq!(seen, (0..=6u8).map(|i| vec![b'k', i]).collect::<Vec<_>>());
+
+    drop(rtx);
+    drop(db);
+    cleanup(&path);
+}
+
+#[test]
+fn test_bucket_for_each_prefix() {
+    let path = test_db_path("for_each_prefix");
+    cleanup(&path);
+    let mut db = Database::open(&path).expect("open should succeed");
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"users").unwrap();
+        wtx.create_bucket(b"users2").unwrap();
+        wtx.bucket_put(b"users2", b"user:4:name", b"other").unwrap();
+        for id in 1..=5u32 {
+            for field in ["email", "name", "role"] {
+                let key = format!("user:{id}:{field}");
+                wtx.bucket_put(b"users", key.as_bytes(), field.as_bytes())
+                    .unwrap();
+            }
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let rtx = db.read_tx();
+    let bucket = rtx.bucket(b"users").unwrap();
+
+    let mut fields = Vec::new();
+    bucket
+        .for_each_prefix(b"user:4:", |key, value| {
+            assert_eq!(&key[b"user:4:".len()..], value);
+            fields.push(key.to_vec());
+            Ok(())
+        })
+        .unwrap();
+    assert_eq!(
+        fields,
+        vec![
+            b"user:4:email".to_vec(),
+            b"user:4:name".to_vec(),
+            b"user:4:role".to_vec()
+        ]
+    );
+
+    // No match, and a prefix past every key.
+    let mut count = 0;
+    bucket
+        .for_each_prefix(b"user:9:", |_, _| {
+            count += 1;
+            Ok(())
+        })
+        .unwrap();
+    bucket
+        .for_each_prefix(b"zzz", |_, _| {
+            count += 1;
+            Ok(())
+        })
+        .unwrap();
+    assert_eq!(count, 0);
+
+    // The empty prefix visits the whole bucket.
+    bucket
+        .for_each_prefix(b"", |_, _| {
+            count += 1;
+            Ok(())
+        })
+        .unwrap();
+    assert_eq!(count, 15);
+
+    // An error stops the scan and is returned.
+    let mut visited = 0;
+    let result = bucket.for_each_prefix(b"user:2:", |key, _| {
+        visited += 1;
+        if key.ends_with(b"name") {
+            return Err(Error::KeyNotFound);
+        }
+        Ok(())
+    });
+    assert!(matches!(result, Err(Error::KeyNotFound)));
+    assert_eq!(visited, 2);
+
+    drop(rtx);
+    drop(db);
+    cleanup(&path);
+}
+
+#[test]
+fn test_bucket_for_each_range() {
+    let path = test_db_path("for_each_range");
+    cleanup(&path);
+    let mut db = Database::open(&path).expect("open should succeed");
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"series").unwrap();
+        wtx.create_bucket(b"series2").unwrap();
+        wtx.bucket_put(b"series2", b"15", b"other").unwrap();
+        // Keys 10, 20, ..., 90.
+        for i in 1..10u32 {
+            wtx.bucket_put(b"series", format!("{}", i * 10).as_bytes(), b"v")
+                .unwrap();
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let rtx = db.read_tx();
+    let bucket = rtx.bucket(b"series").unwrap();
+    let collect = |start: Option<&[u8]>, end: Option<&[u8]>| {
+        let mut keys = Vec::new();
+        bucket
+            .for_each_range(start, end, |key, _| {
+                keys.push(String::from_utf8(key.to_vec()).unwrap());
+                Ok(())
+            })
+            .unwrap();
+        keys
+    };
+
+    // Start inclusive, end exclusive, on existing keys.
+    assert_eq!(collect(Some(b"30"), Some(b"60")), ["30", "40", "50"]);
+    // Bounds straddling keys.
+    assert_eq!(collect(Some(b"25"), Some(b"55")), ["30", "40", "50"]);
+    assert_eq!(collect(Some(b"29"), Some(b"31")), ["30"]);
+    // Unbounded sides.
+    assert_eq!(collect(None, Some(b"30")), ["10", "20"]);
+    assert_eq!(collect(Some(b"80"), None), ["80", "90"]);
+    assert_eq!(collect(None, None).len(), 9);
+
+    // Empty ranges.
+    assert!(collect(Some(b"30"), Some(b"30")).is_empty());
+    assert!(collect(Some(b"31"), Some(b"39")).is_empty());
+    assert!(collect(Some(b"95"), None).is_empty());
+    assert!(collect(None, Some(b"0")).is_empty());
+    // Start after end.
+    assert!(collect(Some(b"70"), Some(b"20")).is_empty());
+
+    // An error stops the scan and is returned.
+    let mut visited = 0;
+    let result = bucket.for_each_range(Some(b"20"), None, |_, _| {
+        visited += 1;
+        if visited == 3 {
+            return Err(Error::KeyNotFound);
+        }
+        Ok(())
+    });
+    assert!(matches!(result, Err(Error::KeyNotFound)));
+    assert_eq!(visited, 3);
+
+    drop(rtx);
+    drop(db);
+    cleanup(&path);
+}
+
+#[test]
+fn test_bucket_iter_with_buckets() {
+    let path = test_db_path("iter_with_buckets");
+    cleanup(&path);
+    let mut db = Database::open(&path).expect("open should succeed");
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"root").unwrap();
+        wtx.bucket_put(b"root", b"a", b"1").unwrap();
+        wtx.bucket_put(b"root", b"c", b"3").unwrap();
+        wtx.bucket_put(b"root", b"e", b"5").unwrap();
+        wtx.create_nested_bucket(b"root", b"b").unwrap();
+        wtx.create_nested_bucket(b"root", b"dd").unwrap();
+        wtx.create_nested_bucket(b"root", b"z").unwrap();
+        wtx.create_nested_bucket_at_path(&[b"root", b"b"], b"deep")
+            .unwrap();
+        wtx.nested_bucket_put(b"root", b"b", b"k", b"v").unwrap();
+        wtx.nested_bucket_put_at_path(&[b"root", b"b", b"deep"], b"k", b"deep")
+            .unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+
+    {
+        let rtx = db.read_tx();
+        let bucket = rtx.bucket(b"root").unwrap();
+        let items: Vec<(Vec<u8>, Option<Vec<u8>>)> = bucket
+            .iter_with_buckets()
+            .map(|(k, v)| (k.to_vec(), v.map(<[u8]>::to_vec)))
+            .collect();
+        assert_eq!(
+            items,
+            vec![
+                (b"a".to_vec(), Some(b"1".to_vec())),
+                (b"b".to_vec(), None),
+                (b"c".to_vec(), Some(b"3".to_vec())),
+                (b"dd".to_vec(), None),
+                (b"e".to_vec(), Some(b"5".to_vec())),
+                (b"z".to_vec(), None),
+            ]
+        );
+
+        // Sub-buckets are reachable from their parent.
+        let child = bucket.bucket(b"b").unwrap();
+        assert_eq!(child.get(b"k"), Some(&b"v"[..]));
+        assert!(matches!(
+            bucket.bucket(b"missing"),
+            Err(Error::BucketNotFound { .. })
+        ));
+    }
+
+    // Deleting the parent removes every nested bucket and its data.
+    {
+        let mut wtx = db.write_tx();
+        wtx.delete_bucket(b"root").unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"root").unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+    let rtx = db.read_tx();
+    let bucket = rtx.bucket(b"root").unwrap();
+    assert_eq!(bucket.iter_with_buckets().count(), 0);
+    assert!(!rtx.nested_bucket_exists_at_path(&[b"root", b"b", b"deep"]));
+
+    drop(rtx);
+    drop(db);
+    cleanup(&path);
+}
+
+#[test]
+fn test_snapshot_outlives_transactions() {
+    let path = test_db_path("snapshot_outlives_tx");
+    cleanup(&path);
+    let mut db = Database::open(&path).expect("open should succeed");
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"export").unwrap();
+        for i in 0..500u32 {
+            wtx.bucket_put(b"export", format!("{i:04}").as_bytes(), b"original")
+                .unwrap();
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let snapshot = db.snapshot();
+    assert_eq!(db.snapshot_stats().active_snapshots, 1);
+
+    // Stream the snapshot on another thread while commits continue.
+    let (tx, rx) = std::sync::mpsc::channel::<()>();
+    let reader = std::thread::spawn(move || {
+        let bucket = snapshot.bucket(b"export").unwrap();
+        let mut cursor = bucket.cursor();
+        let mut entry = cursor.first();
+        let mut count = 0;
+        while let Some((_, value)) = entry {
+            assert_eq!(value, b"original");
+            count += 1;
+            if count == 250 {
+                // Let the writer commit halfway through the export.
+                rx.recv().unwrap();
+            }
+            entry = cursor.next();
+        }
+        assert_eq!(snapshot.get_ref(b"missing"), None);
+        snapshot.release();
+        count
+    });
+
+    for round in 0..5u32 {
+        let mut wtx = db.write_tx();
+        for i in 0..500u32 {
+            let key = format!("{i:04}");
+            if i % 5 == round {
+                wtx.bucket_delete(b"export", key.as_bytes()).unwrap();
+            } else {
+                wtx.bucket_put(b"export", key.as_bytes(), b"updated")
+                    .unwrap();
+            }
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+    tx.send(()).unwrap();
+
+    assert_eq!(reader.join().unwrap(), 500);
+    assert_eq!(db.snapshot_stats().active_snapshots, 0);
+
+    let rtx = db.read_tx();
+    let bucket = rtx.bucket(b"export").unwrap();
+    assert_eq!(bucket.get(b"0004"), None);
+    assert_eq!(bucket.get(b"0003"), Some(&b"updated"[..]));
+    drop(rtx);
+
+    drop(db);
+    cleanup(&path);
+}
+
+// ==================== Backup Tests ====================
+
+#[test]
+fn test_hot_backup_during_writes() {
+    let path = test_db_path("hot_backup");
+    let backup_path = test_db_path("hot_backup_copy");
+    cleanup(&path);
+    cleanup(&backup_path);
+    let mut db = Database::open(&path).expect("open should succeed");
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"data").unwrap();
+        for i in 0..300u32 {
+            wtx.bucket_put(b"data", format!("{i:04}").as_bytes(), &[i as u8; 64])
+                .unwrap();
+        }
+        // One overflow value.
+        wtx.bucket_put(b"data", b"large", &vec![7u8; 100_000])
+            .unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+
+    // Write the backup on another thread while commits continue.
+    let backup = db.begin_backup();
+    let writer_path = backup_path.clone();
+    let copier = std::thread::spawn(move || {
+        let mut file = fs::File::create(&writer_path).unwrap();
+        backup.write_to(&mut file)
+    });
+    for round in 0..5u32 {
+        let mut wtx = db.write_tx();
+        wtx.bucket_put(b"data", format!("later-{round}").as_bytes(), b"x")
+            .unwrap();
+        wtx.bucket_delete(b"data", format!("{round:04}").as_bytes())
+            .unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+    let bytes = copier.join().unwrap().expect("backup should succeed");
+    assert_eq!(bytes, fs::metadata(&backup_path).unwrap().len());
+
+    // The copy opens and holds exactly the state the backup began with.
+    {
+        let copy = Database::open(&backup_path).expect("backup should open");
+        let rtx = copy.read_tx();
+        let bucket = rtx.bucket(b"data").unwrap();
+        for i in 0..300u32 {
+            assert_eq!(
+                bucket.get(format!("{i:04}").as_bytes()),
+                Some(&vec![i as u8; 64][..])
+            );
+        }
+        assert_eq!(bucket.get(b"large"), Some(&vec![7u8; 100_000][..]));
+        assert_eq!(bucket.get(b"later-0"), None);
+        assert_eq!(bucket.iter().count(), 301);
+    }
+
+    // A one-call backup of the current state, through an in-memory buffer.
+    let mut buffer = Vec::new();
+    let bytes = db.write_to(&mut buffer).expect("backup should succeed");
+    assert_eq!(bytes, buffer.len() as u64);
+    fs::write(&backup_path, &buffer).unwrap();
+    {
+        let copy = Database::open(&backup_path).expect("backup should open");
+        let rtx = copy.read_tx();
+        let bucket = rtx.bucket(b"data").unwrap();
+        assert_eq!(bucket.get(b"0000"), None);
+        assert_eq!(bucket.get(b"later-4"), Some(&b"x"[..]));
+    }
+
+    // No temporary files are left behind.
+    let leftovers = fs::read_dir("/tmp")
+        .unwrap()
+        .filter_map(|e| e.ok())
+        .filter(|e| {
+            e.file_name()
+                .to_string_lossy()
+                .starts_with("thunder_integration_test_hot_backup.db.backup")
+        })
+        .count();
+    assert_eq!(leftovers, 0);
+
+    drop(db);
+    cleanup(&path);
+    cleanup(&backup_path);
+}
+
+// ==================== No-Sync Tests ====================
+
+#[test]
+fn test_no_sync_bulk_load_then_sync() {
+    let path = test_db_path("no_sync_bulk");
+    cleanup(&path);
+    let options = DatabaseOptions {
+        no_sync: true,
+        ..DatabaseOptions::default()
+    };
+    let mut db = Database::open_with_options(&path, options).expect("open should succeed");
+    assert!(db.no_sync());
+
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"import").unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+    for batch in 0..20u32 {
+        let mut wtx = db.write_tx();
+        for i in 0..100u32 {
+            let key = format!("{batch:02}-{i:03}");
+            wtx.bucket_put(b"import", key.as_bytes(), key.as_bytes())
+                .unwrap();
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+
+    // Back to synced commits; sync() makes the import durable.
+    db.set_no_sync(false);
+    assert!(!db.no_sync());
+    db.sync().expect("sync should succeed");
+    {
+        let mut wtx = db.write_tx();
+        wtx.bucket_put(b"import", b"after", b"synced").unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+    drop(db);
+
+    let db = Database::open(&path).expect("reopen should succeed");
+    let rtx = db.read_tx();
+    let bucket = rtx.bucket(b"import").unwrap();
+    assert_eq!(bucket.iter().count(), 20 * 100 + 1);
+    assert_eq!(bucket.get(b"07-042"), Some(&b"07-042"[..]));
+    assert_eq!(bucket.get(b"after"), Some(&b"synced"[..]));
+    drop(rtx);
+    drop(db);
+    cleanup(&path);
+}
+
+#[test]
+#[cfg(feature = "failpoint")]
+fn test_no_sync_commits_survive_crash_only_after_sync() {
+    let path = test_db_path("no_sync_crash");
+    cleanup(&path);
+    let options = DatabaseOptions {
+        no_sync: true,
+        ..DatabaseOptions::default()
+    };
+    let load = |db: &mut Database, prefix: &str| {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket_if_not_exists(b"import").unwrap();
+        for i in 0..100u32 {
+            wtx.bucket_put(b"import", format!("{prefix}-{i:03}").as_bytes(), b"v")
+                .unwrap();
+        }
+        wtx.commit().expect("commit should succeed");
+    };
+
+    // Unsynced commits are lost in a crash.
+    let mut db = Database::open_with_options(&path, options.clone()).expect("open should succeed");
+    db.track_durability_for_testing();
+    load(&mut db, "a");
+    db.crash_for_testing().unwrap();
+    let mut db =
+        Database::open_with_options(&path, options.clone()).expect("reopen should succeed");
+    assert!(db.read_tx().bucket(b"import").is_err());
+
+    // Commits synced before the crash survive it; later ones do not.
+    db.track_durability_for_testing();
+    load(&mut db, "b");
+    {
+        // Syncing works alongside open readers.
+        let rtx = db.read_tx();
+        db.sync().expect("sync should succeed");
+        assert_eq!(rtx.bucket(b"import").unwrap().iter().count(), 100);
+    }
+    // Nothing left to flush.
+    db.sync().expect("sync should succeed");
+    load(&mut db, "c");
+    db.crash_for_testing().unwrap();
+
+    let db = Database::open_with_options(&path, options).expect("reopen should succeed");
+    let rtx = db.read_tx();
+    let bucket = rtx.bucket(b"import").unwrap();
+    assert_eq!(bucket.iter().count(), 100);
+    assert_eq!(bucket.get(b"b-042"), Some(&b"v"[..]));
+    assert_eq!(bucket.get(b"c-042"), None);
+    drop(rtx);
+    drop(db);
+    cleanup(&path);
+}
+
+#[test]
+#[cfg(feature = "failpoint")]
+fn test_crash_mid_commit_keeps_last_committed_state() {
+    use thunderdb::{FaultInjector, FaultOp};
+
+    let base_path = test_db_path("fault_injector_base");
+    let path = test_db_path("fault_injector");
+    cleanup(&base_path);
+    cleanup(&path);
+
+    let large = vec![0xCD; 64 * 1024];
+    {
+        let mut db = Database::open(&base_path).expect("open should succeed");
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"docs").unwrap();
+        for i in 0..50u32 {
+            wtx.bucket_put(b"docs", format!("base-{i:03}").as_bytes(), b"v1")
+                .unwrap();
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+
+    // The commit under test overwrites, deletes, inserts and spills to
+    // overflow pages, so a crash can land in any part of it.
+    let commit = |db: &mut Database| {
+        let mut wtx = db.write_tx();
+        for i in 0..10u32 {
+            wtx.bucket_put(b"docs", format!("base-{i:03}").as_bytes(), b"v2")?;
+        }
+        for i in 40..50u32 {
+            wtx.bucket_delete(b"docs", format!("base-{i:03}").as_bytes())?;
+        }
+        for i in 0..50u32 {
+            wtx.bucket_put(b"docs", format!("new-{i:03}").as_bytes(), b"v2")?;
+        }
+        wtx.bucket_put(b"docs", b"large", &large)?;
+        wtx.commit()
+    };
+    let open = |injector: &FaultInjector| {
+        std::fs::copy(&base_path, &path).unwrap();
+        let options = DatabaseOptions {
+            fault_injector: Some(injector.clone()),
+            ..DatabaseOptions::default()
+        };
+        let db = Database::open_with_options(&path, options).expect("open should succeed");
+        db.track_durability_for_testing();
+        db
+    };
+
+    // Learn how many writes and syncs the open and the commit issue.
+    let counter = FaultInjector::counting();
+    let mut db = open(&counter);
+    let (open_writes, open_syncs) = (counter.writes(), counter.syncs());
+    commit(&mut db).expect("commit should succeed");
+    let commit_writes = counter.writes() - open_writes;
+    let commit_syncs = counter.syncs() - open_syncs;
+    assert!(commit_writes > 0 && commit_syncs > 0);
+    drop(db);
+
+    let faults = (1..=commit_writes)
+        .map(|n| (FaultOp::Write, open_writes + n))
+        .chain((1..=commit_syncs).map(|n| (FaultOp::Sync, open_syncs + n)));
+    for (op, n) in faults {
+        let injector = FaultInjector::fail_nth(op, n);
+        let mut db = open(&injector);
+        let committed = commit(&mut db).is_ok();
+        assert!(injector.fired());
+        db.crash_for_testing().unwrap();
+
+        let db = Database::open(&path).expect("reopen should succeed");
+        assert!(db.check().is_empty(), "{op:?} #{n}: {:?}", db.check());
+        let rtx = db.read_tx();
+        let bucket = rtx.bucket(b"docs").unwrap();
+        // The interrupted commit is either entirely absent or, if the crash
+        // came after it was made durable, entirely present. A commit that
+        // reported success must have survived.
+        if bucket.get(b"new-000").is_none() {
+            assert!(!committed, "{op:?} #{n}: acknowledged commit was lost");
+            assert_eq!(bucket.iter().count(), 50, "{op:?} #{n}");
+            for i in 0..50u32 {
+                let key = format!("base-{i:03}");
+                assert_eq!(bucket.get(key.as_bytes()), Some(&b"v1"[..]), "{op:?} #{n}");
+            }
+            assert_eq!(bucket.get(b"large"), None, "{op:?} #{n}");
+        } else {
+            assert_eq!(bucket.iter().count(), 40 + 50 + 1, "{op:?} #{n}");
+            assert_eq!(bucket.get(b"base-000"), Some(&b"v2"[..]), "{op:?} #{n}");
+            assert_eq!(bucket.get(b"base-020"), Some(&b"v1"[..]), "{op:?} #{n}");
+            assert_eq!(bucket.get(b"base-045"), None, "{op:?} #{n}");
+            assert_eq!(bucket.get(b"new-049"), Some(&b"v2"[..]), "{op:?} #{n}");
+            assert_eq!(bucket.get(b"large"), Some(&large[..]), "{op:?} #{n}");
+        }
+        drop(rtx);
+        drop(db);
+        cleanup(&path);
+    }
+
+    cleanup(&base_path);
+}
+
+// ==================== Integrity Check Tests ====================
+
+#[test]
+fn test_check_reports_every_problem() {
+    use std::io::{Seek, SeekFrom, Write};
+
+    let path = test_db_path("check");
+    let restore_path = test_db_path("check_restore");
+    cleanup(&path);
+    cleanup(&restore_path);
+    let mut db = Database::open(&path).expect("open should succeed");
+    assert!(db.check().is_empty());
+    for round in 0..3u8 {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket_if_not_exists(b"docs").unwrap();
+        for i in 0..100u8 {
+            wtx.bucket_put(b"docs", &[round, i], &[i; 32]).unwrap();
+        }
+        wtx.bucket_put(b"docs", &[b'L', round], &vec![round; 64 * 1024])
+            .unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+    {
+        let mut wtx = db.write_tx();
+        wtx.bucket_delete(b"docs", &[0, 0]).unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+    let problems = db.check();
+    assert!(problems.is_empty(), "{problems:?}");
+
+    // A restored backup checks clean.
+    let mut buffer = Vec::new();
+    db.write_to(&mut buffer).expect("backup should succeed");
+    fs::write(&restore_path, &buffer).unwrap();
+    {
+        let restored = Database::open(&restore_path).expect("backup should open");
+        let problems = restored.check();
+        assert!(problems.is_empty(), "{problems:?}");
+    }
+
+    // Damage the transaction id of meta page 0 and a byte inside the first
+    // overflow value; the check reports both.
+    let overflow = db
+        .allocation_map()
+        .unwrap()
+        .into_iter()
+        .find(|range| matches!(range.kind, AllocationKind::Overflow { .. }))
+        .expect("an overflow value");
+    let mut file = std::fs::OpenOptions::new().write(true).open(&path).unwrap();
+    for offset in [20, overflow.start + 1000] {
+        file.seek(SeekFrom::Start(offset)).unwrap();
+        file.write_all(&[0xFF]).unwrap();
+    }
+    file.sync_all().unwrap();
+
+    let problems = db.check();
+    assert_eq!(problems.len(), 2, "{problems:?}");
+    assert!(matches!(
+        problems[0],
+        Error::InvalidMetaPage { page_number: 0, .. }
+    ));
+    let message = problems[1].to_string();
+    assert!(message.contains("checksum"), "{message}");
+    assert!(
+        message.contains(&format!("page {}", overflow.start / db.page_size() as u64)),
+        "{message}"
+    );
+
+    drop(db);
+    cleanup(&path);
+    cleanup(&restore_path);
+}
+
+// ==================== Expiry Tests ====================
+
+#[test]
+fn test_put_with_ttl_hides_expired_entries() {
+    use std::time::Duration;
+    use thunderdb::DatabaseOptions;
+
+    let path = test_db_path("put_with_ttl");
+    cleanup(&path);
+
+    let mut db = Database::open(&path).expect("open should succeed");
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"sessions").unwrap();
+        wtx.bucket_put(b"sessions", b"a", b"forever").unwrap();
+        wtx.bucket_put_with_ttl(b"sessions", b"b", b"gone", Duration::ZERO)
+            .unwrap();
+        wtx.bucket_put_with_ttl(b"sessions", b"c", b"hour", Duration::from_secs(3600))
+            .unwrap();
+        wtx.bucket_put_with_ttl(b"sessions", b"d", b"brief", Duration::from_millis(50))
+            .unwrap();
+        wtx.bucket_put_with_ttl(b"sessions", b"e", b"renewed", Duration::ZERO)
+            .unwrap();
+        // Expired within the transaction that wrote it.
+        assert_eq!(wtx.bucket_get(b"sessions", b"b").unwrap(), None);
+        wtx.bucket_put_with_ttl(b"sessions", b"h", b"kept", Duration::ZERO)
+            .unwrap();
+        wtx.bucket_put(b"sessions", b"h", b"kept").unwrap();
+        assert_eq!(
+            wtx.bucket_get(b"sessions", b"h").unwrap(),
+            Some(b"kept".to_vec())
+        );
+        wtx.bucket_delete(b"sessions", b"h").unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+    {
+        // Writing without a TTL clears the deadline.
+        let mut wtx = db.write_tx();
+        wtx.bucket_put(b"sessions", b"e", b"renewed").unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let live = |db: &Database| -> Vec<Vec<u8>> {
+        let rtx = db.read_tx();
+        let bucket = rtx.bucket(b"sessions").unwrap();
+        let keys: Vec<Vec<u8>> = bucket.iter().map(|(k, _)| k.to_vec()).collect();
+        assert_eq!(bucket.keys().map(<[u8]>::to_vec).collect::<Vec<_>>(), keys);
+        let mut cursor = bucket.cursor();
+        let mut seen = Vec::new();
+        let mut entry = cursor.first();
+        while let Some((key, _)) = entry {
+            seen.push(key.to_vec());
+            entry = cursor.next();
+        }
+        assert_eq!(seen, keys);
+        for key in [&b"a"[..], b"b", b"c", b"d", b"e"] {
+            assert_eq!(
+                bucket.get(key).is_some(),
+                keys.iter().any(|k| k == key),
+                "{key:?}"
+            );
+        }
+        keys
+    };
+    let expect = |keys: &[&[u8]]| keys.iter().map(|k| k.to_vec()).collect::<Vec<_>>();
+
+    assert_eq!(live(&db), expect(&[b"a", b"c", b"d", b"e"]));
+    std::thread::sleep(Duration::from_millis(100));
+    assert_eq!(live(&db), expect(&[b"a", b"c", b"e"]));
+    {
+        let wtx = db.write_tx();
+        assert_eq!(wtx.bucket_get(b"sessions", b"d").unwrap(), None);
+        assert_eq!(
+            wtx.bucket_get(b"sessions", b"c").unwrap(),
+            Some(b"hour".to_vec())
+        );
+    }
+
+    // Deadlines survive a reopen.
+    drop(db);
+    let mut db = Database::open(&path).expect("reopen should succeed");
+    assert_eq!(live(&db), expect(&[b"a", b"c", b"e"]));
+
+    // Purging deletes the expired entries and their deadlines.
+    assert_eq!(db.purge_expired().unwrap(), 2);
+    assert_eq!(db.purge_expired().unwrap(), 0);
+    assert_eq!(live(&db), expect(&[b"a", b"c", b"e"]));
+    let problems = db.check();
+    assert!(problems.is_empty(), "{problems:?}");
+    drop(db);
+
+    // With an expiry interval, a later commit purges.
+    let options = DatabaseOptions {
+        expiry_interval: Some(Duration::from_millis(20)),
+        ..DatabaseOptions::default()
+    };
+    let mut db = Database::open_with_options(&path, options).expect("open should succeed");
+    {
+        let mut wtx = db.write_tx();
+        wtx.bucket_put_with_ttl(b"sessions", b"f", b"gone", Duration::ZERO)
+            .unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+    std::thread::sleep(Duration::from_millis(40));
+    {
+        let mut wtx = db.write_tx();
+        wtx.bucket_put(b"sessions", b"g", b"kept").unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+    assert_eq!(db.purge_expired().unwrap(), 0);
+    assert_eq!(live(&db), expect(&[b"a", b"c", b"e", b"g"]));
+
+    drop(db);
+    cleanup(&path);
+}
+
+// ==================== Compare-and-Swap Tests ====================
+
+#[test]
+fn test_bucket_compare_and_swap() {
+    let path = test_db_path("compare_and_swap");
+    cleanup(&path);
+
+    let mut db = Database::open(&path).expect("open should succeed");
+    let mut wtx = db.write_tx();
+    wtx.create_bucket(b"locks").unwrap();
+
+    // None expects the key to be absent.
+    assert!(
+        wtx.bucket_compare_and_swap(b"locks", b"k", None, b"")
+            .unwrap()
+    );
+    assert!(
+        !wtx.bucket_compare_and_swap(b"locks", b"k", None, b"x")
+            .unwrap()
+    );
+    // An empty value is present, not absent.
+    assert!(
+        !wtx.bucket_compare_and_swap(b"locks", b"k", Some(b"x"), b"y")
+            .unwrap()
+    );
+    assert!(
+        wtx.bucket_compare_and_swap(b"locks", b"k", Some(b""), b"a")
+            .unwrap()
+    );
+    assert_eq!(wtx.bucket_get(b"locks", b"k").unwrap(), Some(b"a".to_vec()));
+    assert!(matches!(
+        wtx.bucket_compare_and_swap(b"missing", b"k", None, b"v"),
+        Err(Error::BucketNotFound { .. })
+    ));
+    wtx.commit().expect("commit should succeed");
+
+    let mut wtx = db.write_tx();
+    assert!(
+        !wtx.bucket_compare_and_swap(b"locks", b"k", Some(b"b"), b"c")
+            .unwrap()
+    );
+    assert!(
+        wtx.bucket_compare_and_swap(b"locks", b"k", Some(b"a"), b"b")
+            .unwrap()
+    );
+    wtx.commit().expect("commit should succeed");
+    assert_eq!(
+        db.read_tx().bucket(b"locks").unwrap().get(b"k"),
+        Some(&b"b"[..])
+    );
+
+    drop(db);
+    cleanup(&path);
+}
+
+#[test]
+fn test_bucket_compare_and_swap_concurrent_increments() {
+    use std::sync::Mutex;
+
+    let path = test_db_path("compare_and_swap_concurrent");
+    cleanup(&path);
+
+    const THREADS: u64 = 8;
+    const PER_THREAD: u64 = 25;
+
+    let mut db = Database::open(&path).expect("open should succeed");
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"counters").unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+    let db = Mutex::new(db);
+
+    let retries: u64 = std::thread::scope(|s| {
+        let handles: Vec<_> = (0..THREADS)
+            .map(|_| {
+                let db = &db;
+                s.spawn(move || {
+                    let mut retries = 0;
+                    for _ in 0..PER_THREAD {
+                        loop {
+                            // Read optimistically, then let other threads run
+                            // before attempting the swap.
+                            let current = db
+                                .lock()
+                                .unwrap()
+                                .read_tx()
+                                .bucket(b"counters")
+                                .unwrap()
+                                .get(b"n")
+                                .map(<[u8]>::to_vec);
+                            let next = current
+                                .as_deref()
+                                .map_or(0, |v| u64::from_le_bytes(v.try_into().unwrap()))
+                                + 1;
+                            std::thread::yield_now();
+
+                            let mut db = db.lock().unwrap();
+                            let mut wtx = db.write_tx();
+                            if wtx
+                                .bucket_compare_and_swap(
+                                    b"counters",
+                                    b"n",
+                                    current.as_deref(),
+                                    &next.to_le_bytes(),
+                                )
+                                .unwrap()
+                            {
+                                wtx.commit().expect("commit should succeed");
+                                break;
+                            }
+                            wtx.rollback();
+                            retries += 1;
+                        }
+                    }
+                    retries
+                })
+            })
+            .collect();
+        handles.into_iter().map(|h| h.join().unwrap()).sum()
+    });
+
+    let db = db.into_inner().unwrap();
+    let value = db
+        .read_tx()
+        .bucket(b"counters")
+        .unwrap()
+        .get(b"n")
+        .map(<[u8]>::to_vec)
+        .expect("counter should exist");
+    assert_eq!(
+        u64::from_le_bytes(value.try_into().unwrap()),
+        THREADS * PER_THREAD,
+        "no increment may be lost ({retries} retries)"
+    );
+
+    drop(db);
+    cleanup(&path);
+}
+
+// ==================== Bucket Sequence Tests ====================
+
+#[test]
+fn test_next_bucket_sequence() {
+    use thunderdb::{CompactionPriority, EvictionPolicy};
+
+    let path = test_db_path("bucket_sequence");
+    cleanup(&path);
+
+    let mut db = Database::open(&path).expect("open should succeed");
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"users").unwrap();
+        assert_eq!(wtx.bucket_sequence(b"users").unwrap(), 0);
+        for expected in 1..=3u64 {
+            let id = wtx.next_bucket_sequence(b"users").unwrap();
+            assert_eq!(id, expected);
+            wtx.bucket_put(b"users", &id.to_be_bytes(), b"user")
+                .unwrap();
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+    {
+        // A rolled back advance is handed out again.
+        let mut wtx = db.write_tx();
+        assert_eq!(wtx.next_bucket_sequence(b"users").unwrap(), 4);
+        wtx.rollback();
+    }
+    {
+        // Other header fields keep the counter, and it keeps them.
+        let mut wtx = db.write_tx();
+        wtx.set_bucket_compaction_priority(b"users", CompactionPriority::High)
+            .unwrap();
+        assert_eq!(wtx.next_bucket_sequence(b"users").unwrap(), 4);
+        wtx.set_bucket_max_keys(b"users", 100, EvictionPolicy::SmallestKey)
+            .unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+
+    drop(db);
+    let mut db = Database::open(&path).expect("reopen should succeed");
+    {
+        let rtx = db.read_tx();
+        let bucket = rtx.bucket(b"users").unwrap();
+        assert_eq!(bucket.sequence(), 4);
+        assert_eq!(bucket.compaction_priority(), CompactionPriority::High);
+        assert_eq!(bucket.key_limit().map(|limit| limit.max_keys), Some(100));
+        assert_eq!(bucket.iter().count(), 3);
+    }
+
+    let mut wtx = db.write_tx();
+    wtx.set_bucket_sequence(b"users", 1000).unwrap();
+    assert_eq!(wtx.next_bucket_sequence(b"users").unwrap(), 1001);
+    wtx.set_bucket_sequence(b"users", u64::MAX).unwrap();
+    assert!(matches!(
+        wtx.next_bucket_sequence(b"users"),
+        Err(Error::SequenceExhausted { .. })
+    ));
+    assert!(matches!(
+        wtx.next_bucket_sequence(b"missing"),
+        Err(Error::BucketNotFound { .. })
+    ));
+    wtx.set_bucket_sequence(b"users", 0).unwrap();
+    wtx.commit().expect("commit should succeed");
+    assert_eq!(db.read_tx().bucket(b"users").unwrap().sequence(), 0);
+
+    drop(db);
+    cleanup(&path);
+}
+
+// ==================== Bucket Bloom Filter Tests ====================
+
+#[test]
+fn test_bucket_bloom_filter() {
+    let path = test_db_path("bucket_bloom");
+    cleanup(&path);
+
+    let mut db = Database::open(&path).expect("open should succeed");
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"users").unwrap();
+        wtx.set_bucket_bloom(b"users", 10).unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+
+    // Keys added over several commits outgrow the first filter.
+    for batch in 0..5u32 {
+        let mut wtx = db.write_tx();
+        for i in batch * 1000..(batch + 1) * 1000 {
+            wtx.bucket_put(b"users", format!("user_{i:05}").as_bytes(), b"v")
+                .unwrap();
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+    {
+        let mut wtx = db.write_tx();
+        for i in (0..5000u32).step_by(2) {
+            wtx.bucket_delete(b"users", format!("user_{i:05}").as_bytes())
+                .unwrap();
+        }
+        // Other header fields keep the filter setting.
+        wtx.next_bucket_sequence(b"users").unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let check = |db: &Database| {
+        let rtx = db.read_tx();
+        let bucket = rtx.bucket(b"users").unwrap();
+        assert_eq!(bucket.bloom_bits_per_key(), Some(10));
+        for i in 0..5000u32 {
+            let key = format!("user_{i:05}");
+            assert_eq!(bucket.get(key.as_bytes()).is_some(), i % 2 == 1);
+        }
+        assert!(bucket.get(b"absent").is_none());
+        assert_eq!(
+            rtx.bucket_get_checked(b"users", b"user_00001").unwrap(),
+            Some(&b"v"[..])
+        );
+    };
+    check(&db);
+
+    drop(db);
+    let mut db = Database::open(&path).expect("reopen should succeed");
+    check(&db);
+
+    let mut wtx = db.write_tx();
+    assert!(matches!(
+        wtx.set_bucket_bloom(b"missing", 10),
+        Err(Error::BucketNotFound { .. })
+    ));
+    wtx.clear_bucket_bloom(b"users").unwrap();
+    wtx.commit().expect("commit should succeed");
+    let rtx = db.read_tx();
+    let bucket = rtx.bucket(b"users").unwrap();
+    assert_eq!(bucket.bloom_bits_per_key(), None);
+    assert_eq!(bucket.sequence(), 1);
+    assert!(bucket.get(b"user_00001").is_some());
+    drop(rtx);
+
+    drop(db);
+    cleanup(&path);
+}
+
+// ==================== Secondary Index Tests ====================
+
+#[test]
+fn test_secondary_index() {
+    use thunderdb::Index;
+
+    let path = test_db_path("secondary_index");
+    cleanup(&path);
+
+    // Records are comma-separated tags; each tag is an index key.
+    let by_tag = Index::new(b"posts", b"posts_by_tag", |_, value| {
+        value
+            .split(|&b| b == b',')
+            .filter(|tag| !tag.is_empty())
+            .map(<[u8]>::to_vec)
+            .collect()
+    });
+    let index_entries =
+        |db: &Database| db.read_tx().bucket(b"posts_by_tag").unwrap().iter().count();
+
+    let mut db = Database::open(&path).expect("open should succeed");
+    db.update(|wtx| {
+        by_tag.create(wtx)?;
+        by_tag.put(wtx, b"p1", b"rust,db")?;
+        by_tag.put(wtx, b"p2", b"rust,web,rust")?;
+        by_tag.put(wtx, b"p3", b"")
+    })
+    .expect("update should succeed");
+    {
+        let rtx = db.read_tx();
+        assert_eq!(by_tag.lookup(&rtx, b"rust").unwrap(), vec![b"p1", b"p2"]);
+        assert_eq!(by_tag.lookup(&rtx, b"db").unwrap(), vec![b"p1"]);
+        // Index keys that prefix others stay apart.
+        assert!(by_tag.lookup(&rtx, b"r").unwrap().is_empty());
+    }
+    assert_eq!(index_entries(&db), 4);
+
+    // Updating a record moves its index entries.
+    db.update(|wtx| by_tag.put(wtx, b"p1", b"db,go"))
+        .expect("update should succeed");
+    {
+        let rtx = db.read_tx();
+        assert_eq!(by_tag.lookup(&rtx, b"rust").unwrap(), vec![b"p2"]);
+        assert_eq!(by_tag.lookup(&rtx, b"go").unwrap(), vec![b"p1"]);
+    }
+
+    // A failed update leaves records and index unchanged.
+    let err = db.update(|wtx| {
+        by_tag.put(wtx, b"p4", b"rust")?;
+        by_tag.delete(wtx, b"p2")?;
+        wtx.bucket_put(b"missing", b"k", b"v")
+    });
+    assert!(err.is_err());
+    assert_eq!(by_tag.lookup(&db.read_tx(), b"rust").unwrap(), vec![b"p2"]);
+
+    // Deleting records removes every one of their index entries.
+    db.update(|wtx| {
+        assert!(by_tag.delete(wtx, b"p1")?);
+        assert!(by_tag.delete(wtx, b"p2")?);
+        assert!(!by_tag.delete(wtx, b"p9")?);
+        Ok(())
+    })
+    .expect("update should succeed");
+    assert_eq!(index_entries(&db), 0);
+    {
+        let rtx = db.read_tx();
+        for tag in [&b"rust"[..], b"web", b"db", b"go"] {
+            assert!(by_tag.lookup(&rtx, tag).unwrap().is_empty());
+        }
+        assert_eq!(rtx.bucket(b"posts").unwrap().iter().count(), 1);
+    }
+
+    drop(db);
+    cleanup(&path);
+}
+
+// ==================== Watch Tests ====================
+
+#[test]
+fn test_watch_committed_changes() {
+    use thunderdb::WatchEvent;
+
+    let path = test_db_path("watch");
+    cleanup(&path);
+
+    let mut db = Database::open(&path).expect("open should succeed");
+    let (events, unwatch) = db.watch(b"cfg/", None);
+    let (bucket_events, bucket_unwatch) = db.watch_bucket(b"users", b"", None).unwrap();
+    assert!(matches!(
+        db.watch_bucket(b"", b"", None),
+        Err(Error::InvalidBucketName { .. })
+    ));
+
+    {
+        let mut wtx = db.write_tx();
+        wtx.put(b"cfg/a", b"1");
+        wtx.put(b"other", b"x");
+        wtx.create_bucket(b"users").unwrap();
+        wtx.bucket_put(b"users", b"alice", b"admin").unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+    let first = db.version();
+    {
+        let mut wtx = db.write_tx();
+        wtx.put(b"cfg/rolled_back", b"1");
+        wtx.bucket_put(b"users", b"bob", b"guest").unwrap();
+        wtx.rollback();
+    }
+    {
+        let mut wtx = db.write_tx();
+        wtx.delete(b"cfg/a");
+        wtx.put(b"cfg/b", b"2");
+        wtx.commit().expect("commit should succeed");
+    }
+    let second = db.version();
+
+    let received: Vec<WatchEvent> = events.try_iter().collect();
+    let expected = |sequence, version, key: &[u8], value: Option<&[u8]>| WatchEvent {
+        sequence,
+        version,
+        key: key.to_vec(),
+        value: value.map(<[u8]>::to_vec),
+    };
+    assert_eq!(
+        received,
+        vec![
+            expected(1, first, b"cfg/a", Some(b"1")),
+            expected(2, second, b"cfg/a", None),
+            expected(3, second, b"cfg/b", Some(b"2")),
+        ]
+    );
+    assert_eq!(
+        bucket_events.try_iter().collect::<Vec<_>>(),
+        vec![expected(1, first, b"alice", Some(b"admin"))]
+    );
+
+    // Deleting a bucket reports each of its keys.
+    {
+        let mut wtx = db.write_tx();
+        wtx.delete_bucket(b"users").unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+    let deleted: Vec<WatchEvent> = bucket_events.try_iter().collect();
+    assert_eq!(deleted.len(), 1);
+    assert_eq!(deleted[0].key, b"alice");
+    assert_eq!(deleted[0].value, None);
+
+    // Unwatching closes the channel.
+    unwatch.unwatch();
+    bucket_unwatch.unwatch();
+    let mut wtx = db.write_tx();
+    wtx.put(b"cfg/c", b"3");
+    wtx.commit().expect("commit should succeed");
+    assert!(matches!(
+        events.try_recv(),
+        Err(std::sync::mpsc::TryRecvError::Disconnected)
+    ));
+    assert!(bucket_events.recv().is_err());
+
+    drop(db);
+    cleanup(&path);
+}
+
+#[test]
+fn test_watch_bounded_buffer_drops_events() {
+    let path = test_db_path("watch_bounded");
+    cleanup(&path);
+
+    let mut db = Database::open(&path).expect("open should succeed");
+    let (events, _unwatch) = db.watch(b"", Some(2));
+    for i in 0..5u8 {
+        let mut wtx = db.write_tx();
+        wtx.put(&[b'k', i], b"v");
+        wtx.commit().expect("commit should succeed");
+    }
+
+    // Commits never waited; the events past the buffer were dropped.
+    let sequences: Vec<u64> = events.try_iter().map(|event| event.sequence).collect();
+    assert_eq!(sequences, vec![1, 2]);
+
+    // The gap shows how many were missed.
+    let mut wtx = db.write_tx();
+    wtx.put(b"later", b"v");
+    wtx.commit().expect("commit should succeed");
+    let event = events.try_recv().expect("event should be delivered");
+    assert_eq!(event.sequence, 6);
+    assert_eq!(event.key, b"later");
+
+    // A dropped receiver ends the watch on the next change.
+    drop(events);
+    let mut wtx = db.write_tx();
+    wtx.put(b"after", b"v");
+    wtx.commit().expect("commit should succeed");
+
+    drop(db);
+    cleanup(&path);
+}
+
+// ==================== Compact-To Tests ====================
+
+#[test]
+fn test_compact_to_new_file() {
+    let path = test_db_path("compact_to_src");
+    let dst_path = test_db_path("compact_to_dst");
+    let busy_path = test_db_path("compact_to_busy");
+    cleanup(&path);
+    cleanup(&dst_path);
+    cleanup(&busy_path);
+
+    let mut db = Database::open(&path).expect("open should succeed");
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"docs").unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+    // Churn: rewrite and delete most keys over several commits.
+    for round in 0..5u32 {
+        let mut wtx = db.write_tx();
+        for i in 0..200u32 {
+            let key = format!("k{i:04}");
+            if round == 4 && i % 4 != 0 {
+                wtx.bucket_delete(b"docs", key.as_bytes()).unwrap();
+            } else {
+                wtx.bucket_put(b"docs", key.as_bytes(), &vec![round as u8; 256])
+                    .unwrap();
+            }
+        }
+        wtx.bucket_put(
+            b"docs",
+            format!("large{round}").as_bytes(),
+            &vec![7u8; 96 * 1024],
+        )
+        .unwrap();
+        if round > 0 {
+            wtx.bucket_delete(b"docs", format!("large{}", round - 1).as_bytes())
+                .unwrap();
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let before = fs::metadata(&path).unwrap().len();
+    let after = db.compact_to(&dst_path).expect("compact_to should succeed");
+    eprintln!("compact_to: {before} -> {after} bytes");
+    assert_eq!(after, fs::metadata(&dst_path).unwrap().len());
+    assert!(after < before, "{before} -> {after}");
+    // The source is untouched.
+    assert_eq!(fs::metadata(&path).unwrap().len(), before);
+
+    // An existing destination is never overwritten.
+    assert!(matches!(
+        db.compact_to(&dst_path),
+        Err(Error::FileOpen { .. })
+    ));
+    assert_eq!(fs::metadata(&dst_path).unwrap().len(), after);
+
+    {
+        let copy = Database::open(&dst_path).expect("copy should open");
+        let problems = copy.check();
+        assert!(problems.is_empty(), "{problems:?}");
+        let src = db.read_tx();
+        let dst = copy.read_tx();
+        let src_entries: Vec<_> = src
+            .bucket(b"docs")
+            .unwrap()
+            .iter()
+            .map(|(k, v)| (k.to_vec(), v.to_vec()))
+            .collect();
+        let dst_entries: Vec<_> = dst
+            .bucket(b"docs")
+            .unwrap()
+            .iter()
+            .map(|(k, v)| (k.to_vec(), v.to_vec()))
+            .collect();
+        assert_eq!(src_entries.len(), 51);
+        assert_eq!(src_entries, dst_entries);
+    }
+
+    // The source keeps committing while a copy is written.
+    let backup = db.begin_backup();
+    std::thread::scope(|s| {
+        let copier = s.spawn(|| backup.write_to_path(&busy_path));
+        let mut wtx = db.write_tx();
+        wtx.bucket_put(b"docs", b"later", b"value").unwrap();
+        wtx.commit().expect("commit should succeed");
+        copier.join().unwrap().expect("copy should succeed");
+    });
+    let busy = Database::open(&busy_path).expect("copy should open");
+    assert_eq!(busy.read_tx().bucket(b"docs").unwrap().get(b"later"), None);
+    assert!(
+        db.read_tx()
+            .bucket(b"docs")
+            .unwrap()
+            .get(b"later")
+            .is_some()
+    );
+
+    drop(busy);
+    drop(db);
+    cleanup(&path);
+    cleanup(&dst_path);
+    cleanup(&busy_path);
+}
+
+// ==================== Transaction Hook Tests ====================
+
+#[test]
+fn test_tx_hooks_run_for_the_decided_outcome_in_order() {
+    use std::sync::{Arc, Mutex};
+    use thunderdb::CancelToken;
+
+    let path = test_db_path("tx_hooks");
+    cleanup(&path);
+    let mut db = Database::open(&path).expect("open should succeed");
+    let log = Arc::new(Mutex::new(Vec::new()));
+    let record = |name: &'static str| {
+        let log = Arc::clone(&log);
+        move || log.lock().unwrap().push(name)
+    };
+    let take = || std::mem::take(&mut *log.lock().unwrap());
+
+    // A committed transaction runs only its commit hooks, after the
+    // changes are visible.
+    let mut wtx = db.write_tx();
+    wtx.put(b"k", b"1");
+    wtx.on_commit(record("commit 1"));
+    wtx.on_rollback(record("rollback 1"));
+    wtx.on_commit(record("commit 2"));
+    wtx.on_commit(record("commit 3"));
+    assert!(take().is_empty());
+    wtx.commit().expect("commit should succeed");
+    assert_eq!(take(), ["commit 1", "commit 2", "commit 3"]);
+
+    // Rolled back, dropped and failed transactions run only rollback hooks.
+    let mut wtx = db.write_tx();
+    wtx.on_rollback(record("rollback 1"));
+    wtx.on_commit(record("commit 1"));
+    wtx.on_rollback(record("rollback 2"));
+    wtx.rollback();
+    assert_eq!(take(), ["rollback 1", "rollback 2"]);
+
+    let mut wtx = db.write_tx();
+    wtx.on_commit(record("commit 1"));
+    wtx.on_rollback(record("dropped"));
+    drop(wtx);
+    assert_eq!(take(), ["dropped"]);
+
+    let token = CancelToken::new();
+    let mut wtx = db.write_tx();
+    wtx.set_cancel_token(token.clone());
+    wtx.put(b"k", b"2");
+    wtx.on_commit(record("commit 1"));
+    wtx.on_rollback(record("failed"));
+    token.cancel();
+    assert!(wtx.commit().is_err());
+    assert_eq!(take(), ["failed"]);
+
+    // Closures passed to update() follow the closure's result.
+    db.update(|wtx| {
+        wtx.on_commit(record("update committed"));
+        wtx.on_rollback(record("update rolled back"));
+        Ok(())
+    })
+    .unwrap();
+    let result: thunderdb::Result<()> = db.update(|wtx| {
+        wtx.on_commit(record("update committed"));
+        wtx.on_rollback(record("update rolled back"));
+        Err(Error::ReadOnly)
+    });
+    assert!(result.is_err());
+    assert_eq!(take(), ["update committed", "update rolled back"]);
+
+    drop(db);
+    cleanup(&path);
+}
+
+// ==================== Cancellation Tests ====================
+
+#[test]
+fn test_cancelled_transactions_stop_promptly() {
+    use std::time::Duration;
+    use thunderdb::CancelToken;
+    use thunderdb::cancel::CHECK_INTERVAL;
+
+    let path = test_db_path("cancel_tx");
+    cleanup(&path);
+
+    const KEYS: u32 = 10_000;
+    let mut db = Database::open(&path).expect("open should succeed");
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"events").unwrap();
+        for i in 0..KEYS {
+            wtx.bucket_put(b"events", &i.to_be_bytes(), b"event")
+                .unwrap();
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+
+    // Cancelling mid-scan ends the iterator within one check interval, and
+    // the view reports the cancellation rather than the partial result.
+    let token = CancelToken::new();
+    let mut visited = 0u32;
+    let result = db.view_with_cancel(&token, |rtx| {
+        for _ in rtx.bucket(b"events")?.iter() {
+            visited += 1;
+            if visited == 1000 {
+                token.cancel();
+            }
+        }
+        Ok(visited)
+    });
+    assert!(matches!(
+        result,
+        Err(Error::TxCancelled {
+            deadline_exceeded: false
+        })
+    ));
+    assert!(visited < 1000 + CHECK_INTERVAL, "visited {visited}");
+
+    // Callback scans and collecting helpers return the error themselves.
+    let token = CancelToken::new();
+    let mut rtx = db.read_tx();
+    rtx.set_cancel_token(token.clone());
+    let bucket = rtx.bucket(b"events").unwrap();
+    let mut visited = 0u32;
+    let result = bucket.for_each(|_, _| {
+        visited += 1;
+        if visited == 10 {
+            token.cancel();
+        }
+        Ok(())
+    });
+    assert!(matches!(result, Err(Error::TxCancelled { .. })));
+    assert!(visited < 10 + CHECK_INTERVAL, "visited {visited}");
+    assert!(matches!(
+        rtx.bucket_entries(b"events"),
+        Err(Error::TxCancelled { .. })
+    ));
+    drop(rtx);
+
+    // A cursor scanning on one thread stops once another thread cancels.
+    let token = CancelToken::new();
+    std::thread::scope(|s| {
+        let canceller = token.clone();
+        s.spawn(move || {
+            std::thread::sleep(Duration::from_millis(20));
+            canceller.cancel();
+        });
+        let result = db.view_with_cancel(&token, |rtx| {
+            let bucket = rtx.bucket(b"events")?;
+            // Without cancellation this would never end.
+            loop {
+                let mut cursor = bucket.cursor();
+                let mut entry = cursor.first();
+                let mut count = 0;
+                while entry.is_some() {
+                    count += 1;
+                    entry = cursor.next();
+                }
+                if count < KEYS {
+                    return Ok(());
+                }
+            }
+        });
+        assert!(matches!(result, Err(Error::TxCancelled { .. })));
+    });
+
+    // A cancelled update is not committed.
+    let token = CancelToken::new();
+    let result = db.update_with_cancel(&token, |wtx| {
+        wtx.bucket_put(b"events", b"cancelled", b"write")?;
+        token.cancel();
+        Ok(())
+    });
+    assert!(matches!(result, Err(Error::TxCancelled { .. })));
+    let rtx = db.read_tx();
+    assert_eq!(rtx.bucket(b"events").unwrap().get(b"cancelled"), None);
+    drop(rtx);
+
+    // Deadlines, and uncancelled tokens, behave as expected.
+    let expired = CancelToken::with_timeout(Duration::ZERO);
+    assert!(matches!(
+        db.view_with_cancel(&expired, |_| Ok(())),
+        Err(Error::TxCancelled {
+            deadline_exceeded: true
+        })
+    ));
+    let token = CancelToken::with_timeout(Duration::from_secs(3600));
+    let count = db
+        .view_with_cancel(&token, |rtx| Ok(rtx.bucket(b"events")?.iter().count()))
+        .unwrap();
+    assert_eq!(count, KEYS as usize);
+    db.update_with_cancel(&token, |wtx| wtx.bucket_put(b"events", b"kept", b"write"))
+        .unwrap();
+    assert!(
+        db.read_tx()
+            .bucket(b"events")
+            .unwrap()
+            .get(b"kept")
+            .is_some()
+    );
+
+    drop(db);
+    cleanup(&path);
+}
@@ -236,6 +236,85 @@ fn test_variable_page_size_configuration() {
     cleanup(&nvme_path);
 }
 
+/// Test 2b: Large Value Throughput at 4KB vs 64KB Pages
+///
+/// This test verifies that:
+/// 1. 1MB values roundtrip at both the smallest and largest page sizes
+/// 2. The page size is read back from the file on reopen
+/// 3. Reopening with the other page size fails with `PageSizeMismatch`
+///
+/// Throughput for each size is printed (run with `--nocapture`); timings
+/// are not asserted since they depend on the machine.
+#[test]
+fn test_page_size_large_value_throughput() {
+    use std::time::Instant;
+    use thunderdb::Error;
+
+    const NUM_VALUES: usize = 16;
+    const VALUE_SIZE: usize = 1024 * 1024;
+
+    for (page_size, other) in [
+        (PageSizeConfig::Size4K, PageSizeConfig::Size64K),
+        (PageSizeConfig::Size64K, PageSizeConfig::Size4K),
+    ] {
+        let path = test_db_path(&format!("throughput_{}", page_size.as_usize()));
+        cleanup(&path);
+
+        let options = DatabaseOptions {
+            page_size,
+            ..Default::default()
+        };
+
+        {
+            let mut db = Database::open_with_options(&path, options.clone())
+                .expect("open with options should succeed");
+
+            let start = Instant::now();
+            let mut wtx = db.write_tx();
+            for i in 0..NUM_VALUES {
+                let value = vec![i as u8; VALUE_SIZE];
+                wtx.put(format!("value_{i:02}").as_bytes(), &value);
+            }
+            wtx.commit().expect("commit should succeed");
+            let elapsed = start.elapsed();
+
+            let mb = (NUM_VALUES * VALUE_SIZE) as f64 / (1024.0 * 1024.0);
+            eprintln!(
+                "{}KB pages: {NUM_VALUES} x 1MB in {elapsed:?} ({:.1} MB/sec)",
+                page_size.as_usize() / 1024,
+                mb / elapsed.as_secs_f64()
+            );
+        }
+
+        {
+            let db = Database::open_with_options(&path, options).expect("reopen should succeed");
+            let rtx = db.read_tx();
+            for i in 0..NUM_VALUES {
+                let value = rtx
+                    .get(format!("value_{i:02}").as_bytes())
+                    .expect("value should exist");
+                assert_eq!(value.len(), VALUE_SIZE);
+                assert!(value.iter().all(|&b| b == i as u8), "value {i} corrupted");
+            }
+        }
+
+        let mismatched = DatabaseOptions {
+            page_size: other,
+            ..Default::default()
+        };
+        match Database::open_with_options(&path, mismatched) {
+            Err(Error::PageSizeMismatch { expected, actual }) => {
+                assert_eq!(expected as usize, other.as_usize());
+                assert_eq!(actual as usize, page_size.as_usize());
+            }
+            Err(e) => panic!("expected PageSizeMismatch, got {e}"),
+            Ok(_) => panic!("opening with a mismatched page size should fail"),
+        }
+
+        cleanup(&path);
+    }
+}
+
 // ==================== Task 2.3: Write Coalescing Tests ====================
 
 /// Test 3: Write Coalescing and Batched I/O
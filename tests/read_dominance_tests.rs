@@ -443,6 +443,89 @@ fn test_snapshot_stats() {
     cleanup(&path);
 }
 
+/// Stress test: readers on other threads take snapshots through a read
+/// handle while a single writer commits, and never see uncommitted state.
+#[test]
+fn test_read_handle_readers_during_writes() {
+    use std::sync::Arc;
+    use std::sync::atomic::{AtomicBool, AtomicUsize, Ordering};
+
+    let path = test_db_path("read_handle_stress");
+    cleanup(&path);
+
+    const READERS: usize = 8;
+    const COMMITS: u64 = 200;
+    let counter = |snapshot: &thunderdb::Snapshot, key: &[u8]| {
+        snapshot
+            .get_ref(key)
+            .map(|v| u64::from_be_bytes(v.try_into().unwrap()))
+    };
+
+    let mut db = Database::open(&path).expect("open should succeed");
+    {
+        let mut wtx = db.write_tx();
+        wtx.put(b"a", &0u64.to_be_bytes());
+        wtx.put(b"b", &0u64.to_be_bytes());
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let handle = db.read_handle();
+    let done = Arc::new(AtomicBool::new(false));
+    let reads = Arc::new(AtomicUsize::new(0));
+    let readers: Vec<_> = (0..READERS)
+        .map(|_| {
+            let handle = handle.clone();
+            let done = Arc::clone(&done);
+            let reads = Arc::clone(&reads);
+            std::thread::spawn(move || {
+                let mut last = 0;
+                while !done.load(Ordering::Acquire) {
+                    let snapshot = handle.snapshot();
+                    let a = counter(&snapshot, b"a").expect("a is always committed");
+                    // Both counters change in one commit; seeing them
+                    // differ would mean observing part of a commit.
+                    assert_eq!(Some(a), counter(&snapshot, b"b"));
+                    assert!(snapshot.get_ref(b"rolled_back").is_none());
+                    assert!(a >= last, "went back from {last} to {a}");
+                    last = a;
+                    reads.fetch_add(1, Ordering::Relaxed);
+                }
+                last
+            })
+        })
+        .collect();
+
+    for i in 1..=COMMITS {
+        let mut wtx = db.write_tx();
+        wtx.put(b"a", &i.to_be_bytes());
+        if i % 20 == 0 {
+            // Readers keep going while this transaction is in flight.
+            let target = reads.load(Ordering::Relaxed) + 100 * READERS;
+            while reads.load(Ordering::Relaxed) < target {
+                std::thread::yield_now();
+            }
+        }
+        wtx.put(b"b", &i.to_be_bytes());
+        wtx.commit().expect("commit should succeed");
+        assert_eq!(handle.version(), db.version());
+
+        if i % 10 == 0 {
+            let mut wtx = db.write_tx();
+            wtx.put(b"rolled_back", b"never visible");
+            wtx.rollback();
+        }
+    }
+
+    done.store(true, Ordering::Release);
+    for reader in readers {
+        assert!(reader.join().expect("reader should not panic") <= COMMITS);
+    }
+    assert_eq!(counter(&handle.snapshot(), b"a"), Some(COMMITS));
+
+    drop(handle);
+    cleanup(&path);
+}
+
 // ==================== 3. Zero-Copy Read Tests ====================
 
 /// Test zero-copy get_ref returns references without allocation.
@@ -787,6 +870,177 @@ fn test_performance_snapshot_creation() {
     cleanup(&path);
 }
 
+/// Benchmark: value-prefix filtering vs materializing every value.
+#[test]
+fn test_performance_scan_filter_pushdown() {
+    let path = test_db_path("perf_scan_filter");
+    cleanup(&path);
+
+    let mut db = Database::open(&path).expect("open should succeed");
+
+    // Large (overflow) values; only every 50th one is tagged as wanted.
+    const NUM_KEYS: usize = 500;
+    const VALUE_LEN: usize = 64 * 1024;
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"blobs").unwrap();
+        for i in 0..NUM_KEYS {
+            let mut value = vec![b'x'; VALUE_LEN];
+            value[0] = if i % 50 == 0 { b'Y' } else { b'N' };
+            wtx.bucket_put(b"blobs", format!("blob_{i:05}").as_bytes(), &value)
+                .unwrap();
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let rtx = db.read_tx();
+    let bucket = rtx.bucket(b"blobs").unwrap();
+
+    // Baseline: materialize every value, then filter.
+    let start = Instant::now();
+    let mut naive_bytes = 0usize;
+    let mut naive_matches = 0usize;
+    for (_key, value) in bucket.iter() {
+        let owned = value.to_vec();
+        naive_bytes += owned.len();
+        if owned[0] == b'Y' {
+            naive_matches += 1;
+        }
+    }
+    let naive_duration = start.elapsed();
+
+    // Pushdown: filter on a 1-byte prefix, materialize matches only.
+    let start = Instant::now();
+    let mut filtered_bytes = 0usize;
+    let mut filtered_matches = 0usize;
+    bucket
+        .scan_filter(
+            1,
+            |_key, prefix| prefix == b"Y",
+            |_key, value| {
+                filtered_bytes += value.to_vec().len();
+                filtered_matches += 1;
+                Ok(())
+            },
+        )
+        .expect("scan should succeed");
+    let filtered_duration = start.elapsed();
+
+    eprintln!(
+        "scan_filter: {filtered_matches} matches, {filtered_bytes} bytes in {filtered_duration:?}; \
+         naive: {naive_bytes} bytes in {naive_duration:?}"
+    );
+
+    assert_eq!(filtered_matches, NUM_KEYS / 50);
+    assert_eq!(filtered_matches, naive_matches);
+    assert_eq!(filtered_bytes, naive_bytes / 50);
+
+    cleanup(&path);
+}
+
+#[test]
+fn test_performance_disable_read_your_writes() {
+    let path = test_db_path("perf_disable_ryw");
+    cleanup(&path);
+
+    let mut db = Database::open(&path).expect("open should succeed");
+
+    const NUM_KEYS: usize = 20_000;
+    const PENDING_DELETES: usize = 2_000;
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"data").unwrap();
+        for i in 0..NUM_KEYS {
+            wtx.bucket_put(b"data", format!("key_{i:06}").as_bytes(), b"value")
+                .unwrap();
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+
+    // Reads of an untouched range while many deletions are pending.
+    let read_untouched = |db: &mut Database, read_your_writes: bool| {
+        let mut wtx = db.write_tx();
+        if !read_your_writes {
+            wtx.disable_read_your_writes();
+        }
+        for i in 0..PENDING_DELETES {
+            wtx.bucket_delete(b"data", format!("key_{i:06}").as_bytes())
+                .unwrap();
+        }
+        let mut found = 0usize;
+        for i in PENDING_DELETES..NUM_KEYS {
+            if wtx
+                .bucket_get(b"data", format!("key_{i:06}").as_bytes())
+                .unwrap()
+                .is_some()
+            {
+                found += 1;
+            }
+        }
+        wtx.rollback();
+        found
+    };
+
+    // How much faster committed-only reads are is measured by the bench.
+    let merged_found = read_untouched(&mut db, true);
+    let committed_found = read_untouched(&mut db, false);
+
+    assert_eq!(merged_found, NUM_KEYS - PENDING_DELETES);
+    assert_eq!(committed_found, merged_found);
+
+    cleanup(&path);
+}
+
+/// Skipping with `nth` lands on the same keys as stepping with `next`.
+///
+/// That `nth` is faster, since it hops over whole leaves, is measured by
+/// the bench.
+#[test]
+fn test_performance_iter_skip_vs_next() {
+    let path = test_db_path("perf_iter_skip");
+    cleanup(&path);
+
+    let mut db = Database::open(&path).expect("open should succeed");
+
+    const NUM_KEYS: u32 = 100_000;
+    const SKIP: usize = 1000;
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"data").unwrap();
+        for i in 0..NUM_KEYS {
+            wtx.bucket_put(b"data", &i.to_be_bytes(), b"value").unwrap();
+        }
+        wtx.commit().expect("commit should succeed");
+    }
+
+    let rtx = db.read_tx();
+    let bucket = rtx.bucket(b"data").unwrap();
+
+    let mut skipped = Vec::new();
+    let mut iter = bucket.iter();
+    while let Some((key, _)) = iter.nth(SKIP - 1) {
+        skipped.push(key);
+    }
+
+    let mut stepped = Vec::new();
+    let mut iter = bucket.iter();
+    'outer: loop {
+        let mut landed = None;
+        for _ in 0..SKIP {
+            match iter.next() {
+                Some((key, _)) => landed = Some(key),
+                None => break 'outer,
+            }
+        }
+        stepped.extend(landed);
+    }
+
+    assert_eq!(skipped.len(), NUM_KEYS as usize / SKIP);
+    assert_eq!(skipped, stepped);
+
+    cleanup(&path);
+}
+
 // ==================== Security Tests ====================
 
 /// Test that snapshot isolation prevents dirty reads.
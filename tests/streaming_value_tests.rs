@@ -0,0 +1,176 @@
+//! Summary: Tests for streaming large values in and out of buckets.
+//! Kept in their own test binary because they install a counting allocator.
+//! Copyright (c) YOAB. All rights reserved.
+
+use std::alloc::{GlobalAlloc, Layout, System};
+use std::cell::Cell;
+use std::fs;
+use std::io::{self, Read};
+
+use thunderdb::{Database, Error};
+
+/// Tracks the bytes allocated by the current thread, so tests running in
+/// parallel do not disturb each other's measurements.
+struct CountingAlloc;
+
+thread_local! {
+    static LIVE: Cell<usize> = const { Cell::new(0) };
+    static PEAK: Cell<usize> = const { Cell::new(0) };
+}
+
+fn record_alloc(size: usize) {
+    let _ = LIVE.try_with(|live| {
+        let now = live.get() + size;
+        live.set(now);
+        let _ = PEAK.try_with(|peak| peak.set(peak.get().max(now)));
+    });
+}
+
+fn record_dealloc(size: usize) {
+    let _ = LIVE.try_with(|live| live.set(live.get().saturating_sub(size)));
+}
+
+unsafe impl GlobalAlloc for CountingAlloc {
+    unsafe fn alloc(&self, layout: Layout) -> *mut u8 {
+        record_alloc(layout.size());
+        unsafe { System.alloc(layout) }
+    }
+
+    unsafe fn alloc_zeroed(&self, layout: Layout) -> *mut u8 {
+        record_alloc(layout.size());
+        unsafe { System.alloc_zeroed(layout) }
+    }
+
+    unsafe fn dealloc(&self, ptr: *mut u8, layout: Layout) {
+        record_dealloc(layout.size());
+        unsafe { System.dealloc(ptr, layout) }
+    }
+
+    unsafe fn realloc(&self, ptr: *mut u8, layout: Layout, new_size: usize) -> *mut u8 {
+        record_dealloc(layout.size());
+        record_alloc(new_size);
+        unsafe { System.realloc(ptr, layout, new_size) }
+    }
+}
+
+#[global_allocator]
+static ALLOC: CountingAlloc = CountingAlloc;
+
+/// Runs `f`, returning its result and the most memory the current thread
+/// held beyond what it held before.
+fn peak_growth<T>(f: impl FnOnce() -> T) -> (T, usize) {
+    let base = LIVE.with(Cell::get);
+    PEAK.with(|peak| peak.set(base));
+    let result = f();
+    (result, PEAK.with(Cell::get) - base)
+}
+
+fn test_db_path(name: &str) -> String {
+    format!("/tmp/thunder_streaming_test_{name}.db")
+}
+
+fn cleanup(path: &str) {
+    let _ = fs::remove_file(path);
+}
+
+/// Produces `len` bytes of a repeating pattern without buffering them.
+struct PatternReader {
+    pos: u64,
+    len: u64,
+}
+
+fn pattern_byte(pos: u64) -> u8 {
+    (pos % 251) as u8
+}
+
+impl Read for PatternReader {
+    fn read(&mut self, buf: &mut [u8]) -> io::Result<usize> {
+        let n = buf.len().min((self.len - self.pos) as usize);
+        for (i, byte) in buf[..n].iter_mut().enumerate() {
+            *byte = pattern_byte(self.pos + i as u64);
+        }
+        self.pos += n as u64;
+        Ok(n)
+    }
+}
+
+#[test]
+fn test_stream_large_value_with_bounded_memory() {
+    const SIZE: u64 = 50 * 1024 * 1024;
+    const SLACK: usize = 1024 * 1024;
+
+    let path = test_db_path("large_value");
+    cleanup(&path);
+
+    let mut db = Database::open(&path).expect("open should succeed");
+    {
+        let mut wtx = db.write_tx();
+        wtx.create_bucket(b"blobs").unwrap();
+        wtx.commit().expect("commit should succeed");
+    }
+
+    // Writing holds the staged value once, never a second copy.
+    let mut wtx = db.write_tx();
+    let (result, staged) = peak_growth(|| {
+        wtx.bucket_put_reader(
+            b"blobs",
+            b"video",
+            PatternReader { pos: 0, len: SIZE },
+            SIZE,
+        )
+    });
+    result.expect("put_reader should succeed");
+    assert!(
+        staged < SIZE as usize + SLACK,
+        "staging used {staged} bytes"
+    );
+    wtx.commit().expect("commit should succeed");
+
+    // Reading streams from the tree without copying the value.
+    let rtx = db.read_tx();
+    let bucket = rtx.bucket(b"blobs").unwrap();
+    let (read, used) = peak_growth(|| {
+        let mut reader = bucket.value_reader(b"video").expect("value exists");
+        let mut buf = vec![0u8; 64 * 1024];
+        let mut pos = 0u64;
+        loop {
+            let n = reader.read(&mut buf).unwrap();
+            if n == 0 {
+                break;
+            }
+            for (i, &byte) in buf[..n].iter().enumerate() {
+                assert_eq!(byte, pattern_byte(pos + i as u64));
+            }
+            pos += n as u64;
+        }
+        pos
+    });
+    assert_eq!(read, SIZE);
+    assert!(used < SLACK, "reading used {used} bytes");
+    assert!(bucket.value_reader(b"missing").is_none());
+    drop(rtx);
+
+    // The reader of a snapshot keeps the value it saw after an overwrite.
+    let snapshot = db.snapshot();
+    let mut wtx = db.write_tx();
+    wtx.bucket_put(b"blobs", b"video", b"replaced").unwrap();
+    wtx.commit().expect("commit should succeed");
+    {
+        let bucket = snapshot.bucket(b"blobs").unwrap();
+        let mut reader = bucket.value_reader(b"video").unwrap();
+        assert_eq!(io::copy(&mut reader, &mut io::sink()).unwrap(), SIZE);
+    }
+    drop(snapshot);
+
+    // A reader that ends early stages nothing.
+    let mut wtx = db.write_tx();
+    let err = wtx
+        .bucket_put_reader(b"blobs", b"short", PatternReader { pos: 0, len: 10 }, 20)
+        .unwrap_err();
+    assert!(matches!(err, Error::Io(ref e) if e.kind() == io::ErrorKind::UnexpectedEof));
+    assert_eq!(wtx.bucket_get(b"blobs", b"short").unwrap(), None);
+    drop(wtx);
+
+    drop(db);
+    cleanup(&path);
+}